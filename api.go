@@ -18,16 +18,66 @@
 package umoci
 
 import (
+	"os"
+	"strings"
+
+	"github.com/opencontainers/umoci/oci/cas"
+	"github.com/opencontainers/umoci/oci/cas/archive"
 	"github.com/opencontainers/umoci/oci/cas/dir"
 	"github.com/opencontainers/umoci/oci/casext"
 	"github.com/pkg/errors"
 )
 
+// ArchiveSuffix is the suffix used to indicate that a new image should be
+// created as an OCI image layout archive (a tar archive of an OCI image
+// layout, as used by the "oci-archive" transport of other tools) rather than
+// as an image layout directory.
+const ArchiveSuffix = ".tar"
+
+// IsArchive returns whether the given image path refers to an OCI image layout
+// archive rather than an image layout directory. Existing regular files are
+// treated as archives, as are non-existent paths ending in ArchiveSuffix.
+func IsArchive(imagePath string) bool {
+	fi, err := os.Stat(imagePath)
+	if err != nil {
+		return os.IsNotExist(err) && strings.HasSuffix(imagePath, ArchiveSuffix)
+	}
+	return fi.Mode().IsRegular()
+}
+
+// OpenEngine opens an existing OCI image layout (or image layout archive, see
+// IsArchive), and fails if it does not exist.
+func OpenEngine(imagePath string) (cas.Engine, error) {
+	if IsArchive(imagePath) {
+		return archive.Open(imagePath)
+	}
+	return dir.Open(imagePath)
+}
+
+// CreateEngine creates a new OCI image layout (or image layout archive, see
+// IsArchive), and fails if it already exists.
+func CreateEngine(imagePath string) error {
+	if IsArchive(imagePath) {
+		return archive.Create(imagePath)
+	}
+	return dir.Create(imagePath)
+}
+
+// MigrateEngine upgrades an existing outdated OCI image layout so that it can
+// be opened with OpenEngine, returning whether any changes were made (see
+// dir.Migrate). Image layout archives cannot be migrated.
+func MigrateEngine(imagePath string) (bool, error) {
+	if IsArchive(imagePath) {
+		return false, errors.Errorf("cannot migrate image layout archive %s: extract it first", imagePath)
+	}
+	return dir.Migrate(imagePath)
+}
+
 // OpenLayout opens an existing OCI image layout, and fails if it does not
 // exist.
 func OpenLayout(imagePath string) (casext.Engine, error) {
 	// Get a reference to the CAS.
-	engine, err := dir.Open(imagePath)
+	engine, err := OpenEngine(imagePath)
 	if err != nil {
 		return casext.Engine{}, errors.Wrap(err, "open CAS")
 	}
@@ -38,7 +88,7 @@ func OpenLayout(imagePath string) (casext.Engine, error) {
 // CreateLayout creates an existing OCI image layout, and fails if it already
 // exists.
 func CreateLayout(imagePath string) (casext.Engine, error) {
-	err := dir.Create(imagePath)
+	err := CreateEngine(imagePath)
 	if err != nil {
 		return casext.Engine{}, err
 	}
@@ -0,0 +1,346 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/opencontainers/umoci"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+// completeCommandName is the name of the hidden command used by the shell
+// completion scripts to compute completions.
+const completeCommandName = "__complete"
+
+const bashCompletion = `# bash completion for umoci(1)
+# Generated by "umoci completion bash".
+
+_umoci() {
+	local line="${COMP_LINE:0:COMP_POINT}"
+	local -a words
+	read -ra words <<<"$line"
+
+	local cur=""
+	if [[ "$line" != *[[:space:]] ]] && (( ${#words[@]} > 1 )); then
+		cur="${words[${#words[@]}-1]}"
+		unset 'words[${#words[@]}-1]'
+	fi
+
+	local IFS=$'\n'
+	COMPREPLY=($("${words[0]}" ` + completeCommandName + ` "${words[@]:1}" "$cur" 2>/dev/null))
+
+	# bash only replaces the part of the word after the last ':' or '=' (which
+	# are in COMP_WORDBREAKS), so strip that prefix from the completions.
+	local prefix="${cur%"${cur##*[:=]}"}"
+	if [[ -n "$prefix" && "$COMP_WORDBREAKS" == *[:=]* ]]; then
+		COMPREPLY=("${COMPREPLY[@]#"$prefix"}")
+	fi
+}
+
+complete -o default -F _umoci umoci
+`
+
+const zshCompletion = `#compdef umoci
+# zsh completion for umoci(1)
+# Generated by "umoci completion zsh".
+
+_umoci() {
+	local -a completions
+	completions=("${(@f)$("${words[1]}" ` + completeCommandName + ` "${(@)words[2,CURRENT-1]}" "${words[CURRENT]}" 2>/dev/null)}")
+	completions=(${completions:#})
+
+	if (( ${#completions} )); then
+		compadd -Q -- "${completions[@]}"
+	else
+		_files
+	fi
+}
+
+if [[ "${funcstack[1]}" == "_umoci" ]]; then
+	_umoci "$@"
+else
+	compdef _umoci umoci
+fi
+`
+
+const fishCompletion = `# fish completion for umoci(1)
+# Generated by "umoci completion fish".
+
+function __umoci_complete
+	set -l tokens (commandline -opc)
+	set -l current (commandline -ct)
+	set -l completions ($tokens[1] ` + completeCommandName + ` $tokens[2..-1] $current 2>/dev/null)
+	if test (count $completions) -eq 0
+		__fish_complete_path $current
+	else
+		printf '%s\n' $completions
+	end
+end
+
+complete -c umoci -f -a '(__umoci_complete)'
+`
+
+var completionScripts = map[string]string{
+	"bash": bashCompletion,
+	"zsh":  zshCompletion,
+	"fish": fishCompletion,
+}
+
+var completionCommand = cli.Command{
+	Name:  "completion",
+	Usage: "outputs a shell completion script for umoci",
+	ArgsUsage: `<shell>
+
+Where "<shell>" is the shell to output a completion script for, and is one of
+"bash", "zsh" or "fish".
+
+The completion script completes subcommands and flags, as well as the tags
+of the image given to --image (once the path has been entered). For example,
+to enable completion for the current bash session:
+
+    % source <(umoci completion bash)`,
+
+	Action: completion,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 1 {
+			return errors.Errorf("invalid number of positional arguments: expected <shell>")
+		}
+		if _, ok := completionScripts[ctx.Args().First()]; !ok {
+			return errors.Errorf("unsupported shell %q: must be one of bash, zsh or fish", ctx.Args().First())
+		}
+		return nil
+	},
+}
+
+func completion(ctx *cli.Context) error {
+	_, err := fmt.Fprint(ctx.App.Writer, completionScripts[ctx.Args().First()])
+	return err
+}
+
+// completeCommand outputs the completions (one per line) for the last of its
+// arguments, given the preceding arguments to umoci. It is used by the
+// completion scripts and is not intended to be used directly.
+var completeCommand = cli.Command{
+	Name:            completeCommandName,
+	Hidden:          true,
+	HideHelp:        true,
+	SkipFlagParsing: true,
+
+	Action: func(ctx *cli.Context) error {
+		args := ctx.Args()
+		if len(args) == 0 {
+			return nil
+		}
+		for _, candidate := range completeArgs(ctx.App, args[:len(args)-1], args[len(args)-1]) {
+			fmt.Fprintln(ctx.App.Writer, candidate)
+		}
+		return nil
+	},
+}
+
+// flagNames returns all of the names of a flag (including the leading dashes).
+func flagNames(flag cli.Flag) []string {
+	var names []string
+	for _, name := range strings.Split(flag.GetName(), ",") {
+		name = strings.TrimSpace(name)
+		switch len(name) {
+		case 0:
+			continue
+		case 1:
+			names = append(names, "-"+name)
+		default:
+			names = append(names, "--"+name)
+		}
+	}
+	return names
+}
+
+// flagHidden returns whether the flag is hidden (all of the cli.Flag types
+// have a Hidden field, but it is not part of the interface).
+func flagHidden(flag cli.Flag) bool {
+	v := reflect.Indirect(reflect.ValueOf(flag))
+	if v.Kind() != reflect.Struct {
+		return false
+	}
+	hidden := v.FieldByName("Hidden")
+	return hidden.IsValid() && hidden.Kind() == reflect.Bool && hidden.Bool()
+}
+
+// flagTakesValue returns whether the given flag requires a value.
+func flagTakesValue(flag cli.Flag) bool {
+	switch flag.(type) {
+	case cli.BoolFlag, *cli.BoolFlag, cli.BoolTFlag, *cli.BoolTFlag:
+		return false
+	}
+	return true
+}
+
+// lookupFlag returns the flag with the given name (with its leading dashes).
+func lookupFlag(flags []cli.Flag, name string) cli.Flag {
+	for _, flag := range flags {
+		for _, flagName := range flagNames(flag) {
+			if flagName == name {
+				return flag
+			}
+		}
+	}
+	return nil
+}
+
+// lookupCommand returns the (non-hidden) command with the given name.
+func lookupCommand(cmds []cli.Command, name string) *cli.Command {
+	for idx, cmd := range cmds {
+		if !cmd.Hidden && cmd.HasName(name) {
+			return &cmds[idx]
+		}
+	}
+	return nil
+}
+
+// completeArgs returns the set of completions for cur, given the preceding
+// set of arguments (not including argv[0]).
+func completeArgs(app *cli.App, words []string, cur string) []string {
+	flags := append([]cli.Flag{}, app.Flags...)
+	cmds := app.Commands
+
+	var pendingFlag string
+	for idx := 0; idx < len(words); idx++ {
+		word := words[idx]
+		if strings.HasPrefix(word, "-") && word != "-" {
+			if strings.Contains(word, "=") {
+				continue
+			}
+			if flag := lookupFlag(flags, word); flag != nil && flagTakesValue(flag) {
+				if idx+1 == len(words) {
+					pendingFlag = word
+				}
+				idx++
+			}
+			continue
+		}
+		if cmd := lookupCommand(cmds, word); cmd != nil {
+			flags = append([]cli.Flag{}, cmd.Flags...)
+			if !cmd.HideHelp {
+				flags = append(flags, cli.HelpFlag)
+			}
+			cmds = cmd.Subcommands
+		}
+	}
+
+	// The value of a flag.
+	if pendingFlag != "" {
+		return completeFlagValue(pendingFlag, "", cur)
+	}
+	if strings.HasPrefix(cur, "-") {
+		if idx := strings.Index(cur, "="); idx >= 0 {
+			name, value := cur[:idx], cur[idx+1:]
+			return completeFlagValue(name, name+"=", value)
+		}
+		var candidates []string
+		for _, flag := range flags {
+			if flagHidden(flag) {
+				continue
+			}
+			for _, name := range flagNames(flag) {
+				if strings.HasPrefix(name, cur) {
+					candidates = append(candidates, name)
+				}
+			}
+		}
+		sort.Strings(candidates)
+		return candidates
+	}
+
+	// Otherwise, the argument can only be completed if it's a subcommand.
+	var candidates []string
+	for _, cmd := range cmds {
+		if cmd.Hidden {
+			continue
+		}
+		for _, name := range cmd.Names() {
+			if strings.HasPrefix(name, cur) {
+				candidates = append(candidates, name)
+			}
+		}
+	}
+	sort.Strings(candidates)
+	return candidates
+}
+
+// completeFlagValue returns the completions for the value of the given flag,
+// with each completion prefixed with prefix.
+func completeFlagValue(flag, prefix, cur string) []string {
+	var values []string
+	switch flag {
+	case "--image":
+		values = completeImage(cur)
+	case "--log":
+		values = []string{"debug", "info", "warn", "error", "fatal"}
+	case "--log-format":
+		values = []string{"text", "json"}
+	case "--rootless-devices":
+		values = []string{"placeholder", "skip", "error"}
+	}
+
+	var candidates []string
+	for _, value := range values {
+		if strings.HasPrefix(value, cur) {
+			candidates = append(candidates, prefix+value)
+		}
+	}
+	return candidates
+}
+
+// completeImage returns the "<path>:<tag>" completions for an --image value,
+// by reading the tags from the image at <path>. If the image path is not
+// (yet) a valid image, no completions are returned so that the shell falls
+// back to completing the path.
+func completeImage(cur string) []string {
+	imagePath := cur
+	if idx := strings.Index(cur, ":"); idx >= 0 {
+		imagePath = cur[:idx]
+	}
+	if imagePath == "" {
+		return nil
+	}
+	engine, err := umoci.OpenEngine(imagePath)
+	if err != nil {
+		return nil
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	names, err := engineExt.ListReferences(context.Background())
+	if err != nil {
+		return nil
+	}
+	var candidates []string
+	for _, name := range names {
+		candidates = append(candidates, imagePath+":"+name)
+	}
+	sort.Strings(candidates)
+	return candidates
+}
@@ -19,13 +19,14 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/apex/log"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/opencontainers/umoci/mutate"
-	"github.com/opencontainers/umoci/oci/cas/dir"
 	"github.com/opencontainers/umoci/oci/casext"
 	igen "github.com/opencontainers/umoci/oci/config/generate"
 	"github.com/pkg/errors"
@@ -60,6 +61,19 @@ image.`,
 		if _, ok := ctx.App.Metadata["--image-tag"]; !ok {
 			return errors.Errorf("missing mandatory argument: --image")
 		}
+		if ctx.IsSet("config.entrypoint") && ctx.IsSet("config.entrypoint-json") {
+			return errors.Errorf("--config.entrypoint and --config.entrypoint-json are mutually exclusive")
+		}
+		if ctx.Bool("clear-history") {
+			for _, flag := range []string{"history.author", "history.comment", "history.created", "history.created_by"} {
+				if ctx.IsSet(flag) {
+					return errors.Errorf("--clear-history and --%s may not be specified together", flag)
+				}
+			}
+		}
+		if ctx.IsSet("config.cmd") && ctx.IsSet("config.cmd-json") {
+			return errors.Errorf("--config.cmd and --config.cmd-json are mutually exclusive")
+		}
 		return nil
 	},
 
@@ -81,21 +95,73 @@ image.`,
 		cli.StringSliceFlag{Name: "config.env"},
 		cli.StringSliceFlag{Name: "config.entrypoint"}, // FIXME: This interface is weird.
 		cli.StringSliceFlag{Name: "config.cmd"},        // FIXME: This interface is weird.
+		cli.StringFlag{Name: "config.entrypoint-json"},
+		cli.StringFlag{Name: "config.cmd-json"},
 		cli.StringSliceFlag{Name: "config.volume"},
 		cli.StringSliceFlag{Name: "config.label"},
+		cli.StringSliceFlag{Name: "config.remove-volume"},
+		cli.StringSliceFlag{Name: "config.remove-label"},
 		cli.StringFlag{Name: "config.workingdir"},
 		cli.StringFlag{Name: "config.stopsignal"},
 		cli.StringFlag{Name: "created"}, // FIXME: Implement TimeFlag.
 		cli.StringFlag{Name: "author"},
 		cli.StringFlag{Name: "architecture"},
 		cli.StringFlag{Name: "os"},
+		cli.StringFlag{Name: "variant"},
 		cli.StringSliceFlag{Name: "manifest.annotation"},
 		cli.StringSliceFlag{Name: "clear"},
+		cli.BoolFlag{Name: "clear-history"},
 	},
 
 	Action: config,
 }))
 
+// isConfigChangeFlag returns whether the umoci-config(1) flag with the given
+// name modifies the image (as opposed to controlling the history entry or the
+// tag of the new image).
+func isConfigChangeFlag(name string) bool {
+	if strings.HasPrefix(name, "config.") || strings.HasPrefix(name, "manifest.") {
+		return true
+	}
+	switch name {
+	case "created", "author", "architecture", "os", "variant", "clear":
+		return true
+	}
+	return false
+}
+
+// shellQuote quotes arg (if necessary) so that it can be pasted into a shell.
+func shellQuote(arg string) string {
+	if arg != "" && strings.Trim(arg, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789@%+=:,./-_") == "" {
+		return arg
+	}
+	return "'" + strings.ReplaceAll(arg, "'", `'"'"'`) + "'"
+}
+
+// configCreatedBy returns the default created_by value of the history entry
+// for a umoci-config(1) invocation, which describes the changes made to the
+// image in the form of the flags used to make them (such as "umoci config
+// --config.env=FOO=bar").
+func configCreatedBy(ctx *cli.Context) string {
+	createdBy := []string{"umoci config"}
+	for _, flag := range ctx.Command.Flags {
+		name := flag.GetName()
+		if !isConfigChangeFlag(name) || !ctx.IsSet(name) {
+			continue
+		}
+		var values []string
+		if _, ok := flag.(cli.StringSliceFlag); ok {
+			values = ctx.StringSlice(name)
+		} else {
+			values = []string{ctx.String(name)}
+		}
+		for _, value := range values {
+			createdBy = append(createdBy, "--"+name+"="+shellQuote(value))
+		}
+	}
+	return strings.Join(createdBy, " ")
+}
+
 func toImage(config ispec.ImageConfig, meta mutate.Meta) ispec.Image {
 	created := meta.Created
 	return ispec.Image{
@@ -136,6 +202,121 @@ func parseKV(input string) (string, string, error) {
 	return name, value, nil
 }
 
+// parseJSONArgs parses a JSON array of strings (as used by the *-json
+// variants of --config.entrypoint and --config.cmd).
+func parseJSONArgs(input string) ([]string, error) {
+	var args []string
+	if err := json.Unmarshal([]byte(input), &args); err != nil {
+		return nil, errors.Wrapf(err, "parse JSON array %q", input)
+	}
+	if args == nil {
+		return nil, errors.Errorf("must be a JSON array of strings: %s", input)
+	}
+	return args, nil
+}
+
+// stopSignals is the set of (Linux) signal names which are permitted as the
+// stop signal of an image. We don't use the host's signal table, as the image
+// need not be for the host's platform.
+var stopSignals = map[string]struct{}{
+	"SIGABRT": {}, "SIGALRM": {}, "SIGBUS": {}, "SIGCHLD": {}, "SIGCONT": {},
+	"SIGFPE": {}, "SIGHUP": {}, "SIGILL": {}, "SIGINT": {}, "SIGIO": {},
+	"SIGIOT": {}, "SIGKILL": {}, "SIGPIPE": {}, "SIGPOLL": {}, "SIGPROF": {},
+	"SIGPWR": {}, "SIGQUIT": {}, "SIGSEGV": {}, "SIGSTKFLT": {}, "SIGSTOP": {},
+	"SIGSYS": {}, "SIGTERM": {}, "SIGTRAP": {}, "SIGTSTP": {}, "SIGTTIN": {},
+	"SIGTTOU": {}, "SIGURG": {}, "SIGUSR1": {}, "SIGUSR2": {}, "SIGVTALRM": {},
+	"SIGWINCH": {}, "SIGXCPU": {}, "SIGXFSZ": {}, "SIGRTMIN": {}, "SIGRTMAX": {},
+}
+
+// maxSignal is the largest valid (Linux) signal number.
+const maxSignal = 64
+
+// parseStopSignal validates a stop signal given to --config.stopsignal, which
+// may either be a signal number or a signal name (with or without the "SIG"
+// prefix, and in any case). Real-time signals can also be given relative to
+// SIGRTMIN or SIGRTMAX (such as "SIGRTMIN+3"). Signal names are returned in
+// their canonical "SIGNAME" form, while signal numbers are returned as-is. An
+// empty stop signal (which unsets the stop signal) is also permitted.
+func parseStopSignal(input string) (string, error) {
+	if input == "" {
+		return "", nil
+	}
+	if num, err := strconv.Atoi(input); err == nil {
+		if num <= 0 || num > maxSignal {
+			return "", errors.Errorf("invalid signal number %d: must be in the range [1, %d]", num, maxSignal)
+		}
+		return input, nil
+	}
+
+	name := strings.ToUpper(input)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	base := name
+	if idx := strings.IndexAny(name, "+-"); idx >= 0 {
+		base = name[:idx]
+		if base != "SIGRTMIN" && base != "SIGRTMAX" {
+			return "", errors.Errorf("invalid signal %q: only SIGRTMIN and SIGRTMAX can have an offset", input)
+		}
+		// SIGRTMIN is 34 and SIGRTMAX is 64 on Linux.
+		offset, err := strconv.Atoi(name[idx+1:])
+		if err != nil || offset < 0 || offset > 30 {
+			return "", errors.Errorf("invalid signal %q: real-time signal offset must be in the range [0, 30]", input)
+		}
+		if offset > 0 && ((base == "SIGRTMIN") != (name[idx] == '+')) {
+			return "", errors.Errorf("invalid signal %q: SIGRTMIN can only have positive offsets and SIGRTMAX only negative offsets", input)
+		}
+	}
+	if _, ok := stopSignals[base]; !ok {
+		return "", errors.Errorf("unknown signal %q", input)
+	}
+	return name, nil
+}
+
+// knownOSes and knownArchitectures are the GOOS and GOARCH values known to
+// Go, which are the values image-spec recommends for the platform of an image.
+var (
+	knownOSes = map[string]struct{}{
+		"aix": {}, "android": {}, "darwin": {}, "dragonfly": {}, "freebsd": {},
+		"hurd": {}, "illumos": {}, "ios": {}, "js": {}, "linux": {}, "nacl": {},
+		"netbsd": {}, "openbsd": {}, "plan9": {}, "solaris": {}, "windows": {},
+		"zos": {},
+	}
+	knownArchitectures = map[string]struct{}{
+		"386": {}, "amd64": {}, "amd64p32": {}, "arm": {}, "armbe": {},
+		"arm64": {}, "arm64be": {}, "loong64": {}, "mips": {}, "mipsle": {},
+		"mips64": {}, "mips64le": {}, "mips64p32": {}, "mips64p32le": {},
+		"ppc": {}, "ppc64": {}, "ppc64le": {}, "riscv": {}, "riscv64": {},
+		"s390": {}, "s390x": {}, "sparc": {}, "sparc64": {}, "wasm": {},
+	}
+	// knownVariants are the commonly-used CPU variants for each architecture
+	// which has variants.
+	knownVariants = map[string]map[string]struct{}{
+		"amd64": {"v1": {}, "v2": {}, "v3": {}, "v4": {}},
+		"arm":   {"v6": {}, "v7": {}, "v8": {}},
+		"arm64": {"v8": {}},
+	}
+)
+
+// warnUnknownPlatform warns about any part of the given platform which is not
+// a known value. Arbitrary values are permitted in image configurations, but
+// unusual values are likely to be a mistake.
+func warnUnknownPlatform(os, arch, variant string) {
+	if _, ok := knownOSes[os]; !ok {
+		log.Warnf("unknown os %q: the image might not be usable on any platform", os)
+	}
+	if _, ok := knownArchitectures[arch]; !ok {
+		log.Warnf("unknown architecture %q: the image might not be usable on any platform", arch)
+	}
+	if variant != "" {
+		if variants, ok := knownVariants[arch]; !ok {
+			log.Warnf("variant %q specified for architecture %q which has no known variants", variant, arch)
+		} else if _, ok := variants[variant]; !ok {
+			log.Warnf("unknown variant %q for architecture %q", variant, arch)
+		}
+	}
+}
+
 func config(ctx *cli.Context) error {
 	imagePath := ctx.App.Metadata["--image-path"].(string)
 	fromName := ctx.App.Metadata["--image-tag"].(string)
@@ -147,7 +328,7 @@ func config(ctx *cli.Context) error {
 	}
 
 	// Get a reference to the CAS.
-	engine, err := dir.Open(imagePath)
+	engine, err := openEngine(ctx, imagePath)
 	if err != nil {
 		return errors.Wrap(err, "open CAS")
 	}
@@ -159,11 +340,11 @@ func config(ctx *cli.Context) error {
 		return errors.Wrap(err, "get descriptor")
 	}
 	if len(fromDescriptorPaths) == 0 {
-		return errors.Errorf("tag not found: %s", fromName)
+		return errors.Wrap(casext.ErrReferenceNotFound, fromName)
 	}
 	if len(fromDescriptorPaths) != 1 {
 		// TODO: Handle this more nicely.
-		return errors.Errorf("tag is ambiguous: %s", fromName)
+		return errors.Wrap(casext.ErrAmbiguousReference, fromName)
 	}
 
 	mutator, err := mutate.New(engine, fromDescriptorPaths[0])
@@ -216,6 +397,28 @@ func config(ctx *cli.Context) error {
 			}
 		}
 	}
+	// Removals are applied before any of the additions, so that removing and
+	// re-adding an entry in the same invocation re-adds it.
+	if ctx.IsSet("config.remove-volume") {
+		volumes := g.ConfigVolumes()
+		for _, volume := range ctx.StringSlice("config.remove-volume") {
+			if _, ok := volumes[volume]; !ok {
+				log.Warnf("config.remove-volume: volume %q is not present in the image config", volume)
+				continue
+			}
+			g.RemoveConfigVolume(volume)
+		}
+	}
+	if ctx.IsSet("config.remove-label") {
+		labels := g.ConfigLabels()
+		for _, label := range ctx.StringSlice("config.remove-label") {
+			if _, ok := labels[label]; !ok {
+				log.Warnf("config.remove-label: label %q is not present in the image config", label)
+				continue
+			}
+			g.RemoveConfigLabel(label)
+		}
+	}
 
 	if ctx.IsSet("created") {
 		// How do we handle other formats?
@@ -224,6 +427,10 @@ func config(ctx *cli.Context) error {
 			return errors.Wrap(err, "parse --created")
 		}
 		g.SetCreated(created)
+	} else if epoch, ok, err := mutate.SourceDateEpoch(); err != nil {
+		return err
+	} else if ok {
+		g.SetCreated(epoch)
 	}
 	if ctx.IsSet("author") {
 		g.SetAuthor(ctx.String("author"))
@@ -234,11 +441,22 @@ func config(ctx *cli.Context) error {
 	if ctx.IsSet("os") {
 		g.SetOS(ctx.String("os"))
 	}
+	variant := imageMeta.Variant
+	if ctx.IsSet("variant") {
+		variant = ctx.String("variant")
+	}
+	if ctx.IsSet("os") || ctx.IsSet("architecture") || ctx.IsSet("variant") {
+		warnUnknownPlatform(g.OS(), g.Architecture(), variant)
+	}
 	if ctx.IsSet("config.user") {
 		g.SetConfigUser(ctx.String("config.user"))
 	}
 	if ctx.IsSet("config.stopsignal") {
-		g.SetConfigStopSignal(ctx.String("config.stopsignal"))
+		stopSignal, err := parseStopSignal(ctx.String("config.stopsignal"))
+		if err != nil {
+			return errors.Wrap(err, "config.stopsignal")
+		}
+		g.SetConfigStopSignal(stopSignal)
 	}
 	if ctx.IsSet("config.workingdir") {
 		g.SetConfigWorkingDir(ctx.String("config.workingdir"))
@@ -261,10 +479,24 @@ func config(ctx *cli.Context) error {
 	if ctx.IsSet("config.entrypoint") {
 		g.SetConfigEntrypoint(ctx.StringSlice("config.entrypoint"))
 	}
+	if ctx.IsSet("config.entrypoint-json") {
+		entrypoint, err := parseJSONArgs(ctx.String("config.entrypoint-json"))
+		if err != nil {
+			return errors.Wrap(err, "config.entrypoint-json")
+		}
+		g.SetConfigEntrypoint(entrypoint)
+	}
 	// FIXME: This interface is weird.
 	if ctx.IsSet("config.cmd") {
 		g.SetConfigCmd(ctx.StringSlice("config.cmd"))
 	}
+	if ctx.IsSet("config.cmd-json") {
+		cmd, err := parseJSONArgs(ctx.String("config.cmd-json"))
+		if err != nil {
+			return errors.Wrap(err, "config.cmd-json")
+		}
+		g.SetConfigCmd(cmd)
+	}
 	if ctx.IsSet("config.volume") {
 		for _, volume := range ctx.StringSlice("config.volume") {
 			g.AddConfigVolume(volume)
@@ -289,14 +521,23 @@ func config(ctx *cli.Context) error {
 		}
 	}
 
+	if ctx.Bool("clear-history") {
+		if err := mutator.ClearHistory(context.Background()); err != nil {
+			return errors.Wrap(err, "clear history")
+		}
+	}
+
 	var history *ispec.History
-	if !ctx.Bool("no-history") {
-		created := time.Now()
+	if !ctx.Bool("no-history") && !ctx.Bool("clear-history") {
+		created, err := historyCreated(ctx)
+		if err != nil {
+			return err
+		}
 		history = &ispec.History{
 			Author:     g.Author(),
 			Comment:    "",
 			Created:    &created,
-			CreatedBy:  "umoci config",
+			CreatedBy:  configCreatedBy(ctx),
 			EmptyLayer: true,
 		}
 
@@ -306,19 +547,13 @@ func config(ctx *cli.Context) error {
 		if ctx.IsSet("history.comment") {
 			history.Comment = ctx.String("history.comment")
 		}
-		if ctx.IsSet("history.created") {
-			created, err := time.Parse(igen.ISO8601, ctx.String("history.created"))
-			if err != nil {
-				return errors.Wrap(err, "parsing --history.created")
-			}
-			history.Created = &created
-		}
 		if ctx.IsSet("history.created_by") {
 			history.CreatedBy = ctx.String("history.created_by")
 		}
 	}
 
 	newConfig, newMeta := fromImage(g.Image())
+	newMeta.Variant = variant
 	if err := mutator.Set(context.Background(), newConfig, newMeta, annotations, history); err != nil {
 		return errors.Wrap(err, "set modified configuration")
 	}
@@ -0,0 +1,127 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/docker/go-units"
+	"github.com/opencontainers/umoci"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+var copyCommand = cli.Command{
+	Name:  "copy",
+	Usage: "copies an image from one OCI image layout to another",
+	ArgsUsage: `--image <image-path>[:<tag>] --to <dest-path>[:<new-tag>]
+
+Where "<image-path>" is the path to the source OCI image, "<tag>" is the name
+of the tag to copy, "<dest-path>" is the path to the destination OCI image
+(which must already exist) and "<new-tag>" is the name of the tag the image
+will be saved as in the destination (if not specified, defaults to "<tag>").
+
+All of the blobs of the image are copied verbatim (layers are not decompressed
+or recompressed) and their digests are verified. Blobs which already exist in
+the destination are re-used.`,
+
+	// copy modifies an image layout.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "to",
+			Usage: "destination OCI image URI of the form 'path[:tag]'",
+		},
+	},
+
+	Action: copyImage,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		fromName := ctx.App.Metadata["--image-tag"].(string)
+		if isSelectorReference(fromName) {
+			return errors.Errorf("--image must refer to a tag, not an annotation or digest reference")
+		}
+		if ctx.String("to") == "" {
+			return errors.Errorf("missing mandatory argument: --to")
+		}
+		to := ctx.String("to")
+		if !strings.Contains(to, ":") {
+			to += ":" + fromName
+		}
+		dir, tag, err := parseImageURI(to)
+		if err != nil {
+			return errors.Wrap(err, "invalid --to")
+		}
+		if isSelectorReference(tag) {
+			return errors.Errorf("invalid --to: cannot copy to an annotation or digest reference")
+		}
+		ctx.App.Metadata["--to-path"] = dir
+		ctx.App.Metadata["--to-tag"] = tag
+		return nil
+	},
+}
+
+func copyImage(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	fromName := ctx.App.Metadata["--image-tag"].(string)
+	toPath := ctx.App.Metadata["--to-path"].(string)
+	toName := ctx.App.Metadata["--to-tag"].(string)
+
+	// Get a reference to the source CAS.
+	srcEngine, err := openEngine(ctx, imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open source CAS")
+	}
+	srcEngineExt := casext.NewEngine(srcEngine)
+	defer srcEngine.Close()
+
+	// Get a reference to the destination CAS. Additional blob stores are only
+	// used for the source, so that every blob is copied to the destination.
+	dstEngine, err := umoci.OpenEngine(toPath)
+	if err != nil {
+		return errors.Wrap(err, "open destination CAS")
+	}
+	dstEngineExt := casext.NewEngine(dstEngine)
+	defer dstEngine.Close()
+
+	root, err := srcEngineExt.ReferenceDescriptor(context.Background(), fromName)
+	if err != nil {
+		return errors.Wrap(err, "get descriptor")
+	}
+
+	stats, err := srcEngineExt.Copy(context.Background(), dstEngineExt, root)
+	if err != nil {
+		return errors.Wrap(err, "copy image")
+	}
+
+	// Only tag the image once all of its blobs have been copied.
+	if err := dstEngineExt.UpdateReference(context.Background(), toName, root); err != nil {
+		return errors.Wrap(err, "put reference")
+	}
+
+	log.Infof("copied %d blobs (%s), re-used %d existing blobs", stats.Blobs, units.HumanSize(float64(stats.Bytes)), stats.Existing)
+	log.Infof("copied image: %s:%s -> %s:%s", imagePath, fromName, toPath, toName)
+	return nil
+}
@@ -0,0 +1,152 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/opencontainers/umoci"
+	"github.com/opencontainers/umoci/oci/cas"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+var diffCommand = uxPlatform(cli.Command{
+	Name:  "diff",
+	Usage: "shows the filesystem differences between two images",
+	ArgsUsage: `--image <image-path>[:<tag>] <new-image-path>[:<new-tag>]
+
+Where "<image-path>" and "<new-image-path>" are the paths to the OCI images
+(which may be the same image), and "<tag>" and "<new-tag>" are the names of the
+tagged images to compare. The root filesystems of the images are compared
+without extracting them.
+
+WARNING: Do not depend on the output of this tool unless you're using --json.
+The intention of the default formatting of this tool is that it is easy for
+humans to read, and might change in future versions.`,
+
+	// diff reads two images.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "output the differences as a JSON encoded blob",
+		},
+	},
+
+	Action: diff,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 1 {
+			return errors.Errorf("invalid number of positional arguments: expected <new-image-path>[:<new-tag>]")
+		}
+		dir, tag, err := parseImageURI(ctx.Args().First())
+		if err != nil {
+			return errors.Wrap(err, "invalid <new-image-path>[:<new-tag>]")
+		}
+		ctx.App.Metadata["new-image-path"] = dir
+		ctx.App.Metadata["new-image-tag"] = tag
+		return nil
+	},
+})
+
+// formatDiffKey returns the human-readable form of a keyword difference.
+func formatDiffKey(key umoci.FileDiffKey) string {
+	value := func(v *string) string {
+		if v == nil {
+			return "<none>"
+		}
+		return *v
+	}
+	return fmt.Sprintf("%s: %s -> %s", key.Keyword, value(key.Old), value(key.New))
+}
+
+func diff(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	tagName := ctx.App.Metadata["--image-tag"].(string)
+	newImagePath := ctx.App.Metadata["new-image-path"].(string)
+	newTagName := ctx.App.Metadata["new-image-tag"].(string)
+
+	// Get a reference to the CAS (or both, if they are different images).
+	engine, err := openEngine(ctx, imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine).WithBlobCache(casext.DefaultBlobCacheSize)
+	defer engine.Close()
+
+	newEngineExt := engineExt
+	if newImagePath != imagePath {
+		var newEngine cas.Engine
+		newEngine, err = openEngine(ctx, newImagePath)
+		if err != nil {
+			return errors.Wrap(err, "open new CAS")
+		}
+		newEngineExt = casext.NewEngine(newEngine).WithBlobCache(casext.DefaultBlobCacheSize)
+		defer newEngine.Close()
+	}
+
+	oldDescriptorPath, err := umoci.ResolveReference(context.Background(), engineExt, tagName, platformMetadata(ctx))
+	if err != nil {
+		return err
+	}
+	newDescriptorPath, err := umoci.ResolveReference(context.Background(), newEngineExt, newTagName, platformMetadata(ctx))
+	if err != nil {
+		return errors.Wrap(err, "resolve new image")
+	}
+
+	diffs, err := umoci.Diff(context.Background(), engineExt, newEngineExt, oldDescriptorPath.Descriptor(), newDescriptorPath.Descriptor())
+	if err != nil {
+		return errors.Wrap(err, "diff")
+	}
+
+	if ctx.Bool("json") {
+		if err := json.NewEncoder(os.Stdout).Encode(diffs); err != nil {
+			return errors.Wrap(err, "encoding diff")
+		}
+		return nil
+	}
+
+	printFileDiffs(diffs)
+	return nil
+}
+
+// printFileDiffs outputs the human-readable form of a set of differences
+// (one path per line, prefixed with A, M or D).
+func printFileDiffs(diffs []umoci.FileDiff) {
+	for _, diff := range diffs {
+		switch diff.Type {
+		case umoci.FileAdded:
+			fmt.Printf("A %s\n", diff.Path)
+		case umoci.FileRemoved:
+			fmt.Printf("D %s\n", diff.Path)
+		case umoci.FileModified:
+			var keys []string
+			for _, key := range diff.Keys {
+				keys = append(keys, formatDiffKey(key))
+			}
+			fmt.Printf("M %s (%s)\n", diff.Path, strings.Join(keys, ", "))
+		}
+	}
+}
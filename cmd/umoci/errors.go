@@ -0,0 +1,143 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"regexp"
+
+	"github.com/opencontainers/umoci/oci/cas"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/opencontainers/umoci/oci/registry"
+	"github.com/opencontainers/umoci/pkg/hardening"
+	"github.com/pkg/errors"
+)
+
+// Error codes output with --errors-json. These are part of umoci's interface
+// for scripts, and so must never be changed (though new codes may be added).
+const (
+	// errCodeTagNotFound means that a tag does not exist in the image (or has
+	// no image for the requested platform).
+	errCodeTagNotFound = "tag_not_found"
+	// errCodeAmbiguousReference means that a tag (or digest reference) refers
+	// to more than one image.
+	errCodeAmbiguousReference = "ambiguous_reference"
+	// errCodeBlobNotFound means that a blob is missing from the image.
+	errCodeBlobNotFound = "blob_not_found"
+	// errCodeBlobCorrupt means that a blob does not match its digest or size.
+	errCodeBlobCorrupt = "blob_corrupt"
+	// errCodeInvalidLayout means that the image layout is invalid or uses an
+	// unsupported layout version.
+	errCodeInvalidLayout = "invalid_layout"
+	// errCodeAlreadyExists means that the operation would have overwritten an
+	// existing tag or blob.
+	errCodeAlreadyExists = "already_exists"
+	// errCodeRegistryNotFound means that an image or blob does not exist in a
+	// registry.
+	errCodeRegistryNotFound = "registry_not_found"
+	// errCodeTimeout means that a registry request made no progress within
+	// the --timeout, or that the operation did not complete within the
+	// --deadline.
+	errCodeTimeout = "timeout"
+	// errCodePermissionDenied means that umoci did not have the necessary
+	// permissions for an operation (see --rootless).
+	errCodePermissionDenied = "permission_denied"
+	// errCodeUnknown is used for all other errors.
+	errCodeUnknown = "unknown"
+)
+
+// errorCode returns the --errors-json error code for the given error. Errors
+// which match several codes (such as a corrupt blob in a registry) use the
+// most specific one.
+func errorCode(err error) string {
+	switch {
+	case errors.Is(err, casext.ErrReferenceNotFound):
+		return errCodeTagNotFound
+	case errors.Is(err, casext.ErrAmbiguousReference):
+		return errCodeAmbiguousReference
+	case errors.Is(err, hardening.ErrDigestMismatch), errors.Is(err, hardening.ErrSizeMismatch):
+		return errCodeBlobCorrupt
+	case errors.Is(err, registry.ErrTimeout), errors.Is(err, context.DeadlineExceeded):
+		return errCodeTimeout
+	case errors.Is(err, registry.ErrNotFound):
+		return errCodeRegistryNotFound
+	case errors.Is(err, cas.ErrNotExist):
+		return errCodeBlobNotFound
+	case errors.Is(err, cas.ErrInvalid):
+		return errCodeInvalidLayout
+	case errors.Is(err, cas.ErrClobber):
+		return errCodeAlreadyExists
+	case os.IsPermission(errors.Cause(err)), errors.Is(err, os.ErrPermission):
+		return errCodePermissionDenied
+	default:
+		return errCodeUnknown
+	}
+}
+
+// errorDigestRegexp matches the blob digests included in error messages.
+var errorDigestRegexp = regexp.MustCompile(regexp.QuoteMeta(cas.BlobAlgorithm.String()) + `:[a-f0-9]{64}`)
+
+// jsonError is the object output by --errors-json when umoci fails.
+type jsonError struct {
+	// Code is one of the errCode* values.
+	Code string `json:"code"`
+	// Message is the full error message (as output without --errors-json).
+	Message string `json:"message"`
+	// Image is the --image or --layout path (or registry reference) the
+	// command was operating on, if any.
+	Image string `json:"image,omitempty"`
+	// Tag is the tag of --image the command was operating on, if any.
+	Tag string `json:"tag,omitempty"`
+	// Digest is the first blob digest mentioned in the error, if any. This is
+	// usually the blob which caused the error.
+	Digest string `json:"digest,omitempty"`
+}
+
+// reportedError is returned by Main for errors which have already been output
+// with --errors-json, and so should not be logged again.
+type reportedError struct {
+	error
+}
+
+func (e reportedError) Cause() error  { return e.error }
+func (e reportedError) Unwrap() error { return e.error }
+
+// writeJSONError outputs err as a single-line jsonError to w, using the
+// command metadata to fill in the context of the error.
+func writeJSONError(w io.Writer, metadata map[string]interface{}, err error) error {
+	jsonErr := jsonError{
+		Code:    errorCode(err),
+		Message: err.Error(),
+		Digest:  errorDigestRegexp.FindString(err.Error()),
+	}
+	if ref, ok := metadata["--image-registry"].(registry.Reference); ok {
+		jsonErr.Image = ref.String()
+	} else if path, ok := metadata["--image-path"].(string); ok {
+		jsonErr.Image = path
+	}
+	if tag, ok := metadata["--image-tag"].(string); ok {
+		jsonErr.Tag = tag
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	return errors.Wrap(enc.Encode(jsonErr), "encode json error")
+}
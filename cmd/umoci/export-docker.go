@@ -0,0 +1,154 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/opencontainers/umoci"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/opencontainers/umoci/oci/dockerarchive"
+	"github.com/opencontainers/umoci/oci/registry"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+var exportDockerCommand = uxPlatform(cli.Command{
+	Name:  "export-docker",
+	Usage: "exports an image as a docker-archive (for docker load)",
+	ArgsUsage: `--image <image-path>[:<tag>] <archive.tar>
+
+Where "<image-path>" is the path to the OCI image, "<tag>" is the name of the
+tagged image to export (if not specified, defaults to "latest"), and
+"<archive.tar>" is the path the docker-archive will be written to (or "-" to
+write it to stdout).
+
+The generated archive can be loaded with "docker load". Use --repo-tag to
+specify the name(s) the image will have once loaded (by default, the image is
+named "<image-name>:<tag>" where "<image-name>" is the name of the directory
+of "<image-path>").`,
+
+	// export-docker reads manifest information.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.StringSliceFlag{
+			Name:  "repo-tag",
+			Usage: "name of the image once loaded by docker (can be specified more than once)",
+		},
+	},
+
+	Action: exportDocker,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 1 {
+			return errors.Errorf("invalid number of positional arguments: expected <archive.tar>")
+		}
+		if ctx.Args().First() == "" {
+			return errors.Errorf("<archive.tar> path cannot be empty")
+		}
+		ctx.App.Metadata["archive"] = ctx.Args().First()
+		return nil
+	},
+})
+
+func exportDocker(ctx *cli.Context) (Err error) {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	tagName := ctx.App.Metadata["--image-tag"].(string)
+	archivePath := ctx.App.Metadata["archive"].(string)
+
+	// Get a reference to the CAS.
+	engine, err := openEngine(ctx, imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	manifestDescriptorPath, err := umoci.ResolveReference(context.Background(), engineExt, tagName, platformMetadata(ctx))
+	if err != nil {
+		return err
+	}
+
+	repoTags := ctx.StringSlice("repo-tag")
+	if len(repoTags) == 0 {
+		if repoTag, ok := defaultRepoTag(imagePath, tagName); ok {
+			log.Infof("image will be loaded as %s (use --repo-tag to change the name)", repoTag)
+			repoTags = []string{repoTag}
+		} else {
+			log.Warnf("cannot name the image after the exported tag (use --repo-tag to name it): image will be loaded untagged")
+		}
+	}
+	options := &dockerarchive.ExportOptions{
+		RepoTags: repoTags,
+	}
+
+	if archivePath == "-" {
+		return errors.Wrap(dockerarchive.Export(context.Background(), engineExt, manifestDescriptorPath.Descriptor(), os.Stdout, options), "export docker-archive")
+	}
+
+	// Write to a temporary file so that we don't leave a partially-written
+	// archive behind on failure.
+	fh, err := ioutil.TempFile(filepath.Dir(archivePath), ".umoci-export-docker.")
+	if err != nil {
+		return errors.Wrap(err, "create archive")
+	}
+	defer func() {
+		if Err != nil {
+			// #nosec G104
+			_ = os.Remove(fh.Name())
+		}
+	}()
+	defer fh.Close()
+
+	if err := dockerarchive.Export(context.Background(), engineExt, manifestDescriptorPath.Descriptor(), fh, options); err != nil {
+		return errors.Wrap(err, "export docker-archive")
+	}
+	if err := fh.Close(); err != nil {
+		return errors.Wrap(err, "close archive")
+	}
+	// #nosec G302
+	if err := os.Chmod(fh.Name(), 0644); err != nil {
+		return errors.Wrap(err, "chmod archive")
+	}
+	if err := os.Rename(fh.Name(), archivePath); err != nil {
+		return errors.Wrap(err, "rename archive")
+	}
+
+	log.Infof("exported %s as docker-archive: %s", tagName, archivePath)
+	return nil
+}
+
+// defaultRepoTag returns the name used for the exported image if no --repo-tag
+// was given, which is "<name>:<tag>" where <name> is the (lowercase) name of
+// the image directory and <tag> is the exported tag. If this isn't a valid
+// name, false is returned.
+func defaultRepoTag(imagePath, tagName string) (string, bool) {
+	name := strings.ToLower(filepath.Base(filepath.Clean(imagePath)))
+	repoTag := name + ":" + tagName
+	if _, err := registry.ParseReference(registry.TransportPrefix + repoTag); err != nil {
+		log.Debugf("export-docker: invalid default repo tag %q: %v", repoTag, err)
+		return "", false
+	}
+	return repoTag, true
+}
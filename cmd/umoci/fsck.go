@@ -0,0 +1,154 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/apex/log"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+var fsckCommand = cli.Command{
+	Name:  "fsck",
+	Usage: "verifies the integrity of an OCI image's blobs",
+	ArgsUsage: `--layout <image-path>
+
+Where "<image-path>" is the path to the OCI image.
+
+This command will read every blob in the provided OCI image and verify that its
+contents match its digest, and then check that every descriptor reachable from
+the references in the image refers to an existing and intact blob of the right
+size and media-type. Blobs which cannot be reached from any reference are
+reported as orphans (they can be removed with umoci-gc(1)). All problems found
+are printed, and the command fails if any problems were found. If
+--allow-orphans is specified, orphan blobs are still printed but do not cause
+the command to fail.
+
+If --fix is specified, corrupted and unreachable blobs are removed from the
+image and the image is checked again. Note that this will not repair any
+references to corrupted or missing blobs.`,
+
+	// fsck reads (and possibly modifies) an image layout.
+	Category: "layout",
+
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "fix",
+			Usage: "remove corrupted and unreachable blobs",
+		},
+		cli.BoolFlag{
+			Name:  "allow-orphans",
+			Usage: "do not fail if the only problems found are unreachable blobs",
+		},
+	},
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		if _, ok := ctx.App.Metadata["--image-path"]; !ok {
+			return errors.Errorf("missing mandatory argument: --layout")
+		}
+		return nil
+	},
+
+	Action: fsck,
+}
+
+func fsck(ctx *cli.Context) (Err error) {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+
+	// Get a reference to the CAS.
+	engine, err := openEngine(ctx, imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	// Some engines (such as OCI archives) only write blob removals when they
+	// are closed, so we need to check the error.
+	defer func() {
+		if err := engine.Close(); err != nil && Err == nil {
+			Err = errors.Wrap(err, "close CAS")
+		}
+	}()
+
+	report, err := engineExt.Fsck(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "fsck")
+	}
+	for _, problem := range report.Problems {
+		fmt.Println(problem)
+	}
+
+	if ctx.Bool("fix") && len(report.Problems) > 0 {
+		var removed int
+		for _, problem := range report.Problems {
+			if problem.Kind != casext.FsckCorruptBlob && problem.Kind != casext.FsckOrphanBlob {
+				continue
+			}
+			if problem.Shared {
+				log.Warnf("not removing %s %s: additional blob stores are read-only", problem.Kind, problem.Digest)
+				continue
+			}
+			log.Infof("removing %s %s", problem.Kind, problem.Digest)
+			if err := engineExt.DeleteBlob(context.Background(), problem.Digest); err != nil {
+				return errors.Wrapf(err, "remove %s %s", problem.Kind, problem.Digest)
+			}
+			removed++
+		}
+		fmt.Printf("removed %d blobs\n", removed)
+
+		// Check whether the image is still corrupted.
+		report, err = engineExt.Fsck(context.Background())
+		if err != nil {
+			return errors.Wrap(err, "fsck")
+		}
+		for _, problem := range report.Problems {
+			fmt.Println(problem)
+		}
+	}
+
+	checked := fmt.Sprintf("checked %d blobs", report.Blobs)
+	if report.SharedBlobs > 0 {
+		checked += fmt.Sprintf(" (and %d shared blobs)", report.SharedBlobs)
+	}
+
+	var problems, orphans int
+	for _, problem := range report.Problems {
+		if problem.Kind == casext.FsckOrphanBlob {
+			orphans++
+			if ctx.Bool("allow-orphans") {
+				continue
+			}
+		}
+		problems++
+	}
+	if problems > 0 {
+		return errors.Errorf("%s: %d problems found", checked, problems)
+	}
+	if orphans > 0 {
+		fmt.Printf("%s: no problems found (ignoring %d orphan blobs)\n", checked, orphans)
+		return nil
+	}
+	fmt.Printf("%s: no problems found\n", checked)
+	return nil
+}
@@ -19,8 +19,11 @@ package main
 
 import (
 	"context"
+	"fmt"
 
-	"github.com/opencontainers/umoci/oci/cas/dir"
+	"github.com/apex/log"
+	"github.com/docker/go-units"
+	"github.com/opencontainers/go-digest"
 	"github.com/opencontainers/umoci/oci/casext"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
@@ -35,11 +38,24 @@ Where "<image-path>" is the path to the OCI image.
 
 This command will do a mark-and-sweep garbage collection of the provided OCI
 image, only retaining blobs which can be reached by a descriptor path from the
-root set of references. All other blobs will be removed.`,
+root set of references. All other blobs will be removed. A summary of the
+number of blobs removed and the amount of space freed is printed once the
+garbage collection is complete.
+
+If --dry-run is specified, the blobs which would be removed are instead printed
+(along with their size in bytes), followed by the total number of bytes which
+would be freed. The image is not modified.`,
 
 	// create modifies an image layout.
 	Category: "layout",
 
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "only list the blobs which would be removed, without removing them",
+		},
+	},
+
 	Before: func(ctx *cli.Context) error {
 		if ctx.NArg() != 0 {
 			return errors.Errorf("invalid number of positional arguments: expected none")
@@ -53,17 +69,70 @@ root set of references. All other blobs will be removed.`,
 	Action: gc,
 }
 
-func gc(ctx *cli.Context) error {
+func gc(ctx *cli.Context) (Err error) {
 	imagePath := ctx.App.Metadata["--image-path"].(string)
 
 	// Get a reference to the CAS.
-	engine, err := dir.Open(imagePath)
+	engine, err := openEngine(ctx, imagePath)
 	if err != nil {
 		return errors.Wrap(err, "open CAS")
 	}
-	engineExt := casext.NewEngine(engine)
-	defer engine.Close()
+	engineExt := casext.NewEngine(engine).WithBlobCache(casext.DefaultBlobCacheSize)
+	// Some engines (such as OCI archives) only write blob removals when they
+	// are closed, so we need to check the error.
+	defer func() {
+		if err := engine.Close(); err != nil && Err == nil {
+			Err = errors.Wrap(err, "close CAS")
+		}
+	}()
+
+	if ctx.Bool("dry-run") {
+		return gcDryRun(context.Background(), engineExt)
+	}
 
 	// Run the GC.
-	return errors.Wrap(engineExt.GC(context.Background()), "gc")
+	stats, err := engineExt.GCWithStats(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "gc")
+	}
+	fmt.Printf("removed %d blobs, freed %s\n", stats.Blobs, units.BytesSize(float64(stats.Bytes)))
+	return nil
+}
+
+// gcDryRun prints the set of blobs which would be removed by GC (along with
+// their sizes) without modifying the image.
+func gcDryRun(ctx context.Context, engineExt casext.Engine) error {
+	reachable, err := engineExt.ReachableBlobs(ctx)
+	if err != nil {
+		return errors.Wrap(err, "get reachable blobs")
+	}
+	black := map[digest.Digest]struct{}{}
+	for _, digest := range reachable {
+		black[digest] = struct{}{}
+	}
+
+	blobs, err := engineExt.ListBlobs(ctx)
+	if err != nil {
+		return errors.Wrap(err, "get blob list")
+	}
+
+	var n, total int64
+	for _, digest := range blobs {
+		if _, ok := black[digest]; ok {
+			continue
+		}
+		size, err := engineExt.BlobSize(ctx, digest)
+		if err != nil {
+			// The blob would still be removed, so don't bail out.
+			log.Warnf("could not get size of unmarked blob %s: %v", digest, err)
+			fmt.Printf("%s unknown\n", digest)
+			n++
+			continue
+		}
+		fmt.Printf("%s %d\n", digest, size)
+		n++
+		total += size
+	}
+	fmt.Printf("would remove %d blobs, freeing %d bytes (%s)\n", n, total, units.BytesSize(float64(total)))
+	return nil
 }
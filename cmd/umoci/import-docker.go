@@ -0,0 +1,95 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+
+	"github.com/apex/log"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/opencontainers/umoci/oci/dockerarchive"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+var importDockerCommand = cli.Command{
+	Name:  "import-docker",
+	Usage: "imports an image from a docker-archive (docker save output)",
+	ArgsUsage: `--image <image-path>[:<new-tag>] <archive.tar>
+
+Where "<image-path>" is the path to the OCI image, "<new-tag>" is the name of
+the tag that the imported image will be saved as (if not specified, defaults
+to "latest"), and "<archive.tar>" is an uncompressed docker-archive (as
+produced by "docker save").
+
+If the archive contains more than one image, --repo-tag must be used to select
+which image is imported.`,
+
+	// import-docker creates a new image, with a given tag.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "repo-tag",
+			Usage: "name of the image in the archive to import (one of the RepoTags in the archive)",
+		},
+	},
+
+	Action: importDocker,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 1 {
+			return errors.Errorf("invalid number of positional arguments: expected <archive.tar>")
+		}
+		if ctx.Args().First() == "" {
+			return errors.Errorf("<archive.tar> path cannot be empty")
+		}
+		ctx.App.Metadata["archive"] = ctx.Args().First()
+		return nil
+	},
+}
+
+func importDocker(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	tagName := ctx.App.Metadata["--image-tag"].(string)
+	archivePath := ctx.App.Metadata["archive"].(string)
+
+	// Get a reference to the CAS.
+	engine, err := openEngine(ctx, imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	descriptor, err := dockerarchive.Import(context.Background(), engineExt, archivePath, &dockerarchive.ImportOptions{
+		RepoTag: ctx.String("repo-tag"),
+	})
+	if err != nil {
+		return errors.Wrap(err, "import docker-archive")
+	}
+
+	log.Infof("new image manifest created: %s", descriptor.Digest)
+
+	if err := engineExt.UpdateReference(context.Background(), tagName, descriptor); err != nil {
+		return errors.Wrap(err, "add new tag")
+	}
+
+	log.Infof("created new tag for image manifest: %s", tagName)
+	return nil
+}
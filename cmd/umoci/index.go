@@ -0,0 +1,265 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+
+	"github.com/apex/log"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+var indexSubcommand = cli.Command{
+	Name:  "index",
+	Usage: "create and modify image indexes (multi-platform images)",
+	ArgsUsage: `index <command> [<args>...]
+
+The umoci-index(1) subcommands allow for the creation of image indexes
+(sometimes called "manifest lists"), which contain a separate image for each
+platform. Such indexes can be used to create multi-platform images out of
+images built separately for each platform.`,
+
+	Subcommands: []cli.Command{
+		indexNewCommand,
+		indexAddCommand,
+		indexRemoveCommand,
+	},
+}
+
+var indexNewCommand = cli.Command{
+	Name:  "new",
+	Usage: "creates a blank tagged image index",
+	ArgsUsage: `--image <image-path>:<new-tag>
+
+Where "<image-path>" is the path to the OCI image, and "<new-tag>" is the name
+of the tag for the empty image index.`,
+
+	// index new modifies an image layout.
+	Category: "image",
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		return nil
+	},
+
+	Action: indexNew,
+}
+
+func indexNew(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	tagName := ctx.App.Metadata["--image-tag"].(string)
+
+	// Get a reference to the CAS.
+	engine, err := openEngine(ctx, imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	descriptor, err := engineExt.PutImageIndex(context.Background(), ispec.Index{})
+	if err != nil {
+		return errors.Wrap(err, "create index")
+	}
+	if err := engineExt.UpdateReference(context.Background(), tagName, descriptor); err != nil {
+		return errors.Wrap(err, "add new tag")
+	}
+
+	log.Infof("new index created: %s", descriptor.Digest)
+	return nil
+}
+
+var indexAddCommand = uxPlatform(uxTag(cli.Command{
+	Name:  "add",
+	Usage: "adds an image to an image index",
+	ArgsUsage: `--image <image-path>[:<tag>] --manifest <manifest-tag> [--platform <os>/<arch>[/<variant>]]
+
+Where "<image-path>" is the path to the OCI image, "<tag>" is the name of the
+image index to modify (if it does not exist, a new image index is created) and
+"<manifest-tag>" is the name of the tagged image to add to the index. If
+--platform is not specified, the platform is taken from the configuration of
+the image being added. Any existing entry in the index for the same platform
+is replaced.`,
+
+	// index add modifies an image layout.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "manifest",
+			Usage: "tag of the image to add to the index",
+		},
+	},
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		manifest := ctx.String("manifest")
+		if manifest == "" {
+			return errors.Errorf("missing mandatory argument: --manifest")
+		}
+		if !casext.IsValidReferenceName(manifest) {
+			return errors.Errorf("invalid --manifest: tag contains invalid characters: '%s'", manifest)
+		}
+		return nil
+	},
+
+	Action: indexAdd,
+}))
+
+func indexAdd(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	fromName := ctx.App.Metadata["--image-tag"].(string)
+	manifestName := ctx.String("manifest")
+
+	tagName := fromName
+	if val, ok := ctx.App.Metadata["--tag"]; ok {
+		tagName = val.(string)
+	}
+
+	// Get a reference to the CAS.
+	engine, err := openEngine(ctx, imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	manifestPath, err := umoci.ResolveReference(context.Background(), engineExt, manifestName, nil)
+	if err != nil {
+		return errors.Wrap(err, "invalid --manifest")
+	}
+
+	platform := platformMetadata(ctx)
+	if platform == nil {
+		// Take the platform from the image configuration.
+		platform, err = engineExt.DescriptorPlatform(context.Background(), manifestPath)
+		if err != nil {
+			return errors.Wrap(err, "get platform of --manifest")
+		}
+		if platform == nil || platform.OS == "" || platform.Architecture == "" {
+			return errors.Errorf("could not determine platform of %s: --platform must be specified", manifestName)
+		}
+	}
+
+	// Get the index to modify, or create a new one if the tag doesn't exist.
+	names, err := engineExt.ListReferences(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "list references")
+	}
+	var indexDescriptor ispec.Descriptor
+	if containsString(names, fromName) {
+		indexDescriptor, err = engineExt.ReferenceDescriptor(context.Background(), fromName)
+		if err != nil {
+			return errors.Wrap(err, "get index")
+		}
+	} else {
+		indexDescriptor, err = engineExt.PutImageIndex(context.Background(), ispec.Index{})
+		if err != nil {
+			return errors.Wrap(err, "create index")
+		}
+	}
+
+	newDescriptor, err := engineExt.IndexAddManifest(context.Background(), indexDescriptor, manifestPath.Descriptor(), *platform)
+	if err != nil {
+		return errors.Wrap(err, "add manifest to index")
+	}
+	if err := engineExt.UpdateReference(context.Background(), tagName, newDescriptor); err != nil {
+		return errors.Wrap(err, "add new tag")
+	}
+
+	log.Infof("added %s (%s) to index %s: %s", manifestName, casext.FormatPlatform(*platform), tagName, newDescriptor.Digest)
+	return nil
+}
+
+var indexRemoveCommand = uxPlatform(uxTag(cli.Command{
+	Name:    "remove",
+	Aliases: []string{"rm"},
+	Usage:   "removes a platform entry from an image index",
+	ArgsUsage: `--image <image-path>[:<tag>] --platform <os>/<arch>[/<variant>]
+
+Where "<image-path>" is the path to the OCI image, and "<tag>" is the name of
+the image index to modify. All entries in the index for the given platform are
+removed.`,
+
+	// index remove modifies an image layout.
+	Category: "image",
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		if !ctx.IsSet("platform") {
+			return errors.Errorf("missing mandatory argument: --platform")
+		}
+		return nil
+	},
+
+	Action: indexRemove,
+}))
+
+func indexRemove(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	fromName := ctx.App.Metadata["--image-tag"].(string)
+	platform := platformMetadata(ctx)
+
+	tagName := fromName
+	if val, ok := ctx.App.Metadata["--tag"]; ok {
+		tagName = val.(string)
+	}
+
+	// Get a reference to the CAS.
+	engine, err := openEngine(ctx, imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	indexDescriptor, err := engineExt.ReferenceDescriptor(context.Background(), fromName)
+	if err != nil {
+		return errors.Wrap(err, "get index")
+	}
+
+	newDescriptor, err := engineExt.IndexRemovePlatform(context.Background(), indexDescriptor, *platform)
+	if err != nil {
+		return errors.Wrap(err, "remove platform from index")
+	}
+	if err := engineExt.UpdateReference(context.Background(), tagName, newDescriptor); err != nil {
+		return errors.Wrap(err, "add new tag")
+	}
+
+	log.Infof("removed %s from index %s: %s", casext.FormatPlatform(*platform), tagName, newDescriptor.Digest)
+	return nil
+}
+
+func containsString(list []string, str string) bool {
+	for _, item := range list {
+		if item == str {
+			return true
+		}
+	}
+	return false
+}
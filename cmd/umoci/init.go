@@ -22,7 +22,7 @@ import (
 	"os"
 
 	"github.com/apex/log"
-	"github.com/opencontainers/umoci/oci/cas/dir"
+	"github.com/opencontainers/umoci"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
 )
@@ -61,7 +61,7 @@ func initLayout(ctx *cli.Context) error {
 		return errors.Wrap(err, "image layout creation")
 	}
 
-	if err := dir.Create(imagePath); err != nil {
+	if err := umoci.CreateEngine(imagePath); err != nil {
 		return errors.Wrap(err, "image layout creation")
 	}
 
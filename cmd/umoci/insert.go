@@ -20,15 +20,14 @@ package main
 
 import (
 	"context"
-	"time"
+	"io"
+	"os"
 
 	"github.com/apex/log"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/opencontainers/umoci"
 	"github.com/opencontainers/umoci/mutate"
-	"github.com/opencontainers/umoci/oci/cas/dir"
 	"github.com/opencontainers/umoci/oci/casext"
-	igen "github.com/opencontainers/umoci/oci/config/generate"
 	"github.com/opencontainers/umoci/oci/layer"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
@@ -38,7 +37,8 @@ var insertCommand = uxRemap(uxHistory(uxTag(cli.Command{
 	Name:  "insert",
 	Usage: "insert content into an OCI image",
 	ArgsUsage: `--image <image-path>[:<tag>] [--opaque] <source> <target>
-                                  --image <image-path>[:<tag>] [--whiteout] <target>
+                                  --image <image-path>[:<tag>] [--opaque] --whiteout <target>
+                                  --image <image-path>[:<tag>] --tar <archive>
 
 Where "<image-path>" is the path to the OCI image, and "<tag>" is the name of
 the tag that the content wil be inserted into (if not specified, defaults to
@@ -46,7 +46,13 @@ the tag that the content wil be inserted into (if not specified, defaults to
 
 The path at "<source>" is added to the image with the given "<target>" name.
 If "--whiteout" is specified, rather than inserting content into the image, a
-removal entry for "<target>" is inserted instead.
+removal entry for "<target>" is inserted instead. If "--opaque" is also
+specified, only the contents of the "<target>" directory are removed (and the
+directory itself is kept).
+
+If "--tar" is specified, the contents of the tar archive "<archive>" (or
+stdin, if "<archive>" is "-") are inserted as a new layer instead. Entries with
+paths outside the root of the archive are rejected.
 
 If "--opaque" is specified then any paths below "<target>" (assuming it is a
 directory) from previous layers will no longer be present. Only the contents
@@ -62,6 +68,8 @@ Some examples:
 	umoci insert --image oci:foo myconfigdir /etc/myconfigdir
 	umoci insert --image oci:foo --opaque myoptdir /opt
 	umoci insert --image oci:foo --whiteout /some/old/dir
+	umoci insert --image oci:foo --opaque --whiteout /var/cache
+	tar c -C mydir . | umoci insert --image oci:foo --tar -
 `,
 
 	Category: "image",
@@ -77,6 +85,14 @@ Some examples:
 			Name:  "opaque",
 			Usage: "mask any previous entries in the target directory",
 		},
+		cli.StringFlag{
+			Name:  "tar",
+			Usage: "insert the contents of the given tar archive (or stdin if '-')",
+		},
+		cli.BoolFlag{
+			Name:  "canonicalize",
+			Usage: "flatten the metadata of the new layer (root:root owners, a fixed mtime of SOURCE_DATE_EPOCH or the epoch, and no non-essential xattrs)",
+		},
 	},
 
 	Before: func(ctx *cli.Context) error {
@@ -86,6 +102,15 @@ Some examples:
 		if ctx.IsSet("whiteout") {
 			numArgs = 1
 		}
+		if ctx.IsSet("tar") {
+			if ctx.IsSet("whiteout") || ctx.IsSet("opaque") {
+				return errors.Errorf("--tar cannot be used with --whiteout or --opaque")
+			}
+			if ctx.String("tar") == "" {
+				return errors.Errorf("--tar archive path cannot be empty")
+			}
+			numArgs = 0
+		}
 		if ctx.NArg() != numArgs {
 			return errors.Errorf("invalid number of positional arguments: expected %d", numArgs)
 		}
@@ -97,9 +122,11 @@ Some examples:
 
 		// Figure out the arguments.
 		var sourcePath, targetPath string
-		targetPath = ctx.Args()[0]
-		if !ctx.IsSet("whiteout") {
-			sourcePath = targetPath
+		switch numArgs {
+		case 1:
+			targetPath = ctx.Args()[0]
+		case 2:
+			sourcePath = ctx.Args()[0]
 			targetPath = ctx.Args()[1]
 		}
 
@@ -122,7 +149,7 @@ func insert(ctx *cli.Context) error {
 	}
 
 	// Get a reference to the CAS.
-	engine, err := dir.Open(imagePath)
+	engine, err := openEngine(ctx, imagePath)
 	if err != nil {
 		return errors.Wrap(err, "open CAS")
 	}
@@ -134,11 +161,11 @@ func insert(ctx *cli.Context) error {
 		return errors.Wrap(err, "get descriptor")
 	}
 	if len(descriptorPaths) == 0 {
-		return errors.Errorf("tag not found: %s", fromName)
+		return errors.Wrap(casext.ErrReferenceNotFound, fromName)
 	}
 	if len(descriptorPaths) != 1 {
 		// TODO: Handle this more nicely.
-		return errors.Errorf("tag is ambiguous: %s", fromName)
+		return errors.Wrap(casext.ErrAmbiguousReference, fromName)
 	}
 
 	// Create the mutator.
@@ -156,17 +183,53 @@ func insert(ctx *cli.Context) error {
 		return err
 	}
 
-	packOptions := layer.RepackOptions{MapOptions: meta.MapOptions}
-	reader := layer.GenerateInsertLayer(sourcePath, targetPath, ctx.IsSet("opaque"), &packOptions)
+	packOptions := layer.RepackOptions{
+		MapOptions:   meta.MapOptions,
+		Canonicalize: ctx.Bool("canonicalize"),
+	}
+	if packOptions.Canonicalize {
+		packOptions.CanonicalTime, err = canonicalTime()
+		if err != nil {
+			return err
+		}
+	}
+
+	var reader io.ReadCloser
+	if ctx.IsSet("tar") {
+		archive := os.Stdin
+		if archivePath := ctx.String("tar"); archivePath != "-" {
+			archive, err = os.Open(archivePath)
+			if err != nil {
+				return errors.Wrap(err, "open tar archive")
+			}
+			defer archive.Close()
+		}
+		reader = layer.GenerateTarLayer(archive, &packOptions)
+	} else {
+		reader = layer.GenerateInsertLayer(sourcePath, targetPath, ctx.IsSet("opaque"), &packOptions)
+	}
 	defer reader.Close()
 
 	var history *ispec.History
 	if !ctx.Bool("no-history") {
-		created := time.Now()
+		// Whiteout-only layers are otherwise indistinguishable from one
+		// another in the history, so describe what was removed.
+		createdBy := "umoci insert" // XXX: Should we append argv to this?
+		if ctx.IsSet("whiteout") {
+			createdBy = "umoci insert --whiteout " + targetPath
+			if ctx.IsSet("opaque") {
+				createdBy = "umoci insert --opaque --whiteout " + targetPath
+			}
+		}
+
+		created, err := historyCreated(ctx)
+		if err != nil {
+			return err
+		}
 		history = &ispec.History{
 			Comment:    "",
 			Created:    &created,
-			CreatedBy:  "umoci insert", // XXX: Should we append argv to this?
+			CreatedBy:  createdBy,
 			EmptyLayer: false,
 		}
 
@@ -176,13 +239,6 @@ func insert(ctx *cli.Context) error {
 		if ctx.IsSet("history.comment") {
 			history.Comment = ctx.String("history.comment")
 		}
-		if ctx.IsSet("history.created") {
-			created, err := time.Parse(igen.ISO8601, ctx.String("history.created"))
-			if err != nil {
-				return errors.Wrap(err, "parsing --history.created")
-			}
-			history.Created = &created
-		}
 		if ctx.IsSet("history.created_by") {
 			history.CreatedBy = ctx.String("history.created_by")
 		}
@@ -0,0 +1,96 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+	logcli "github.com/apex/log/handlers/cli"
+	"github.com/pkg/errors"
+)
+
+// newLogHandler returns the log.Handler for the given --log-format.
+func newLogHandler(format string, w io.Writer) (log.Handler, error) {
+	switch format {
+	case "text":
+		return logcli.New(w), nil
+	case "json":
+		return newJSONLogHandler(w), nil
+	default:
+		return nil, errors.Errorf("unknown log format %q (must be text or json)", format)
+	}
+}
+
+// jsonLogReservedKeys are the keys used by jsonLogHandler for the standard
+// parts of each log entry. Fields with the same name are output with a
+// "fields." prefix.
+var jsonLogReservedKeys = map[string]struct{}{
+	"time":  {},
+	"level": {},
+	"msg":   {},
+}
+
+// jsonLogHandler is a log.Handler which outputs each log entry as a single
+// JSON object (on its own line) with the keys "time", "level" and "msg", as
+// well as a key for each of the fields of the entry.
+type jsonLogHandler struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func newJSONLogHandler(w io.Writer) *jsonLogHandler {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	return &jsonLogHandler{enc: enc}
+}
+
+// jsonLogValue converts a field value into something which can be encoded as
+// JSON. Errors are converted to their message, and values which cannot be
+// encoded are converted to a string.
+func jsonLogValue(value interface{}) interface{} {
+	if err, ok := value.(error); ok {
+		return err.Error()
+	}
+	if _, err := json.Marshal(value); err != nil {
+		return fmt.Sprintf("%v", value)
+	}
+	return value
+}
+
+// HandleLog implements log.Handler.
+func (h *jsonLogHandler) HandleLog(e *log.Entry) error {
+	entry := make(map[string]interface{}, len(e.Fields)+len(jsonLogReservedKeys))
+	for name, value := range e.Fields {
+		if _, reserved := jsonLogReservedKeys[name]; reserved {
+			name = "fields." + name
+		}
+		entry[name] = jsonLogValue(value)
+	}
+	entry["time"] = e.Timestamp.UTC().Format(time.RFC3339Nano)
+	entry["level"] = e.Level.String()
+	entry["msg"] = e.Message
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.enc.Encode(entry)
+}
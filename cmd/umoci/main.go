@@ -22,8 +22,8 @@ import (
 	"runtime/pprof"
 
 	"github.com/apex/log"
-	logcli "github.com/apex/log/handlers/cli"
 	"github.com/opencontainers/umoci"
+	"github.com/opencontainers/umoci/pkg/userns"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
 )
@@ -40,6 +40,12 @@ const (
 // though it were the command-line arguments of the umoci binary (this is
 // needed for umoci's integration test hacks you can find in main_test.go).
 func Main(args []string) error {
+	// If we were re-executed inside a user namespace (with --userns), wait
+	// until the namespace has been configured.
+	if err := userns.Init(); err != nil {
+		return err
+	}
+
 	app := cli.NewApp()
 	app.Name = "umoci"
 	app.Usage = usage
@@ -61,6 +67,19 @@ func Main(args []string) error {
 			Usage: "set the log level (debug, info, [warn], error, fatal)",
 			Value: "warn",
 		},
+		cli.StringFlag{
+			Name:  "log-format",
+			Usage: "set the log format ([text], json)",
+			Value: "text",
+		},
+		cli.BoolFlag{
+			Name:  "errors-json",
+			Usage: "output errors as a JSON object (with a stable error code) to stderr",
+		},
+		cli.StringSliceFlag{
+			Name:  "additional-blob-store",
+			Usage: "read-only directory of shared blobs to use for blobs missing from the image (can be specified multiple times)",
+		},
 		cli.StringFlag{
 			Name:   "cpu-profile",
 			Usage:  "profile umoci during execution and output it to a file",
@@ -68,8 +87,15 @@ func Main(args []string) error {
 		},
 	}
 
+	var jsonErrors bool
 	app.Before = func(ctx *cli.Context) error {
-		log.SetHandler(logcli.New(os.Stderr))
+		jsonErrors = ctx.GlobalBool("errors-json")
+
+		handler, err := newLogHandler(ctx.GlobalString("log-format"), os.Stderr)
+		if err != nil {
+			return errors.Wrap(err, "invalid --log-format")
+		}
+		log.SetHandler(handler)
 
 		if ctx.GlobalBool("verbose") {
 			if ctx.GlobalIsSet("log") {
@@ -108,14 +134,30 @@ func Main(args []string) error {
 		unpackCommand,
 		repackCommand,
 		gcCommand,
+		pruneCommand,
+		fsckCommand,
 		initCommand,
+		migrateCommand,
 		newCommand,
+		copyCommand,
 		tagAddCommand,
 		tagRemoveCommand,
 		tagListCommand,
 		statCommand,
+		verifyCommand,
+		referrersCommand,
+		verifyConfigCommand,
+		diffCommand,
 		rawSubcommand,
+		indexSubcommand,
 		insertCommand,
+		squashCommand,
+		importDockerCommand,
+		exportDockerCommand,
+		pullCommand,
+		pushCommand,
+		completionCommand,
+		completeCommand,
 	}
 
 	app.Metadata = map[string]interface{}{}
@@ -164,12 +206,23 @@ func Main(args []string) error {
 			log.Warn("umoci encountered a permission error: maybe --rootless will help?")
 		}
 		log.Debugf("%+v", err)
+
+		if jsonErrors {
+			if jsonErr := writeJSONError(os.Stderr, app.Metadata, err); jsonErr != nil {
+				log.Warnf("could not output error as json: %v", jsonErr)
+				return err
+			}
+			return reportedError{err}
+		}
 	}
 	return err
 }
 
 func main() {
 	if err := Main(os.Args); err != nil {
+		if _, ok := err.(reportedError); ok {
+			os.Exit(1)
+		}
 		log.Fatalf("%v", err)
 	}
 }
@@ -57,7 +57,10 @@ func TestUmoci(t *testing.T) {
 		if err := Main(args); err != nil {
 			// Output to stderr rather than the test log so that the
 			// integration tests can properly handle cleaning up the output.
-			fmt.Fprintf(os.Stderr, "%v\n", err)
+			// Errors output with --errors-json have already been printed.
+			if _, ok := err.(reportedError); !ok {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+			}
 			t.Fail()
 		}
 	}
@@ -0,0 +1,67 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"github.com/apex/log"
+	"github.com/opencontainers/umoci"
+	"github.com/opencontainers/umoci/oci/cas/dir"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+var migrateCommand = cli.Command{
+	Name:  "migrate",
+	Usage: "upgrades an outdated OCI layout to the current layout version",
+	ArgsUsage: `--layout <image-path>
+
+Where "<image-path>" is the path to the OCI image to be migrated.
+
+This command upgrades an OCI image layout which cannot be opened by umoci
+because it is outdated (such as a layout without an "oci-layout" file, or a
+layout using the pre-1.0 "refs" directory rather than "index.json") to the
+current layout version. Layouts which are already up-to-date are not modified.`,
+
+	// migrate modifies an image layout.
+	Category: "layout",
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		return nil
+	},
+
+	Action: migrate,
+}
+
+func migrate(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+
+	changed, err := umoci.MigrateEngine(imagePath)
+	if err != nil {
+		return errors.Wrap(err, "migrate image layout")
+	}
+
+	if changed {
+		log.Infof("migrated OCI image to layout version %s: %s", dir.ImageLayoutVersion, imagePath)
+	} else {
+		log.Infof("OCI image is already up-to-date: %s", imagePath)
+	}
+	return nil
+}
@@ -18,8 +18,9 @@
 package main
 
 import (
+	"os"
+
 	"github.com/opencontainers/umoci"
-	"github.com/opencontainers/umoci/oci/cas/dir"
 	"github.com/opencontainers/umoci/oci/casext"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
@@ -28,10 +29,12 @@ import (
 var newCommand = cli.Command{
 	Name:  "new",
 	Usage: "creates a blank tagged OCI image",
-	ArgsUsage: `--image <image-path>:<new-tag>
+	ArgsUsage: `--image <image-path>:<new-tag> [--config <config>]
 
 Where "<image-path>" is the path to the OCI image, and "<new-tag>" is the name
-of the tag for the empty manifest.
+of the tag for the empty manifest. If "<config>" is specified, it is the path to
+an OCI image configuration which is used as the configuration of the new image
+(rather than the defaults).
 
 Once you create a new image with umoci-new(1) you can directly use the image
 with umoci-unpack(1), umoci-repack(1), and umoci-config(1) to modify the new
@@ -41,10 +44,20 @@ needing a base image to start from.`,
 	// new modifies an image layout.
 	Category: "image",
 
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "config",
+			Usage: "path to an OCI image configuration to use for the new image",
+		},
+	},
+
 	Before: func(ctx *cli.Context) error {
 		if ctx.NArg() != 0 {
 			return errors.Errorf("invalid number of positional arguments: expected none")
 		}
+		if ctx.IsSet("config") && ctx.String("config") == "" {
+			return errors.Errorf("--config cannot be empty")
+		}
 		return nil
 	},
 
@@ -56,12 +69,20 @@ func newImage(ctx *cli.Context) error {
 	tagName := ctx.App.Metadata["--image-tag"].(string)
 
 	// Get a reference to the CAS.
-	engine, err := dir.Open(imagePath)
+	engine, err := openEngine(ctx, imagePath)
 	if err != nil {
 		return errors.Wrap(err, "open CAS")
 	}
 	engineExt := casext.NewEngine(engine)
 	defer engine.Close()
 
+	if configPath := ctx.String("config"); configPath != "" {
+		fh, err := os.Open(configPath)
+		if err != nil {
+			return errors.Wrap(err, "open --config")
+		}
+		defer fh.Close()
+		return umoci.NewImageConfig(engineExt, tagName, fh)
+	}
 	return umoci.NewImage(engineExt, tagName)
 }
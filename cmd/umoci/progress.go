@@ -0,0 +1,122 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/go-units"
+	"github.com/mattn/go-isatty"
+	"github.com/opencontainers/umoci/oci/layer"
+	"github.com/urfave/cli"
+)
+
+// uxProgress adds a --no-progress flag to the given cli.Command. Use
+// newProgress to create the progress bar for the command.
+func uxProgress(cmd cli.Command) cli.Command {
+	cmd.Flags = append(cmd.Flags, cli.BoolFlag{
+		Name:  "no-progress",
+		Usage: "do not show a progress bar (it is only shown if stdout is a terminal)",
+	})
+	return cmd
+}
+
+// progressBarWidth is the number of characters used for the bar itself.
+const progressBarWidth = 30
+
+// progressInterval is the minimum interval between re-renders of the bar.
+const progressInterval = 100 * time.Millisecond
+
+// progressBar renders a single-line progress bar to a terminal.
+type progressBar struct {
+	mu       sync.Mutex
+	out      io.Writer
+	label    string
+	last     time.Time
+	rendered bool
+}
+
+// newProgress returns a layer.ProgressFunc which renders a progress bar with
+// the given label to stdout, as well as a function which must be called once
+// the operation is complete (to clear the bar). If stdout is not a terminal or
+// --no-progress was specified, the returned layer.ProgressFunc is nil.
+func newProgress(ctx *cli.Context, label string) (layer.ProgressFunc, func()) {
+	if ctx.Bool("no-progress") || !isatty.IsTerminal(os.Stdout.Fd()) {
+		return nil, func() {}
+	}
+	pb := &progressBar{out: os.Stdout, label: label}
+	return pb.Update, pb.Done
+}
+
+// Update re-renders the progress bar, rate-limited to progressInterval (the
+// final update of an operation with a known total is always rendered, and is
+// left on its own line).
+func (pb *progressBar) Update(processed, total int64) {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(pb.last) < progressInterval && processed != total {
+		return
+	}
+	pb.last = now
+	pb.rendered = true
+
+	if total < 0 {
+		fmt.Fprintf(pb.out, "\r\x1b[K%s %s", pb.label, units.HumanSize(float64(processed)))
+		return
+	}
+
+	ratio := 1.0
+	if total > 0 {
+		ratio = float64(processed) / float64(total)
+	}
+	if ratio > 1 {
+		ratio = 1
+	}
+	filled := int(ratio * progressBarWidth)
+	bar := strings.Repeat("=", filled)
+	if filled < progressBarWidth {
+		bar += ">" + strings.Repeat(" ", progressBarWidth-filled-1)
+	}
+	fmt.Fprintf(pb.out, "\r\x1b[K%s [%s] %3d%% (%s / %s)", pb.label, bar, int(ratio*100),
+		units.HumanSize(float64(processed)), units.HumanSize(float64(total)))
+
+	// Leave the completed bar on its own line, so that any later output
+	// doesn't get mixed up with it.
+	if processed >= total {
+		fmt.Fprintln(pb.out)
+		pb.rendered = false
+	}
+}
+
+// Done clears the progress bar.
+func (pb *progressBar) Done() {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+
+	if pb.rendered {
+		fmt.Fprint(pb.out, "\r\x1b[K")
+		pb.rendered = false
+	}
+}
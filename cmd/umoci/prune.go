@@ -0,0 +1,130 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/apex/log"
+	"github.com/docker/go-units"
+	"github.com/opencontainers/umoci"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+var pruneCommand = cli.Command{
+	Name:  "prune",
+	Usage: "removes old tags from an OCI image and garbage-collects its blobs",
+	ArgsUsage: `--layout <image-path> --keep-latest <n> [--match <pattern>]
+
+Where "<image-path>" is the path to the OCI image, "<n>" is the number of tags
+to keep and "<pattern>" is a glob pattern (defaulting to "*") which selects the
+tags the retention policy applies to.
+
+Of the tags matching "<pattern>", only the "<n>" newest are kept and the rest
+are removed, after which the image is garbage-collected (as with umoci-gc(1)).
+Tags are ordered by the "created" timestamp of their image configuration, with
+ties broken by tag name (the lexicographically greater tag is newer).
+
+If --dry-run is specified, the tags which would be removed are instead printed
+and the image is not modified.`,
+
+	// prune modifies an image layout.
+	Category: "layout",
+
+	Flags: []cli.Flag{
+		cli.IntFlag{
+			Name:  "keep-latest",
+			Usage: "number of the newest matching tags to keep",
+		},
+		cli.StringFlag{
+			Name:  "match",
+			Usage: "glob pattern selecting the tags to prune",
+			Value: "*",
+		},
+		cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "only list the tags which would be removed, without removing them",
+		},
+	},
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		if _, ok := ctx.App.Metadata["--image-path"]; !ok {
+			return errors.Errorf("missing mandatory argument: --layout")
+		}
+		if !ctx.IsSet("keep-latest") {
+			return errors.Errorf("missing mandatory argument: --keep-latest")
+		}
+		if ctx.Int("keep-latest") < 0 {
+			return errors.Errorf("--keep-latest must not be negative")
+		}
+		return nil
+	},
+
+	Action: prune,
+}
+
+func prune(ctx *cli.Context) (Err error) {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+
+	// Get a reference to the CAS.
+	engine, err := openEngine(ctx, imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine).WithBlobCache(casext.DefaultBlobCacheSize)
+	// Some engines (such as OCI archives) only write changes when they are
+	// closed, so we need to check the error.
+	defer func() {
+		if err := engine.Close(); err != nil && Err == nil {
+			Err = errors.Wrap(err, "close CAS")
+		}
+	}()
+
+	expired, err := umoci.ExpiredTags(context.Background(), engineExt, ctx.String("match"), ctx.Int("keep-latest"))
+	if err != nil {
+		return errors.Wrap(err, "find expired tags")
+	}
+
+	if ctx.Bool("dry-run") {
+		for _, tag := range expired {
+			fmt.Println(tag)
+		}
+		fmt.Printf("would remove %d tags\n", len(expired))
+		return nil
+	}
+
+	for _, tag := range expired {
+		if err := engineExt.DeleteReference(context.Background(), tag); err != nil {
+			return errors.Wrapf(err, "remove tag %s", tag)
+		}
+		log.Infof("removed tag: %s", tag)
+	}
+
+	stats, err := engineExt.GCWithStats(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "gc")
+	}
+	fmt.Printf("removed %d tags and %d blobs, freed %s\n", len(expired), stats.Blobs, units.BytesSize(float64(stats.Bytes)))
+	return nil
+}
@@ -0,0 +1,149 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+
+	"github.com/apex/log"
+	"github.com/opencontainers/umoci"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/opencontainers/umoci/oci/registry"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+var pullCommand = cli.Command{
+	Name:  "pull",
+	Usage: "pulls an image from a registry into an OCI image",
+	ArgsUsage: `--image <image-path>[:<new-tag>] <source>
+
+Where "<image-path>" is the path to the OCI image, "<new-tag>" is the name of
+the tag that the pulled image will be saved as (if not specified, defaults to
+"latest"), and "<source>" is a reference to an image in a registry of the form
+"docker://[<registry>/]<repository>[:<tag>][@<digest>]".
+
+Credentials for the registry are loaded from the docker config.json (either in
+$DOCKER_CONFIG or ~/.docker).`,
+
+	// pull creates a new image, with a given tag.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "plain-http",
+			Usage: "access the registry over plain HTTP rather than HTTPS",
+		},
+		cli.IntFlag{
+			Name:  "max-concurrent-downloads",
+			Usage: "maximum number of layers to download in parallel",
+			Value: 3,
+		},
+		registryTimeoutFlag,
+		registryDeadlineFlag,
+	},
+
+	Action: pull,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 1 {
+			return errors.Errorf("invalid number of positional arguments: expected <source>")
+		}
+		ref, err := registry.ParseReference(ctx.Args().First())
+		if err != nil {
+			return errors.Wrap(err, "invalid <source>")
+		}
+		if ctx.Int("max-concurrent-downloads") < 1 {
+			return errors.Errorf("--max-concurrent-downloads must be at least 1")
+		}
+		ctx.App.Metadata["source"] = ref
+		return nil
+	},
+}
+
+func pull(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	tagName := ctx.App.Metadata["--image-tag"].(string)
+	source := ctx.App.Metadata["source"].(registry.Reference)
+
+	// Get a reference to the CAS.
+	engine, err := openEngine(ctx, imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	regCtx, cancel, err := registryContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+
+	client, err := registry.NewClient(source, &registry.ClientOptions{
+		PlainHTTP: ctx.Bool("plain-http"),
+		UserAgent: "umoci/" + umoci.FullVersion(),
+		Timeout:   ctx.Duration("timeout"),
+	})
+	if err != nil {
+		return errors.Wrap(err, "create registry client")
+	}
+
+	descriptor, err := registry.Pull(regCtx, engineExt, client, &registry.PullOptions{
+		MaxConcurrentDownloads: ctx.Int("max-concurrent-downloads"),
+	})
+	if err != nil {
+		return errors.Wrapf(err, "pull %s", source)
+	}
+
+	log.Infof("pulled image %s: %s", source, descriptor.Digest)
+
+	if err := engineExt.UpdateReference(context.Background(), tagName, descriptor); err != nil {
+		return errors.Wrap(err, "add new tag")
+	}
+
+	log.Infof("created new tag for image: %s", tagName)
+	return nil
+}
+
+// registryEngine returns a streaming view (see registry.NewStreamingEngine) of
+// the image the registry reference refers to, with the image tagged as
+// tagName. This is used by commands wrapped with uxRegistryImage.
+func registryEngine(ctx *cli.Context, ref registry.Reference, tagName string) (casext.Engine, error) {
+	client, err := registry.NewClient(ref, &registry.ClientOptions{
+		PlainHTTP: ctx.Bool(registryImageFlag),
+		UserAgent: "umoci/" + umoci.FullVersion(),
+		Timeout:   ctx.Duration("timeout"),
+	})
+	if err != nil {
+		return casext.Engine{}, errors.Wrap(err, "create registry client")
+	}
+
+	engine, descriptor, err := registry.NewStreamingEngine(context.Background(), client)
+	if err != nil {
+		return casext.Engine{}, errors.Wrapf(err, "fetch %s", ref)
+	}
+	engineExt := casext.NewEngine(engine)
+
+	if err := engineExt.UpdateReference(context.Background(), tagName, descriptor); err != nil {
+		// #nosec G104
+		_ = engine.Close()
+		return casext.Engine{}, errors.Wrap(err, "tag fetched image")
+	}
+	return engineExt, nil
+}
@@ -0,0 +1,135 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/opencontainers/umoci"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/opencontainers/umoci/oci/registry"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+var pushCommand = cli.Command{
+	Name:  "push",
+	Usage: "pushes an OCI image to a registry",
+	ArgsUsage: `--image <image-path>[:<tag>] <destination>
+
+Where "<image-path>" is the path to the OCI image, "<tag>" is the name of the
+tag to push (if not specified, defaults to "latest"), and "<destination>" is a
+reference to an image in a registry of the form
+"docker://[<registry>/]<repository>[:<tag>][@<digest>]".
+
+Credentials for the registry are loaded from the docker config.json (either in
+$DOCKER_CONFIG or ~/.docker), unless --creds is specified.`,
+
+	// push reads an image.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "plain-http",
+			Usage: "access the registry over plain HTTP rather than HTTPS",
+		},
+		cli.StringFlag{
+			Name:  "creds",
+			Usage: "credentials (<username>[:<password>]) used to authenticate with the registry",
+		},
+		cli.StringSliceFlag{
+			Name:  "mount-from",
+			Usage: "repository in the same registry to cross-mount existing blobs from (can be specified multiple times)",
+		},
+		registryTimeoutFlag,
+		registryDeadlineFlag,
+	},
+
+	Action: push,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 1 {
+			return errors.Errorf("invalid number of positional arguments: expected <destination>")
+		}
+		ref, err := registry.ParseReference(ctx.Args().First())
+		if err != nil {
+			return errors.Wrap(err, "invalid <destination>")
+		}
+		ctx.App.Metadata["destination"] = ref
+		return nil
+	},
+}
+
+func push(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	fromName := ctx.App.Metadata["--image-tag"].(string)
+	destination := ctx.App.Metadata["destination"].(registry.Reference)
+
+	var creds *registry.Credentials
+	if ctx.IsSet("creds") {
+		parts := strings.SplitN(ctx.String("creds"), ":", 2)
+		creds = &registry.Credentials{Username: parts[0]}
+		if len(parts) == 2 {
+			creds.Password = parts[1]
+		}
+		if creds.Username == "" {
+			return errors.Errorf("invalid --creds: username must not be empty")
+		}
+	}
+
+	// Get a reference to the CAS.
+	engine, err := openEngine(ctx, imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	descriptor, err := engineExt.ReferenceDescriptor(context.Background(), fromName)
+	if err != nil {
+		return errors.Wrap(err, "get descriptor")
+	}
+
+	regCtx, cancel, err := registryContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+
+	client, err := registry.NewClient(destination, &registry.ClientOptions{
+		PlainHTTP:   ctx.Bool("plain-http"),
+		Credentials: creds,
+		UserAgent:   "umoci/" + umoci.FullVersion(),
+		Push:        true,
+		Timeout:     ctx.Duration("timeout"),
+	})
+	if err != nil {
+		return errors.Wrap(err, "create registry client")
+	}
+
+	if err := registry.Push(regCtx, engineExt, client, descriptor, &registry.PushOptions{
+		MountFrom: ctx.StringSlice("mount-from"),
+	}); err != nil {
+		return errors.Wrapf(err, "push %s", destination)
+	}
+
+	log.Infof("pushed image %s: %s", destination, descriptor.Digest)
+	return nil
+}
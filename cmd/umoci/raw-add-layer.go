@@ -20,20 +20,17 @@ package main
 import (
 	"context"
 	"os"
-	"time"
 
 	"github.com/apex/log"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/opencontainers/umoci"
 	"github.com/opencontainers/umoci/mutate"
-	"github.com/opencontainers/umoci/oci/cas/dir"
 	"github.com/opencontainers/umoci/oci/casext"
-	igen "github.com/opencontainers/umoci/oci/config/generate"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
 )
 
-var rawAddLayerCommand = uxHistory(uxTag(cli.Command{
+var rawAddLayerCommand = uxMediaType(uxHistory(uxTag(cli.Command{
 	Name:  "add-layer",
 	Usage: "add a layer archive verbatim to an image",
 	ArgsUsage: `--image <image-path>[:<tag>] <new-layer.tar>
@@ -64,7 +61,7 @@ only supports uncompressed archives.`,
 		ctx.App.Metadata["newlayer"] = ctx.Args().First()
 		return nil
 	},
-}))
+})))
 
 func rawAddLayer(ctx *cli.Context) error {
 	imagePath := ctx.App.Metadata["--image-path"].(string)
@@ -81,7 +78,7 @@ func rawAddLayer(ctx *cli.Context) error {
 	meta.Version = umoci.MetaVersion
 
 	// Get a reference to the CAS.
-	engine, err := dir.Open(imagePath)
+	engine, err := openEngine(ctx, imagePath)
 	if err != nil {
 		return errors.Wrap(err, "open CAS")
 	}
@@ -93,11 +90,11 @@ func rawAddLayer(ctx *cli.Context) error {
 		return errors.Wrap(err, "get descriptor")
 	}
 	if len(fromDescriptorPaths) == 0 {
-		return errors.Errorf("tag not found: %s", fromName)
+		return errors.Wrap(casext.ErrReferenceNotFound, fromName)
 	}
 	if len(fromDescriptorPaths) != 1 {
 		// TODO: Handle this more nicely.
-		return errors.Errorf("tag is ambiguous: %s", fromName)
+		return errors.Wrap(casext.ErrAmbiguousReference, fromName)
 	}
 	meta.From = fromDescriptorPaths[0]
 
@@ -126,7 +123,10 @@ func rawAddLayer(ctx *cli.Context) error {
 
 	var history *ispec.History
 	if !ctx.Bool("no-history") {
-		created := time.Now()
+		created, err := historyCreated(ctx)
+		if err != nil {
+			return err
+		}
 		history = &ispec.History{
 			Author:     imageMeta.Author,
 			Comment:    "",
@@ -141,21 +141,19 @@ func rawAddLayer(ctx *cli.Context) error {
 		if ctx.IsSet("history.comment") {
 			history.Comment = ctx.String("history.comment")
 		}
-		if ctx.IsSet("history.created") {
-			created, err := time.Parse(igen.ISO8601, ctx.String("history.created"))
-			if err != nil {
-				return errors.Wrap(err, "parsing --history.created")
-			}
-			history.Created = &created
-		}
 		if ctx.IsSet("history.created_by") {
 			history.CreatedBy = ctx.String("history.created_by")
 		}
 	}
 
+	compressor, err := layerCompressor(ctx, mutate.GzipOptions{Level: -1})
+	if err != nil {
+		return errors.Wrap(err, "create layer compressor")
+	}
+
 	// TODO: We should add a flag to allow for a new layer to be made
 	//       non-distributable.
-	if _, err := mutator.Add(context.Background(), ispec.MediaTypeImageLayer, newLayer, history, mutate.GzipCompressor, nil); err != nil {
+	if _, err := mutator.Add(context.Background(), ispec.MediaTypeImageLayer, newLayer, history, compressor, nil); err != nil {
 		return errors.Wrap(err, "add diff layer")
 	}
 
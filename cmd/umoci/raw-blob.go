@@ -0,0 +1,138 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"os"
+
+	"github.com/apex/log"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/opencontainers/umoci/oci/layer"
+	"github.com/opencontainers/umoci/pkg/hardening"
+	"github.com/opencontainers/umoci/pkg/system"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+var rawBlobCommand = uxRemap(cli.Command{
+	Name:  "blob",
+	Usage: "writes the contents of a blob to stdout",
+	ArgsUsage: `--layout <image-path> [--decompress] <digest>
+
+Where "<image-path>" is the path to the OCI image and "<digest>" is the digest
+of the blob to output.
+
+The digest of the blob is verified as it is written, and an error is returned
+if the blob does not match its digest. Note that (because the blob is streamed)
+the mismatching contents will have already been written to stdout.`,
+
+	// blob reads blobs from the layout.
+	Category: "layout",
+
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "decompress",
+			Usage: "output the uncompressed tar stream of a layer blob",
+		},
+	},
+
+	Action: rawBlob,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 1 {
+			return errors.Errorf("invalid number of positional arguments: expected <digest>")
+		}
+		blobDigest, err := digest.Parse(ctx.Args().First())
+		if err != nil {
+			return errors.Wrap(err, "invalid <digest>")
+		}
+		ctx.App.Metadata["digest"] = blobDigest
+		return nil
+	},
+})
+
+func rawBlob(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	blobDigest := ctx.App.Metadata["digest"].(digest.Digest)
+
+	// Get a reference to the CAS.
+	engine, err := openEngine(ctx, imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	// We need the media type of the blob in order to decompress it, which
+	// requires finding a descriptor which references it.
+	var mediaType string
+	if ctx.Bool("decompress") {
+		descriptor, err := findDescriptor(context.Background(), engineExt, blobDigest)
+		if err != nil {
+			return errors.Wrap(err, "find layer descriptor")
+		}
+		mediaType = descriptor.MediaType
+	}
+
+	log.WithFields(log.Fields{
+		"image":     imagePath,
+		"digest":    blobDigest,
+		"mediatype": mediaType,
+	}).Debugf("umoci: outputting blob")
+
+	blob, err := engineExt.GetBlob(context.Background(), blobDigest)
+	if err != nil {
+		return errors.Wrap(err, "get blob")
+	}
+	// Not all CAS engines verify the blobs they return, so make sure that a
+	// mismatching blob always results in an error once it has been streamed.
+	blob = &hardening.VerifiedReadCloser{
+		Reader:         blob,
+		ExpectedDigest: blobDigest,
+		ExpectedSize:   -1,
+	}
+	defer blob.Close()
+
+	if !ctx.Bool("decompress") {
+		if _, err := system.Copy(os.Stdout, blob); err != nil {
+			return errors.Wrap(err, "output blob")
+		}
+		return errors.Wrap(blob.Close(), "verify blob")
+	}
+
+	blobReader := bufio.NewReader(blob)
+	layerRaw, err := layer.DecompressLayer(mediaType, blobReader)
+	if err != nil {
+		return errors.Wrapf(err, "decompress layer %s", blobDigest)
+	}
+	defer layerRaw.Close()
+
+	if _, err := system.Copy(os.Stdout, layerRaw); err != nil {
+		return errors.Wrap(err, "output decompressed layer")
+	}
+	// Decompressors don't necessarily read the blob until EOF, so consume
+	// whatever is left to make sure the blob digest is verified.
+	if _, err := system.Copy(ioutil.Discard, blobReader); err != nil {
+		return errors.Wrap(err, "discard trailing raw bits")
+	}
+	return errors.Wrap(blob.Close(), "verify blob")
+}
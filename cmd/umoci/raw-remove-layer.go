@@ -0,0 +1,114 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/apex/log"
+	"github.com/opencontainers/umoci"
+	"github.com/opencontainers/umoci/mutate"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+var rawRemoveLayerCommand = uxTag(cli.Command{
+	Name:  "remove-layer",
+	Usage: "remove a layer from an image",
+	ArgsUsage: `--image <image-path>[:<tag>] <index>
+
+Where "<image-path>" is the path to the OCI image, "<tag>" is the name of the
+tagged image to modify (if not specified, defaults to "latest") and "<index>"
+is the index of the layer to remove (starting from 0 for the bottom-most
+layer).
+
+The layer's entry in the image history is also removed. Note that whiteouts in
+later layers may refer to paths that were only present in the removed layer.
+Such whiteouts are ignored when unpacking the image, but a warning is output
+for each of them.`,
+
+	// remove-layer modifies an image layout.
+	Category: "image",
+
+	Action: rawRemoveLayer,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 1 {
+			return errors.Errorf("invalid number of positional arguments: expected <index>")
+		}
+		index, err := strconv.Atoi(ctx.Args().First())
+		if err != nil {
+			return errors.Wrap(err, "invalid <index>")
+		}
+		if index < 0 {
+			return errors.Errorf("invalid <index>: must not be negative")
+		}
+		ctx.App.Metadata["index"] = index
+		return nil
+	},
+})
+
+func rawRemoveLayer(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	fromName := ctx.App.Metadata["--image-tag"].(string)
+	index := ctx.App.Metadata["index"].(int)
+
+	// Overide the from tag by default, otherwise use the one specified.
+	tagName := fromName
+	if overrideTagName, ok := ctx.App.Metadata["--tag"]; ok {
+		tagName = overrideTagName.(string)
+	}
+
+	// Get a reference to the CAS.
+	engine, err := openEngine(ctx, imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	fromDescriptorPath, err := umoci.ResolveReference(context.Background(), engineExt, fromName, nil)
+	if err != nil {
+		return err
+	}
+
+	mutator, err := mutate.New(engine, fromDescriptorPath)
+	if err != nil {
+		return errors.Wrap(err, "create mutator for base image")
+	}
+
+	if err := mutator.RemoveLayer(context.Background(), index); err != nil {
+		return errors.Wrap(err, "remove layer")
+	}
+
+	newDescriptorPath, err := mutator.Commit(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "commit mutated image")
+	}
+
+	log.Infof("new image manifest created: %s->%s", newDescriptorPath.Root().Digest, newDescriptorPath.Descriptor().Digest)
+
+	if err := engineExt.UpdateReference(context.Background(), tagName, newDescriptorPath.Root()); err != nil {
+		return errors.Wrap(err, "add new tag")
+	}
+
+	log.Infof("created new tag for image manifest: %s", tagName)
+	return nil
+}
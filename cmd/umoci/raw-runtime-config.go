@@ -25,14 +25,13 @@ import (
 	"github.com/apex/log"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/opencontainers/umoci"
-	"github.com/opencontainers/umoci/oci/cas/dir"
 	"github.com/opencontainers/umoci/oci/casext"
 	"github.com/opencontainers/umoci/oci/layer"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
 )
 
-var rawConfigCommand = uxRemap(cli.Command{
+var rawConfigCommand = uxRuntime(uxPlatform(uxRemap(cli.Command{
 	Name:    "runtime-config",
 	Aliases: []string{"config"},
 	Usage:   "generates an OCI runtime configuration for an image",
@@ -69,7 +68,7 @@ Note that the results of this may not agree with umoci-unpack(1) because the
 		ctx.App.Metadata["config"] = ctx.Args().First()
 		return nil
 	},
-})
+})))
 
 func rawConfig(ctx *cli.Context) error {
 	imagePath := ctx.App.Metadata["--image-path"].(string)
@@ -86,25 +85,18 @@ func rawConfig(ctx *cli.Context) error {
 	}
 
 	// Get a reference to the CAS.
-	engine, err := dir.Open(imagePath)
+	engine, err := openEngine(ctx, imagePath)
 	if err != nil {
 		return errors.Wrap(err, "open CAS")
 	}
 	engineExt := casext.NewEngine(engine)
 	defer engine.Close()
 
-	fromDescriptorPaths, err := engineExt.ResolveReference(context.Background(), fromName)
+	fromDescriptorPath, err := umoci.ResolveReference(context.Background(), engineExt, fromName, platformMetadata(ctx))
 	if err != nil {
-		return errors.Wrap(err, "get descriptor")
-	}
-	if len(fromDescriptorPaths) == 0 {
-		return errors.Errorf("tag not found: %s", fromName)
-	}
-	if len(fromDescriptorPaths) != 1 {
-		// TODO: Handle this more nicely.
-		return errors.Errorf("tag is ambiguous: %s", fromName)
+		return err
 	}
-	meta.From = fromDescriptorPaths[0]
+	meta.From = fromDescriptorPath
 
 	manifestBlob, err := engineExt.FromDescriptor(context.Background(), meta.From.Descriptor())
 	if err != nil {
@@ -132,7 +124,11 @@ func rawConfig(ctx *cli.Context) error {
 
 	// Write out the generated config.
 	log.Info("generating config.json")
-	if err := layer.UnpackRuntimeJSON(context.Background(), engineExt, configFile, ctx.String("rootfs"), manifest, &meta.MapOptions); err != nil {
+	unpackOptions := layer.UnpackOptions{
+		MapOptions:     meta.MapOptions,
+		RuntimeOptions: runtimeOptionsMetadata(ctx),
+	}
+	if err := layer.UnpackRuntimeJSONWithOptions(context.Background(), engineExt, configFile, ctx.String("rootfs"), manifest, &unpackOptions); err != nil {
 		return errors.Wrap(err, "generate config")
 	}
 	return nil
@@ -0,0 +1,171 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"os"
+
+	"github.com/apex/log"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/opencontainers/umoci/oci/layer"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+var rawUnpackLayerCommand = uxRemap(cli.Command{
+	Name:  "unpack-layer",
+	Usage: "unpacks a single layer blob into a directory",
+	ArgsUsage: `--layout <image-path> --digest <digest> <dir>
+
+Where "<image-path>" is the path to the OCI image, "<digest>" is the digest of
+a layer blob referenced by one of the manifests in the image and "<dir>" is
+the destination to unpack the layer to.
+
+Only the given layer is extracted (none of the layers below it are applied),
+and whiteouts are extracted as ordinary ".wh." files rather than removing
+anything. This is intended for inspecting the contents of a layer.`,
+
+	// unpack-layer reads layer blobs.
+	Category: "layout",
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "digest",
+			Usage: "digest of the layer blob to unpack",
+		},
+		cli.BoolFlag{
+			Name:  "detect-compression",
+			Usage: "detect the compression of the layer from its contents rather than its media type",
+		},
+	},
+
+	Action: rawUnpackLayer,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 1 {
+			return errors.Errorf("invalid number of positional arguments: expected <dir>")
+		}
+		if ctx.Args().First() == "" {
+			return errors.Errorf("dir path cannot be empty")
+		}
+		if !ctx.IsSet("digest") {
+			return errors.Errorf("missing mandatory argument: --digest")
+		}
+		if _, err := digest.Parse(ctx.String("digest")); err != nil {
+			return errors.Wrap(err, "invalid --digest")
+		}
+		ctx.App.Metadata["dir"] = ctx.Args().First()
+		return nil
+	},
+})
+
+// errFoundDescriptor is used to stop walking once the descriptor has been
+// found.
+var errFoundDescriptor = errors.New("[internal] found descriptor")
+
+// findDescriptor returns a descriptor for the blob with the given digest, by
+// walking the DAG from every reference in the image. This is necessary to
+// figure out the media type of the blob.
+func findDescriptor(ctx context.Context, engineExt casext.Engine, blobDigest digest.Digest) (ispec.Descriptor, error) {
+	index, err := engineExt.GetIndex(ctx)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "get top-level index")
+	}
+
+	var found ispec.Descriptor
+	for _, root := range index.Manifests {
+		err := engineExt.Walk(ctx, root, func(descriptorPath casext.DescriptorPath) error {
+			if descriptor := descriptorPath.Descriptor(); descriptor.Digest == blobDigest {
+				found = descriptor
+				return errFoundDescriptor
+			}
+			return nil
+		})
+		if errors.Cause(err) == errFoundDescriptor {
+			return found, nil
+		}
+		if err != nil {
+			return ispec.Descriptor{}, errors.Wrapf(err, "walk %s", root.Digest)
+		}
+	}
+	return ispec.Descriptor{}, errors.Errorf("blob %s is not referenced by the image", blobDigest)
+}
+
+func rawUnpackLayer(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	dirPath := ctx.App.Metadata["dir"].(string)
+	layerDigest := digest.Digest(ctx.String("digest"))
+
+	var meta umoci.Meta
+	meta.Version = umoci.MetaVersion
+
+	// Parse map options.
+	// We need to set mappings if we're in rootless mode.
+	err := umoci.ParseIdmapOptions(&meta, ctx)
+	if err != nil {
+		return err
+	}
+
+	unpackOptions := layer.UnpackOptions{
+		MapOptions:        meta.MapOptions,
+		WhiteoutMode:      layer.LiteralWhiteout,
+		DetectCompression: ctx.Bool("detect-compression"),
+	}
+
+	// Get a reference to the CAS.
+	engine, err := openEngine(ctx, imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	layerDescriptor, err := findDescriptor(context.Background(), engineExt, layerDigest)
+	if err != nil {
+		return errors.Wrap(err, "find layer descriptor")
+	}
+
+	log.WithFields(log.Fields{
+		"image":     imagePath,
+		"dir":       dirPath,
+		"digest":    layerDescriptor.Digest,
+		"mediatype": layerDescriptor.MediaType,
+	}).Debugf("umoci: unpacking OCI layer")
+
+	created := true
+	if err := os.Mkdir(dirPath, 0755); os.IsExist(err) {
+		created = false
+	} else if err != nil {
+		return errors.Wrap(err, "mkdir dir")
+	}
+	if err := layer.UnpackLayerDescriptor(context.Background(), engine, dirPath, layerDescriptor, &unpackOptions); err != nil {
+		if created {
+			// It's too late to care about errors.
+			// #nosec G104
+			_ = os.RemoveAll(dirPath)
+		}
+		return errors.Wrap(err, "unpack layer")
+	}
+
+	log.Infof("unpacked layer %s: %s", layerDescriptor.Digest, dirPath)
+	return nil
+}
@@ -24,14 +24,13 @@ import (
 	"github.com/apex/log"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/opencontainers/umoci"
-	"github.com/opencontainers/umoci/oci/cas/dir"
 	"github.com/opencontainers/umoci/oci/casext"
 	"github.com/opencontainers/umoci/oci/layer"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
 )
 
-var rawUnpackCommand = uxRemap(cli.Command{
+var rawUnpackCommand = uxProgress(uxPlatform(uxRemap(cli.Command{
 	Name:  "unpack",
 	Usage: "unpacks a reference into a rootfs",
 	ArgsUsage: `--image <image-path>[:<tag>] <rootfs>
@@ -48,6 +47,27 @@ is the destination to unpack the image to.`,
 			Name:  "keep-dirlinks",
 			Usage: "don't clobber underlying symlinks to directories",
 		},
+		cli.BoolFlag{
+			Name:  "allow-foreign-layers",
+			Usage: "fetch non-distributable layers which are not included in the image from their urls",
+		},
+		cli.BoolFlag{
+			Name:  "detect-compression",
+			Usage: "detect the compression of layers from their contents rather than their media type",
+		},
+		cli.StringFlag{
+			Name:  "rootless-devices",
+			Usage: "how to handle devices which cannot be created when unprivileged (placeholder, skip, error)",
+			Value: layer.RootlessDevicePlaceholder.String(),
+		},
+		cli.BoolFlag{
+			Name:  "shadow-xattrs",
+			Usage: "store privileged xattrs which cannot be set when unprivileged in user.umoci.* xattrs",
+		},
+		cli.StringFlag{
+			Name:  "layer-cache",
+			Usage: "directory used to cache extracted layers, so that layers shared with previously unpacked images are not re-extracted",
+		},
 	},
 
 	Action: rawUnpack,
@@ -59,10 +79,13 @@ is the destination to unpack the image to.`,
 		if ctx.Args().First() == "" {
 			return errors.Errorf("rootfs path cannot be empty")
 		}
+		if ctx.IsSet("layer-cache") && ctx.String("layer-cache") == "" {
+			return errors.Errorf("--layer-cache cannot be empty")
+		}
 		ctx.App.Metadata["rootfs"] = ctx.Args().First()
 		return nil
 	},
-})
+})))
 
 func rawUnpack(ctx *cli.Context) error {
 	imagePath := ctx.App.Metadata["--image-path"].(string)
@@ -81,28 +104,29 @@ func rawUnpack(ctx *cli.Context) error {
 	}
 
 	unpackOptions.KeepDirlinks = ctx.Bool("keep-dirlinks")
+	unpackOptions.AllowForeignLayers = ctx.Bool("allow-foreign-layers")
+	unpackOptions.DetectCompression = ctx.Bool("detect-compression")
+	unpackOptions.ShadowXattrs = ctx.Bool("shadow-xattrs")
+	unpackOptions.LayerCache = ctx.String("layer-cache")
 	unpackOptions.MapOptions = meta.MapOptions
+	unpackOptions.RootlessDeviceMode, err = layer.ParseRootlessDeviceMode(ctx.String("rootless-devices"))
+	if err != nil {
+		return errors.Wrap(err, "invalid --rootless-devices")
+	}
 
 	// Get a reference to the CAS.
-	engine, err := dir.Open(imagePath)
+	engine, err := openEngine(ctx, imagePath)
 	if err != nil {
 		return errors.Wrap(err, "open CAS")
 	}
 	engineExt := casext.NewEngine(engine)
 	defer engine.Close()
 
-	fromDescriptorPaths, err := engineExt.ResolveReference(context.Background(), fromName)
+	fromDescriptorPath, err := umoci.ResolveReference(context.Background(), engineExt, fromName, platformMetadata(ctx))
 	if err != nil {
-		return errors.Wrap(err, "get descriptor")
-	}
-	if len(fromDescriptorPaths) == 0 {
-		return errors.Errorf("tag is not found: %s", fromName)
-	}
-	if len(fromDescriptorPaths) != 1 {
-		// TODO: Handle this more nicely.
-		return errors.Errorf("tag is ambiguous: %s", fromName)
+		return err
 	}
-	meta.From = fromDescriptorPaths[0]
+	meta.From = fromDescriptorPath
 
 	manifestBlob, err := engineExt.FromDescriptor(context.Background(), meta.From.Descriptor())
 	if err != nil {
@@ -128,7 +152,11 @@ func rawUnpack(ctx *cli.Context) error {
 	}
 
 	log.Warnf("unpacking rootfs ...")
-	if err := layer.UnpackRootfs(context.Background(), engineExt, rootfsPath, manifest, &unpackOptions); err != nil {
+	progress, progressDone := newProgress(ctx, "unpacking")
+	unpackOptions.Progress = progress
+	err = layer.UnpackRootfs(context.Background(), engineExt, rootfsPath, manifest, &unpackOptions)
+	progressDone()
+	if err != nil {
 		return errors.Wrap(err, "create rootfs")
 	}
 	log.Warnf("... done")
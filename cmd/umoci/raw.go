@@ -34,7 +34,10 @@ should be sufficient for most use-cases.`,
 
 	Subcommands: []cli.Command{
 		rawAddLayerCommand,
+		rawBlobCommand,
+		rawRemoveLayerCommand,
 		rawConfigCommand,
 		rawUnpackCommand,
+		rawUnpackLayerCommand,
 	},
 }
@@ -0,0 +1,184 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/apex/log"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/mutate"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+var referrersCommand = cli.Command{
+	Name:  "referrers",
+	Usage: "lists the manifests in an OCI layout which refer to an image",
+	ArgsUsage: `--image <image-path>[:<tag>]
+
+Where "<image-path>" is the path to the OCI layout, and "<tag>" is the name of
+the tagged image (or "@<digest>" to refer to a manifest or image index by its
+digest) whose referrers will be listed.
+
+The referrers of an image are the manifests (such as signatures, SBOMs and
+other attestations) in the top-level index whose "subject" is the image. The
+digest and media-type of each referrer is output on a single line, followed by
+its tag if it has one.
+
+With --json, the top-level index entry of each referrer (including its
+media-type, digest, size and annotations) is output as a JSON array.
+
+With --attach, the manifest tagged "<referrer-tag>" in the same layout is
+instead made into a referrer of the image. A copy of the manifest with the
+image as its subject is added to the top-level index without a tag, and the
+"<referrer-tag>" tag is left unchanged.`,
+
+	// referrers reads manifest information.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "output the index entry of each referrer as a JSON encoded array",
+		},
+		cli.StringFlag{
+			Name:  "attach",
+			Usage: "tag of a manifest in the layout to make into a referrer of the image",
+		},
+	},
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		if ctx.IsSet("attach") {
+			if ctx.Bool("json") {
+				return errors.Errorf("--attach and --json are mutually exclusive")
+			}
+			if !casext.IsValidReferenceName(ctx.String("attach")) {
+				return errors.Errorf("--attach has an invalid tag")
+			}
+		}
+		return nil
+	},
+
+	Action: referrers,
+}
+
+func referrers(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	tagName := ctx.App.Metadata["--image-tag"].(string)
+
+	// Get a reference to the CAS.
+	engine, err := openEngine(ctx, imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	// Referrers refer to the tagged blob itself (which may be an image index)
+	// rather than the manifests it contains, so we only need the root of each
+	// resolved path.
+	descriptorPaths, err := engineExt.ResolveReference(context.Background(), tagName)
+	if err != nil {
+		return errors.Wrap(err, "get descriptor")
+	}
+	if len(descriptorPaths) == 0 {
+		return errors.Wrap(casext.ErrReferenceNotFound, tagName)
+	}
+	subject := descriptorPaths[0].Root()
+	for _, descriptorPath := range descriptorPaths[1:] {
+		if descriptorPath.Root().Digest != subject.Digest {
+			return errors.Wrap(casext.ErrAmbiguousReference, tagName)
+		}
+	}
+
+	if ctx.IsSet("attach") {
+		return attachReferrer(engineExt, ctx.String("attach"), ispec.Descriptor{
+			MediaType: subject.MediaType,
+			Digest:    subject.Digest,
+			Size:      subject.Size,
+		})
+	}
+
+	descriptors, err := engineExt.Referrers(context.Background(), subject.Digest)
+	if err != nil {
+		return errors.Wrapf(err, "get referrers of %s", subject.Digest)
+	}
+
+	if ctx.Bool("json") {
+		if descriptors == nil {
+			descriptors = []ispec.Descriptor{}
+		}
+		if err := json.NewEncoder(os.Stdout).Encode(descriptors); err != nil {
+			return errors.Wrap(err, "encoding referrers")
+		}
+		return nil
+	}
+
+	for _, descriptor := range descriptors {
+		line := fmt.Sprintf("%s %s", descriptor.Digest, descriptor.MediaType)
+		if name, ok := descriptor.Annotations[ispec.AnnotationRefName]; ok {
+			line += " " + name
+		}
+		fmt.Println(line)
+	}
+	return nil
+}
+
+// attachReferrer sets the subject of the manifest referenced by referrerName
+// and adds the new manifest to the top-level index as an untagged referrer.
+func attachReferrer(engineExt casext.Engine, referrerName string, subject ispec.Descriptor) error {
+	referrerPaths, err := engineExt.ResolveReference(context.Background(), referrerName)
+	if err != nil {
+		return errors.Wrap(err, "get referrer descriptor")
+	}
+	if len(referrerPaths) == 0 {
+		return errors.Wrap(casext.ErrReferenceNotFound, referrerName)
+	}
+	if len(referrerPaths) != 1 {
+		return errors.Wrap(casext.ErrAmbiguousReference, referrerName)
+	}
+
+	mutator, err := mutate.New(engineExt, referrerPaths[0])
+	if err != nil {
+		return errors.Wrap(err, "create mutator for referrer")
+	}
+	if err := mutator.SetSubject(context.Background(), &subject); err != nil {
+		return errors.Wrap(err, "set subject of referrer")
+	}
+	newDescriptorPath, err := mutator.Commit(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "commit referrer")
+	}
+
+	// The subject is set on the manifest itself, so that is what is added to
+	// the index (even if referrerName refers to an image index).
+	referrer := newDescriptorPath.Descriptor()
+	if err := engineExt.AddReferrer(context.Background(), referrer); err != nil {
+		return errors.Wrap(err, "add referrer")
+	}
+	log.Infof("attached referrer %s to %s", referrer.Digest, subject.Digest)
+	return nil
+}
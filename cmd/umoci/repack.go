@@ -20,21 +20,21 @@ package main
 import (
 	"context"
 	"fmt"
+	"os"
 	"time"
 
 	"github.com/apex/log"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/opencontainers/umoci"
 	"github.com/opencontainers/umoci/mutate"
-	"github.com/opencontainers/umoci/oci/cas/dir"
 	"github.com/opencontainers/umoci/oci/casext"
-	igen "github.com/opencontainers/umoci/oci/config/generate"
+	"github.com/opencontainers/umoci/oci/layer"
 	"github.com/opencontainers/umoci/pkg/mtreefilter"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
 )
 
-var repackCommand = uxHistory(cli.Command{
+var repackCommand = uxSealKey(uxMediaType(uxProgress(uxHistory(cli.Command{
 	Name:  "repack",
 	Usage: "repacks an OCI runtime bundle into a reference",
 	ArgsUsage: `--image <image-path>[:<new-tag>] <bundle>
@@ -74,6 +74,47 @@ manifest and configuration information uses the new diff atop the old manifest.`
 			Name:  "refresh-bundle",
 			Usage: "update the bundle metadata to reflect the packed rootfs",
 		},
+		cli.IntFlag{
+			Name:  "compression-level",
+			Usage: "gzip compression level for the new layer (-1 is the default level, 0 is no compression, 1-9 are the standard gzip levels)",
+			Value: -1,
+		},
+		cli.BoolFlag{
+			Name:  "no-parallel-compression",
+			Usage: "compress the new layer serially (for byte-for-byte reproducible layers)",
+		},
+		cli.Int64Flag{
+			Name:  "parallel-compression-threshold",
+			Usage: "minimum uncompressed size (in bytes) of the new layer before parallel compression is used",
+		},
+		cli.BoolFlag{
+			Name:  "reproducible",
+			Usage: "normalise timestamps so that repacking the same rootfs always produces an identical layer",
+		},
+		cli.BoolFlag{
+			Name:  "canonicalize",
+			Usage: "flatten the metadata of the new layer (root:root owners, a fixed mtime of SOURCE_DATE_EPOCH or the epoch, and no non-essential xattrs)",
+		},
+		cli.StringSliceFlag{
+			Name:  "ignore",
+			Usage: "gitignore-style pattern (relative to the rootfs) of paths to exclude entirely from the new layer",
+		},
+		cli.BoolFlag{
+			Name:  "from-overlay",
+			Usage: "translate overlayfs whiteouts (0:0 character devices and opaque directories) in the rootfs into OCI whiteouts",
+		},
+		cli.BoolFlag{
+			Name:  "append",
+			Usage: "always add a new layer (and history entry), even if there are no changes to the rootfs",
+		},
+		cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "print the changes which would be included in the new layer, without modifying the image",
+		},
+		cli.BoolFlag{
+			Name:  "force",
+			Usage: "repack the bundle even if its metadata does not match the seal created by umoci-unpack(1)",
+		},
 	},
 
 	Action: repack,
@@ -86,15 +127,49 @@ manifest and configuration information uses the new diff atop the old manifest.`
 			return errors.Errorf("bundle path cannot be empty")
 		}
 		ctx.App.Metadata["bundle"] = ctx.Args().First()
+		if ctx.Bool("dry-run") && ctx.IsSet("refresh-bundle") {
+			return errors.Errorf("--dry-run and --refresh-bundle may not be specified together")
+		}
+		if ctx.Bool("dry-run") && ctx.IsSet("append") {
+			return errors.Errorf("--dry-run and --append may not be specified together")
+		}
+		if level := ctx.Int("compression-level"); level < -1 || level > 9 {
+			return errors.Errorf("invalid --compression-level %d: must be in the range [-1, 9]", level)
+		}
+		if threshold := ctx.Int64("parallel-compression-threshold"); threshold < 0 {
+			return errors.Errorf("invalid --parallel-compression-threshold %d: must not be negative", threshold)
+		}
+		// The gzip options don't make sense for other compression types.
+		if mediaType, ok := ctx.App.Metadata["--media-type"].(string); ok && mediaType != ispec.MediaTypeImageLayerGzip {
+			for _, flag := range []string{"compression-level", "no-parallel-compression", "parallel-compression-threshold"} {
+				if ctx.IsSet(flag) {
+					return errors.Errorf("--%s can only be used with a --media-type of tar+gzip", flag)
+				}
+			}
+		}
 		return nil
 	},
-})
+}))))
+
+// reproducibleTime is the default history creation time used with
+// --reproducible, matching the timestamps used inside the layer.
+var reproducibleTime = time.Unix(0, 0).UTC()
 
 func repack(ctx *cli.Context) error {
 	imagePath := ctx.App.Metadata["--image-path"].(string)
 	tagName := ctx.App.Metadata["--image-tag"].(string)
 	bundlePath := ctx.App.Metadata["bundle"].(string)
 
+	// Make sure the metadata hasn't been tampered with since it was sealed.
+	sealKey, _ := ctx.App.Metadata["--seal-key"].([]byte)
+	sealed, err := umoci.VerifyBundleSeal(bundlePath, sealKey)
+	if err != nil {
+		if !ctx.Bool("force") {
+			return errors.Wrap(err, "verify bundle seal (use --force to ignore)")
+		}
+		log.Warnf("ignoring bundle seal verification failure (--force): %v", err)
+	}
+
 	// Read the metadata first.
 	meta, err := umoci.ReadBundleMeta(bundlePath)
 	if err != nil {
@@ -107,12 +182,16 @@ func repack(ctx *cli.Context) error {
 		"map_options": meta.MapOptions,
 	}).Debugf("umoci: loaded Meta metadata")
 
+	if meta.Overlay {
+		return errors.Errorf("bundle was unpacked with --overlay: repacking overlay bundles is not supported")
+	}
+
 	if meta.From.Descriptor().MediaType != ispec.MediaTypeImageManifest {
 		return errors.Wrap(fmt.Errorf("descriptor does not point to ispec.MediaTypeImageManifest: not implemented: %s", meta.From.Descriptor().MediaType), "invalid saved from descriptor")
 	}
 
 	// Get a reference to the CAS.
-	engine, err := dir.Open(imagePath)
+	engine, err := openEngine(ctx, imagePath)
 	if err != nil {
 		return errors.Wrap(err, "open CAS")
 	}
@@ -145,7 +224,14 @@ func repack(ctx *cli.Context) error {
 
 	var history *ispec.History
 	if !ctx.Bool("no-history") {
-		created := time.Now()
+		created, err := historyCreated(ctx)
+		if err != nil {
+			return err
+		}
+		// --history.created and SOURCE_DATE_EPOCH take precedence.
+		if ctx.Bool("reproducible") && !ctx.IsSet("history.created") && os.Getenv(mutate.SourceDateEpochEnv) == "" {
+			created = reproducibleTime
+		}
 		history = &ispec.History{
 			Author:     imageMeta.Author,
 			Comment:    "",
@@ -160,13 +246,6 @@ func repack(ctx *cli.Context) error {
 		if ctx.IsSet("history.comment") {
 			history.Comment = ctx.String("history.comment")
 		}
-		if ctx.IsSet("history.created") {
-			created, err := time.Parse(igen.ISO8601, ctx.String("history.created"))
-			if err != nil {
-				return errors.Wrap(err, "parsing --history.created")
-			}
-			history.Created = &created
-		}
 		if ctx.IsSet("history.created_by") {
 			history.CreatedBy = ctx.String("history.created_by")
 		}
@@ -176,5 +255,51 @@ func repack(ctx *cli.Context) error {
 		mtreefilter.MaskFilter(maskedPaths),
 	}
 
-	return umoci.Repack(engineExt, tagName, bundlePath, meta, history, filters, ctx.Bool("refresh-bundle"), mutator)
+	if ctx.Bool("dry-run") {
+		diffs, err := umoci.RepackDiff(bundlePath, meta, filters, &layer.RepackOptions{
+			IgnorePatterns: ctx.StringSlice("ignore"),
+		})
+		if err != nil {
+			return errors.Wrap(err, "compute bundle changes")
+		}
+		printFileDiffs(diffs)
+		return nil
+	}
+
+	gzipOptions := mutate.GzipOptions{
+		Level:             ctx.Int("compression-level"),
+		Serial:            ctx.Bool("no-parallel-compression"),
+		ParallelThreshold: ctx.Int64("parallel-compression-threshold"),
+	}
+	compressor, err := layerCompressor(ctx, gzipOptions)
+	if err != nil {
+		return errors.Wrap(err, "create layer compressor")
+	}
+
+	progress, progressDone := newProgress(ctx, "repacking")
+	defer progressDone()
+
+	packOptions := layer.RepackOptions{
+		Reproducible:   ctx.Bool("reproducible"),
+		Canonicalize:   ctx.Bool("canonicalize"),
+		Progress:       progress,
+		IgnorePatterns: ctx.StringSlice("ignore"),
+		AlwaysAppend:   ctx.Bool("append"),
+
+		TranslateOverlayWhiteouts: ctx.Bool("from-overlay"),
+	}
+	if packOptions.Canonicalize {
+		packOptions.CanonicalTime, err = canonicalTime()
+		if err != nil {
+			return err
+		}
+	}
+	if err := umoci.Repack(engineExt, tagName, bundlePath, meta, history, filters, ctx.Bool("refresh-bundle"), mutator, compressor, &packOptions); err != nil {
+		return err
+	}
+	// The bundle metadata was regenerated, so it needs to be re-sealed.
+	if ctx.Bool("refresh-bundle") && (sealed || sealKey != nil) {
+		return errors.Wrap(umoci.SealBundle(bundlePath, sealKey), "seal bundle")
+	}
+	return nil
 }
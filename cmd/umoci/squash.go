@@ -0,0 +1,130 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+
+	"github.com/apex/log"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci"
+	"github.com/opencontainers/umoci/mutate"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+var squashCommand = uxHistory(uxTag(cli.Command{
+	Name:  "squash",
+	Usage: "squashes all layers of an image into a single layer",
+	ArgsUsage: `--image <image-path>[:<tag>]
+
+Where "<image-path>" is the path to the OCI image, and "<tag>" is the name of
+the tagged image to squash (if not specified, defaults to "latest").
+
+All of the layers of the image are combined into a single layer which contains
+the final filesystem state of the image (with all whiteouts applied). The image
+configuration is preserved, but the history of the image is replaced with a
+single history entry for the squashed layer (or cleared, if --no-history is
+specified).`,
+
+	// squash modifies an image layout.
+	Category: "image",
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		return nil
+	},
+
+	Action: squash,
+}))
+
+func squash(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	fromName := ctx.App.Metadata["--image-tag"].(string)
+
+	// By default we clobber the old tag.
+	tagName := fromName
+	if val, ok := ctx.App.Metadata["--tag"]; ok {
+		tagName = val.(string)
+	}
+
+	// Get a reference to the CAS.
+	engine, err := openEngine(ctx, imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	fromDescriptorPath, err := umoci.ResolveReference(context.Background(), engineExt, fromName, nil)
+	if err != nil {
+		return err
+	}
+
+	mutator, err := mutate.New(engine, fromDescriptorPath)
+	if err != nil {
+		return errors.Wrap(err, "create mutator for base image")
+	}
+
+	var history *ispec.History
+	if !ctx.Bool("no-history") {
+		created, err := historyCreated(ctx)
+		if err != nil {
+			return err
+		}
+		history = &ispec.History{
+			Comment:    "",
+			Created:    &created,
+			CreatedBy:  "umoci squash",
+			EmptyLayer: false,
+		}
+
+		if ctx.IsSet("history.author") {
+			history.Author = ctx.String("history.author")
+		}
+		if ctx.IsSet("history.comment") {
+			history.Comment = ctx.String("history.comment")
+		}
+		if ctx.IsSet("history.created_by") {
+			history.CreatedBy = ctx.String("history.created_by")
+		}
+	}
+
+	log.Info("squashing layers ...")
+	layerDescriptor, err := mutator.Squash(context.Background(), history, mutate.GzipCompressor)
+	if err != nil {
+		return errors.Wrap(err, "squash layers")
+	}
+	log.Infof("... done: %s", layerDescriptor.Digest)
+
+	newDescriptorPath, err := mutator.Commit(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "commit mutated image")
+	}
+
+	log.Infof("new image manifest created: %s->%s", newDescriptorPath.Root().Digest, newDescriptorPath.Descriptor().Digest)
+
+	if err := engineExt.UpdateReference(context.Background(), tagName, newDescriptorPath.Root()); err != nil {
+		return errors.Wrap(err, "add new tag")
+	}
+	log.Infof("updated tag for image manifest: %s", tagName)
+	return nil
+}
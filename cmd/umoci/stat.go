@@ -25,13 +25,12 @@ import (
 
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/opencontainers/umoci"
-	"github.com/opencontainers/umoci/oci/cas/dir"
 	"github.com/opencontainers/umoci/oci/casext"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
 )
 
-var statCommand = cli.Command{
+var statCommand = uxPlatform(cli.Command{
 	Name:  "stat",
 	Usage: "displays status information of an image manifest",
 	ArgsUsage: `--image <image-path>[:<tag>]
@@ -58,35 +57,32 @@ humans to read, and might change in future versions.`,
 			Name:  "json",
 			Usage: "output the stat information as a JSON encoded blob",
 		},
+		cli.BoolFlag{
+			Name:  "uncompressed",
+			Usage: "decompress every layer to compute its uncompressed size (this may be slow)",
+		},
 	},
 
 	Action: stat,
-}
+})
 
 func stat(ctx *cli.Context) error {
 	imagePath := ctx.App.Metadata["--image-path"].(string)
 	tagName := ctx.App.Metadata["--image-tag"].(string)
 
 	// Get a reference to the CAS.
-	engine, err := dir.Open(imagePath)
+	engine, err := openEngine(ctx, imagePath)
 	if err != nil {
 		return errors.Wrap(err, "open CAS")
 	}
-	engineExt := casext.NewEngine(engine)
+	engineExt := casext.NewEngine(engine).WithBlobCache(casext.DefaultBlobCacheSize)
 	defer engine.Close()
 
-	manifestDescriptorPaths, err := engineExt.ResolveReference(context.Background(), tagName)
+	manifestDescriptorPath, err := umoci.ResolveReference(context.Background(), engineExt, tagName, platformMetadata(ctx))
 	if err != nil {
-		return errors.Wrap(err, "get descriptor")
-	}
-	if len(manifestDescriptorPaths) == 0 {
-		return errors.Errorf("tag not found: %s", tagName)
-	}
-	if len(manifestDescriptorPaths) != 1 {
-		// TODO: Handle this more nicely.
-		return errors.Errorf("tag is ambiguous: %s", tagName)
+		return err
 	}
-	manifestDescriptor := manifestDescriptorPaths[0].Descriptor()
+	manifestDescriptor := manifestDescriptorPath.Descriptor()
 
 	// FIXME: Implement support for manifest lists.
 	if manifestDescriptor.MediaType != ispec.MediaTypeImageManifest {
@@ -94,7 +90,7 @@ func stat(ctx *cli.Context) error {
 	}
 
 	// Get stat information.
-	ms, err := umoci.Stat(context.Background(), engineExt, manifestDescriptor)
+	ms, err := umoci.Stat(context.Background(), engineExt, manifestDescriptor, ctx.Bool("uncompressed"))
 	if err != nil {
 		return errors.Wrap(err, "stat")
 	}
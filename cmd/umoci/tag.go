@@ -19,10 +19,13 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"os"
+	"strings"
 
 	"github.com/apex/log"
-	"github.com/opencontainers/umoci/oci/cas/dir"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/opencontainers/umoci/oci/casext"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
@@ -32,16 +35,61 @@ var tagAddCommand = cli.Command{
 	Name:  "tag",
 	Usage: "creates a new tag in an OCI image",
 	ArgsUsage: `--image <image-path>[:<tag>] <new-tag>
+   umoci tag --image <image-path> {--rename|--copy} [--force] <old-tag> <new-tag>
 
 Where "<image-path>" is the path to the OCI image, "<tag>" is the old name of
-the tag and "<new-tag>" is the new name of the tag.`,
+the tag and "<new-tag>" is the new name of the tag.
+
+With --rename or --copy, the top-level index entries of "<old-tag>" are
+renamed (or copied) to "<new-tag>" without resolving the tag or touching any
+blobs. Unless --force is given, this fails if "<new-tag>" already exists.`,
 
 	// tag modifies an image layout.
 	Category: "image",
 
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "rename",
+			Usage: "rename <old-tag> to <new-tag> (only modifying the index)",
+		},
+		cli.BoolFlag{
+			Name:  "copy",
+			Usage: "copy <old-tag> to <new-tag> (only modifying the index)",
+		},
+		cli.BoolFlag{
+			Name:  "force",
+			Usage: "replace <new-tag> if it already exists (with --rename or --copy)",
+		},
+	},
+
 	Action: tagAdd,
 
 	Before: func(ctx *cli.Context) error {
+		if ctx.Bool("rename") && ctx.Bool("copy") {
+			return errors.Errorf("--rename and --copy are mutually exclusive")
+		}
+		if ctx.Bool("rename") || ctx.Bool("copy") {
+			if ctx.NArg() != 2 {
+				return errors.Errorf("invalid number of positional arguments: expected <old-tag> <new-tag>")
+			}
+			if strings.Contains(ctx.String("image"), ":") {
+				return errors.Errorf("--image must not contain a tag with --rename or --copy")
+			}
+			for _, tag := range ctx.Args() {
+				if tag == "" {
+					return errors.Errorf("tag cannot be empty")
+				}
+				if !casext.IsValidReferenceName(tag) {
+					return errors.Errorf("tag is an invalid reference: %q", tag)
+				}
+			}
+			ctx.App.Metadata["--image-tag"] = ctx.Args().Get(0)
+			ctx.App.Metadata["new-tag"] = ctx.Args().Get(1)
+			return nil
+		}
+		if ctx.Bool("force") {
+			return errors.Errorf("--force can only be used with --rename or --copy")
+		}
 		if ctx.NArg() != 1 {
 			return errors.Errorf("invalid number of positional arguments: expected <new-tag>")
 		}
@@ -62,24 +110,39 @@ func tagAdd(ctx *cli.Context) error {
 	tagName := ctx.App.Metadata["new-tag"].(string)
 
 	// Get a reference to the CAS.
-	engine, err := dir.Open(imagePath)
+	engine, err := openEngine(ctx, imagePath)
 	if err != nil {
 		return errors.Wrap(err, "open CAS")
 	}
 	engineExt := casext.NewEngine(engine)
 	defer engine.Close()
 
+	switch {
+	case ctx.Bool("rename"):
+		if err := engineExt.RenameReference(context.Background(), fromName, tagName, ctx.Bool("force")); err != nil {
+			return errors.Wrap(err, "rename reference")
+		}
+		log.Infof("renamed tag: %q -> %q", fromName, tagName)
+		return nil
+	case ctx.Bool("copy"):
+		if err := engineExt.CopyReference(context.Background(), fromName, tagName, ctx.Bool("force")); err != nil {
+			return errors.Wrap(err, "copy reference")
+		}
+		log.Infof("copied tag: %q -> %q", tagName, fromName)
+		return nil
+	}
+
 	// Get original descriptor.
 	descriptorPaths, err := engineExt.ResolveReference(context.Background(), fromName)
 	if err != nil {
 		return errors.Wrap(err, "get descriptor")
 	}
 	if len(descriptorPaths) == 0 {
-		return errors.Errorf("tag not found: %s", fromName)
+		return errors.Wrap(casext.ErrReferenceNotFound, fromName)
 	}
 	if len(descriptorPaths) != 1 {
 		// TODO: Handle this more nicely.
-		return errors.Errorf("tag is ambiguous: %s", fromName)
+		return errors.Wrap(casext.ErrAmbiguousReference, fromName)
 	}
 	descriptor := descriptorPaths[0].Descriptor()
 
@@ -120,7 +183,7 @@ func tagRemove(ctx *cli.Context) error {
 	tagName := ctx.App.Metadata["--image-tag"].(string)
 
 	// Get a reference to the CAS.
-	engine, err := dir.Open(imagePath)
+	engine, err := openEngine(ctx, imagePath)
 	if err != nil {
 		return errors.Wrap(err, "open CAS")
 	}
@@ -145,11 +208,21 @@ var tagListCommand = cli.Command{
 Where "<image-path>" is the path to the OCI layout.
 
 Gives the full list of tags in an OCI layout, with each tag name on a single
-line. See umoci-stat(1) to get more information about each tagged image.`,
+line. See umoci-stat(1) to get more information about each tagged image.
+
+With --json, the top-level index entry of each tag (including its media-type,
+digest, size, platform and annotations) is output as a JSON array.`,
 
 	// tag modifies an image layout.
 	Category: "layout",
 
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "output the index entry of each tag as a JSON encoded array",
+		},
+	},
+
 	Before: func(ctx *cli.Context) error {
 		if ctx.NArg() != 0 {
 			return errors.Errorf("invalid number of positional arguments: expected none")
@@ -160,17 +233,50 @@ line. See umoci-stat(1) to get more information about each tagged image.`,
 	Action: tagList,
 }
 
+// tagListEntry is the --json output of umoci-list(1) for a single tag.
+type tagListEntry struct {
+	// Name is the reference name of the tag.
+	Name string `json:"name"`
+
+	// Descriptor is the top-level index entry of the tag.
+	ispec.Descriptor
+}
+
 func tagList(ctx *cli.Context) error {
 	imagePath := ctx.App.Metadata["--image-path"].(string)
 
 	// Get a reference to the CAS.
-	engine, err := dir.Open(imagePath)
+	engine, err := openEngine(ctx, imagePath)
 	if err != nil {
 		return errors.Wrap(err, "open CAS")
 	}
 	engineExt := casext.NewEngine(engine)
 	defer engine.Close()
 
+	if ctx.Bool("json") {
+		// We need the full index entries, not just the names.
+		index, err := engineExt.GetIndex(context.Background())
+		if err != nil {
+			return errors.Wrap(err, "get top-level index")
+		}
+
+		entries := []tagListEntry{}
+		for _, descriptor := range index.Manifests {
+			name, ok := descriptor.Annotations[ispec.AnnotationRefName]
+			if !ok {
+				continue
+			}
+			entries = append(entries, tagListEntry{
+				Name:       name,
+				Descriptor: descriptor,
+			})
+		}
+		if err := json.NewEncoder(os.Stdout).Encode(entries); err != nil {
+			return errors.Wrap(err, "encoding tag list")
+		}
+		return nil
+	}
+
 	names, err := engineExt.ListReferences(context.Background())
 	if err != nil {
 		return errors.Wrap(err, "list references")
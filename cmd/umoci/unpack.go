@@ -18,15 +18,18 @@
 package main
 
 import (
+	"os"
+
 	"github.com/opencontainers/umoci"
-	"github.com/opencontainers/umoci/oci/cas/dir"
 	"github.com/opencontainers/umoci/oci/casext"
 	"github.com/opencontainers/umoci/oci/layer"
+	"github.com/opencontainers/umoci/oci/registry"
+	"github.com/opencontainers/umoci/pkg/userns"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
 )
 
-var unpackCommand = uxRemap(cli.Command{
+var unpackCommand = uxRegistryImage(uxProgress(uxRuntime(uxPlatform(uxRemap(uxSealKey(cli.Command{
 	Name:  "unpack",
 	Usage: "unpacks a reference into an OCI runtime bundle",
 	ArgsUsage: `--image <image-path>[:<tag>] <bundle>
@@ -35,6 +38,13 @@ Where "<image-path>" is the path to the OCI image, "<tag>" is the name of the
 tagged image to unpack (if not specified, defaults to "latest") and "<bundle>"
 is the destination to unpack the image to.
 
+Alternatively, --image can be a reference to an image in a registry of the form
+"docker://[<registry>/]<repository>[:<tag>][@<digest>]", in which case the
+layers are streamed from the registry and extracted as they are downloaded
+(without storing the image on disk). Because the image is not stored in an
+image layout, the resulting bundle can only be repacked into an image layout
+containing the same image (such as one created with umoci-pull(1)).
+
 It should be noted that this is not the same as oci-create-runtime-bundle,
 because this command also will create an mtree specification to allow for layer
 creation with umoci-repack(1).`,
@@ -47,6 +57,71 @@ creation with umoci-repack(1).`,
 			Name:  "keep-dirlinks",
 			Usage: "don't clobber underlying symlinks to directories",
 		},
+		cli.BoolFlag{
+			Name:  "allow-foreign-layers",
+			Usage: "fetch non-distributable layers which are not included in the image from their urls",
+		},
+		cli.BoolFlag{
+			Name:  "detect-compression",
+			Usage: "detect the compression of layers from their contents rather than their media type",
+		},
+		cli.BoolFlag{
+			Name:  "overlay",
+			Usage: "extract each layer to a separate overlayfs lower directory (layerN/) rather than a single rootfs",
+		},
+		cli.StringFlag{
+			Name:  "rootless-devices",
+			Usage: "how to handle devices which cannot be created when unprivileged (placeholder, skip, error)",
+			Value: layer.RootlessDevicePlaceholder.String(),
+		},
+		cli.BoolFlag{
+			Name:  "shadow-xattrs",
+			Usage: "store privileged xattrs which cannot be set when unprivileged in user.umoci.* xattrs",
+		},
+		cli.StringFlag{
+			Name:  "layer-cache",
+			Usage: "directory used to cache extracted layers, so that layers shared with previously unpacked images are not re-extracted",
+		},
+		cli.BoolFlag{
+			Name:  "userns",
+			Usage: "unpack inside a new user namespace configured with the --uid-map and --gid-map mappings (using newuidmap(1) and newgidmap(1))",
+		},
+		cli.BoolFlag{
+			Name:  "preserve-atime",
+			Usage: "restore the access time of extracted files from the image (default, for compatibility with older versions)",
+		},
+		cli.BoolFlag{
+			Name:  "no-preserve-atime",
+			Usage: "do not restore the access time of extracted files from the image",
+		},
+		cli.StringFlag{
+			Name:  "mtree-keywords",
+			Usage: "comma-separated set of mtree keywords to record for the bundle (or +keyword/-keyword to modify the default set)",
+		},
+		cli.StringFlag{
+			Name:  "mtree-output",
+			Usage: "path of the mtree manifest (relative to the bundle unless absolute)",
+		},
+		cli.BoolFlag{
+			Name:  "no-mtree",
+			Usage: "do not generate the mtree manifest or umoci metadata (the bundle cannot be repacked)",
+		},
+		cli.StringFlag{
+			Name:  "manifest-out",
+			Usage: "write a JSON manifest of every path created, modified or deleted in the rootfs to this path",
+		},
+		cli.BoolFlag{
+			Name:  "seal",
+			Usage: "seal the bundle metadata with a checksum (or a HMAC with --seal-key) which is verified by umoci-repack(1)",
+		},
+		cli.BoolFlag{
+			Name:  "rootfs-only",
+			Usage: "extract only the root filesystem directly into <bundle> (without a config.json or umoci metadata)",
+		},
+		cli.BoolFlag{
+			Name:  "refresh",
+			Usage: "re-base an existing bundle onto the image without re-extracting it",
+		},
 	},
 
 	Action: unpack,
@@ -58,10 +133,79 @@ creation with umoci-repack(1).`,
 		if ctx.Args().First() == "" {
 			return errors.Errorf("bundle path cannot be empty")
 		}
+		if ctx.Bool("overlay") && (ctx.IsSet("mtree-keywords") || ctx.IsSet("mtree-output")) {
+			return errors.Errorf("--mtree-keywords and --mtree-output cannot be used with --overlay")
+		}
+		if ctx.Bool("preserve-atime") && ctx.Bool("no-preserve-atime") {
+			return errors.Errorf("--preserve-atime and --no-preserve-atime are mutually exclusive")
+		}
+		if ctx.IsSet("mtree-output") && ctx.String("mtree-output") == "" {
+			return errors.Errorf("--mtree-output cannot be empty")
+		}
+		if ctx.IsSet("manifest-out") {
+			if ctx.String("manifest-out") == "" {
+				return errors.Errorf("--manifest-out cannot be empty")
+			}
+			if ctx.Bool("overlay") {
+				return errors.Errorf("--manifest-out cannot be used with --overlay")
+			}
+		}
+		if ctx.IsSet("layer-cache") {
+			if ctx.String("layer-cache") == "" {
+				return errors.Errorf("--layer-cache cannot be empty")
+			}
+			if ctx.Bool("overlay") {
+				return errors.Errorf("--layer-cache cannot be used with --overlay")
+			}
+		}
+		if ctx.Bool("userns") {
+			if ctx.Bool("rootless") {
+				return errors.Errorf("--userns and --rootless may not be specified together")
+			}
+			if !ctx.Bool("subid-auto") && (!ctx.IsSet("uid-map") || !ctx.IsSet("gid-map")) {
+				return errors.Errorf("--userns requires --uid-map and --gid-map (or --subid-auto)")
+			}
+		}
+		if ctx.Bool("no-mtree") {
+			for _, flag := range []string{"overlay", "mtree-keywords", "mtree-output", "refresh", "seal", "seal-key"} {
+				if ctx.IsSet(flag) {
+					return errors.Errorf("--no-mtree and --%s may not be specified together", flag)
+				}
+			}
+		}
+		if ctx.Bool("rootfs-only") {
+			// There is no runtime configuration or bundle metadata, so
+			// none of the options controlling them make sense.
+			for _, flag := range []string{
+				"overlay", "mtree-keywords", "mtree-output", "no-mtree",
+				"refresh", "seal", "seal-key", "no-hardening",
+				"masked-path", "readonly-path", "default-capabilities",
+				"seccomp",
+			} {
+				if ctx.IsSet(flag) {
+					return errors.Errorf("--rootfs-only and --%s may not be specified together", flag)
+				}
+			}
+		}
+		if ctx.Bool("refresh") {
+			// The bundle has already been extracted, so none of the options
+			// controlling extraction make sense.
+			for _, flag := range []string{
+				"keep-dirlinks", "allow-foreign-layers", "detect-compression", "overlay",
+				"rootless-devices", "shadow-xattrs", "layer-cache", "preserve-atime",
+				"no-preserve-atime", "mtree-keywords",
+				"mtree-output", "manifest-out", "uid-map", "gid-map", "rootless", "subid-auto",
+				"userns",
+			} {
+				if ctx.IsSet(flag) {
+					return errors.Errorf("--refresh and --%s may not be specified together", flag)
+				}
+			}
+		}
 		ctx.App.Metadata["bundle"] = ctx.Args().First()
 		return nil
 	},
-})
+}))))))
 
 func unpack(ctx *cli.Context) error {
 	imagePath := ctx.App.Metadata["--image-path"].(string)
@@ -78,15 +222,93 @@ func unpack(ctx *cli.Context) error {
 		return err
 	}
 
+	// With --userns, the unpack is done by a copy of umoci running inside a
+	// user namespace in which the mapped host IDs can be used directly.
+	if ctx.Bool("userns") && !userns.IsChild() {
+		status, err := userns.Run(os.Args, meta.MapOptions.UIDMappings, meta.MapOptions.GIDMappings)
+		if err != nil {
+			return errors.Wrap(err, "--userns")
+		}
+		if status != 0 {
+			return errors.Errorf("unpack inside user namespace failed (exit status %d)", status)
+		}
+		return nil
+	}
+
 	unpackOptions.KeepDirlinks = ctx.Bool("keep-dirlinks")
+	unpackOptions.AllowForeignLayers = ctx.Bool("allow-foreign-layers")
+	unpackOptions.DetectCompression = ctx.Bool("detect-compression")
+	unpackOptions.ShadowXattrs = ctx.Bool("shadow-xattrs")
+	unpackOptions.LayerCache = ctx.String("layer-cache")
+	unpackOptions.NoPreserveAtime = ctx.Bool("no-preserve-atime")
 	unpackOptions.MapOptions = meta.MapOptions
+	unpackOptions.RuntimeOptions = runtimeOptionsMetadata(ctx)
+	unpackOptions.RootlessDeviceMode, err = layer.ParseRootlessDeviceMode(ctx.String("rootless-devices"))
+	if err != nil {
+		return errors.Wrap(err, "invalid --rootless-devices")
+	}
+
+	var bundleOptions umoci.BundleOptions
+	if ctx.IsSet("mtree-keywords") {
+		bundleOptions.MtreeKeywords, err = umoci.ParseMtreeKeywords(ctx.String("mtree-keywords"))
+		if err != nil {
+			return errors.Wrap(err, "invalid --mtree-keywords")
+		}
+	}
+	bundleOptions.MtreePath = ctx.String("mtree-output")
+	bundleOptions.NoMtree = ctx.Bool("no-mtree")
+	bundleOptions.FileManifestPath = ctx.String("manifest-out")
+	bundleOptions.RootfsOnly = ctx.Bool("rootfs-only")
 
 	// Get a reference to the CAS.
-	engine, err := dir.Open(imagePath)
+	var engineExt casext.Engine
+	if ref, ok := ctx.App.Metadata["--image-registry"].(registry.Reference); ok {
+		engineExt, err = registryEngine(ctx, ref, fromName)
+		if err != nil {
+			return err
+		}
+	} else {
+		engine, err := openEngine(ctx, imagePath)
+		if err != nil {
+			return errors.Wrap(err, "open CAS")
+		}
+		engineExt = casext.NewEngine(engine)
+	}
+	defer engineExt.Close()
+
+	sealKey, _ := ctx.App.Metadata["--seal-key"].([]byte)
+	seal := ctx.Bool("seal") || sealKey != nil
+
+	if ctx.Bool("refresh") {
+		// Refreshing regenerates the metadata, so make sure the old metadata
+		// wasn't tampered with before re-sealing it.
+		sealed, err := umoci.VerifyBundleSeal(bundlePath, sealKey)
+		if err != nil {
+			return errors.Wrap(err, "verify bundle seal")
+		}
+		if err := umoci.RefreshBundle(engineExt, fromName, bundlePath, platformMetadata(ctx)); err != nil {
+			return err
+		}
+		if sealed || seal {
+			return errors.Wrap(umoci.SealBundle(bundlePath, sealKey), "seal bundle")
+		}
+		return nil
+	}
+
+	progress, progressDone := newProgress(ctx, "unpacking")
+	defer progressDone()
+	unpackOptions.Progress = progress
+
+	if ctx.Bool("overlay") {
+		err = umoci.UnpackOverlay(engineExt, fromName, bundlePath, unpackOptions, platformMetadata(ctx))
+	} else {
+		err = umoci.UnpackBundle(engineExt, fromName, bundlePath, unpackOptions, platformMetadata(ctx), bundleOptions)
+	}
 	if err != nil {
-		return errors.Wrap(err, "open CAS")
+		return err
+	}
+	if seal {
+		return errors.Wrap(umoci.SealBundle(bundlePath, sealKey), "seal bundle")
 	}
-	engineExt := casext.NewEngine(engine)
-	defer engine.Close()
-	return umoci.Unpack(engineExt, fromName, bundlePath, unpackOptions)
+	return nil
 }
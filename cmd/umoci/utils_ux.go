@@ -18,10 +18,28 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
 	"strings"
+	"time"
 
+	"github.com/apex/log"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/opencontainers/umoci"
+	"github.com/opencontainers/umoci/mutate"
+	"github.com/opencontainers/umoci/oci/cas"
 	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/opencontainers/umoci/oci/casext/mediatype"
+	iconv "github.com/opencontainers/umoci/oci/config/convert"
+	igen "github.com/opencontainers/umoci/oci/config/generate"
+	"github.com/opencontainers/umoci/oci/layer"
+	"github.com/opencontainers/umoci/oci/registry"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
 )
@@ -88,6 +106,55 @@ func uxHistory(cmd cli.Command) cli.Command {
 	return cmd
 }
 
+// historyCreated returns the created value for a new history entry, which is
+// the value of --history.created if it was set and otherwise the value of
+// mutate.Now (which honours SOURCE_DATE_EPOCH).
+func historyCreated(ctx *cli.Context) (time.Time, error) {
+	if ctx.IsSet("history.created") {
+		created, err := time.Parse(igen.ISO8601, ctx.String("history.created"))
+		if err != nil {
+			return time.Time{}, errors.Wrap(err, "parsing --history.created")
+		}
+		return created, nil
+	}
+	return mutate.Now()
+}
+
+// canonicalTime returns the modification time of every entry in a layer
+// generated with --canonicalize, which is the value of SOURCE_DATE_EPOCH if it
+// is set. Otherwise the zero time is returned, so that the default of
+// layer.RepackOptions (the Unix epoch) is used.
+func canonicalTime() (time.Time, error) {
+	epoch, ok, err := mutate.SourceDateEpoch()
+	if err != nil || !ok {
+		return time.Time{}, err
+	}
+	return epoch, nil
+}
+
+// openEngine opens the existing image at imagePath (see umoci.OpenEngine),
+// falling back to the additional blob stores given with the global
+// --additional-blob-store flag for blobs which are not in the image.
+func openEngine(ctx *cli.Context, imagePath string) (cas.Engine, error) {
+	engine, err := umoci.OpenEngine(imagePath)
+	if err != nil {
+		// Give a hint for existing layouts which umoci doesn't understand,
+		// since they might just be outdated.
+		if fi, statErr := os.Stat(imagePath); statErr == nil && fi.IsDir() && errors.Cause(err) == cas.ErrInvalid {
+			log.Warnf("%s is not a valid OCI image layout: maybe umoci migrate will help?", imagePath)
+		}
+		return nil, err
+	}
+	stores := ctx.GlobalStringSlice("additional-blob-store")
+	storeEngine, err := casext.WithAdditionalBlobStores(engine, stores...)
+	if err != nil {
+		// #nosec G104
+		_ = engine.Close()
+		return nil, errors.Wrap(err, "invalid --additional-blob-store")
+	}
+	return storeEngine, nil
+}
+
 // uxTag adds a --tag flag to the given cli.Command as well as adding relevant
 // validation logic to the .Before of the command. The value will be stored in
 // ctx.Metadata["--tag"] as a string (or nil if --tag was not specified).
@@ -109,6 +176,9 @@ func uxTag(cmd cli.Command) cli.Command {
 				return errors.Wrap(fmt.Errorf("tag is empty"), "invalid --tag")
 			}
 			ctx.App.Metadata["--tag"] = tag
+		} else if tag, ok := ctx.App.Metadata["--image-tag"].(string); ok && isSelectorReference(tag) {
+			// We cannot overwrite an annotation or digest reference.
+			return errors.Errorf("missing mandatory argument: --tag (--image is an annotation or digest reference)")
 		}
 
 		// Include any old befores set.
@@ -121,44 +191,110 @@ func uxTag(cmd cli.Command) cli.Command {
 	return cmd
 }
 
+// isSelectorReference returns whether the given --image tag is an annotation
+// or digest reference (see casext.AnnotationReferencePrefix and
+// casext.DigestReferencePrefix) rather than a tag. Such references can only be
+// resolved, not updated.
+func isSelectorReference(tag string) bool {
+	_, _, byAnnotation, _ := casext.ParseAnnotationReference(tag)
+	_, _, byDigest, _ := casext.ParseDigestReference(tag)
+	return byAnnotation || byDigest
+}
+
+// parseImageURI parses an OCI image URI of the form "path[:tag]" (as used by
+// --image), returning the path and tag. If no tag is given, it defaults to
+// "latest". The image can instead be selected by an annotation with a URI of
+// the form "path@annotation:key=value", in which case the returned tag is the
+// annotation reference "@annotation:key=value" (see
+// casext.AnnotationReferencePrefix), or by the (possibly truncated) digest of
+// a manifest with a URI of the form "path@sha256:abcd", in which case the
+// returned tag is the digest reference "@sha256:abcd" (see
+// casext.DigestReferencePrefix).
+func parseImageURI(image string) (string, string, error) {
+	var dir, tag string
+	for _, algorithm := range []digest.Algorithm{digest.SHA256, digest.SHA384, digest.SHA512} {
+		sep := strings.LastIndex(image, casext.DigestReferencePrefix+algorithm.String()+":")
+		if sep == -1 {
+			continue
+		}
+		dir, tag = image[:sep], image[sep:]
+		if dir == "" {
+			return "", "", fmt.Errorf("path is empty")
+		}
+		if _, _, _, err := casext.ParseDigestReference(tag); err != nil {
+			return "", "", err
+		}
+		return dir, tag, nil
+	}
+	if sep := strings.Index(image, casext.AnnotationReferencePrefix); sep != -1 {
+		dir, tag = image[:sep], image[sep:]
+		if dir == "" {
+			return "", "", fmt.Errorf("path is empty")
+		}
+		if _, _, _, err := casext.ParseAnnotationReference(tag); err != nil {
+			return "", "", err
+		}
+		return dir, tag, nil
+	}
+	sep := strings.Index(image, ":")
+	if sep == -1 {
+		dir = image
+		tag = "latest"
+	} else {
+		dir = image[:sep]
+		tag = image[sep+1:]
+	}
+
+	// Verify directory value.
+	if dir == "" {
+		return "", "", fmt.Errorf("path is empty")
+	}
+
+	// Verify tag value.
+	if !casext.IsValidReferenceName(tag) {
+		return "", "", fmt.Errorf("tag contains invalid characters: '%s'", tag)
+	}
+	if tag == "" {
+		return "", "", fmt.Errorf("tag is empty")
+	}
+	return dir, tag, nil
+}
+
 // uxImage adds an --image flag to the given cli.Command as well as adding
 // relevant validation logic to the .Before of the command. The values (image,
 // tag) will be stored in ctx.Metadata["--image-path"] and
 // ctx.Metadata["--image-tag"] as strings (both will be nil if --image is not
-// specified).
+// specified). If the command was wrapped with uxRegistryImage, --image may
+// instead be a registry reference (see uxRegistryImage).
 func uxImage(cmd cli.Command) cli.Command {
 	cmd.Flags = append(cmd.Flags, cli.StringFlag{
 		Name:  "image",
-		Usage: "OCI image URI of the form 'path[:tag]'",
+		Usage: "OCI image URI of the form 'path[:tag]' (or 'path@annotation:key=value')",
 	})
 
 	oldBefore := cmd.Before
 	cmd.Before = func(ctx *cli.Context) error {
 		// Verify and parse --image.
-		if ctx.IsSet("image") {
-			image := ctx.String("image")
-
-			var dir, tag string
-			sep := strings.Index(image, ":")
-			if sep == -1 {
-				dir = image
-				tag = "latest"
-			} else {
-				dir = image[:sep]
-				tag = image[sep+1:]
+		if image := ctx.String("image"); ctx.IsSet("image") && strings.HasPrefix(image, registry.TransportPrefix) {
+			if !hasFlag(ctx.Command.Flags, registryImageFlag) {
+				return errors.Errorf("invalid --image: registry references are not supported by this command")
 			}
-
-			// Verify directory value.
-			if dir == "" {
-				return errors.Wrap(fmt.Errorf("path is empty"), "invalid --image")
+			ref, err := registry.ParseReference(image)
+			if err != nil {
+				return errors.Wrap(err, "invalid --image")
 			}
-
-			// Verify tag value.
-			if !casext.IsValidReferenceName(tag) {
-				return errors.Wrap(fmt.Errorf("tag contains invalid characters: '%s'", tag), "invalid --image")
+			tag := ref.Tag
+			if ref.Digest != "" {
+				tag = "latest"
 			}
-			if tag == "" {
-				return errors.Wrap(fmt.Errorf("tag is empty"), "invalid --image")
+
+			ctx.App.Metadata["--image-registry"] = ref
+			ctx.App.Metadata["--image-path"] = ""
+			ctx.App.Metadata["--image-tag"] = tag
+		} else if ctx.IsSet("image") {
+			dir, tag, err := parseImageURI(ctx.String("image"))
+			if err != nil {
+				return errors.Wrap(err, "invalid --image")
 			}
 
 			ctx.App.Metadata["--image-path"] = dir
@@ -174,6 +310,66 @@ func uxImage(cmd cli.Command) cli.Command {
 	return cmd
 }
 
+// registryImageFlag is the flag added by uxRegistryImage, which is also used by
+// uxImage to tell whether a command supports registry references.
+const registryImageFlag = "plain-http"
+
+func hasFlag(flags []cli.Flag, name string) bool {
+	for _, flag := range flags {
+		if flag.GetName() == name {
+			return true
+		}
+	}
+	return false
+}
+
+// uxRegistryImage allows the --image flag (added by uxImage) of the given
+// cli.Command to also be a registry reference of the form
+// "docker://[<registry>/]<repository>[:<tag>][@<digest>]", and adds the
+// --plain-http and --timeout flags used when accessing the registry. If --image is a registry
+// reference, the parsed registry.Reference is stored in
+// ctx.App.Metadata["--image-registry"] (along with an empty
+// ctx.App.Metadata["--image-path"]), and the command should use
+// registryEngine to access the image.
+func uxRegistryImage(cmd cli.Command) cli.Command {
+	cmd.Flags = append(cmd.Flags, cli.BoolFlag{
+		Name:  registryImageFlag,
+		Usage: "access the registry over plain HTTP rather than HTTPS (if --image is a registry reference)",
+	}, registryTimeoutFlag)
+	return cmd
+}
+
+// registryTimeoutFlag is the --timeout flag of commands which access a
+// registry, which is used as registry.ClientOptions.Timeout.
+var registryTimeoutFlag = cli.DurationFlag{
+	Name:  "timeout",
+	Usage: "abort registry requests which make no progress for this long, such as 30s (0 disables the timeout)",
+}
+
+// registryDeadlineFlag is the --deadline flag of commands which transfer whole
+// images to or from a registry. Unlike --timeout (which only aborts stalled
+// requests), it bounds the entire operation -- see registryContext.
+var registryDeadlineFlag = cli.DurationFlag{
+	Name:  "deadline",
+	Usage: "abort the whole operation if it takes longer than this, such as 10m (0 disables the deadline)",
+}
+
+// registryContext returns the context used for an operation which transfers
+// an image to or from a registry, which is cancelled once the --deadline (if
+// any) has passed.
+func registryContext(ctx *cli.Context) (context.Context, context.CancelFunc, error) {
+	deadline := ctx.Duration("deadline")
+	switch {
+	case deadline < 0:
+		return nil, nil, errors.Errorf("invalid --deadline %s: must not be negative", deadline)
+	case deadline == 0:
+		return context.Background(), func() {}, nil
+	default:
+		regCtx, cancel := context.WithTimeout(context.Background(), deadline)
+		return regCtx, cancel, nil
+	}
+}
+
 // uxLayout adds an --layout flag to the given cli.Command as well as adding
 // relevant validation logic to the .Before of the command. The value is stored
 // in ctx.App.Metadata["--image-path"] as a string (or nil --layout was not set).
@@ -223,7 +419,269 @@ func uxRemap(cmd cli.Command) cli.Command {
 			Name:  "rootless",
 			Usage: "enable rootless command support",
 		},
+		cli.BoolFlag{
+			Name:  "subid-auto",
+			Usage: "generate the uid and gid mappings from the current user's /etc/subuid and /etc/subgid allocations",
+		},
+		cli.StringFlag{
+			Name:  "on-unmapped",
+			Usage: "what to do when unpacking owners not covered by the uid and gid mappings ([error], skip, nobody)",
+			Value: string(layer.UnmappedError),
+		},
+		cli.IntFlag{
+			Name:  "nobody-uid",
+			Usage: "container uid to use for unmapped uids with --on-unmapped=nobody",
+			Value: layer.DefaultNobodyID,
+		},
+		cli.IntFlag{
+			Name:  "nobody-gid",
+			Usage: "container gid to use for unmapped gids with --on-unmapped=nobody",
+			Value: layer.DefaultNobodyID,
+		},
+	}...)
+
+	return cmd
+}
+
+// uxPlatform adds a --platform flag to the given cli.Command as well as adding
+// relevant validation logic to the .Before of the command. The value will be
+// stored in ctx.App.Metadata["--platform"] as an *ispec.Platform (or nil if
+// --platform was not specified).
+func uxPlatform(cmd cli.Command) cli.Command {
+	cmd.Flags = append(cmd.Flags, cli.StringFlag{
+		Name:  "platform",
+		Usage: "select the image for the given platform (os/arch[/variant]) from a multi-platform index",
+	})
+
+	oldBefore := cmd.Before
+	cmd.Before = func(ctx *cli.Context) error {
+		// Verify and parse --platform.
+		if ctx.IsSet("platform") {
+			platform, err := casext.ParsePlatform(ctx.String("platform"))
+			if err != nil {
+				return errors.Wrap(err, "invalid --platform")
+			}
+			ctx.App.Metadata["--platform"] = &platform
+		}
+
+		if oldBefore != nil {
+			return oldBefore(ctx)
+		}
+		return nil
+	}
+
+	return cmd
+}
+
+// platformMetadata returns the --platform value set by uxPlatform, or nil if
+// --platform was not specified.
+func platformMetadata(ctx *cli.Context) *ispec.Platform {
+	platform, _ := ctx.App.Metadata["--platform"].(*ispec.Platform)
+	return platform
+}
+
+// uxRuntime adds the set of flags controlling runtime configuration generation
+// (--no-hardening, --masked-path, --readonly-path, --default-capabilities and
+// --seccomp) to the given cli.Command
+// as well as adding relevant validation logic to the .Before of the command.
+// The parsed options are stored in ctx.App.Metadata["--runtime-options"] as a
+// layer.RuntimeOptions.
+func uxRuntime(cmd cli.Command) cli.Command {
+	cmd.Flags = append(cmd.Flags, []cli.Flag{
+		cli.BoolFlag{
+			Name:  "no-hardening",
+			Usage: "do not add the default masked and read-only paths to the generated config.json",
+		},
+		cli.StringSliceFlag{
+			Name:  "masked-path",
+			Usage: "additional path to add to linux.maskedPaths in the generated config.json",
+		},
+		cli.StringSliceFlag{
+			Name:  "readonly-path",
+			Usage: "additional path to add to linux.readonlyPaths in the generated config.json",
+		},
+		cli.BoolFlag{
+			Name:  "default-capabilities",
+			Usage: "grant the default capability set of container engines in the generated config.json",
+		},
+		cli.StringFlag{
+			Name:  "seccomp",
+			Usage: "seccomp profile for the generated config.json (none, minimal or a path to a profile)",
+			Value: "none",
+		},
 	}...)
 
+	oldBefore := cmd.Before
+	cmd.Before = func(ctx *cli.Context) error {
+		// Verify and parse the runtime options.
+		for _, flag := range []string{"masked-path", "readonly-path"} {
+			for _, p := range ctx.StringSlice(flag) {
+				if !path.IsAbs(p) {
+					return errors.Errorf("invalid --%s: path must be absolute: %q", flag, p)
+				}
+			}
+		}
+		seccomp, err := parseSeccomp(ctx.String("seccomp"))
+		if err != nil {
+			return errors.Wrap(err, "invalid --seccomp")
+		}
+		ctx.App.Metadata["--runtime-options"] = layer.RuntimeOptions{
+			NoHardening:         ctx.Bool("no-hardening"),
+			MaskedPaths:         ctx.StringSlice("masked-path"),
+			ReadonlyPaths:       ctx.StringSlice("readonly-path"),
+			DefaultCapabilities: ctx.Bool("default-capabilities"),
+			Seccomp:             seccomp,
+		}
+
+		if oldBefore != nil {
+			return oldBefore(ctx)
+		}
+		return nil
+	}
+
+	return cmd
+}
+
+// parseSeccomp parses the value of --seccomp, which is either "none" (no
+// seccomp profile), "minimal" (convert.MinimalSeccomp) or the path to a JSON
+// file containing a linux.seccomp profile.
+func parseSeccomp(value string) (*rspec.LinuxSeccomp, error) {
+	switch value {
+	case "":
+		return nil, errors.Errorf("value cannot be empty")
+	case "none":
+		return nil, nil
+	case "minimal":
+		return iconv.MinimalSeccomp(), nil
+	}
+
+	data, err := ioutil.ReadFile(value)
+	if err != nil {
+		return nil, errors.Wrap(err, "read seccomp profile")
+	}
+	var seccomp rspec.LinuxSeccomp
+	if err := json.Unmarshal(data, &seccomp); err != nil {
+		return nil, errors.Wrapf(err, "parse seccomp profile %s", value)
+	}
+	if seccomp.DefaultAction == "" {
+		return nil, errors.Errorf("seccomp profile %s has no defaultAction", value)
+	}
+	return &seccomp, nil
+}
+
+// runtimeOptionsMetadata returns the runtime options set by uxRuntime.
+func runtimeOptionsMetadata(ctx *cli.Context) layer.RuntimeOptions {
+	opts, _ := ctx.App.Metadata["--runtime-options"].(layer.RuntimeOptions)
+	return opts
+}
+
+// layerMediaTypes is the set of short names accepted by --media-type, and the
+// OCI layer media type they correspond to.
+var layerMediaTypes = map[string]string{
+	"tar":      ispec.MediaTypeImageLayer,
+	"tar+gzip": ispec.MediaTypeImageLayerGzip,
+	"tar+zstd": mediatype.MediaTypeImageLayerZstd,
+}
+
+// parseLayerMediaType parses a --media-type value, which is either one of the
+// short names in layerMediaTypes or the corresponding full OCI media type.
+func parseLayerMediaType(value string) (string, error) {
+	if mediaType, ok := layerMediaTypes[value]; ok {
+		return mediaType, nil
+	}
+	for _, mediaType := range layerMediaTypes {
+		if value == mediaType {
+			return mediaType, nil
+		}
+	}
+	return "", errors.Errorf("unsupported layer media type %q: must be one of tar, tar+gzip, tar+zstd, or %s", value, zstdChunkedLayerFormat)
+}
+
+// zstdChunkedLayerFormat is the --media-type short name for zstd:chunked
+// layers. They have the same media type as tar+zstd layers, but are
+// compressed with mutate.ZstdChunkedCompressor.
+const zstdChunkedLayerFormat = "tar+zstd:chunked"
+
+// layerCompressor returns the mutate.Compressor for the new layer based on the
+// --media-type set by uxMediaType. If --media-type was not specified, layers
+// are compressed with gzip. The gzip options are only used for gzip layers.
+func layerCompressor(ctx *cli.Context, gzipOptions mutate.GzipOptions) (mutate.Compressor, error) {
+	if chunked, _ := ctx.App.Metadata["--zstd-chunked"].(bool); chunked {
+		return mutate.ZstdChunkedCompressor, nil
+	}
+	if mediaType, ok := ctx.App.Metadata["--media-type"].(string); ok {
+		return mutate.CompressorForMediaType(mediaType, gzipOptions)
+	}
+	return mutate.NewGzipCompressor(gzipOptions)
+}
+
+// uxMediaType adds a --media-type flag to the given cli.Command as well as
+// adding relevant validation logic to the .Before of the command. The full OCI
+// media type of the new layer will be stored in ctx.App.Metadata["--media-type"]
+// as a string (or unset if --media-type was not specified). For zstd:chunked
+// layers, ctx.App.Metadata["--zstd-chunked"] is also set to true. Use
+// layerCompressor to get the matching mutate.Compressor.
+func uxMediaType(cmd cli.Command) cli.Command {
+	cmd.Flags = append(cmd.Flags, cli.StringFlag{
+		Name:  "media-type",
+		Usage: "media type (and thus compression) of the new layer (tar, tar+gzip, tar+zstd, or " + zstdChunkedLayerFormat + ")",
+	})
+
+	oldBefore := cmd.Before
+	cmd.Before = func(ctx *cli.Context) error {
+		if ctx.IsSet("media-type") {
+			if ctx.String("media-type") == zstdChunkedLayerFormat {
+				ctx.App.Metadata["--media-type"] = mediatype.MediaTypeImageLayerZstd
+				ctx.App.Metadata["--zstd-chunked"] = true
+			} else {
+				mediaType, err := parseLayerMediaType(ctx.String("media-type"))
+				if err != nil {
+					return errors.Wrap(err, "invalid --media-type")
+				}
+				ctx.App.Metadata["--media-type"] = mediaType
+			}
+		}
+
+		// Include any old befores set.
+		if oldBefore != nil {
+			return oldBefore(ctx)
+		}
+		return nil
+	}
+
+	return cmd
+}
+
+// uxSealKey adds a --seal-key flag to the given cli.Command, which is the path
+// of a file containing the secret key used to seal (or verify the seal of) the
+// bundle metadata. The contents of the key file are stored in ctx.Metadata
+// with the key "--seal-key" (as a []byte). If the flag is not set the value
+// will be nil.
+func uxSealKey(cmd cli.Command) cli.Command {
+	cmd.Flags = append(cmd.Flags, cli.StringFlag{
+		Name:  "seal-key",
+		Usage: "path of a file containing the secret key for the HMAC seal of the bundle metadata",
+	})
+
+	oldBefore := cmd.Before
+	cmd.Before = func(ctx *cli.Context) error {
+		if ctx.IsSet("seal-key") {
+			key, err := ioutil.ReadFile(ctx.String("seal-key"))
+			if err != nil {
+				return errors.Wrap(err, "read --seal-key")
+			}
+			if len(key) == 0 {
+				return errors.Errorf("invalid --seal-key: key file %s is empty", ctx.String("seal-key"))
+			}
+			ctx.App.Metadata["--seal-key"] = key
+		}
+
+		// Include any old befores set.
+		if oldBefore != nil {
+			return oldBefore(ctx)
+		}
+		return nil
+	}
+
 	return cmd
 }
@@ -0,0 +1,96 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/opencontainers/umoci/oci/layer"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+var verifyConfigCommand = uxPlatform(cli.Command{
+	Name:  "verify-config",
+	Usage: "verifies the diffids of an image configuration against its layers",
+	ArgsUsage: `--image <image-path>[:<tag>]
+
+Where "<image-path>" is the path to the OCI image, and "<tag>" is the name of
+the tagged image to verify.
+
+This command will decompress every layer of the image and check that its
+DiffID (the digest of the uncompressed layer) matches the corresponding entry
+in the rootfs.diff_ids of the image configuration. All mismatches found are
+printed, and the command fails if there were any.`,
+
+	// verify-config reads manifest information.
+	Category: "image",
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		return nil
+	},
+
+	Action: verifyConfig,
+})
+
+func verifyConfig(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	tagName := ctx.App.Metadata["--image-tag"].(string)
+
+	// Get a reference to the CAS.
+	engine, err := openEngine(ctx, imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	manifestDescriptorPath, err := umoci.ResolveReference(context.Background(), engineExt, tagName, platformMetadata(ctx))
+	if err != nil {
+		return err
+	}
+	manifestDescriptor := manifestDescriptorPath.Descriptor()
+
+	// FIXME: Implement support for manifest lists.
+	if manifestDescriptor.MediaType != ispec.MediaTypeImageManifest {
+		return errors.Wrap(fmt.Errorf("descriptor does not point to ispec.MediaTypeImageManifest: not implemented: %s", manifestDescriptor.MediaType), "invalid saved from descriptor")
+	}
+
+	mismatches, err := engineExt.VerifyDiffIDs(context.Background(), manifestDescriptor, func(ctx context.Context, descriptor ispec.Descriptor) (digest.Digest, error) {
+		return layer.DiffID(ctx, engineExt, descriptor)
+	})
+	if err != nil {
+		return errors.Wrap(err, "verify diffids")
+	}
+	for _, mismatch := range mismatches {
+		fmt.Println(mismatch)
+	}
+	if len(mismatches) > 0 {
+		return errors.Errorf("image config does not match layers (%d mismatches found)", len(mismatches))
+	}
+	fmt.Println("image config matches layers: no mismatches found")
+	return nil
+}
@@ -0,0 +1,151 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/umoci"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+var verifyCommand = uxPlatform(cli.Command{
+	Name:  "verify",
+	Usage: "verifies the cosign signatures of an image",
+	ArgsUsage: `--image <image-path>[:<tag>] --key <public-key>
+
+Where "<image-path>" is the path to the OCI image, "<tag>" is the name of the
+tagged image to verify, and "<public-key>" is the path to a PEM-encoded public
+key (such as the cosign.pub generated by "cosign generate-key-pair").
+
+The cosign signature manifests of the image are looked up in the same image
+(using the cosign "sha256-<digest>.sig" tag convention, as well as manifests
+whose subject is the image) and each signature is verified against the image
+manifest digest. No registries or transparency logs are contacted. The command
+fails unless at least one valid signature was found.
+
+WARNING: Do not depend on the output of this tool unless you're using --json.
+The intention of the default formatting of this tool is that it is easy for
+humans to read, and might change in future versions.`,
+
+	// verify reads manifest information.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "key",
+			Usage: "path to the PEM-encoded public key to verify signatures with",
+		},
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "output the result of verifying each signature as a JSON encoded array",
+		},
+	},
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		if ctx.String("key") == "" {
+			return errors.Errorf("--key must be specified")
+		}
+		return nil
+	},
+
+	Action: verify,
+})
+
+func verify(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	tagName := ctx.App.Metadata["--image-tag"].(string)
+
+	keyData, err := ioutil.ReadFile(ctx.String("key"))
+	if err != nil {
+		return errors.Wrap(err, "read public key")
+	}
+	key, err := umoci.ParsePublicKey(keyData)
+	if err != nil {
+		return err
+	}
+
+	// Get a reference to the CAS.
+	engine, err := openEngine(ctx, imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	descriptorPath, err := umoci.ResolveReference(context.Background(), engineExt, tagName, platformMetadata(ctx))
+	if err != nil {
+		return err
+	}
+
+	// cosign signs whatever the tag refers to, which is the image index for
+	// multi-platform images. So we verify both the tagged descriptor and the
+	// manifest for our platform.
+	imageDigests := []digest.Digest{descriptorPath.Root().Digest}
+	if manifestDigest := descriptorPath.Descriptor().Digest; manifestDigest != imageDigests[0] {
+		imageDigests = append(imageDigests, manifestDigest)
+	}
+
+	signatures := []umoci.Signature{}
+	for _, imageDigest := range imageDigests {
+		imageSignatures, err := umoci.VerifyCosignSignatures(context.Background(), engineExt, imageDigest, key)
+		if err != nil {
+			return errors.Wrapf(err, "verify signatures of %s", imageDigest)
+		}
+		signatures = append(signatures, imageSignatures...)
+	}
+
+	valid := 0
+	for _, signature := range signatures {
+		if signature.Valid {
+			valid++
+		}
+	}
+
+	if ctx.Bool("json") {
+		if err := json.NewEncoder(os.Stdout).Encode(signatures); err != nil {
+			return errors.Wrap(err, "encoding signatures")
+		}
+	} else {
+		for _, signature := range signatures {
+			if signature.Valid {
+				fmt.Printf("valid signature of %s (%s)\n", signature.Image, signature.Manifest.Digest)
+			} else {
+				fmt.Printf("invalid signature of %s (%s): %s\n", signature.Image, signature.Manifest.Digest, signature.Error)
+			}
+		}
+	}
+
+	if len(signatures) == 0 {
+		return errors.Errorf("no signatures found for image")
+	}
+	if valid == 0 {
+		return errors.Errorf("no valid signatures found for image (%d invalid signatures)", len(signatures))
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"path"
+	"sort"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/opencontainers/umoci/oci/layer"
+	"github.com/pkg/errors"
+	"github.com/vbatts/go-mtree"
+)
+
+// DiffKeywords is the set of mtree keywords compared by Diff. Unlike
+// MtreeKeywords, timestamps are not included because they usually change for
+// reasons unrelated to the contents of the image.
+var DiffKeywords = []mtree.Keyword{
+	"type",
+	"mode",
+	"uid",
+	"gid",
+	"size",
+	"link",
+	"sha256digest",
+	"xattr",
+}
+
+// FileDiffType is the kind of change to a path reported by Diff.
+type FileDiffType string
+
+const (
+	// FileAdded indicates that the path only exists in the new image.
+	FileAdded FileDiffType = "added"
+
+	// FileRemoved indicates that the path only exists in the old image.
+	FileRemoved FileDiffType = "removed"
+
+	// FileModified indicates that the path exists in both images, but some
+	// of its metadata or contents differ.
+	FileModified FileDiffType = "modified"
+)
+
+// FileDiffKey is a single difference in the metadata of a modified path.
+type FileDiffKey struct {
+	// Keyword is the mtree keyword which differs.
+	Keyword string `json:"keyword"`
+
+	// Old and New are the values of the keyword in the old and new image. They
+	// are nil if the keyword is not set in that image.
+	Old *string `json:"old"`
+	New *string `json:"new"`
+}
+
+// FileDiff describes how a single path differs between two images.
+type FileDiff struct {
+	// Path is the (absolute) path inside the root filesystem.
+	Path string `json:"path"`
+
+	// Type is the kind of change.
+	Type FileDiffType `json:"type"`
+
+	// Keys is the set of differences for modified paths.
+	Keys []FileDiffKey `json:"keys,omitempty"`
+}
+
+// manifestHierarchy computes the mtree hierarchy of the root filesystem of the
+// given manifest. Rather than extracting the root filesystem, the layers are
+// squashed into a single stream which is fed directly to mtree.
+func manifestHierarchy(ctx context.Context, engineExt casext.Engine, manifestDescriptor ispec.Descriptor) (*mtree.DirectoryHierarchy, error) {
+	if manifestDescriptor.MediaType != ispec.MediaTypeImageManifest {
+		return nil, errors.Errorf("cannot diff a non-manifest descriptor: invalid media type '%s'", manifestDescriptor.MediaType)
+	}
+	manifestBlob, err := engineExt.FromDescriptor(ctx, manifestDescriptor)
+	if err != nil {
+		return nil, errors.Wrap(err, "get manifest")
+	}
+	defer manifestBlob.Close()
+	manifest, ok := manifestBlob.Data.(ispec.Manifest)
+	if !ok {
+		// Should _never_ be reached.
+		return nil, errors.Errorf("[internal error] unknown manifest blob type: %s", manifestBlob.Descriptor.MediaType)
+	}
+
+	squashed, err := layer.SquashLayers(ctx, engineExt, manifest.Layers)
+	if err != nil {
+		return nil, errors.Wrap(err, "squash layers")
+	}
+	defer squashed.Close()
+
+	streamer := mtree.NewTarStreamer(squashed, nil, DiffKeywords)
+	if _, err := io.Copy(ioutil.Discard, streamer); err != nil {
+		return nil, errors.Wrap(err, "read squashed layers")
+	}
+	if err := streamer.Close(); err != nil {
+		return nil, errors.Wrap(err, "close mtree streamer")
+	}
+	return streamer.Hierarchy()
+}
+
+// Diff computes the differences between the root filesystems of the two
+// given manifests, in terms of the metadata in DiffKeywords. The root
+// filesystems are not extracted to do this. The returned differences are
+// sorted by path.
+func Diff(ctx context.Context, oldEngine, newEngine casext.Engine, oldManifest, newManifest ispec.Descriptor) ([]FileDiff, error) {
+	oldDh, err := manifestHierarchy(ctx, oldEngine, oldManifest)
+	if err != nil {
+		return nil, errors.Wrapf(err, "compute filesystem of %s", oldManifest.Digest)
+	}
+	newDh, err := manifestHierarchy(ctx, newEngine, newManifest)
+	if err != nil {
+		return nil, errors.Wrapf(err, "compute filesystem of %s", newManifest.Digest)
+	}
+
+	deltas, err := mtree.Compare(oldDh, newDh, DiffKeywords)
+	if err != nil {
+		return nil, errors.Wrap(err, "compare filesystems")
+	}
+	return fileDiffs(deltas), nil
+}
+
+// fileDiffs converts a set of mtree deltas into FileDiffs, sorted by path.
+func fileDiffs(deltas []mtree.InodeDelta) []FileDiff {
+	diffs := []FileDiff{}
+	for _, delta := range deltas {
+		diff := FileDiff{Path: path.Clean("/" + delta.Path())}
+		switch delta.Type() {
+		case mtree.Extra:
+			diff.Type = FileAdded
+		case mtree.Missing:
+			diff.Type = FileRemoved
+		case mtree.Modified:
+			diff.Type = FileModified
+			for _, key := range delta.Diff() {
+				diff.Keys = append(diff.Keys, FileDiffKey{
+					Keyword: string(key.Name()),
+					Old:     key.Old(),
+					New:     key.New(),
+				})
+			}
+		default:
+			continue
+		}
+		diffs = append(diffs, diff)
+	}
+	sort.Slice(diffs, func(i, j int) bool {
+		return diffs[i].Path < diffs[j].Path
+	})
+	return diffs
+}
@@ -0,0 +1,185 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	imeta "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/cas/dir"
+	"github.com/opencontainers/umoci/oci/casext"
+)
+
+type diffTestEntry struct {
+	hdr  tar.Header
+	data string
+}
+
+// putDiffTestImage adds an image with the given layers to the image,
+// returning the manifest descriptor. The config is not valid, but Diff doesn't
+// need it.
+func putDiffTestImage(t *testing.T, engineExt casext.Engine, layers ...[]diffTestEntry) ispec.Descriptor {
+	ctx := context.Background()
+
+	manifest := ispec.Manifest{
+		Versioned: imeta.Versioned{SchemaVersion: 2},
+		MediaType: ispec.MediaTypeImageManifest,
+	}
+	for _, entries := range layers {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for _, entry := range entries {
+			hdr := entry.hdr
+			hdr.Size = int64(len(entry.data))
+			if err := tw.WriteHeader(&hdr); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tw.Write([]byte(entry.data)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		layerDigest, layerSize, err := engineExt.PutBlob(ctx, &buf)
+		if err != nil {
+			t.Fatalf("put layer: %+v", err)
+		}
+		manifest.Layers = append(manifest.Layers, ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageLayer,
+			Digest:    layerDigest,
+			Size:      layerSize,
+		})
+	}
+
+	configDigest, configSize, err := engineExt.PutBlobJSON(ctx, ispec.Image{})
+	if err != nil {
+		t.Fatalf("put config: %+v", err)
+	}
+	manifest.Config = ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageConfig,
+		Digest:    configDigest,
+		Size:      configSize,
+	}
+	manifestDigest, manifestSize, err := engineExt.PutBlobJSON(ctx, manifest)
+	if err != nil {
+		t.Fatalf("put manifest: %+v", err)
+	}
+	return ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    manifestDigest,
+		Size:      manifestSize,
+	}
+}
+
+func TestDiff(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestDiff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	base := []diffTestEntry{
+		{hdr: tar.Header{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{hdr: tar.Header{Name: "etc/config", Typeflag: tar.TypeReg, Mode: 0644}, data: "old config"},
+		{hdr: tar.Header{Name: "etc/removed", Typeflag: tar.TypeReg, Mode: 0644}, data: "removed"},
+		{hdr: tar.Header{Name: "etc/same", Typeflag: tar.TypeReg, Mode: 0644}, data: "same"},
+		{hdr: tar.Header{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{hdr: tar.Header{Name: "bin/tool", Typeflag: tar.TypeReg, Mode: 0644}, data: "tool"},
+	}
+	oldManifest := putDiffTestImage(t, engineExt, base)
+	newManifest := putDiffTestImage(t, engineExt, base, []diffTestEntry{
+		{hdr: tar.Header{Name: "etc/config", Typeflag: tar.TypeReg, Mode: 0644}, data: "new config"},
+		{hdr: tar.Header{Name: "etc/.wh.removed", Typeflag: tar.TypeReg, Mode: 0644}},
+		{hdr: tar.Header{Name: "etc/added", Typeflag: tar.TypeSymlink, Linkname: "same", Mode: 0777}},
+		// Only the mtime of etc/same changes, which must be ignored.
+		{hdr: tar.Header{Name: "etc/same", Typeflag: tar.TypeReg, Mode: 0644, ModTime: time.Unix(1234, 0)}, data: "same"},
+		{hdr: tar.Header{Name: "bin/tool", Typeflag: tar.TypeReg, Mode: 0755}, data: "tool"},
+	})
+
+	diffs, err := Diff(ctx, engineExt, engineExt, oldManifest, newManifest)
+	if err != nil {
+		t.Fatalf("unexpected error computing diff: %+v", err)
+	}
+
+	expected := map[string]FileDiffType{
+		"/bin/tool":    FileModified,
+		"/etc/added":   FileAdded,
+		"/etc/config":  FileModified,
+		"/etc/removed": FileRemoved,
+	}
+	got := map[string]FileDiffType{}
+	var paths []string
+	for _, diff := range diffs {
+		got[diff.Path] = diff.Type
+		paths = append(paths, diff.Path)
+	}
+	if !reflect.DeepEqual(expected, got) {
+		t.Errorf("unexpected diff: expected %v, got %v", expected, got)
+	}
+	if !reflect.DeepEqual(paths, []string{"/bin/tool", "/etc/added", "/etc/config", "/etc/removed"}) {
+		t.Errorf("diff not sorted by path: %v", paths)
+	}
+
+	for _, diff := range diffs {
+		var keywords []string
+		for _, key := range diff.Keys {
+			keywords = append(keywords, key.Keyword)
+		}
+		switch diff.Path {
+		case "/bin/tool":
+			if len(diff.Keys) != 1 || diff.Keys[0].Keyword != "mode" || *diff.Keys[0].Old != "0644" || *diff.Keys[0].New != "0755" {
+				t.Errorf("unexpected changes to %s: %+v", diff.Path, diff.Keys)
+			}
+		case "/etc/config":
+			if !reflect.DeepEqual(keywords, []string{"sha256digest"}) {
+				t.Errorf("unexpected changes to %s: %v", diff.Path, keywords)
+			}
+		}
+	}
+
+	// An image must not differ from itself.
+	if diffs, err := Diff(ctx, engineExt, engineExt, newManifest, newManifest); err != nil {
+		t.Errorf("unexpected error computing diff: %+v", err)
+	} else if len(diffs) != 0 {
+		t.Errorf("expected no differences between identical images, got %+v", diffs)
+	}
+}
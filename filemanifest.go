@@ -0,0 +1,193 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/opencontainers/umoci/oci/layer"
+	"github.com/opencontainers/umoci/pkg/fseval"
+	"github.com/pkg/errors"
+)
+
+// FileManifestVersion is the version of the FileManifest format. It is
+// incremented whenever an incompatible change is made to the format.
+const FileManifestVersion = 1
+
+// FileManifest is a machine-readable description of every path changed in the
+// root filesystem of a bundle when it was unpacked (see
+// BundleOptions.FileManifestPath).
+type FileManifest struct {
+	// Version is the version of the format (FileManifestVersion).
+	Version int `json:"version"`
+
+	// Entries are the changed paths, sorted by path.
+	Entries []FileManifestEntry `json:"entries"`
+}
+
+// FileManifestEntry describes a single path changed during unpacking.
+type FileManifestEntry struct {
+	// Path is the (absolute) path inside the root filesystem.
+	Path string `json:"path"`
+
+	// Change is how the path was changed ("created", "modified" or
+	// "deleted"). A path which already existed in the root filesystem before
+	// unpacking (or was created by an earlier layer and then replaced) is
+	// "modified".
+	Change string `json:"change"`
+
+	// Type is the final type of the path ("file", "dir", "symlink", "char",
+	// "block", "fifo" or "socket"). It is omitted for deleted paths.
+	Type string `json:"type,omitempty"`
+
+	// Mode is the final permission bits of the path (including the setuid,
+	// setgid and sticky bits), as an octal string. It is omitted for deleted
+	// paths.
+	Mode string `json:"mode,omitempty"`
+
+	// Size is the final size of the path in bytes. It is only set for regular
+	// files.
+	Size *int64 `json:"size,omitempty"`
+}
+
+// fileManifestRecorder collects the paths changed by a layer.TarExtractor.
+type fileManifestRecorder struct {
+	// existed records, for every changed path, whether the path existed
+	// before it was first changed.
+	existed map[string]bool
+}
+
+func newFileManifestRecorder() *fileManifestRecorder {
+	return &fileManifestRecorder{existed: map[string]bool{}}
+}
+
+// onPathChange is a layer.PathChangeFunc.
+func (r *fileManifestRecorder) onPathChange(path string, change layer.PathChange) {
+	if _, ok := r.existed[path]; !ok {
+		r.existed[path] = change != layer.PathCreated
+	}
+}
+
+// fileTypeName returns the FileManifestEntry.Type of the given mode.
+func fileTypeName(mode os.FileMode) string {
+	switch {
+	case mode.IsRegular():
+		return "file"
+	case mode&os.ModeDir != 0:
+		return "dir"
+	case mode&os.ModeSymlink != 0:
+		return "symlink"
+	case mode&os.ModeCharDevice != 0:
+		return "char"
+	case mode&os.ModeDevice != 0:
+		return "block"
+	case mode&os.ModeNamedPipe != 0:
+		return "fifo"
+	case mode&os.ModeSocket != 0:
+		return "socket"
+	}
+	return "unknown"
+}
+
+// fileModeBits returns the permission bits of mode (in the traditional unix
+// layout, rather than the layout used by os.FileMode).
+func fileModeBits(mode os.FileMode) uint32 {
+	bits := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		bits |= 04000
+	}
+	if mode&os.ModeSetgid != 0 {
+		bits |= 02000
+	}
+	if mode&os.ModeSticky != 0 {
+		bits |= 01000
+	}
+	return bits
+}
+
+// manifest generates the FileManifest of the recorded changes, based on the
+// current state of rootfs. Paths which were created but no longer exist (such
+// as files removed by a whiteout in a later layer) are not included.
+func (r *fileManifestRecorder) manifest(rootfs string, fsEval fseval.FsEval) (*FileManifest, error) {
+	var paths []string
+	for path := range r.existed {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	fileManifest := &FileManifest{
+		Version: FileManifestVersion,
+		Entries: []FileManifestEntry{},
+	}
+	for _, path := range paths {
+		existed := r.existed[path]
+		fi, err := fsEval.Lstat(filepath.Join(rootfs, path))
+		if os.IsNotExist(errors.Cause(err)) {
+			if existed {
+				fileManifest.Entries = append(fileManifest.Entries, FileManifestEntry{
+					Path:   path,
+					Change: layer.PathDeleted.String(),
+				})
+			}
+			continue
+		} else if err != nil {
+			return nil, errors.Wrapf(err, "lstat %s", path)
+		}
+
+		entry := FileManifestEntry{
+			Path:   path,
+			Change: layer.PathCreated.String(),
+			Type:   fileTypeName(fi.Mode()),
+			Mode:   fmt.Sprintf("%04o", fileModeBits(fi.Mode())),
+		}
+		if existed {
+			entry.Change = layer.PathModified.String()
+		}
+		if fi.Mode().IsRegular() {
+			size := fi.Size()
+			entry.Size = &size
+		}
+		fileManifest.Entries = append(fileManifest.Entries, entry)
+	}
+	return fileManifest, nil
+}
+
+// writeFileManifest writes the FileManifest of the recorded changes to path.
+func (r *fileManifestRecorder) writeFileManifest(path, rootfs string, fsEval fseval.FsEval) error {
+	fileManifest, err := r.manifest(rootfs, fsEval)
+	if err != nil {
+		return errors.Wrap(err, "generate file manifest")
+	}
+
+	fh, err := os.Create(path)
+	if err != nil {
+		return errors.Wrap(err, "create file manifest")
+	}
+	defer fh.Close()
+
+	enc := json.NewEncoder(fh)
+	enc.SetIndent("", "\t")
+	if err := enc.Encode(fileManifest); err != nil {
+		return errors.Wrap(err, "encode file manifest")
+	}
+	return errors.Wrap(fh.Close(), "close file manifest")
+}
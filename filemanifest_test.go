@@ -0,0 +1,100 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/opencontainers/umoci/oci/layer"
+	"github.com/opencontainers/umoci/pkg/fseval"
+)
+
+func TestFileManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestFileManifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rootfs := filepath.Join(dir, "rootfs")
+	if err := os.MkdirAll(filepath.Join(rootfs, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(rootfs, "dir", "file"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(rootfs, "dir"), 0755|os.ModeSticky); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("dir/file", filepath.Join(rootfs, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := newFileManifestRecorder()
+	for _, change := range []struct {
+		path   string
+		change layer.PathChange
+	}{
+		{"/dir", layer.PathModified},
+		{"/dir/file", layer.PathCreated},
+		{"/dir/file", layer.PathModified},
+		{"/link", layer.PathCreated},
+		// Created and then deleted by a later layer.
+		{"/tmp", layer.PathCreated},
+		{"/tmp", layer.PathDeleted},
+		// Deleted from the existing rootfs.
+		{"/old", layer.PathDeleted},
+	} {
+		recorder.onPathChange(change.path, change.change)
+	}
+
+	manifestPath := filepath.Join(dir, "manifest.json")
+	if err := recorder.writeFileManifest(manifestPath, rootfs, fseval.Default); err != nil {
+		t.Fatalf("unexpected writeFileManifest error: %+v", err)
+	}
+
+	fh, err := os.Open(manifestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+
+	var got FileManifest
+	if err := json.NewDecoder(fh).Decode(&got); err != nil {
+		t.Fatalf("decode file manifest: %v", err)
+	}
+
+	fileSize := int64(5)
+	expected := FileManifest{
+		Version: FileManifestVersion,
+		Entries: []FileManifestEntry{
+			{Path: "/dir", Change: "modified", Type: "dir", Mode: "1755"},
+			{Path: "/dir/file", Change: "created", Type: "file", Mode: "0644", Size: &fileSize},
+			{Path: "/link", Change: "created", Type: "symlink", Mode: "0777"},
+			{Path: "/old", Change: "deleted"},
+		},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("unexpected file manifest:\n\texpected: %+v\n\tgot:      %+v", expected, got)
+	}
+}
@@ -1,13 +1,18 @@
 package mutate
 
 import (
+	"bytes"
+	stdgzip "compress/gzip"
 	"io"
 	"io/ioutil"
 	"runtime"
+	"time"
 
 	"github.com/apex/log"
 	zstd "github.com/klauspost/compress/zstd"
 	gzip "github.com/klauspost/pgzip"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/casext/mediatype"
 	"github.com/opencontainers/umoci/pkg/system"
 	"github.com/pkg/errors"
 )
@@ -38,18 +43,119 @@ func (nc noopCompressor) MediaTypeSuffix() string {
 var NoopCompressor Compressor = noopCompressor{}
 
 // GzipCompressor provides gzip compression.
-var GzipCompressor Compressor = gzipCompressor{}
+var GzipCompressor Compressor = gzipCompressor{GzipOptions{Level: gzip.DefaultCompression}}
 
-type gzipCompressor struct{}
+// GzipCompressorLevel returns a Compressor which provides gzip compression at
+// the given compression level. A level of -1 uses the default gzip level, 0
+// disables compression entirely (the layer is still a valid gzip stream made
+// up of stored blocks, so the layer still has a "+gzip" media-type), and 1-9
+// are the standard gzip levels (from fastest to smallest).
+func GzipCompressorLevel(level int) (Compressor, error) {
+	return NewGzipCompressor(GzipOptions{Level: level})
+}
+
+// GzipOptions describes how a gzip Compressor should compress layers.
+type GzipOptions struct {
+	// Level is the gzip compression level. See GzipCompressorLevel for the
+	// meaning of the different values.
+	Level int
+
+	// Serial disables parallel compression entirely. Parallel gzip streams
+	// are valid gzip streams and are reproducible for a given block size, but
+	// are not byte-for-byte identical to the output of a serial gzip
+	// implementation. If you need layers to be reproducible across
+	// implementations, set this option.
+	Serial bool
+
+	// ParallelThreshold is the minimum (uncompressed) size of a layer, in
+	// bytes, for which parallel compression will be used. Layers smaller than
+	// this are compressed serially. Note that up to ParallelThreshold bytes
+	// of the layer are buffered in memory in order to make this decision. A
+	// value of 0 means that parallel compression is always used.
+	ParallelThreshold int64
+}
+
+// NewGzipCompressor returns a Compressor which provides gzip compression with
+// the given options. Unless disabled, layers will be compressed in parallel
+// (splitting the compression across GOMAXPROCS workers).
+func NewGzipCompressor(opts GzipOptions) (Compressor, error) {
+	if opts.Level < gzip.DefaultCompression || opts.Level > gzip.BestCompression {
+		return nil, errors.Errorf("invalid gzip compression level %d: must be in the range [%d, %d]", opts.Level, gzip.DefaultCompression, gzip.BestCompression)
+	}
+	if opts.ParallelThreshold < 0 {
+		return nil, errors.Errorf("invalid parallel gzip threshold %d: must not be negative", opts.ParallelThreshold)
+	}
+	return gzipCompressor{opts}, nil
+}
+
+type gzipCompressor struct {
+	opts GzipOptions
+}
+
+// gzipParallelBlockSize is the size of each block compressed by a parallel
+// gzip worker. This must not be changed, as it affects the output of parallel
+// compression and thus would break reproducibility.
+const gzipParallelBlockSize = 256 << 10
+
+// gzipUnknownOS is the gzip header OS byte meaning "unknown" (RFC 1952). We
+// always use this (rather than the OS of the host) and never include a
+// modification time or filename in the gzip header, so that the compressed
+// layer only depends on the layer contents.
+const gzipUnknownOS = 255
+
+// newWriter creates the gzip writer for a layer, deciding whether to use
+// parallel compression based on the options. For thresholded parallel
+// compression, this requires reading some of the layer from reader -- what
+// is returned is the reader which should be used in place of reader.
+func (gz gzipCompressor) newWriter(w io.Writer, reader io.Reader) (io.WriteCloser, io.Reader, error) {
+	parallel := !gz.opts.Serial
+	if parallel && gz.opts.ParallelThreshold > 0 {
+		// Buffer the first ParallelThreshold bytes to figure out whether the
+		// layer is large enough to make parallel compression worthwhile.
+		var buffer bytes.Buffer
+		n, err := system.Copy(&buffer, io.LimitReader(reader, gz.opts.ParallelThreshold))
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "buffer layer")
+		}
+		parallel = n >= gz.opts.ParallelThreshold
+		reader = io.MultiReader(&buffer, reader)
+	}
+
+	if !parallel {
+		gzw, err := stdgzip.NewWriterLevel(w, gz.opts.Level)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "create gzip writer with level %d", gz.opts.Level)
+		}
+		gzw.Header = stdgzip.Header{OS: gzipUnknownOS}
+		return gzw, reader, nil
+	}
+
+	gzw, err := gzip.NewWriterLevel(w, gz.opts.Level)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "create parallel gzip writer with level %d", gz.opts.Level)
+	}
+	// pgzip doesn't special-case a zero ModTime (unlike compress/gzip) and
+	// would otherwise write a garbage truncated timestamp, so we need to
+	// explicitly use the epoch (which means "no timestamp" in gzip).
+	gzw.Header = gzip.Header{OS: gzipUnknownOS, ModTime: time.Unix(0, 0)}
+	blocks := 2 * runtime.GOMAXPROCS(0)
+	if err := gzw.SetConcurrency(gzipParallelBlockSize, blocks); err != nil {
+		return nil, nil, errors.Wrapf(err, "set concurrency level to %v blocks", blocks)
+	}
+	return gzw, reader, nil
+}
 
 func (gz gzipCompressor) Compress(reader io.Reader) (io.ReadCloser, error) {
 	pipeReader, pipeWriter := io.Pipe()
 
-	gzw := gzip.NewWriter(pipeWriter)
-	if err := gzw.SetConcurrency(256<<10, 2*runtime.NumCPU()); err != nil {
-		return nil, errors.Wrapf(err, "set concurrency level to %v blocks", 2*runtime.NumCPU())
-	}
 	go func() {
+		gzw, reader, err := gz.newWriter(pipeWriter, reader)
+		if err != nil {
+			log.Warnf("gzip compress: could not create gzip writer: %v", err)
+			// #nosec G104
+			_ = pipeWriter.CloseWithError(err)
+			return
+		}
 		if _, err := system.Copy(gzw, reader); err != nil {
 			log.Warnf("gzip compress: could not compress layer: %v", err)
 			// #nosec G104
@@ -96,7 +202,7 @@ func (zs zstdCompressor) Compress(reader io.Reader) (io.ReadCloser, error) {
 			return
 		}
 		if err := zw.Close(); err != nil {
-			log.Warnf("zstd compress: could not close gzip writer: %v", err)
+			log.Warnf("zstd compress: could not close zstd writer: %v", err)
 			// #nosec G104
 			_ = pipeWriter.CloseWithError(errors.Wrap(err, "close zstd writer"))
 			return
@@ -114,3 +220,47 @@ func (zs zstdCompressor) Compress(reader io.Reader) (io.ReadCloser, error) {
 func (zs zstdCompressor) MediaTypeSuffix() string {
 	return "zstd"
 }
+
+// CompressorForMediaType returns the Compressor which generates layers with
+// the given OCI layer media type (ispec.MediaTypeImageLayer,
+// ispec.MediaTypeImageLayerGzip or mediatype.MediaTypeImageLayerZstd), for use
+// with Mutator.Add (with a mediaType of ispec.MediaTypeImageLayer). For gzip
+// layers, the compressor uses the given options -- because a gzip compression
+// level of 0 disables compression entirely, it cannot be used with
+// ispec.MediaTypeImageLayerGzip (use ispec.MediaTypeImageLayer instead).
+func CompressorForMediaType(mediaType string, gzipOptions GzipOptions) (Compressor, error) {
+	var compressor Compressor
+	switch mediaType {
+	case ispec.MediaTypeImageLayer:
+		compressor = NoopCompressor
+	case ispec.MediaTypeImageLayerGzip:
+		if gzipOptions.Level == 0 {
+			return nil, errors.Errorf("gzip compression level 0 disables compression: cannot be used with media type %s", mediaType)
+		}
+		gzipCompressor, err := NewGzipCompressor(gzipOptions)
+		if err != nil {
+			return nil, err
+		}
+		compressor = gzipCompressor
+	case mediatype.MediaTypeImageLayerZstd:
+		compressor = ZstdCompressor
+	default:
+		return nil, errors.Errorf("unsupported layer media type: %s", mediaType)
+	}
+
+	// Make sure that the layer media type generated by Mutator.Add will
+	// actually match the requested media type.
+	if generated := layerMediaType(ispec.MediaTypeImageLayer, compressor); generated != mediaType {
+		return nil, errors.Errorf("[internal error] compressor for %s generates %s layers", mediaType, generated)
+	}
+	return compressor, nil
+}
+
+// layerMediaType returns the media type of a layer with the given
+// (uncompressed) media type and compressed with the given compressor.
+func layerMediaType(mediaType string, compressor Compressor) string {
+	if suffix := compressor.MediaTypeSuffix(); suffix != "" {
+		mediaType += "+" + suffix
+	}
+	return mediaType
+}
@@ -2,12 +2,19 @@ package mutate
 
 import (
 	"bytes"
+	stdgzip "compress/gzip"
 	"io"
 	"io/ioutil"
+	"math/rand"
+	"os"
+	"runtime"
+	"strconv"
 	"testing"
 
 	zstd "github.com/klauspost/compress/zstd"
 	gzip "github.com/klauspost/pgzip"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/casext/mediatype"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -48,6 +55,184 @@ func TestGzipCompressor(t *testing.T) {
 	assert.Equal(string(content), fact)
 }
 
+func TestGzipCompressorLevel(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, level := range []int{-1, 0, 1, 6, 9} {
+		buf := bytes.NewBufferString(fact)
+		c, err := GzipCompressorLevel(level)
+		assert.NoError(err)
+		assert.Equal(c.MediaTypeSuffix(), "gzip")
+
+		r, err := c.Compress(buf)
+		assert.NoError(err)
+
+		r, err = gzip.NewReader(r)
+		assert.NoError(err)
+
+		content, err := ioutil.ReadAll(r)
+		assert.NoError(err)
+
+		assert.Equal(string(content), fact)
+	}
+
+	for _, level := range []int{-3, -2, 10, 100} {
+		_, err := GzipCompressorLevel(level)
+		assert.Error(err, "level %d should be invalid", level)
+	}
+}
+
+func compressAll(t testing.TB, c Compressor, data []byte) []byte {
+	r, err := c.Compress(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("compress: %+v", err)
+	}
+	compressed, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("read compressed stream: %+v", err)
+	}
+	return compressed
+}
+
+// compressibleData returns size bytes of (deterministic) data that is
+// compressible but not trivially so.
+func compressibleData(size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(1337)).Read(data)
+	for i := range data {
+		// Restrict the alphabet to make the data compressible.
+		data[i] = 'a' + data[i]%16
+	}
+	return data
+}
+
+func TestGzipCompressorSerial(t *testing.T) {
+	assert := assert.New(t)
+
+	data := compressibleData(4 << 20)
+
+	c, err := NewGzipCompressor(GzipOptions{Level: stdgzip.BestSpeed, Serial: true})
+	assert.NoError(err)
+	compressed := compressAll(t, c, data)
+
+	// The output must be identical to a plain serial gzip implementation.
+	var expected bytes.Buffer
+	gzw, err := stdgzip.NewWriterLevel(&expected, stdgzip.BestSpeed)
+	assert.NoError(err)
+	_, err = gzw.Write(data)
+	assert.NoError(err)
+	assert.NoError(gzw.Close())
+
+	assert.Equal(expected.Bytes(), compressed)
+}
+
+func TestGzipCompressorParallelReproducible(t *testing.T) {
+	assert := assert.New(t)
+
+	data := compressibleData(4 << 20)
+
+	c, err := NewGzipCompressor(GzipOptions{Level: gzip.DefaultCompression})
+	assert.NoError(err)
+
+	// The parallel output must not depend on the number of workers.
+	oldProcs := runtime.GOMAXPROCS(1)
+	compressed1 := compressAll(t, c, data)
+	runtime.GOMAXPROCS(4)
+	compressed4 := compressAll(t, c, data)
+	runtime.GOMAXPROCS(oldProcs)
+	assert.Equal(compressed1, compressed4)
+
+	r, err := gzip.NewReader(bytes.NewReader(compressed4))
+	assert.NoError(err)
+	content, err := ioutil.ReadAll(r)
+	assert.NoError(err)
+	assert.Equal(data, content)
+}
+
+func TestGzipCompressorHeader(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, serial := range []bool{true, false} {
+		c, err := NewGzipCompressor(GzipOptions{Level: gzip.DefaultCompression, Serial: serial})
+		assert.NoError(err)
+		compressed := compressAll(t, c, []byte(fact))
+
+		// RFC 1952: MTIME is bytes 4-7 and OS is byte 9.
+		if assert.True(len(compressed) > 10, "serial=%v: gzip stream too short", serial) {
+			assert.Equal([]byte{0, 0, 0, 0}, compressed[4:8], "serial=%v: gzip header mtime", serial)
+			assert.Equal(byte(gzipUnknownOS), compressed[9], "serial=%v: gzip header os", serial)
+		}
+
+		r, err := stdgzip.NewReader(bytes.NewReader(compressed))
+		assert.NoError(err)
+		assert.True(r.ModTime.IsZero(), "serial=%v: gzip header mtime", serial)
+		assert.Equal("", r.Name, "serial=%v: gzip header name", serial)
+	}
+}
+
+func TestGzipCompressorParallelThreshold(t *testing.T) {
+	assert := assert.New(t)
+
+	serial, err := NewGzipCompressor(GzipOptions{Level: gzip.DefaultCompression, Serial: true})
+	assert.NoError(err)
+	parallel, err := NewGzipCompressor(GzipOptions{Level: gzip.DefaultCompression})
+	assert.NoError(err)
+	threshold, err := NewGzipCompressor(GzipOptions{Level: gzip.DefaultCompression, ParallelThreshold: 1 << 20})
+	assert.NoError(err)
+
+	// Layers below the threshold must be compressed serially.
+	small := compressibleData(1<<20 - 1)
+	assert.Equal(compressAll(t, serial, small), compressAll(t, threshold, small))
+
+	// ... and layers at or above the threshold must be compressed in parallel.
+	large := compressibleData(2 << 20)
+	assert.Equal(compressAll(t, parallel, large), compressAll(t, threshold, large))
+
+	_, err = NewGzipCompressor(GzipOptions{ParallelThreshold: -1})
+	assert.Error(err)
+}
+
+// BenchmarkGzipCompressor compares serial and parallel gzip compression. The
+// size of the layer can be configured with $UMOCI_BENCH_GZIP_SIZE (in bytes)
+// to benchmark very large layers (such as a 2GB rootfs).
+func BenchmarkGzipCompressor(b *testing.B) {
+	size := 64 << 20
+	if env := os.Getenv("UMOCI_BENCH_GZIP_SIZE"); env != "" {
+		var err error
+		if size, err = strconv.Atoi(env); err != nil {
+			b.Fatalf("invalid $UMOCI_BENCH_GZIP_SIZE: %v", err)
+		}
+	}
+	data := compressibleData(size)
+
+	for _, test := range []struct {
+		name string
+		opts GzipOptions
+	}{
+		{"Serial", GzipOptions{Level: gzip.DefaultCompression, Serial: true}},
+		{"Parallel", GzipOptions{Level: gzip.DefaultCompression}},
+	} {
+		test := test // copy iterator
+		b.Run(test.name, func(b *testing.B) {
+			c, err := NewGzipCompressor(test.opts)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.SetBytes(int64(len(data)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				r, err := c.Compress(bytes.NewReader(data))
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := io.Copy(ioutil.Discard, r); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
 func TestZstdCompressor(t *testing.T) {
 	assert := assert.New(t)
 
@@ -66,3 +251,36 @@ func TestZstdCompressor(t *testing.T) {
 	assert.NoError(err)
 	assert.Equal(content.String(), fact)
 }
+
+func TestCompressorForMediaType(t *testing.T) {
+	assert := assert.New(t)
+
+	defaultOptions := GzipOptions{Level: gzip.DefaultCompression}
+	for _, test := range []struct {
+		mediaType string
+		options   GzipOptions
+		suffix    string
+		valid     bool
+	}{
+		{ispec.MediaTypeImageLayer, defaultOptions, "", true},
+		{ispec.MediaTypeImageLayerGzip, defaultOptions, "gzip", true},
+		{ispec.MediaTypeImageLayerGzip, GzipOptions{Level: gzip.BestCompression}, "gzip", true},
+		{mediatype.MediaTypeImageLayerZstd, defaultOptions, "zstd", true},
+		// Level 0 disables gzip compression.
+		{ispec.MediaTypeImageLayerGzip, GzipOptions{Level: 0}, "", false},
+		{ispec.MediaTypeImageLayerGzip, GzipOptions{Level: 42}, "", false},
+		{ispec.MediaTypeImageLayerNonDistributable, defaultOptions, "", false},
+		{ispec.MediaTypeImageManifest, defaultOptions, "", false},
+		{"tar+gzip", defaultOptions, "", false},
+	} {
+		compressor, err := CompressorForMediaType(test.mediaType, test.options)
+		if !test.valid {
+			assert.Errorf(err, "expected error for %s with %#v", test.mediaType, test.options)
+			continue
+		}
+		if assert.NoErrorf(err, "unexpected error for %s", test.mediaType) {
+			assert.Equal(test.suffix, compressor.MediaTypeSuffix())
+			assert.Equal(test.mediaType, layerMediaType(ispec.MediaTypeImageLayer, compressor))
+		}
+	}
+}
@@ -33,6 +33,7 @@ import (
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/opencontainers/umoci/oci/cas"
 	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/opencontainers/umoci/oci/layer"
 	"github.com/pkg/errors"
 )
 
@@ -63,6 +64,30 @@ type Mutator struct {
 	// Cached values of the configuration and manifest.
 	manifest *ispec.Manifest
 	config   *ispec.Image
+
+	// variant is the cached CPU variant of the configuration, which is not
+	// included in the version of ispec.Image we use.
+	variant string
+
+	// subject is the cached subject of the manifest, which is not included
+	// in the version of ispec.Manifest we use.
+	subject *ispec.Descriptor
+}
+
+// ImageConfig is ispec.Image with the addition of the "variant" field from
+// newer versions of the image-spec. It is the format of the configurations
+// written by Commit, and can be used by other users which need to write image
+// configurations with a variant.
+type ImageConfig struct {
+	ispec.Image
+	Variant string `json:"variant,omitempty"`
+}
+
+// imageManifest is ispec.Manifest with the addition of the "subject" field
+// from newer versions of the image-spec, and is what is written by Commit.
+type imageManifest struct {
+	ispec.Manifest
+	Subject *ispec.Descriptor `json:"subject,omitempty"`
 }
 
 // Meta is a wrapper around the "safe" fields in ispec.Image, which can be
@@ -84,6 +109,10 @@ type Meta struct {
 	// OS is the name of the operating system which the image is built to run
 	// on.
 	OS string `json:"os"`
+
+	// Variant is the variant of the CPU architecture which the binaries in
+	// this image are built to run on (such as "v8" for arm64).
+	Variant string `json:"variant,omitempty"`
 }
 
 // cache ensures that the cached versions of the related configurations have
@@ -104,8 +133,14 @@ func (m *Mutator) cache(ctx context.Context) error {
 			return errors.Errorf("[internal error] unknown manifest blob type: %s", blob.Descriptor.MediaType)
 		}
 
+		subject, err := m.engine.ManifestSubject(ctx, m.source.Descriptor())
+		if err != nil {
+			return errors.Wrap(err, "cache source manifest subject")
+		}
+
 		// Make a copy of the manifest.
 		m.manifest = manifestPtr(manifest)
+		m.subject = subject
 	}
 
 	if m.config == nil {
@@ -121,8 +156,14 @@ func (m *Mutator) cache(ctx context.Context) error {
 			return errors.Errorf("[internal error] unknown config blob type: %s", blob.Descriptor.MediaType)
 		}
 
+		variant, err := m.engine.ConfigVariant(ctx, m.manifest.Config)
+		if err != nil {
+			return errors.Wrap(err, "cache source config variant")
+		}
+
 		// Make a copy of the config and configDescriptor.
 		m.config = configPtr(config)
+		m.variant = variant
 	}
 
 	return nil
@@ -180,6 +221,7 @@ func (m *Mutator) Meta(ctx context.Context) (Meta, error) {
 		Author:       m.config.Author,
 		Architecture: m.config.Architecture,
 		OS:           m.config.OS,
+		Variant:      m.variant,
 	}, nil
 }
 
@@ -199,6 +241,43 @@ func (m *Mutator) Annotations(ctx context.Context) (map[string]string, error) {
 	return annotations, nil
 }
 
+// Subject returns the subject of the current manifest (the descriptor of the
+// manifest which this manifest refers to, for referrers such as signatures or
+// SBOMs), or nil if the manifest has no subject.
+func (m *Mutator) Subject(ctx context.Context) (*ispec.Descriptor, error) {
+	if err := m.cache(ctx); err != nil {
+		return nil, errors.Wrap(err, "getting cache failed")
+	}
+
+	if m.subject == nil {
+		return nil, nil
+	}
+	subject := *m.subject
+	return &subject, nil
+}
+
+// SetSubject sets the subject of the manifest to the given descriptor, making
+// the manifest a referrer of the subject (see casext.Engine.Referrers). A nil
+// subject removes the subject from the manifest. Note that the committed
+// manifest must still be added to the top-level index (with
+// casext.Engine.AddReferrer or by tagging it) for it to be found as a
+// referrer.
+func (m *Mutator) SetSubject(ctx context.Context, subject *ispec.Descriptor) error {
+	if err := m.cache(ctx); err != nil {
+		return errors.Wrap(err, "getting cache failed")
+	}
+
+	m.subject = nil
+	if subject != nil {
+		if err := subject.Digest.Validate(); err != nil {
+			return errors.Wrap(err, "invalid subject digest")
+		}
+		copied := *subject
+		m.subject = &copied
+	}
+	return nil
+}
+
 // Set sets the image configuration and metadata to the given values. The
 // provided ispec.History entry is appended to the image's history and should
 // correspond to what operations were made to the configuration.
@@ -221,6 +300,7 @@ func (m *Mutator) Set(ctx context.Context, config ispec.ImageConfig, meta Meta,
 	m.config.Author = meta.Author
 	m.config.Architecture = meta.Architecture
 	m.config.OS = meta.OS
+	m.variant = meta.Variant
 
 	// Append history.
 	if history != nil {
@@ -248,10 +328,11 @@ func (m *Mutator) appendToConfig(history *ispec.History, layerDiffID digest.Dige
 
 // add adds the given layer to the CAS, and mutates the configuration to
 // include the diffID. The returned string is the digest of the *compressed*
-// layer (which is compressed by us).
-func (m *Mutator) add(ctx context.Context, reader io.Reader, history *ispec.History, compressor Compressor) (digest.Digest, int64, error) {
+// layer (which is compressed by us). Any annotations generated by the
+// compressor for the layer are also returned.
+func (m *Mutator) add(ctx context.Context, reader io.Reader, history *ispec.History, compressor Compressor) (digest.Digest, int64, map[string]string, error) {
 	if err := m.cache(ctx); err != nil {
-		return "", -1, errors.Wrap(err, "getting cache failed")
+		return "", -1, nil, errors.Wrap(err, "getting cache failed")
 	}
 
 	diffidDigester := cas.BlobAlgorithm.Digester()
@@ -259,19 +340,24 @@ func (m *Mutator) add(ctx context.Context, reader io.Reader, history *ispec.Hist
 
 	compressed, err := compressor.Compress(hashReader)
 	if err != nil {
-		return "", -1, errors.Wrapf(err, "couldn't create compression for blob")
+		return "", -1, nil, errors.Wrapf(err, "couldn't create compression for blob")
 	}
 	defer compressed.Close()
 
 	layerDigest, layerSize, err := m.engine.PutBlob(ctx, compressed)
 	if err != nil {
-		return "", -1, errors.Wrap(err, "put layer blob")
+		return "", -1, nil, errors.Wrap(err, "put layer blob")
+	}
+
+	var annotations map[string]string
+	if annotated, ok := compressed.(annotatedLayer); ok {
+		annotations = annotated.LayerAnnotations()
 	}
 
 	// Add DiffID to configuration.
 	layerDiffID := diffidDigester.Digest()
 	m.appendToConfig(history, layerDiffID)
-	return layerDigest, layerSize, nil
+	return layerDigest, layerSize, annotations, nil
 }
 
 // Add adds a layer to the image, by reading the layer changeset blob from the
@@ -285,19 +371,24 @@ func (m *Mutator) Add(ctx context.Context, mediaType string, r io.Reader, histor
 		return desc, errors.Wrap(err, "getting cache failed")
 	}
 
-	digest, size, err := m.add(ctx, r, history, compressor)
+	digest, size, layerAnnotations, err := m.add(ctx, r, history, compressor)
 	if err != nil {
 		return desc, errors.Wrap(err, "add layer")
 	}
 
-	compressedMediaType := mediaType
-	if compressor.MediaTypeSuffix() != "" {
-		compressedMediaType = compressedMediaType + "+" + compressor.MediaTypeSuffix()
+	// Some compressors (such as ZstdChunkedCompressor) generate annotations
+	// which describe the compressed layer. The annotations provided by the
+	// caller take precedence.
+	if len(layerAnnotations) > 0 {
+		for key, value := range annotations {
+			layerAnnotations[key] = value
+		}
+		annotations = layerAnnotations
 	}
 
 	// Append to layers.
 	desc = ispec.Descriptor{
-		MediaType:   compressedMediaType,
+		MediaType:   layerMediaType(mediaType, compressor),
 		Digest:      digest,
 		Size:        size,
 		Annotations: annotations,
@@ -319,6 +410,137 @@ func (m *Mutator) AddExisting(ctx context.Context, desc ispec.Descriptor, histor
 	return nil
 }
 
+// Squash replaces all of the layers in the image with a single layer that
+// represents the same final filesystem state (see layer.SquashLayers). The
+// image's history is replaced with the provided history entry (or cleared
+// entirely if history is nil) -- this includes any empty_layer entries, as
+// the history would otherwise no longer match the layers of the image. The
+// new layer is compressed with the given compressor.
+func (m *Mutator) Squash(ctx context.Context, history *ispec.History, compressor Compressor) (ispec.Descriptor, error) {
+	if err := m.cache(ctx); err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "getting cache failed")
+	}
+
+	reader, err := layer.SquashLayers(ctx, m.engine, m.manifest.Layers)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "squash layers")
+	}
+	defer reader.Close()
+
+	m.manifest.Layers = nil
+	m.config.RootFS.DiffIDs = nil
+	m.config.History = nil
+
+	desc, err := m.Add(ctx, ispec.MediaTypeImageLayer, reader, history, compressor, nil)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "add squashed layer")
+	}
+	return desc, nil
+}
+
+// ClearHistory removes all of the history entries from the image
+// configuration. The layers and their DiffIDs are left untouched. Note that
+// any history entries added after ClearHistory (such as by Set or Add) will
+// then be the only history entries in the image.
+func (m *Mutator) ClearHistory(ctx context.Context) error {
+	if err := m.cache(ctx); err != nil {
+		return errors.Wrap(err, "getting cache failed")
+	}
+
+	m.config.History = nil
+	return nil
+}
+
+// RemoveLayer removes the layer with the given index (starting from 0) from
+// the image, along with the corresponding DiffID and history entry. If the
+// history of the image does not match its layers, the history is left
+// unmodified. Removing a layer may result in whiteouts in later layers no
+// longer referring to any path in the image -- such whiteouts are ignored
+// during extraction, so a warning is logged for each of them rather than
+// treating them as an error.
+func (m *Mutator) RemoveLayer(ctx context.Context, index int) error {
+	if err := m.cache(ctx); err != nil {
+		return errors.Wrap(err, "getting cache failed")
+	}
+
+	numLayers := len(m.manifest.Layers)
+	if index < 0 || index >= numLayers {
+		return errors.Errorf("layer index %d out of range: image has %d layers", index, numLayers)
+	}
+	if len(m.config.RootFS.DiffIDs) != numLayers {
+		return errors.Errorf("image has %d layers but %d diffids", numLayers, len(m.config.RootFS.DiffIDs))
+	}
+
+	// Figure out which whiteouts are already dangling, so that we only warn
+	// about whiteouts which are dangling because of the removal.
+	oldDangling, err := layer.FindDanglingWhiteouts(ctx, m.engine, m.manifest.Layers)
+	if err != nil {
+		return errors.Wrap(err, "check whiteouts before removal")
+	}
+	dangling := map[layer.DanglingWhiteout]struct{}{}
+	for _, whiteout := range oldDangling {
+		switch {
+		case whiteout.Layer == index:
+			// Whiteouts in the removed layer are removed with it (and must
+			// not be confused with whiteouts in the layer which takes its
+			// index after the removal).
+			continue
+		case whiteout.Layer > index:
+			whiteout.Layer--
+		}
+		dangling[whiteout] = struct{}{}
+	}
+
+	layers := []ispec.Descriptor{}
+	layers = append(layers, m.manifest.Layers[:index]...)
+	layers = append(layers, m.manifest.Layers[index+1:]...)
+
+	diffIDs := []digest.Digest{}
+	diffIDs = append(diffIDs, m.config.RootFS.DiffIDs[:index]...)
+	diffIDs = append(diffIDs, m.config.RootFS.DiffIDs[index+1:]...)
+
+	newDangling, err := layer.FindDanglingWhiteouts(ctx, m.engine, layers)
+	if err != nil {
+		return errors.Wrap(err, "check whiteouts after removal")
+	}
+	for _, whiteout := range newDangling {
+		if _, ok := dangling[whiteout]; !ok {
+			// Report the index of the layer before the removal.
+			oldLayer := whiteout.Layer
+			if oldLayer >= index {
+				oldLayer++
+			}
+			log.Warnf("removing layer %d: whiteout in layer %d no longer refers to an existing path: %s", index, oldLayer, whiteout.Path)
+		}
+	}
+
+	// Find the history entry for the layer, which is the index-th history
+	// entry which isn't an empty_layer.
+	historyIndex := -1
+	var numLayerHistory int
+	for idx, history := range m.config.History {
+		if history.EmptyLayer {
+			continue
+		}
+		if numLayerHistory == index {
+			historyIndex = idx
+		}
+		numLayerHistory++
+	}
+	if numLayerHistory == numLayers {
+		var history []ispec.History
+		history = append(history, m.config.History[:historyIndex]...)
+		history = append(history, m.config.History[historyIndex+1:]...)
+		m.config.History = history
+	} else if len(m.config.History) > 0 {
+		log.Warnf("image history has %d layer entries but image has %d layers -- not removing history entry", numLayerHistory, numLayers)
+	}
+
+	m.manifest.Layers = layers
+	m.config.RootFS.DiffIDs = diffIDs
+	return nil
+}
+
 // Commit writes all of the temporary changes made to the configuration,
 // metadata and manifest to the engine. It then returns a new manifest
 // descriptor (which can be used in place of the source descriptor provided to
@@ -329,7 +551,10 @@ func (m *Mutator) Commit(ctx context.Context) (casext.DescriptorPath, error) {
 	}
 
 	// We first have to commit the configuration blob.
-	configDigest, configSize, err := m.engine.PutBlobJSON(ctx, m.config)
+	configDigest, configSize, err := m.engine.PutBlobJSON(ctx, ImageConfig{
+		Image:   *m.config,
+		Variant: m.variant,
+	})
 	if err != nil {
 		return casext.DescriptorPath{}, errors.Wrap(err, "commit mutated config blob")
 	}
@@ -341,7 +566,10 @@ func (m *Mutator) Commit(ctx context.Context) (casext.DescriptorPath, error) {
 	}
 
 	// Now commit the manifest.
-	manifestDigest, manifestSize, err := m.engine.PutBlobJSON(ctx, m.manifest)
+	manifestDigest, manifestSize, err := m.engine.PutBlobJSON(ctx, imageManifest{
+		Manifest: *m.manifest,
+		Subject:  m.subject,
+	})
 	if err != nil {
 		return casext.DescriptorPath{}, errors.Wrap(err, "commit mutated manifest blob")
 	}
@@ -29,12 +29,14 @@ import (
 	"reflect"
 	"testing"
 
+	gzip "github.com/klauspost/pgzip"
 	"github.com/opencontainers/go-digest"
 	imeta "github.com/opencontainers/image-spec/specs-go"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/opencontainers/umoci/oci/cas"
 	casdir "github.com/opencontainers/umoci/oci/cas/dir"
 	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/opencontainers/umoci/oci/casext/mediatype"
 )
 
 // These come from just running the code.
@@ -295,6 +297,90 @@ func TestMutateAdd(t *testing.T) {
 	}
 }
 
+func TestMutateAddZstd(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateAddZstd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, fromDescriptor := setup(t, dir)
+	defer engine.Close()
+
+	mutator, err := New(engine, casext.DescriptorPath{Walk: []ispec.Descriptor{fromDescriptor}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// This isn't a valid image, but whatever.
+	buffer := bytes.NewBufferString("contents")
+
+	// Add a new zstd layer.
+	newLayerDesc, err := mutator.Add(context.Background(), ispec.MediaTypeImageLayer, buffer, &ispec.History{
+		Comment: "new layer",
+	}, ZstdCompressor, nil)
+	if err != nil {
+		t.Fatalf("unexpected error adding layer: %+v", err)
+	}
+
+	if newLayerDesc.MediaType != mediatype.MediaTypeImageLayerZstd {
+		t.Errorf("new layer has the wrong media type: %s", newLayerDesc.MediaType)
+	}
+	if len(mutator.manifest.Layers) != 2 || mutator.manifest.Layers[1].MediaType != mediatype.MediaTypeImageLayerZstd {
+		t.Errorf("manifest.Layers was not updated with the zstd layer")
+	}
+	if len(mutator.config.RootFS.DiffIDs) != 2 {
+		t.Errorf("config.RootFS.DiffIDs was not updated")
+	}
+}
+
+func TestMutateAddZstdChunked(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateAddZstdChunked")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, fromDescriptor := setup(t, dir)
+	defer engine.Close()
+
+	mutator, err := New(engine, casext.DescriptorPath{Walk: []ispec.Descriptor{fromDescriptor}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, _ := zstdChunkedTestTar(t)
+
+	// Add a new zstd:chunked layer.
+	annotations := map[string]string{"hello": "world"}
+	newLayerDesc, err := mutator.Add(context.Background(), ispec.MediaTypeImageLayer, bytes.NewReader(data), &ispec.History{
+		Comment: "new layer",
+	}, ZstdChunkedCompressor, annotations)
+	if err != nil {
+		t.Fatalf("unexpected error adding layer: %+v", err)
+	}
+
+	if newLayerDesc.MediaType != mediatype.MediaTypeImageLayerZstd {
+		t.Errorf("new layer has the wrong media type: %s", newLayerDesc.MediaType)
+	}
+	for _, key := range []string{
+		"hello",
+		ZstdChunkedManifestChecksumAnnotation,
+		ZstdChunkedManifestPositionAnnotation,
+		ZstdChunkedTarSplitPositionAnnotation,
+	} {
+		if _, ok := newLayerDesc.Annotations[key]; !ok {
+			t.Errorf("new layer is missing the %s annotation: %v", key, newLayerDesc.Annotations)
+		}
+	}
+	if !reflect.DeepEqual(mutator.manifest.Layers[1], newLayerDesc) {
+		t.Errorf("manifest.Layers was not updated with the zstd:chunked layer")
+	}
+	if len(mutator.config.RootFS.DiffIDs) != 2 || mutator.config.RootFS.DiffIDs[1] != digest.FromBytes(data) {
+		t.Errorf("config.RootFS.DiffIDs was not updated with the uncompressed digest")
+	}
+}
+
 func TestMutateAddExisting(t *testing.T) {
 	dir, err := ioutil.TempDir("", "umoci-TestMutateAddExisting")
 	if err != nil {
@@ -654,3 +740,399 @@ func TestMutatePath(t *testing.T) {
 		}
 	}
 }
+
+// addTestLayers replaces the layers of the image with new layers containing
+// the given files (each followed by an empty_layer history entry). The
+// contents of each file are "layer <n>".
+func addTestLayers(t *testing.T, mutator *Mutator, layers [][]string) {
+	if err := mutator.cache(context.Background()); err != nil {
+		t.Fatalf("unexpected error getting cache: %+v", err)
+	}
+
+	// The base layer in setup() isn't actually compressed, so start with an
+	// image without any layers.
+	mutator.manifest.Layers = nil
+	mutator.config.RootFS.DiffIDs = nil
+	mutator.config.History = nil
+
+	for idx, files := range layers {
+		var buffer bytes.Buffer
+		tw := tar.NewWriter(&buffer)
+		for _, file := range files {
+			data := []byte(fmt.Sprintf("layer %d", idx))
+			if err := tw.WriteHeader(&tar.Header{
+				Typeflag: tar.TypeReg,
+				Name:     file,
+				Mode:     0644,
+				Size:     int64(len(data)),
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tw.Write(data); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := mutator.Add(context.Background(), ispec.MediaTypeImageLayer, &buffer, &ispec.History{
+			Comment: fmt.Sprintf("layer %d", idx),
+		}, GzipCompressor, nil); err != nil {
+			t.Fatalf("unexpected error adding layer: %+v", err)
+		}
+		if err := mutator.Set(context.Background(), mutator.config.Config, Meta{}, nil, &ispec.History{
+			Comment: fmt.Sprintf("config %d", idx),
+		}); err != nil {
+			t.Fatalf("unexpected error setting config: %+v", err)
+		}
+	}
+}
+
+func TestMutateSquash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateSquash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, fromDescriptor := setup(t, dir)
+	defer engine.Close()
+
+	mutator, err := New(engine, casext.DescriptorPath{Walk: []ispec.Descriptor{fromDescriptor}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.cache(context.Background()); err != nil {
+		t.Fatalf("unexpected error getting cache: %+v", err)
+	}
+
+	// Each layer is followed by an empty_layer history entry.
+	addTestLayers(t, mutator, [][]string{{"a", "b"}, {".wh.a", "c"}})
+
+	if _, err := mutator.Squash(context.Background(), &ispec.History{
+		Comment: "squashed",
+	}, GzipCompressor); err != nil {
+		t.Fatalf("unexpected error squashing: %+v", err)
+	}
+
+	newDescriptor, err := mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+
+	mutator, err = New(engine, newDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.cache(context.Background()); err != nil {
+		t.Fatalf("unexpected error getting cache: %+v", err)
+	}
+
+	if len(mutator.manifest.Layers) != 1 {
+		t.Fatalf("expected a single layer after squash, got %d", len(mutator.manifest.Layers))
+	}
+	if len(mutator.config.RootFS.DiffIDs) != 1 {
+		t.Errorf("expected a single diffid after squash, got %d", len(mutator.config.RootFS.DiffIDs))
+	}
+	if len(mutator.config.History) != 1 {
+		t.Fatalf("expected a single history entry after squash, got %d", len(mutator.config.History))
+	}
+	if mutator.config.History[0].EmptyLayer || mutator.config.History[0].Comment != "squashed" {
+		t.Errorf("unexpected history entry after squash: %#v", mutator.config.History[0])
+	}
+	if mutator.config.Config.User != "default:user" {
+		t.Errorf("config was not preserved by squash: %#v", mutator.config.Config)
+	}
+
+	// Check the contents of the squashed layer.
+	blob, err := mutator.engine.FromDescriptor(context.Background(), mutator.manifest.Layers[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blob.Close()
+	gzr, err := gzip.NewReader(blob.Data.(io.Reader))
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents := map[string]string{}
+	tr := tar.NewReader(gzr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents[hdr.Name] = string(data)
+	}
+	expected := map[string]string{"b": "layer 0", "c": "layer 1"}
+	if !reflect.DeepEqual(contents, expected) {
+		t.Errorf("unexpected squashed layer contents: expected %v, got %v", expected, contents)
+	}
+}
+
+func TestMutateRemoveLayer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateRemoveLayer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, fromDescriptor := setup(t, dir)
+	defer engine.Close()
+
+	mutator, err := New(engine, casext.DescriptorPath{Walk: []ispec.Descriptor{fromDescriptor}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addTestLayers(t, mutator, [][]string{{"a"}, {"b"}, {".wh.b", "c"}})
+	oldLayers := append([]ispec.Descriptor{}, mutator.manifest.Layers...)
+	oldDiffIDs := append([]digest.Digest{}, mutator.config.RootFS.DiffIDs...)
+
+	// Out of range indices are rejected.
+	for _, index := range []int{-1, 3} {
+		if err := mutator.RemoveLayer(context.Background(), index); err == nil {
+			t.Errorf("expected RemoveLayer(%d) to fail", index)
+		}
+	}
+
+	// Removing the layer makes the whiteout in the last layer dangling, but
+	// this is only a warning.
+	if err := mutator.RemoveLayer(context.Background(), 1); err != nil {
+		t.Fatalf("unexpected error removing layer: %+v", err)
+	}
+
+	newDescriptor, err := mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+	mutator, err = New(engine, newDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.cache(context.Background()); err != nil {
+		t.Fatalf("unexpected error getting cache: %+v", err)
+	}
+
+	if !reflect.DeepEqual(mutator.manifest.Layers, []ispec.Descriptor{oldLayers[0], oldLayers[2]}) {
+		t.Errorf("unexpected layers after RemoveLayer: %v", mutator.manifest.Layers)
+	}
+	if !reflect.DeepEqual(mutator.config.RootFS.DiffIDs, []digest.Digest{oldDiffIDs[0], oldDiffIDs[2]}) {
+		t.Errorf("unexpected diffids after RemoveLayer: %v", mutator.config.RootFS.DiffIDs)
+	}
+	var comments []string
+	for _, history := range mutator.config.History {
+		comments = append(comments, history.Comment)
+	}
+	expectedComments := []string{"layer 0", "config 0", "config 1", "layer 2", "config 2"}
+	if !reflect.DeepEqual(comments, expectedComments) {
+		t.Errorf("unexpected history after RemoveLayer: expected %v, got %v", expectedComments, comments)
+	}
+}
+
+func TestMutateClearHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateClearHistory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, fromDescriptor := setup(t, dir)
+	defer engine.Close()
+
+	mutator, err := New(engine, casext.DescriptorPath{Walk: []ispec.Descriptor{fromDescriptor}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addTestLayers(t, mutator, [][]string{{"a"}, {"b"}})
+	oldLayers := append([]ispec.Descriptor{}, mutator.manifest.Layers...)
+	oldDiffIDs := append([]digest.Digest{}, mutator.config.RootFS.DiffIDs...)
+	if len(mutator.config.History) == 0 {
+		t.Fatalf("expected test image to have history entries")
+	}
+
+	if err := mutator.ClearHistory(context.Background()); err != nil {
+		t.Fatalf("unexpected error clearing history: %+v", err)
+	}
+
+	newDescriptor, err := mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+	mutator, err = New(engine, newDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.cache(context.Background()); err != nil {
+		t.Fatalf("unexpected error getting cache: %+v", err)
+	}
+
+	if len(mutator.config.History) != 0 {
+		t.Errorf("expected history to be cleared, got %v", mutator.config.History)
+	}
+	if !reflect.DeepEqual(mutator.manifest.Layers, oldLayers) {
+		t.Errorf("ClearHistory modified layers: expected %v, got %v", oldLayers, mutator.manifest.Layers)
+	}
+	if !reflect.DeepEqual(mutator.config.RootFS.DiffIDs, oldDiffIDs) {
+		t.Errorf("ClearHistory modified diffids: expected %v, got %v", oldDiffIDs, mutator.config.RootFS.DiffIDs)
+	}
+}
+
+func TestMutateVariant(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateVariant")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, fromDescriptor := setup(t, dir)
+	defer engine.Close()
+	engineExt := casext.NewEngine(engine)
+
+	mutator, err := New(engine, casext.DescriptorPath{Walk: []ispec.Descriptor{fromDescriptor}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	meta, err := mutator.Meta(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error getting meta: %+v", err)
+	}
+	if meta.Variant != "" {
+		t.Errorf("unexpected variant in test image: %q", meta.Variant)
+	}
+	meta.Variant = "v8"
+	if err := mutator.Set(context.Background(), mutator.config.Config, meta, nil, nil); err != nil {
+		t.Fatalf("unexpected error setting meta: %+v", err)
+	}
+	newDescriptor, err := mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+
+	// The variant must be written to the configuration.
+	manifest, err := mutator.Manifest(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error getting manifest: %+v", err)
+	}
+	variant, err := engineExt.ConfigVariant(context.Background(), manifest.Config)
+	if err != nil {
+		t.Fatalf("unexpected error getting variant: %+v", err)
+	}
+	if variant != "v8" {
+		t.Errorf("expected variant v8 in config, got %q", variant)
+	}
+
+	// And must be preserved by later mutations.
+	mutator, err = New(engine, newDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mutator.Add(context.Background(), ispec.MediaTypeImageLayer, bytes.NewReader(nil), nil, NoopCompressor, nil); err != nil {
+		t.Fatalf("unexpected error adding layer: %+v", err)
+	}
+	newDescriptor, err = mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+	mutator, err = New(engine, newDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err = mutator.Meta(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error getting meta: %+v", err)
+	}
+	if meta.Variant != "v8" {
+		t.Errorf("expected variant v8 to be preserved, got %q", meta.Variant)
+	}
+}
+
+func TestMutateSubject(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateSubject")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, fromDescriptor := setup(t, dir)
+	defer engine.Close()
+	engineExt := casext.NewEngine(engine)
+
+	mutator, err := New(engine, casext.DescriptorPath{Walk: []ispec.Descriptor{fromDescriptor}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subject, err := mutator.Subject(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error getting subject: %+v", err)
+	}
+	if subject != nil {
+		t.Errorf("unexpected subject in test image: %v", subject)
+	}
+	if err := mutator.SetSubject(context.Background(), &ispec.Descriptor{Digest: "invalid"}); err == nil {
+		t.Errorf("expected error setting invalid subject")
+	}
+	if err := mutator.SetSubject(context.Background(), &fromDescriptor); err != nil {
+		t.Fatalf("unexpected error setting subject: %+v", err)
+	}
+	newDescriptor, err := mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+
+	// The subject must be written to the manifest.
+	subject, err = engineExt.ManifestSubject(context.Background(), newDescriptor.Descriptor())
+	if err != nil {
+		t.Fatalf("unexpected error getting subject: %+v", err)
+	}
+	if subject == nil || subject.Digest != fromDescriptor.Digest {
+		t.Errorf("expected subject %s in manifest, got %v", fromDescriptor.Digest, subject)
+	}
+
+	// And must be preserved by later mutations.
+	mutator, err = New(engine, newDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mutator.Add(context.Background(), ispec.MediaTypeImageLayer, bytes.NewReader(nil), nil, NoopCompressor, nil); err != nil {
+		t.Fatalf("unexpected error adding layer: %+v", err)
+	}
+	newDescriptor, err = mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+	mutator, err = New(engine, newDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subject, err = mutator.Subject(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error getting subject: %+v", err)
+	}
+	if subject == nil || subject.Digest != fromDescriptor.Digest {
+		t.Errorf("expected subject %s to be preserved, got %v", fromDescriptor.Digest, subject)
+	}
+
+	// Clearing the subject removes it from the manifest.
+	if err := mutator.SetSubject(context.Background(), nil); err != nil {
+		t.Fatalf("unexpected error clearing subject: %+v", err)
+	}
+	newDescriptor, err = mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+	subject, err = engineExt.ManifestSubject(context.Background(), newDescriptor.Descriptor())
+	if err != nil {
+		t.Fatalf("unexpected error getting subject: %+v", err)
+	}
+	if subject != nil {
+		t.Errorf("expected subject to be removed, got %v", subject)
+	}
+}
@@ -0,0 +1,63 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mutate
+
+import (
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// SourceDateEpochEnv is the environment variable which (if set) contains the
+// timestamp that should be used in place of the current time, as a decimal
+// number of seconds since the Unix epoch. See
+// <https://reproducible-builds.org/specs/source-date-epoch/>.
+const SourceDateEpochEnv = "SOURCE_DATE_EPOCH"
+
+// SourceDateEpoch returns the timestamp given by the SOURCE_DATE_EPOCH
+// environment variable. If the variable is not set (or is empty), ok is false.
+// An error is returned if the variable is not a valid timestamp.
+func SourceDateEpoch() (epoch time.Time, ok bool, err error) {
+	value := os.Getenv(SourceDateEpochEnv)
+	if value == "" {
+		return time.Time{}, false, nil
+	}
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, false, errors.Wrapf(err, "parse %s", SourceDateEpochEnv)
+	}
+	return time.Unix(seconds, 0).UTC(), true, nil
+}
+
+// Now returns the timestamp which should be used when stamping new entries
+// (such as history entries or image configurations) with their creation time.
+// This is the timestamp given by SOURCE_DATE_EPOCH if it is set, otherwise it
+// is the current time. All code which adds timestamps to an image should use
+// this rather than time.Now, so that SOURCE_DATE_EPOCH is always honoured.
+func Now() (time.Time, error) {
+	epoch, ok, err := SourceDateEpoch()
+	if err != nil {
+		return time.Time{}, err
+	}
+	if ok {
+		return epoch, nil
+	}
+	return time.Now(), nil
+}
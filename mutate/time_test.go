@@ -0,0 +1,57 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mutate
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSourceDateEpoch(t *testing.T) {
+	assert := assert.New(t)
+
+	t.Setenv(SourceDateEpochEnv, "")
+	_, ok, err := SourceDateEpoch()
+	assert.NoError(err)
+	assert.False(ok, "empty SOURCE_DATE_EPOCH should be ignored")
+
+	before := time.Now()
+	now, err := Now()
+	assert.NoError(err)
+	assert.False(now.Before(before), "Now should use the current time without SOURCE_DATE_EPOCH")
+
+	t.Setenv(SourceDateEpochEnv, "1234567890")
+	epoch, ok, err := SourceDateEpoch()
+	assert.NoError(err)
+	assert.True(ok)
+	assert.Equal(time.Date(2009, time.February, 13, 23, 31, 30, 0, time.UTC), epoch)
+
+	now, err = Now()
+	assert.NoError(err)
+	assert.Equal(epoch, now, "Now should use SOURCE_DATE_EPOCH if set")
+
+	for _, invalid := range []string{"yesterday", "12.5", "2020-01-01T00:00:00Z"} {
+		t.Setenv(SourceDateEpochEnv, invalid)
+		_, _, err = SourceDateEpoch()
+		assert.Error(err, "SOURCE_DATE_EPOCH=%q should be rejected", invalid)
+		_, err = Now()
+		assert.Error(err, "SOURCE_DATE_EPOCH=%q should be rejected", invalid)
+	}
+}
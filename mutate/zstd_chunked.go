@@ -0,0 +1,494 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mutate
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc64"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/apex/log"
+	zstd "github.com/klauspost/compress/zstd"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// These are the annotations used by zstd:chunked layers (as defined by
+// github.com/containers/storage) to describe where the table of contents and
+// tar-split metadata are stored in the layer blob.
+const (
+	// ZstdChunkedManifestChecksumAnnotation is the digest of the compressed
+	// table of contents of a zstd:chunked layer.
+	ZstdChunkedManifestChecksumAnnotation = "io.github.containers.zstd-chunked.manifest-checksum"
+
+	// ZstdChunkedManifestPositionAnnotation is the position of the table of
+	// contents of a zstd:chunked layer, in the form
+	// "offset:compressed-size:uncompressed-size:manifest-type".
+	ZstdChunkedManifestPositionAnnotation = "io.github.containers.zstd-chunked.manifest-position"
+
+	// ZstdChunkedTarSplitPositionAnnotation is the position of the tar-split
+	// metadata of a zstd:chunked layer, in the form
+	// "offset:compressed-size:uncompressed-size".
+	ZstdChunkedTarSplitPositionAnnotation = "io.github.containers.zstd-chunked.tarsplit-position"
+)
+
+const (
+	// zstdChunkedManifestTypeCRFS is the only supported table of contents
+	// format (which is compatible with the CRFS table of contents).
+	zstdChunkedManifestTypeCRFS = 1
+
+	// zstdChunkedFooterSize is the size of the footer at the end of a
+	// zstd:chunked layer (not including the skippable frame header).
+	zstdChunkedFooterSize = 64
+
+	// zstdSkippableFrameHeaderSize is the size of the header of a zstd
+	// skippable frame (the magic number followed by the frame size).
+	zstdSkippableFrameHeaderSize = 8
+)
+
+var (
+	// zstdSkippableFrameMagic is the magic number of the zstd skippable frames
+	// used to store the zstd:chunked metadata. Decoders which don't know
+	// about zstd:chunked just skip these frames.
+	zstdSkippableFrameMagic = []byte{0x50, 0x2a, 0x4d, 0x18}
+
+	// zstdChunkedFooterMagic is the magic number at the end of the footer of
+	// a zstd:chunked layer.
+	zstdChunkedFooterMagic = []byte("GNUlInUx")
+)
+
+// zstdChunkedTOC is the table of contents of a zstd:chunked layer.
+type zstdChunkedTOC struct {
+	Version        int                   `json:"version"`
+	Entries        []zstdChunkedTOCEntry `json:"entries"`
+	TarSplitDigest digest.Digest         `json:"tarSplitDigest,omitempty"`
+}
+
+// zstdChunkedTOCEntry describes a single tar entry in a zstd:chunked table of
+// contents. For regular files, Offset and EndOffset are the positions (in the
+// compressed layer) of the zstd frame containing the file contents, so that
+// the contents can be fetched without fetching the rest of the layer.
+type zstdChunkedTOCEntry struct {
+	Type        string            `json:"type"`
+	Name        string            `json:"name"`
+	Linkname    string            `json:"linkName,omitempty"`
+	Mode        int64             `json:"mode,omitempty"`
+	Size        int64             `json:"size,omitempty"`
+	UID         int               `json:"uid,omitempty"`
+	GID         int               `json:"gid,omitempty"`
+	ModTime     *time.Time        `json:"modtime,omitempty"`
+	AccessTime  *time.Time        `json:"accesstime,omitempty"`
+	ChangeTime  *time.Time        `json:"changetime,omitempty"`
+	Devmajor    int64             `json:"devMajor,omitempty"`
+	Devminor    int64             `json:"devMinor,omitempty"`
+	Xattrs      map[string]string `json:"xattrs,omitempty"`
+	Digest      string            `json:"digest,omitempty"`
+	Offset      int64             `json:"offset,omitempty"`
+	EndOffset   int64             `json:"endOffset,omitempty"`
+	ChunkSize   int64             `json:"chunkSize,omitempty"`
+	ChunkDigest string            `json:"chunkDigest,omitempty"`
+}
+
+// zstdChunkedTypes maps tar entry types to the zstd:chunked entry types.
+var zstdChunkedTypes = map[byte]string{
+	tar.TypeReg:     "reg",
+	tar.TypeRegA:    "reg",
+	tar.TypeLink:    "hardlink",
+	tar.TypeSymlink: "symlink",
+	tar.TypeChar:    "char",
+	tar.TypeBlock:   "block",
+	tar.TypeDir:     "dir",
+	tar.TypeFifo:    "fifo",
+}
+
+// tarSplitEntry is an entry in the tar-split metadata of a zstd:chunked layer
+// (which allows the original tar stream to be reconstructed from the
+// extracted files), using the format of github.com/vbatts/tar-split.
+type tarSplitEntry struct {
+	Type     int    `json:"type"`
+	Name     string `json:"name,omitempty"`
+	Size     int64  `json:"size,omitempty"`
+	Payload  []byte `json:"payload"`
+	Position int    `json:"position"`
+}
+
+const (
+	// tarSplitFileType is a tar-split entry for the contents of a file (the
+	// payload is the crc64 checksum of the file contents).
+	tarSplitFileType = 1
+
+	// tarSplitSegmentType is a tar-split entry for raw tar data (headers and
+	// padding) which is stored as-is in the payload.
+	tarSplitSegmentType = 2
+)
+
+var tarSplitCRCTable = crc64.MakeTable(crc64.ISO)
+
+// tarSplitWriter generates the tar-split metadata of a tar stream.
+type tarSplitWriter struct {
+	buffer  bytes.Buffer
+	encoder *json.Encoder
+	entries int
+}
+
+func newTarSplitWriter() *tarSplitWriter {
+	tw := &tarSplitWriter{}
+	tw.encoder = json.NewEncoder(&tw.buffer)
+	return tw
+}
+
+func (tw *tarSplitWriter) add(entry tarSplitEntry) error {
+	entry.Position = tw.entries
+	tw.entries++
+	return tw.encoder.Encode(entry)
+}
+
+// rawTarReader records all of the raw bytes read from the underlying tar
+// stream, so that they can be included as-is in the compressed layer.
+type rawTarReader struct {
+	reader io.Reader
+	raw    bytes.Buffer
+}
+
+func (r *rawTarReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.raw.Write(p[:n])
+	return n, err
+}
+
+// take returns the raw bytes read since the last call to take. The returned
+// slice is only valid until the next Read.
+func (r *rawTarReader) take() []byte {
+	raw := r.raw.Bytes()
+	r.raw.Reset()
+	return raw
+}
+
+// writeCounter counts the number of bytes written to the underlying writer.
+type writeCounter struct {
+	writer io.Writer
+	count  int64
+}
+
+func (w *writeCounter) Write(p []byte) (int, error) {
+	n, err := w.writer.Write(p)
+	w.count += int64(n)
+	return n, err
+}
+
+// writeZstdSkippableFrame writes data to w as a zstd skippable frame.
+func writeZstdSkippableFrame(w io.Writer, data []byte) error {
+	header := make([]byte, zstdSkippableFrameHeaderSize)
+	copy(header, zstdSkippableFrameMagic)
+	binary.LittleEndian.PutUint32(header[len(zstdSkippableFrameMagic):], uint32(len(data)))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// zstdCompress returns data compressed as a single zstd frame.
+func zstdCompress(data []byte) ([]byte, error) {
+	var buffer bytes.Buffer
+	zw, err := zstd.NewWriter(&buffer)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// zstdChunkedEntry returns the table of contents entry for a tar header
+// (without any of the content-related fields).
+func zstdChunkedEntry(hdr *tar.Header) (zstdChunkedTOCEntry, error) {
+	typ, ok := zstdChunkedTypes[hdr.Typeflag]
+	if !ok {
+		return zstdChunkedTOCEntry{}, errors.Errorf("unsupported tar entry type %q of %s", hdr.Typeflag, hdr.Name)
+	}
+	entry := zstdChunkedTOCEntry{
+		Type:     typ,
+		Name:     hdr.Name,
+		Linkname: hdr.Linkname,
+		Mode:     hdr.Mode,
+		Size:     hdr.Size,
+		UID:      hdr.Uid,
+		GID:      hdr.Gid,
+		Devmajor: hdr.Devmajor,
+		Devminor: hdr.Devminor,
+	}
+	modTime := hdr.ModTime.UTC()
+	entry.ModTime = &modTime
+	if !hdr.AccessTime.IsZero() {
+		accessTime := hdr.AccessTime.UTC()
+		entry.AccessTime = &accessTime
+	}
+	if !hdr.ChangeTime.IsZero() {
+		changeTime := hdr.ChangeTime.UTC()
+		entry.ChangeTime = &changeTime
+	}
+	for key, value := range hdr.PAXRecords {
+		if name := strings.TrimPrefix(key, "SCHILY.xattr."); name != key {
+			if entry.Xattrs == nil {
+				entry.Xattrs = map[string]string{}
+			}
+			entry.Xattrs[name] = base64.StdEncoding.EncodeToString([]byte(value))
+		}
+	}
+	return entry, nil
+}
+
+// writeZstdChunked compresses the given tar stream as a zstd:chunked layer,
+// returning the annotations describing the layer. The contents of each
+// regular file are compressed in a separate zstd frame, and the table of
+// contents (which lists the position of each file), the tar-split metadata and
+// the footer are appended as zstd skippable frames. The decompressed layer is
+// byte-for-byte identical to the tar stream.
+func writeZstdChunked(w io.Writer, reader io.Reader) (map[string]string, error) {
+	dest := &writeCounter{writer: w}
+	zw, err := zstd.NewWriter(dest)
+	if err != nil {
+		return nil, errors.Wrap(err, "create zstd writer")
+	}
+	// restartFrame ends the current zstd frame (so that the next data written
+	// starts a new frame) and returns the current offset in the layer.
+	restartFrame := func() (int64, error) {
+		if err := zw.Close(); err != nil {
+			return 0, errors.Wrap(err, "close zstd frame")
+		}
+		zw.Reset(dest)
+		return dest.count, nil
+	}
+
+	raw := &rawTarReader{reader: reader}
+	tr := tar.NewReader(raw)
+	tarSplit := newTarSplitWriter()
+
+	var entries []zstdChunkedTOCEntry
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "read next entry")
+		}
+
+		// Write the tar header (and the padding of the previous entry).
+		header := raw.take()
+		if _, err := zw.Write(header); err != nil {
+			return nil, errors.Wrapf(err, "compress header of %s", hdr.Name)
+		}
+		if err := tarSplit.add(tarSplitEntry{Type: tarSplitSegmentType, Payload: header}); err != nil {
+			return nil, errors.Wrapf(err, "add tar-split header of %s", hdr.Name)
+		}
+
+		entry, err := zstdChunkedEntry(hdr)
+		if err != nil {
+			return nil, err
+		}
+
+		var crc []byte
+		if entry.Type == "reg" {
+			// Regular file contents are stored in their own frame.
+			if entry.Offset, err = restartFrame(); err != nil {
+				return nil, err
+			}
+
+			contentDigester := digest.Canonical.Digester()
+			crcHash := crc64.New(tarSplitCRCTable)
+			contents := io.MultiWriter(contentDigester.Hash(), crcHash)
+
+			var rawSize int64
+			buffer := make([]byte, 32*1024)
+			for {
+				n, err := tr.Read(buffer)
+				if n > 0 {
+					// #nosec G104 -- hash writes cannot fail.
+					_, _ = contents.Write(buffer[:n])
+					data := raw.take()
+					rawSize += int64(len(data))
+					if _, err := zw.Write(data); err != nil {
+						return nil, errors.Wrapf(err, "compress contents of %s", hdr.Name)
+					}
+				}
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					return nil, errors.Wrapf(err, "read contents of %s", hdr.Name)
+				}
+			}
+			// Sparse files are expanded by archive/tar, so the offsets would
+			// not match the layer.
+			if rawSize != hdr.Size {
+				return nil, errors.Errorf("unsupported sparse file %s", hdr.Name)
+			}
+
+			if entry.EndOffset, err = restartFrame(); err != nil {
+				return nil, err
+			}
+			entry.Digest = contentDigester.Digest().String()
+			if hdr.Size > 0 {
+				entry.ChunkSize = hdr.Size
+				entry.ChunkDigest = entry.Digest
+				crc = crcHash.Sum(nil)
+			}
+		}
+		if err := tarSplit.add(tarSplitEntry{Type: tarSplitFileType, Name: hdr.Name, Size: hdr.Size, Payload: crc}); err != nil {
+			return nil, errors.Wrapf(err, "add tar-split entry of %s", hdr.Name)
+		}
+		entries = append(entries, entry)
+	}
+
+	// Include the end-of-archive marker (and anything after it).
+	if _, err := io.Copy(ioutil.Discard, raw); err != nil {
+		return nil, errors.Wrap(err, "read end of archive")
+	}
+	trailer := raw.take()
+	if _, err := zw.Write(trailer); err != nil {
+		return nil, errors.Wrap(err, "compress end of archive")
+	}
+	if err := tarSplit.add(tarSplitEntry{Type: tarSplitSegmentType, Payload: trailer}); err != nil {
+		return nil, errors.Wrap(err, "add tar-split end of archive")
+	}
+	if err := zw.Close(); err != nil {
+		return nil, errors.Wrap(err, "close zstd writer")
+	}
+
+	// Generate the metadata.
+	tarSplitData, err := zstdCompress(tarSplit.buffer.Bytes())
+	if err != nil {
+		return nil, errors.Wrap(err, "compress tar-split metadata")
+	}
+	toc, err := json.Marshal(zstdChunkedTOC{
+		Version:        1,
+		Entries:        entries,
+		TarSplitDigest: digest.Canonical.FromBytes(tarSplitData),
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal table of contents")
+	}
+	tocData, err := zstdCompress(toc)
+	if err != nil {
+		return nil, errors.Wrap(err, "compress table of contents")
+	}
+
+	tocOffset := dest.count + zstdSkippableFrameHeaderSize
+	if err := writeZstdSkippableFrame(dest, tocData); err != nil {
+		return nil, errors.Wrap(err, "write table of contents")
+	}
+	tarSplitOffset := dest.count + zstdSkippableFrameHeaderSize
+	if err := writeZstdSkippableFrame(dest, tarSplitData); err != nil {
+		return nil, errors.Wrap(err, "write tar-split metadata")
+	}
+
+	footer := make([]byte, zstdChunkedFooterSize)
+	for idx, value := range []uint64{
+		uint64(tocOffset),
+		uint64(len(tocData)),
+		uint64(len(toc)),
+		zstdChunkedManifestTypeCRFS,
+		uint64(tarSplitOffset),
+		uint64(len(tarSplitData)),
+		uint64(tarSplit.buffer.Len()),
+	} {
+		binary.LittleEndian.PutUint64(footer[8*idx:], value)
+	}
+	copy(footer[zstdChunkedFooterSize-len(zstdChunkedFooterMagic):], zstdChunkedFooterMagic)
+	if err := writeZstdSkippableFrame(dest, footer); err != nil {
+		return nil, errors.Wrap(err, "write footer")
+	}
+
+	return map[string]string{
+		ZstdChunkedManifestChecksumAnnotation: digest.Canonical.FromBytes(tocData).String(),
+		ZstdChunkedManifestPositionAnnotation: fmt.Sprintf("%d:%d:%d:%d", tocOffset, len(tocData), len(toc), zstdChunkedManifestTypeCRFS),
+		ZstdChunkedTarSplitPositionAnnotation: fmt.Sprintf("%d:%d:%d", tarSplitOffset, len(tarSplitData), tarSplit.buffer.Len()),
+	}, nil
+}
+
+// annotatedLayer is implemented by the compressed streams returned by
+// Compressors which generate annotations for the descriptor of the layer. The
+// annotations are only available once the stream has been read completely.
+type annotatedLayer interface {
+	LayerAnnotations() map[string]string
+}
+
+// zstdChunkedReader is the compressed stream of a zstd:chunked layer.
+type zstdChunkedReader struct {
+	*io.PipeReader
+	annotations map[string]string
+}
+
+func (r *zstdChunkedReader) LayerAnnotations() map[string]string {
+	return r.annotations
+}
+
+// ZstdChunkedCompressor provides zstd compression in the zstd:chunked format
+// (as used by github.com/containers/storage), which allows runtimes to only
+// fetch the files in a layer they don't already have. The layers are regular
+// zstd-compressed layers (with the same media type), but have additional
+// annotations (the ZstdChunked*Annotation constants) which describe where the
+// table of contents of the layer is stored. These annotations are added to
+// the layer descriptor by Mutator.Add. Layers which are not valid tar
+// archives, or which contain sparse files, cannot be compressed.
+var ZstdChunkedCompressor Compressor = zstdChunkedCompressor{}
+
+type zstdChunkedCompressor struct{}
+
+func (zc zstdChunkedCompressor) Compress(reader io.Reader) (io.ReadCloser, error) {
+	pipeReader, pipeWriter := io.Pipe()
+	compressed := &zstdChunkedReader{PipeReader: pipeReader}
+
+	go func() {
+		annotations, err := writeZstdChunked(pipeWriter, reader)
+		if err != nil {
+			log.Warnf("zstd:chunked compress: could not compress layer: %v", err)
+			// #nosec G104
+			_ = pipeWriter.CloseWithError(errors.Wrap(err, "compressing layer"))
+			return
+		}
+		// This must be set before closing the pipe, so that the annotations
+		// are available once the stream has been read.
+		compressed.annotations = annotations
+		if err := pipeWriter.Close(); err != nil {
+			log.Warnf("zstd:chunked compress: could not close pipe: %v", err)
+			// We don't CloseWithError because we cannot override the Close.
+			return
+		}
+	}()
+
+	return compressed, nil
+}
+
+func (zc zstdChunkedCompressor) MediaTypeSuffix() string {
+	return "zstd"
+}
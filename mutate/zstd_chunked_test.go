@@ -0,0 +1,253 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mutate
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	zstd "github.com/klauspost/compress/zstd"
+	"github.com/opencontainers/go-digest"
+)
+
+// zstdChunkedTestTar returns a tar archive containing a variety of entries,
+// along with the contents of each regular file.
+func zstdChunkedTestTar(t *testing.T) ([]byte, map[string]string) {
+	files := map[string]string{
+		"etc/passwd": "root:x:0:0:root:/root:/bin/sh\n",
+		"etc/empty":  "",
+		"usr/bin/sh": strings.Repeat("not really a shell ", 10000),
+	}
+
+	var buffer bytes.Buffer
+	tw := tar.NewWriter(&buffer)
+	for _, hdr := range []*tar.Header{
+		{Typeflag: tar.TypeDir, Name: "etc/", Mode: 0755},
+		{Typeflag: tar.TypeReg, Name: "etc/passwd", Mode: 0644, PAXRecords: map[string]string{"SCHILY.xattr.user.foo": "bar"}},
+		{Typeflag: tar.TypeReg, Name: "etc/empty", Mode: 0600, Uid: 1000, Gid: 100},
+		{Typeflag: tar.TypeDir, Name: "usr/bin/", Mode: 0755},
+		{Typeflag: tar.TypeReg, Name: "usr/bin/sh", Mode: 0755},
+		{Typeflag: tar.TypeSymlink, Name: "bin", Linkname: "usr/bin"},
+		{Typeflag: tar.TypeLink, Name: "usr/bin/bash", Linkname: "usr/bin/sh"},
+		{Typeflag: tar.TypeChar, Name: "dev/null", Mode: 0666, Devmajor: 1, Devminor: 3},
+	} {
+		hdr.ModTime = time.Unix(1234567890, 0)
+		hdr.Size = int64(len(files[hdr.Name]))
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("write header %s: %v", hdr.Name, err)
+		}
+		if _, err := io.WriteString(tw, files[hdr.Name]); err != nil {
+			t.Fatalf("write contents %s: %v", hdr.Name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("close tar writer: %v", err)
+	}
+	return buffer.Bytes(), files
+}
+
+// zstdDecompress decompresses all of the zstd frames in data.
+func zstdDecompress(t *testing.T, data []byte) []byte {
+	dec, err := zstd.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("create zstd reader: %v", err)
+	}
+	defer dec.Close()
+	decompressed, err := ioutil.ReadAll(dec)
+	if err != nil {
+		t.Fatalf("decompress: %v", err)
+	}
+	return decompressed
+}
+
+// zstdChunkedPosition parses a zstd:chunked position annotation, and returns
+// the (compressed) data it refers to.
+func zstdChunkedPosition(t *testing.T, layer []byte, annotation string) ([]byte, int) {
+	var offset, compressedSize, uncompressedSize int
+	if _, err := fmt.Sscanf(annotation, "%d:%d:%d", &offset, &compressedSize, &uncompressedSize); err != nil {
+		t.Fatalf("invalid position annotation %q: %v", annotation, err)
+	}
+	if offset+compressedSize > len(layer) {
+		t.Fatalf("position annotation %q is outside of the layer (%d bytes)", annotation, len(layer))
+	}
+	return layer[offset : offset+compressedSize], uncompressedSize
+}
+
+func TestZstdChunkedCompressor(t *testing.T) {
+	data, files := zstdChunkedTestTar(t)
+
+	c := ZstdChunkedCompressor
+	if suffix := c.MediaTypeSuffix(); suffix != "zstd" {
+		t.Errorf("unexpected media type suffix %q", suffix)
+	}
+
+	r, err := c.Compress(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("compress: %+v", err)
+	}
+	layer, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("read compressed stream: %+v", err)
+	}
+	annotated, ok := r.(annotatedLayer)
+	if !ok {
+		t.Fatalf("zstd:chunked compressed stream does not provide annotations")
+	}
+	annotations := annotated.LayerAnnotations()
+
+	// The layer must be usable as a normal zstd layer.
+	if !bytes.Equal(zstdDecompress(t, layer), data) {
+		t.Fatalf("decompressed layer does not match the original tar archive")
+	}
+
+	// The footer must match the annotations.
+	footer := layer[len(layer)-zstdChunkedFooterSize:]
+	if !bytes.Equal(footer[zstdChunkedFooterSize-len(zstdChunkedFooterMagic):], zstdChunkedFooterMagic) {
+		t.Fatalf("footer has the wrong magic: %x", footer)
+	}
+	var fields [7]uint64
+	for idx := range fields {
+		fields[idx] = binary.LittleEndian.Uint64(footer[8*idx:])
+	}
+	if expected := fmt.Sprintf("%d:%d:%d:%d", fields[0], fields[1], fields[2], fields[3]); annotations[ZstdChunkedManifestPositionAnnotation] != expected {
+		t.Errorf("manifest position annotation %q does not match footer %q", annotations[ZstdChunkedManifestPositionAnnotation], expected)
+	}
+	if expected := fmt.Sprintf("%d:%d:%d", fields[4], fields[5], fields[6]); annotations[ZstdChunkedTarSplitPositionAnnotation] != expected {
+		t.Errorf("tar-split position annotation %q does not match footer %q", annotations[ZstdChunkedTarSplitPositionAnnotation], expected)
+	}
+
+	// Parse the table of contents.
+	tocData, tocSize := zstdChunkedPosition(t, layer, annotations[ZstdChunkedManifestPositionAnnotation])
+	if got := digest.FromBytes(tocData).String(); got != annotations[ZstdChunkedManifestChecksumAnnotation] {
+		t.Errorf("table of contents has digest %s, expected %s", got, annotations[ZstdChunkedManifestChecksumAnnotation])
+	}
+	tocJSON := zstdDecompress(t, tocData)
+	if len(tocJSON) != tocSize {
+		t.Errorf("table of contents is %d bytes, expected %d", len(tocJSON), tocSize)
+	}
+	var toc zstdChunkedTOC
+	if err := json.Unmarshal(tocJSON, &toc); err != nil {
+		t.Fatalf("parse table of contents: %v", err)
+	}
+	if toc.Version != 1 {
+		t.Errorf("unexpected table of contents version %d", toc.Version)
+	}
+
+	expectedTypes := map[string]string{
+		"etc/":         "dir",
+		"etc/passwd":   "reg",
+		"etc/empty":    "reg",
+		"usr/bin/":     "dir",
+		"usr/bin/sh":   "reg",
+		"bin":          "symlink",
+		"usr/bin/bash": "hardlink",
+		"dev/null":     "char",
+	}
+	if len(toc.Entries) != len(expectedTypes) {
+		t.Errorf("expected %d entries in table of contents, got %d", len(expectedTypes), len(toc.Entries))
+	}
+	for _, entry := range toc.Entries {
+		if typ := expectedTypes[entry.Name]; entry.Type != typ {
+			t.Errorf("entry %s has type %q, expected %q", entry.Name, entry.Type, typ)
+		}
+		if entry.Type != "reg" {
+			continue
+		}
+		// Each file's contents can be fetched by only decompressing the
+		// frame referenced by the table of contents.
+		contents := zstdDecompress(t, layer[entry.Offset:entry.EndOffset])
+		if string(contents) != files[entry.Name] {
+			t.Errorf("entry %s offsets refer to the wrong contents", entry.Name)
+		}
+		if expected := digest.FromBytes(contents).String(); entry.Digest != expected {
+			t.Errorf("entry %s has digest %s, expected %s", entry.Name, entry.Digest, expected)
+		}
+	}
+	for _, entry := range toc.Entries {
+		switch entry.Name {
+		case "etc/passwd":
+			if value := entry.Xattrs["user.foo"]; value != base64.StdEncoding.EncodeToString([]byte("bar")) {
+				t.Errorf("entry %s has the wrong xattr value %q", entry.Name, value)
+			}
+		case "etc/empty":
+			if entry.UID != 1000 || entry.GID != 100 || entry.Mode != 0600 {
+				t.Errorf("entry %s has the wrong metadata: %#v", entry.Name, entry)
+			}
+		case "dev/null":
+			if entry.Devmajor != 1 || entry.Devminor != 3 {
+				t.Errorf("entry %s has the wrong device number: %#v", entry.Name, entry)
+			}
+		}
+	}
+
+	// The tar-split metadata together with the file contents must be enough
+	// to reconstruct the original tar archive.
+	tarSplitData, tarSplitSize := zstdChunkedPosition(t, layer, annotations[ZstdChunkedTarSplitPositionAnnotation])
+	if got := digest.FromBytes(tarSplitData); got != toc.TarSplitDigest {
+		t.Errorf("tar-split metadata has digest %s, expected %s", got, toc.TarSplitDigest)
+	}
+	tarSplitJSON := zstdDecompress(t, tarSplitData)
+	if len(tarSplitJSON) != tarSplitSize {
+		t.Errorf("tar-split metadata is %d bytes, expected %d", len(tarSplitJSON), tarSplitSize)
+	}
+	var reconstructed bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(tarSplitJSON))
+	for position := 0; scanner.Scan(); position++ {
+		var entry tarSplitEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("parse tar-split entry: %v", err)
+		}
+		if entry.Position != position {
+			t.Errorf("tar-split entry has position %d, expected %d", entry.Position, position)
+		}
+		switch entry.Type {
+		case tarSplitSegmentType:
+			reconstructed.Write(entry.Payload)
+		case tarSplitFileType:
+			reconstructed.WriteString(files[entry.Name])
+		default:
+			t.Fatalf("unknown tar-split entry type %d", entry.Type)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatalf("read tar-split metadata: %v", err)
+	}
+	if !bytes.Equal(reconstructed.Bytes(), data) {
+		t.Errorf("tar-split metadata does not reconstruct the original tar archive")
+	}
+}
+
+func TestZstdChunkedCompressorInvalid(t *testing.T) {
+	r, err := ZstdChunkedCompressor.Compress(bytes.NewBufferString(fact))
+	if err != nil {
+		t.Fatalf("compress: %+v", err)
+	}
+	if _, err := ioutil.ReadAll(r); err == nil {
+		t.Errorf("expected an error compressing a non-tar layer with zstd:chunked")
+	}
+}
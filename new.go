@@ -19,12 +19,15 @@ package umoci
 
 import (
 	"context"
+	"encoding/json"
+	"io"
 	"runtime"
-	"time"
 
 	"github.com/apex/log"
+	"github.com/opencontainers/go-digest"
 	imeta "github.com/opencontainers/image-spec/specs-go"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/mutate"
 	"github.com/opencontainers/umoci/oci/casext"
 	igen "github.com/opencontainers/umoci/oci/config/generate"
 	"github.com/pkg/errors"
@@ -32,14 +35,12 @@ import (
 
 // NewImage creates a new empty image (tag) in the existing layout.
 func NewImage(engineExt casext.Engine, tagName string) error {
-	// Create a new manifest.
-	log.WithFields(log.Fields{
-		"tag": tagName,
-	}).Debugf("creating new manifest")
-
 	// Create a new image config.
 	g := igen.New()
-	createTime := time.Now()
+	createTime, err := mutate.Now()
+	if err != nil {
+		return err
+	}
 
 	// Set all of the defaults we need.
 	g.SetCreated(createTime)
@@ -51,8 +52,75 @@ func NewImage(engineExt casext.Engine, tagName string) error {
 	g.SetRootfsType("layers")
 	g.ClearRootfsDiffIDs()
 
-	// Update config and create a new blob for it.
-	config := g.Image()
+	return newImage(engineExt, tagName, mutate.ImageConfig{Image: g.Image()})
+}
+
+// NewImageConfig creates a new empty image (tag) in the existing layout, with
+// the image configuration initialised from the OCI image configuration JSON
+// read from config (rather than the defaults used by NewImage). The
+// configuration is validated, and must not reference any layers. If the
+// configuration has no creation time, the current time is used.
+func NewImageConfig(engineExt casext.Engine, tagName string, config io.Reader) error {
+	imageConfig, err := parseNewImageConfig(config)
+	if err != nil {
+		return errors.Wrap(err, "parse image config")
+	}
+	if imageConfig.Created == nil {
+		createTime, err := mutate.Now()
+		if err != nil {
+			return err
+		}
+		imageConfig.Created = &createTime
+	}
+	return newImage(engineExt, tagName, imageConfig)
+}
+
+// parseNewImageConfig parses and validates an OCI image configuration for use
+// as the configuration of a new (empty) image.
+func parseNewImageConfig(r io.Reader) (mutate.ImageConfig, error) {
+	var config mutate.ImageConfig
+
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&config); err != nil {
+		return config, errors.Wrap(err, "decode config")
+	}
+	if decoder.More() {
+		return config, errors.New("decode config: unexpected trailing data")
+	}
+
+	// Required fields.
+	if config.OS == "" {
+		return config, errors.New("missing required field: os")
+	}
+	if config.Architecture == "" {
+		return config, errors.New("missing required field: architecture")
+	}
+	if config.RootFS.Type != "layers" {
+		return config, errors.Errorf("invalid rootfs.type %q: must be \"layers\"", config.RootFS.Type)
+	}
+
+	// The new image has no layers, so the configuration must not refer to
+	// any.
+	if len(config.RootFS.DiffIDs) != 0 {
+		return config, errors.Errorf("invalid rootfs.diff_ids: new images cannot have layers (config has %d diff_ids)", len(config.RootFS.DiffIDs))
+	}
+	for idx, history := range config.History {
+		if !history.EmptyLayer {
+			return config, errors.Errorf("invalid history[%d]: new images cannot have layers (history entry is not an empty_layer)", idx)
+		}
+	}
+	config.RootFS.DiffIDs = []digest.Digest{}
+	return config, nil
+}
+
+func newImage(engineExt casext.Engine, tagName string, config mutate.ImageConfig) error {
+	// Create a new manifest.
+	log.WithFields(log.Fields{
+		"tag": tagName,
+	}).Debugf("creating new manifest")
+
+	// Create a new blob for the config.
 	configDigest, configSize, err := engineExt.PutBlobJSON(context.Background(), config)
 	if err != nil {
 		return errors.Wrap(err, "put config blob")
@@ -0,0 +1,133 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/casext"
+)
+
+func TestParseNewImageConfig(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		config string
+		valid  bool
+	}{
+		{"Minimal", `{"architecture": "amd64", "os": "linux", "rootfs": {"type": "layers", "diff_ids": []}}`, true},
+		{"NullDiffIDs", `{"architecture": "amd64", "os": "linux", "rootfs": {"type": "layers"}}`, true},
+		{"Full", `{"created": "2020-01-01T00:00:00Z", "author": "Someone", "architecture": "arm64", "variant": "v8", "os": "linux",
+			"config": {"User": "1000:1000", "Env": ["PATH=/bin"], "Entrypoint": ["/bin/sh"], "Labels": {"a": "b"}},
+			"rootfs": {"type": "layers", "diff_ids": []},
+			"history": [{"created_by": "umoci config", "empty_layer": true}]}`, true},
+		{"MissingOS", `{"architecture": "amd64", "rootfs": {"type": "layers", "diff_ids": []}}`, false},
+		{"MissingArchitecture", `{"os": "linux", "rootfs": {"type": "layers", "diff_ids": []}}`, false},
+		{"MissingRootfs", `{"architecture": "amd64", "os": "linux"}`, false},
+		{"BadRootfsType", `{"architecture": "amd64", "os": "linux", "rootfs": {"type": "squashfs", "diff_ids": []}}`, false},
+		{"DiffIDs", `{"architecture": "amd64", "os": "linux", "rootfs": {"type": "layers", "diff_ids": ["sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"]}}`, false},
+		{"LayerHistory", `{"architecture": "amd64", "os": "linux", "rootfs": {"type": "layers", "diff_ids": []}, "history": [{"created_by": "layer"}]}`, false},
+		{"UnknownField", `{"architecture": "amd64", "os": "linux", "rootfs": {"type": "layers", "diff_ids": []}, "unknown": true}`, false},
+		{"UnknownConfigField", `{"architecture": "amd64", "os": "linux", "config": {"Healthcheck": {}}, "rootfs": {"type": "layers", "diff_ids": []}}`, false},
+		{"TrailingData", `{"architecture": "amd64", "os": "linux", "rootfs": {"type": "layers", "diff_ids": []}} {}`, false},
+		{"NotJSON", `architecture: amd64`, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			config, err := parseNewImageConfig(strings.NewReader(test.config))
+			if test.valid && err != nil {
+				t.Errorf("unexpected error parsing config: %+v", err)
+			} else if !test.valid && err == nil {
+				t.Errorf("expected error parsing config, got %#v", config)
+			}
+			if err == nil && config.RootFS.DiffIDs == nil {
+				t.Errorf("expected rootfs.diff_ids to be non-nil")
+			}
+		})
+	}
+}
+
+func TestNewImageConfig(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "umoci-TestNewImageConfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, err := CreateLayout(filepath.Join(dir, "image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	config := `{"architecture": "arm", "variant": "v7", "os": "linux", "config": {"Env": ["FOO=bar"]}, "rootfs": {"type": "layers", "diff_ids": []}}`
+	if err := NewImageConfig(engineExt, "latest", strings.NewReader(config)); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+	if err := NewImageConfig(engineExt, "invalid", strings.NewReader(`{"os": "linux"}`)); err == nil {
+		t.Errorf("expected error creating image with invalid config")
+	}
+
+	descriptorPaths, err := engineExt.ResolveReference(ctx, "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(descriptorPaths) != 1 {
+		t.Fatalf("expected exactly one image, got %d", len(descriptorPaths))
+	}
+	manifestBlob, err := engineExt.FromDescriptor(ctx, descriptorPaths[0].Descriptor())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manifestBlob.Close()
+	manifest := manifestBlob.Data.(ispec.Manifest)
+	if len(manifest.Layers) != 0 {
+		t.Errorf("expected new image to have no layers, got %d", len(manifest.Layers))
+	}
+
+	configBlob, err := engineExt.FromDescriptor(ctx, manifest.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer configBlob.Close()
+	image := configBlob.Data.(ispec.Image)
+	if image.Architecture != "arm" || image.OS != "linux" {
+		t.Errorf("unexpected platform %s/%s", image.OS, image.Architecture)
+	}
+	if len(image.Config.Env) != 1 || image.Config.Env[0] != "FOO=bar" {
+		t.Errorf("unexpected config.Env %v", image.Config.Env)
+	}
+	if image.Created == nil {
+		t.Errorf("expected created time to be set")
+	}
+
+	variant, err := engineExt.ConfigVariant(ctx, manifest.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if variant != "v7" {
+		t.Errorf("expected variant v7, got %q", variant)
+	}
+}
@@ -0,0 +1,670 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package archive provides an implementation of cas.Engine backed by an OCI
+// image layout stored inside a (non-compressed) tar archive -- the format
+// used by the "oci-archive" transport of other tools.
+//
+// Blobs are read directly out of the archive (using an index of the archive
+// built when it is opened). Modifications are stored in a scratch directory
+// until they are committed, at which point a new archive is written and
+// atomically renamed over the original. Since rewriting an archive requires
+// copying every blob, modifications are only committed by PutIndex (which is
+// the point where a modification of an image becomes visible) and Close.
+package archive
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/opencontainers/go-digest"
+	imeta "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/cas"
+	"github.com/opencontainers/umoci/oci/cas/dir"
+	"github.com/opencontainers/umoci/pkg/hardening"
+	"github.com/opencontainers/umoci/pkg/system"
+	"github.com/pkg/errors"
+)
+
+const (
+	// blobDirectory is the directory inside an OCI image that contains blobs.
+	blobDirectory = "blobs"
+
+	// indexFile is the file inside an OCI image that contains the top-level
+	// index.
+	indexFile = "index.json"
+
+	// layoutFile is the file in side an OCI image the indicates what version
+	// of the OCI spec the image is.
+	layoutFile = "oci-layout"
+)
+
+// entry is the location of a blob inside the archive.
+type entry struct {
+	offset int64
+	size   int64
+}
+
+type archiveEngine struct {
+	// lock protects all of the following fields.
+	lock sync.Mutex
+
+	// path is the path to the archive.
+	path string
+
+	// file is the currently open archive, entries is the set of blobs inside
+	// the archive and index is the archive's index.
+	file    *os.File
+	entries map[digest.Digest]entry
+	index   ispec.Index
+
+	// oldFiles are previous versions of the archive that have since been
+	// replaced. We keep them open until Close so that any readers returned by
+	// GetBlob before the archive was rewritten continue to work.
+	oldFiles []*os.File
+
+	// scratchDir is a temporary directory containing an image layout (opened
+	// as scratch) which stores blobs added since the archive was last written.
+	scratchDir string
+	scratch    cas.Engine
+
+	// added (mapping to the sizes of the blobs) and deleted are the set of
+	// blobs added and deleted since the archive was last written, and
+	// newIndex is the new index (if PutIndex was called).
+	added    map[digest.Digest]int64
+	deleted  map[digest.Digest]struct{}
+	newIndex *ispec.Index
+
+	// closed indicates whether Close has been called.
+	closed bool
+}
+
+// blobName returns the name of a blob inside the archive.
+func blobName(digest digest.Digest) string {
+	return path.Join(blobDirectory, digest.Algorithm().String(), digest.Hex())
+}
+
+// cleanName returns the cleaned version of the given tar entry name, as a
+// relative path.
+func cleanName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// load opens the archive and builds the in-memory index of the blobs inside
+// it. e.lock must be held.
+func (e *archiveEngine) load() error {
+	fh, err := os.Open(e.path)
+	if err != nil {
+		return errors.Wrap(err, "open archive")
+	}
+
+	var (
+		entries    = map[digest.Digest]entry{}
+		index      ispec.Index
+		haveIndex  bool
+		haveLayout bool
+	)
+	tr := tar.NewReader(fh)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fh.Close()
+			return errors.Wrap(err, "read archive entry")
+		}
+
+		name := cleanName(hdr.Name)
+		switch {
+		case name == layoutFile:
+			var ociLayout ispec.ImageLayout
+			if err := json.NewDecoder(tr).Decode(&ociLayout); err != nil {
+				fh.Close()
+				return errors.Wrap(err, "parse oci-layout")
+			}
+			// XXX: Currently the meaning of this field is not adequately
+			//      defined by the spec, nor is the "official" value
+			//      determined by the spec.
+			if ociLayout.Version != dir.ImageLayoutVersion {
+				fh.Close()
+				return errors.Wrapf(cas.ErrInvalid, "layout version %q is not supported", ociLayout.Version)
+			}
+			haveLayout = true
+		case name == indexFile:
+			if err := json.NewDecoder(tr).Decode(&index); err != nil {
+				fh.Close()
+				return errors.Wrap(err, "parse index")
+			}
+			haveIndex = true
+		case strings.HasPrefix(name, blobDirectory+"/") && hdr.Typeflag == tar.TypeReg:
+			parts := strings.Split(name, "/")
+			if len(parts) != 3 {
+				log.Debugf("archive: ignoring unknown entry %s", hdr.Name)
+				continue
+			}
+			blobDigest := digest.NewDigestFromHex(parts[1], parts[2])
+			if err := blobDigest.Validate(); err != nil {
+				log.Debugf("archive: ignoring invalid blob entry %s: %v", hdr.Name, err)
+				continue
+			}
+			// archive/tar reads no further than the start of the data of
+			// the current entry, so the current offset of the file is the
+			// offset of the blob contents.
+			offset, err := fh.Seek(0, io.SeekCurrent)
+			if err != nil {
+				fh.Close()
+				return errors.Wrap(err, "get blob offset")
+			}
+			entries[blobDigest] = entry{offset: offset, size: hdr.Size}
+		default:
+			log.Debugf("archive: ignoring unknown entry %s", hdr.Name)
+		}
+	}
+
+	if !haveLayout {
+		fh.Close()
+		return errors.Wrap(cas.ErrInvalid, "archive is missing oci-layout")
+	}
+	if !haveIndex {
+		fh.Close()
+		return errors.Wrap(cas.ErrInvalid, "archive is missing index")
+	}
+
+	if e.file != nil {
+		e.oldFiles = append(e.oldFiles, e.file)
+	}
+	e.file = fh
+	e.entries = entries
+	e.index = index
+	return nil
+}
+
+// ensureScratch creates the scratch image layout, if it doesn't already
+// exist. e.lock must be held.
+func (e *archiveEngine) ensureScratch() error {
+	if e.scratch != nil {
+		return nil
+	}
+	tempDir, err := ioutil.TempDir("", "umoci-archive-")
+	if err != nil {
+		return errors.Wrap(err, "create scratch tempdir")
+	}
+	scratchDir := filepath.Join(tempDir, "image")
+	if err := dir.Create(scratchDir); err != nil {
+		// #nosec G104
+		_ = os.RemoveAll(tempDir)
+		return errors.Wrap(err, "create scratch image")
+	}
+	scratch, err := dir.Open(scratchDir)
+	if err != nil {
+		// #nosec G104
+		_ = os.RemoveAll(tempDir)
+		return errors.Wrap(err, "open scratch image")
+	}
+	e.scratchDir = tempDir
+	e.scratch = scratch
+	return nil
+}
+
+// removeScratch removes the scratch image layout. e.lock must be held.
+func (e *archiveEngine) removeScratch() error {
+	if e.scratch == nil {
+		return nil
+	}
+	if err := e.scratch.Close(); err != nil {
+		return errors.Wrap(err, "close scratch image")
+	}
+	if err := os.RemoveAll(e.scratchDir); err != nil {
+		return errors.Wrap(err, "remove scratch image")
+	}
+	e.scratch = nil
+	e.scratchDir = ""
+	return nil
+}
+
+// dirty returns whether there are any uncommitted modifications. e.lock must
+// be held.
+func (e *archiveEngine) dirty() bool {
+	return len(e.added) > 0 || len(e.deleted) > 0 || e.newIndex != nil
+}
+
+// currentIndex returns the current index, including uncommitted changes.
+// e.lock must be held.
+func (e *archiveEngine) currentIndex() ispec.Index {
+	if e.newIndex != nil {
+		return *e.newIndex
+	}
+	return e.index
+}
+
+// currentBlobs returns the sorted list of blobs, including uncommitted
+// changes. e.lock must be held.
+func (e *archiveEngine) currentBlobs() []digest.Digest {
+	digests := []digest.Digest{}
+	for digest := range e.entries {
+		if _, ok := e.deleted[digest]; ok {
+			continue
+		}
+		if _, ok := e.added[digest]; ok {
+			continue
+		}
+		digests = append(digests, digest)
+	}
+	for digest := range e.added {
+		digests = append(digests, digest)
+	}
+	sort.Slice(digests, func(i, j int) bool {
+		return digests[i] < digests[j]
+	})
+	return digests
+}
+
+// getBlob is the lock-free implementation of GetBlob, which also returns the
+// size of the blob. e.lock must be held.
+func (e *archiveEngine) getBlob(ctx context.Context, digest digest.Digest) (io.ReadCloser, int64, error) {
+	if size, ok := e.added[digest]; ok {
+		rdr, err := e.scratch.GetBlob(ctx, digest)
+		return rdr, size, err
+	}
+	if _, ok := e.deleted[digest]; ok {
+		return nil, -1, errors.Wrapf(cas.ErrNotExist, "get blob %s", digest)
+	}
+	blob, ok := e.entries[digest]
+	if !ok {
+		return nil, -1, errors.Wrapf(cas.ErrNotExist, "get blob %s", digest)
+	}
+	return &hardening.VerifiedReadCloser{
+		Reader:         ioutil.NopCloser(io.NewSectionReader(e.file, blob.offset, blob.size)),
+		ExpectedDigest: digest,
+		ExpectedSize:   blob.size,
+	}, blob.size, nil
+}
+
+// commit writes a new archive containing the current state of the image, and
+// atomically replaces the old archive with it. e.lock must be held.
+func (e *archiveEngine) commit(ctx context.Context) (Err error) {
+	if !e.dirty() {
+		return nil
+	}
+
+	fh, err := ioutil.TempFile(filepath.Dir(e.path), "."+filepath.Base(e.path)+"-")
+	if err != nil {
+		return errors.Wrap(err, "create temporary archive")
+	}
+	tempPath := fh.Name()
+	defer func() {
+		if Err != nil {
+			// #nosec G104
+			_ = os.Remove(tempPath)
+		}
+	}()
+	defer fh.Close()
+
+	index := e.currentIndex()
+	if err := writeArchive(fh, index, e.currentBlobs(), func(digest digest.Digest) (io.ReadCloser, int64, error) {
+		return e.getBlob(ctx, digest)
+	}); err != nil {
+		return err
+	}
+	if err := fh.Sync(); err != nil {
+		return errors.Wrap(err, "sync temporary archive")
+	}
+	if err := fh.Close(); err != nil {
+		return errors.Wrap(err, "close temporary archive")
+	}
+	if err := os.Rename(tempPath, e.path); err != nil {
+		return errors.Wrap(err, "rename temporary archive")
+	}
+
+	// Reload the new archive and reset the modification state.
+	if err := e.load(); err != nil {
+		return errors.Wrap(err, "reload archive")
+	}
+	if err := e.removeScratch(); err != nil {
+		return err
+	}
+	e.added = map[digest.Digest]int64{}
+	e.deleted = map[digest.Digest]struct{}{}
+	e.newIndex = nil
+	return nil
+}
+
+// writeArchive writes an OCI image layout archive containing the given index
+// and blobs (with blob contents retrieved using getBlob) to w. The archive is
+// generated deterministically.
+func writeArchive(w io.Writer, index ispec.Index, blobs []digest.Digest, getBlob func(digest.Digest) (io.ReadCloser, int64, error)) error {
+	tw := tar.NewWriter(w)
+	epoch := time.Unix(0, 0)
+
+	writeJSON := func(name string, v interface{}) error {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return errors.Wrapf(err, "encode %s", name)
+		}
+		if err := tw.WriteHeader(&tar.Header{
+			Name:     name,
+			Typeflag: tar.TypeReg,
+			Mode:     0644,
+			Size:     int64(len(data)),
+			ModTime:  epoch,
+		}); err != nil {
+			return errors.Wrapf(err, "write %s header", name)
+		}
+		_, err = tw.Write(data)
+		return errors.Wrapf(err, "write %s", name)
+	}
+
+	if err := writeJSON(layoutFile, ispec.ImageLayout{Version: dir.ImageLayoutVersion}); err != nil {
+		return err
+	}
+	if err := writeJSON(indexFile, index); err != nil {
+		return err
+	}
+
+	// Make sure that the directory of every blob exists.
+	dirs := []string{blobDirectory + "/", path.Join(blobDirectory, cas.BlobAlgorithm.String()) + "/"}
+	for _, digest := range blobs {
+		if name := path.Dir(blobName(digest)) + "/"; name != dirs[len(dirs)-1] {
+			dirs = append(dirs, name)
+		}
+	}
+	for _, name := range dirs {
+		if err := tw.WriteHeader(&tar.Header{
+			Name:     name,
+			Typeflag: tar.TypeDir,
+			Mode:     0755,
+			ModTime:  epoch,
+		}); err != nil {
+			return errors.Wrapf(err, "write %s header", name)
+		}
+	}
+
+	for _, digest := range blobs {
+		if err := writeBlob(tw, digest, epoch, getBlob); err != nil {
+			return errors.Wrapf(err, "write blob %s", digest)
+		}
+	}
+	return errors.Wrap(tw.Close(), "close archive")
+}
+
+func writeBlob(tw *tar.Writer, digest digest.Digest, epoch time.Time, getBlob func(digest.Digest) (io.ReadCloser, int64, error)) error {
+	rdr, size, err := getBlob(digest)
+	if err != nil {
+		return errors.Wrap(err, "get blob")
+	}
+	defer rdr.Close()
+
+	if err := tw.WriteHeader(&tar.Header{
+		Name:     blobName(digest),
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		Size:     size,
+		ModTime:  epoch,
+	}); err != nil {
+		return errors.Wrap(err, "write header")
+	}
+	if _, err := system.Copy(tw, rdr); err != nil {
+		return errors.Wrap(err, "write contents")
+	}
+	// Make sure the blob wasn't corrupted.
+	return errors.Wrap(rdr.Close(), "verify blob")
+}
+
+// PutBlob adds a new blob to the image. This is idempotent; a nil error
+// means that "the content is stored at DIGEST" without implying "because
+// of this PutBlob() call".
+func (e *archiveEngine) PutBlob(ctx context.Context, reader io.Reader) (digest.Digest, int64, error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if e.closed {
+		return "", -1, ErrClosed
+	}
+	if err := e.ensureScratch(); err != nil {
+		return "", -1, err
+	}
+	digest, size, err := e.scratch.PutBlob(ctx, reader)
+	if err != nil {
+		return "", -1, err
+	}
+	delete(e.deleted, digest)
+	if _, ok := e.entries[digest]; !ok {
+		e.added[digest] = size
+	} else {
+		// The blob is already in the archive, no need to store it twice.
+		if err := e.scratch.DeleteBlob(ctx, digest); err != nil {
+			return "", -1, errors.Wrap(err, "remove duplicate scratch blob")
+		}
+	}
+	return digest, size, nil
+}
+
+// GetBlob returns a reader for retrieving a blob from the image, which the
+// caller must Close(). Returns ErrNotExist if the digest is not found.
+//
+// This function will return a VerifiedReadCloser, meaning that you must call
+// Close() and check the error returned from Close() in order to ensure that
+// the hash of the blob is verified.
+func (e *archiveEngine) GetBlob(ctx context.Context, digest digest.Digest) (io.ReadCloser, error) {
+	if err := digest.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid digest: %q", digest)
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if e.closed {
+		return nil, ErrClosed
+	}
+	rdr, _, err := e.getBlob(ctx, digest)
+	return rdr, err
+}
+
+// StatBlob returns whether the specified blob exists in the image. Returns
+// false if the blob doesn't exist, true if it does, or an error if any error
+// occurred.
+func (e *archiveEngine) StatBlob(ctx context.Context, digest digest.Digest) (bool, error) {
+	if err := digest.Validate(); err != nil {
+		return false, errors.Wrapf(err, "invalid digest: %q", digest)
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if e.closed {
+		return false, ErrClosed
+	}
+	if _, ok := e.added[digest]; ok {
+		return true, nil
+	}
+	if _, ok := e.deleted[digest]; ok {
+		return false, nil
+	}
+	_, ok := e.entries[digest]
+	return ok, nil
+}
+
+// PutIndex sets the index of the OCI image to the given index, replacing the
+// previously existing index. The new archive (including all modifications
+// made since the archive was last written) is written before PutIndex
+// returns, and replaces the old archive atomically.
+func (e *archiveEngine) PutIndex(ctx context.Context, index ispec.Index) error {
+	// Make sure the index has the mediatype field set.
+	index.MediaType = ispec.MediaTypeImageIndex
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if e.closed {
+		return ErrClosed
+	}
+	e.newIndex = &index
+	return errors.Wrap(e.commit(ctx), "write archive")
+}
+
+// GetIndex returns the index of the OCI image.
+//
+// It is not recommended that users of cas.Engine use this interface directly,
+// due to the complication of properly handling references as well as correctly
+// handling nested indexes. casext.Engine provides a wrapper for cas.Engine
+// that implements various reference resolution functions that should work for
+// most users.
+func (e *archiveEngine) GetIndex(ctx context.Context) (ispec.Index, error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if e.closed {
+		return ispec.Index{}, ErrClosed
+	}
+	return e.currentIndex(), nil
+}
+
+// DeleteBlob removes a blob from the image. This is idempotent; a nil
+// error means "the content is not in the store" without implying "because
+// of this DeleteBlob() call".
+func (e *archiveEngine) DeleteBlob(ctx context.Context, digest digest.Digest) error {
+	if err := digest.Validate(); err != nil {
+		return errors.Wrapf(err, "invalid digest: %q", digest)
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if e.closed {
+		return ErrClosed
+	}
+	if _, ok := e.added[digest]; ok {
+		if err := e.scratch.DeleteBlob(ctx, digest); err != nil {
+			return errors.Wrap(err, "remove scratch blob")
+		}
+		delete(e.added, digest)
+	}
+	if _, ok := e.entries[digest]; ok {
+		e.deleted[digest] = struct{}{}
+	}
+	return nil
+}
+
+// ListBlobs returns the set of blob digests stored in the image.
+func (e *archiveEngine) ListBlobs(ctx context.Context) ([]digest.Digest, error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if e.closed {
+		return nil, ErrClosed
+	}
+	return e.currentBlobs(), nil
+}
+
+// Clean executes a garbage collection of any non-blob garbage in the store.
+// All temporary data of the archive engine is stored outside of the archive
+// and removed by Close, so this is a no-op.
+func (e *archiveEngine) Clean(ctx context.Context) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if e.closed {
+		return ErrClosed
+	}
+	return nil
+}
+
+// Close writes any uncommitted modifications to the archive, and releases all
+// references held by the engine. Subsequent operations will fail with
+// ErrClosed.
+func (e *archiveEngine) Close() error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if e.closed {
+		return nil
+	}
+	if err := e.commit(context.Background()); err != nil {
+		return errors.Wrap(err, "write archive")
+	}
+	if err := e.removeScratch(); err != nil {
+		return err
+	}
+	for _, fh := range append(e.oldFiles, e.file) {
+		if err := fh.Close(); err != nil {
+			return errors.Wrap(err, "close archive")
+		}
+	}
+	e.oldFiles = nil
+	e.closed = true
+	return nil
+}
+
+// ErrClosed is returned by all operations on an engine after it has been
+// closed.
+var ErrClosed = errors.New("archive engine has been closed")
+
+// Open opens a new reference to the OCI image layout archive at the provided
+// path.
+func Open(path string) (cas.Engine, error) {
+	engine := &archiveEngine{
+		path:    path,
+		added:   map[digest.Digest]int64{},
+		deleted: map[digest.Digest]struct{}{},
+	}
+	if err := engine.load(); err != nil {
+		return nil, errors.Wrap(err, "load archive")
+	}
+	return engine, nil
+}
+
+// Create creates a new OCI image layout archive at the given path. If the path
+// already exists, os.ErrExist is returned. However, all of the parent
+// components of the path will be created if necessary.
+func Create(path string) error {
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return errors.Wrap(err, "mkdir parent")
+		}
+	}
+	fh, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return errors.Wrap(err, "create archive")
+	}
+	defer fh.Close()
+
+	defaultIndex := ispec.Index{
+		Versioned: imeta.Versioned{
+			SchemaVersion: 2, // FIXME: This is hardcoded at the moment.
+		},
+		MediaType: ispec.MediaTypeImageIndex,
+	}
+	if err := writeArchive(fh, defaultIndex, nil, nil); err != nil {
+		// #nosec G104
+		_ = os.Remove(path)
+		return err
+	}
+	return errors.Wrap(fh.Close(), "close archive")
+}
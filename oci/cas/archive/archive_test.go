@@ -0,0 +1,349 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/cas"
+	"github.com/opencontainers/umoci/oci/cas/dir"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/pkg/errors"
+)
+
+func readBlob(t *testing.T, engine cas.Engine, digest digest.Digest) []byte {
+	rdr, err := engine.GetBlob(context.Background(), digest)
+	if err != nil {
+		t.Fatalf("GetBlob %s: unexpected error: %+v", digest, err)
+	}
+	data, err := ioutil.ReadAll(rdr)
+	if err != nil {
+		t.Fatalf("GetBlob %s: failed to ReadAll: %+v", digest, err)
+	}
+	if err := rdr.Close(); err != nil {
+		t.Fatalf("GetBlob %s: failed to Close: %+v", digest, err)
+	}
+	return data
+}
+
+func TestCreateArchive(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestCreateArchive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image.tar")
+	if err := Create(image); err != nil {
+		t.Fatalf("unexpected error creating archive: %+v", err)
+	}
+
+	engine, err := Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening archive: %+v", err)
+	}
+	defer engine.Close()
+
+	index, err := engine.GetIndex(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error getting index: %+v", err)
+	}
+	if index.SchemaVersion != 2 || len(index.Manifests) != 0 {
+		t.Errorf("new archive has an unexpected index: %#v", index)
+	}
+	if blobs, err := engine.ListBlobs(ctx); err != nil {
+		t.Errorf("unexpected error getting list of blobs: %+v", err)
+	} else if len(blobs) > 0 {
+		t.Errorf("got blobs in a clean archive: %v", blobs)
+	}
+
+	// We should get an error if we try to create a new archive atop an old
+	// one.
+	if err := Create(image); err == nil {
+		t.Errorf("expected to get a cowardly no-clobber error!")
+	}
+}
+
+func TestEngineBlob(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineBlob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image.tar")
+	if err := Create(image); err != nil {
+		t.Fatalf("unexpected error creating archive: %+v", err)
+	}
+
+	engine, err := Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening archive: %+v", err)
+	}
+
+	var digests []digest.Digest
+	contents := map[digest.Digest][]byte{}
+	for _, data := range [][]byte{
+		[]byte(""),
+		[]byte("some blob"),
+		[]byte("another blob"),
+	} {
+		digest, size, err := engine.PutBlob(ctx, bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("PutBlob: unexpected error: %+v", err)
+		}
+		if size != int64(len(data)) {
+			t.Errorf("PutBlob: length doesn't match: expected=%d got=%d", len(data), size)
+		}
+		if got := readBlob(t, engine, digest); !bytes.Equal(got, data) {
+			t.Errorf("GetBlob: bytes did not match: expected=%s got=%s", string(data), string(got))
+		}
+		digests = append(digests, digest)
+		contents[digest] = data
+	}
+
+	// Commit the blobs to the archive.
+	if err := engine.PutIndex(ctx, ispec.Index{}); err != nil {
+		t.Fatalf("PutIndex: unexpected error: %+v", err)
+	}
+
+	// Delete one of the blobs (which must only be committed on Close).
+	if err := engine.DeleteBlob(ctx, digests[0]); err != nil {
+		t.Fatalf("DeleteBlob: unexpected error: %+v", err)
+	}
+	if br, err := engine.GetBlob(ctx, digests[0]); errors.Cause(err) != cas.ErrNotExist {
+		if err == nil {
+			br.Close()
+			t.Errorf("GetBlob: still got blob contents after DeleteBlob!")
+		} else {
+			t.Errorf("GetBlob: unexpected error: %+v", err)
+		}
+	}
+	if err := engine.Close(); err != nil {
+		t.Fatalf("Close: unexpected error: %+v", err)
+	}
+
+	// Re-open the archive and make sure everything was saved.
+	engine, err = Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error re-opening archive: %+v", err)
+	}
+	defer engine.Close()
+
+	blobs, err := engine.ListBlobs(ctx)
+	if err != nil {
+		t.Fatalf("ListBlobs: unexpected error: %+v", err)
+	}
+	if len(blobs) != len(digests)-1 {
+		t.Errorf("ListBlobs: expected %d blobs, got %v", len(digests)-1, blobs)
+	}
+	if exists, err := engine.StatBlob(ctx, digests[0]); err != nil || exists {
+		t.Errorf("StatBlob: deleted blob still exists after re-open: %v", err)
+	}
+	for _, digest := range digests[1:] {
+		if exists, err := engine.StatBlob(ctx, digest); err != nil || !exists {
+			t.Errorf("StatBlob: blob %s missing after re-open: %v", digest, err)
+		}
+		if got := readBlob(t, engine, digest); !bytes.Equal(got, contents[digest]) {
+			t.Errorf("GetBlob: bytes did not match: expected=%s got=%s", string(contents[digest]), string(got))
+		}
+	}
+}
+
+// tarLayout creates an archive of the given image layout directory (with
+// "./"-prefixed names, like tar(1) generates).
+func tarLayout(t *testing.T, layout, archive string) {
+	fh, err := os.Create(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+
+	tw := tar.NewWriter(fh)
+	if err := filepath.Walk(layout, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(layout, path)
+		if err != nil {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(fi, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = "./" + filepath.ToSlash(rel)
+		if fi.IsDir() {
+			hdr.Name += "/"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if fi.Mode().IsRegular() {
+			src, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer src.Close()
+			if _, err := io.Copy(tw, src); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("tar layout: %+v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEngineExternalArchive(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineExternalArchive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	// Create an image layout with some references.
+	layout := filepath.Join(root, "layout")
+	if err := dir.Create(layout); err != nil {
+		t.Fatal(err)
+	}
+	dirEngine, err := dir.Open(layout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirEngineExt := casext.NewEngine(dirEngine)
+	configDigest, configSize, err := dirEngineExt.PutBlobJSON(ctx, ispec.Image{OS: "linux"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobDigest, blobSize, err := dirEngineExt.PutBlobJSON(ctx, ispec.Manifest{
+		MediaType: ispec.MediaTypeImageManifest,
+		Config: ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageConfig,
+			Digest:    configDigest,
+			Size:      configSize,
+		},
+		Layers: []ispec.Descriptor{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	descriptor := ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    blobDigest,
+		Size:      blobSize,
+	}
+	if err := dirEngineExt.UpdateReference(ctx, "latest", descriptor); err != nil {
+		t.Fatal(err)
+	}
+	// Add a garbage blob for GC.
+	garbageDigest, _, err := dirEngine.PutBlob(ctx, bytes.NewBufferString("garbage"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dirEngine.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	image := filepath.Join(root, "image.tar")
+	tarLayout(t, layout, image)
+
+	engine, err := Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening archive: %+v", err)
+	}
+	engineExt := casext.NewEngine(engine)
+
+	descriptorPaths, err := engineExt.ResolveReference(ctx, "latest")
+	if err != nil {
+		t.Fatalf("ResolveReference: unexpected error: %+v", err)
+	}
+	if len(descriptorPaths) != 1 || descriptorPaths[0].Descriptor().Digest != blobDigest {
+		t.Fatalf("ResolveReference: got unexpected result: %v", descriptorPaths)
+	}
+
+	// Garbage collection of archives must work.
+	if err := engineExt.GC(ctx); err != nil {
+		t.Fatalf("GC: unexpected error: %+v", err)
+	}
+	if err := engine.Close(); err != nil {
+		t.Fatalf("Close: unexpected error: %+v", err)
+	}
+
+	engine, err = Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error re-opening archive: %+v", err)
+	}
+	defer engine.Close()
+	if blobs, err := engine.ListBlobs(ctx); err != nil {
+		t.Fatalf("ListBlobs: unexpected error: %+v", err)
+	} else if len(blobs) != 2 {
+		t.Errorf("ListBlobs: expected only the manifest and config after gc, got %v", blobs)
+	}
+	if exists, err := engine.StatBlob(ctx, garbageDigest); err != nil || exists {
+		t.Errorf("StatBlob: garbage blob still exists after gc: %v", err)
+	}
+}
+
+func TestEngineInvalidArchive(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestEngineInvalidArchive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	// An archive without an oci-layout or index.json is invalid.
+	image := filepath.Join(root, "image.tar")
+	fh, err := os.Create(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw := tar.NewWriter(fh)
+	if err := tw.WriteHeader(&tar.Header{Name: "blobs/", Typeflag: tar.TypeDir, Mode: 0755}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	fh.Close()
+
+	if engine, err := Open(image); errors.Cause(err) != cas.ErrInvalid {
+		if err == nil {
+			engine.Close()
+		}
+		t.Errorf("expected ErrInvalid opening invalid archive: %+v", err)
+	}
+}
@@ -120,3 +120,26 @@ type Engine interface {
 	// may fail.
 	Close() (err error)
 }
+
+// IndexLocker is an optional interface which can be implemented by an Engine
+// to allow read-modify-write updates of the index (such as
+// casext.Engine.UpdateReference) to be made safe against concurrent updates
+// by other users of the same image. Without it, concurrent updates are still
+// atomic (see Engine.PutIndex) but one of the updates may be lost.
+type IndexLocker interface {
+	// LockIndex blocks until an exclusive lock on the index of the image has
+	// been acquired, and returns a function to release the lock. The lock
+	// only excludes other users of LockIndex -- GetIndex and PutIndex do not
+	// take the lock themselves (and may be called while holding it).
+	LockIndex(ctx context.Context) (unlock func() error, err error)
+}
+
+// BlobSizer is an optional interface which can be implemented by an Engine to
+// allow the size of a blob to be found without reading the entire blob (see
+// casext.Engine.BlobSize).
+type BlobSizer interface {
+	// BlobSize returns the size (in bytes) of the blob with the given digest.
+	// The contents of the blob are not verified. If the blob doesn't exist,
+	// ErrNotExist is returned.
+	BlobSize(ctx context.Context, digest digest.Digest) (int64, error)
+}
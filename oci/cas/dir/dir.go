@@ -24,6 +24,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sync"
 
 	"github.com/apex/log"
 	"github.com/opencontainers/go-digest"
@@ -53,6 +54,14 @@ const (
 	// layoutFile is the file in side an OCI image the indicates what version
 	// of the OCI spec the image is.
 	layoutFile = "oci-layout"
+
+	// lockFile is the file inside an OCI image used by umoci for flock(2)
+	// advisory locking between users of the image. An exclusive lock is held
+	// while updating the index (with LockIndex) and while Clean is removing
+	// temporary directories, and a shared lock is held while creating a
+	// temporary directory. Note that this name must not match the ".umoci-*"
+	// pattern used for temporary directories.
+	lockFile = ".umoci.lock"
 )
 
 // blobPath returns the path to a blob given its digest, relative to the root
@@ -72,14 +81,58 @@ func blobPath(digest digest.Digest) (string, error) {
 	return filepath.Join(blobDirectory, algo.String(), hash), nil
 }
 
+// dirEngine is a cas.Engine backed by an OCI image layout directory.
+//
+// Blobs and the index are always written to a temporary file (in a locked
+// temporary directory inside the image, so that it is on the same filesystem)
+// which is synced to disk and then atomically renamed into place. This means
+// that concurrent users of the same image (in the same process or in
+// different processes) will never observe partially-written blobs or
+// indexes, even if a writer crashes. Note that the digest of a blob is
+// computed from the data written to the temporary file, so the blob path
+// always matches its contents.
 type dirEngine struct {
-	path     string
+	path string
+
+	// tempLock protects temp and tempFile.
+	tempLock sync.Mutex
 	temp     string
 	tempFile *os.File
 }
 
+// lock acquires a flock(2) of the given type on the lockFile of the image,
+// returning the locked file (which must be closed to release the lock).
+func (e *dirEngine) lock(how int) (*os.File, error) {
+	fh, err := os.OpenFile(filepath.Join(e.path, lockFile), os.O_RDONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "open lock file")
+	}
+	for {
+		err = unix.Flock(int(fh.Fd()), how)
+		if err != unix.EINTR {
+			break
+		}
+	}
+	if err != nil {
+		fh.Close()
+		return nil, errors.Wrap(err, "flock lock file")
+	}
+	return fh, nil
+}
+
 func (e *dirEngine) ensureTempDir() error {
+	e.tempLock.Lock()
+	defer e.tempLock.Unlock()
+
 	if e.temp == "" {
+		// Make sure that Clean() (from another user of the image) can't
+		// remove our temporary directory before we've locked it.
+		lockFh, err := e.lock(unix.LOCK_SH)
+		if err != nil {
+			return errors.Wrap(err, "lock image")
+		}
+		defer lockFh.Close()
+
 		tempDir, err := ioutil.TempDir(e.path, ".umoci-")
 		if err != nil {
 			return errors.Wrap(err, "create tempdir")
@@ -120,7 +173,7 @@ func (e *dirEngine) validate() error {
 	// XXX: Currently the meaning of this field is not adequately defined by
 	//      the spec, nor is the "official" value determined by the spec.
 	if ociLayout.Version != ImageLayoutVersion {
-		return errors.Wrap(cas.ErrInvalid, "layout version is not supported")
+		return errors.Wrapf(cas.ErrInvalid, "layout version %q is not supported", ociLayout.Version)
 	}
 
 	// Check that "blobs" and "index.json" exist in the image.
@@ -151,27 +204,41 @@ func (e *dirEngine) validate() error {
 // PutBlob adds a new blob to the image. This is idempotent; a nil error
 // means that "the content is stored at DIGEST" without implying "because
 // of this PutBlob() call".
-func (e *dirEngine) PutBlob(ctx context.Context, reader io.Reader) (digest.Digest, int64, error) {
+func (e *dirEngine) PutBlob(ctx context.Context, reader io.Reader) (_ digest.Digest, _ int64, Err error) {
 	if err := e.ensureTempDir(); err != nil {
 		return "", -1, errors.Wrap(err, "ensure tempdir")
 	}
+	e.tempLock.Lock()
+	tempDir := e.temp
+	e.tempLock.Unlock()
 
 	digester := cas.BlobAlgorithm.Digester()
 
 	// We copy this into a temporary file because we need to get the blob hash,
 	// but also to avoid half-writing an invalid blob.
-	fh, err := ioutil.TempFile(e.temp, "blob-")
+	fh, err := ioutil.TempFile(tempDir, "blob-")
 	if err != nil {
 		return "", -1, errors.Wrap(err, "create temporary blob")
 	}
 	tempPath := fh.Name()
 	defer fh.Close()
+	// Don't leave behind partially-written blobs if we fail (such as when the
+	// reader is a network stream which timed out).
+	defer func() {
+		if Err != nil {
+			// #nosec G104
+			_ = os.Remove(tempPath)
+		}
+	}()
 
 	writer := io.MultiWriter(fh, digester.Hash())
 	size, err := system.Copy(writer, reader)
 	if err != nil {
 		return "", -1, errors.Wrap(err, "copy to temporary blob")
 	}
+	if err := fh.Sync(); err != nil {
+		return "", -1, errors.Wrap(err, "sync temporary blob")
+	}
 	if err := fh.Close(); err != nil {
 		return "", -1, errors.Wrap(err, "close temporary blob")
 	}
@@ -182,7 +249,9 @@ func (e *dirEngine) PutBlob(ctx context.Context, reader io.Reader) (digest.Diges
 		return "", -1, errors.Wrap(err, "compute blob name")
 	}
 
-	// Move the blob to its correct path.
+	// Move the blob to its correct path. rename(2) is atomic, so even if
+	// someone else is writing the same blob concurrently, readers will only
+	// ever see a complete blob.
 	path = filepath.Join(e.path, path)
 	if err := os.Rename(tempPath, path); err != nil {
 		return "", -1, errors.Wrap(err, "rename temporary blob")
@@ -225,7 +294,7 @@ func (e *dirEngine) StatBlob(ctx context.Context, digest digest.Digest) (bool, e
 	if err != nil {
 		return false, errors.Wrap(err, "compute blob path")
 	}
-	_, err = os.Stat(path)
+	_, err = os.Stat(filepath.Join(e.path, path))
 	if os.IsNotExist(err) {
 		return false, nil
 	}
@@ -235,6 +304,23 @@ func (e *dirEngine) StatBlob(ctx context.Context, digest digest.Digest) (bool, e
 	return true, nil
 }
 
+// BlobSize returns the size of the specified blob, without reading (or
+// verifying) its contents.
+func (e *dirEngine) BlobSize(ctx context.Context, digest digest.Digest) (int64, error) {
+	path, err := blobPath(digest)
+	if err != nil {
+		return -1, errors.Wrap(err, "compute blob path")
+	}
+	fi, err := os.Lstat(filepath.Join(e.path, path))
+	if os.IsNotExist(err) {
+		return -1, errors.Wrapf(cas.ErrNotExist, "blob %s", digest)
+	}
+	if err != nil {
+		return -1, errors.Wrap(err, "stat blob path")
+	}
+	return fi.Size(), nil
+}
+
 // PutIndex sets the index of the OCI image to the given index, replacing the
 // previously existing index. This operation is atomic; any readers attempting
 // to access the OCI image while it is being modified will only ever see the
@@ -243,13 +329,16 @@ func (e *dirEngine) PutIndex(ctx context.Context, index ispec.Index) error {
 	if err := e.ensureTempDir(); err != nil {
 		return errors.Wrap(err, "ensure tempdir")
 	}
+	e.tempLock.Lock()
+	tempDir := e.temp
+	e.tempLock.Unlock()
 
 	// Make sure the index has the mediatype field set.
 	index.MediaType = ispec.MediaTypeImageIndex
 
 	// We copy this into a temporary index to ensure the atomicity of this
 	// operation.
-	fh, err := ioutil.TempFile(e.temp, "index-")
+	fh, err := ioutil.TempFile(tempDir, "index-")
 	if err != nil {
 		return errors.Wrap(err, "create temporary index")
 	}
@@ -260,6 +349,9 @@ func (e *dirEngine) PutIndex(ctx context.Context, index ispec.Index) error {
 	if err := json.NewEncoder(fh).Encode(index); err != nil {
 		return errors.Wrap(err, "write temporary index")
 	}
+	if err := fh.Sync(); err != nil {
+		return errors.Wrap(err, "sync temporary index")
+	}
 	if err := fh.Close(); err != nil {
 		return errors.Wrap(err, "close temporary index")
 	}
@@ -272,6 +364,23 @@ func (e *dirEngine) PutIndex(ctx context.Context, index ispec.Index) error {
 	return nil
 }
 
+// LockIndex blocks until an exclusive lock on the index of the OCI image has
+// been acquired, and returns a function to release the lock. The lock is a
+// flock(2) of a lock file inside the image, so it excludes other users of
+// LockIndex in this process as well as in other processes.
+func (e *dirEngine) LockIndex(ctx context.Context) (func() error, error) {
+	// PutIndex needs a temporary directory, which requires taking a shared
+	// lock -- so make sure it is created before we take the exclusive lock.
+	if err := e.ensureTempDir(); err != nil {
+		return nil, errors.Wrap(err, "ensure tempdir")
+	}
+	fh, err := e.lock(unix.LOCK_EX)
+	if err != nil {
+		return nil, errors.Wrap(err, "lock index")
+	}
+	return fh.Close, nil
+}
+
 // GetIndex returns the index of the OCI image. Return ErrNotExist if the
 // digest is not found. If the image doesn't have an index, ErrInvalid is
 // returned (a valid OCI image MUST have an image index).
@@ -340,6 +449,14 @@ func (e *dirEngine) ListBlobs(ctx context.Context) ([]digest.Digest, error) {
 // (this includes temporary files and directories not reachable from the CAS
 // interface). This MUST NOT remove any blobs or references in the store.
 func (e *dirEngine) Clean(ctx context.Context) error {
+	// Make sure nobody is in the middle of creating (and locking) a temporary
+	// directory while we look for unlocked temporary directories.
+	lockFh, err := e.lock(unix.LOCK_EX)
+	if err != nil {
+		return errors.Wrap(err, "lock image")
+	}
+	defer lockFh.Close()
+
 	// Remove every .umoci directory that isn't flocked.
 	matches, err := filepath.Glob(filepath.Join(e.path, ".umoci-*"))
 	if err != nil {
@@ -383,6 +500,9 @@ func (e *dirEngine) cleanPath(ctx context.Context, path string) error {
 // Close releases all references held by the e. Subsequent operations may
 // fail.
 func (e *dirEngine) Close() error {
+	e.tempLock.Lock()
+	defer e.tempLock.Unlock()
+
 	if e.temp != "" {
 		if err := unix.Flock(int(e.tempFile.Fd()), unix.LOCK_UN); err != nil {
 			return errors.Wrap(err, "unlock tempdir")
@@ -402,7 +522,6 @@ func (e *dirEngine) Close() error {
 func Open(path string) (cas.Engine, error) {
 	engine := &dirEngine{
 		path: path,
-		temp: "",
 	}
 
 	if err := engine.validate(); err != nil {
@@ -20,10 +20,12 @@ package dir
 import (
 	"bytes"
 	"context"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sync"
 	"testing"
 
 	"github.com/opencontainers/umoci/oci/cas"
@@ -117,6 +119,10 @@ func TestEngineBlob(t *testing.T) {
 			t.Errorf("PutBlob: length doesn't match: expected=%d got=%d", len(test.bytes), size)
 		}
 
+		if exists, err := engine.StatBlob(ctx, digest); err != nil || !exists {
+			t.Errorf("StatBlob: expected blob to exist: exists=%v err=%+v", exists, err)
+		}
+
 		blobReader, err := engine.GetBlob(ctx, digest)
 		if err != nil {
 			t.Errorf("GetBlob: unexpected error: %+v", err)
@@ -144,6 +150,10 @@ func TestEngineBlob(t *testing.T) {
 			}
 		}
 
+		if exists, err := engine.StatBlob(ctx, digest); err != nil || exists {
+			t.Errorf("StatBlob: expected blob to not exist after DeleteBlob: exists=%v err=%+v", exists, err)
+		}
+
 		// DeleteBlob is idempotent. It shouldn't cause an error.
 		if err := engine.DeleteBlob(ctx, digest); err != nil {
 			t.Errorf("DeleteBlob: unexpected error on double-delete: %+v", err)
@@ -512,3 +522,167 @@ func TestEngineBlobReadonly(t *testing.T) {
 		testutils.MakeReadWrite(t, image)
 	}
 }
+
+// TestEnginePutBlobConcurrent hammers PutBlob from many goroutines (using
+// several engines for the same image, as several processes would) and makes
+// sure that every blob is stored correctly.
+func TestEnginePutBlobConcurrent(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEnginePutBlobConcurrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	const (
+		numEngines    = 4
+		numGoroutines = 8
+		numBlobs      = 32
+	)
+
+	// Every goroutine writes the same set of blobs, so that blobs with the
+	// same digest are being written concurrently.
+	var blobs [][]byte
+	for i := 0; i < numBlobs; i++ {
+		blobs = append(blobs, bytes.Repeat([]byte(fmt.Sprintf("blob %d\n", i)), 4096*i))
+	}
+
+	var engines []cas.Engine
+	for i := 0; i < numEngines; i++ {
+		engine, err := Open(image)
+		if err != nil {
+			t.Fatalf("unexpected error opening image: %+v", err)
+		}
+		defer engine.Close()
+		engines = append(engines, engine)
+	}
+
+	var wg sync.WaitGroup
+	errCh := make(chan error, numEngines*numGoroutines+1)
+	for _, engine := range engines {
+		for i := 0; i < numGoroutines; i++ {
+			wg.Add(1)
+			go func(engine cas.Engine) {
+				defer wg.Done()
+				for _, blob := range blobs {
+					if _, _, err := engine.PutBlob(ctx, bytes.NewReader(blob)); err != nil {
+						errCh <- errors.Wrap(err, "PutBlob")
+						return
+					}
+				}
+			}(engine)
+		}
+	}
+	// Clean must not interfere with concurrent writers.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 16; i++ {
+			if err := engines[0].Clean(ctx); err != nil {
+				errCh <- errors.Wrap(err, "Clean")
+				return
+			}
+		}
+	}()
+	wg.Wait()
+	close(errCh)
+	for err := range errCh {
+		t.Errorf("unexpected error: %+v", err)
+	}
+
+	// Make sure all of the blobs are intact.
+	listed, err := engines[0].ListBlobs(ctx)
+	if err != nil {
+		t.Fatalf("ListBlobs: unexpected error: %+v", err)
+	}
+	if len(listed) != numBlobs {
+		t.Errorf("ListBlobs: expected %d blobs, got %d: %v", numBlobs, len(listed), listed)
+	}
+	for _, blob := range blobs {
+		digester := cas.BlobAlgorithm.Digester()
+		if _, err := io.Copy(digester.Hash(), bytes.NewReader(blob)); err != nil {
+			t.Fatalf("could not hash bytes: %+v", err)
+		}
+
+		reader, err := engines[0].GetBlob(ctx, digester.Digest())
+		if err != nil {
+			t.Errorf("GetBlob: unexpected error: %+v", err)
+			continue
+		}
+		gotBytes, err := ioutil.ReadAll(reader)
+		if err != nil {
+			t.Errorf("GetBlob: failed to ReadAll: %+v", err)
+		}
+		if err := reader.Close(); err != nil {
+			t.Errorf("GetBlob: unexpected error verifying blob: %+v", err)
+		}
+		if !bytes.Equal(blob, gotBytes) {
+			t.Errorf("GetBlob: bytes did not match for %s: expected %d bytes, got %d bytes", digester.Digest(), len(blob), len(gotBytes))
+		}
+	}
+}
+
+// failingReader returns some data and then fails.
+type failingReader struct {
+	data []byte
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, errors.New("read failed")
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestEnginePutBlobFailure(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEnginePutBlobFailure")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+	engine, err := Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	defer engine.Close()
+
+	if _, _, err := engine.PutBlob(ctx, &failingReader{data: bytes.Repeat([]byte("partial blob\n"), 4096)}); err == nil {
+		t.Fatalf("expected PutBlob with failing reader to fail")
+	}
+
+	// The partially-written blob must not be left behind, either as a blob or
+	// in the temporary directory.
+	blobs, err := engine.ListBlobs(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error listing blobs: %+v", err)
+	}
+	if len(blobs) != 0 {
+		t.Errorf("expected no blobs after failed PutBlob, got %v", blobs)
+	}
+	tempDir := engine.(*dirEngine).temp
+	if tempDir == "" {
+		t.Fatalf("expected PutBlob to have created a temporary directory")
+	}
+	entries, err := ioutil.ReadDir(tempDir)
+	if err != nil {
+		t.Fatalf("unexpected error reading temporary directory: %+v", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("expected no partially-written blobs in temporary directory, got %d entries", len(entries))
+	}
+}
@@ -0,0 +1,251 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dir
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/apex/log"
+	imeta "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/cas"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// refsDirectory is the directory used by pre-1.0 versions of the OCI image
+// layout to store references (each file is a JSON descriptor named after the
+// reference). It was replaced by the manifests list of the index.
+const refsDirectory = "refs"
+
+// Migrate upgrades an outdated OCI image layout at the given path to the
+// current layout version (ImageLayoutVersion), so that it can be used with
+// Open. In particular, this will:
+//
+//   - Create (or fill in the version of) the "oci-layout" file if it is
+//     missing.
+//   - Create the blob directories if they are missing.
+//   - Convert the pre-1.0 "refs" directory into entries in the index (creating
+//     the index if it is missing), using the ispec.AnnotationRefName
+//     annotation for the reference names.
+//
+// The returned bool indicates whether any changes were made to the layout.
+// Layouts which already have an "oci-layout" with an unknown version are not
+// modified, since they may use an incompatible layout. The "oci-layout" file
+// is only updated once everything else has been migrated, so an interrupted
+// migration will not result in a layout which appears to be up-to-date (and
+// Migrate can simply be re-run).
+func Migrate(path string) (_ bool, Err error) {
+	if fi, err := os.Stat(path); err != nil {
+		return false, errors.Wrap(err, "stat layout")
+	} else if !fi.IsDir() {
+		return false, errors.Wrap(cas.ErrInvalid, "layout is not a directory")
+	}
+
+	// Make sure that this actually looks like an image layout before we start
+	// creating files in it.
+	var isLayout bool
+	for _, name := range []string{layoutFile, blobDirectory, indexFile, refsDirectory} {
+		if _, err := os.Lstat(filepath.Join(path, name)); err == nil {
+			isLayout = true
+		} else if !os.IsNotExist(err) {
+			return false, errors.Wrapf(err, "check %s", name)
+		}
+	}
+	if !isLayout {
+		return false, errors.Wrap(cas.ErrInvalid, "path does not look like an OCI image layout")
+	}
+
+	var ociLayout ispec.ImageLayout
+	content, err := ioutil.ReadFile(filepath.Join(path, layoutFile))
+	if err == nil {
+		if err := json.Unmarshal(content, &ociLayout); err != nil {
+			return false, errors.Wrap(err, "parse oci-layout")
+		}
+	} else if !os.IsNotExist(err) {
+		return false, errors.Wrap(err, "read oci-layout")
+	}
+	switch ociLayout.Version {
+	case "", ImageLayoutVersion:
+	default:
+		return false, errors.Wrapf(cas.ErrInvalid, "cannot migrate unknown layout version %q", ociLayout.Version)
+	}
+
+	// Block other users of the image from modifying the index while we are
+	// migrating it.
+	engine := &dirEngine{path: path}
+	lockFh, err := engine.lock(unix.LOCK_EX)
+	if err != nil {
+		return false, errors.Wrap(err, "lock image")
+	}
+	defer lockFh.Close()
+
+	var changed bool
+	algoDir := filepath.Join(path, blobDirectory, cas.BlobAlgorithm.String())
+	if _, err := os.Stat(algoDir); os.IsNotExist(err) {
+		log.Infof("migrate: creating missing blob directory %s", cas.BlobAlgorithm)
+		if err := os.MkdirAll(algoDir, 0755); err != nil {
+			return changed, errors.Wrap(err, "mkdir blobdir")
+		}
+		changed = true
+	} else if err != nil {
+		return changed, errors.Wrap(err, "check blobdir")
+	}
+
+	indexChanged, err := migrateIndex(path)
+	if err != nil {
+		return changed, errors.Wrap(err, "migrate index")
+	}
+	changed = changed || indexChanged
+
+	if ociLayout.Version != ImageLayoutVersion {
+		log.Infof("migrate: setting layout version to %s", ImageLayoutVersion)
+		if err := writeJSONAtomic(path, layoutFile, ispec.ImageLayout{Version: ImageLayoutVersion}); err != nil {
+			return changed, errors.Wrap(err, "write oci-layout")
+		}
+		changed = true
+	}
+	return changed, nil
+}
+
+// migrateIndex creates the index of the layout at path if it is missing, and
+// moves any references from a pre-1.0 "refs" directory into it.
+func migrateIndex(path string) (bool, error) {
+	var (
+		index   ispec.Index
+		changed bool
+	)
+	content, err := ioutil.ReadFile(filepath.Join(path, indexFile))
+	if err == nil {
+		if err := json.Unmarshal(content, &index); err != nil {
+			return false, errors.Wrap(err, "parse index")
+		}
+	} else if os.IsNotExist(err) {
+		log.Infof("migrate: creating missing %s", indexFile)
+		changed = true
+	} else {
+		return false, errors.Wrap(err, "read index")
+	}
+
+	if index.SchemaVersion == 0 {
+		index.Versioned = imeta.Versioned{
+			SchemaVersion: 2, // FIXME: This is hardcoded at the moment.
+		}
+		changed = true
+	}
+	if index.MediaType == "" {
+		index.MediaType = ispec.MediaTypeImageIndex
+		changed = true
+	}
+
+	refsDir := filepath.Join(path, refsDirectory)
+	refs, err := ioutil.ReadDir(refsDir)
+	haveRefs := err == nil
+	if err != nil && !os.IsNotExist(err) {
+		return false, errors.Wrap(err, "read refs")
+	}
+	existing := map[string]ispec.Descriptor{}
+	for _, descriptor := range index.Manifests {
+		if name, ok := descriptor.Annotations[ispec.AnnotationRefName]; ok {
+			existing[name] = descriptor
+		}
+	}
+	for _, ref := range refs {
+		name := ref.Name()
+		if !ref.Mode().IsRegular() {
+			return false, errors.Wrapf(cas.ErrInvalid, "reference %q in refs is not a regular file", name)
+		}
+		content, err := ioutil.ReadFile(filepath.Join(refsDir, name))
+		if err != nil {
+			return false, errors.Wrapf(err, "read reference %q", name)
+		}
+		var descriptor ispec.Descriptor
+		if err := json.Unmarshal(content, &descriptor); err != nil {
+			return false, errors.Wrapf(err, "parse reference %q", name)
+		}
+		if err := descriptor.Digest.Validate(); err != nil {
+			return false, errors.Wrapf(err, "reference %q has invalid digest", name)
+		}
+		if old, ok := existing[name]; ok {
+			if old.Digest != descriptor.Digest {
+				return false, errors.Errorf("reference %q in refs (%s) conflicts with the index (%s)", name, descriptor.Digest, old.Digest)
+			}
+			continue
+		}
+
+		log.Infof("migrate: moving reference %q from refs to %s", name, indexFile)
+		if descriptor.Annotations == nil {
+			descriptor.Annotations = map[string]string{}
+		}
+		descriptor.Annotations[ispec.AnnotationRefName] = name
+		index.Manifests = append(index.Manifests, descriptor)
+		existing[name] = descriptor
+		changed = true
+	}
+
+	if changed {
+		if err := writeJSONAtomic(path, indexFile, index); err != nil {
+			return false, errors.Wrap(err, "write index")
+		}
+	}
+	// Only remove the old references once they are in the index.
+	if haveRefs {
+		log.Infof("migrate: removing old refs directory")
+		if err := os.RemoveAll(refsDir); err != nil {
+			return changed, errors.Wrap(err, "remove refs")
+		}
+		changed = true
+	}
+	return changed, nil
+}
+
+// writeJSONAtomic encodes value as JSON and atomically replaces the given file
+// inside the layout at path with it.
+func writeJSONAtomic(path, name string, value interface{}) (Err error) {
+	// Use the same prefix as our temporary directories, so that Clean will
+	// remove the file if we crash before renaming it.
+	fh, err := ioutil.TempFile(path, ".umoci-migrate-")
+	if err != nil {
+		return errors.Wrap(err, "create temporary file")
+	}
+	tempPath := fh.Name()
+	defer fh.Close()
+	defer func() {
+		if Err != nil {
+			// #nosec G104
+			_ = os.Remove(tempPath)
+		}
+	}()
+
+	if err := json.NewEncoder(fh).Encode(value); err != nil {
+		return errors.Wrap(err, "encode temporary file")
+	}
+	if err := fh.Chmod(0644); err != nil {
+		return errors.Wrap(err, "chmod temporary file")
+	}
+	if err := fh.Sync(); err != nil {
+		return errors.Wrap(err, "sync temporary file")
+	}
+	if err := fh.Close(); err != nil {
+		return errors.Wrap(err, "close temporary file")
+	}
+	return errors.Wrap(os.Rename(tempPath, filepath.Join(path, name)), "rename temporary file")
+}
@@ -0,0 +1,213 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dir
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/cas"
+	"github.com/pkg/errors"
+)
+
+// createOldLayout creates an image layout in the pre-1.0 style (no oci-layout
+// or index.json, with the given references in a refs directory).
+func createOldLayout(t *testing.T, image string, refs map[string]ispec.Descriptor) {
+	if err := Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+	for _, name := range []string{layoutFile, indexFile} {
+		if err := os.Remove(filepath.Join(image, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(image, refsDirectory), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, descriptor := range refs {
+		data, err := json.Marshal(descriptor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(image, refsDirectory, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestMigrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	refs := map[string]ispec.Descriptor{
+		"latest": {
+			MediaType: ispec.MediaTypeImageManifest,
+			Digest:    digest.FromString("latest"),
+			Size:      6,
+		},
+		"v1.0": {
+			MediaType: ispec.MediaTypeImageManifest,
+			Digest:    digest.FromString("v1.0"),
+			Size:      4,
+		},
+	}
+	createOldLayout(t, image, refs)
+
+	if _, err := Open(image); errors.Cause(err) != cas.ErrInvalid {
+		t.Fatalf("expected ErrInvalid opening old layout: %+v", err)
+	}
+
+	changed, err := Migrate(image)
+	if err != nil {
+		t.Fatalf("unexpected error migrating image: %+v", err)
+	}
+	if !changed {
+		t.Errorf("expected migration of old layout to make changes")
+	}
+	if _, err := os.Stat(filepath.Join(image, refsDirectory)); !os.IsNotExist(err) {
+		t.Errorf("expected refs to be removed after migration: %v", err)
+	}
+
+	engine, err := Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening migrated image: %+v", err)
+	}
+	defer engine.Close()
+
+	index, err := engine.GetIndex(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error getting index: %+v", err)
+	}
+	if index.SchemaVersion != 2 {
+		t.Errorf("expected schemaVersion 2 in migrated index, got %d", index.SchemaVersion)
+	}
+	if len(index.Manifests) != len(refs) {
+		t.Fatalf("expected %d manifests in migrated index, got %d", len(refs), len(index.Manifests))
+	}
+	for _, descriptor := range index.Manifests {
+		name := descriptor.Annotations[ispec.AnnotationRefName]
+		ref, ok := refs[name]
+		if !ok {
+			t.Errorf("unexpected reference %q in migrated index", name)
+			continue
+		}
+		if descriptor.Digest != ref.Digest || descriptor.Size != ref.Size || descriptor.MediaType != ref.MediaType {
+			t.Errorf("migrated reference %q doesn't match: expected %v, got %v", name, ref, descriptor)
+		}
+	}
+
+	// Migrating again should be a no-op.
+	if changed, err := Migrate(image); err != nil {
+		t.Errorf("unexpected error migrating already-migrated image: %+v", err)
+	} else if changed {
+		t.Errorf("expected migration of up-to-date image to make no changes")
+	}
+}
+
+func TestMigrateConflict(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestMigrateConflict")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	createOldLayout(t, image, map[string]ispec.Descriptor{
+		"latest": {
+			MediaType: ispec.MediaTypeImageManifest,
+			Digest:    digest.FromString("refs"),
+			Size:      4,
+		},
+	})
+
+	// An index with a different "latest" reference.
+	data, err := json.Marshal(ispec.Index{
+		Manifests: []ispec.Descriptor{{
+			MediaType: ispec.MediaTypeImageManifest,
+			Digest:    digest.FromString("index"),
+			Size:      5,
+			Annotations: map[string]string{
+				ispec.AnnotationRefName: "latest",
+			},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(image, indexFile), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Migrate(image); err == nil {
+		t.Errorf("expected migration with conflicting references to fail")
+	}
+	// Nothing should have been changed.
+	if _, err := os.Stat(filepath.Join(image, refsDirectory, "latest")); err != nil {
+		t.Errorf("refs should not be removed after failed migration: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(image, layoutFile)); !os.IsNotExist(err) {
+		t.Errorf("oci-layout should not be created by failed migration: %v", err)
+	}
+}
+
+func TestMigrateInvalid(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestMigrateInvalid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	// An empty directory is not an image layout.
+	empty := filepath.Join(root, "empty")
+	if err := os.Mkdir(empty, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Migrate(empty); errors.Cause(err) != cas.ErrInvalid {
+		t.Errorf("expected ErrInvalid migrating empty directory: %+v", err)
+	}
+	if _, err := os.Stat(filepath.Join(empty, layoutFile)); !os.IsNotExist(err) {
+		t.Errorf("migrating empty directory should not create oci-layout: %v", err)
+	}
+
+	// Unknown layout versions cannot be migrated.
+	image := filepath.Join(root, "image")
+	if err := Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(image, layoutFile), []byte(`{"imageLayoutVersion": "9.9.9"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(image); errors.Cause(err) != cas.ErrInvalid {
+		t.Errorf("expected ErrInvalid opening image with unknown version: %+v", err)
+	}
+	if _, err := Migrate(image); errors.Cause(err) != cas.ErrInvalid {
+		t.Errorf("expected ErrInvalid migrating image with unknown version: %+v", err)
+	}
+}
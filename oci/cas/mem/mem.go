@@ -0,0 +1,250 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package mem provides an implementation of cas.Engine which stores all blobs
+// and the index in memory. It is intended for use in tests and for ephemeral
+// pipelines where an on-disk image layout is not necessary.
+package mem
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/opencontainers/go-digest"
+	imeta "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/cas"
+	"github.com/opencontainers/umoci/pkg/hardening"
+	"github.com/opencontainers/umoci/pkg/system"
+	"github.com/pkg/errors"
+)
+
+// ErrClosed is returned by all operations on an engine after it has been
+// closed.
+var ErrClosed = errors.New("in-memory engine has been closed")
+
+type memEngine struct {
+	// lock protects all of the following fields.
+	lock sync.RWMutex
+
+	// blobs is the set of blobs stored in the engine.
+	blobs map[digest.Digest][]byte
+
+	// index is the JSON encoding of the current index. We store it encoded so
+	// that callers cannot modify the stored index through any of the slices
+	// or maps contained in the ispec.Index they gave us.
+	index []byte
+
+	// closed indicates whether Close has been called.
+	closed bool
+}
+
+// New creates a new empty in-memory OCI image, with an empty index.
+func New() cas.Engine {
+	engine := &memEngine{
+		blobs: map[digest.Digest][]byte{},
+	}
+	// This cannot fail.
+	_ = engine.setIndex(ispec.Index{
+		Versioned: imeta.Versioned{
+			SchemaVersion: 2, // FIXME: This is hardcoded at the moment.
+		},
+		MediaType: ispec.MediaTypeImageIndex,
+	})
+	return engine
+}
+
+// setIndex is the lock-free implementation of PutIndex.
+func (e *memEngine) setIndex(index ispec.Index) error {
+	data, err := json.Marshal(index)
+	if err != nil {
+		return errors.Wrap(err, "encode index")
+	}
+	e.index = data
+	return nil
+}
+
+// PutBlob adds a new blob to the image. This is idempotent; a nil error
+// means that "the content is stored at DIGEST" without implying "because
+// of this PutBlob() call".
+func (e *memEngine) PutBlob(ctx context.Context, reader io.Reader) (digest.Digest, int64, error) {
+	// Read the blob outside of the lock, since reader might be slow.
+	digester := cas.BlobAlgorithm.Digester()
+	var buffer bytes.Buffer
+	size, err := system.Copy(io.MultiWriter(&buffer, digester.Hash()), reader)
+	if err != nil {
+		return "", -1, errors.Wrap(err, "copy blob")
+	}
+	blobDigest := digester.Digest()
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if e.closed {
+		return "", -1, ErrClosed
+	}
+	if _, ok := e.blobs[blobDigest]; !ok {
+		e.blobs[blobDigest] = buffer.Bytes()
+	}
+	return blobDigest, size, nil
+}
+
+// GetBlob returns a reader for retrieving a blob from the image, which the
+// caller must Close(). Returns ErrNotExist if the digest is not found.
+//
+// This function will return a VerifiedReadCloser, meaning that you must call
+// Close() and check the error returned from Close() in order to ensure that
+// the hash of the blob is verified.
+func (e *memEngine) GetBlob(ctx context.Context, digest digest.Digest) (io.ReadCloser, error) {
+	if err := digest.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid digest: %q", digest)
+	}
+
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+
+	if e.closed {
+		return nil, ErrClosed
+	}
+	data, ok := e.blobs[digest]
+	if !ok {
+		return nil, errors.Wrapf(cas.ErrNotExist, "get blob %s", digest)
+	}
+	// Blobs are never modified once stored, so we can safely share data.
+	return &hardening.VerifiedReadCloser{
+		Reader:         ioutil.NopCloser(bytes.NewReader(data)),
+		ExpectedDigest: digest,
+		ExpectedSize:   int64(len(data)),
+	}, nil
+}
+
+// StatBlob returns whether the specified blob exists in the image. Returns
+// false if the blob doesn't exist, true if it does, or an error if any error
+// occurred.
+func (e *memEngine) StatBlob(ctx context.Context, digest digest.Digest) (bool, error) {
+	if err := digest.Validate(); err != nil {
+		return false, errors.Wrapf(err, "invalid digest: %q", digest)
+	}
+
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+
+	if e.closed {
+		return false, ErrClosed
+	}
+	_, ok := e.blobs[digest]
+	return ok, nil
+}
+
+// PutIndex sets the index of the OCI image to the given index, replacing the
+// previously existing index. This operation is atomic; any readers attempting
+// to access the OCI image while it is being modified will only ever see the
+// new or old index.
+func (e *memEngine) PutIndex(ctx context.Context, index ispec.Index) error {
+	// Make sure the index has the mediatype field set.
+	index.MediaType = ispec.MediaTypeImageIndex
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if e.closed {
+		return ErrClosed
+	}
+	return e.setIndex(index)
+}
+
+// GetIndex returns the index of the OCI image.
+//
+// It is not recommended that users of cas.Engine use this interface directly,
+// due to the complication of properly handling references as well as correctly
+// handling nested indexes. casext.Engine provides a wrapper for cas.Engine
+// that implements various reference resolution functions that should work for
+// most users.
+func (e *memEngine) GetIndex(ctx context.Context) (ispec.Index, error) {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+
+	if e.closed {
+		return ispec.Index{}, ErrClosed
+	}
+	var index ispec.Index
+	if err := json.Unmarshal(e.index, &index); err != nil {
+		return ispec.Index{}, errors.Wrap(err, "parse index")
+	}
+	return index, nil
+}
+
+// DeleteBlob removes a blob from the image. This is idempotent; a nil
+// error means "the content is not in the store" without implying "because
+// of this DeleteBlob() call".
+func (e *memEngine) DeleteBlob(ctx context.Context, digest digest.Digest) error {
+	if err := digest.Validate(); err != nil {
+		return errors.Wrapf(err, "invalid digest: %q", digest)
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if e.closed {
+		return ErrClosed
+	}
+	delete(e.blobs, digest)
+	return nil
+}
+
+// ListBlobs returns the set of blob digests stored in the image.
+func (e *memEngine) ListBlobs(ctx context.Context) ([]digest.Digest, error) {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+
+	if e.closed {
+		return nil, ErrClosed
+	}
+	digests := []digest.Digest{}
+	for digest := range e.blobs {
+		digests = append(digests, digest)
+	}
+	return digests, nil
+}
+
+// Clean executes a garbage collection of any non-blob garbage in the store.
+// The in-memory engine never has any such garbage, so this is a no-op.
+func (e *memEngine) Clean(ctx context.Context) error {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+
+	if e.closed {
+		return ErrClosed
+	}
+	return nil
+}
+
+// Close releases all references held by the engine. All of the stored data is
+// discarded, and subsequent operations will fail with ErrClosed.
+func (e *memEngine) Close() error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	e.closed = true
+	e.blobs = nil
+	e.index = nil
+	return nil
+}
@@ -0,0 +1,284 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mem
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/cas"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/pkg/errors"
+)
+
+func TestEngineBlob(t *testing.T) {
+	ctx := context.Background()
+
+	engine := New()
+	defer engine.Close()
+
+	for _, test := range []struct {
+		bytes []byte
+	}{
+		{[]byte("")},
+		{[]byte("some blob")},
+		{[]byte("another blob")},
+	} {
+		digester := cas.BlobAlgorithm.Digester()
+		if _, err := io.Copy(digester.Hash(), bytes.NewReader(test.bytes)); err != nil {
+			t.Fatalf("could not hash bytes: %+v", err)
+		}
+		expectedDigest := digester.Digest()
+
+		digest, size, err := engine.PutBlob(ctx, bytes.NewReader(test.bytes))
+		if err != nil {
+			t.Errorf("PutBlob: unexpected error: %+v", err)
+		}
+
+		if digest != expectedDigest {
+			t.Errorf("PutBlob: digest doesn't match: expected=%s got=%s", expectedDigest, digest)
+		}
+		if size != int64(len(test.bytes)) {
+			t.Errorf("PutBlob: length doesn't match: expected=%d got=%d", len(test.bytes), size)
+		}
+
+		if exists, err := engine.StatBlob(ctx, digest); err != nil {
+			t.Errorf("StatBlob: unexpected error: %+v", err)
+		} else if !exists {
+			t.Errorf("StatBlob: blob doesn't exist after PutBlob")
+		}
+
+		blobReader, err := engine.GetBlob(ctx, digest)
+		if err != nil {
+			t.Fatalf("GetBlob: unexpected error: %+v", err)
+		}
+
+		gotBytes, err := ioutil.ReadAll(blobReader)
+		if err != nil {
+			t.Errorf("GetBlob: failed to ReadAll: %+v", err)
+		}
+		if err := blobReader.Close(); err != nil {
+			t.Errorf("GetBlob: failed to Close: %+v", err)
+		}
+		if !bytes.Equal(test.bytes, gotBytes) {
+			t.Errorf("GetBlob: bytes did not match: expected=%s got=%s", string(test.bytes), string(gotBytes))
+		}
+
+		if err := engine.DeleteBlob(ctx, digest); err != nil {
+			t.Errorf("DeleteBlob: unexpected error: %+v", err)
+		}
+
+		if br, err := engine.GetBlob(ctx, digest); errors.Cause(err) != cas.ErrNotExist {
+			if err == nil {
+				br.Close()
+				t.Errorf("GetBlob: still got blob contents after DeleteBlob!")
+			} else {
+				t.Errorf("GetBlob: unexpected error: %+v", err)
+			}
+		}
+		if exists, err := engine.StatBlob(ctx, digest); err != nil {
+			t.Errorf("StatBlob: unexpected error: %+v", err)
+		} else if exists {
+			t.Errorf("StatBlob: blob still exists after DeleteBlob")
+		}
+
+		// DeleteBlob is idempotent. It shouldn't cause an error.
+		if err := engine.DeleteBlob(ctx, digest); err != nil {
+			t.Errorf("DeleteBlob: unexpected error on double-delete: %+v", err)
+		}
+	}
+
+	// Should be no blobs left.
+	if blobs, err := engine.ListBlobs(ctx); err != nil {
+		t.Errorf("unexpected error getting list of blobs: %+v", err)
+	} else if len(blobs) > 0 {
+		t.Errorf("got blobs in a clean image: %v", blobs)
+	}
+}
+
+func TestEngineIndex(t *testing.T) {
+	ctx := context.Background()
+
+	engine := New()
+	defer engine.Close()
+
+	index, err := engine.GetIndex(ctx)
+	if err != nil {
+		t.Fatalf("GetIndex: unexpected error: %+v", err)
+	}
+	if index.SchemaVersion != 2 || index.MediaType != ispec.MediaTypeImageIndex || len(index.Manifests) != 0 {
+		t.Errorf("GetIndex: new engine has an unexpected index: %#v", index)
+	}
+
+	index.Manifests = append(index.Manifests, ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    digest.FromString("manifest"),
+		Size:      8,
+		Annotations: map[string]string{
+			ispec.AnnotationRefName: "latest",
+		},
+	})
+	if err := engine.PutIndex(ctx, index); err != nil {
+		t.Fatalf("PutIndex: unexpected error: %+v", err)
+	}
+
+	// Modifying our copy of the index must not modify the stored index.
+	index.Manifests[0].Annotations[ispec.AnnotationRefName] = "modified"
+
+	gotIndex, err := engine.GetIndex(ctx)
+	if err != nil {
+		t.Fatalf("GetIndex: unexpected error: %+v", err)
+	}
+	if len(gotIndex.Manifests) != 1 {
+		t.Fatalf("GetIndex: unexpected number of manifests: %d", len(gotIndex.Manifests))
+	}
+	if name := gotIndex.Manifests[0].Annotations[ispec.AnnotationRefName]; name != "latest" {
+		t.Errorf("GetIndex: stored index was modified: got ref.name %q", name)
+	}
+}
+
+func TestEngineClose(t *testing.T) {
+	ctx := context.Background()
+
+	engine := New()
+	if _, _, err := engine.PutBlob(ctx, bytes.NewBufferString("blob")); err != nil {
+		t.Fatalf("PutBlob: unexpected error: %+v", err)
+	}
+	if err := engine.Close(); err != nil {
+		t.Fatalf("Close: unexpected error: %+v", err)
+	}
+
+	if _, _, err := engine.PutBlob(ctx, bytes.NewBufferString("blob")); errors.Cause(err) != ErrClosed {
+		t.Errorf("PutBlob: expected ErrClosed after Close: %+v", err)
+	}
+	if _, err := engine.ListBlobs(ctx); errors.Cause(err) != ErrClosed {
+		t.Errorf("ListBlobs: expected ErrClosed after Close: %+v", err)
+	}
+	if _, err := engine.GetIndex(ctx); errors.Cause(err) != ErrClosed {
+		t.Errorf("GetIndex: expected ErrClosed after Close: %+v", err)
+	}
+}
+
+func TestEngineConcurrent(t *testing.T) {
+	ctx := context.Background()
+
+	engine := New()
+	defer engine.Close()
+
+	const numWorkers = 16
+
+	var wg sync.WaitGroup
+	errCh := make(chan error, numWorkers)
+	for i := 0; i < numWorkers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			content := fmt.Sprintf("blob %d", i)
+			digest, _, err := engine.PutBlob(ctx, bytes.NewBufferString(content))
+			if err != nil {
+				errCh <- err
+				return
+			}
+			// Everyone also writes the same shared blob.
+			if _, _, err := engine.PutBlob(ctx, bytes.NewBufferString("shared")); err != nil {
+				errCh <- err
+				return
+			}
+			rdr, err := engine.GetBlob(ctx, digest)
+			if err != nil {
+				errCh <- err
+				return
+			}
+			defer rdr.Close()
+			data, err := ioutil.ReadAll(rdr)
+			if err != nil {
+				errCh <- err
+				return
+			}
+			if string(data) != content {
+				errCh <- errors.Errorf("blob %d has wrong contents: %q", i, string(data))
+			}
+			if _, err := engine.GetIndex(ctx); err != nil {
+				errCh <- err
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errCh)
+
+	for err := range errCh {
+		t.Errorf("concurrent operation failed: %+v", err)
+	}
+
+	if blobs, err := engine.ListBlobs(ctx); err != nil {
+		t.Errorf("ListBlobs: unexpected error: %+v", err)
+	} else if len(blobs) != numWorkers+1 {
+		t.Errorf("ListBlobs: expected %d blobs, got %d", numWorkers+1, len(blobs))
+	}
+}
+
+func TestEngineCasext(t *testing.T) {
+	ctx := context.Background()
+
+	engine := casext.NewEngine(New())
+	defer engine.Close()
+
+	configDigest, configSize, err := engine.PutBlobJSON(ctx, ispec.Image{OS: "linux"})
+	if err != nil {
+		t.Fatalf("PutBlobJSON: unexpected error: %+v", err)
+	}
+	manifestDigest, manifestSize, err := engine.PutBlobJSON(ctx, ispec.Manifest{
+		MediaType: ispec.MediaTypeImageManifest,
+		Config: ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageConfig,
+			Digest:    configDigest,
+			Size:      configSize,
+		},
+		Layers: []ispec.Descriptor{},
+	})
+	if err != nil {
+		t.Fatalf("PutBlobJSON: unexpected error: %+v", err)
+	}
+	manifestDescriptor := ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    manifestDigest,
+		Size:      manifestSize,
+	}
+
+	if err := engine.UpdateReference(ctx, "latest", manifestDescriptor); err != nil {
+		t.Fatalf("UpdateReference: unexpected error: %+v", err)
+	}
+
+	descriptorPaths, err := engine.ResolveReference(ctx, "latest")
+	if err != nil {
+		t.Fatalf("ResolveReference: unexpected error: %+v", err)
+	}
+	if len(descriptorPaths) != 1 {
+		t.Fatalf("ResolveReference: expected one result, got %d", len(descriptorPaths))
+	}
+	if got := descriptorPaths[0].Descriptor().Digest; got != manifestDigest {
+		t.Errorf("ResolveReference: got the wrong descriptor: expected=%s got=%s", manifestDigest, got)
+	}
+}
@@ -18,12 +18,16 @@
 package casext
 
 import (
+	"bytes"
 	"context"
 	"io"
 	"io/ioutil"
 
+	"github.com/opencontainers/go-digest"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/cas"
 	"github.com/opencontainers/umoci/oci/casext/mediatype"
+	"github.com/opencontainers/umoci/pkg/hardening"
 	"github.com/opencontainers/umoci/pkg/system"
 	"github.com/pkg/errors"
 )
@@ -46,6 +50,8 @@ type Blob struct {
 	// ispec.MediaTypeImageLayerGzip => io.ReadCloser
 	// ispec.MediaTypeImageLayerNonDistributable => io.ReadCloser
 	// ispec.MediaTypeImageLayerNonDistributableGzip => io.ReadCloser
+	// mediatype.MediaTypeImageLayerZstd => io.ReadCloser
+	// mediatype.MediaTypeImageLayerNonDistributableZstd => io.ReadCloser
 	// ispec.MediaTypeImageConfig => ispec.Image
 	// unknown => io.ReadCloser
 	Data interface{}
@@ -61,6 +67,13 @@ func (b *Blob) Close() error {
 
 // FromDescriptor parses the blob referenced by the given descriptor.
 func (e Engine) FromDescriptor(ctx context.Context, descriptor ispec.Descriptor) (_ *Blob, Err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if fn := mediatype.GetParser(descriptor.MediaType); fn != nil && e.cache != nil {
+		return e.fromDescriptorCached(ctx, descriptor, fn)
+	}
+
 	reader, err := e.GetVerifiedBlob(ctx, descriptor)
 	if err != nil {
 		return nil, errors.Wrap(err, "get blob")
@@ -74,10 +87,10 @@ func (e Engine) FromDescriptor(ctx context.Context, descriptor ispec.Descriptor)
 	if fn := mediatype.GetParser(descriptor.MediaType); fn != nil {
 		defer func() {
 			if _, err := system.Copy(ioutil.Discard, reader); Err == nil {
-				Err = errors.Wrapf(err, "discard trailing %q blob", descriptor.MediaType)
+				Err = errors.Wrapf(err, "discard trailing %q blob %s", descriptor.MediaType, descriptor.Digest)
 			}
 			if err := reader.Close(); Err == nil {
-				Err = errors.Wrapf(err, "close %q blob", descriptor.MediaType)
+				Err = errors.Wrapf(err, "close %q blob %s", descriptor.MediaType, descriptor.Digest)
 			}
 		}()
 
@@ -92,3 +105,77 @@ func (e Engine) FromDescriptor(ctx context.Context, descriptor ispec.Descriptor)
 	}
 	return &blob, nil
 }
+
+// fromDescriptorCached is FromDescriptor for parseable blobs when the blob
+// cache is enabled. The verified contents of the blob are cached, and are
+// re-parsed on each call so that callers get their own copy of the blob.
+func (e Engine) fromDescriptorCached(ctx context.Context, descriptor ispec.Descriptor, fn mediatype.ParseFunc) (*Blob, error) {
+	key := blobCacheKey{
+		digest:    descriptor.Digest,
+		mediaType: descriptor.MediaType,
+		size:      descriptor.Size,
+	}
+	raw, ok := e.cache.get(key)
+	if !ok {
+		reader, err := e.GetVerifiedBlob(ctx, descriptor)
+		if err != nil {
+			return nil, errors.Wrap(err, "get blob")
+		}
+		raw, err = ioutil.ReadAll(reader)
+		if err != nil {
+			// #nosec G104
+			_ = reader.Close()
+			return nil, errors.Wrapf(err, "read %q blob %s", descriptor.MediaType, descriptor.Digest)
+		}
+		// The blob is only verified once it has been closed.
+		if err := reader.Close(); err != nil {
+			return nil, errors.Wrapf(err, "close %q blob %s", descriptor.MediaType, descriptor.Digest)
+		}
+		e.cache.put(key, raw)
+	}
+
+	data, err := fn(bytes.NewReader(raw))
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse %s", descriptor.MediaType)
+	}
+	if data == nil {
+		return nil, errors.Errorf("[internal error] b.Data was nil after parsing")
+	}
+	return &Blob{
+		Descriptor: descriptor,
+		Data:       data,
+	}, nil
+}
+
+// BlobSize returns the size (in bytes) of the blob with the given digest. The
+// contents of the blob are not verified, so the size of a corrupted blob can
+// still be computed. If the engine implements cas.BlobSizer the blob is not
+// read at all, otherwise the blob is read in full in order to compute its
+// size.
+func (e Engine) BlobSize(ctx context.Context, digest digest.Digest) (_ int64, Err error) {
+	if sizer, ok := e.Engine.(cas.BlobSizer); ok {
+		return sizer.BlobSize(ctx, digest)
+	}
+
+	reader, err := e.GetBlob(ctx, digest)
+	if err != nil {
+		return -1, errors.Wrap(err, "get blob")
+	}
+	defer func() {
+		if err := reader.Close(); err != nil && Err == nil && !isVerificationError(err) {
+			Err = errors.Wrap(err, "close blob")
+		}
+	}()
+
+	size, err := system.Copy(ioutil.Discard, reader)
+	if err != nil && !isVerificationError(err) {
+		return -1, errors.Wrap(err, "read blob")
+	}
+	return size, nil
+}
+
+// isVerificationError returns whether err is caused by the contents of a blob
+// not matching its digest or size.
+func isVerificationError(err error) bool {
+	return errors.Is(err, hardening.ErrDigestMismatch) || errors.Is(err, hardening.ErrSizeMismatch)
+}
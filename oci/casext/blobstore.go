@@ -0,0 +1,190 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/apex/log"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/umoci/oci/cas"
+	"github.com/opencontainers/umoci/pkg/hardening"
+	"github.com/pkg/errors"
+)
+
+// additionalBlobStoreEngine is a cas.Engine which falls back to reading blobs
+// from a list of read-only blob directories if they are not present in the
+// underlying cas.Engine.
+type additionalBlobStoreEngine struct {
+	cas.Engine
+
+	// stores is the list of additional blob directories, in the order they
+	// are searched.
+	stores []string
+}
+
+// WithAdditionalBlobStores returns a cas.Engine which acts like the given
+// cas.Engine, except that blobs which do not exist in it are looked up in each
+// of the given additional blob stores (in order). This allows for many images
+// to share common blobs (such as the layers of base images) without each image
+// needing its own copy.
+//
+// An additional blob store is a directory with the same structure as the
+// "blobs" directory of an OCI image layout (blobs are stored as
+// <algorithm>/<encoded>), so the "blobs" directory of an existing image can be
+// used directly. Additional blob stores are never modified -- new blobs are
+// always written to the underlying cas.Engine, and blobs which only exist in an
+// additional blob store are not included in ListBlobs (so they are not affected
+// by garbage collection). If no additional blob stores are given, engine is
+// returned as-is.
+func WithAdditionalBlobStores(engine cas.Engine, stores ...string) (cas.Engine, error) {
+	if len(stores) == 0 {
+		return engine, nil
+	}
+	for _, store := range stores {
+		fi, err := os.Stat(store)
+		if err != nil {
+			return nil, errors.Wrap(err, "open additional blob store")
+		}
+		if !fi.IsDir() {
+			return nil, errors.Errorf("additional blob store %s is not a directory", store)
+		}
+	}
+	return &additionalBlobStoreEngine{
+		Engine: engine,
+		stores: stores,
+	}, nil
+}
+
+// storeBlobPath returns the path of the given blob within a blob store.
+func storeBlobPath(store string, blobDigest digest.Digest) (string, error) {
+	if err := blobDigest.Validate(); err != nil {
+		return "", errors.Wrapf(err, "invalid digest: %q", blobDigest)
+	}
+	return filepath.Join(store, blobDigest.Algorithm().String(), blobDigest.Encoded()), nil
+}
+
+// GetBlob returns a reader for the blob with the given digest, from the
+// underlying cas.Engine or (if it isn't present there) from the first
+// additional blob store which contains it.
+func (e *additionalBlobStoreEngine) GetBlob(ctx context.Context, blobDigest digest.Digest) (io.ReadCloser, error) {
+	reader, err := e.Engine.GetBlob(ctx, blobDigest)
+	if err == nil || !IsNotExist(err) {
+		return reader, err
+	}
+	for _, store := range e.stores {
+		path, pathErr := storeBlobPath(store, blobDigest)
+		if pathErr != nil {
+			return nil, pathErr
+		}
+		fh, openErr := os.Open(path)
+		if os.IsNotExist(openErr) {
+			continue
+		} else if openErr != nil {
+			return nil, errors.Wrapf(openErr, "open blob in additional blob store %s", store)
+		}
+		log.Debugf("using blob %s from additional blob store %s", blobDigest, store)
+		return &hardening.VerifiedReadCloser{
+			Reader:         fh,
+			ExpectedDigest: blobDigest,
+			ExpectedSize:   int64(-1), // We don't know the expected size.
+		}, nil
+	}
+	return nil, err
+}
+
+// StatBlob returns whether the blob with the given digest exists, either in
+// the underlying cas.Engine or in any of the additional blob stores.
+func (e *additionalBlobStoreEngine) StatBlob(ctx context.Context, blobDigest digest.Digest) (bool, error) {
+	exists, err := e.Engine.StatBlob(ctx, blobDigest)
+	if err != nil || exists {
+		return exists, err
+	}
+	for _, store := range e.stores {
+		path, err := storeBlobPath(store, blobDigest)
+		if err != nil {
+			return false, err
+		}
+		_, err = os.Stat(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return false, errors.Wrapf(err, "stat blob in additional blob store %s", store)
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// LockIndex acquires the index lock of the underlying cas.Engine, if it
+// implements cas.IndexLocker.
+func (e *additionalBlobStoreEngine) LockIndex(ctx context.Context) (func() error, error) {
+	locker, ok := e.Engine.(cas.IndexLocker)
+	if !ok {
+		return func() error { return nil }, nil
+	}
+	return locker.LockIndex(ctx)
+}
+
+// BlobSize returns the size of the blob with the given digest, from the
+// underlying cas.Engine or (if it isn't present there) from the first
+// additional blob store which contains it. As with cas.BlobSizer, the blob is
+// not read if the underlying cas.Engine implements cas.BlobSizer.
+func (e *additionalBlobStoreEngine) BlobSize(ctx context.Context, blobDigest digest.Digest) (int64, error) {
+	size, err := NewEngine(e.Engine).BlobSize(ctx, blobDigest)
+	if err == nil || !IsNotExist(err) {
+		return size, err
+	}
+	for _, store := range e.stores {
+		path, pathErr := storeBlobPath(store, blobDigest)
+		if pathErr != nil {
+			return -1, pathErr
+		}
+		fi, statErr := os.Stat(path)
+		if os.IsNotExist(statErr) {
+			continue
+		} else if statErr != nil {
+			return -1, errors.Wrapf(statErr, "stat blob in additional blob store %s", store)
+		}
+		return fi.Size(), nil
+	}
+	return -1, err
+}
+
+// sharedBlobStore is implemented by cas.Engines which can also serve blobs
+// from read-only blob stores that are not part of the image (and so are not
+// included in ListBlobs).
+type sharedBlobStore interface {
+	// IsSharedBlob returns whether the blob with the given digest is only
+	// present in a read-only blob store.
+	IsSharedBlob(ctx context.Context, digest digest.Digest) (bool, error)
+}
+
+// IsSharedBlob returns whether the blob with the given digest is not present
+// in the underlying cas.Engine, but is present in one of the additional blob
+// stores.
+func (e *additionalBlobStoreEngine) IsSharedBlob(ctx context.Context, blobDigest digest.Digest) (bool, error) {
+	exists, err := e.Engine.StatBlob(ctx, blobDigest)
+	if err != nil || exists {
+		return false, err
+	}
+	return e.StatBlob(ctx, blobDigest)
+}
@@ -0,0 +1,192 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/cas"
+	"github.com/opencontainers/umoci/oci/cas/dir"
+)
+
+func TestAdditionalBlobStores(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestAdditionalBlobStores")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	// Create a "base" image which holds the shared blobs.
+	base := filepath.Join(root, "base")
+	if err := dir.Create(base); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+	baseEngine, err := dir.Open(base)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	defer baseEngine.Close()
+	sharedData := []byte("shared blob")
+	sharedDigest, sharedSize, err := baseEngine.PutBlob(ctx, bytes.NewReader(sharedData))
+	if err != nil {
+		t.Fatalf("put blob: %+v", err)
+	}
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+	imageEngine, err := dir.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	defer imageEngine.Close()
+
+	if engine, err := WithAdditionalBlobStores(imageEngine); err != nil || engine != imageEngine {
+		t.Errorf("expected engine to be returned as-is with no additional blob stores: %+v", err)
+	}
+
+	if _, err := WithAdditionalBlobStores(imageEngine, filepath.Join(root, "empty"), filepath.Join(base, "blobs")); err == nil {
+		t.Errorf("expected non-existent additional blob store to be rejected")
+	}
+	if err := os.Mkdir(filepath.Join(root, "empty"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	engine, err := WithAdditionalBlobStores(imageEngine, filepath.Join(root, "empty"), filepath.Join(base, "blobs"))
+	if err != nil {
+		t.Fatalf("unexpected error adding additional blob stores: %+v", err)
+	}
+	engineExt := NewEngine(engine)
+
+	// The shared blob is only in the additional blob store.
+	if exists, err := engineExt.StatBlob(ctx, sharedDigest); err != nil || !exists {
+		t.Errorf("expected shared blob to exist: exists=%v err=%+v", exists, err)
+	}
+	blob, err := engineExt.GetVerifiedBlob(ctx, ispec.Descriptor{
+		MediaType: "application/octet-stream",
+		Digest:    sharedDigest,
+		Size:      sharedSize,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error getting shared blob: %+v", err)
+	}
+	data, err := ioutil.ReadAll(blob)
+	if err != nil {
+		t.Errorf("unexpected error reading shared blob: %+v", err)
+	}
+	if err := blob.Close(); err != nil {
+		t.Errorf("unexpected error closing shared blob: %+v", err)
+	}
+	if !bytes.Equal(data, sharedData) {
+		t.Errorf("shared blob has wrong contents: expected %q got %q", sharedData, data)
+	}
+
+	// The size of shared blobs can be found without reading them.
+	sizer, ok := engine.(cas.BlobSizer)
+	if !ok {
+		t.Fatalf("expected additional blob store engine to implement cas.BlobSizer")
+	}
+	if size, err := sizer.BlobSize(ctx, sharedDigest); err != nil || size != sharedSize {
+		t.Errorf("expected shared blob to have size %d: size=%d err=%+v", sharedSize, size, err)
+	}
+	if shared, err := engine.(sharedBlobStore).IsSharedBlob(ctx, sharedDigest); err != nil || !shared {
+		t.Errorf("expected blob to be shared: shared=%v err=%+v", shared, err)
+	}
+
+	// Blobs in neither the image nor the additional blob stores still don't
+	// exist.
+	missingDigest := digest.FromString("missing blob")
+	if exists, err := engineExt.StatBlob(ctx, missingDigest); err != nil || exists {
+		t.Errorf("expected missing blob to not exist: exists=%v err=%+v", exists, err)
+	}
+	if _, err := engineExt.GetBlob(ctx, missingDigest); !IsNotExist(err) {
+		t.Errorf("expected missing blob to give a not-exist error: %+v", err)
+	}
+	if _, err := sizer.BlobSize(ctx, missingDigest); !IsNotExist(err) {
+		t.Errorf("expected missing blob size to give a not-exist error: %+v", err)
+	}
+
+	// New blobs are written to the image, and blobs in the additional blob
+	// stores are not listed (so they will never be garbage collected).
+	newDigest, _, err := engineExt.PutBlob(ctx, bytes.NewReader([]byte("new blob")))
+	if err != nil {
+		t.Fatalf("put blob: %+v", err)
+	}
+	if exists, err := imageEngine.StatBlob(ctx, newDigest); err != nil || !exists {
+		t.Errorf("expected new blob to be written to the image: exists=%v err=%+v", exists, err)
+	}
+	if size, err := sizer.BlobSize(ctx, newDigest); err != nil || size != int64(len("new blob")) {
+		t.Errorf("expected new blob to have size %d: size=%d err=%+v", len("new blob"), size, err)
+	}
+	if shared, err := engine.(sharedBlobStore).IsSharedBlob(ctx, newDigest); err != nil || shared {
+		t.Errorf("expected blob in the image to not be shared: shared=%v err=%+v", shared, err)
+	}
+	blobs, err := engineExt.ListBlobs(ctx)
+	if err != nil {
+		t.Fatalf("list blobs: %+v", err)
+	}
+	if len(blobs) != 1 || blobs[0] != newDigest {
+		t.Errorf("expected only the new blob to be listed, got %v", blobs)
+	}
+	if err := engineExt.GC(ctx); err != nil {
+		t.Fatalf("unexpected error during gc: %+v", err)
+	}
+	if exists, err := baseEngine.StatBlob(ctx, sharedDigest); err != nil || !exists {
+		t.Errorf("expected gc to not touch additional blob stores: exists=%v err=%+v", exists, err)
+	}
+
+	// Referencing a shared blob from the image works (including locking the
+	// index of the image).
+	if err := engineExt.UpdateReference(ctx, "shared", ispec.Descriptor{
+		MediaType: "application/octet-stream",
+		Digest:    sharedDigest,
+		Size:      sharedSize,
+	}); err != nil {
+		t.Fatalf("unexpected error updating reference: %+v", err)
+	}
+
+	// Blobs from additional blob stores are still verified.
+	sharedPath := filepath.Join(base, "blobs", sharedDigest.Algorithm().String(), sharedDigest.Encoded())
+	if err := os.Chmod(sharedPath, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(sharedPath, []byte("tampered blob"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	blob, err = engineExt.GetVerifiedBlob(ctx, ispec.Descriptor{
+		MediaType: "application/octet-stream",
+		Digest:    sharedDigest,
+		Size:      sharedSize,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error getting shared blob: %+v", err)
+	}
+	if _, err := ioutil.ReadAll(blob); err == nil {
+		t.Errorf("expected tampered shared blob to fail verification")
+	}
+	blob.Close()
+}
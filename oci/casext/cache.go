@@ -0,0 +1,116 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// DefaultBlobCacheSize is the default maximum size (in bytes) of a blob cache
+// enabled with WithBlobCache. Manifests, configurations and indexes tend to be
+// quite small, so this is enough to cache every such blob in most images.
+const DefaultBlobCacheSize = 32 << 20
+
+// blobCacheKey identifies a cached blob. The media-type and size are included
+// because FromDescriptor verifies (and parses) a blob with respect to the
+// descriptor it was given, not just its digest.
+type blobCacheKey struct {
+	digest    digest.Digest
+	mediaType string
+	size      int64
+}
+
+type blobCacheEntry struct {
+	key  blobCacheKey
+	data []byte
+}
+
+// blobCache is a thread-safe LRU cache of the (verified) contents of
+// parseable blobs, bounded by the total size of the cached contents. The raw
+// contents are cached rather than the parsed blobs, so that callers which
+// modify the results of FromDescriptor cannot corrupt the cache.
+type blobCache struct {
+	lock     sync.Mutex
+	maxBytes int64
+	curBytes int64
+	lru      *list.List
+	entries  map[blobCacheKey]*list.Element
+}
+
+func newBlobCache(maxBytes int64) *blobCache {
+	return &blobCache{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  map[blobCacheKey]*list.Element{},
+	}
+}
+
+// get returns the cached contents of the blob, if present.
+func (c *blobCache) get(key blobCacheKey) ([]byte, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*blobCacheEntry).data, true
+}
+
+// put adds the contents of a blob to the cache, evicting the least recently
+// used entries if necessary. Blobs larger than the cache are not cached.
+func (c *blobCache) put(key blobCacheKey, data []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if int64(len(data)) > c.maxBytes {
+		return
+	}
+	if elem, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&blobCacheEntry{key: key, data: data})
+	c.curBytes += int64(len(data))
+	for c.curBytes > c.maxBytes {
+		c.remove(c.lru.Back())
+	}
+}
+
+// invalidate removes all cached entries for the given digest.
+func (c *blobCache) invalidate(digest digest.Digest) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for key, elem := range c.entries {
+		if key.digest == digest {
+			c.remove(elem)
+		}
+	}
+}
+
+// remove drops an entry from the cache. c.lock must be held.
+func (c *blobCache) remove(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*blobCacheEntry)
+	delete(c.entries, entry.key)
+	c.curBytes -= int64(len(entry.data))
+}
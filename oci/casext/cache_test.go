@@ -0,0 +1,178 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	imeta "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/cas"
+	"github.com/opencontainers/umoci/oci/cas/dir"
+)
+
+// countingEngine is a cas.Engine which counts how many blobs have been
+// fetched from it.
+type countingEngine struct {
+	cas.Engine
+	fetched int32
+}
+
+func (e *countingEngine) GetBlob(ctx context.Context, digest digest.Digest) (io.ReadCloser, error) {
+	atomic.AddInt32(&e.fetched, 1)
+	return e.Engine.GetBlob(ctx, digest)
+}
+
+func TestBlobCacheEviction(t *testing.T) {
+	cache := newBlobCache(10)
+
+	keyA := blobCacheKey{digest: digest.FromString("a")}
+	keyB := blobCacheKey{digest: digest.FromString("b")}
+	keyC := blobCacheKey{digest: digest.FromString("c")}
+
+	cache.put(keyA, []byte("aaaa"))
+	cache.put(keyB, []byte("bbbb"))
+	// Make keyA the most recently used entry.
+	if _, ok := cache.get(keyA); !ok {
+		t.Errorf("expected %v to be cached", keyA.digest)
+	}
+	// This must evict keyB, the least recently used entry.
+	cache.put(keyC, []byte("cccc"))
+
+	if _, ok := cache.get(keyB); ok {
+		t.Errorf("expected %v to have been evicted", keyB.digest)
+	}
+	for _, key := range []blobCacheKey{keyA, keyC} {
+		if _, ok := cache.get(key); !ok {
+			t.Errorf("expected %v to be cached", key.digest)
+		}
+	}
+	if cache.curBytes != 8 {
+		t.Errorf("expected cache to contain 8 bytes, got %d", cache.curBytes)
+	}
+
+	// Blobs larger than the cache must not be cached.
+	keyBig := blobCacheKey{digest: digest.FromString("big")}
+	cache.put(keyBig, []byte("this is far too big"))
+	if _, ok := cache.get(keyBig); ok {
+		t.Errorf("expected oversized blob to not be cached")
+	}
+
+	cache.invalidate(keyA.digest)
+	if _, ok := cache.get(keyA); ok {
+		t.Errorf("expected %v to have been invalidated", keyA.digest)
+	}
+	if cache.curBytes != 4 {
+		t.Errorf("expected cache to contain 4 bytes, got %d", cache.curBytes)
+	}
+}
+
+func TestEngineBlobCache(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineBlobCache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	defer engine.Close()
+
+	layerDigest := digest.FromString("fake layer")
+	manifestDigest, manifestSize, err := NewEngine(engine).PutBlobJSON(ctx, ispec.Manifest{
+		Versioned: imeta.Versioned{
+			SchemaVersion: 2,
+		},
+		MediaType: ispec.MediaTypeImageManifest,
+		Layers: []ispec.Descriptor{
+			{MediaType: ispec.MediaTypeImageLayer, Digest: layerDigest},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error putting manifest: %+v", err)
+	}
+	descriptor := ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    manifestDigest,
+		Size:      manifestSize,
+	}
+
+	for _, test := range []struct {
+		name          string
+		cacheSize     int64
+		expectFetches int32
+	}{
+		{"Disabled", 0, 3},
+		{"Enabled", DefaultBlobCacheSize, 1},
+		{"TooSmall", 8, 3},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			counter := &countingEngine{Engine: engine}
+			engineExt := NewEngine(counter).WithBlobCache(test.cacheSize)
+
+			for i := 0; i < 3; i++ {
+				blob, err := engineExt.FromDescriptor(ctx, descriptor)
+				if err != nil {
+					t.Fatalf("FromDescriptor: unexpected error: %+v", err)
+				}
+				manifest, ok := blob.Data.(ispec.Manifest)
+				if !ok {
+					t.Fatalf("FromDescriptor returned unexpected type %T", blob.Data)
+				}
+				if len(manifest.Layers) != 1 || manifest.Layers[0].Digest != layerDigest {
+					t.Fatalf("FromDescriptor returned unexpected manifest: %#v", manifest)
+				}
+				// Modifying the returned blob must not affect later calls.
+				manifest.Layers[0].Digest = digest.FromString("modified")
+			}
+			if counter.fetched != test.expectFetches {
+				t.Errorf("expected %d blob fetches, got %d", test.expectFetches, counter.fetched)
+			}
+		})
+	}
+
+	t.Run("DeleteBlob", func(t *testing.T) {
+		engineExt := NewEngine(engine).WithBlobCache(DefaultBlobCacheSize)
+
+		if _, err := engineExt.FromDescriptor(ctx, descriptor); err != nil {
+			t.Fatalf("FromDescriptor: unexpected error: %+v", err)
+		}
+		if err := engineExt.DeleteBlob(ctx, descriptor.Digest); err != nil {
+			t.Fatalf("DeleteBlob: unexpected error: %+v", err)
+		}
+		if _, err := engineExt.FromDescriptor(ctx, descriptor); !IsNotExist(err) {
+			t.Errorf("expected FromDescriptor of deleted blob to fail with not-exist, got %v", err)
+		}
+	})
+}
@@ -20,7 +20,12 @@
 // of cas.Engine.
 package casext
 
-import "github.com/opencontainers/umoci/oci/cas"
+import (
+	"context"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/umoci/oci/cas"
+)
 
 // TODO: Convert this to an interface and make Engine private.
 
@@ -28,6 +33,10 @@ import "github.com/opencontainers/umoci/oci/cas"
 // extensions to the transport-dependent cas.Engine implementation.
 type Engine struct {
 	cas.Engine
+
+	// cache is the (optional) cache of parseable blobs used by
+	// FromDescriptor. It is shared by all copies of the Engine.
+	cache *blobCache
 }
 
 // NewEngine returns a new Engine which acts as a wrapper around the given
@@ -36,3 +45,32 @@ type Engine struct {
 func NewEngine(engine cas.Engine) Engine {
 	return Engine{Engine: engine}
 }
+
+// WithBlobCache returns a copy of the Engine which caches the contents of
+// parseable blobs (manifests, configurations, indexes and so on) fetched with
+// FromDescriptor in memory, so that walking the same image several times does
+// not require re-reading and re-verifying each blob from the underlying
+// cas.Engine. At most maxBytes of blob contents are cached, with the least
+// recently used blobs being evicted first. If maxBytes is not positive, the
+// returned Engine has caching disabled.
+//
+// Because blobs are content-addressed, cached entries only need to be
+// invalidated when a blob is removed -- which DeleteBlob does. However, if the
+// underlying image is modified other than through this Engine (such as by
+// another process) while the cache is in use, stale blobs may be returned.
+func (e Engine) WithBlobCache(maxBytes int64) Engine {
+	e.cache = nil
+	if maxBytes > 0 {
+		e.cache = newBlobCache(maxBytes)
+	}
+	return e
+}
+
+// DeleteBlob removes a blob from the image, as with cas.Engine.DeleteBlob,
+// and also removes it from the blob cache (if enabled).
+func (e Engine) DeleteBlob(ctx context.Context, digest digest.Digest) error {
+	if e.cache != nil {
+		e.cache.invalidate(digest)
+	}
+	return e.Engine.DeleteBlob(ctx, digest)
+}
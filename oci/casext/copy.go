@@ -0,0 +1,122 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"context"
+
+	"github.com/apex/log"
+	"github.com/docker/go-units"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/casext/mediatype"
+	"github.com/pkg/errors"
+)
+
+// CopyStats contains statistics about the blobs copied by Copy.
+type CopyStats struct {
+	// Blobs is the number of blobs that were copied.
+	Blobs int
+	// Bytes is the sum of the sizes of all of the blobs that were copied.
+	Bytes int64
+	// Existing is the number of blobs that were not copied because they
+	// already existed in the destination.
+	Existing int
+}
+
+// copyBlob copies a single blob from the image to dst, verifying its digest
+// and size.
+func (e Engine) copyBlob(ctx context.Context, dst Engine, descriptor ispec.Descriptor) error {
+	blob, err := e.GetVerifiedBlob(ctx, descriptor)
+	if err != nil {
+		return errors.Wrap(err, "get blob")
+	}
+	defer blob.Close()
+
+	// The blob reader verifies the digest and size of the source blob, so a
+	// corrupted blob will cause PutBlob to fail before the blob is stored.
+	gotDigest, gotSize, err := dst.PutBlob(ctx, blob)
+	if err != nil {
+		return errors.Wrap(err, "put blob")
+	}
+	if gotDigest != descriptor.Digest || gotSize != descriptor.Size {
+		// Should never happen, but make sure we don't leave a bad blob around.
+		// #nosec G104
+		_ = dst.DeleteBlob(ctx, gotDigest)
+		return errors.Errorf("[internal error] copied blob has digest %s (size %d): expected %s (size %d)", gotDigest, gotSize, descriptor.Digest, descriptor.Size)
+	}
+	return errors.Wrap(blob.Close(), "verify blob")
+}
+
+// Copy copies the blob described by root, and every blob reachable from it,
+// from the image to the image referenced by dst. Blobs are copied verbatim
+// (compressed layers are not decompressed or recompressed) and the digest and
+// size of every copied blob is verified. Blobs which already exist in dst are
+// re-used rather than copied again -- though the blobs they reference are
+// still checked, in case a previous copy was interrupted. Non-distributable
+// layers which are not present in the image are skipped. No references are
+// modified in dst, so the caller should tag root in dst once Copy returns.
+func (e Engine) Copy(ctx context.Context, dst Engine, root ispec.Descriptor) (CopyStats, error) {
+	var stats CopyStats
+
+	seen := map[digest.Digest]struct{}{}
+	err := e.Walk(ctx, root, func(descriptorPath DescriptorPath) error {
+		descriptor := descriptorPath.Descriptor()
+
+		// Blobs may be referenced more than once (such as a layer shared by
+		// several manifests in an index), but only need to be copied once.
+		if _, ok := seen[descriptor.Digest]; ok {
+			return ErrSkipDescriptor
+		}
+		seen[descriptor.Digest] = struct{}{}
+
+		exists, err := dst.StatBlob(ctx, descriptor.Digest)
+		if err != nil {
+			return errors.Wrapf(err, "stat destination blob %s", descriptor.Digest)
+		}
+		if exists {
+			log.Debugf("copy: blob %s already exists in destination", descriptor.Digest)
+			stats.Existing++
+			return nil
+		}
+
+		if mediatype.IsNonDistributable(descriptor.MediaType) {
+			exists, err := e.StatBlob(ctx, descriptor.Digest)
+			if err != nil {
+				return errors.Wrapf(err, "stat blob %s", descriptor.Digest)
+			}
+			if !exists {
+				log.Debugf("copy: skipping missing non-distributable blob %s", descriptor.Digest)
+				return nil
+			}
+		}
+
+		log.WithFields(log.Fields{
+			"digest":    descriptor.Digest,
+			"mediatype": descriptor.MediaType,
+			"size":      units.HumanSize(float64(descriptor.Size)),
+		}).Debugf("copy: copying blob")
+		if err := e.copyBlob(ctx, dst, descriptor); err != nil {
+			return errors.Wrapf(err, "copy blob %s", descriptor.Digest)
+		}
+		stats.Blobs++
+		stats.Bytes += descriptor.Size
+		return nil
+	})
+	return stats, err
+}
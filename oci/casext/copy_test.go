@@ -0,0 +1,158 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/cas/dir"
+)
+
+func setupCopyEngine(t *testing.T, path string) Engine {
+	if err := dir.Create(path); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+	engine, err := dir.Open(path)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	return NewEngine(engine)
+}
+
+func TestCopy(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestCopy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	src := setupCopyEngine(t, filepath.Join(root, "src"))
+	defer src.Close()
+	dst := setupCopyEngine(t, filepath.Join(root, "dst"))
+	defer dst.Close()
+
+	descMap, err := fakeSetupEngine(t, src)
+	if err != nil {
+		t.Fatalf("unexpected error doing fakeSetupEngine: %+v", err)
+	}
+
+	for _, test := range descMap {
+		// Only the "normal" images are made up of real manifests.
+		if test.result.MediaType != ispec.MediaTypeImageManifest {
+			continue
+		}
+
+		stats, err := src.Copy(ctx, dst, test.index)
+		if err != nil {
+			t.Fatalf("unexpected error copying %s: %+v", test.index.Digest, err)
+		}
+		if stats.Blobs == 0 {
+			t.Errorf("expected blobs to be copied for %s", test.index.Digest)
+		}
+
+		// Every blob must now be reachable in the destination.
+		blobs := map[digest.Digest]struct{}{}
+		if err := dst.Walk(ctx, test.index, func(descriptorPath DescriptorPath) error {
+			descriptor := descriptorPath.Descriptor()
+			exists, err := dst.StatBlob(ctx, descriptor.Digest)
+			if err != nil {
+				return err
+			}
+			if !exists {
+				t.Errorf("blob %s missing from destination", descriptor.Digest)
+			}
+			blobs[descriptor.Digest] = struct{}{}
+			return nil
+		}); err != nil {
+			t.Fatalf("unexpected error walking destination: %+v", err)
+		}
+		if stats.Blobs+stats.Existing != len(blobs) {
+			t.Errorf("expected %d blobs to be handled: got %d copied and %d existing", len(blobs), stats.Blobs, stats.Existing)
+		}
+
+		// Copying again should re-use everything.
+		stats, err = src.Copy(ctx, dst, test.index)
+		if err != nil {
+			t.Fatalf("unexpected error re-copying %s: %+v", test.index.Digest, err)
+		}
+		if stats.Blobs != 0 || stats.Bytes != 0 {
+			t.Errorf("expected no blobs to be copied again: got %d (%d bytes)", stats.Blobs, stats.Bytes)
+		}
+		if stats.Existing != len(blobs) {
+			t.Errorf("expected all %d blobs to already exist: got %d existing", len(blobs), stats.Existing)
+		}
+	}
+}
+
+func TestCopyCorrupted(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestCopyCorrupted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	srcPath := filepath.Join(root, "src")
+	src := setupCopyEngine(t, srcPath)
+	defer src.Close()
+	dst := setupCopyEngine(t, filepath.Join(root, "dst"))
+	defer dst.Close()
+
+	descMap, err := fakeSetupEngine(t, src)
+	if err != nil {
+		t.Fatalf("unexpected error doing fakeSetupEngine: %+v", err)
+	}
+	test := descMap[0]
+
+	blob, err := src.FromDescriptor(ctx, test.result)
+	if err != nil {
+		t.Fatalf("unexpected error getting manifest: %+v", err)
+	}
+	defer blob.Close()
+	manifest := blob.Data.(ispec.Manifest)
+	layer := manifest.Layers[0]
+
+	// Corrupt the layer blob in the source.
+	layerPath := filepath.Join(srcPath, "blobs", layer.Digest.Algorithm().String(), layer.Digest.Encoded())
+	if err := os.Chmod(layerPath, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(layerPath, []byte("corrupted layer"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := src.Copy(ctx, dst, test.index); err == nil {
+		t.Fatalf("expected copy of corrupted image to fail")
+	}
+	exists, err := dst.StatBlob(ctx, layer.Digest)
+	if err != nil {
+		t.Fatalf("unexpected error stat-ing blob: %+v", err)
+	}
+	if exists {
+		t.Errorf("corrupted blob %s was copied to destination", layer.Digest)
+	}
+}
@@ -0,0 +1,129 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// DiffIDFunc computes the DiffID (the digest of the uncompressed tar stream)
+// of the layer blob referenced by the given descriptor. This is usually
+// layer.DiffID, which cannot be used directly by casext because the layer
+// package depends on casext.
+type DiffIDFunc func(ctx context.Context, layer ispec.Descriptor) (digest.Digest, error)
+
+// DiffIDMismatch describes a layer whose DiffID does not match the DiffID
+// recorded for it in the rootfs.diff_ids of the image configuration.
+type DiffIDMismatch struct {
+	// Index is the index of the layer in the manifest (and of the DiffID in
+	// the configuration).
+	Index int
+
+	// Layer is the descriptor of the layer. It is nil if the configuration
+	// has more DiffIDs than the manifest has layers.
+	Layer *ispec.Descriptor
+
+	// Expected is the DiffID recorded in the configuration. It is empty if
+	// the manifest has more layers than the configuration has DiffIDs.
+	Expected digest.Digest
+
+	// Actual is the DiffID computed from the layer. It is empty if the layer
+	// is missing, or if the DiffID could not be computed (in which case Err
+	// is set).
+	Actual digest.Digest
+
+	// Err is the error encountered while computing the DiffID (may be nil).
+	Err error
+}
+
+// String returns a human-readable description of the mismatch.
+func (m DiffIDMismatch) String() string {
+	switch {
+	case m.Layer == nil:
+		return fmt.Sprintf("layer %d: config has diffid %s but manifest has no such layer", m.Index, m.Expected)
+	case m.Err != nil:
+		return fmt.Sprintf("layer %d (%s): could not compute diffid: %v", m.Index, m.Layer.Digest, m.Err)
+	case m.Expected == "":
+		return fmt.Sprintf("layer %d (%s): layer has diffid %s but config has no such diffid", m.Index, m.Layer.Digest, m.Actual)
+	default:
+		return fmt.Sprintf("layer %d (%s): layer has diffid %s but config has diffid %s", m.Index, m.Layer.Digest, m.Actual, m.Expected)
+	}
+}
+
+// VerifyDiffIDs checks that the rootfs.diff_ids of the configuration of the
+// given manifest matches the layers of the manifest, by recomputing the DiffID
+// of every layer (in order) using diffID. This catches corruption that blob
+// digest verification cannot, because the layer blobs can be intact while the
+// configuration is wrong.
+//
+// An error is only returned if the manifest or configuration could not be
+// read -- every mismatch found is returned instead. Layers are checked even
+// after a mismatch is found, so that all mismatches are reported.
+func (e Engine) VerifyDiffIDs(ctx context.Context, manifestDescriptor ispec.Descriptor, diffID DiffIDFunc) ([]DiffIDMismatch, error) {
+	if manifestDescriptor.MediaType != ispec.MediaTypeImageManifest {
+		return nil, errors.Errorf("verify diffids: descriptor does not point to a manifest: %s", manifestDescriptor.MediaType)
+	}
+	manifestBlob, err := e.FromDescriptor(ctx, manifestDescriptor)
+	if err != nil {
+		return nil, errors.Wrap(err, "get manifest")
+	}
+	defer manifestBlob.Close()
+	manifest, ok := manifestBlob.Data.(ispec.Manifest)
+	if !ok {
+		// Should _never_ be reached.
+		return nil, errors.Errorf("[internal error] unknown manifest blob type: %s", manifestBlob.Descriptor.MediaType)
+	}
+
+	configBlob, err := e.FromDescriptor(ctx, manifest.Config)
+	if err != nil {
+		return nil, errors.Wrap(err, "get config")
+	}
+	defer configBlob.Close()
+	config, ok := configBlob.Data.(ispec.Image)
+	if !ok {
+		return nil, errors.Errorf("verify diffids: config is not an image configuration: %s", configBlob.Descriptor.MediaType)
+	}
+
+	mismatches := []DiffIDMismatch{}
+	for idx, layer := range manifest.Layers {
+		layer := layer
+		mismatch := DiffIDMismatch{
+			Index: idx,
+			Layer: &layer,
+		}
+		if idx < len(config.RootFS.DiffIDs) {
+			mismatch.Expected = config.RootFS.DiffIDs[idx]
+		}
+		mismatch.Actual, mismatch.Err = diffID(ctx, layer)
+		if mismatch.Err != nil || mismatch.Actual != mismatch.Expected {
+			mismatches = append(mismatches, mismatch)
+		}
+	}
+	for idx := len(manifest.Layers); idx < len(config.RootFS.DiffIDs); idx++ {
+		mismatches = append(mismatches, DiffIDMismatch{
+			Index:    idx,
+			Expected: config.RootFS.DiffIDs[idx],
+		})
+	}
+	return mismatches, nil
+}
@@ -0,0 +1,173 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ispecs "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/cas/dir"
+)
+
+func TestVerifyDiffIDs(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestVerifyDiffIDs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := NewEngine(engine)
+	defer engine.Close()
+
+	// The layers are "uncompressed", so their DiffIDs are their digests.
+	var (
+		layers  []ispec.Descriptor
+		diffIDs []digest.Digest
+	)
+	for idx := 0; idx < 3; idx++ {
+		layerDigest, layerSize, err := engineExt.PutBlob(ctx, bytes.NewReader([]byte(fmt.Sprintf("layer %d", idx))))
+		if err != nil {
+			t.Fatalf("put layer: %+v", err)
+		}
+		layers = append(layers, ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageLayer,
+			Digest:    layerDigest,
+			Size:      layerSize,
+		})
+		diffIDs = append(diffIDs, layerDigest)
+	}
+	missingLayer := ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageLayer,
+		Digest:    digest.FromString("missing layer"),
+		Size:      13,
+	}
+	bogus := digest.FromString("bogus")
+
+	diffID := func(ctx context.Context, layer ispec.Descriptor) (digest.Digest, error) {
+		blob, err := engineExt.GetVerifiedBlob(ctx, layer)
+		if err != nil {
+			return "", err
+		}
+		defer blob.Close()
+		return digest.SHA256.FromReader(blob)
+	}
+
+	for _, test := range []struct {
+		name     string
+		layers   []ispec.Descriptor
+		diffIDs  []digest.Digest
+		expected []DiffIDMismatch
+	}{
+		{"Valid", layers, diffIDs, nil},
+		{"Empty", nil, nil, nil},
+		{"Mismatch", layers, []digest.Digest{diffIDs[0], bogus, diffIDs[1]}, []DiffIDMismatch{
+			{Index: 1, Layer: &layers[1], Expected: bogus, Actual: diffIDs[1]},
+			{Index: 2, Layer: &layers[2], Expected: diffIDs[1], Actual: diffIDs[2]},
+		}},
+		{"Reordered", layers, []digest.Digest{diffIDs[1], diffIDs[0], diffIDs[2]}, []DiffIDMismatch{
+			{Index: 0, Layer: &layers[0], Expected: diffIDs[1], Actual: diffIDs[0]},
+			{Index: 1, Layer: &layers[1], Expected: diffIDs[0], Actual: diffIDs[1]},
+		}},
+		{"MissingDiffIDs", layers, diffIDs[:1], []DiffIDMismatch{
+			{Index: 1, Layer: &layers[1], Actual: diffIDs[1]},
+			{Index: 2, Layer: &layers[2], Actual: diffIDs[2]},
+		}},
+		{"ExtraDiffIDs", layers[:2], diffIDs, []DiffIDMismatch{
+			{Index: 2, Expected: diffIDs[2]},
+		}},
+		{"MissingLayer", []ispec.Descriptor{layers[0], missingLayer}, []digest.Digest{diffIDs[0], bogus}, []DiffIDMismatch{
+			{Index: 1, Layer: &missingLayer, Expected: bogus},
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			configDigest, configSize, err := engineExt.PutBlobJSON(ctx, ispec.Image{
+				OS: "linux",
+				RootFS: ispec.RootFS{
+					Type:    "layers",
+					DiffIDs: test.diffIDs,
+				},
+			})
+			if err != nil {
+				t.Fatalf("put config: %+v", err)
+			}
+			manifestDigest, manifestSize, err := engineExt.PutBlobJSON(ctx, ispec.Manifest{
+				Versioned: ispecs.Versioned{SchemaVersion: 2},
+				MediaType: ispec.MediaTypeImageManifest,
+				Config: ispec.Descriptor{
+					MediaType: ispec.MediaTypeImageConfig,
+					Digest:    configDigest,
+					Size:      configSize,
+				},
+				Layers: test.layers,
+			})
+			if err != nil {
+				t.Fatalf("put manifest: %+v", err)
+			}
+
+			mismatches, err := engineExt.VerifyDiffIDs(ctx, ispec.Descriptor{
+				MediaType: ispec.MediaTypeImageManifest,
+				Digest:    manifestDigest,
+				Size:      manifestSize,
+			}, diffID)
+			if err != nil {
+				t.Fatalf("unexpected error verifying diffids: %+v", err)
+			}
+
+			if len(mismatches) != len(test.expected) {
+				t.Fatalf("expected %d mismatches, got %d: %v", len(test.expected), len(mismatches), mismatches)
+			}
+			for idx, mismatch := range mismatches {
+				t.Logf("mismatch: %s", mismatch)
+				expected := test.expected[idx]
+				if mismatch.Index != expected.Index || mismatch.Expected != expected.Expected || mismatch.Actual != expected.Actual {
+					t.Errorf("mismatch %d: expected %+v, got %+v", idx, expected, mismatch)
+				}
+				if (mismatch.Layer == nil) != (expected.Layer == nil) || (mismatch.Layer != nil && mismatch.Layer.Digest != expected.Layer.Digest) {
+					t.Errorf("mismatch %d: expected layer %v, got %v", idx, expected.Layer, mismatch.Layer)
+				}
+				// Only the missing layer has an error.
+				if (mismatch.Err != nil) != (expected.Layer == &missingLayer) {
+					t.Errorf("mismatch %d: unexpected error state: %v", idx, mismatch.Err)
+				}
+			}
+		})
+	}
+
+	// Only manifests can be verified.
+	if _, err := engineExt.VerifyDiffIDs(ctx, layers[0], diffID); err == nil {
+		t.Errorf("expected verifying a non-manifest to fail")
+	}
+}
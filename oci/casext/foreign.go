@@ -0,0 +1,97 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/apex/log"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/cas"
+	"github.com/opencontainers/umoci/pkg/hardening"
+	"github.com/pkg/errors"
+)
+
+// IsNotExist returns whether the given error (returned by GetBlob or a
+// similar method) indicates that the blob does not exist in the image. Not all
+// engines return cas.ErrNotExist for missing blobs (some return errors
+// wrapping os.ErrNotExist), so this handles both.
+func IsNotExist(err error) bool {
+	return errors.Is(err, cas.ErrNotExist) || errors.Is(err, os.ErrNotExist)
+}
+
+// GetForeignBlob fetches the blob referenced by the given descriptor from the
+// URLs in the descriptor (which is how non-distributable layers are
+// distributed), trying each URL in order until one succeeds. Only http and
+// https URLs are supported. As with GetVerifiedBlob, the returned reader
+// verifies that the blob matches the descriptor, so the caller must Close()
+// *and* read-to-EOF (checking the error code of both). The blob is not stored
+// in the image.
+func GetForeignBlob(ctx context.Context, client *http.Client, descriptor ispec.Descriptor) (io.ReadCloser, error) {
+	if len(descriptor.URLs) == 0 {
+		return nil, errors.Errorf("foreign blob %s has no urls", descriptor.Digest)
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	var lastErr error
+	for _, rawURL := range descriptor.URLs {
+		reader, err := getForeignURL(ctx, client, rawURL)
+		if err != nil {
+			log.Warnf("could not fetch foreign blob %s from %s: %v", descriptor.Digest, rawURL, err)
+			lastErr = err
+			continue
+		}
+		log.Infof("fetching foreign blob %s from %s", descriptor.Digest, rawURL)
+		return &hardening.VerifiedReadCloser{
+			Reader:         reader,
+			ExpectedDigest: descriptor.Digest,
+			ExpectedSize:   descriptor.Size,
+		}, nil
+	}
+	return nil, errors.Wrapf(lastErr, "fetch foreign blob %s", descriptor.Digest)
+}
+
+// getForeignURL opens the response body of a GET request for the given URL.
+func getForeignURL(ctx context.Context, client *http.Client, rawURL string) (io.ReadCloser, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse url")
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, errors.Errorf("unsupported url scheme %q", u.Scheme)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "create request")
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "get url")
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, errors.Errorf("unexpected status: %s", resp.Status)
+	}
+	return resp.Body, nil
+}
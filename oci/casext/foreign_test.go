@@ -0,0 +1,135 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/cas"
+	"github.com/opencontainers/umoci/oci/cas/dir"
+	"github.com/opencontainers/umoci/oci/cas/mem"
+	"github.com/pkg/errors"
+)
+
+func TestIsNotExist(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestIsNotExist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+	dirEngine, err := dir.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	defer dirEngine.Close()
+	memEngine := mem.New()
+	defer memEngine.Close()
+
+	missing := digest.FromString("missing blob")
+	for name, engine := range map[string]cas.Engine{
+		"Dir": dirEngine,
+		"Mem": memEngine,
+	} {
+		t.Run(name, func(t *testing.T) {
+			engineExt := NewEngine(engine)
+			if _, err := engineExt.GetBlob(ctx, missing); !IsNotExist(err) {
+				t.Errorf("expected GetBlob of missing blob to be IsNotExist: %v", err)
+			}
+			if _, err := engineExt.GetVerifiedBlob(ctx, ispec.Descriptor{Digest: missing}); !IsNotExist(err) {
+				t.Errorf("expected GetVerifiedBlob of missing blob to be IsNotExist: %v", err)
+			}
+		})
+	}
+	if IsNotExist(nil) || IsNotExist(errors.New("some other error")) {
+		t.Errorf("unexpected IsNotExist for other errors")
+	}
+}
+
+func TestGetForeignBlob(t *testing.T) {
+	ctx := context.Background()
+
+	blob := []byte("this is a foreign layer")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/layer":
+			_, _ = w.Write(blob)
+		case "/corrupt":
+			_, _ = w.Write([]byte("this is not the foreign layer"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	descriptor := ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageLayerNonDistributable,
+		Digest:    digest.FromBytes(blob),
+		Size:      int64(len(blob)),
+	}
+
+	for _, test := range []struct {
+		name string
+		urls []string
+		fail bool
+	}{
+		{"Simple", []string{server.URL + "/layer"}, false},
+		{"Fallback", []string{"file:///etc/passwd", server.URL + "/missing", server.URL + "/layer"}, false},
+		{"NoURLs", nil, true},
+		{"NotFound", []string{server.URL + "/missing"}, true},
+		{"UnsupportedScheme", []string{"file:///etc/passwd"}, true},
+		{"Corrupt", []string{server.URL + "/corrupt"}, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			descriptor := descriptor
+			descriptor.URLs = test.urls
+
+			reader, err := GetForeignBlob(ctx, nil, descriptor)
+			if err == nil {
+				var data []byte
+				data, err = ioutil.ReadAll(reader)
+				if closeErr := reader.Close(); err == nil {
+					err = closeErr
+				}
+				if err == nil && !bytes.Equal(data, blob) {
+					t.Errorf("unexpected blob contents: %q", data)
+				}
+			}
+			if test.fail && err == nil {
+				t.Errorf("expected fetching foreign blob to fail")
+			} else if !test.fail && err != nil {
+				t.Errorf("unexpected error fetching foreign blob: %+v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,375 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"sort"
+
+	"github.com/apex/log"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/cas"
+	"github.com/opencontainers/umoci/oci/casext/mediatype"
+	"github.com/opencontainers/umoci/pkg/hardening"
+	"github.com/opencontainers/umoci/pkg/system"
+	"github.com/pkg/errors"
+)
+
+// FsckProblemKind is the kind of problem found by Fsck.
+type FsckProblemKind int
+
+const (
+	// FsckCorruptBlob indicates that the contents of a blob do not match its
+	// digest (or could not be read).
+	FsckCorruptBlob FsckProblemKind = iota
+
+	// FsckMissingBlob indicates that a descriptor references a blob which
+	// does not exist in the image.
+	FsckMissingBlob
+
+	// FsckSizeMismatch indicates that the size in a descriptor does not match
+	// the size of the blob it references.
+	FsckSizeMismatch
+
+	// FsckInvalidBlob indicates that a blob could not be parsed as the
+	// media-type given by the descriptor referencing it.
+	FsckInvalidBlob
+
+	// FsckOrphanBlob indicates that a blob cannot be reached from any of the
+	// references in the image (and thus would be removed by GC). This is not
+	// a sign of corruption.
+	FsckOrphanBlob
+)
+
+// String returns a human-readable description of the FsckProblemKind.
+func (k FsckProblemKind) String() string {
+	switch k {
+	case FsckCorruptBlob:
+		return "corrupt blob"
+	case FsckMissingBlob:
+		return "missing blob"
+	case FsckSizeMismatch:
+		return "size mismatch"
+	case FsckInvalidBlob:
+		return "invalid blob"
+	case FsckOrphanBlob:
+		return "orphan blob"
+	default:
+		return fmt.Sprintf("unknown problem %d", int(k))
+	}
+}
+
+// FsckProblem describes a single problem found by Fsck.
+type FsckProblem struct {
+	// Kind is the kind of problem.
+	Kind FsckProblemKind
+
+	// Digest is the digest of the blob with the problem.
+	Digest digest.Digest
+
+	// Path is the descriptor path used to reach the blob, for problems found
+	// while walking the references in the image. It is empty for problems
+	// with the blob itself (FsckCorruptBlob and FsckOrphanBlob).
+	Path DescriptorPath
+
+	// Err describes the problem in more detail (may be nil).
+	Err error
+
+	// Shared indicates that the blob is not in the image itself, but in a
+	// read-only additional blob store (see WithAdditionalBlobStores), and so
+	// cannot be removed from the image.
+	Shared bool
+}
+
+// String returns a human-readable description of the problem.
+func (p FsckProblem) String() string {
+	str := fmt.Sprintf("%s %s", p.Kind, p.Digest)
+	if len(p.Path.Walk) > 1 {
+		str += fmt.Sprintf(" (referenced by %s)", p.Path.Walk[len(p.Path.Walk)-2].Digest)
+	} else if len(p.Path.Walk) == 1 {
+		str += " (referenced by index)"
+	}
+	if p.Shared {
+		str += " (in additional blob store)"
+	}
+	if p.Err != nil {
+		str += fmt.Sprintf(": %v", p.Err)
+	}
+	return str
+}
+
+// FsckReport is the result of a Fsck run.
+type FsckReport struct {
+	// Blobs is the number of blobs in the image which were checked.
+	Blobs int
+
+	// SharedBlobs is the number of blobs referenced by the image which were
+	// checked in read-only additional blob stores (see
+	// WithAdditionalBlobStores), rather than in the image itself.
+	SharedBlobs int
+
+	// Problems is the set of problems found, sorted by digest.
+	Problems []FsckProblem
+}
+
+// Corrupted returns whether any problems other than FsckOrphanBlob were
+// found.
+func (r FsckReport) Corrupted() bool {
+	for _, problem := range r.Problems {
+		if problem.Kind != FsckOrphanBlob {
+			return true
+		}
+	}
+	return false
+}
+
+// fsckState stores state information about a Fsck run.
+type fsckState struct {
+	engine Engine
+
+	// sizes is the size of every intact blob in the image.
+	sizes map[digest.Digest]int64
+
+	// corrupt is the set of corrupt blobs in the image.
+	corrupt map[digest.Digest]struct{}
+
+	// seen is the set of blobs reached while walking the references.
+	seen map[digest.Digest]struct{}
+
+	// walked is the set of blobs whose children have been walked.
+	walked map[digest.Digest]struct{}
+
+	// shared is the number of blobs checked in additional blob stores.
+	shared int
+
+	problems []FsckProblem
+}
+
+// checkBlob reads the entire blob with the given digest and verifies that its
+// contents match the digest, returning the size of the blob.
+func (fs *fsckState) checkBlob(ctx context.Context, digest digest.Digest) (_ int64, Err error) {
+	reader, err := fs.engine.GetBlob(ctx, digest)
+	if err != nil {
+		return -1, errors.Wrap(err, "get blob")
+	}
+	verifiedReader := &hardening.VerifiedReadCloser{
+		Reader:         reader,
+		ExpectedDigest: digest,
+		ExpectedSize:   -1,
+	}
+	defer func() {
+		if err := verifiedReader.Close(); err != nil && Err == nil {
+			Err = errors.Wrap(err, "verify blob")
+		}
+	}()
+	return system.Copy(ioutil.Discard, verifiedReader)
+}
+
+// checkSharedBlob checks the blob with the given digest if it is only present
+// in a read-only additional blob store, recording the result in the same way
+// as blobs in the image. It returns whether the blob is corrupt and whether it
+// is intact -- if neither are true, the blob doesn't exist.
+func (fs *fsckState) checkSharedBlob(ctx context.Context, digest digest.Digest) (isCorrupt, exists bool, _ error) {
+	store, ok := fs.engine.Engine.(sharedBlobStore)
+	if !ok {
+		return false, false, nil
+	}
+	shared, err := store.IsSharedBlob(ctx, digest)
+	if err != nil {
+		return false, false, errors.Wrap(err, "stat blob")
+	}
+	if !shared {
+		return false, false, nil
+	}
+
+	log.Debugf("fsck: checking shared blob %s", digest)
+	fs.shared++
+	size, err := fs.checkBlob(ctx, digest)
+	if err != nil {
+		fs.corrupt[digest] = struct{}{}
+		fs.problems = append(fs.problems, FsckProblem{
+			Kind:   FsckCorruptBlob,
+			Digest: digest,
+			Err:    err,
+			Shared: true,
+		})
+		return true, false, nil
+	}
+	fs.sizes[digest] = size
+	return false, true, nil
+}
+
+// walk checks the blob referenced by the given descriptor path (as well as
+// any blobs it references).
+func (fs *fsckState) walk(ctx context.Context, descriptorPath DescriptorPath) {
+	descriptor := descriptorPath.Descriptor()
+	problem := func(kind FsckProblemKind, err error) {
+		fs.problems = append(fs.problems, FsckProblem{
+			Kind:   kind,
+			Digest: descriptor.Digest,
+			Path:   DescriptorPath{Walk: append([]ispec.Descriptor{}, descriptorPath.Walk...)},
+			Err:    err,
+		})
+	}
+
+	if err := descriptor.Digest.Validate(); err != nil {
+		problem(FsckMissingBlob, errors.Wrap(err, "invalid digest"))
+		return
+	}
+	_, isCorrupt := fs.corrupt[descriptor.Digest]
+	size, exists := fs.sizes[descriptor.Digest]
+	if !isCorrupt && !exists {
+		// Blobs in additional blob stores are not listed with the blobs in
+		// the image, so we only check them once they are referenced.
+		var err error
+		if isCorrupt, exists, err = fs.checkSharedBlob(ctx, descriptor.Digest); err != nil {
+			problem(FsckMissingBlob, err)
+			return
+		}
+		size = fs.sizes[descriptor.Digest]
+	}
+	// Corrupt blobs have already been reported, but we need to mark them as
+	// being reachable.
+	if isCorrupt {
+		fs.seen[descriptor.Digest] = struct{}{}
+		return
+	}
+	if !exists {
+		// Non-distributable layers are usually not included in images, and
+		// are instead fetched from the URLs in their descriptor.
+		if mediatype.IsNonDistributable(descriptor.MediaType) {
+			log.Debugf("fsck: skipping missing non-distributable blob %s", descriptor.Digest)
+			return
+		}
+		problem(FsckMissingBlob, nil)
+		return
+	}
+	fs.seen[descriptor.Digest] = struct{}{}
+	if descriptor.Size != size {
+		problem(FsckSizeMismatch, errors.Errorf("descriptor has size %d but blob has size %d", descriptor.Size, size))
+		return
+	}
+	// Don't check the children of the same blob more than once (the same
+	// blobs are often referenced by several manifests).
+	if _, ok := fs.walked[descriptor.Digest]; ok {
+		return
+	}
+	fs.walked[descriptor.Digest] = struct{}{}
+
+	if mediatype.GetParser(descriptor.MediaType) == nil {
+		return
+	}
+	blob, err := fs.engine.FromDescriptor(ctx, descriptor)
+	if err != nil {
+		if errors.Cause(err) == cas.ErrUnknownType {
+			return
+		}
+		problem(FsckInvalidBlob, err)
+		return
+	}
+	children := childDescriptors(blob.Data)
+	if err := blob.Close(); err != nil {
+		problem(FsckInvalidBlob, errors.Wrap(err, "close blob"))
+		return
+	}
+
+	for _, child := range children {
+		fs.walk(ctx, DescriptorPath{
+			Walk: append(descriptorPath.Walk, child),
+		})
+	}
+}
+
+// Fsck checks the integrity of the OCI image referenced by the given CAS
+// engine. Every blob in the image is read and its contents are verified
+// against its digest, and then every descriptor reachable from the references
+// in the image is checked to make sure that it references an existing,
+// intact blob of the right size (which can be parsed as the right
+// media-type). Blobs which cannot be reached from any reference are reported
+// as FsckOrphanBlob problems. If the engine was created with
+// WithAdditionalBlobStores, referenced blobs which are only present in an
+// additional blob store are checked in the same way (but are never reported
+// as FsckOrphanBlob problems).
+//
+// An error is only returned if the image could not be checked at all -- any
+// problems with the image are returned in the FsckReport. Nothing in the
+// image is modified.
+func (e Engine) Fsck(ctx context.Context) (FsckReport, error) {
+	var report FsckReport
+
+	fs := &fsckState{
+		engine:  e,
+		sizes:   map[digest.Digest]int64{},
+		corrupt: map[digest.Digest]struct{}{},
+		seen:    map[digest.Digest]struct{}{},
+		walked:  map[digest.Digest]struct{}{},
+	}
+
+	blobs, err := e.ListBlobs(ctx)
+	if err != nil {
+		return report, errors.Wrap(err, "get blob list")
+	}
+	for _, digest := range blobs {
+		log.Debugf("fsck: checking blob %s", digest)
+		size, err := fs.checkBlob(ctx, digest)
+		if err != nil {
+			fs.corrupt[digest] = struct{}{}
+			fs.problems = append(fs.problems, FsckProblem{
+				Kind:   FsckCorruptBlob,
+				Digest: digest,
+				Err:    err,
+			})
+			continue
+		}
+		fs.sizes[digest] = size
+	}
+	report.Blobs = len(blobs)
+
+	index, err := e.GetIndex(ctx)
+	if err != nil {
+		return report, errors.Wrap(err, "get top-level index")
+	}
+	for _, descriptor := range index.Manifests {
+		log.Debugf("fsck: checking reference %s", descriptor.Digest)
+		fs.walk(ctx, DescriptorPath{
+			Walk: []ispec.Descriptor{descriptor},
+		})
+	}
+
+	for _, digest := range blobs {
+		if _, ok := fs.corrupt[digest]; ok {
+			continue
+		}
+		if _, ok := fs.seen[digest]; !ok {
+			fs.problems = append(fs.problems, FsckProblem{
+				Kind:   FsckOrphanBlob,
+				Digest: digest,
+			})
+		}
+	}
+
+	sort.SliceStable(fs.problems, func(i, j int) bool {
+		return fs.problems[i].Digest < fs.problems[j].Digest
+	})
+	report.SharedBlobs = fs.shared
+	report.Problems = fs.problems
+	return report, nil
+}
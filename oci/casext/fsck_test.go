@@ -0,0 +1,360 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ispecs "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/cas/dir"
+)
+
+// fsckSetupImage creates an image containing a single tagged manifest (with a
+// config and a single layer), returning the descriptors of the manifest,
+// config and layer.
+func fsckSetupImage(t *testing.T, engineExt Engine) (manifest, config, layer ispec.Descriptor) {
+	ctx := context.Background()
+
+	layerData := []byte("not really a layer")
+	layerDigest, layerSize, err := engineExt.PutBlob(ctx, bytes.NewReader(layerData))
+	if err != nil {
+		t.Fatalf("put layer: %+v", err)
+	}
+	layer = ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageLayer,
+		Digest:    layerDigest,
+		Size:      layerSize,
+	}
+
+	configDigest, configSize, err := engineExt.PutBlobJSON(ctx, ispec.Image{
+		OS:           "linux",
+		Architecture: "amd64",
+		RootFS: ispec.RootFS{
+			Type:    "layers",
+			DiffIDs: []digest.Digest{layerDigest},
+		},
+	})
+	if err != nil {
+		t.Fatalf("put config: %+v", err)
+	}
+	config = ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageConfig,
+		Digest:    configDigest,
+		Size:      configSize,
+	}
+
+	manifestDigest, manifestSize, err := engineExt.PutBlobJSON(ctx, ispec.Manifest{
+		Versioned: ispecs.Versioned{SchemaVersion: 2},
+		MediaType: ispec.MediaTypeImageManifest,
+		Config:    config,
+		Layers:    []ispec.Descriptor{layer},
+	})
+	if err != nil {
+		t.Fatalf("put manifest: %+v", err)
+	}
+	manifest = ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    manifestDigest,
+		Size:      manifestSize,
+	}
+
+	if err := engineExt.UpdateReference(ctx, "latest", manifest); err != nil {
+		t.Fatalf("update reference: %+v", err)
+	}
+	return manifest, config, layer
+}
+
+// fsckProblems returns the set of problems found by Fsck, keyed by digest.
+func fsckProblems(t *testing.T, engineExt Engine) map[digest.Digest]FsckProblemKind {
+	report, err := engineExt.Fsck(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected fsck error: %+v", err)
+	}
+	problems := map[digest.Digest]FsckProblemKind{}
+	for _, problem := range report.Problems {
+		t.Logf("fsck problem: %s", problem)
+		if kind, ok := problems[problem.Digest]; ok {
+			t.Errorf("got more than one problem for %s: %s and %s", problem.Digest, kind, problem.Kind)
+		}
+		problems[problem.Digest] = problem.Kind
+	}
+	return problems
+}
+
+func TestFsck(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestFsck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := NewEngine(engine)
+	defer engine.Close()
+
+	manifest, config, layer := fsckSetupImage(t, engineExt)
+
+	// A fresh image has no problems.
+	if problems := fsckProblems(t, engineExt); len(problems) != 0 {
+		t.Errorf("unexpected problems in fresh image: %v", problems)
+	}
+
+	// Orphan blobs are reported, but are not corruption.
+	orphanDigest, _, err := engineExt.PutBlob(ctx, bytes.NewReader([]byte("orphan")))
+	if err != nil {
+		t.Fatalf("put orphan: %+v", err)
+	}
+	report, err := engineExt.Fsck(ctx)
+	if err != nil {
+		t.Fatalf("unexpected fsck error: %+v", err)
+	}
+	if report.Blobs != 4 {
+		t.Errorf("expected fsck to check %d blobs, got %d", 4, report.Blobs)
+	}
+	if report.Corrupted() {
+		t.Errorf("orphan blobs should not be treated as corruption: %v", report.Problems)
+	}
+	if len(report.Problems) != 1 || report.Problems[0].Kind != FsckOrphanBlob || report.Problems[0].Digest != orphanDigest {
+		t.Errorf("expected only an orphan blob problem for %s, got %v", orphanDigest, report.Problems)
+	}
+
+	// Corrupt the layer blob.
+	layerPath := filepath.Join(image, "blobs", layer.Digest.Algorithm().String(), layer.Digest.Encoded())
+	if err := ioutil.WriteFile(layerPath, []byte("corrupted layer"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if problems := fsckProblems(t, engineExt); problems[layer.Digest] != FsckCorruptBlob {
+		t.Errorf("expected corrupt layer blob, got %v", problems)
+	}
+
+	// Remove the config blob.
+	if err := engineExt.DeleteBlob(ctx, config.Digest); err != nil {
+		t.Fatal(err)
+	}
+	problems := fsckProblems(t, engineExt)
+	if kind, ok := problems[config.Digest]; !ok || kind != FsckMissingBlob {
+		t.Errorf("expected missing config blob, got %v", problems)
+	}
+	if _, ok := problems[manifest.Digest]; ok {
+		t.Errorf("unexpected problem with intact manifest: %v", problems)
+	}
+
+	// Reference the orphan blob with the wrong size.
+	if err := engineExt.UpdateReference(ctx, "bad-size", ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    orphanDigest,
+		Size:      1337,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if problems := fsckProblems(t, engineExt); problems[orphanDigest] != FsckSizeMismatch {
+		t.Errorf("expected size mismatch for %s, got %v", orphanDigest, problems)
+	}
+
+	// Reference the orphan blob as a manifest with the right size.
+	if err := engineExt.UpdateReference(ctx, "bad-size", ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    orphanDigest,
+		Size:      int64(len("orphan")),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if problems := fsckProblems(t, engineExt); problems[orphanDigest] != FsckInvalidBlob {
+		t.Errorf("expected invalid blob for %s, got %v", orphanDigest, problems)
+	}
+}
+
+func TestFsckForeignLayer(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestFsckForeignLayer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := NewEngine(engine)
+	defer engine.Close()
+
+	_, config, layer := fsckSetupImage(t, engineExt)
+
+	// Missing non-distributable layers are not a problem, but other missing
+	// layers are.
+	foreignLayer := ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageLayerNonDistributableGzip,
+		Digest:    digest.FromString("foreign layer"),
+		Size:      1234,
+		URLs:      []string{"https://example.com/foreign-layer"},
+	}
+	missingLayer := ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageLayerGzip,
+		Digest:    digest.FromString("missing layer"),
+		Size:      1234,
+	}
+	manifestDigest, manifestSize, err := engineExt.PutBlobJSON(ctx, ispec.Manifest{
+		Versioned: ispecs.Versioned{SchemaVersion: 2},
+		MediaType: ispec.MediaTypeImageManifest,
+		Config:    config,
+		Layers:    []ispec.Descriptor{foreignLayer, layer, missingLayer},
+	})
+	if err != nil {
+		t.Fatalf("put manifest: %+v", err)
+	}
+	if err := engineExt.UpdateReference(ctx, "foreign", ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    manifestDigest,
+		Size:      manifestSize,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	problems := fsckProblems(t, engineExt)
+	if _, ok := problems[foreignLayer.Digest]; ok {
+		t.Errorf("missing non-distributable layer should not be a problem: %v", problems)
+	}
+	if kind, ok := problems[missingLayer.Digest]; !ok || kind != FsckMissingBlob {
+		t.Errorf("expected missing layer blob, got %v", problems)
+	}
+	if len(problems) != 1 {
+		t.Errorf("expected only one problem, got %v", problems)
+	}
+}
+
+func TestFsckAdditionalBlobStore(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestFsckAdditionalBlobStore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+	imageEngine, err := dir.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	defer imageEngine.Close()
+
+	_, config, layer := fsckSetupImage(t, NewEngine(imageEngine))
+
+	// Move the config and layer into a shared blob store.
+	store := filepath.Join(root, "shared")
+	if err := os.MkdirAll(filepath.Join(store, "sha256"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, descriptor := range []ispec.Descriptor{config, layer} {
+		path := filepath.Join(descriptor.Digest.Algorithm().String(), descriptor.Digest.Encoded())
+		if err := os.Rename(filepath.Join(image, "blobs", path), filepath.Join(store, path)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Without the shared blob store, the blobs are missing.
+	problems := fsckProblems(t, NewEngine(imageEngine))
+	if problems[config.Digest] != FsckMissingBlob || problems[layer.Digest] != FsckMissingBlob {
+		t.Errorf("expected missing config and layer blobs, got %v", problems)
+	}
+
+	// With the shared blob store, the image has no problems.
+	engine, err := WithAdditionalBlobStores(imageEngine, store)
+	if err != nil {
+		t.Fatalf("unexpected error adding additional blob store: %+v", err)
+	}
+	engineExt := NewEngine(engine)
+	report, err := engineExt.Fsck(ctx)
+	if err != nil {
+		t.Fatalf("unexpected fsck error: %+v", err)
+	}
+	if len(report.Problems) != 0 {
+		t.Errorf("unexpected problems with shared blobs: %v", report.Problems)
+	}
+	if report.Blobs != 1 || report.SharedBlobs != 2 {
+		t.Errorf("expected fsck to check 1 blob and 2 shared blobs, got %d and %d", report.Blobs, report.SharedBlobs)
+	}
+
+	// Shared blobs are still verified.
+	layerPath := filepath.Join(store, layer.Digest.Algorithm().String(), layer.Digest.Encoded())
+	if err := ioutil.WriteFile(layerPath, []byte("corrupted layer"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	report, err = engineExt.Fsck(ctx)
+	if err != nil {
+		t.Fatalf("unexpected fsck error: %+v", err)
+	}
+	if len(report.Problems) != 1 || report.Problems[0].Kind != FsckCorruptBlob || report.Problems[0].Digest != layer.Digest || !report.Problems[0].Shared {
+		t.Errorf("expected only a shared corrupt blob problem for %s, got %v", layer.Digest, report.Problems)
+	}
+
+	// As are their sizes.
+	if err := ioutil.WriteFile(layerPath, []byte("not really a layer!"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	newLayer := digest.FromString("not really a layer!")
+	if err := os.Rename(layerPath, filepath.Join(store, newLayer.Algorithm().String(), newLayer.Encoded())); err != nil {
+		t.Fatal(err)
+	}
+	manifestDigest, manifestSize, err := engineExt.PutBlobJSON(ctx, ispec.Manifest{
+		Versioned: ispecs.Versioned{SchemaVersion: 2},
+		MediaType: ispec.MediaTypeImageManifest,
+		Config:    config,
+		Layers:    []ispec.Descriptor{{MediaType: ispec.MediaTypeImageLayer, Digest: newLayer, Size: layer.Size}},
+	})
+	if err != nil {
+		t.Fatalf("put manifest: %+v", err)
+	}
+	if err := engineExt.UpdateReference(ctx, "latest", ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    manifestDigest,
+		Size:      manifestSize,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	problems = fsckProblems(t, engineExt)
+	if kind, ok := problems[newLayer]; !ok || kind != FsckSizeMismatch {
+		t.Errorf("expected size mismatch for shared layer, got %v", problems)
+	}
+}
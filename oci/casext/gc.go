@@ -19,6 +19,9 @@ package casext
 
 import (
 	"context"
+	"runtime"
+	"sort"
+	"sync"
 
 	"github.com/apex/log"
 	"github.com/opencontainers/go-digest"
@@ -29,6 +32,14 @@ import (
 // GCPolicy is a policy function that returns 'true' if a blob can be GC'ed
 type GCPolicy func(ctx context.Context, digest digest.Digest) (bool, error)
 
+// GCStats contains statistics about the blobs removed by a GC run.
+type GCStats struct {
+	// Blobs is the number of blobs that were removed.
+	Blobs int
+	// Bytes is the sum of the sizes of all of the blobs that were removed.
+	Bytes int64
+}
+
 // GC will perform a mark-and-sweep garbage collection of the OCI image
 // referenced by the given CAS engine. The root set is taken to be the set of
 // references stored in the image, and all blobs not reachable by following a
@@ -44,44 +55,29 @@ type GCPolicy func(ctx context.Context, digest digest.Digest) (bool, error)
 // blob's digest can indicate whether that blob needs to garbage collected. The
 // blob is skipped for garbage collection if a policy returns false.
 func (e Engine) GC(ctx context.Context, policies ...GCPolicy) error {
-	// Generate the root set of descriptors.
-	var root []ispec.Descriptor
-
-	index, err := e.GetIndex(ctx)
-	if err != nil {
-		return errors.Wrap(err, "get top-level index")
-	}
+	_, err := e.GCWithStats(ctx, policies...)
+	return err
+}
 
-	for _, descriptor := range index.Manifests {
-		log.WithFields(log.Fields{
-			"digest": descriptor.Digest,
-		}).Debugf("GC: got reference")
-		root = append(root, descriptor)
-	}
+// GCWithStats is identical to GC, except that it also returns statistics
+// about the blobs which were removed. The size of each removed blob is
+// computed with BlobSize before it is removed -- if the size cannot be
+// computed, the blob is still removed but is not included in GCStats.Bytes.
+func (e Engine) GCWithStats(ctx context.Context, policies ...GCPolicy) (GCStats, error) {
+	var stats GCStats
 
-	// Mark from the root sets.
-	black := map[digest.Digest]struct{}{}
-	for idx, descriptor := range root {
-		log.WithFields(log.Fields{
-			"digest": descriptor.Digest,
-		}).Debugf("GC: marking from root")
-
-		reachables, err := e.reachable(ctx, descriptor)
-		if err != nil {
-			return errors.Wrapf(err, "getting reachables from root %d", idx)
-		}
-		for _, reachable := range reachables {
-			black[reachable] = struct{}{}
-		}
+	// Mark from the root set.
+	black, err := e.reachableSet(ctx)
+	if err != nil {
+		return stats, err
 	}
 
 	// Sweep all blobs in the white set.
 	blobs, err := e.ListBlobs(ctx)
 	if err != nil {
-		return errors.Wrap(err, "get blob list")
+		return stats, errors.Wrap(err, "get blob list")
 	}
 
-	n := 0
 sweep:
 	for _, digest := range blobs {
 		if _, ok := black[digest]; ok {
@@ -92,7 +88,7 @@ sweep:
 		for i, policy := range policies {
 			ok, err := policy(ctx, digest)
 			if err != nil {
-				return errors.Wrapf(err, "invoking policy %d failed", i)
+				return stats, errors.Wrapf(err, "invoking policy %d failed", i)
 			}
 
 			if !ok {
@@ -103,17 +99,151 @@ sweep:
 		}
 		log.Debugf("garbage collecting blob: %s", digest)
 
+		size, err := e.BlobSize(ctx, digest)
+		if err != nil {
+			log.Warnf("could not get size of unmarked blob %s: %v", digest, err)
+			size = 0
+		}
 		if err := e.DeleteBlob(ctx, digest); err != nil {
-			return errors.Wrapf(err, "remove unmarked blob %s", digest)
+			return stats, errors.Wrapf(err, "remove unmarked blob %s", digest)
 		}
-		n++
+		stats.Blobs++
+		stats.Bytes += size
 	}
 
 	// Finally, tell CAS to GC it.
 	if err := e.Clean(ctx); err != nil {
-		return errors.Wrapf(err, "clean engine")
+		return stats, errors.Wrapf(err, "clean engine")
+	}
+
+	log.Debugf("garbage collected %d blobs (%d bytes)", stats.Blobs, stats.Bytes)
+	return stats, nil
+}
+
+// markSet is a thread-safe set of digests, used as the "black" set during the
+// mark phase of GC.
+type markSet struct {
+	lock    sync.Mutex
+	digests map[digest.Digest]struct{}
+}
+
+// mark adds the digest to the set, and returns whether it was newly added.
+func (m *markSet) mark(digest digest.Digest) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, ok := m.digests[digest]; ok {
+		return false
+	}
+	m.digests[digest] = struct{}{}
+	return true
+}
+
+// markFrom marks all of the blobs reachable from the given root descriptor.
+// Descriptors which have already been marked (by this walk or any other walk
+// sharing the same markSet) are not traversed further.
+func (e Engine) markFrom(ctx context.Context, root ispec.Descriptor, black *markSet) error {
+	return e.Walk(ctx, root, func(descriptorPath DescriptorPath) error {
+		if !black.mark(descriptorPath.Descriptor().Digest) {
+			// Don't traverse further if we've already seen this digest.
+			return ErrSkipDescriptor
+		}
+		return nil
+	})
+}
+
+// reachableSet returns the set of blobs reachable by following a descriptor
+// path from the root set of references stored in the image. This is the
+// "mark" phase of GC. Each root is walked concurrently by a bounded pool of
+// workers, and reachableSet only returns once every walk has completed.
+func (e Engine) reachableSet(ctx context.Context) (map[digest.Digest]struct{}, error) {
+	// Generate the root set of descriptors.
+	var root []ispec.Descriptor
+
+	index, err := e.GetIndex(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "get top-level index")
+	}
+
+	for _, descriptor := range index.Manifests {
+		log.WithFields(log.Fields{
+			"digest": descriptor.Digest,
+		}).Debugf("reachable: got reference")
+		root = append(root, descriptor)
 	}
 
-	log.Debugf("garbage collected %d blobs", n)
-	return nil
+	// Mark from the root sets. The first error cancels all other walks.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	black := &markSet{digests: map[digest.Digest]struct{}{}}
+
+	workers := runtime.GOMAXPROCS(0)
+	if workers > len(root) {
+		workers = len(root)
+	}
+	jobs := make(chan int)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range jobs {
+				descriptor := root[idx]
+				log.WithFields(log.Fields{
+					"digest": descriptor.Digest,
+				}).Debugf("reachable: marking from root")
+
+				if err := e.markFrom(ctx, descriptor, black); err != nil {
+					errOnce.Do(func() {
+						firstErr = errors.Wrapf(err, "getting reachables from root %d", idx)
+						cancel()
+					})
+				}
+			}
+		}()
+	}
+feed:
+	for idx := range root {
+		select {
+		case jobs <- idx:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	// If the caller's context was cancelled before every root was handed out,
+	// the black set is incomplete and must not be used for sweeping.
+	if err := ctx.Err(); err != nil {
+		return nil, errors.Wrap(err, "mark reachable blobs")
+	}
+	return black.digests, nil
+}
+
+// ReachableBlobs returns the (sorted and deduplicated) set of blobs which are
+// reachable by following a descriptor path from the root set of references
+// stored in the image -- in other words, the set of blobs which GC would not
+// remove. Nothing in the image is modified.
+func (e Engine) ReachableBlobs(ctx context.Context) ([]digest.Digest, error) {
+	black, err := e.reachableSet(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	digests := make([]digest.Digest, 0, len(black))
+	for digest := range black {
+		digests = append(digests, digest)
+	}
+	sort.Slice(digests, func(i, j int) bool {
+		return digests[i] < digests[j]
+	})
+	return digests, nil
 }
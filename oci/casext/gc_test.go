@@ -8,6 +8,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"testing"
 
@@ -213,6 +214,64 @@ func errFunc(ctx context.Context, digest digest.Digest) (bool, error) {
 	return false, fmt.Errorf("err policy")
 }
 
+func TestGCCorruptBlob(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestGCCorruptBlob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := NewEngine(engine)
+	defer engine.Close()
+
+	blobDigest, _, err := engineExt.PutBlob(ctx, bytes.NewBufferString("some orphan blob"))
+	if err != nil {
+		t.Fatalf("unexpected error putting blob: %+v", err)
+	}
+
+	// Corrupt the orphan blob.
+	const corrupted = "corrupted blob contents"
+	blobPath := filepath.Join(image, "blobs", blobDigest.Algorithm().String(), blobDigest.Encoded())
+	if err := os.Chmod(blobPath, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(blobPath, []byte(corrupted), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The size of a corrupted blob can still be computed.
+	size, err := engineExt.BlobSize(ctx, blobDigest)
+	if err != nil {
+		t.Fatalf("unexpected error getting size of corrupted blob: %+v", err)
+	}
+	if size != int64(len(corrupted)) {
+		t.Errorf("expected corrupted blob to have size %d, got %d", len(corrupted), size)
+	}
+
+	// ... and it must still be garbage collected.
+	stats, err := engineExt.GCWithStats(ctx)
+	if err != nil {
+		t.Fatalf("GC failed: %+v", err)
+	}
+	if stats.Blobs != 1 || stats.Bytes != int64(len(corrupted)) {
+		t.Errorf("unexpected GC stats: %#v", stats)
+	}
+	if _, err := os.Lstat(blobPath); !os.IsNotExist(err) {
+		t.Errorf("expected corrupted blob to be removed: %v", err)
+	}
+}
+
 func TestGCWithPolicy(t *testing.T) {
 	ctx := context.Background()
 
@@ -329,3 +388,302 @@ func TestGCWithPolicy(t *testing.T) {
 		t.Fatalf("expected blob list with two entries after GC: %#v", b)
 	}
 }
+
+func TestReachableBlobs(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestReachableBlobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := NewEngine(engine)
+	defer engine.Close()
+
+	descMap, err := fakeSetupEngine(t, engineExt)
+	if err != nil {
+		t.Fatalf("unexpected error doing fakeSetupEngine: %+v", err)
+	}
+
+	// Only reference the first image, so the rest become unreachable.
+	if err := engineExt.UpdateReference(ctx, "reachable", descMap[0].index); err != nil {
+		t.Fatalf("UpdateReference: unexpected error: %+v", err)
+	}
+
+	// Add an orphan blob which must not be reachable.
+	orphanDigest, _, err := engine.PutBlob(ctx, strings.NewReader("this is an orphan blob"))
+	if err != nil {
+		t.Fatalf("error writing blob: %+v", err)
+	}
+
+	before, err := engine.ListBlobs(ctx)
+	if err != nil {
+		t.Fatalf("unable to list blobs: %+v", err)
+	}
+
+	reachable, err := engineExt.ReachableBlobs(ctx)
+	if err != nil {
+		t.Fatalf("ReachableBlobs failed: %+v", err)
+	}
+	if len(reachable) == 0 {
+		t.Fatalf("expected non-empty reachable set")
+	}
+	for idx, digest := range reachable {
+		if digest == orphanDigest {
+			t.Errorf("orphan blob %s is reachable", orphanDigest)
+		}
+		if idx > 0 && reachable[idx-1] >= digest {
+			t.Errorf("reachable set is not sorted and deduplicated: %v", reachable)
+		}
+	}
+
+	// ReachableBlobs must not modify the image.
+	after, err := engine.ListBlobs(ctx)
+	if err != nil {
+		t.Fatalf("unable to list blobs: %+v", err)
+	}
+	if len(before) != len(after) {
+		t.Errorf("ReachableBlobs modified the image: had %d blobs, now have %d", len(before), len(after))
+	}
+
+	// GC must remove exactly the unreachable blobs.
+	stats, err := engineExt.GCWithStats(ctx)
+	if err != nil {
+		t.Fatalf("GC failed: %+v", err)
+	}
+	if stats.Blobs != len(before)-len(reachable) {
+		t.Errorf("GC stats report %d blobs removed, expected %d", stats.Blobs, len(before)-len(reachable))
+	}
+	if stats.Bytes <= 0 {
+		t.Errorf("GC stats report %d bytes freed, expected a positive number", stats.Bytes)
+	}
+	remaining, err := engine.ListBlobs(ctx)
+	if err != nil {
+		t.Fatalf("unable to list blobs: %+v", err)
+	}
+	sort.Slice(remaining, func(i, j int) bool {
+		return remaining[i] < remaining[j]
+	})
+	if len(remaining) != len(reachable) {
+		t.Fatalf("GC and ReachableBlobs disagree: reachable=%v remaining=%v", reachable, remaining)
+	}
+	for idx := range remaining {
+		if remaining[idx] != reachable[idx] {
+			t.Errorf("GC and ReachableBlobs disagree: reachable=%v remaining=%v", reachable, remaining)
+			break
+		}
+	}
+}
+
+// fakeSetupManyReferences creates a synthetic image with the given number of
+// references, each pointing to a manifest which shares a set of base layers
+// with every other manifest (as well as having its own layer and config). The
+// set of blobs reachable from the references is returned.
+func fakeSetupManyReferences(tb testing.TB, engineExt Engine, numRefs int) map[digest.Digest]struct{} {
+	ctx := context.Background()
+	reachable := map[digest.Digest]struct{}{}
+
+	putBlob := func(mediaType string, data []byte) ispec.Descriptor {
+		digest, size, err := engineExt.PutBlob(ctx, bytes.NewReader(data))
+		if err != nil {
+			tb.Fatalf("error writing blob: %+v", err)
+		}
+		reachable[digest] = struct{}{}
+		return ispec.Descriptor{
+			MediaType: mediaType,
+			Digest:    digest,
+			Size:      size,
+		}
+	}
+
+	var baseLayers []ispec.Descriptor
+	for idx := 0; idx < 4; idx++ {
+		baseLayers = append(baseLayers, putBlob(ispec.MediaTypeImageLayer, []byte(fmt.Sprintf("base layer %d", idx))))
+	}
+
+	for idx := 0; idx < numRefs; idx++ {
+		layers := append([]ispec.Descriptor{}, baseLayers...)
+		layers = append(layers, putBlob(ispec.MediaTypeImageLayer, []byte(fmt.Sprintf("layer for ref %d", idx))))
+
+		configData, err := json.Marshal(ispec.Image{
+			Author: fmt.Sprintf("ref %d", idx),
+			RootFS: ispec.RootFS{Type: "layers"},
+		})
+		if err != nil {
+			tb.Fatalf("error marshalling config: %+v", err)
+		}
+		config := putBlob(ispec.MediaTypeImageConfig, configData)
+
+		manifestData, err := json.Marshal(ispec.Manifest{
+			Versioned: imeta.Versioned{
+				SchemaVersion: 2,
+			},
+			MediaType: ispec.MediaTypeImageManifest,
+			Config:    config,
+			Layers:    layers,
+		})
+		if err != nil {
+			tb.Fatalf("error marshalling manifest: %+v", err)
+		}
+		manifest := putBlob(ispec.MediaTypeImageManifest, manifestData)
+
+		if err := engineExt.UpdateReference(ctx, fmt.Sprintf("tag%d", idx), manifest); err != nil {
+			tb.Fatalf("UpdateReference: unexpected error: %+v", err)
+		}
+	}
+
+	// Add some orphan blobs which must not be reachable.
+	for idx := 0; idx < 10; idx++ {
+		if _, _, err := engineExt.PutBlob(ctx, strings.NewReader(fmt.Sprintf("orphan blob %d", idx))); err != nil {
+			tb.Fatalf("error writing blob: %+v", err)
+		}
+	}
+	return reachable
+}
+
+func TestReachableBlobsManyReferences(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestReachableBlobsManyReferences")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := NewEngine(engine)
+	defer engine.Close()
+
+	expected := fakeSetupManyReferences(t, engineExt, 200)
+
+	reachable, err := engineExt.ReachableBlobs(ctx)
+	if err != nil {
+		t.Fatalf("ReachableBlobs failed: %+v", err)
+	}
+	if len(reachable) != len(expected) {
+		t.Errorf("expected %d reachable blobs, got %d", len(expected), len(reachable))
+	}
+	for _, digest := range reachable {
+		if _, ok := expected[digest]; !ok {
+			t.Errorf("unexpected reachable blob %s", digest)
+		}
+	}
+
+	stats, err := engineExt.GCWithStats(ctx)
+	if err != nil {
+		t.Fatalf("GC failed: %+v", err)
+	}
+	if stats.Blobs != 10 {
+		t.Errorf("expected GC to remove 10 orphan blobs, removed %d", stats.Blobs)
+	}
+}
+
+func TestGCMarkError(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestGCMarkError")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := NewEngine(engine)
+	defer engine.Close()
+
+	fakeSetupManyReferences(t, engineExt, 50)
+
+	// Remove one of the referenced manifests, so that one of the walks fails.
+	descriptors, err := engineExt.ResolveReference(ctx, "tag42")
+	if err != nil {
+		t.Fatalf("ResolveReference: unexpected error: %+v", err)
+	}
+	if len(descriptors) != 1 {
+		t.Fatalf("expected exactly one descriptor for tag42, got %d", len(descriptors))
+	}
+	if err := engine.DeleteBlob(ctx, descriptors[0].Descriptor().Digest); err != nil {
+		t.Fatalf("error deleting manifest blob: %+v", err)
+	}
+
+	before, err := engine.ListBlobs(ctx)
+	if err != nil {
+		t.Fatalf("unable to list blobs: %+v", err)
+	}
+
+	if _, err := engineExt.ReachableBlobs(ctx); err == nil {
+		t.Errorf("expected ReachableBlobs to fail with a missing manifest")
+	}
+	if err := engineExt.GC(ctx); err == nil {
+		t.Errorf("expected GC to fail with a missing manifest")
+	}
+
+	// A failed mark must not result in anything being swept.
+	after, err := engine.ListBlobs(ctx)
+	if err != nil {
+		t.Fatalf("unable to list blobs: %+v", err)
+	}
+	if len(before) != len(after) {
+		t.Errorf("GC with failed mark removed blobs: had %d blobs, now have %d", len(before), len(after))
+	}
+}
+
+func BenchmarkReachableBlobs(b *testing.B) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-BenchmarkReachableBlobs")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		b.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	engine, err := dir.Open(image)
+	if err != nil {
+		b.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := NewEngine(engine)
+	defer engine.Close()
+
+	expected := fakeSetupManyReferences(b, engineExt, 500)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		reachable, err := engineExt.ReachableBlobs(ctx)
+		if err != nil {
+			b.Fatalf("ReachableBlobs failed: %+v", err)
+		}
+		if len(reachable) != len(expected) {
+			b.Fatalf("expected %d reachable blobs, got %d", len(expected), len(reachable))
+		}
+	}
+}
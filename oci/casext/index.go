@@ -0,0 +1,184 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"context"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// samePlatform returns whether the two platforms are identical (ignoring any
+// optional fields such as os.version and os.features).
+func samePlatform(a, b *ispec.Platform) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.OS == b.OS && a.Architecture == b.Architecture && a.Variant == b.Variant
+}
+
+// Errors returned when a reference name cannot be resolved to a single
+// descriptor. These are always wrapped with the offending reference name.
+var (
+	// ErrReferenceNotFound is returned when a reference name does not match any
+	// descriptors.
+	ErrReferenceNotFound = errors.New("tag not found")
+
+	// ErrAmbiguousReference is returned when a reference name matches more
+	// than one descriptor.
+	ErrAmbiguousReference = errors.New("tag is ambiguous")
+)
+
+// ReferenceDescriptor returns the top-level descriptor for the given
+// reference name (unlike ResolveReference, the descriptor is not resolved any
+// further and so may refer to an image index). An error is returned if there
+// is not exactly one descriptor for the given reference name.
+func (e Engine) ReferenceDescriptor(ctx context.Context, refname string) (ispec.Descriptor, error) {
+	if !IsValidReferenceName(refname) {
+		return ispec.Descriptor{}, errors.Errorf("refusing to resolve invalid reference %q", refname)
+	}
+
+	index, err := e.GetIndex(ctx)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "get top-level index")
+	}
+
+	var roots []ispec.Descriptor
+	for _, descriptor := range index.Manifests {
+		if descriptor.Annotations[ispec.AnnotationRefName] == refname {
+			roots = append(roots, descriptor)
+		}
+	}
+	if len(roots) == 0 {
+		return ispec.Descriptor{}, errors.Wrap(ErrReferenceNotFound, refname)
+	}
+	if len(roots) != 1 {
+		return ispec.Descriptor{}, errors.Wrap(ErrAmbiguousReference, refname)
+	}
+	return roots[0], nil
+}
+
+// PutImageIndex adds the given image index as a new blob to the image, and
+// returns a descriptor for the new blob.
+func (e Engine) PutImageIndex(ctx context.Context, index ispec.Index) (ispec.Descriptor, error) {
+	if index.SchemaVersion == 0 {
+		index.SchemaVersion = 2
+	}
+	if index.Manifests == nil {
+		index.Manifests = []ispec.Descriptor{}
+	}
+
+	digest, size, err := e.PutBlobJSON(ctx, index)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "put index blob")
+	}
+	return ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageIndex,
+		Digest:    digest,
+		Size:      size,
+	}, nil
+}
+
+// getImageIndex returns the image index referenced by the given descriptor.
+func (e Engine) getImageIndex(ctx context.Context, descriptor ispec.Descriptor) (ispec.Index, error) {
+	if descriptor.MediaType != ispec.MediaTypeImageIndex {
+		return ispec.Index{}, errors.Errorf("descriptor does not point to an image index: %s", descriptor.MediaType)
+	}
+
+	blob, err := e.FromDescriptor(ctx, descriptor)
+	if err != nil {
+		return ispec.Index{}, errors.Wrap(err, "get index")
+	}
+	defer blob.Close()
+
+	index, ok := blob.Data.(ispec.Index)
+	if !ok {
+		// Should _never_ be reached.
+		return ispec.Index{}, errors.Errorf("[internal error] unknown index blob type: %s", blob.Descriptor.MediaType)
+	}
+	return index, nil
+}
+
+// IndexAddManifest creates a new image index, which is a copy of the image
+// index referenced by indexDescriptor with the given manifest added as the
+// image for the given platform. Any existing entry for the same platform is
+// replaced. The descriptor of the new image index is returned.
+func (e Engine) IndexAddManifest(ctx context.Context, indexDescriptor, manifestDescriptor ispec.Descriptor, platform ispec.Platform) (ispec.Descriptor, error) {
+	if manifestDescriptor.MediaType != ispec.MediaTypeImageManifest {
+		return ispec.Descriptor{}, errors.Errorf("descriptor does not point to an image manifest: %s", manifestDescriptor.MediaType)
+	}
+
+	index, err := e.getImageIndex(ctx, indexDescriptor)
+	if err != nil {
+		return ispec.Descriptor{}, err
+	}
+
+	// Don't copy over the reference name of the manifest (if it was taken
+	// from the top-level index).
+	entry := ispec.Descriptor{
+		MediaType: manifestDescriptor.MediaType,
+		Digest:    manifestDescriptor.Digest,
+		Size:      manifestDescriptor.Size,
+		URLs:      manifestDescriptor.URLs,
+		Platform:  &platform,
+	}
+	for key, value := range manifestDescriptor.Annotations {
+		if key == ispec.AnnotationRefName {
+			continue
+		}
+		if entry.Annotations == nil {
+			entry.Annotations = map[string]string{}
+		}
+		entry.Annotations[key] = value
+	}
+
+	var manifests []ispec.Descriptor
+	for _, descriptor := range index.Manifests {
+		if !samePlatform(descriptor.Platform, &platform) {
+			manifests = append(manifests, descriptor)
+		}
+	}
+	index.Manifests = append(manifests, entry)
+
+	return e.PutImageIndex(ctx, index)
+}
+
+// IndexRemovePlatform creates a new image index, which is a copy of the image
+// index referenced by indexDescriptor with all entries for the given platform
+// removed. The descriptor of the new image index is returned. An error is
+// returned if there were no entries for the given platform.
+func (e Engine) IndexRemovePlatform(ctx context.Context, indexDescriptor ispec.Descriptor, platform ispec.Platform) (ispec.Descriptor, error) {
+	index, err := e.getImageIndex(ctx, indexDescriptor)
+	if err != nil {
+		return ispec.Descriptor{}, err
+	}
+
+	manifests := []ispec.Descriptor{}
+	for _, descriptor := range index.Manifests {
+		if !samePlatform(descriptor.Platform, &platform) {
+			manifests = append(manifests, descriptor)
+		}
+	}
+	if len(manifests) == len(index.Manifests) {
+		return ispec.Descriptor{}, errors.Errorf("index has no entry for platform %s", FormatPlatform(platform))
+	}
+	index.Manifests = manifests
+
+	return e.PutImageIndex(ctx, index)
+}
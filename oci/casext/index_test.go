@@ -0,0 +1,140 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/cas/dir"
+)
+
+func TestIndexAddRemove(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestIndexAddRemove")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := NewEngine(engine)
+	defer engine.Close()
+
+	descMap, err := fakeSetupEngine(t, engineExt)
+	if err != nil {
+		t.Fatalf("unexpected error doing fakeSetupEngine: %+v", err)
+	}
+
+	indexDescriptor, err := engineExt.PutImageIndex(ctx, ispec.Index{})
+	if err != nil {
+		t.Fatalf("PutImageIndex: unexpected error: %+v", err)
+	}
+
+	amd64 := ispec.Platform{OS: "linux", Architecture: "amd64"}
+	arm64 := ispec.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}
+
+	manifest0 := descMap[0].result
+	manifest0.Annotations = map[string]string{ispec.AnnotationRefName: "foo"}
+	indexDescriptor, err = engineExt.IndexAddManifest(ctx, indexDescriptor, manifest0, amd64)
+	if err != nil {
+		t.Fatalf("IndexAddManifest(amd64): unexpected error: %+v", err)
+	}
+	indexDescriptor, err = engineExt.IndexAddManifest(ctx, indexDescriptor, descMap[1].result, arm64)
+	if err != nil {
+		t.Fatalf("IndexAddManifest(arm64): unexpected error: %+v", err)
+	}
+	// Replace the amd64 entry.
+	indexDescriptor, err = engineExt.IndexAddManifest(ctx, indexDescriptor, descMap[2].result, amd64)
+	if err != nil {
+		t.Fatalf("IndexAddManifest(amd64): unexpected error: %+v", err)
+	}
+
+	index, err := engineExt.getImageIndex(ctx, indexDescriptor)
+	if err != nil {
+		t.Fatalf("getImageIndex: unexpected error: %+v", err)
+	}
+	if len(index.Manifests) != 2 {
+		t.Fatalf("expected 2 entries in index, got %d", len(index.Manifests))
+	}
+	for _, entry := range index.Manifests {
+		if _, ok := entry.Annotations[ispec.AnnotationRefName]; ok {
+			t.Errorf("index entry %s has a ref.name annotation", entry.Digest)
+		}
+		switch FormatPlatform(*entry.Platform) {
+		case "linux/amd64":
+			if entry.Digest != descMap[2].result.Digest {
+				t.Errorf("amd64 entry was not replaced: got %s", entry.Digest)
+			}
+		case "linux/arm64/v8":
+			if entry.Digest != descMap[1].result.Digest {
+				t.Errorf("arm64 entry has wrong digest: got %s", entry.Digest)
+			}
+		default:
+			t.Errorf("unexpected platform in index: %v", entry.Platform)
+		}
+	}
+
+	// Only manifests can be added.
+	if _, err := engineExt.IndexAddManifest(ctx, indexDescriptor, indexDescriptor, amd64); err == nil {
+		t.Errorf("IndexAddManifest: expected error when adding an index")
+	}
+
+	indexDescriptor, err = engineExt.IndexRemovePlatform(ctx, indexDescriptor, amd64)
+	if err != nil {
+		t.Fatalf("IndexRemovePlatform: unexpected error: %+v", err)
+	}
+	if _, err := engineExt.IndexRemovePlatform(ctx, indexDescriptor, amd64); err == nil {
+		t.Errorf("IndexRemovePlatform: expected error when removing missing platform")
+	}
+
+	// Make sure the index resolves correctly.
+	if err := engineExt.UpdateReference(ctx, "multi", indexDescriptor); err != nil {
+		t.Fatalf("UpdateReference: unexpected error: %+v", err)
+	}
+	descriptorPaths, err := engineExt.ResolveReference(ctx, "multi")
+	if err != nil {
+		t.Fatalf("ResolveReference: unexpected error: %+v", err)
+	}
+	if len(descriptorPaths) != 1 || descriptorPaths[0].Descriptor().Digest != descMap[1].result.Digest {
+		t.Errorf("ResolveReference: got unexpected paths %#v", descriptorPaths)
+	}
+	refDescriptor, err := engineExt.ReferenceDescriptor(ctx, "multi")
+	if err != nil {
+		t.Fatalf("ReferenceDescriptor: unexpected error: %+v", err)
+	}
+	if refDescriptor.Digest != indexDescriptor.Digest {
+		t.Errorf("ReferenceDescriptor: expected %s, got %s", indexDescriptor.Digest, refDescriptor.Digest)
+	}
+	if _, err := engineExt.ReferenceDescriptor(ctx, "nonexistent"); err == nil {
+		t.Errorf("ReferenceDescriptor: expected error for missing reference")
+	}
+}
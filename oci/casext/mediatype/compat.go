@@ -0,0 +1,52 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mediatype
+
+import (
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// The image-spec version we currently import predates the standardisation of
+// zstd-compressed layers, so we define the relevant media-types here. Once we
+// update to a newer image-spec these should be switched to aliases of the
+// ispec constants.
+const (
+	// MediaTypeImageLayerZstd is the media type used for zstd compressed
+	// layers referenced by the manifest.
+	MediaTypeImageLayerZstd = "application/vnd.oci.image.layer.v1.tar+zstd"
+
+	// MediaTypeImageLayerNonDistributableZstd is the media type for zstd
+	// compressed layers referenced by the manifest but with distribution
+	// restrictions.
+	MediaTypeImageLayerNonDistributableZstd = "application/vnd.oci.image.layer.nondistributable.v1.tar+zstd"
+)
+
+// IsNonDistributable returns whether the given media type is one of the OCI
+// "non-distributable" layer media types. Blobs of such layers are usually not
+// included in images (or registries), and instead must be fetched from the
+// URLs listed in their descriptors. These are also known as "foreign" layers,
+// and are used most notably by Windows base images.
+func IsNonDistributable(mediaType string) bool {
+	switch mediaType {
+	case ispec.MediaTypeImageLayerNonDistributable,
+		ispec.MediaTypeImageLayerNonDistributableGzip,
+		MediaTypeImageLayerNonDistributableZstd:
+		return true
+	}
+	return false
+}
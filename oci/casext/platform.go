@@ -0,0 +1,161 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// ParsePlatform parses a platform specifier of the form
+// "os/architecture[/variant]" (such as "linux/arm64/v8").
+func ParsePlatform(platform string) (ispec.Platform, error) {
+	parts := strings.Split(platform, "/")
+	if len(parts) < 2 || len(parts) > 3 {
+		return ispec.Platform{}, errors.Errorf("invalid platform %q: must be of the form os/arch[/variant]", platform)
+	}
+	for _, part := range parts {
+		if part == "" {
+			return ispec.Platform{}, errors.Errorf("invalid platform %q: components cannot be empty", platform)
+		}
+	}
+	p := ispec.Platform{
+		OS:           parts[0],
+		Architecture: parts[1],
+	}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+	return p, nil
+}
+
+// FormatPlatform formats the given platform in the form accepted by
+// ParsePlatform.
+func FormatPlatform(platform ispec.Platform) string {
+	str := platform.OS + "/" + platform.Architecture
+	if platform.Variant != "" {
+		str += "/" + platform.Variant
+	}
+	return str
+}
+
+// matchPlatform returns whether the given platform satisfies the requested
+// platform. If the requested platform has no variant then any variant is
+// accepted.
+func matchPlatform(platform, want ispec.Platform) bool {
+	if platform.OS != want.OS || platform.Architecture != want.Architecture {
+		return false
+	}
+	return want.Variant == "" || platform.Variant == want.Variant
+}
+
+// DescriptorPlatform returns the platform of the image referenced by the
+// given descriptor path. If the descriptor contains platform information
+// (which is the case for manifests referenced by an index) that is used,
+// otherwise the platform is taken from the image configuration (if the
+// descriptor refers to an image manifest).
+func (e Engine) DescriptorPlatform(ctx context.Context, descriptorPath DescriptorPath) (*ispec.Platform, error) {
+	descriptor := descriptorPath.Descriptor()
+	if descriptor.Platform != nil {
+		return descriptor.Platform, nil
+	}
+	if descriptor.MediaType != ispec.MediaTypeImageManifest {
+		return nil, nil
+	}
+
+	manifestBlob, err := e.FromDescriptor(ctx, descriptor)
+	if err != nil {
+		return nil, errors.Wrap(err, "get manifest")
+	}
+	defer manifestBlob.Close()
+	manifest, ok := manifestBlob.Data.(ispec.Manifest)
+	if !ok {
+		// Should _never_ be reached.
+		return nil, errors.Errorf("[internal error] unknown manifest blob type: %s", manifestBlob.Descriptor.MediaType)
+	}
+
+	configBlob, err := e.FromDescriptor(ctx, manifest.Config)
+	if err != nil {
+		return nil, errors.Wrap(err, "get config")
+	}
+	defer configBlob.Close()
+	config, ok := configBlob.Data.(ispec.Image)
+	if !ok {
+		// Not an OCI image configuration, so we have no idea.
+		return nil, nil
+	}
+	variant, err := e.ConfigVariant(ctx, manifest.Config)
+	if err != nil {
+		return nil, errors.Wrap(err, "get config variant")
+	}
+	return &ispec.Platform{
+		OS:           config.OS,
+		Architecture: config.Architecture,
+		Variant:      variant,
+	}, nil
+}
+
+// ConfigVariant returns the CPU variant (the "variant" field) of the image
+// configuration referenced by the given descriptor, or "" if it has no
+// variant. The version of ispec.Image we use has no Variant field, so this
+// requires decoding the raw configuration blob.
+func (e Engine) ConfigVariant(ctx context.Context, descriptor ispec.Descriptor) (_ string, Err error) {
+	reader, err := e.GetVerifiedBlob(ctx, descriptor)
+	if err != nil {
+		return "", errors.Wrap(err, "get config blob")
+	}
+	defer func() {
+		if err := reader.Close(); err != nil && Err == nil {
+			Err = errors.Wrap(err, "close config blob")
+		}
+	}()
+
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return "", errors.Wrap(err, "read config blob")
+	}
+	var config struct {
+		Variant string `json:"variant,omitempty"`
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return "", errors.Wrap(err, "parse config blob")
+	}
+	return config.Variant, nil
+}
+
+// FilterPlatform returns the subset of the given descriptor paths (usually
+// from ResolveReference) which refer to images for the requested platform.
+// See DescriptorPlatform for how the platform of each image is determined.
+func (e Engine) FilterPlatform(ctx context.Context, descriptorPaths []DescriptorPath, platform ispec.Platform) ([]DescriptorPath, error) {
+	var matches []DescriptorPath
+	for _, descriptorPath := range descriptorPaths {
+		descPlatform, err := e.DescriptorPlatform(ctx, descriptorPath)
+		if err != nil {
+			return nil, errors.Wrapf(err, "get platform of %s", descriptorPath.Descriptor().Digest)
+		}
+		if descPlatform != nil && matchPlatform(*descPlatform, platform) {
+			matches = append(matches, descriptorPath)
+		}
+	}
+	return matches, nil
+}
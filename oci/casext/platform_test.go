@@ -0,0 +1,201 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/cas/dir"
+)
+
+func TestParsePlatform(t *testing.T) {
+	for _, test := range []struct {
+		input    string
+		platform ispec.Platform
+		valid    bool
+	}{
+		{"linux/amd64", ispec.Platform{OS: "linux", Architecture: "amd64"}, true},
+		{"linux/arm64/v8", ispec.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}, true},
+		{"windows/amd64", ispec.Platform{OS: "windows", Architecture: "amd64"}, true},
+		{"", ispec.Platform{}, false},
+		{"linux", ispec.Platform{}, false},
+		{"linux/", ispec.Platform{}, false},
+		{"/amd64", ispec.Platform{}, false},
+		{"linux/arm/", ispec.Platform{}, false},
+		{"linux/arm/v7/extra", ispec.Platform{}, false},
+	} {
+		platform, err := ParsePlatform(test.input)
+		if (err == nil) != test.valid {
+			t.Errorf("ParsePlatform(%q): expected valid=%v, got err=%v", test.input, test.valid, err)
+			continue
+		}
+		if !test.valid {
+			continue
+		}
+		if platform.OS != test.platform.OS || platform.Architecture != test.platform.Architecture || platform.Variant != test.platform.Variant {
+			t.Errorf("ParsePlatform(%q): expected %#v, got %#v", test.input, test.platform, platform)
+		}
+		if got := FormatPlatform(platform); got != test.input {
+			t.Errorf("FormatPlatform(ParsePlatform(%q)): got %q", test.input, got)
+		}
+	}
+}
+
+func TestFilterPlatform(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestFilterPlatform")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := NewEngine(engine)
+	defer engine.Close()
+
+	platforms := []ispec.Platform{
+		{OS: "linux", Architecture: "amd64"},
+		{OS: "linux", Architecture: "arm64", Variant: "v8"},
+		{OS: "linux", Architecture: "arm", Variant: "v7"},
+		{OS: "linux", Architecture: "arm", Variant: "v6"},
+	}
+
+	// Create a multi-platform index with an image for each platform.
+	var index ispec.Index
+	index.SchemaVersion = 2
+	for idx, platform := range platforms {
+		platform := platform
+
+		// The author is set to make sure each image has a unique digest.
+		configDigest, configSize, err := engineExt.PutBlobJSON(ctx, ispec.Image{
+			OS:           platform.OS,
+			Architecture: platform.Architecture,
+			Author:       FormatPlatform(platform),
+		})
+		if err != nil {
+			t.Fatalf("put config %d: %+v", idx, err)
+		}
+		manifest := ispec.Manifest{
+			Config: ispec.Descriptor{
+				MediaType: ispec.MediaTypeImageConfig,
+				Digest:    configDigest,
+				Size:      configSize,
+			},
+			Layers: []ispec.Descriptor{},
+		}
+		manifest.SchemaVersion = 2
+		manifestDigest, manifestSize, err := engineExt.PutBlobJSON(ctx, manifest)
+		if err != nil {
+			t.Fatalf("put manifest %d: %+v", idx, err)
+		}
+		index.Manifests = append(index.Manifests, ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageManifest,
+			Digest:    manifestDigest,
+			Size:      manifestSize,
+			Platform:  &platform,
+		})
+	}
+	indexDigest, indexSize, err := engineExt.PutBlobJSON(ctx, index)
+	if err != nil {
+		t.Fatalf("put index: %+v", err)
+	}
+	if err := engineExt.UpdateReference(ctx, "multi", ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageIndex,
+		Digest:    indexDigest,
+		Size:      indexSize,
+	}); err != nil {
+		t.Fatalf("UpdateReference: %+v", err)
+	}
+
+	descriptorPaths, err := engineExt.ResolveReference(ctx, "multi")
+	if err != nil {
+		t.Fatalf("ResolveReference: %+v", err)
+	}
+	if len(descriptorPaths) != len(platforms) {
+		t.Fatalf("ResolveReference: expected %d paths, got %d", len(platforms), len(descriptorPaths))
+	}
+
+	for _, test := range []struct {
+		platform string
+		expected []string
+	}{
+		{"linux/amd64", []string{"linux/amd64"}},
+		{"linux/arm64", []string{"linux/arm64/v8"}},
+		{"linux/arm64/v8", []string{"linux/arm64/v8"}},
+		{"linux/arm/v7", []string{"linux/arm/v7"}},
+		{"linux/arm", []string{"linux/arm/v6", "linux/arm/v7"}},
+		{"linux/arm64/v9", nil},
+		{"windows/amd64", nil},
+	} {
+		platform, err := ParsePlatform(test.platform)
+		if err != nil {
+			t.Fatalf("ParsePlatform(%q): %+v", test.platform, err)
+		}
+		matches, err := engineExt.FilterPlatform(ctx, descriptorPaths, platform)
+		if err != nil {
+			t.Errorf("FilterPlatform(%q): unexpected error: %+v", test.platform, err)
+			continue
+		}
+		var got []string
+		for _, match := range matches {
+			descPlatform, err := engineExt.DescriptorPlatform(ctx, match)
+			if err != nil {
+				t.Fatalf("DescriptorPlatform: %+v", err)
+			}
+			got = append(got, FormatPlatform(*descPlatform))
+		}
+		sort.Strings(got)
+		if len(got) != len(test.expected) {
+			t.Errorf("FilterPlatform(%q): expected %v, got %v", test.platform, test.expected, got)
+			continue
+		}
+		for idx := range got {
+			if got[idx] != test.expected[idx] {
+				t.Errorf("FilterPlatform(%q): expected %v, got %v", test.platform, test.expected, got)
+				break
+			}
+		}
+	}
+
+	// Images without platform information in their descriptor fall back to
+	// the platform in their configuration.
+	manifestPath := DescriptorPath{Walk: []ispec.Descriptor{index.Manifests[0]}}
+	manifestPath.Walk[0].Platform = nil
+	platform, err := engineExt.DescriptorPlatform(ctx, manifestPath)
+	if err != nil {
+		t.Fatalf("DescriptorPlatform: %+v", err)
+	}
+	if platform == nil || FormatPlatform(*platform) != "linux/amd64" {
+		t.Errorf("DescriptorPlatform without descriptor platform: expected linux/amd64, got %v", platform)
+	}
+}
@@ -0,0 +1,140 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// ManifestSubject returns the subject (the "subject" field, which refers to
+// the manifest that a referrer such as a signature or SBOM is attached to) of
+// the manifest or image index referenced by the given descriptor, or nil if it
+// has no subject. The version of the image-spec we use has no Subject field,
+// so this requires decoding the raw blob.
+func (e Engine) ManifestSubject(ctx context.Context, descriptor ispec.Descriptor) (_ *ispec.Descriptor, Err error) {
+	reader, err := e.GetVerifiedBlob(ctx, descriptor)
+	if err != nil {
+		return nil, errors.Wrap(err, "get manifest blob")
+	}
+	defer func() {
+		if err := reader.Close(); err != nil && Err == nil {
+			Err = errors.Wrap(err, "close manifest blob")
+		}
+	}()
+
+	var manifest struct {
+		Subject *ispec.Descriptor `json:"subject,omitempty"`
+	}
+	if err := json.NewDecoder(reader).Decode(&manifest); err != nil {
+		return nil, errors.Wrap(err, "parse manifest blob")
+	}
+	return manifest.Subject, nil
+}
+
+// Referrers returns the descriptors of the manifests and image indexes in the
+// top-level index whose subject (see ManifestSubject) is the blob with the
+// given digest. Each referrer is only returned once, even if it is referenced
+// by more than one entry in the top-level index.
+func (e Engine) Referrers(ctx context.Context, subject digest.Digest) ([]ispec.Descriptor, error) {
+	index, err := e.GetIndex(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "get top-level index")
+	}
+
+	var (
+		referrers []ispec.Descriptor
+		seen      = map[digest.Digest]struct{}{}
+	)
+	for _, descriptor := range index.Manifests {
+		if descriptor.MediaType != ispec.MediaTypeImageManifest && descriptor.MediaType != ispec.MediaTypeImageIndex {
+			continue
+		}
+		if _, ok := seen[descriptor.Digest]; ok {
+			continue
+		}
+		seen[descriptor.Digest] = struct{}{}
+
+		descriptorSubject, err := e.ManifestSubject(ctx, descriptor)
+		if err != nil {
+			return nil, errors.Wrapf(err, "get subject of %s", descriptor.Digest)
+		}
+		if descriptorSubject != nil && descriptorSubject.Digest == subject {
+			referrers = append(referrers, descriptor)
+		}
+	}
+	return referrers, nil
+}
+
+// AddReferrer adds the given manifest (or image index) descriptor to the
+// top-level index without a reference name, so that it will be returned by
+// Referrers (and will not be garbage collected) without needing to be
+// tagged. The manifest must have a subject. If the top-level index already
+// contains the manifest, AddReferrer does nothing.
+func (e Engine) AddReferrer(ctx context.Context, descriptor ispec.Descriptor) error {
+	if descriptor.MediaType != ispec.MediaTypeImageManifest && descriptor.MediaType != ispec.MediaTypeImageIndex {
+		return errors.Errorf("add referrer: unsupported media type %s", descriptor.MediaType)
+	}
+	subject, err := e.ManifestSubject(ctx, descriptor)
+	if err != nil {
+		return errors.Wrap(err, "add referrer")
+	}
+	if subject == nil {
+		return errors.Errorf("add referrer: %s has no subject", descriptor.Digest)
+	}
+
+	unlock, err := e.lockIndex(ctx)
+	if err != nil {
+		return errors.Wrap(err, "lock top-level index")
+	}
+	defer unlock()
+
+	index, err := e.GetIndex(ctx)
+	if err != nil {
+		return errors.Wrap(err, "get top-level index")
+	}
+	for _, existing := range index.Manifests {
+		if existing.Digest == descriptor.Digest {
+			return nil
+		}
+	}
+
+	// Referrers are not tagged, so make sure we don't add a stale reference
+	// name (and thus a tag) to the index.
+	var annotations map[string]string
+	for k, v := range descriptor.Annotations {
+		if k == ispec.AnnotationRefName {
+			continue
+		}
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+		annotations[k] = v
+	}
+	descriptor.Annotations = annotations
+
+	index.Manifests = append(index.Manifests, descriptor)
+	if err := e.PutIndex(ctx, index); err != nil {
+		return errors.Wrap(err, "replace index")
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/cas/dir"
+)
+
+// referrersTestManifest is an image-spec v1.1 manifest (with a subject), which
+// our vendored image-spec doesn't support yet.
+type referrersTestManifest struct {
+	ispec.Manifest
+	Subject *ispec.Descriptor `json:"subject,omitempty"`
+}
+
+// putReferrersTestManifest adds a manifest with the given subject (and with
+// the given author, to make sure each manifest has a unique digest).
+func putReferrersTestManifest(t *testing.T, engineExt Engine, author string, subject *ispec.Descriptor) ispec.Descriptor {
+	ctx := context.Background()
+
+	configDigest, configSize, err := engineExt.PutBlobJSON(ctx, ispec.Image{Author: author})
+	if err != nil {
+		t.Fatalf("put config: %+v", err)
+	}
+	manifest := referrersTestManifest{
+		Manifest: ispec.Manifest{
+			MediaType: ispec.MediaTypeImageManifest,
+			Config: ispec.Descriptor{
+				MediaType: ispec.MediaTypeImageConfig,
+				Digest:    configDigest,
+				Size:      configSize,
+			},
+			Layers: []ispec.Descriptor{},
+		},
+		Subject: subject,
+	}
+	manifest.SchemaVersion = 2
+	manifestDigest, manifestSize, err := engineExt.PutBlobJSON(ctx, manifest)
+	if err != nil {
+		t.Fatalf("put manifest: %+v", err)
+	}
+	return ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    manifestDigest,
+		Size:      manifestSize,
+	}
+}
+
+func TestReferrers(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestReferrers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := NewEngine(engine)
+	defer engine.Close()
+
+	subject := putReferrersTestManifest(t, engineExt, "subject", nil)
+	other := putReferrersTestManifest(t, engineExt, "other", nil)
+	if err := engineExt.UpdateReference(ctx, "subject", subject); err != nil {
+		t.Fatalf("UpdateReference: %+v", err)
+	}
+
+	if got, err := engineExt.ManifestSubject(ctx, subject); err != nil {
+		t.Fatalf("ManifestSubject: %+v", err)
+	} else if got != nil {
+		t.Errorf("ManifestSubject: expected no subject, got %v", got)
+	}
+
+	sbom := putReferrersTestManifest(t, engineExt, "sbom", &subject)
+	signature := putReferrersTestManifest(t, engineExt, "signature", &subject)
+	unrelated := putReferrersTestManifest(t, engineExt, "unrelated", &other)
+
+	if got, err := engineExt.ManifestSubject(ctx, sbom); err != nil {
+		t.Fatalf("ManifestSubject: %+v", err)
+	} else if got == nil || got.Digest != subject.Digest {
+		t.Errorf("ManifestSubject: expected subject %s, got %v", subject.Digest, got)
+	}
+
+	// Referrers must be in the index to be found.
+	referrers, err := engineExt.Referrers(ctx, subject.Digest)
+	if err != nil {
+		t.Fatalf("Referrers: %+v", err)
+	}
+	if len(referrers) != 0 {
+		t.Errorf("Referrers: expected no referrers before AddReferrer, got %v", referrers)
+	}
+
+	for _, descriptor := range []ispec.Descriptor{sbom, unrelated, sbom} {
+		if err := engineExt.AddReferrer(ctx, descriptor); err != nil {
+			t.Fatalf("AddReferrer: %+v", err)
+		}
+	}
+	// Tagged referrers are also found.
+	if err := engineExt.UpdateReference(ctx, "signature", signature); err != nil {
+		t.Fatalf("UpdateReference: %+v", err)
+	}
+	// Manifests without a subject cannot be added as referrers.
+	if err := engineExt.AddReferrer(ctx, other); err == nil {
+		t.Errorf("AddReferrer: expected error adding manifest without subject")
+	}
+
+	index, err := engineExt.GetIndex(ctx)
+	if err != nil {
+		t.Fatalf("GetIndex: %+v", err)
+	}
+	if len(index.Manifests) != 4 {
+		t.Errorf("expected 4 index entries (AddReferrer should not add duplicates), got %d", len(index.Manifests))
+	}
+	refs, err := engineExt.ListReferences(ctx)
+	if err != nil {
+		t.Fatalf("ListReferences: %+v", err)
+	}
+	if len(refs) != 2 {
+		t.Errorf("ListReferences: expected referrers to be untagged, got %v", refs)
+	}
+
+	referrers, err = engineExt.Referrers(ctx, subject.Digest)
+	if err != nil {
+		t.Fatalf("Referrers: %+v", err)
+	}
+	if len(referrers) != 2 || referrers[0].Digest != sbom.Digest || referrers[1].Digest != signature.Digest {
+		t.Errorf("Referrers: expected [%s %s], got %v", sbom.Digest, signature.Digest, referrers)
+	}
+
+	referrers, err = engineExt.Referrers(ctx, other.Digest)
+	if err != nil {
+		t.Fatalf("Referrers: %+v", err)
+	}
+	if len(referrers) != 1 || referrers[0].Digest != unrelated.Digest {
+		t.Errorf("Referrers: expected [%s], got %v", unrelated.Digest, referrers)
+	}
+
+	// Referrers in the index are not garbage collected.
+	if err := engineExt.GC(ctx); err != nil {
+		t.Fatalf("GC: %+v", err)
+	}
+	if _, err := engineExt.ManifestSubject(ctx, unrelated); err != nil {
+		t.Errorf("referrer was garbage collected: %+v", err)
+	}
+}
@@ -19,11 +19,19 @@ package casext
 
 import (
 	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
 	"regexp"
+	"sort"
+	"strings"
 
 	"github.com/apex/log"
+	"github.com/opencontainers/go-digest"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/cas"
 	"github.com/opencontainers/umoci/oci/casext/mediatype"
+	"github.com/opencontainers/umoci/pkg/system"
 	"github.com/pkg/errors"
 )
 
@@ -44,6 +52,179 @@ func IsValidReferenceName(refname string) bool {
 	return refnameRegex.MatchString(refname)
 }
 
+// AnnotationReferencePrefix is the prefix of a reference which selects
+// descriptors by an arbitrary annotation rather than by their
+// "org.opencontainers.image.ref.name" annotation. Such references are of the
+// form "@annotation:<key>=<value>" (such as
+// "@annotation:com.example.build=123"), and can only be used to resolve
+// references -- not to update or delete them.
+const AnnotationReferencePrefix = "@annotation:"
+
+// ParseAnnotationReference parses a reference of the form
+// "@annotation:<key>=<value>" (see AnnotationReferencePrefix), returning the
+// annotation key and value. ok is false if refname is not an annotation
+// reference, and an error is returned if it is a malformed one.
+func ParseAnnotationReference(refname string) (key, value string, ok bool, err error) {
+	if !strings.HasPrefix(refname, AnnotationReferencePrefix) {
+		return "", "", false, nil
+	}
+	selector := strings.TrimPrefix(refname, AnnotationReferencePrefix)
+	parts := strings.SplitN(selector, "=", 2)
+	if len(parts) != 2 {
+		return "", "", true, errors.Errorf("invalid annotation reference %q: must be of the form %s<key>=<value>", refname, AnnotationReferencePrefix)
+	}
+	if parts[0] == "" {
+		return "", "", true, errors.Errorf("invalid annotation reference %q: annotation key must not be empty", refname)
+	}
+	return parts[0], parts[1], true, nil
+}
+
+// DigestReferencePrefix is the prefix of a reference which selects a manifest
+// (or image index) blob by its digest rather than by any tag. Such references
+// are of the form "@<algorithm>:<encoded>" (such as "@sha256:abcd"), where
+// <encoded> may be a prefix of the full encoded digest so long as it is
+// unambiguous. Blobs selected this way do not need to be referenced by the
+// top-level index. Like annotation references, digest references can only be
+// used to resolve references -- not to update or delete them.
+const DigestReferencePrefix = "@"
+
+// ParseDigestReference parses a reference of the form "@<algorithm>:<encoded>"
+// (see DigestReferencePrefix), returning the algorithm and (possibly
+// truncated) encoded digest. ok is false if refname is not a digest reference,
+// and an error is returned if it is a malformed one.
+func ParseDigestReference(refname string) (algorithm digest.Algorithm, encoded string, ok bool, err error) {
+	if !strings.HasPrefix(refname, DigestReferencePrefix) || strings.HasPrefix(refname, AnnotationReferencePrefix) {
+		return "", "", false, nil
+	}
+	parts := strings.SplitN(strings.TrimPrefix(refname, DigestReferencePrefix), ":", 2)
+	if len(parts) != 2 {
+		return "", "", true, errors.Errorf("invalid digest reference %q: must be of the form %s<algorithm>:<encoded>", refname, DigestReferencePrefix)
+	}
+	algorithm, encoded = digest.Algorithm(parts[0]), parts[1]
+	if !algorithm.Available() {
+		return "", "", true, errors.Errorf("invalid digest reference %q: unsupported digest algorithm %q", refname, algorithm)
+	}
+	if encoded == "" {
+		return "", "", true, errors.Errorf("invalid digest reference %q: digest must not be empty", refname)
+	}
+	if len(encoded) > 2*algorithm.Size() || strings.Trim(encoded, "0123456789abcdef") != "" {
+		return "", "", true, errors.Errorf("invalid digest reference %q: not a (prefix of a) valid %s digest", refname, algorithm)
+	}
+	return algorithm, encoded, true, nil
+}
+
+// sniffedBlob is the subset of the fields of manifests and image indexes used
+// to detect the media-type of blobs which are not referenced by a descriptor.
+type sniffedBlob struct {
+	MediaType string             `json:"mediaType"`
+	Config    *ispec.Descriptor  `json:"config"`
+	Layers    []ispec.Descriptor `json:"layers"`
+	Manifests []ispec.Descriptor `json:"manifests"`
+}
+
+// countingReader is an io.Reader which counts the number of bytes read.
+type countingReader struct {
+	reader io.Reader
+	n      int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// sniffDescriptor returns a descriptor for the manifest or image index blob
+// with the given digest. ok is false if the blob is not a manifest or image
+// index (in which case only as much of the blob as needed to determine this
+// is read).
+func (e Engine) sniffDescriptor(ctx context.Context, blobDigest digest.Digest) (ispec.Descriptor, bool, error) {
+	blob, err := e.GetBlob(ctx, blobDigest)
+	if err != nil {
+		return ispec.Descriptor{}, false, errors.Wrap(err, "get blob")
+	}
+	defer blob.Close()
+
+	reader := &countingReader{reader: blob}
+	var sniffed sniffedBlob
+	if err := json.NewDecoder(reader).Decode(&sniffed); err != nil {
+		// Not a JSON blob (such as a layer).
+		return ispec.Descriptor{}, false, nil
+	}
+
+	mediaType := sniffed.MediaType
+	if mediaType == "" {
+		// The mediaType field is optional in older versions of the image
+		// specification, so fall back to the structure of the blob.
+		switch {
+		case sniffed.Manifests != nil:
+			mediaType = ispec.MediaTypeImageIndex
+		case sniffed.Config != nil && sniffed.Layers != nil:
+			mediaType = ispec.MediaTypeImageManifest
+		}
+	}
+	if mediaType != ispec.MediaTypeImageManifest && mediaType != ispec.MediaTypeImageIndex {
+		return ispec.Descriptor{}, false, nil
+	}
+
+	// Get the full size of the blob.
+	if _, err := system.Copy(ioutil.Discard, reader); err != nil {
+		return ispec.Descriptor{}, false, errors.Wrap(err, "read blob")
+	}
+	return ispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    blobDigest,
+		Size:      reader.n,
+	}, true, nil
+}
+
+// resolveDigestReference returns the descriptor of the manifest or image
+// index blob whose digest matches the given (possibly truncated) digest. If a
+// top-level descriptor in the index refers to the blob, that descriptor is
+// returned (so that its annotations and platform are retained). An error is
+// returned if more than one blob matches, and ok is false if none do.
+func (e Engine) resolveDigestReference(ctx context.Context, index ispec.Index, algorithm digest.Algorithm, encoded string) (_ ispec.Descriptor, ok bool, _ error) {
+	prefix := algorithm.String() + ":" + encoded
+
+	blobs, err := e.ListBlobs(ctx)
+	if err != nil {
+		return ispec.Descriptor{}, false, errors.Wrap(err, "list blobs")
+	}
+	var candidates []ispec.Descriptor
+	for _, blobDigest := range blobs {
+		if !strings.HasPrefix(blobDigest.String(), prefix) {
+			continue
+		}
+		descriptor, ok, err := e.sniffDescriptor(ctx, blobDigest)
+		if err != nil {
+			return ispec.Descriptor{}, false, errors.Wrapf(err, "inspect blob %s", blobDigest)
+		}
+		if ok {
+			candidates = append(candidates, descriptor)
+		}
+	}
+
+	switch len(candidates) {
+	case 0:
+		return ispec.Descriptor{}, false, nil
+	case 1:
+	default:
+		var digests []string
+		for _, candidate := range candidates {
+			digests = append(digests, candidate.Digest.String())
+		}
+		sort.Strings(digests)
+		return ispec.Descriptor{}, false, errors.Wrapf(ErrAmbiguousReference, "digest reference %s%s matches %s", DigestReferencePrefix, prefix, strings.Join(digests, ", "))
+	}
+
+	for _, descriptor := range index.Manifests {
+		if descriptor.Digest == candidates[0].Digest {
+			return descriptor, true, nil
+		}
+	}
+	return candidates[0], true, nil
+}
+
 // ResolveReference will attempt to resolve all possible descriptor paths to
 // Manifests (or any unknown blobs) that match a particular reference name (if
 // descriptors are stored in non-standard blobs, Resolve will be unable to find
@@ -53,15 +234,34 @@ func IsValidReferenceName(refname string) bool {
 // that if the returned slice of descriptors is greater than zero that the user
 // be consulted to resolve the conflict (due to ambiguity in resolution paths).
 //
+// If refname is of the form "@annotation:<key>=<value>" (see
+// AnnotationReferencePrefix), the top-level descriptors with the given value
+// for the given annotation key are used instead of those with a matching
+// "org.opencontainers.image.ref.name" annotation. If refname is of the form
+// "@<algorithm>:<encoded>" (see DigestReferencePrefix), the manifest or image
+// index blob with a matching digest is used instead (even if it is not
+// referenced by the top-level index).
+//
 // TODO: How are we meant to implement other restrictions such as the
 //
 //	architecture and feature flags? The API will need to change.
 func (e Engine) ResolveReference(ctx context.Context, refname string) ([]DescriptorPath, error) {
-	// XXX: It should be possible to override this somehow, in case we are
-	//      dealing with an image that abuses the image specification in some
-	//      way.
-	if !IsValidReferenceName(refname) {
-		return nil, errors.Errorf("refusing to resolve invalid reference %q", refname)
+	annotationKey, annotationValue, byAnnotation, err := ParseAnnotationReference(refname)
+	if err != nil {
+		return nil, err
+	}
+	digestAlgorithm, digestEncoded, byDigest, err := ParseDigestReference(refname)
+	if err != nil {
+		return nil, err
+	}
+	if !byAnnotation && !byDigest {
+		// XXX: It should be possible to override this somehow, in case we are
+		//      dealing with an image that abuses the image specification in
+		//      some way.
+		if !IsValidReferenceName(refname) {
+			return nil, errors.Errorf("refusing to resolve invalid reference %q", refname)
+		}
+		annotationKey, annotationValue = ispec.AnnotationRefName, refname
 	}
 
 	index, err := e.GetIndex(ctx)
@@ -72,13 +272,26 @@ func (e Engine) ResolveReference(ctx context.Context, refname string) ([]Descrip
 	// Set of root links that match the given refname.
 	var roots []ispec.Descriptor
 
+	if byDigest {
+		root, ok, err := e.resolveDigestReference(ctx, index, digestAlgorithm, digestEncoded)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			roots = append(roots, root)
+		}
+	}
+
 	// We only consider the case where AnnotationRefName is defined on the
 	// top-level of the index tree. While this isn't codified in the spec (at
 	// the time of writing -- 1.0.0-rc5) there are some discussions to add this
 	// restriction in 1.0.0-rc6.
 	for _, descriptor := range index.Manifests {
+		if byDigest {
+			break
+		}
 		// XXX: What should we do if refname == "".
-		if descriptor.Annotations[ispec.AnnotationRefName] == refname {
+		if value, ok := descriptor.Annotations[annotationKey]; ok && value == annotationValue {
 			roots = append(roots, descriptor)
 		}
 	}
@@ -126,6 +339,12 @@ func (e Engine) UpdateReference(ctx context.Context, refname string, descriptor
 		return errors.Errorf("refusing to update invalid reference %q", refname)
 	}
 
+	unlock, err := e.lockIndex(ctx)
+	if err != nil {
+		return errors.Wrap(err, "lock top-level index")
+	}
+	defer unlock()
+
 	// Get index to modify.
 	index, err := e.GetIndex(ctx)
 	if err != nil {
@@ -159,6 +378,24 @@ func (e Engine) UpdateReference(ctx context.Context, refname string, descriptor
 	return nil
 }
 
+// lockIndex acquires the index lock of the underlying cas.Engine (if it
+// implements cas.IndexLocker). The returned function releases the lock.
+func (e Engine) lockIndex(ctx context.Context) (func(), error) {
+	locker, ok := e.Engine.(cas.IndexLocker)
+	if !ok {
+		return func() {}, nil
+	}
+	unlock, err := locker.LockIndex(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		if err := unlock(); err != nil {
+			log.Warnf("failed to unlock index: %v", err)
+		}
+	}, nil
+}
+
 // DeleteReference removes all entries in the index that match the given
 // refname.
 func (e Engine) DeleteReference(ctx context.Context, refname string) error {
@@ -169,6 +406,12 @@ func (e Engine) DeleteReference(ctx context.Context, refname string) error {
 		return errors.Errorf("refusing to delete invalid reference %q", refname)
 	}
 
+	unlock, err := e.lockIndex(ctx)
+	if err != nil {
+		return errors.Wrap(err, "lock top-level index")
+	}
+	defer unlock()
+
 	// Get index to modify.
 	index, err := e.GetIndex(ctx)
 	if err != nil {
@@ -195,6 +438,95 @@ func (e Engine) DeleteReference(ctx context.Context, refname string) error {
 	return nil
 }
 
+// CopyReference adds a copy of every top-level index entry matching src with
+// the reference name dst. Only the top-level index is modified (no blobs are
+// read or written). If dst already exists, cas.ErrClobber is returned unless
+// force is set (in which case the existing dst entries are replaced).
+func (e Engine) CopyReference(ctx context.Context, src, dst string, force bool) error {
+	return e.copyReference(ctx, src, dst, force, false)
+}
+
+// RenameReference renames every top-level index entry matching src to the
+// reference name dst. Only the top-level index is modified (no blobs are read
+// or written). If dst already exists, cas.ErrClobber is returned unless force
+// is set (in which case the existing dst entries are replaced).
+func (e Engine) RenameReference(ctx context.Context, src, dst string, force bool) error {
+	return e.copyReference(ctx, src, dst, force, true)
+}
+
+// copyReference implements CopyReference and RenameReference. If remove is
+// set, the src entries are removed from the index.
+func (e Engine) copyReference(ctx context.Context, src, dst string, force, remove bool) error {
+	// XXX: It should be possible to override this somehow, in case we are
+	//      dealing with an image that abuses the image specification in some
+	//      way.
+	if !IsValidReferenceName(src) {
+		return errors.Errorf("refusing to use invalid reference %q", src)
+	}
+	if !IsValidReferenceName(dst) {
+		return errors.Errorf("refusing to update invalid reference %q", dst)
+	}
+	if src == dst {
+		return errors.Errorf("source and destination reference are the same: %q", src)
+	}
+
+	unlock, err := e.lockIndex(ctx)
+	if err != nil {
+		return errors.Wrap(err, "lock top-level index")
+	}
+	defer unlock()
+
+	// Get index to modify.
+	index, err := e.GetIndex(ctx)
+	if err != nil {
+		return errors.Wrap(err, "get top-level index")
+	}
+
+	var (
+		newIndex []ispec.Descriptor
+		copies   []ispec.Descriptor
+		clobber  bool
+	)
+	for _, descriptor := range index.Manifests {
+		switch descriptor.Annotations[ispec.AnnotationRefName] {
+		case dst:
+			clobber = true
+			continue
+		case src:
+			// Copy the annotations so we don't modify the original entry.
+			annotations := map[string]string{}
+			for k, v := range descriptor.Annotations {
+				annotations[k] = v
+			}
+			annotations[ispec.AnnotationRefName] = dst
+			copied := descriptor
+			copied.Annotations = annotations
+			copies = append(copies, copied)
+			if remove {
+				continue
+			}
+		}
+		newIndex = append(newIndex, descriptor)
+	}
+	if len(copies) == 0 {
+		return errors.Wrap(ErrReferenceNotFound, src)
+	}
+	if clobber && !force {
+		return errors.Wrapf(cas.ErrClobber, "reference %q already exists", dst)
+	}
+	if len(copies) > 1 {
+		// Warn users if the operation is going to copy more than one reference.
+		log.Warn("multiple references match the given reference name -- all of them have been copied due to this ambiguity")
+	}
+
+	// Commit to image.
+	index.Manifests = append(newIndex, copies...)
+	if err := e.PutIndex(ctx, index); err != nil {
+		return errors.Wrap(err, "replace index")
+	}
+	return nil
+}
+
 // ListReferences returns all of the ref.name entries that are specified in the
 // top-level index. Note that the list may contain duplicates, due to the
 // nature of references in the image-spec.
@@ -30,15 +30,19 @@ import (
 	"path/filepath"
 	"reflect"
 	"runtime"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/opencontainers/go-digest"
 	ispecs "github.com/opencontainers/image-spec/specs-go"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/cas"
 	"github.com/opencontainers/umoci/oci/cas/dir"
 	"github.com/opencontainers/umoci/oci/casext/mediatype"
 	"github.com/opencontainers/umoci/pkg/testutils"
+	"github.com/pkg/errors"
 )
 
 const (
@@ -419,6 +423,415 @@ func TestEngineReference(t *testing.T) {
 	}
 }
 
+// refDigests returns a map of reference names in the top-level index to the
+// digest they refer to.
+func refDigests(t *testing.T, engineExt Engine) map[string]digest.Digest {
+	index, err := engineExt.GetIndex(context.Background())
+	if err != nil {
+		t.Fatalf("GetIndex: unexpected error: %+v", err)
+	}
+	refs := map[string]digest.Digest{}
+	for _, descriptor := range index.Manifests {
+		refs[descriptor.Annotations[ispec.AnnotationRefName]] = descriptor.Digest
+	}
+	return refs
+}
+
+func TestEngineReferenceAnnotation(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineReferenceAnnotation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := NewEngine(engine)
+	defer engine.Close()
+
+	fakeSetupManyReferences(t, engineExt, 3)
+
+	// Add some custom annotations to the top-level descriptors.
+	index, err := engineExt.GetIndex(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error getting index: %+v", err)
+	}
+	for idx := range index.Manifests {
+		index.Manifests[idx].Annotations["com.example.build"] = fmt.Sprintf("build-%d", idx)
+		index.Manifests[idx].Annotations["com.example.team"] = "shared"
+	}
+	// A descriptor with no ref.name which can only be resolved by annotation.
+	untagged := index.Manifests[0]
+	untagged.Annotations = map[string]string{"com.example.build": "untagged"}
+	index.Manifests = append(index.Manifests, untagged)
+	if err := engine.PutIndex(ctx, index); err != nil {
+		t.Fatalf("unexpected error putting index: %+v", err)
+	}
+
+	for _, test := range []struct {
+		refname  string
+		expected []ispec.Descriptor
+	}{
+		{"@annotation:com.example.build=build-1", []ispec.Descriptor{index.Manifests[1]}},
+		{"@annotation:com.example.build=untagged", []ispec.Descriptor{untagged}},
+		{"@annotation:com.example.team=shared", index.Manifests[:3]},
+		{"@annotation:com.example.team=", nil},
+		{"@annotation:com.example.missing=shared", nil},
+		{"@annotation:" + ispec.AnnotationRefName + "=tag2", []ispec.Descriptor{index.Manifests[2]}},
+		// Ordinary tags are not affected.
+		{"tag0", []ispec.Descriptor{index.Manifests[0]}},
+	} {
+		descriptorPaths, err := engineExt.ResolveReference(ctx, test.refname)
+		if err != nil {
+			t.Errorf("ResolveReference(%q): unexpected error: %+v", test.refname, err)
+			continue
+		}
+		var got []ispec.Descriptor
+		for _, descriptorPath := range descriptorPaths {
+			got = append(got, descriptorPath.Root())
+		}
+		if !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("ResolveReference(%q): expected %v, got %v", test.refname, test.expected, got)
+		}
+	}
+
+	// Malformed annotation references are rejected.
+	if _, err := engineExt.ResolveReference(ctx, "@annotation:com.example.build"); err == nil {
+		t.Errorf("ResolveReference: expected malformed annotation reference to fail")
+	}
+	// Annotation references cannot be updated.
+	if err := engineExt.UpdateReference(ctx, "@annotation:com.example.build=build-1", index.Manifests[0]); err == nil {
+		t.Errorf("UpdateReference: expected annotation reference to be rejected")
+	}
+}
+
+func TestEngineReferenceDigest(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineReferenceDigest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := NewEngine(engine)
+	defer engine.Close()
+
+	layerDigest, layerSize, err := engineExt.PutBlob(ctx, bytes.NewBufferString("not a manifest"))
+	if err != nil {
+		t.Fatalf("unexpected error putting layer: %+v", err)
+	}
+	layer := ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageLayer,
+		Digest:    layerDigest,
+		Size:      layerSize,
+	}
+
+	// Create enough untagged manifests that at least two of them must share
+	// the first character of their digest.
+	var manifests []ispec.Descriptor
+	for i := 0; i < 17; i++ {
+		manifest := ispec.Manifest{
+			Versioned: ispecs.Versioned{
+				SchemaVersion: 2,
+			},
+			Config: layer,
+			Layers: []ispec.Descriptor{layer},
+			Annotations: map[string]string{
+				"idx": fmt.Sprintf("%d", i),
+			},
+		}
+		// Only set the (optional) mediaType field on some of the manifests.
+		if i%2 == 0 {
+			manifest.MediaType = ispec.MediaTypeImageManifest
+		}
+		manifestDigest, manifestSize, err := engineExt.PutBlobJSON(ctx, manifest)
+		if err != nil {
+			t.Fatalf("unexpected error putting manifest: %+v", err)
+		}
+		manifests = append(manifests, ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageManifest,
+			Digest:    manifestDigest,
+			Size:      manifestSize,
+		})
+	}
+
+	// An image index referencing the first manifest, which is tagged.
+	indexDescriptor, err := engineExt.PutImageIndex(ctx, ispec.Index{
+		Manifests: []ispec.Descriptor{manifests[0]},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error putting index: %+v", err)
+	}
+	if err := engineExt.UpdateReference(ctx, "tagged", indexDescriptor); err != nil {
+		t.Fatalf("unexpected error updating reference: %+v", err)
+	}
+	tagged, err := engineExt.ReferenceDescriptor(ctx, "tagged")
+	if err != nil {
+		t.Fatalf("unexpected error getting reference: %+v", err)
+	}
+
+	for _, test := range []struct {
+		refname      string
+		expectedRoot ispec.Descriptor
+		expected     ispec.Descriptor
+	}{
+		{"@" + manifests[1].Digest.String(), manifests[1], manifests[1]},
+		{"@" + manifests[2].Digest.String()[:len("sha256:")+16], manifests[2], manifests[2]},
+		// Index blobs referenced by the top-level index use that descriptor.
+		{"@" + indexDescriptor.Digest.String(), tagged, manifests[0]},
+	} {
+		descriptorPaths, err := engineExt.ResolveReference(ctx, test.refname)
+		if err != nil {
+			t.Errorf("ResolveReference(%q): unexpected error: %+v", test.refname, err)
+			continue
+		}
+		if len(descriptorPaths) != 1 {
+			t.Errorf("ResolveReference(%q): expected one descriptor, got %v", test.refname, descriptorPaths)
+			continue
+		}
+		if got := descriptorPaths[0].Root(); !reflect.DeepEqual(got, test.expectedRoot) {
+			t.Errorf("ResolveReference(%q): expected root %v, got %v", test.refname, test.expectedRoot, got)
+		}
+		if got := descriptorPaths[0].Descriptor(); got.Digest != test.expected.Digest {
+			t.Errorf("ResolveReference(%q): expected %v, got %v", test.refname, test.expected, got)
+		}
+	}
+
+	// Non-manifest blobs and unknown digests don't resolve.
+	for _, refname := range []string{
+		"@" + layerDigest.String(),
+		"@" + digest.FromString("does not exist").String(),
+	} {
+		descriptorPaths, err := engineExt.ResolveReference(ctx, refname)
+		if err != nil {
+			t.Errorf("ResolveReference(%q): unexpected error: %+v", refname, err)
+		}
+		if len(descriptorPaths) != 0 {
+			t.Errorf("ResolveReference(%q): expected no descriptors, got %v", refname, descriptorPaths)
+		}
+	}
+
+	// Ambiguous prefixes are rejected.
+	byPrefix := map[string][]ispec.Descriptor{}
+	for _, manifest := range manifests {
+		prefix := manifest.Digest.Encoded()[:1]
+		byPrefix[prefix] = append(byPrefix[prefix], manifest)
+	}
+	for prefix, candidates := range byPrefix {
+		if len(candidates) < 2 {
+			continue
+		}
+		refname := "@sha256:" + prefix
+		_, err := engineExt.ResolveReference(ctx, refname)
+		if err == nil {
+			t.Errorf("ResolveReference(%q): expected ambiguous digest reference to fail", refname)
+			continue
+		}
+		for _, candidate := range candidates {
+			if !strings.Contains(err.Error(), candidate.Digest.String()) {
+				t.Errorf("ResolveReference(%q): expected error to list candidate %s: %v", refname, candidate.Digest, err)
+			}
+		}
+	}
+
+	// Digest references cannot be updated.
+	if err := engineExt.UpdateReference(ctx, "@"+manifests[1].Digest.String(), manifests[1]); err == nil {
+		t.Errorf("UpdateReference: expected digest reference to be rejected")
+	}
+}
+
+func TestEngineReferenceCopyRename(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineReferenceCopyRename")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := NewEngine(engine)
+	defer engine.Close()
+
+	// None of these blobs exist -- copying and renaming must not need them.
+	descA := ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    digest.FromString("manifest a"),
+		Size:      10,
+		Annotations: map[string]string{
+			"org.opensuse.custom": "value",
+		},
+	}
+	descB := ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    digest.FromString("manifest b"),
+		Size:      10,
+	}
+	if err := engineExt.UpdateReference(ctx, "a", descA); err != nil {
+		t.Fatalf("UpdateReference: unexpected error: %+v", err)
+	}
+	if err := engineExt.UpdateReference(ctx, "b", descB); err != nil {
+		t.Fatalf("UpdateReference: unexpected error: %+v", err)
+	}
+
+	// Copy a -> c.
+	if err := engineExt.CopyReference(ctx, "a", "c", false); err != nil {
+		t.Fatalf("CopyReference: unexpected error: %+v", err)
+	}
+	refs := refDigests(t, engineExt)
+	if len(refs) != 3 || refs["a"] != descA.Digest || refs["c"] != descA.Digest {
+		t.Errorf("CopyReference: unexpected references after copy: %v", refs)
+	}
+	index, err := engineExt.GetIndex(ctx)
+	if err != nil {
+		t.Fatalf("GetIndex: unexpected error: %+v", err)
+	}
+	for _, descriptor := range index.Manifests {
+		if descriptor.Digest == descA.Digest && descriptor.Annotations["org.opensuse.custom"] != "value" {
+			t.Errorf("CopyReference: other annotations not preserved: %v", descriptor.Annotations)
+		}
+	}
+
+	// Rename c -> b must fail without force.
+	if err := engineExt.RenameReference(ctx, "c", "b", false); errors.Cause(err) != cas.ErrClobber {
+		t.Errorf("RenameReference: expected ErrClobber, got %+v", err)
+	}
+	if err := engineExt.CopyReference(ctx, "c", "b", false); errors.Cause(err) != cas.ErrClobber {
+		t.Errorf("CopyReference: expected ErrClobber, got %+v", err)
+	}
+	if refs := refDigests(t, engineExt); len(refs) != 3 || refs["b"] != descB.Digest {
+		t.Errorf("RenameReference: references modified after failed rename: %v", refs)
+	}
+
+	// Rename c -> b with force.
+	if err := engineExt.RenameReference(ctx, "c", "b", true); err != nil {
+		t.Fatalf("RenameReference: unexpected error: %+v", err)
+	}
+	refs = refDigests(t, engineExt)
+	if len(refs) != 2 || refs["a"] != descA.Digest || refs["b"] != descA.Digest {
+		t.Errorf("RenameReference: unexpected references after rename: %v", refs)
+	}
+
+	// Rename a -> d.
+	if err := engineExt.RenameReference(ctx, "a", "d", false); err != nil {
+		t.Fatalf("RenameReference: unexpected error: %+v", err)
+	}
+	refs = refDigests(t, engineExt)
+	if len(refs) != 2 || refs["d"] != descA.Digest || refs["b"] != descA.Digest {
+		t.Errorf("RenameReference: unexpected references after rename: %v", refs)
+	}
+
+	// Invalid operations.
+	if err := engineExt.RenameReference(ctx, "does-not-exist", "e", false); err == nil {
+		t.Errorf("RenameReference: expected error with non-existent source")
+	}
+	if err := engineExt.CopyReference(ctx, "d", "d", true); err == nil {
+		t.Errorf("CopyReference: expected error with same source and destination")
+	}
+	if err := engineExt.CopyReference(ctx, "d", "in valid", false); err == nil {
+		t.Errorf("CopyReference: expected error with invalid destination")
+	}
+}
+
+// TestEngineReferenceConcurrent makes sure that concurrent UpdateReference
+// calls (from several engines for the same image, as several processes would)
+// don't lose any updates.
+func TestEngineReferenceConcurrent(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineReferenceConcurrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	const (
+		numEngines = 4
+		numTags    = 16
+	)
+
+	descriptor := ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    digest.FromString("fake manifest"),
+		Size:      13,
+	}
+
+	var wg sync.WaitGroup
+	errCh := make(chan error, numEngines)
+	for i := 0; i < numEngines; i++ {
+		engine, err := dir.Open(image)
+		if err != nil {
+			t.Fatalf("unexpected error opening image: %+v", err)
+		}
+		engineExt := NewEngine(engine)
+		defer engine.Close()
+
+		wg.Add(1)
+		go func(idx int) {
+			defer wg.Done()
+			for j := 0; j < numTags; j++ {
+				name := fmt.Sprintf("tag_%d_%d", idx, j)
+				if err := engineExt.UpdateReference(ctx, name, descriptor); err != nil {
+					errCh <- err
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errCh)
+	for err := range errCh {
+		t.Errorf("UpdateReference: unexpected error: %+v", err)
+	}
+
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := NewEngine(engine)
+	defer engine.Close()
+
+	names, err := engineExt.ListReferences(ctx)
+	if err != nil {
+		t.Fatalf("ListReferences: unexpected error: %+v", err)
+	}
+	if len(names) != numEngines*numTags {
+		t.Errorf("ListReferences: expected %d references, got %d: %v", numEngines*numTags, len(names), names)
+	}
+}
+
 func TestEngineReferenceReadonly(t *testing.T) {
 	ctx := context.Background()
 
@@ -19,6 +19,8 @@ package casext
 
 import (
 	"testing"
+
+	"github.com/opencontainers/go-digest"
 )
 
 func TestValidateRefname(t *testing.T) {
@@ -63,3 +65,59 @@ func TestValidateRefname(t *testing.T) {
 		}
 	}
 }
+
+func TestParseAnnotationReference(t *testing.T) {
+	for _, test := range []struct {
+		refname   string
+		key       string
+		value     string
+		ok, isErr bool
+	}{
+		{"latest", "", "", false, false},
+		{"annotation:foo=bar", "", "", false, false},
+		{"@annotation:com.example.build=123", "com.example.build", "123", true, false},
+		{"@annotation:key=", "key", "", true, false},
+		{"@annotation:key=a=b", "key", "a=b", true, false},
+		{"@annotation:key", "", "", true, true},
+		{"@annotation:=value", "", "", true, true},
+		{"@annotation:", "", "", true, true},
+	} {
+		key, value, ok, err := ParseAnnotationReference(test.refname)
+		if (err != nil) != test.isErr {
+			t.Errorf("ParseAnnotationReference(%q): unexpected error state: expected error=%v, got %v", test.refname, test.isErr, err)
+		}
+		if ok != test.ok || key != test.key || value != test.value {
+			t.Errorf("ParseAnnotationReference(%q): expected (%q, %q, %v), got (%q, %q, %v)", test.refname, test.key, test.value, test.ok, key, value, ok)
+		}
+	}
+}
+
+func TestParseDigestReference(t *testing.T) {
+	for _, test := range []struct {
+		refname   string
+		algorithm digest.Algorithm
+		encoded   string
+		ok, isErr bool
+	}{
+		{"latest", "", "", false, false},
+		{"sha256:abcd", "", "", false, false},
+		{"@annotation:foo=bar", "", "", false, false},
+		{"@sha256:abcd", digest.SHA256, "abcd", true, false},
+		{"@sha256:" + digest.FromString("foo").Encoded(), digest.SHA256, digest.FromString("foo").Encoded(), true, false},
+		{"@sha512:0123456789", digest.SHA512, "0123456789", true, false},
+		{"@sha256:" + digest.FromString("foo").Encoded() + "0", "", "", true, true},
+		{"@sha256:ABCD", "", "", true, true},
+		{"@sha256:xyz", "", "", true, true},
+		{"@sha256:", "", "", true, true},
+		{"@md5:abcd", "", "", true, true},
+		{"@abcd", "", "", true, true},
+	} {
+		algorithm, encoded, ok, err := ParseDigestReference(test.refname)
+		if (err != nil) != test.isErr {
+			t.Errorf("ParseDigestReference(%q): unexpected error state: expected error=%v, got %v", test.refname, test.isErr, err)
+		}
+		if ok != test.ok || algorithm != test.algorithm || encoded != test.encoded {
+			t.Errorf("ParseDigestReference(%q): expected (%q, %q, %v), got (%q, %q, %v)", test.refname, test.algorithm, test.encoded, test.ok, algorithm, encoded, ok)
+		}
+	}
+}
@@ -22,7 +22,6 @@ import (
 	"errors"
 
 	"github.com/apex/log"
-	"github.com/opencontainers/go-digest"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 
 	"github.com/opencontainers/umoci/oci/cas"
@@ -99,6 +98,12 @@ var ErrSkipDescriptor = errors.New("[internal] do not recurse into descriptor")
 // WalkFunc, the recursion will halt and the error will bubble up to the
 // caller.
 //
+// The DescriptorPath contains every descriptor traversed from the root of the
+// walk to the current descriptor, so WalkFunc can tell how the descriptor was
+// reached (such as which manifest in which index references a config). Each
+// call gets its own DescriptorPath, so it is safe to retain it after WalkFunc
+// returns.
+//
 // TODO: Also provide Blob to WalkFunc so that callers don't need to load blobs
 //
 //	more than once. This is quite important for remote CAS implementations.
@@ -112,6 +117,12 @@ func (ws *walkState) recurse(ctx context.Context, descriptorPath DescriptorPath)
 		"digest": descriptorPath.Descriptor().Digest,
 	}).Debugf("<- ws.recurse")
 
+	// Bail out early if the walk has been cancelled, so that callers don't
+	// need to check ctx themselves at each descriptor.
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	// Run walkFunc.
 	if err := ws.walkFunc(descriptorPath); err != nil {
 		if err == ErrSkipDescriptor {
@@ -151,11 +162,14 @@ func (ws *walkState) recurse(ctx context.Context, descriptorPath DescriptorPath)
 		}
 	}()
 
-	// Recurse into children.
+	// Recurse into children. Each child gets a fresh copy of the walk, as
+	// otherwise siblings could end up sharing (and overwriting) the same
+	// backing array -- which would break any WalkFunc that retains paths.
 	for _, child := range childDescriptors(blob.Data) {
-		if err := ws.recurse(ctx, DescriptorPath{
-			Walk: append(descriptorPath.Walk, child),
-		}); err != nil {
+		walk := make([]ispec.Descriptor, 0, len(descriptorPath.Walk)+1)
+		walk = append(walk, descriptorPath.Walk...)
+		walk = append(walk, child)
+		if err := ws.recurse(ctx, DescriptorPath{Walk: walk}); err != nil {
 			return err
 		}
 	}
@@ -166,7 +180,9 @@ func (ws *walkState) recurse(ctx context.Context, descriptorPath DescriptorPath)
 // Walk preforms a depth-first walk from a given root descriptor, using the
 // provided CAS engine to fetch all other necessary descriptors. If an error is
 // returned by the provided WalkFunc, walking is terminated and the error is
-// returned to the caller.
+// returned to the caller. The context is checked before each descriptor is
+// visited, and if it has been cancelled the walk is aborted and ctx.Err() is
+// returned (WalkFunc will not be called again).
 func (e Engine) Walk(ctx context.Context, root ispec.Descriptor, walkFunc WalkFunc) error {
 	ws := &walkState{
 		engine:   e,
@@ -176,31 +192,3 @@ func (e Engine) Walk(ctx context.Context, root ispec.Descriptor, walkFunc WalkFu
 		Walk: []ispec.Descriptor{root},
 	})
 }
-
-// reachable returns the set of digests which can be reached using a descriptor
-// path from the provided root descriptor. The returned slice will *not*
-// contain any duplicate digest.Digest entries.
-//
-// Please note that without descriptors, a digest is not particularly meaninful
-// (OCI blobs are not self-descriptive). This method primarily exists for GC()
-// and any use outside of GC() should be carefully considered (you probably
-// want to use Walk directly).
-func (e Engine) reachable(ctx context.Context, root ispec.Descriptor) ([]digest.Digest, error) {
-	seen := map[digest.Digest]struct{}{}
-	if err := e.Walk(ctx, root, func(descriptorPath DescriptorPath) error {
-		digest := descriptorPath.Descriptor().Digest
-		if _, ok := seen[digest]; ok {
-			// Don't traverse further if we've already seen this digest.
-			return ErrSkipDescriptor
-		}
-		seen[digest] = struct{}{}
-		return nil
-	}); err != nil {
-		return nil, err
-	}
-	var reachable []digest.Digest
-	for node := range seen {
-		reachable = append(reachable, node)
-	}
-	return reachable, nil
-}
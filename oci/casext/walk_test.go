@@ -0,0 +1,314 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	imeta "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/cas"
+	"github.com/opencontainers/umoci/oci/cas/dir"
+	"github.com/pkg/errors"
+)
+
+// cancellingEngine is a cas.Engine which cancels a context once a given
+// number of blobs have been fetched from it.
+type cancellingEngine struct {
+	cas.Engine
+	after   int32
+	fetched int32
+	cancel  context.CancelFunc
+}
+
+func (e *cancellingEngine) GetBlob(ctx context.Context, digest digest.Digest) (io.ReadCloser, error) {
+	if atomic.AddInt32(&e.fetched, 1) == e.after {
+		e.cancel()
+	}
+	return e.Engine.GetBlob(ctx, digest)
+}
+
+// checkGoroutines makes sure that the number of running goroutines drops back
+// to (at most) the given baseline in a reasonable amount of time.
+func checkGoroutines(t *testing.T, baseline int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > baseline {
+		if time.Now().After(deadline) {
+			t.Errorf("leaked goroutines: had %d before walk, have %d after", baseline, runtime.NumGoroutine())
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// fakeSetupWalkIndex creates an image containing many manifests, and returns
+// a descriptor for an index which references all of them.
+func fakeSetupWalkIndex(t *testing.T, engineExt Engine) ispec.Descriptor {
+	ctx := context.Background()
+
+	fakeSetupManyReferences(t, engineExt, 50)
+	index, err := engineExt.GetIndex(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error getting index: %+v", err)
+	}
+
+	indexDigest, indexSize, err := engineExt.PutBlobJSON(ctx, ispec.Index{
+		Versioned: imeta.Versioned{
+			SchemaVersion: 2,
+		},
+		MediaType: ispec.MediaTypeImageIndex,
+		Manifests: index.Manifests,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error putting index blob: %+v", err)
+	}
+	return ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageIndex,
+		Digest:    indexDigest,
+		Size:      indexSize,
+	}
+}
+
+func TestWalkCancelled(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestWalkCancelled")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := NewEngine(engine)
+	defer engine.Close()
+
+	index := fakeSetupWalkIndex(t, engineExt)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err = engineExt.Walk(ctx, index, func(descriptorPath DescriptorPath) error {
+		t.Errorf("walkFunc called with cancelled context: %v", descriptorPath.Descriptor().Digest)
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected walk to fail with %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestWalkCancelMidWalk(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestWalkCancelMidWalk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := NewEngine(engine)
+	defer engine.Close()
+
+	index := fakeSetupWalkIndex(t, engineExt)
+
+	const cancelAfter = 10
+	baseline := runtime.NumGoroutine()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var visited int
+	start := time.Now()
+	err = engineExt.Walk(ctx, index, func(descriptorPath DescriptorPath) error {
+		visited++
+		if visited == cancelAfter {
+			cancel()
+		}
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected walk to fail with %v, got %v", context.Canceled, err)
+	}
+	if visited != cancelAfter {
+		t.Errorf("expected walk to stop after %d descriptors, visited %d", cancelAfter, visited)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("cancelled walk took too long to return: %v", elapsed)
+	}
+	checkGoroutines(t, baseline)
+}
+
+func TestWalkDescriptorPath(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestWalkDescriptorPath")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := NewEngine(engine)
+	defer engine.Close()
+
+	ctx := context.Background()
+
+	// Nest the index a few times, so that the walk is deep enough that paths
+	// of sibling descriptors could share the same backing array.
+	index := fakeSetupWalkIndex(t, engineExt)
+	for i := 0; i < 3; i++ {
+		indexDigest, indexSize, err := engineExt.PutBlobJSON(ctx, ispec.Index{
+			Versioned: imeta.Versioned{
+				SchemaVersion: 2,
+			},
+			MediaType: ispec.MediaTypeImageIndex,
+			Manifests: []ispec.Descriptor{index},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error putting index blob: %+v", err)
+		}
+		index = ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageIndex,
+			Digest:    indexDigest,
+			Size:      indexSize,
+		}
+	}
+
+	// Retain every path (as well as the descriptor being visited), and only
+	// check them once the walk is done.
+	var (
+		paths   []DescriptorPath
+		visited []ispec.Descriptor
+	)
+	if err := engineExt.Walk(ctx, index, func(descriptorPath DescriptorPath) error {
+		paths = append(paths, descriptorPath)
+		visited = append(visited, descriptorPath.Descriptor())
+		return nil
+	}); err != nil {
+		t.Fatalf("unexpected error walking image: %+v", err)
+	}
+
+	for idx, path := range paths {
+		if got := path.Descriptor().Digest; got != visited[idx].Digest {
+			t.Errorf("path %d was modified after the visit: expected it to end at %v, got %v", idx, visited[idx].Digest, got)
+		}
+		if path.Root().Digest != index.Digest {
+			t.Errorf("path %v does not start at the root %v", path.Walk, index.Digest)
+			continue
+		}
+		// Every step in the path must be referenced by the previous step.
+		for i := 1; i < len(path.Walk); i++ {
+			parent, child := path.Walk[i-1], path.Walk[i]
+			blob, err := engineExt.FromDescriptor(ctx, parent)
+			if err != nil {
+				t.Fatalf("unexpected error reading blob %v: %+v", parent.Digest, err)
+			}
+			found := false
+			for _, descriptor := range childDescriptors(blob.Data) {
+				if descriptor.Digest == child.Digest {
+					found = true
+					break
+				}
+			}
+			if err := blob.Close(); err != nil {
+				t.Errorf("unexpected error closing blob %v: %+v", parent.Digest, err)
+			}
+			if !found {
+				t.Errorf("path %v is invalid: %v is not referenced by %v", path.Walk, child.Digest, parent.Digest)
+			}
+		}
+	}
+}
+
+func TestGCCancelMidMark(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestGCCancelMidMark")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	defer engine.Close()
+
+	fakeSetupManyReferences(t, NewEngine(engine), 200)
+
+	before, err := engine.ListBlobs(context.Background())
+	if err != nil {
+		t.Fatalf("unable to list blobs: %+v", err)
+	}
+
+	baseline := runtime.NumGoroutine()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	engineExt := NewEngine(&cancellingEngine{
+		Engine: engine,
+		after:  20,
+		cancel: cancel,
+	})
+
+	err = engineExt.GC(ctx)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected GC to fail with %v, got %v", context.Canceled, err)
+	}
+	checkGoroutines(t, baseline)
+
+	// A cancelled mark must not result in anything being swept.
+	after, err := engine.ListBlobs(context.Background())
+	if err != nil {
+		t.Fatalf("unable to list blobs: %+v", err)
+	}
+	if len(before) != len(after) {
+		t.Errorf("cancelled GC removed blobs: had %d blobs, now have %d", len(before), len(after))
+	}
+}
@@ -23,6 +23,7 @@ import (
 	"github.com/blang/semver/v4"
 	rspec "github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
 )
 
 // FIXME: We currently use an unreleased version of the runtime-spec and so we
@@ -37,6 +38,147 @@ import (
 // 1.0.2 (it has a pre-release tag) -- the specs should be using 1.0.2+dev.
 var curSpecVersion = semver.MustParse(strings.TrimSuffix(rspec.Version, "-dev"))
 
+// DefaultMaskedPaths returns the default set of linux.maskedPaths used by
+// Example. These are paths which are (or were) known to leak host information
+// or otherwise be dangerous to expose to containers, and match the defaults
+// used by "runc spec".
+func DefaultMaskedPaths() []string {
+	return []string{
+		"/proc/kcore",
+		"/proc/latency_stats",
+		"/proc/timer_list",
+		"/proc/timer_stats",
+		"/proc/sched_debug",
+		"/sys/firmware",
+		"/proc/scsi",
+	}
+}
+
+// DefaultReadonlyPaths returns the default set of linux.readonlyPaths used by
+// Example, which match the defaults used by "runc spec".
+func DefaultReadonlyPaths() []string {
+	return []string{
+		"/proc/asound",
+		"/proc/bus",
+		"/proc/fs",
+		"/proc/irq",
+		"/proc/sys",
+		"/proc/sysrq-trigger",
+	}
+}
+
+// DefaultCapabilities returns the default set of capabilities granted to
+// containers by the common runc-based container engines (such as Docker and
+// containerd). This is a larger set than the one used by Example (which
+// matches "runc spec"), and is the set most images expect to have.
+func DefaultCapabilities() []string {
+	return []string{
+		"CAP_CHOWN",
+		"CAP_DAC_OVERRIDE",
+		"CAP_FSETID",
+		"CAP_FOWNER",
+		"CAP_MKNOD",
+		"CAP_NET_RAW",
+		"CAP_SETGID",
+		"CAP_SETUID",
+		"CAP_SETFCAP",
+		"CAP_SETPCAP",
+		"CAP_NET_BIND_SERVICE",
+		"CAP_SYS_CHROOT",
+		"CAP_KILL",
+		"CAP_AUDIT_WRITE",
+	}
+}
+
+// DefaultCapabilitySet returns a linux capability set which grants
+// DefaultCapabilities to the container process. Following the container
+// engines, the capabilities are not added to the inheritable or ambient sets
+// (so they are not passed through execve(2) to non-root programs).
+func DefaultCapabilitySet() *rspec.LinuxCapabilities {
+	return &rspec.LinuxCapabilities{
+		Bounding:  DefaultCapabilities(),
+		Permitted: DefaultCapabilities(),
+		Effective: DefaultCapabilities(),
+	}
+}
+
+// minimalSeccompBlocked is the set of syscalls blocked by MinimalSeccomp.
+// These are some of the syscalls which are blocked by the default seccomp
+// profiles of the common container engines regardless of the granted
+// capabilities. Syscalls which do not exist on the running architecture are
+// ignored by the runtime.
+var minimalSeccompBlocked = []string{
+	"_sysctl",
+	"acct",
+	"add_key",
+	"bpf",
+	"clock_adjtime",
+	"clock_settime",
+	"create_module",
+	"delete_module",
+	"finit_module",
+	"get_kernel_syms",
+	"get_mempolicy",
+	"init_module",
+	"ioperm",
+	"iopl",
+	"kcmp",
+	"kexec_file_load",
+	"kexec_load",
+	"keyctl",
+	"lookup_dcookie",
+	"mbind",
+	"mount",
+	"move_pages",
+	"name_to_handle_at",
+	"nfsservctl",
+	"open_by_handle_at",
+	"perf_event_open",
+	"pivot_root",
+	"process_vm_readv",
+	"process_vm_writev",
+	"ptrace",
+	"query_module",
+	"quotactl",
+	"reboot",
+	"request_key",
+	"set_mempolicy",
+	"setns",
+	"settimeofday",
+	"stime",
+	"swapoff",
+	"swapon",
+	"sysfs",
+	"umount",
+	"umount2",
+	"unshare",
+	"uselib",
+	"userfaultfd",
+	"ustat",
+	"vm86",
+	"vm86old",
+}
+
+// MinimalSeccomp returns umoci's own minimal seccomp profile, which allows all
+// syscalls other than a small set of syscalls known to be dangerous to expose
+// to containers (which fail with EPERM). Note that this is a deny-list, and is
+// far less restrictive than the (allow-list) default profiles of runc-based
+// container engines such as Docker and Podman -- users who need those should
+// provide them explicitly.
+func MinimalSeccomp() *rspec.LinuxSeccomp {
+	errnoRet := uint(unix.EPERM)
+	return &rspec.LinuxSeccomp{
+		DefaultAction: rspec.ActAllow,
+		Syscalls: []rspec.LinuxSyscall{
+			{
+				Names:    append([]string(nil), minimalSeccompBlocked...),
+				Action:   rspec.ActErrno,
+				ErrnoRet: &errnoRet,
+			},
+		},
+	}
+}
+
 // Example returns an example spec file, used as a "good sane default".
 // XXX: Really we should just use runc's directly.
 func Example() rspec.Spec {
@@ -139,23 +281,8 @@ func Example() rspec.Spec {
 			},
 		},
 		Linux: &rspec.Linux{
-			MaskedPaths: []string{
-				"/proc/kcore",
-				"/proc/latency_stats",
-				"/proc/timer_list",
-				"/proc/timer_stats",
-				"/proc/sched_debug",
-				"/sys/firmware",
-				"/proc/scsi",
-			},
-			ReadonlyPaths: []string{
-				"/proc/asound",
-				"/proc/bus",
-				"/proc/fs",
-				"/proc/irq",
-				"/proc/sys",
-				"/proc/sysrq-trigger",
-			},
+			MaskedPaths:   DefaultMaskedPaths(),
+			ReadonlyPaths: DefaultReadonlyPaths(),
 			Resources: &rspec.LinuxResources{
 				Devices: []rspec.LinuxDeviceCgroup{
 					{
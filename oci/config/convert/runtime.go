@@ -18,11 +18,13 @@
 package convert
 
 import (
+	"path"
 	"path/filepath"
 	"strings"
 
 	"github.com/apex/log"
 	"github.com/blang/semver/v4"
+	securejoin "github.com/cyphar/filepath-securejoin"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/opencontainers/runc/libcontainer/user"
 	rspec "github.com/opencontainers/runtime-spec/specs-go"
@@ -83,6 +85,17 @@ func appendEnv(env *[]string, name, value string) {
 	*env = append(*env, val)
 }
 
+// hasEnv returns whether the environment variable with the given name is set
+// in the given environment list.
+func hasEnv(env []string, name string) bool {
+	for _, val := range env {
+		if strings.HasPrefix(val, name+"=") {
+			return true
+		}
+	}
+	return false
+}
+
 // allocateNilStruct recursively enumerates all pointers in the given type and
 // replaces them with the zero-value of their associated type. It's a shame
 // that this is necessary.
@@ -141,11 +154,18 @@ func MutateRuntimeSpec(spec *rspec.Spec, rootfs string, image ispec.Image) error
 	spec.Root.Path = filepath.Base(rootfs)
 	spec.Root.Readonly = false
 
+	// The runtime-spec requires process.cwd to be absolute, so we treat a
+	// relative WorkingDir as being relative to the root (as Docker does).
 	spec.Process.Cwd = "/"
 	if ig.ConfigWorkingDir() != "" {
-		spec.Process.Cwd = ig.ConfigWorkingDir()
+		spec.Process.Cwd = path.Join("/", ig.ConfigWorkingDir())
 	}
 
+	// The image's environment is placed first (in the order it was declared
+	// by the image), followed by any of the defaults from the original spec
+	// which the image did not override.
+	defaultEnv := spec.Process.Env
+	spec.Process.Env = []string{}
 	for _, env := range ig.ConfigEnv() {
 		name, value, err := parseEnv(env)
 		if err != nil {
@@ -153,6 +173,15 @@ func MutateRuntimeSpec(spec *rspec.Spec, rootfs string, image ispec.Image) error
 		}
 		appendEnv(&spec.Process.Env, name, value)
 	}
+	for _, env := range defaultEnv {
+		name, _, err := parseEnv(env)
+		if err != nil {
+			return errors.Wrap(err, "parsing default process.env")
+		}
+		if !hasEnv(spec.Process.Env, name) {
+			spec.Process.Env = append(spec.Process.Env, env)
+		}
+	}
 
 	args := []string{}
 	args = append(args, ig.ConfigEntrypoint()...)
@@ -174,11 +203,18 @@ func MutateRuntimeSpec(spec *rspec.Spec, rootfs string, image ispec.Image) error
 	// Set parsed fields
 	// Get the *actual* uid and gid of the user. If the image doesn't contain
 	// an /etc/passwd or /etc/group file then GetExecUserPath will just do a
-	// numerical parsing.
+	// numerical parsing. The paths are resolved inside the rootfs, so that a
+	// symlinked /etc/passwd cannot cause us to read the host's files.
 	var passwdPath, groupPath string
 	if rootfs != "" {
-		passwdPath = filepath.Join(rootfs, "/etc/passwd")
-		groupPath = filepath.Join(rootfs, "/etc/group")
+		passwdPath, err = securejoin.SecureJoin(rootfs, "/etc/passwd")
+		if err != nil {
+			return errors.Wrap(err, "resolve /etc/passwd in rootfs")
+		}
+		groupPath, err = securejoin.SecureJoin(rootfs, "/etc/group")
+		if err != nil {
+			return errors.Wrap(err, "resolve /etc/group in rootfs")
+		}
 	}
 	execUser, err := user.GetExecUserPath(ig.ConfigUser(), nil, passwdPath, groupPath)
 	if err != nil {
@@ -199,7 +235,9 @@ func MutateRuntimeSpec(spec *rspec.Spec, rootfs string, image ispec.Image) error
 		spec.Process.User.AdditionalGids = append(spec.Process.User.AdditionalGids, uint32(sgid))
 	}
 
-	if execUser.Home != "" {
+	// Only use the home directory of the user if the image didn't explicitly
+	// set HOME.
+	if execUser.Home != "" && !hasEnv(spec.Process.Env, "HOME") {
 		appendEnv(&spec.Process.Env, "HOME", execUser.Home)
 	}
 
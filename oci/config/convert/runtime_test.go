@@ -0,0 +1,170 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package convert
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestToRuntimeSpecConfig(t *testing.T) {
+	image := ispec.Image{
+		OS:           "linux",
+		Architecture: "amd64",
+		Config: ispec.ImageConfig{
+			WorkingDir: "/srv/app",
+			Env: []string{
+				"ZZZ=last letter",
+				"TERM=vt100",
+				"AAA=first letter",
+				"PATH=/app/bin:/usr/bin",
+				"AAA=overridden",
+			},
+			ExposedPorts: map[string]struct{}{
+				"8080/tcp": {},
+				"53/udp":   {},
+				"2000":     {},
+			},
+		},
+	}
+
+	spec, err := ToRuntimeSpec("", image)
+	if err != nil {
+		t.Fatalf("unexpected error converting image: %+v", err)
+	}
+
+	if spec.Process.Cwd != "/srv/app" {
+		t.Errorf("unexpected process.cwd: expected %q got %q", "/srv/app", spec.Process.Cwd)
+	}
+
+	// The image's environment must come first (in order, with later entries
+	// overriding earlier ones) with the defaults after it.
+	expectedEnv := []string{
+		"ZZZ=last letter",
+		"TERM=vt100",
+		"AAA=overridden",
+		"PATH=/app/bin:/usr/bin",
+	}
+	if !reflect.DeepEqual(spec.Process.Env, expectedEnv) {
+		t.Errorf("unexpected process.env: expected %v got %v", expectedEnv, spec.Process.Env)
+	}
+
+	if ports := spec.Annotations[exposedPortsAnnotation]; ports != "2000,53/udp,8080/tcp" {
+		t.Errorf("unexpected %s annotation: got %q", exposedPortsAnnotation, ports)
+	}
+}
+
+func TestToRuntimeSpecDefaultEnv(t *testing.T) {
+	image := ispec.Image{
+		OS: "linux",
+		Config: ispec.ImageConfig{
+			Env: []string{"FOO=bar"},
+		},
+	}
+
+	spec, err := ToRuntimeSpec("", image)
+	if err != nil {
+		t.Fatalf("unexpected error converting image: %+v", err)
+	}
+
+	// Defaults the image didn't set are appended after the image's env.
+	expectedEnv := append([]string{"FOO=bar"}, Example().Process.Env...)
+	if !reflect.DeepEqual(spec.Process.Env, expectedEnv) {
+		t.Errorf("unexpected process.env: expected %v got %v", expectedEnv, spec.Process.Env)
+	}
+	if spec.Process.Cwd != "/" {
+		t.Errorf("unexpected process.cwd: expected %q got %q", "/", spec.Process.Cwd)
+	}
+}
+
+func TestToRuntimeSpecRelativeWorkingDir(t *testing.T) {
+	image := ispec.Image{
+		OS: "linux",
+		Config: ispec.ImageConfig{
+			WorkingDir: "srv/../app",
+		},
+	}
+
+	spec, err := ToRuntimeSpec("", image)
+	if err != nil {
+		t.Fatalf("unexpected error converting image: %+v", err)
+	}
+	if spec.Process.Cwd != "/app" {
+		t.Errorf("unexpected process.cwd: expected %q got %q", "/app", spec.Process.Cwd)
+	}
+}
+
+func TestToRuntimeSpecHome(t *testing.T) {
+	rootfs, err := ioutil.TempDir("", "umoci-TestToRuntimeSpecHome")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootfs)
+
+	if err := os.Mkdir(filepath.Join(rootfs, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(rootfs, "etc", "passwd"), []byte("test:x:1000:1000::/home/test:/bin/sh\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(rootfs, "etc", "group"), []byte("test:x:1000:\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name     string
+		env      []string
+		expected string
+	}{
+		{"PasswdHome", nil, "HOME=/home/test"},
+		{"ImageHome", []string{"HOME=/var/lib/test"}, "HOME=/var/lib/test"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			image := ispec.Image{
+				OS: "linux",
+				Config: ispec.ImageConfig{
+					User: "test",
+					Env:  test.env,
+				},
+			}
+
+			spec, err := ToRuntimeSpec(rootfs, image)
+			if err != nil {
+				t.Fatalf("unexpected error converting image: %+v", err)
+			}
+			if spec.Process.User.UID != 1000 || spec.Process.User.GID != 1000 {
+				t.Errorf("unexpected process.user: %+v", spec.Process.User)
+			}
+
+			var homes []string
+			for _, env := range spec.Process.Env {
+				if name, _, _ := parseEnv(env); name == "HOME" {
+					homes = append(homes, env)
+				}
+			}
+			if !reflect.DeepEqual(homes, []string{test.expected}) {
+				t.Errorf("unexpected HOME: expected %v got %v", []string{test.expected}, homes)
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package dockerarchive implements conversion between OCI images and the
+// "docker-archive" format (the tar archive format produced by "docker save"
+// and consumed by "docker load").
+package dockerarchive
+
+import (
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/casext/mediatype"
+	"github.com/pkg/errors"
+)
+
+// ManifestFile is the name of the file inside a docker-archive which lists the
+// images contained in the archive.
+const ManifestFile = "manifest.json"
+
+// Docker media types, which are used in the LayerSources of a docker-archive
+// (and by the Docker registry API).
+const (
+	// MediaTypeDockerManifest is the media type of a Docker image manifest.
+	MediaTypeDockerManifest = "application/vnd.docker.distribution.manifest.v2+json"
+
+	// MediaTypeDockerManifestList is the media type of a Docker manifest list.
+	MediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+
+	// MediaTypeDockerConfig is the media type of a Docker image configuration.
+	MediaTypeDockerConfig = "application/vnd.docker.container.image.v1+json"
+
+	// MediaTypeDockerLayer is the media type of an uncompressed Docker layer.
+	MediaTypeDockerLayer = "application/vnd.docker.image.rootfs.diff.tar"
+
+	// MediaTypeDockerLayerGzip is the media type of a gzip-compressed Docker
+	// layer.
+	MediaTypeDockerLayerGzip = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+
+	// MediaTypeDockerLayerZstd is the media type of a zstd-compressed Docker
+	// layer.
+	MediaTypeDockerLayerZstd = "application/vnd.docker.image.rootfs.diff.tar.zstd"
+
+	// MediaTypeDockerForeignLayer is the media type of a gzip-compressed
+	// Docker layer which must not be distributed (a "foreign" layer).
+	MediaTypeDockerForeignLayer = "application/vnd.docker.image.rootfs.foreign.diff.tar.gzip"
+)
+
+// dockerToOCI maps Docker media types to their OCI equivalents.
+var dockerToOCI = map[string]string{
+	MediaTypeDockerManifest:     ispec.MediaTypeImageManifest,
+	MediaTypeDockerManifestList: ispec.MediaTypeImageIndex,
+	MediaTypeDockerConfig:       ispec.MediaTypeImageConfig,
+	MediaTypeDockerLayer:        ispec.MediaTypeImageLayer,
+	MediaTypeDockerLayerGzip:    ispec.MediaTypeImageLayerGzip,
+	MediaTypeDockerLayerZstd:    mediatype.MediaTypeImageLayerZstd,
+	MediaTypeDockerForeignLayer: ispec.MediaTypeImageLayerNonDistributableGzip,
+}
+
+// TranslateMediaType returns the OCI media type equivalent to the given Docker
+// media type. OCI media types are returned unchanged, and an error is returned
+// for media types which have no OCI equivalent.
+func TranslateMediaType(mediaType string) (string, error) {
+	if ociType, ok := dockerToOCI[mediaType]; ok {
+		return ociType, nil
+	}
+	for _, ociType := range dockerToOCI {
+		if mediaType == ociType {
+			return ociType, nil
+		}
+	}
+	return "", errors.Errorf("unsupported media type: %s", mediaType)
+}
+
+// Manifest is an entry in the ManifestFile of a docker-archive, describing a
+// single image in the archive. All paths are relative to the root of the
+// archive.
+type Manifest struct {
+	// Config is the path of the image configuration.
+	Config string `json:"Config"`
+
+	// RepoTags is the set of names (such as "opensuse/leap:15.2") that the
+	// image was saved with.
+	RepoTags []string `json:"RepoTags"`
+
+	// Layers are the paths of the layer archives of the image, in order.
+	Layers []string `json:"Layers"`
+
+	// LayerSources contains the original descriptors of any layers which
+	// must be fetched from elsewhere (such as foreign layers), keyed by the
+	// DiffID of the layer.
+	LayerSources map[digest.Digest]ispec.Descriptor `json:"LayerSources,omitempty"`
+}
@@ -0,0 +1,273 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dockerarchive
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	"github.com/apex/log"
+	zstd "github.com/klauspost/compress/zstd"
+	gzip "github.com/klauspost/pgzip"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/opencontainers/umoci/oci/casext/mediatype"
+	"github.com/opencontainers/umoci/pkg/system"
+	"github.com/pkg/errors"
+)
+
+// ExportOptions modifies the behaviour of Export.
+type ExportOptions struct {
+	// RepoTags are the names (such as "opensuse/leap:15.2") the image will
+	// be given when loaded with "docker load". If empty, the image will be
+	// loaded untagged.
+	RepoTags []string
+}
+
+// archiveWriter is a helper for writing docker-archives.
+type archiveWriter struct {
+	tw    *tar.Writer
+	epoch time.Time
+
+	// dirs is the set of directories already written to the archive.
+	dirs map[string]struct{}
+}
+
+// writeEntry writes a regular file to the archive (as well as its parent
+// directory, if necessary) with the contents read from r.
+func (aw *archiveWriter) writeEntry(name string, r io.Reader, size int64) error {
+	if dir := path.Dir(name); dir != "." {
+		if _, ok := aw.dirs[dir]; !ok {
+			if err := aw.tw.WriteHeader(&tar.Header{
+				Name:     dir + "/",
+				Typeflag: tar.TypeDir,
+				Mode:     0755,
+				ModTime:  aw.epoch,
+			}); err != nil {
+				return errors.Wrapf(err, "write %s header", dir)
+			}
+			aw.dirs[dir] = struct{}{}
+		}
+	}
+	if err := aw.tw.WriteHeader(&tar.Header{
+		Name:     name,
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		Size:     size,
+		ModTime:  aw.epoch,
+	}); err != nil {
+		return errors.Wrapf(err, "write %s header", name)
+	}
+	n, err := system.Copy(aw.tw, r)
+	if err != nil {
+		return errors.Wrapf(err, "write %s", name)
+	}
+	if n != size {
+		return errors.Wrapf(io.ErrShortWrite, "write %s", name)
+	}
+	return nil
+}
+
+// writeBlob writes the blob described by descriptor to the archive.
+func (aw *archiveWriter) writeBlob(ctx context.Context, engineExt casext.Engine, name string, descriptor ispec.Descriptor) error {
+	blob, err := engineExt.GetVerifiedBlob(ctx, descriptor)
+	if err != nil {
+		return errors.Wrap(err, "get blob")
+	}
+	defer blob.Close()
+
+	if err := aw.writeEntry(name, blob, descriptor.Size); err != nil {
+		return err
+	}
+	// Make sure the blob wasn't corrupted.
+	return errors.Wrap(blob.Close(), "verify blob")
+}
+
+// writeRecompressedLayer writes the zstd-compressed layer described by
+// descriptor to the archive, re-encoded with gzip (which unlike zstd is
+// supported by all versions of "docker load"). The layer is buffered in a
+// temporary file, since the size of the re-encoded layer must be known before
+// it is written to the archive.
+func (aw *archiveWriter) writeRecompressedLayer(ctx context.Context, engineExt casext.Engine, name string, descriptor ispec.Descriptor) error {
+	blob, err := engineExt.GetVerifiedBlob(ctx, descriptor)
+	if err != nil {
+		return errors.Wrap(err, "get blob")
+	}
+	defer blob.Close()
+
+	zr, err := zstd.NewReader(blob)
+	if err != nil {
+		return errors.Wrap(err, "create zstd reader")
+	}
+	defer zr.Close()
+
+	tmp, err := ioutil.TempFile("", "umoci-docker-layer.")
+	if err != nil {
+		return errors.Wrap(err, "create temporary layer")
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	gzw := gzip.NewWriter(tmp)
+	if _, err := system.Copy(gzw, zr); err != nil {
+		return errors.Wrap(err, "recompress layer")
+	}
+	if err := gzw.Close(); err != nil {
+		return errors.Wrap(err, "close gzip writer")
+	}
+	// Make sure the blob wasn't corrupted.
+	if err := blob.Close(); err != nil {
+		return errors.Wrap(err, "verify blob")
+	}
+
+	size, err := tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return errors.Wrap(err, "get recompressed layer size")
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return errors.Wrap(err, "rewind recompressed layer")
+	}
+	return aw.writeEntry(name, tmp, size)
+}
+
+// Export writes the image described by the manifest descriptor to w as a
+// docker-archive, which can then be loaded with "docker load". The image
+// configuration is included as-is. Uncompressed and gzip-compressed layers are
+// also included as-is, while zstd-compressed layers are re-encoded with gzip
+// (which does not change their DiffIDs). Non-distributable ("foreign") layers
+// are referenced in the LayerSources of the archive manifest (as with "docker
+// save"), and are only included in the archive if they are present in the
+// image.
+func Export(ctx context.Context, engineExt casext.Engine, descriptor ispec.Descriptor, w io.Writer, opt *ExportOptions) error {
+	var options ExportOptions
+	if opt != nil {
+		options = *opt
+	}
+
+	if descriptor.MediaType != ispec.MediaTypeImageManifest {
+		return errors.Errorf("descriptor does not point to a manifest: %s", descriptor.MediaType)
+	}
+	blob, err := engineExt.FromDescriptor(ctx, descriptor)
+	if err != nil {
+		return errors.Wrap(err, "get manifest")
+	}
+	defer blob.Close()
+	ociManifest, ok := blob.Data.(ispec.Manifest)
+	if !ok {
+		// Should _never_ be reached.
+		return errors.Errorf("[internal error] unknown manifest blob type: %s", blob.Descriptor.MediaType)
+	}
+
+	aw := &archiveWriter{
+		tw:    tar.NewWriter(w),
+		epoch: time.Unix(0, 0),
+		dirs:  map[string]struct{}{},
+	}
+
+	// Docker uses the digest of the configuration as the image ID, so we must
+	// not modify it.
+	manifest := Manifest{
+		Config:   ociManifest.Config.Digest.Hex() + ".json",
+		RepoTags: options.RepoTags,
+		Layers:   []string{},
+	}
+	if err := aw.writeBlob(ctx, engineExt, manifest.Config, ociManifest.Config); err != nil {
+		return errors.Wrap(err, "write config")
+	}
+
+	// We need the DiffIDs of the layers to reference foreign layers.
+	configBlob, err := engineExt.FromDescriptor(ctx, ociManifest.Config)
+	if err != nil {
+		return errors.Wrap(err, "get config")
+	}
+	defer configBlob.Close()
+	config, ok := configBlob.Data.(ispec.Image)
+	if !ok {
+		// Should _never_ be reached.
+		return errors.Errorf("[internal error] unknown config blob type: %s", configBlob.Descriptor.MediaType)
+	}
+	if len(config.RootFS.DiffIDs) != len(ociManifest.Layers) {
+		return errors.Errorf("image config has %d diffids but manifest has %d layers", len(config.RootFS.DiffIDs), len(ociManifest.Layers))
+	}
+
+	written := map[string]struct{}{}
+	for idx, layer := range ociManifest.Layers {
+		name := path.Join(layer.Digest.Hex(), "layer.tar")
+		manifest.Layers = append(manifest.Layers, name)
+		if _, ok := written[name]; ok {
+			continue
+		}
+		written[name] = struct{}{}
+
+		if mediatype.IsNonDistributable(layer.MediaType) {
+			source := layer
+			if source.MediaType == ispec.MediaTypeImageLayerNonDistributableGzip {
+				source.MediaType = MediaTypeDockerForeignLayer
+			}
+			if manifest.LayerSources == nil {
+				manifest.LayerSources = map[digest.Digest]ispec.Descriptor{}
+			}
+			manifest.LayerSources[config.RootFS.DiffIDs[idx]] = source
+
+			// Foreign layers usually aren't in the image, in which case they
+			// can only be referenced.
+			exists, err := engineExt.StatBlob(ctx, layer.Digest)
+			if err != nil {
+				return errors.Wrapf(err, "stat layer %s", layer.Digest)
+			}
+			if !exists {
+				if len(layer.URLs) == 0 {
+					return errors.Errorf("foreign layer %s is not in the image and has no urls", layer.Digest)
+				}
+				log.Infof("docker-archive: referencing foreign layer %s without including it", layer.Digest)
+				continue
+			}
+		}
+
+		switch layer.MediaType {
+		case ispec.MediaTypeImageLayer, ispec.MediaTypeImageLayerNonDistributable,
+			ispec.MediaTypeImageLayerGzip, ispec.MediaTypeImageLayerNonDistributableGzip:
+			err = aw.writeBlob(ctx, engineExt, name, layer)
+		case mediatype.MediaTypeImageLayerZstd, mediatype.MediaTypeImageLayerNonDistributableZstd:
+			log.Debugf("docker-archive: re-encoding zstd layer %s with gzip", layer.Digest)
+			err = aw.writeRecompressedLayer(ctx, engineExt, name, layer)
+		default:
+			err = errors.Errorf("unsupported layer media type: %s", layer.MediaType)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "write layer %s", layer.Digest)
+		}
+	}
+
+	manifestData, err := json.Marshal([]Manifest{manifest})
+	if err != nil {
+		return errors.Wrap(err, "encode archive manifest")
+	}
+	if err := aw.writeEntry(ManifestFile, bytes.NewReader(manifestData), int64(len(manifestData))); err != nil {
+		return errors.Wrap(err, "write archive manifest")
+	}
+	return errors.Wrap(aw.tw.Close(), "close archive")
+}
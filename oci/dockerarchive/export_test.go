@@ -0,0 +1,339 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dockerarchive
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	zstd "github.com/klauspost/compress/zstd"
+	"github.com/opencontainers/go-digest"
+	imeta "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/cas/dir"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/opencontainers/umoci/oci/casext/mediatype"
+)
+
+func zstdCompress(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	zw, err := zstd.NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := zw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func putTestBlob(t *testing.T, engineExt casext.Engine, mediaType string, data []byte) ispec.Descriptor {
+	blobDigest, blobSize, err := engineExt.PutBlob(context.Background(), bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("put blob: %+v", err)
+	}
+	return ispec.Descriptor{MediaType: mediaType, Digest: blobDigest, Size: blobSize}
+}
+
+func TestExport(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestExport")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	// One layer of each compression type.
+	layer1, diffID1 := makeTestLayer(t, map[string]string{"etc/hostname": "docker\n"}, false)
+	layer2, diffID2 := makeTestLayer(t, map[string]string{"usr/bin/hello": "#!/bin/sh\necho hello\n"}, true)
+	layer3, diffID3 := makeTestLayer(t, map[string]string{"usr/bin/zstd": "zstd\n"}, false)
+	layers := []ispec.Descriptor{
+		putTestBlob(t, engineExt, ispec.MediaTypeImageLayer, layer1),
+		putTestBlob(t, engineExt, ispec.MediaTypeImageLayerGzip, layer2),
+		putTestBlob(t, engineExt, mediatype.MediaTypeImageLayerZstd, zstdCompress(t, layer3)),
+	}
+
+	config := ispec.Image{
+		Architecture: "amd64",
+		OS:           "linux",
+		RootFS: ispec.RootFS{
+			Type:    "layers",
+			DiffIDs: []digest.Digest{diffID1, diffID2, diffID3},
+		},
+	}
+	configDigest, configSize, err := engineExt.PutBlobJSON(ctx, config)
+	if err != nil {
+		t.Fatalf("put config: %+v", err)
+	}
+	manifestDigest, manifestSize, err := engineExt.PutBlobJSON(ctx, ispec.Manifest{
+		Versioned: imeta.Versioned{SchemaVersion: 2},
+		MediaType: ispec.MediaTypeImageManifest,
+		Config: ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageConfig,
+			Digest:    configDigest,
+			Size:      configSize,
+		},
+		Layers: layers,
+	})
+	if err != nil {
+		t.Fatalf("put manifest: %+v", err)
+	}
+
+	archivePath := filepath.Join(root, "archive.tar")
+	fh, err := os.Create(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	if err := Export(ctx, engineExt, ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    manifestDigest,
+		Size:      manifestSize,
+	}, fh, &ExportOptions{RepoTags: []string{"example/exported:latest"}}); err != nil {
+		t.Fatalf("unexpected error exporting image: %+v", err)
+	}
+	if err := fh.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Check the archive manifest.
+	afh, err := os.Open(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer afh.Close()
+	idx, err := indexArchive(afh)
+	if err != nil {
+		t.Fatalf("unexpected error indexing archive: %+v", err)
+	}
+	var manifests []Manifest
+	if err := idx.readJSON(ManifestFile, &manifests); err != nil {
+		t.Fatalf("unexpected error reading archive manifest: %+v", err)
+	}
+	if len(manifests) != 1 {
+		t.Fatalf("expected one image in archive, got %d", len(manifests))
+	}
+	if tags := manifests[0].RepoTags; len(tags) != 1 || tags[0] != "example/exported:latest" {
+		t.Errorf("unexpected repo tags: %v", tags)
+	}
+	if manifests[0].Config != configDigest.Hex()+".json" {
+		t.Errorf("config must be stored with its digest as the name: %s", manifests[0].Config)
+	}
+	if len(manifests[0].Layers) != 3 {
+		t.Fatalf("expected 3 layers, got %d", len(manifests[0].Layers))
+	}
+
+	// Uncompressed and gzip layers are stored as-is.
+	for i, layer := range layers[:2] {
+		r, err := idx.open(manifests[0].Layers[i])
+		if err != nil {
+			t.Fatalf("unexpected error opening layer %d: %+v", i, err)
+		}
+		if layerDigest, err := digest.SHA256.FromReader(r); err != nil || layerDigest != layer.Digest {
+			t.Errorf("layer %d was modified: expected %s, got %s (err=%v)", i, layer.Digest, layerDigest, err)
+		}
+	}
+
+	// Importing the archive must give the same DiffIDs and configuration,
+	// with the zstd layer having been converted to gzip.
+	descriptor, err := Import(ctx, engineExt, archivePath, nil)
+	if err != nil {
+		t.Fatalf("unexpected error re-importing exported image: %+v", err)
+	}
+	blob, err := engineExt.FromDescriptor(ctx, descriptor)
+	if err != nil {
+		t.Fatalf("unexpected error getting manifest: %+v", err)
+	}
+	defer blob.Close()
+	manifest := blob.Data.(ispec.Manifest)
+	if manifest.Config.Digest != configDigest {
+		t.Errorf("config changed after round-trip: expected %s, got %s", configDigest, manifest.Config.Digest)
+	}
+	if manifest.Layers[0].Digest != layers[0].Digest || manifest.Layers[1].Digest != layers[1].Digest {
+		t.Errorf("layers changed after round-trip: %+v", manifest.Layers)
+	}
+	if manifest.Layers[2].MediaType != ispec.MediaTypeImageLayerGzip {
+		t.Errorf("zstd layer was not converted to gzip: %s", manifest.Layers[2].MediaType)
+	}
+}
+
+func TestExportForeignLayers(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestExportForeignLayers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	// A regular layer, a foreign layer which isn't in the image, and a
+	// foreign layer which is in the image.
+	layer1, diffID1 := makeTestLayer(t, map[string]string{"etc/hostname": "docker\n"}, false)
+	layer2, diffID2 := makeTestLayer(t, map[string]string{"foreign/missing": "missing\n"}, true)
+	layer3, diffID3 := makeTestLayer(t, map[string]string{"foreign/present": "present\n"}, false)
+	missing := ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageLayerNonDistributableGzip,
+		Digest:    digest.FromBytes(layer2),
+		Size:      int64(len(layer2)),
+		URLs:      []string{"https://example.com/layer.tar.gz"},
+	}
+	layers := []ispec.Descriptor{
+		putTestBlob(t, engineExt, ispec.MediaTypeImageLayer, layer1),
+		missing,
+		putTestBlob(t, engineExt, ispec.MediaTypeImageLayerNonDistributable, layer3),
+	}
+
+	configDigest, configSize, err := engineExt.PutBlobJSON(ctx, ispec.Image{
+		Architecture: "amd64",
+		OS:           "linux",
+		RootFS: ispec.RootFS{
+			Type:    "layers",
+			DiffIDs: []digest.Digest{diffID1, diffID2, diffID3},
+		},
+	})
+	if err != nil {
+		t.Fatalf("put config: %+v", err)
+	}
+	putManifest := func(layers []ispec.Descriptor) ispec.Descriptor {
+		manifestDigest, manifestSize, err := engineExt.PutBlobJSON(ctx, ispec.Manifest{
+			Versioned: imeta.Versioned{SchemaVersion: 2},
+			MediaType: ispec.MediaTypeImageManifest,
+			Config: ispec.Descriptor{
+				MediaType: ispec.MediaTypeImageConfig,
+				Digest:    configDigest,
+				Size:      configSize,
+			},
+			Layers: layers,
+		})
+		if err != nil {
+			t.Fatalf("put manifest: %+v", err)
+		}
+		return ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageManifest,
+			Digest:    manifestDigest,
+			Size:      manifestSize,
+		}
+	}
+
+	archivePath := filepath.Join(root, "archive.tar")
+	fh, err := os.Create(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	if err := Export(ctx, engineExt, putManifest(layers), fh, nil); err != nil {
+		t.Fatalf("unexpected error exporting image with foreign layers: %+v", err)
+	}
+	if err := fh.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	afh, err := os.Open(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer afh.Close()
+	idx, err := indexArchive(afh)
+	if err != nil {
+		t.Fatalf("unexpected error indexing archive: %+v", err)
+	}
+	var manifests []Manifest
+	if err := idx.readJSON(ManifestFile, &manifests); err != nil {
+		t.Fatalf("unexpected error reading archive manifest: %+v", err)
+	}
+	if len(manifests) != 1 || len(manifests[0].Layers) != 3 {
+		t.Fatalf("unexpected archive manifest: %+v", manifests)
+	}
+
+	// Both foreign layers are referenced, but only the one in the image is
+	// included in the archive.
+	sources := manifests[0].LayerSources
+	if len(sources) != 2 {
+		t.Errorf("expected 2 layer sources, got %+v", sources)
+	}
+	if source := sources[diffID2]; source.MediaType != MediaTypeDockerForeignLayer || source.Digest != missing.Digest || len(source.URLs) != 1 || source.URLs[0] != missing.URLs[0] {
+		t.Errorf("unexpected layer source for missing foreign layer: %+v", source)
+	}
+	if source := sources[diffID3]; source.MediaType != ispec.MediaTypeImageLayerNonDistributable || source.Digest != layers[2].Digest {
+		t.Errorf("unexpected layer source for included foreign layer: %+v", source)
+	}
+	if _, err := idx.open(manifests[0].Layers[1]); err == nil {
+		t.Errorf("foreign layer which isn't in the image should not be in the archive")
+	}
+	r, err := idx.open(manifests[0].Layers[2])
+	if err != nil {
+		t.Fatalf("unexpected error opening included foreign layer: %+v", err)
+	}
+	if layerDigest, err := digest.SHA256.FromReader(r); err != nil || layerDigest != layers[2].Digest {
+		t.Errorf("foreign layer was modified: expected %s, got %s (err=%v)", layers[2].Digest, layerDigest, err)
+	}
+
+	// Importing the archive must give back the original foreign layers.
+	descriptor, err := Import(ctx, engineExt, archivePath, nil)
+	if err != nil {
+		t.Fatalf("unexpected error re-importing exported image: %+v", err)
+	}
+	blob, err := engineExt.FromDescriptor(ctx, descriptor)
+	if err != nil {
+		t.Fatalf("unexpected error getting manifest: %+v", err)
+	}
+	defer blob.Close()
+	manifest := blob.Data.(ispec.Manifest)
+	for i, layer := range layers {
+		if got := manifest.Layers[i]; got.MediaType != layer.MediaType || got.Digest != layer.Digest {
+			t.Errorf("layer %d changed after round-trip: expected %+v, got %+v", i, layer, got)
+		}
+	}
+
+	// Foreign layers which aren't in the image can't be referenced without
+	// urls.
+	missing.URLs = nil
+	if err := Export(ctx, engineExt, putManifest([]ispec.Descriptor{layers[0], missing, layers[2]}), ioutil.Discard, nil); err == nil {
+		t.Errorf("expected exporting missing foreign layer without urls to fail")
+	}
+}
@@ -0,0 +1,339 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dockerarchive
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/apex/log"
+	zstd "github.com/klauspost/compress/zstd"
+	gzip "github.com/klauspost/pgzip"
+	"github.com/opencontainers/go-digest"
+	imeta "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/opencontainers/umoci/oci/casext/mediatype"
+	"github.com/pkg/errors"
+)
+
+// maxLinkDepth is the maximum number of links which will be followed when
+// looking up an entry in an archive. "docker save" uses symlinks between
+// layer directories for layers which are shared by several images.
+const maxLinkDepth = 32
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// entry is the location of a file inside an archive.
+type entry struct {
+	offset int64
+	size   int64
+}
+
+// archiveIndex is an index of the files inside an (uncompressed) tar archive,
+// allowing them to be read in any order.
+type archiveIndex struct {
+	file *os.File
+
+	// entries are the regular files in the archive.
+	entries map[string]entry
+
+	// links maps the names of symlinks and hardlinks inside the archive to
+	// the (cleaned) name they refer to.
+	links map[string]string
+}
+
+// cleanName returns the cleaned version of the given tar entry name, as a
+// relative path.
+func cleanName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// indexArchive builds an archiveIndex of the given archive.
+func indexArchive(fh *os.File) (*archiveIndex, error) {
+	idx := &archiveIndex{
+		file:    fh,
+		entries: map[string]entry{},
+		links:   map[string]string{},
+	}
+
+	tr := tar.NewReader(fh)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "read archive entry")
+		}
+
+		name := cleanName(hdr.Name)
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeRegA:
+			// archive/tar reads no further than the start of the data of the
+			// current entry, so the current offset of the file is the offset
+			// of the entry contents.
+			offset, err := fh.Seek(0, io.SeekCurrent)
+			if err != nil {
+				return nil, errors.Wrap(err, "get entry offset")
+			}
+			idx.entries[name] = entry{offset: offset, size: hdr.Size}
+		case tar.TypeSymlink:
+			idx.links[name] = cleanName(path.Join(path.Dir(name), hdr.Linkname))
+		case tar.TypeLink:
+			idx.links[name] = cleanName(hdr.Linkname)
+		default:
+			log.Debugf("docker-archive: ignoring entry %s", hdr.Name)
+		}
+	}
+	return idx, nil
+}
+
+// open returns a reader for the contents of the named file in the archive,
+// following any links.
+func (idx *archiveIndex) open(name string) (*io.SectionReader, error) {
+	name = cleanName(name)
+	for i := 0; i < maxLinkDepth; i++ {
+		if e, ok := idx.entries[name]; ok {
+			return io.NewSectionReader(idx.file, e.offset, e.size), nil
+		}
+		target, ok := idx.links[name]
+		if !ok {
+			return nil, errors.Wrapf(os.ErrNotExist, "missing archive entry %s", name)
+		}
+		name = target
+	}
+	return nil, errors.Errorf("too many levels of links resolving archive entry %s", name)
+}
+
+// readJSON parses the named file in the archive as JSON into v.
+func (idx *archiveIndex) readJSON(name string, v interface{}) error {
+	r, err := idx.open(name)
+	if err != nil {
+		return err
+	}
+	return errors.Wrapf(json.NewDecoder(r).Decode(v), "parse %s", name)
+}
+
+// ImportOptions modifies the behaviour of Import.
+type ImportOptions struct {
+	// RepoTag selects the image in the archive to import, which must have
+	// RepoTag as one of its RepoTags. If empty, the archive must contain
+	// exactly one image.
+	RepoTag string
+}
+
+// selectManifest returns the manifest (of an image inside a docker-archive)
+// with the given repo tag.
+func selectManifest(manifests []Manifest, repoTag string) (Manifest, error) {
+	var repoTags []string
+	for _, manifest := range manifests {
+		for _, tag := range manifest.RepoTags {
+			if tag == repoTag {
+				return manifest, nil
+			}
+			repoTags = append(repoTags, tag)
+		}
+	}
+	switch {
+	case len(manifests) == 0:
+		return Manifest{}, errors.Errorf("archive contains no images")
+	case repoTag != "":
+		return Manifest{}, errors.Errorf("archive contains no image tagged %s (available tags: %s)", repoTag, strings.Join(repoTags, ", "))
+	case len(manifests) > 1:
+		return Manifest{}, errors.Errorf("archive contains %d images, so a tag must be specified (available tags: %s)", len(manifests), strings.Join(repoTags, ", "))
+	}
+	return manifests[0], nil
+}
+
+// importLayer adds the named layer archive to the image, returning its
+// descriptor and DiffID. The layer is stored as-is (with a media type
+// matching its compression), so that its digest is unchanged.
+func importLayer(ctx context.Context, engineExt casext.Engine, idx *archiveIndex, name string) (ispec.Descriptor, digest.Digest, error) {
+	layer, err := idx.open(name)
+	if err != nil {
+		return ispec.Descriptor{}, "", err
+	}
+
+	magic := make([]byte, len(zstdMagic))
+	n, err := layer.ReadAt(magic, 0)
+	if err != nil && err != io.EOF {
+		return ispec.Descriptor{}, "", errors.Wrap(err, "read layer header")
+	}
+	magic = magic[:n]
+
+	layerDigest, layerSize, err := engineExt.PutBlob(ctx, io.NewSectionReader(layer, 0, layer.Size()))
+	if err != nil {
+		return ispec.Descriptor{}, "", errors.Wrap(err, "put layer blob")
+	}
+	descriptor := ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageLayer,
+		Digest:    layerDigest,
+		Size:      layerSize,
+	}
+
+	// Uncompressed layers are their own DiffID, otherwise we need to compute
+	// the digest of the decompressed layer.
+	var layerRaw io.ReadCloser
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		descriptor.MediaType = ispec.MediaTypeImageLayerGzip
+		gzr, err := gzip.NewReader(io.NewSectionReader(layer, 0, layer.Size()))
+		if err != nil {
+			return ispec.Descriptor{}, "", errors.Wrap(err, "create gzip reader")
+		}
+		layerRaw = gzr
+	case bytes.HasPrefix(magic, zstdMagic):
+		descriptor.MediaType = mediatype.MediaTypeImageLayerZstd
+		zr, err := zstd.NewReader(io.NewSectionReader(layer, 0, layer.Size()))
+		if err != nil {
+			return ispec.Descriptor{}, "", errors.Wrap(err, "create zstd reader")
+		}
+		layerRaw = zr.IOReadCloser()
+	default:
+		return descriptor, layerDigest, nil
+	}
+	defer layerRaw.Close()
+
+	diffID, err := digest.SHA256.FromReader(layerRaw)
+	if err != nil {
+		return ispec.Descriptor{}, "", errors.Wrap(err, "compute layer diffid")
+	}
+	return descriptor, diffID, nil
+}
+
+// Import adds the image stored in the docker-archive at archivePath to the
+// image layout, returning the descriptor of the new image manifest (which
+// is not tagged). The Docker image configuration is converted to an OCI image
+// configuration (any Docker-specific fields are dropped), and the layers are
+// stored unmodified with the equivalent OCI media type. The DiffIDs of the
+// layers are verified against the image configuration.
+func Import(ctx context.Context, engineExt casext.Engine, archivePath string, opt *ImportOptions) (ispec.Descriptor, error) {
+	var options ImportOptions
+	if opt != nil {
+		options = *opt
+	}
+
+	fh, err := os.Open(archivePath)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "open archive")
+	}
+	defer fh.Close()
+
+	idx, err := indexArchive(fh)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "index archive")
+	}
+
+	var manifests []Manifest
+	if err := idx.readJSON(ManifestFile, &manifests); err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "read archive manifest")
+	}
+	manifest, err := selectManifest(manifests, options.RepoTag)
+	if err != nil {
+		return ispec.Descriptor{}, err
+	}
+
+	log.WithFields(log.Fields{
+		"config":    manifest.Config,
+		"repo_tags": manifest.RepoTags,
+		"layers":    len(manifest.Layers),
+	}).Debugf("docker-archive: importing image")
+
+	// The Docker image configuration is a superset of the OCI one, so we can
+	// just drop any of the Docker-specific fields.
+	var config ispec.Image
+	if err := idx.readJSON(manifest.Config, &config); err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "read image config")
+	}
+	if config.RootFS.Type != "layers" {
+		return ispec.Descriptor{}, errors.Errorf("unsupported image config rootfs type: %q", config.RootFS.Type)
+	}
+	if len(config.RootFS.DiffIDs) != len(manifest.Layers) {
+		return ispec.Descriptor{}, errors.Errorf("image config has %d diffids but archive manifest has %d layers", len(config.RootFS.DiffIDs), len(manifest.Layers))
+	}
+
+	layers := []ispec.Descriptor{}
+	for i, layerPath := range manifest.Layers {
+		expectedDiffID := config.RootFS.DiffIDs[i]
+
+		// Foreign layers are not necessarily included in the archive, and
+		// instead their original descriptor is stored in LayerSources (with
+		// either the Docker foreign layer media type or, for archives written
+		// by umoci, an OCI non-distributable media type).
+		if source, ok := manifest.LayerSources[expectedDiffID]; ok && (source.MediaType == MediaTypeDockerForeignLayer || mediatype.IsNonDistributable(source.MediaType)) {
+			if source.MediaType == MediaTypeDockerForeignLayer {
+				source.MediaType = ispec.MediaTypeImageLayerNonDistributableGzip
+			}
+			log.Debugf("docker-archive: using foreign layer source %s for layer %d", source.Digest, i)
+			layers = append(layers, source)
+			continue
+		}
+
+		descriptor, diffID, err := importLayer(ctx, engineExt, idx, layerPath)
+		if err != nil {
+			return ispec.Descriptor{}, errors.Wrapf(err, "import layer %s", layerPath)
+		}
+		if diffID != expectedDiffID {
+			return ispec.Descriptor{}, errors.Errorf("layer %s has diffid %s but image config expected %s", layerPath, diffID, expectedDiffID)
+		}
+		log.WithFields(log.Fields{
+			"digest":    descriptor.Digest,
+			"mediatype": descriptor.MediaType,
+			"diffid":    diffID,
+		}).Debugf("docker-archive: imported layer %s", layerPath)
+		layers = append(layers, descriptor)
+	}
+
+	configDigest, configSize, err := engineExt.PutBlobJSON(ctx, config)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "put config blob")
+	}
+
+	ociManifest := ispec.Manifest{
+		Versioned: imeta.Versioned{
+			SchemaVersion: 2,
+		},
+		MediaType: ispec.MediaTypeImageManifest,
+		Config: ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageConfig,
+			Digest:    configDigest,
+			Size:      configSize,
+		},
+		Layers: layers,
+	}
+	manifestDigest, manifestSize, err := engineExt.PutBlobJSON(ctx, ociManifest)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "put manifest blob")
+	}
+
+	return ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    manifestDigest,
+		Size:      manifestSize,
+	}, nil
+}
@@ -0,0 +1,313 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dockerarchive
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	gzip "github.com/klauspost/pgzip"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/opencontainers/umoci/oci/cas/dir"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/opencontainers/umoci/oci/layer"
+)
+
+// makeTestLayer creates a layer archive containing the given files, returning
+// the (possibly compressed) archive and its DiffID.
+func makeTestLayer(t *testing.T, files map[string]string, compress bool) ([]byte, digest.Digest) {
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var raw bytes.Buffer
+	tw := tar.NewWriter(&raw)
+	for _, name := range names {
+		if err := tw.WriteHeader(&tar.Header{
+			Name:     name,
+			Typeflag: tar.TypeReg,
+			Mode:     0644,
+			Size:     int64(len(files[name])),
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(files[name])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	diffID := digest.FromBytes(raw.Bytes())
+
+	if !compress {
+		return raw.Bytes(), diffID
+	}
+	var compressed bytes.Buffer
+	gzw := gzip.NewWriter(&compressed)
+	if _, err := gzw.Write(raw.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return compressed.Bytes(), diffID
+}
+
+type testArchiveEntry struct {
+	name     string
+	data     []byte
+	linkname string
+}
+
+func writeTestArchive(t *testing.T, archivePath string, entries []testArchiveEntry) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, entry := range entries {
+		hdr := &tar.Header{
+			Name:     entry.name,
+			Typeflag: tar.TypeReg,
+			Mode:     0644,
+			Size:     int64(len(entry.data)),
+		}
+		if entry.linkname != "" {
+			hdr.Typeflag = tar.TypeSymlink
+			hdr.Linkname = entry.linkname
+			hdr.Size = 0
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(entry.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(archivePath, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func mustMarshal(t *testing.T, v interface{}) []byte {
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// dockerConfig returns a Docker image configuration (including some
+// Docker-specific fields) with the given DiffIDs.
+func dockerConfig(diffIDs ...digest.Digest) map[string]interface{} {
+	return map[string]interface{}{
+		"architecture":   "amd64",
+		"os":             "linux",
+		"created":        "2020-01-02T03:04:05Z",
+		"docker_version": "19.03.8",
+		"container":      "0123456789abcdef",
+		"container_config": map[string]interface{}{
+			"Hostname": "0123456789ab",
+		},
+		"config": map[string]interface{}{
+			"Hostname":   "0123456789ab",
+			"Env":        []string{"PATH=/usr/bin:/bin"},
+			"Cmd":        []string{"/usr/bin/hello"},
+			"WorkingDir": "/",
+		},
+		"rootfs": map[string]interface{}{
+			"type":     "layers",
+			"diff_ids": diffIDs,
+		},
+		"history": []map[string]interface{}{
+			{"created": "2020-01-02T03:04:05Z", "created_by": "ADD etc /etc"},
+			{"created": "2020-01-02T03:04:05Z", "created_by": "CMD [\"/usr/bin/hello\"]", "empty_layer": true},
+		},
+	}
+}
+
+func TestImport(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestImport")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	layer1, diffID1 := makeTestLayer(t, map[string]string{"etc/hostname": "docker\n"}, false)
+	layer2, diffID2 := makeTestLayer(t, map[string]string{"usr/bin/hello": "#!/bin/sh\necho hello\n"}, true)
+
+	// This mirrors the layout of "docker save" archives, where layers shared
+	// between images are symlinks.
+	archivePath := filepath.Join(root, "archive.tar")
+	writeTestArchive(t, archivePath, []testArchiveEntry{
+		{name: "aaaa/layer.tar", data: layer1},
+		{name: "aaaa/VERSION", data: []byte("1.0")},
+		{name: "bbbb/layer.tar", data: layer2},
+		{name: "cccc/layer.tar", linkname: "../aaaa/layer.tar"},
+		{name: "one.json", data: mustMarshal(t, dockerConfig(diffID1, diffID2))},
+		{name: "two.json", data: mustMarshal(t, dockerConfig(diffID1))},
+		{name: "bad.json", data: mustMarshal(t, dockerConfig(diffID2))},
+		{name: "repositories", data: []byte("{}")},
+		{name: ManifestFile, data: mustMarshal(t, []Manifest{
+			{Config: "one.json", RepoTags: []string{"example/one:latest"}, Layers: []string{"aaaa/layer.tar", "bbbb/layer.tar"}},
+			{Config: "two.json", RepoTags: []string{"example/two:v1"}, Layers: []string{"cccc/layer.tar"}},
+			{Config: "bad.json", RepoTags: []string{"example/bad:latest"}, Layers: []string{"aaaa/layer.tar"}},
+		})},
+	})
+
+	// An image must be selected if there is more than one.
+	if _, err := Import(ctx, engineExt, archivePath, nil); err == nil {
+		t.Errorf("expected an error importing multi-image archive without a repo tag")
+	}
+	if _, err := Import(ctx, engineExt, archivePath, &ImportOptions{RepoTag: "example/missing:latest"}); err == nil {
+		t.Errorf("expected an error importing non-existent repo tag")
+	}
+	// The layer DiffIDs must match the configuration.
+	if _, err := Import(ctx, engineExt, archivePath, &ImportOptions{RepoTag: "example/bad:latest"}); err == nil || !strings.Contains(err.Error(), "diffid") {
+		t.Errorf("expected a diffid error importing image with mismatched diffids, got %v", err)
+	}
+
+	descriptor, err := Import(ctx, engineExt, archivePath, &ImportOptions{RepoTag: "example/one:latest"})
+	if err != nil {
+		t.Fatalf("unexpected error importing image: %+v", err)
+	}
+	if descriptor.MediaType != ispec.MediaTypeImageManifest {
+		t.Errorf("unexpected manifest media type: %s", descriptor.MediaType)
+	}
+
+	blob, err := engineExt.FromDescriptor(ctx, descriptor)
+	if err != nil {
+		t.Fatalf("unexpected error getting manifest: %+v", err)
+	}
+	defer blob.Close()
+	manifest := blob.Data.(ispec.Manifest)
+
+	if manifest.Config.MediaType != ispec.MediaTypeImageConfig {
+		t.Errorf("unexpected config media type: %s", manifest.Config.MediaType)
+	}
+	if len(manifest.Layers) != 2 {
+		t.Fatalf("expected 2 layers, got %d", len(manifest.Layers))
+	}
+	if manifest.Layers[0].MediaType != ispec.MediaTypeImageLayer || manifest.Layers[0].Digest != diffID1 {
+		t.Errorf("unexpected first layer: %+v", manifest.Layers[0])
+	}
+	if manifest.Layers[1].MediaType != ispec.MediaTypeImageLayerGzip || manifest.Layers[1].Digest != digest.FromBytes(layer2) {
+		t.Errorf("unexpected second layer: %+v", manifest.Layers[1])
+	}
+
+	configBlob, err := engineExt.FromDescriptor(ctx, manifest.Config)
+	if err != nil {
+		t.Fatalf("unexpected error getting config: %+v", err)
+	}
+	defer configBlob.Close()
+	config := configBlob.Data.(ispec.Image)
+
+	if len(config.Config.Env) != 1 || config.Config.Env[0] != "PATH=/usr/bin:/bin" {
+		t.Errorf("config env not preserved: %v", config.Config.Env)
+	}
+	if len(config.History) != 2 || !config.History[1].EmptyLayer {
+		t.Errorf("config history not preserved: %+v", config.History)
+	}
+	rawConfig, err := json.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(rawConfig, []byte("docker_version")) || bytes.Contains(rawConfig, []byte("Hostname")) {
+		t.Errorf("docker-specific config fields were not dropped: %s", rawConfig)
+	}
+
+	// The image must be unpackable (which also verifies the DiffIDs).
+	rootfs := filepath.Join(root, "rootfs")
+	if err := layer.UnpackRootfs(ctx, engine, rootfs, manifest, &layer.UnpackOptions{
+		MapOptions: layer.MapOptions{
+			UIDMappings: []rspec.LinuxIDMapping{{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1}},
+			GIDMappings: []rspec.LinuxIDMapping{{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1}},
+			Rootless:    os.Geteuid() != 0,
+		},
+	}); err != nil {
+		t.Fatalf("unexpected error unpacking image: %+v", err)
+	}
+	for _, name := range []string{"etc/hostname", "usr/bin/hello"} {
+		if _, err := os.Lstat(filepath.Join(rootfs, name)); err != nil {
+			t.Errorf("unpacked rootfs is missing %s: %v", name, err)
+		}
+	}
+
+	// Symlinked layers must be resolved.
+	descriptor, err = Import(ctx, engineExt, archivePath, &ImportOptions{RepoTag: "example/two:v1"})
+	if err != nil {
+		t.Fatalf("unexpected error importing image with symlinked layer: %+v", err)
+	}
+	blob2, err := engineExt.FromDescriptor(ctx, descriptor)
+	if err != nil {
+		t.Fatalf("unexpected error getting manifest: %+v", err)
+	}
+	defer blob2.Close()
+	if layers := blob2.Data.(ispec.Manifest).Layers; len(layers) != 1 || layers[0].Digest != diffID1 {
+		t.Errorf("unexpected layers for image with symlinked layer: %+v", layers)
+	}
+}
+
+func TestTranslateMediaType(t *testing.T) {
+	for _, test := range []struct {
+		mediaType, expected string
+	}{
+		{MediaTypeDockerLayer, ispec.MediaTypeImageLayer},
+		{MediaTypeDockerLayerGzip, ispec.MediaTypeImageLayerGzip},
+		{MediaTypeDockerForeignLayer, ispec.MediaTypeImageLayerNonDistributableGzip},
+		{MediaTypeDockerConfig, ispec.MediaTypeImageConfig},
+		{MediaTypeDockerManifest, ispec.MediaTypeImageManifest},
+		{ispec.MediaTypeImageLayerGzip, ispec.MediaTypeImageLayerGzip},
+	} {
+		got, err := TranslateMediaType(test.mediaType)
+		if err != nil {
+			t.Errorf("TranslateMediaType(%s): unexpected error: %+v", test.mediaType, err)
+		} else if got != test.expected {
+			t.Errorf("TranslateMediaType(%s): expected %s, got %s", test.mediaType, test.expected, got)
+		}
+	}
+	if _, err := TranslateMediaType("application/x-unknown"); err == nil {
+		t.Errorf("TranslateMediaType: expected error for unknown media type")
+	}
+}
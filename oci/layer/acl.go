@@ -0,0 +1,124 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"encoding/binary"
+
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/opencontainers/umoci/pkg/idtools"
+	"github.com/pkg/errors"
+)
+
+// POSIX ACLs are stored by Linux as xattrs with a binary payload, which
+// (unlike the rest of the xattrs we handle) include user and group IDs that
+// need to be mapped in the same way as the owner of the inode.
+const (
+	aclXattrAccess  = "system.posix_acl_access"
+	aclXattrDefault = "system.posix_acl_default"
+)
+
+// The on-disk format of POSIX ACL xattrs, from <linux/posix_acl_xattr.h>. The
+// payload is a little-endian header (containing the version) followed by a
+// sequence of (tag, perm, id) entries.
+const (
+	aclXattrVersion = 0x0002
+	aclHeaderSize   = 4
+	aclEntrySize    = 8
+	aclTagUser      = 0x02
+	aclTagGroup     = 0x08
+	aclUndefinedID  = 0xffffffff
+)
+
+// isACLXattr returns whether the given xattr name is a POSIX ACL.
+func isACLXattr(name string) bool {
+	return name == aclXattrAccess || name == aclXattrDefault
+}
+
+// mapACL remaps all of the ACL_USER and ACL_GROUP entries in the given POSIX
+// ACL xattr payload using the provided functions, returning the new payload.
+// The other entries (ACL_USER_OBJ and so on) refer to the owner of the inode
+// and thus don't contain an ID.
+func mapACL(value string, mapUID, mapGID func(int) (int, error)) (string, error) {
+	payload := []byte(value)
+	if len(payload) < aclHeaderSize || (len(payload)-aclHeaderSize)%aclEntrySize != 0 {
+		return "", errors.Errorf("invalid posix acl xattr: bad length %d", len(payload))
+	}
+	if version := binary.LittleEndian.Uint32(payload[0:]); version != aclXattrVersion {
+		return "", errors.Errorf("invalid posix acl xattr: unsupported version %#x", version)
+	}
+
+	newPayload := make([]byte, len(payload))
+	copy(newPayload, payload)
+	for off := aclHeaderSize; off < len(newPayload); off += aclEntrySize {
+		entry := newPayload[off : off+aclEntrySize]
+
+		var mapFn func(int) (int, error)
+		switch tag := binary.LittleEndian.Uint16(entry[0:]); tag {
+		case aclTagUser:
+			mapFn = mapUID
+		case aclTagGroup:
+			mapFn = mapGID
+		default:
+			continue
+		}
+
+		id := binary.LittleEndian.Uint32(entry[4:])
+		if id == aclUndefinedID {
+			continue
+		}
+		newID, err := mapFn(int(id))
+		if err != nil {
+			return "", errors.Wrapf(err, "map posix acl entry id %d", id)
+		}
+		binary.LittleEndian.PutUint32(entry[4:], uint32(newID))
+	}
+	return string(newPayload), nil
+}
+
+// mapACLToContainer maps the POSIX ACL xattr payload from the host to the
+// container mappings.
+func mapACLToContainer(value string, mapOptions MapOptions) (string, error) {
+	return mapACL(value, idMapper(idtools.ToContainer, mapOptions.UIDMappings), idMapper(idtools.ToContainer, mapOptions.GIDMappings))
+}
+
+// mapACLToHost maps the POSIX ACL xattr payload from the container to the
+// host mappings, applying the OnUnmapped policy to unmapped entries. ACL
+// entries cannot be left unchanged, so unmapped entries are an error with
+// UnmappedSkip.
+func mapACLToHost(value string, mapOptions MapOptions) (string, error) {
+	return mapACL(value, skipMapper(mapOptions.uidToHost), skipMapper(mapOptions.gidToHost))
+}
+
+// skipMapper converts the result of a MapOptions.toHost-style mapper for
+// unmapped IDs with UnmappedSkip into an error.
+func skipMapper(fn func(int) (int, error)) func(int) (int, error) {
+	return func(id int) (int, error) {
+		newID, err := fn(id)
+		if err == nil && newID == unmappedHostID {
+			err = errors.Errorf("container id %d cannot be mapped to a host id", id)
+		}
+		return newID, err
+	}
+}
+
+func idMapper(fn func(int, []rspec.LinuxIDMapping) (int, error), idMap []rspec.LinuxIDMapping) func(int) (int, error) {
+	return func(id int) (int, error) {
+		return fn(id, idMap)
+	}
+}
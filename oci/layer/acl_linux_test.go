@@ -0,0 +1,253 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/opencontainers/umoci/pkg/system"
+	"golang.org/x/sys/unix"
+)
+
+type aclEntry struct {
+	tag  uint16
+	perm uint16
+	id   uint32
+}
+
+// makeACL builds a POSIX ACL xattr payload from the given entries.
+func makeACL(entries ...aclEntry) string {
+	payload := make([]byte, aclHeaderSize, aclHeaderSize+aclEntrySize*len(entries))
+	binary.LittleEndian.PutUint32(payload, aclXattrVersion)
+	for _, entry := range entries {
+		var buf [aclEntrySize]byte
+		binary.LittleEndian.PutUint16(buf[0:], entry.tag)
+		binary.LittleEndian.PutUint16(buf[2:], entry.perm)
+		binary.LittleEndian.PutUint32(buf[4:], entry.id)
+		payload = append(payload, buf[:]...)
+	}
+	return string(payload)
+}
+
+// testACL returns an ACL payload containing a named user and group entry with
+// the given IDs (in addition to the usual owner, mask and other entries).
+func testACL(uid, gid uint32) string {
+	return makeACL(
+		aclEntry{0x01, 06, aclUndefinedID}, // ACL_USER_OBJ
+		aclEntry{aclTagUser, 04, uid},
+		aclEntry{0x04, 04, aclUndefinedID}, // ACL_GROUP_OBJ
+		aclEntry{aclTagGroup, 05, gid},
+		aclEntry{0x10, 05, aclUndefinedID}, // ACL_MASK
+		aclEntry{0x20, 04, aclUndefinedID}, // ACL_OTHER
+	)
+}
+
+func TestMapACL(t *testing.T) {
+	mapOptions := MapOptions{
+		UIDMappings: []rspec.LinuxIDMapping{{HostID: 100000, ContainerID: 0, Size: 65536}},
+		GIDMappings: []rspec.LinuxIDMapping{{HostID: 200000, ContainerID: 0, Size: 65536}},
+	}
+
+	hostACL, err := mapACLToHost(testACL(1000, 1001), mapOptions)
+	if err != nil {
+		t.Fatalf("unexpected error mapping acl to host: %+v", err)
+	}
+	if expected := testACL(101000, 201001); hostACL != expected {
+		t.Errorf("mapACLToHost: expected %x, got %x", expected, hostACL)
+	}
+
+	ctrACL, err := mapACLToContainer(hostACL, mapOptions)
+	if err != nil {
+		t.Fatalf("unexpected error mapping acl to container: %+v", err)
+	}
+	if expected := testACL(1000, 1001); ctrACL != expected {
+		t.Errorf("mapACLToContainer: expected %x, got %x", expected, ctrACL)
+	}
+
+	// IDs outside the mapping must result in an error.
+	if _, err := mapACLToHost(testACL(70000, 1001), mapOptions); err == nil {
+		t.Errorf("mapACLToHost: expected error with unmapped uid")
+	}
+	if _, err := mapACLToContainer(testACL(1000, 1001), mapOptions); err == nil {
+		t.Errorf("mapACLToContainer: expected error with unmapped uid")
+	}
+
+	// Malformed payloads must result in an error.
+	for _, bad := range []string{
+		"",
+		"\x02\x00",
+		makeACL() + "\x01\x00",
+		"\x03\x00\x00\x00",
+	} {
+		if _, err := mapACL(bad, nil, nil); err == nil {
+			t.Errorf("mapACL: expected error with malformed payload %x", bad)
+		}
+	}
+}
+
+func TestUnmapRootlessACL(t *testing.T) {
+	hdr := &tar.Header{
+		Name: "file",
+		Xattrs: map[string]string{
+			aclXattrAccess: testACL(1000, 1000),
+		},
+	}
+	mapOptions := MapOptions{
+		UIDMappings: []rspec.LinuxIDMapping{{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1}},
+		GIDMappings: []rspec.LinuxIDMapping{{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1}},
+		Rootless:    true,
+	}
+
+	// Rootless unpacking cannot represent the ACL, so it is dropped.
+	if err := unmapHeader(hdr, mapOptions); err != nil {
+		t.Fatalf("unexpected error in unmapHeader: %+v", err)
+	}
+	if _, ok := hdr.Xattrs[aclXattrAccess]; ok {
+		t.Errorf("expected unmappable acl to be dropped in rootless mode")
+	}
+}
+
+func TestUnmapUnmappedACL(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		policy    UnmappedPolicy
+		expectErr bool
+		expectACL string // "" means the acl is dropped
+	}{
+		{"Error", UnmappedError, true, ""},
+		{"Skip", UnmappedSkip, false, ""},
+		{"Nobody", UnmappedNobody, false, testACL(100000+DefaultNobodyID, 201001)},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			hdr := &tar.Header{
+				Name: "file",
+				Xattrs: map[string]string{
+					aclXattrAccess: testACL(70000, 1001),
+				},
+			}
+			mapOptions := MapOptions{
+				UIDMappings: []rspec.LinuxIDMapping{{HostID: 100000, ContainerID: 0, Size: 65536}},
+				GIDMappings: []rspec.LinuxIDMapping{{HostID: 200000, ContainerID: 0, Size: 65536}},
+				OnUnmapped:  test.policy,
+			}
+
+			err := unmapHeader(hdr, mapOptions)
+			if test.expectErr {
+				if err == nil {
+					t.Errorf("expected unmapHeader to fail with unmapped acl entry")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error in unmapHeader: %+v", err)
+			}
+			acl, ok := hdr.Xattrs[aclXattrAccess]
+			if test.expectACL == "" {
+				if ok {
+					t.Errorf("expected unmappable acl to be dropped")
+				}
+			} else if acl != test.expectACL {
+				t.Errorf("unexpected mapped acl: expected %x, got %x", test.expectACL, acl)
+			}
+		})
+	}
+}
+
+func TestTarACLRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestTarACLRoundTrip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	dst := filepath.Join(dir, "dst")
+	for _, path := range []string{src, dst} {
+		if err := os.Mkdir(path, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	accessACL := testACL(1000, 1001)
+	defaultACL := testACL(1002, 1003)
+
+	if err := os.Mkdir(filepath.Join(src, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "file"), []byte("file"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Lsetxattr(filepath.Join(src, "dir"), aclXattrDefault, []byte(defaultACL), 0); err != nil {
+		t.Skipf("skipping test: posix acls unsupported: %v", err)
+	}
+	if err := unix.Lsetxattr(filepath.Join(src, "file"), aclXattrAccess, []byte(accessACL), 0); err != nil {
+		t.Skipf("skipping test: posix acls unsupported: %v", err)
+	}
+
+	// Generate a layer containing both paths.
+	var buf bytes.Buffer
+	tg := newTarGenerator(&buf, MapOptions{})
+	for _, name := range []string{"dir", "file"} {
+		if err := tg.AddFile(name, filepath.Join(src, name)); err != nil {
+			t.Fatalf("AddFile %s: unexpected error: %+v", name, err)
+		}
+	}
+	if err := tg.tw.Close(); err != nil {
+		t.Fatalf("tw.Close: unexpected error: %+v", err)
+	}
+
+	// Extract the layer again.
+	te := NewTarExtractor(UnpackOptions{})
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("read tar: %+v", err)
+		}
+		if err := te.UnpackEntry(dst, hdr, tr); err != nil {
+			t.Fatalf("UnpackEntry %s: unexpected error: %+v", hdr.Name, err)
+		}
+	}
+
+	for _, test := range []struct {
+		path, name, value string
+	}{
+		{"dir", aclXattrDefault, defaultACL},
+		{"file", aclXattrAccess, accessACL},
+	} {
+		value, err := system.Lgetxattr(filepath.Join(dst, test.path), test.name)
+		if err != nil {
+			t.Errorf("%s: unexpected error getting %s: %+v", test.path, test.name, err)
+			continue
+		}
+		if string(value) != test.value {
+			t.Errorf("%s: %s changed: expected %x, got %x", test.path, test.name, test.value, value)
+		}
+	}
+}
@@ -0,0 +1,394 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/umoci/pkg/fseval"
+	"github.com/opencontainers/umoci/pkg/system"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// layerCacheOptions are the UnpackOptions which affect what an extracted
+// rootfs looks like on-disk. Rootfs snapshots are only shared between unpacks
+// with the same options.
+type layerCacheOptions struct {
+	MapOptions         MapOptions         `json:"map_options"`
+	KeepDirlinks       bool               `json:"keep_dirlinks"`
+	WhiteoutMode       WhiteoutMode       `json:"whiteout_mode"`
+	RootlessDeviceMode RootlessDeviceMode `json:"rootless_device_mode"`
+	ShadowXattrs       bool               `json:"shadow_xattrs"`
+	NoPreserveAtime    bool               `json:"no_preserve_atime"`
+	UserNamespace      bool               `json:"user_namespace"`
+}
+
+// layerCache is a directory containing snapshots of extracted rootfs
+// directories, keyed by the ChainID of the layers which were extracted to
+// produce them (so the snapshot for the ChainID of the first N layers of an
+// image can be used in place of extracting those N layers). Snapshots are
+// cloned into and out of the cache with reflinks where possible, falling back
+// to copying the file contents.
+//
+// The layout of the cache is <root>/<options>/<chainid>, where <options> is
+// the digest of the layerCacheOptions used when extracting the layers.
+type layerCache struct {
+	dir    string
+	cloner *treeCloner
+}
+
+// openLayerCache opens (creating it if necessary) the layer cache at the path
+// given in opt.LayerCache.
+func openLayerCache(opt *UnpackOptions) (*layerCache, error) {
+	cacheOpts := layerCacheOptions{
+		MapOptions:         opt.MapOptions,
+		KeepDirlinks:       opt.KeepDirlinks,
+		WhiteoutMode:       opt.WhiteoutMode,
+		RootlessDeviceMode: opt.RootlessDeviceMode,
+		ShadowXattrs:       opt.ShadowXattrs,
+		NoPreserveAtime:    opt.NoPreserveAtime,
+		UserNamespace:      inUserNamespace(),
+	}
+	optsJSON, err := json.Marshal(cacheOpts)
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal layer cache options")
+	}
+	dir := filepath.Join(opt.LayerCache, digest.FromBytes(optsJSON).Encoded())
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrap(err, "create layer cache")
+	}
+
+	fsEval := fseval.Default
+	if opt.MapOptions.Rootless {
+		fsEval = fseval.Rootless
+	}
+	return &layerCache{
+		dir: dir,
+		cloner: &treeCloner{
+			fsEval:   fsEval,
+			rootless: opt.MapOptions.Rootless,
+			reflink:  true,
+		},
+	}, nil
+}
+
+// chainIDs returns the ChainID of each prefix of the given list of DiffIDs, as
+// defined by the image-spec.
+func chainIDs(diffIDs []digest.Digest) []digest.Digest {
+	var chain []digest.Digest
+	for idx, diffID := range diffIDs {
+		chainID := diffID
+		if idx > 0 {
+			chainID = digest.FromString(chain[idx-1].String() + " " + diffID.String())
+		}
+		chain = append(chain, chainID)
+	}
+	return chain
+}
+
+// path returns the path of the snapshot for the given ChainID.
+func (lc *layerCache) path(chainID digest.Digest) string {
+	return filepath.Join(lc.dir, chainID.Encoded())
+}
+
+// Lookup returns the number of layers (of the layers with the given ChainIDs)
+// which have a snapshot in the cache. That is, the snapshot of
+// chainIDs[n-1] can be used in place of extracting the first n layers. If
+// none of the layers are cached, 0 is returned.
+func (lc *layerCache) Lookup(chainIDs []digest.Digest) int {
+	for n := len(chainIDs); n > 0; n-- {
+		if fi, err := os.Lstat(lc.path(chainIDs[n-1])); err == nil && fi.IsDir() {
+			return n
+		}
+	}
+	return 0
+}
+
+// errNoReflink is returned by layerCache.Store (and treeCloner.Clone) when a
+// snapshot may only be created using reflinks, but the files cannot be
+// reflinked.
+var errNoReflink = errors.New("cannot reflink files")
+
+// Restore clones the snapshot for the given ChainID to the (already existing,
+// and empty) root. onPath is called with the path (relative to root) of each
+// restored inode.
+func (lc *layerCache) Restore(chainID digest.Digest, root string, onPath func(string)) error {
+	if err := lc.cloner.Clone(lc.path(chainID), root, onPath, false); err != nil {
+		return errors.Wrapf(err, "restore layer cache snapshot %s", chainID)
+	}
+	return nil
+}
+
+// Store creates a snapshot of root (in which exactly the layers with the
+// given ChainID have been extracted) in the cache. If the snapshot already
+// exists, nothing is done. If reflinkOnly is set, the snapshot is only created
+// if the files in root can be reflinked into the cache (otherwise errNoReflink
+// is returned) -- this is used for the snapshots of intermediate layers, as
+// copying the entire rootfs after every layer would make unpacking an image
+// quadratic in the number of layers.
+func (lc *layerCache) Store(chainID digest.Digest, root string, reflinkOnly bool) (Err error) {
+	snapshot := lc.path(chainID)
+	if _, err := os.Lstat(snapshot); err == nil {
+		return nil
+	}
+	if reflinkOnly && !lc.cloner.reflink {
+		return errNoReflink
+	}
+
+	// Every snapshot is first created in a temporary directory and then
+	// renamed, so that concurrent unpacks never see partial snapshots.
+	tmpDir, err := ioutil.TempDir(lc.dir, ".tmp-")
+	if err != nil {
+		return errors.Wrap(err, "create layer cache snapshot")
+	}
+	defer func() {
+		// It's too late to care about errors.
+		// #nosec G104
+		_ = lc.cloner.fsEval.RemoveAll(tmpDir)
+	}()
+
+	if err := lc.cloner.Clone(root, tmpDir, nil, reflinkOnly); err != nil {
+		return errors.Wrapf(err, "create layer cache snapshot %s", chainID)
+	}
+	if err := os.Rename(tmpDir, snapshot); err != nil {
+		// Someone else created the same snapshot in the meantime.
+		if _, err := os.Lstat(snapshot); err == nil {
+			return nil
+		}
+		return errors.Wrapf(err, "create layer cache snapshot %s", chainID)
+	}
+	return nil
+}
+
+// cloneIgnoreXattrs are xattrs which are specific to the filesystem an inode
+// is on, and so are not copied when cloning a tree.
+var cloneIgnoreXattrs = map[string]struct{}{
+	"security.selinux": {},
+	"system.nfs4_acl":  {},
+}
+
+// treeCloner copies directory trees, preserving all of the metadata of the
+// inodes that a TarExtractor could have created (including hardlinks within
+// the tree).
+type treeCloner struct {
+	fsEval   fseval.FsEval
+	rootless bool
+
+	// reflink is whether we should try to reflink files. It is cleared once
+	// reflinking fails, to avoid retrying for every file.
+	reflink bool
+}
+
+// inodeKey uniquely identifies an inode.
+type inodeKey struct {
+	dev, ino uint64
+}
+
+// clonedDir is a directory whose metadata has to be applied after all of its
+// children have been created.
+type clonedDir struct {
+	path         string
+	mode         os.FileMode
+	atime, mtime time.Time
+}
+
+// Clone copies the contents of src to dst, which must already exist (its
+// metadata is replaced with the metadata of src). onPath (if non-nil) is
+// called with the path (relative to dst) of every inode created in dst. If
+// reflinkOnly is set, errNoReflink is returned rather than copying the
+// contents of files which cannot be reflinked.
+func (tc *treeCloner) Clone(src, dst string, onPath func(string), reflinkOnly bool) error {
+	inodes := map[inodeKey]string{}
+	var dirs []clonedDir
+
+	err := tc.fsEval.Walk(src, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return errors.Wrap(err, "get relative path")
+		}
+		target := filepath.Join(dst, rel)
+
+		st, err := tc.fsEval.Lstatx(path)
+		if err != nil {
+			return errors.Wrap(err, "lstat")
+		}
+
+		// Hardlinks only need to be linked to the first copy of the inode.
+		if !fi.IsDir() && st.Nlink > 1 {
+			key := inodeKey{dev: uint64(st.Dev), ino: st.Ino}
+			if linkTarget, ok := inodes[key]; ok {
+				if err := tc.fsEval.Link(linkTarget, target); err != nil {
+					return errors.Wrap(err, "clone hardlink")
+				}
+				if onPath != nil {
+					onPath(rel)
+				}
+				return nil
+			}
+			inodes[key] = target
+		}
+
+		switch fi.Mode() & os.ModeType {
+		case os.ModeDir:
+			if rel != "." {
+				// The mode is applied once all of the children are created.
+				if err := tc.fsEval.MkdirAll(target, 0700); err != nil {
+					return errors.Wrap(err, "clone directory")
+				}
+			}
+		case 0:
+			if err := tc.cloneFile(path, target, reflinkOnly); err != nil {
+				return errors.Wrap(err, "clone file")
+			}
+		case os.ModeSymlink:
+			linkname, err := tc.fsEval.Readlink(path)
+			if err != nil {
+				return errors.Wrap(err, "read symlink")
+			}
+			if err := tc.fsEval.Symlink(linkname, target); err != nil {
+				return errors.Wrap(err, "clone symlink")
+			}
+		case os.ModeNamedPipe, os.ModeDevice, os.ModeDevice | os.ModeCharDevice:
+			if err := tc.fsEval.Mknod(target, os.FileMode(st.Mode), st.Rdev); err != nil {
+				return errors.Wrap(err, "clone special file")
+			}
+		case os.ModeSocket:
+			// Sockets are never extracted from layers.
+			log.Debugf("clone tree: skipping socket %s", path)
+			return nil
+		default:
+			return errors.Errorf("clone tree: unknown file type of %s: %v", path, fi.Mode())
+		}
+
+		if err := tc.cloneXattrs(path, target); err != nil {
+			return err
+		}
+		// If we are rootless then we own everything anyway.
+		if !tc.rootless {
+			// NOTE: This is not done through fsEval.
+			if err := os.Lchown(target, int(st.Uid), int(st.Gid)); err != nil {
+				return errors.Wrap(err, "clone owner")
+			}
+		}
+
+		atime := time.Unix(st.Atim.Unix())
+		mtime := time.Unix(st.Mtim.Unix())
+		switch {
+		case fi.IsDir():
+			dirs = append(dirs, clonedDir{path: target, mode: fi.Mode(), atime: atime, mtime: mtime})
+		default:
+			// Symlinks don't have a mode of their own.
+			if fi.Mode()&os.ModeSymlink == 0 {
+				if err := tc.fsEval.Chmod(target, fi.Mode()); err != nil {
+					return errors.Wrap(err, "clone mode")
+				}
+			}
+			if err := tc.fsEval.Lutimes(target, atime, mtime); err != nil {
+				return errors.Wrap(err, "clone times")
+			}
+		}
+
+		if onPath != nil && rel != "." {
+			onPath(rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Directories are walked before their children, so apply their metadata
+	// in reverse (otherwise creating the children would change the mtime).
+	for idx := len(dirs) - 1; idx >= 0; idx-- {
+		dir := dirs[idx]
+		if err := tc.fsEval.Chmod(dir.path, dir.mode); err != nil {
+			return errors.Wrap(err, "clone directory mode")
+		}
+		if err := tc.fsEval.Lutimes(dir.path, dir.atime, dir.mtime); err != nil {
+			return errors.Wrap(err, "clone directory times")
+		}
+	}
+	return nil
+}
+
+// cloneFile copies the regular file src to dst (which must not exist),
+// reflinking the contents if possible. If reflinkOnly is set, errNoReflink is
+// returned if the contents cannot be reflinked.
+func (tc *treeCloner) cloneFile(src, dst string, reflinkOnly bool) error {
+	srcFile, err := tc.fsEval.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+
+	dstFile, err := tc.fsEval.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer dstFile.Close()
+
+	if tc.reflink {
+		err := system.Reflink(dstFile, srcFile)
+		if err == nil {
+			return dstFile.Close()
+		}
+		log.Debugf("clone tree: cannot reflink files, falling back to copying: %v", err)
+		tc.reflink = false
+	}
+	if reflinkOnly {
+		return errNoReflink
+	}
+	if _, err := system.Copy(dstFile, srcFile); err != nil {
+		return err
+	}
+	return dstFile.Close()
+}
+
+// cloneXattrs copies all of the xattrs of src to dst.
+func (tc *treeCloner) cloneXattrs(src, dst string) error {
+	names, err := tc.fsEval.Llistxattr(src)
+	if err != nil {
+		if errors.Cause(err) == unix.ENOTSUP {
+			return nil
+		}
+		return errors.Wrap(err, "list xattrs")
+	}
+	for _, name := range names {
+		if _, skip := cloneIgnoreXattrs[name]; skip {
+			continue
+		}
+		value, err := tc.fsEval.Lgetxattr(src, name)
+		if err != nil {
+			return errors.Wrapf(err, "get xattr %q", name)
+		}
+		if err := tc.fsEval.Lsetxattr(dst, name, value, 0); err != nil {
+			return errors.Wrapf(err, "clone xattr %q", name)
+		}
+	}
+	return nil
+}
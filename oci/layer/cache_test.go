@@ -0,0 +1,464 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/opencontainers/umoci/oci/cas/dir"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/opencontainers/umoci/pkg/system"
+)
+
+// putCacheTestImage creates an image from the given (uncompressed) layers
+// and returns its manifest.
+func putCacheTestImage(t testing.TB, engineExt casext.Engine, layers []ispec.Descriptor) ispec.Manifest {
+	var diffIDs []digest.Digest
+	for _, layer := range layers {
+		diffIDs = append(diffIDs, layer.Digest)
+	}
+	config := ispec.Image{
+		OS: "linux",
+		RootFS: ispec.RootFS{
+			Type:    "layers",
+			DiffIDs: diffIDs,
+		},
+	}
+	configDigest, configSize, err := engineExt.PutBlobJSON(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ispec.Manifest{
+		Versioned: specs.Versioned{
+			SchemaVersion: 2,
+		},
+		MediaType: ispec.MediaTypeImageManifest,
+		Config: ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageConfig,
+			Digest:    configDigest,
+			Size:      configSize,
+		},
+		Layers: layers,
+	}
+}
+
+func cacheTestUnpackOptions() *UnpackOptions {
+	return &UnpackOptions{MapOptions: MapOptions{
+		UIDMappings: []rspec.LinuxIDMapping{
+			{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1},
+		},
+		GIDMappings: []rspec.LinuxIDMapping{
+			{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1},
+		},
+		Rootless: os.Geteuid() != 0,
+	}}
+}
+
+// describeTreeTimes is like describeTree, but also includes the modification
+// time of every path.
+func describeTreeTimes(t *testing.T, root string) []string {
+	tree := describeTree(t, root)
+	for idx, desc := range tree {
+		rel := strings.SplitN(desc, " ", 2)[0]
+		fi, err := os.Lstat(filepath.Join(root, rel))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tree[idx] = fmt.Sprintf("%s mtime=%d", desc, fi.ModTime().UnixNano())
+	}
+	return tree
+}
+
+// canReflink returns whether files in the given directory can be reflinked.
+func canReflink(t testing.TB, dir string) bool {
+	src, err := ioutil.TempFile(dir, "reflink-src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(src.Name())
+	defer src.Close()
+	dst, err := ioutil.TempFile(dir, "reflink-dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(dst.Name())
+	defer dst.Close()
+	return system.Reflink(dst, src) == nil
+}
+
+func TestChainIDs(t *testing.T) {
+	diffIDs := []digest.Digest{
+		digest.FromString("a"),
+		digest.FromString("b"),
+		digest.FromString("c"),
+	}
+	chain := chainIDs(diffIDs)
+	expected := []digest.Digest{diffIDs[0]}
+	expected = append(expected, digest.FromString(expected[0].String()+" "+diffIDs[1].String()))
+	expected = append(expected, digest.FromString(expected[1].String()+" "+diffIDs[2].String()))
+	if !reflect.DeepEqual(chain, expected) {
+		t.Errorf("unexpected chain ids: expected %v, got %v", expected, chain)
+	}
+	if chain := chainIDs(nil); len(chain) != 0 {
+		t.Errorf("unexpected chain ids for no layers: %v", chain)
+	}
+}
+
+func TestUnpackRootfsLayerCache(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestUnpackRootfsLayerCache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatal(err)
+	}
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	base := putSquashTestLayer(t, engineExt, []squashTestEntry{
+		{hdr: tar.Header{Name: "etc/", Typeflag: tar.TypeDir, ModTime: mtime}},
+		{hdr: tar.Header{Name: "etc/passwd", Typeflag: tar.TypeReg, ModTime: mtime}, content: "root:x:0:0"},
+		{hdr: tar.Header{Name: "etc/shadow", Typeflag: tar.TypeReg, Mode: 0600, ModTime: mtime}, content: "root:!:"},
+		{hdr: tar.Header{Name: "etc/hosts", Typeflag: tar.TypeReg, ModTime: mtime}, content: "localhost"},
+		{hdr: tar.Header{Name: "etc/hosts.link", Typeflag: tar.TypeLink, Linkname: "etc/hosts"}},
+		{hdr: tar.Header{Name: "private/", Typeflag: tar.TypeDir, Mode: 0700, ModTime: mtime}},
+		{hdr: tar.Header{Name: "private/key", Typeflag: tar.TypeReg, Mode: 0400, ModTime: mtime}, content: "secret"},
+		{hdr: tar.Header{Name: "usr/", Typeflag: tar.TypeDir, ModTime: mtime}},
+		{hdr: tar.Header{Name: "usr/bin/", Typeflag: tar.TypeDir, ModTime: mtime}},
+		{hdr: tar.Header{Name: "usr/bin/su", Typeflag: tar.TypeReg, Mode: 04755, ModTime: mtime}, content: "#!su"},
+		{hdr: tar.Header{Name: "bin", Typeflag: tar.TypeSymlink, Linkname: "usr/bin", ModTime: mtime}},
+	}, false)
+	middle := putSquashTestLayer(t, engineExt, []squashTestEntry{
+		{hdr: tar.Header{Name: "etc/.wh.shadow", Typeflag: tar.TypeReg}},
+		{hdr: tar.Header{Name: "etc/hosts", Typeflag: tar.TypeReg, ModTime: mtime}, content: "new localhost"},
+		{hdr: tar.Header{Name: "etc/passwd.link", Typeflag: tar.TypeLink, Linkname: "etc/passwd"}},
+	}, false)
+	top1 := putSquashTestLayer(t, engineExt, []squashTestEntry{
+		{hdr: tar.Header{Name: "app1", Typeflag: tar.TypeReg, ModTime: mtime}, content: "app1"},
+	}, false)
+	top2 := putSquashTestLayer(t, engineExt, []squashTestEntry{
+		{hdr: tar.Header{Name: "etc/.wh.hosts.link", Typeflag: tar.TypeReg}},
+		{hdr: tar.Header{Name: "app2", Typeflag: tar.TypeReg, ModTime: mtime}, content: "app2"},
+	}, false)
+
+	baseImage := putCacheTestImage(t, engineExt, []ispec.Descriptor{base, middle})
+	image1 := putCacheTestImage(t, engineExt, []ispec.Descriptor{base, middle, top1})
+	image2 := putCacheTestImage(t, engineExt, []ispec.Descriptor{base, middle, top2})
+	cacheDir := filepath.Join(root, "cache")
+
+	// Populate the cache with the first image. Snapshots of the intermediate
+	// layers are only stored if they can be reflinked, but the final rootfs is
+	// always stored.
+	opt := cacheTestUnpackOptions()
+	opt.LayerCache = cacheDir
+	if err := UnpackRootfs(ctx, engineExt, filepath.Join(root, "rootfs1"), image1, opt); err != nil {
+		t.Fatalf("unexpected UnpackRootfs error: %+v", err)
+	}
+	cache, err := openLayerCache(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := getLayersConfig(ctx, engineExt, image1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := cache.Lookup(chainIDs(config.RootFS.DiffIDs)); n != 3 {
+		t.Errorf("expected all layers of the first image to be cached, got %d", n)
+	}
+	config, err = getLayersConfig(ctx, engineExt, image2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := chainIDs(config.RootFS.DiffIDs)
+	expectedCached := 0
+	if canReflink(t, root) {
+		expectedCached = 2
+	}
+	if n := cache.Lookup(chain); n != expectedCached {
+		t.Errorf("expected the first %d layers of the second image to be cached, got %d", expectedCached, n)
+	}
+
+	// Unpacking the base image caches its final rootfs.
+	opt = cacheTestUnpackOptions()
+	opt.LayerCache = cacheDir
+	if err := UnpackRootfs(ctx, engineExt, filepath.Join(root, "rootfs-base"), baseImage, opt); err != nil {
+		t.Fatalf("unexpected UnpackRootfs error: %+v", err)
+	}
+	if n := cache.Lookup(chain); n != 2 {
+		t.Fatalf("expected the first 2 layers of the second image to be cached, got %d", n)
+	}
+
+	// Unpack the second image with the cache, and without.
+	var (
+		afterLayer    []digest.Digest
+		created       []string
+		progressTotal int64
+	)
+	opt = cacheTestUnpackOptions()
+	opt.LayerCache = cacheDir
+	opt.AfterLayerUnpack = func(_ ispec.Manifest, desc ispec.Descriptor) error {
+		afterLayer = append(afterLayer, desc.Digest)
+		return nil
+	}
+	opt.OnPathChange = func(path string, change PathChange) {
+		if change == PathCreated {
+			created = append(created, path)
+		}
+	}
+	opt.Progress = func(_, total int64) {
+		progressTotal = total
+	}
+	cachedRootfs := filepath.Join(root, "rootfs2-cached")
+	if err := UnpackRootfs(ctx, engineExt, cachedRootfs, image2, opt); err != nil {
+		t.Fatalf("unexpected UnpackRootfs error: %+v", err)
+	}
+
+	freshRootfs := filepath.Join(root, "rootfs2-fresh")
+	if err := UnpackRootfs(ctx, engineExt, freshRootfs, image2, cacheTestUnpackOptions()); err != nil {
+		t.Fatalf("unexpected UnpackRootfs error: %+v", err)
+	}
+
+	cachedTree := describeTreeTimes(t, cachedRootfs)
+	freshTree := describeTreeTimes(t, freshRootfs)
+	if !reflect.DeepEqual(cachedTree, freshTree) {
+		t.Errorf("rootfs restored from cache doesn't match fresh rootfs:\n cached: %q\n  fresh: %q", cachedTree, freshTree)
+	}
+
+	expectedLayers := []digest.Digest{base.Digest, middle.Digest, top2.Digest}
+	if !reflect.DeepEqual(afterLayer, expectedLayers) {
+		t.Errorf("AfterLayerUnpack called with unexpected layers: expected %v, got %v", expectedLayers, afterLayer)
+	}
+	if progressTotal != top2.Size {
+		t.Errorf("progress total should only include uncached layers: expected %d, got %d", top2.Size, progressTotal)
+	}
+	for _, path := range []string{"/etc/hosts", "/etc/passwd.link", "/private/key", "/bin", "/app2"} {
+		found := false
+		for _, createdPath := range created {
+			if createdPath == path {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("expected %s to be reported as created, got %v", path, created)
+		}
+	}
+
+	// All three layers of the second image are now cached.
+	if n := cache.Lookup(chain); n != 3 {
+		t.Errorf("expected all layers of the second image to be cached, got %d", n)
+	}
+
+	// Snapshots must not share inodes with the rootfs, so that modifying the
+	// rootfs doesn't modify the cache.
+	if err := ioutil.WriteFile(filepath.Join(cachedRootfs, "etc", "passwd"), []byte("modified"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(cache.path(chain[2]), "etc", "passwd"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "root:x:0:0" {
+		t.Errorf("modifying the rootfs modified the cache: got %q", content)
+	}
+}
+
+func TestUnpackRootfsLayerCacheOptions(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestUnpackRootfsLayerCacheOptions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatal(err)
+	}
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	manifest := putCacheTestImage(t, engineExt, []ispec.Descriptor{
+		putSquashTestLayer(t, engineExt, []squashTestEntry{
+			{hdr: tar.Header{Name: "file", Typeflag: tar.TypeReg}, content: "file"},
+		}, false),
+	})
+	cacheDir := filepath.Join(root, "cache")
+
+	opt := cacheTestUnpackOptions()
+	opt.LayerCache = cacheDir
+	if err := UnpackRootfs(ctx, engineExt, filepath.Join(root, "rootfs1"), manifest, opt); err != nil {
+		t.Fatalf("unexpected UnpackRootfs error: %+v", err)
+	}
+
+	// Snapshots extracted with different options must not be used.
+	opt = cacheTestUnpackOptions()
+	opt.LayerCache = cacheDir
+	opt.NoPreserveAtime = true
+	cache, err := openLayerCache(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := chainIDs([]digest.Digest{manifest.Layers[0].Digest})
+	if n := cache.Lookup(chain); n != 0 {
+		t.Errorf("snapshot with different options should not be used, got %d cached layers", n)
+	}
+
+	// StartFrom doesn't use the cache.
+	opt = cacheTestUnpackOptions()
+	opt.LayerCache = filepath.Join(root, "cache2")
+	opt.StartFrom = manifest.Layers[0]
+	if err := UnpackRootfs(ctx, engineExt, filepath.Join(root, "rootfs2"), manifest, opt); err != nil {
+		t.Fatalf("unexpected UnpackRootfs error: %+v", err)
+	}
+	if _, err := os.Lstat(opt.LayerCache); !os.IsNotExist(err) {
+		t.Errorf("layer cache should not be used with StartFrom: %v", err)
+	}
+}
+
+// BenchmarkUnpackRootfsLayerCache measures unpacking an image with a large base
+// layer without a layer cache, with an empty (cold) layer cache which has to
+// be populated, and with a (warm) layer cache which already contains the base
+// layer from a previously unpacked image.
+func BenchmarkUnpackRootfsLayerCache(b *testing.B) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-BenchmarkUnpackRootfsLayerCache")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		b.Fatal(err)
+	}
+	engine, err := dir.Open(image)
+	if err != nil {
+		b.Fatal(err)
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	// The base layer is 64MiB, made up of 256 files.
+	content := strings.Repeat("umoci layer cache benchmark\n", (256<<10)/28)
+	var entries []squashTestEntry
+	for dirIdx := 0; dirIdx < 16; dirIdx++ {
+		dirName := fmt.Sprintf("dir%d/", dirIdx)
+		entries = append(entries, squashTestEntry{hdr: tar.Header{Name: dirName, Typeflag: tar.TypeDir}})
+		for fileIdx := 0; fileIdx < 16; fileIdx++ {
+			fileName := fmt.Sprintf("%sfile%d", dirName, fileIdx)
+			entries = append(entries, squashTestEntry{hdr: tar.Header{Name: fileName, Typeflag: tar.TypeReg}, content: content})
+		}
+	}
+	base := putSquashTestLayer(b, engineExt, entries, false)
+	top := putSquashTestLayer(b, engineExt, []squashTestEntry{
+		{hdr: tar.Header{Name: "app", Typeflag: tar.TypeReg}, content: "app"},
+	}, false)
+	baseImage := putCacheTestImage(b, engineExt, []ispec.Descriptor{base})
+	appImage := putCacheTestImage(b, engineExt, []ispec.Descriptor{base, top})
+	appChain := chainIDs([]digest.Digest{base.Digest, top.Digest})
+
+	for _, test := range []struct {
+		name     string
+		useCache bool
+		warm     bool
+	}{
+		{"NoCache", false, false},
+		{"ColdCache", true, false},
+		{"WarmCache", true, true},
+	} {
+		test := test // copy iterator
+		b.Run(test.name, func(b *testing.B) {
+			cacheDir := filepath.Join(root, "cache-"+test.name)
+			newOptions := func() *UnpackOptions {
+				opt := cacheTestUnpackOptions()
+				if test.useCache {
+					opt.LayerCache = cacheDir
+				}
+				return opt
+			}
+
+			rootfs := filepath.Join(root, "rootfs-"+test.name)
+			if test.warm {
+				if err := UnpackRootfs(ctx, engineExt, rootfs+"-base", baseImage, newOptions()); err != nil {
+					b.Fatalf("unexpected UnpackRootfs error: %+v", err)
+				}
+			}
+			var cache *layerCache
+			if test.useCache {
+				cache, err = openLayerCache(newOptions())
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := UnpackRootfs(ctx, engineExt, rootfs, appImage, newOptions()); err != nil {
+					b.Fatalf("unexpected UnpackRootfs error: %+v", err)
+				}
+				b.StopTimer()
+				if err := os.RemoveAll(rootfs); err != nil {
+					b.Fatal(err)
+				}
+				// Reset the cache to its original state, so that every
+				// iteration does the same work (otherwise from the second
+				// iteration onwards the whole image would be cached).
+				if test.useCache {
+					if test.warm {
+						err = os.RemoveAll(cache.path(appChain[1]))
+					} else {
+						err = os.RemoveAll(cacheDir)
+					}
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.StartTimer()
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+)
+
+// capabilityXattr is the xattr used by Linux to store file capabilities.
+const capabilityXattr = "security.capability"
+
+// The on-disk format of file capabilities, from <linux/capability.h>. The
+// payload starts with a little-endian magic_etc field containing the revision
+// and flags, followed by (permitted, inheritable) pairs and (for revision 3)
+// the owner of the user namespace the capabilities apply to.
+const (
+	vfsCapRevisionMask = 0xff000000
+	vfsCapFlagsMask    = ^uint32(vfsCapRevisionMask)
+	vfsCapRevision2    = 0x02000000
+	vfsCapRevision3    = 0x03000000
+	vfsCapV2Size       = 4 + 2*2*4
+	vfsCapV3Size       = vfsCapV2Size + 4
+)
+
+// normaliseCapability converts a security.capability xattr payload into a
+// form suitable for inclusion in an image layer. Revision 3 ("namespaced")
+// capabilities include the host UID of the root user of the user namespace
+// they were created in, which is meaningless on any other system (and would
+// stop the capabilities from working at all when unpacked elsewhere). So they
+// are converted to the equivalent revision 2 capabilities, which is also what
+// the kernel does when a revision 3 capability is read from within the user
+// namespace it applies to. Other revisions are returned unmodified.
+func normaliseCapability(value string) (string, error) {
+	payload := []byte(value)
+	if len(payload) < 4 {
+		return "", errors.Errorf("invalid %s xattr: bad length %d", capabilityXattr, len(payload))
+	}
+
+	magic := binary.LittleEndian.Uint32(payload)
+	if magic&vfsCapRevisionMask != vfsCapRevision3 {
+		return value, nil
+	}
+	if len(payload) != vfsCapV3Size {
+		return "", errors.Errorf("invalid %s xattr: bad v3 length %d", capabilityXattr, len(payload))
+	}
+
+	newPayload := make([]byte, vfsCapV2Size)
+	copy(newPayload, payload[:vfsCapV2Size])
+	binary.LittleEndian.PutUint32(newPayload, vfsCapRevision2|(magic&vfsCapFlagsMask))
+	return string(newPayload), nil
+}
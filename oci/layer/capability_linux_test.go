@@ -0,0 +1,140 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/umoci/pkg/system"
+	"golang.org/x/sys/unix"
+)
+
+// makeCapability builds a security.capability xattr payload with the given
+// revision, flags and (lower 32-bit) permitted set. If rootid is non-nil a
+// revision 3 payload is generated.
+func makeCapability(revision, flags, permitted uint32, rootid *uint32) string {
+	size := vfsCapV2Size
+	if rootid != nil {
+		size = vfsCapV3Size
+	}
+	payload := make([]byte, size)
+	binary.LittleEndian.PutUint32(payload[0:], revision|flags)
+	binary.LittleEndian.PutUint32(payload[4:], permitted)
+	if rootid != nil {
+		binary.LittleEndian.PutUint32(payload[vfsCapV2Size:], *rootid)
+	}
+	return string(payload)
+}
+
+const capNetRaw = 1 << 13
+
+func TestNormaliseCapability(t *testing.T) {
+	rootid := uint32(100000)
+	v2 := makeCapability(vfsCapRevision2, 1, capNetRaw, nil)
+	v3 := makeCapability(vfsCapRevision3, 1, capNetRaw, &rootid)
+
+	for _, test := range []struct {
+		name, value, expected string
+	}{
+		{"v2", v2, v2},
+		{"v3", v3, v2},
+	} {
+		got, err := normaliseCapability(test.value)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %+v", test.name, err)
+			continue
+		}
+		if got != test.expected {
+			t.Errorf("%s: expected %x, got %x", test.name, test.expected, got)
+		}
+	}
+
+	for _, bad := range []string{"", "\x00\x00\x00\x03", v3 + "\x00"} {
+		if _, err := normaliseCapability(bad); err == nil {
+			t.Errorf("expected error with malformed payload %x", bad)
+		}
+	}
+}
+
+func TestTarCapabilityRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestTarCapabilityRoundTrip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	dst := filepath.Join(dir, "dst")
+	for _, path := range []string{src, dst} {
+		if err := os.Mkdir(path, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	capability := makeCapability(vfsCapRevision2, 1, capNetRaw, nil)
+	if err := ioutil.WriteFile(filepath.Join(src, "ping"), []byte("ping"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Lsetxattr(filepath.Join(src, "ping"), capabilityXattr, []byte(capability), 0); err != nil {
+		t.Skipf("skipping test: cannot set %s: %v", capabilityXattr, err)
+	}
+
+	// Generate a layer containing the file.
+	var buf bytes.Buffer
+	tg := newTarGenerator(&buf, MapOptions{})
+	if err := tg.AddFile("ping", filepath.Join(src, "ping")); err != nil {
+		t.Fatalf("AddFile: unexpected error: %+v", err)
+	}
+	if err := tg.tw.Close(); err != nil {
+		t.Fatalf("tw.Close: unexpected error: %+v", err)
+	}
+
+	// Extract the layer again.
+	te := NewTarExtractor(UnpackOptions{})
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("read tar: %+v", err)
+		}
+		if got := hdr.Xattrs[capabilityXattr]; got != capability {
+			t.Errorf("%s: %s not included in layer: expected %x, got %x", hdr.Name, capabilityXattr, capability, got)
+		}
+		if err := te.UnpackEntry(dst, hdr, tr); err != nil {
+			t.Fatalf("UnpackEntry %s: unexpected error: %+v", hdr.Name, err)
+		}
+	}
+
+	value, err := system.Lgetxattr(filepath.Join(dst, "ping"), capabilityXattr)
+	if err != nil {
+		t.Fatalf("unexpected error getting %s: %+v", capabilityXattr, err)
+	}
+	if string(value) != capability {
+		t.Errorf("%s changed: expected %x, got %x", capabilityXattr, capability, value)
+	}
+}
@@ -0,0 +1,133 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"fmt"
+
+	"github.com/apex/log"
+	"github.com/pkg/errors"
+)
+
+// rootlessDeviceXattr is the xattr set on the placeholder files created in
+// place of device nodes when extracting with RootlessDevicePlaceholder. It
+// stores the type and number of the original device (see
+// formatRootlessDevice) so that the device can be reconstructed when
+// generating a layer. Like "user.rootlesscontainers", it never appears in
+// generated layers.
+const rootlessDeviceXattr = "user.umoci.rootless.device"
+
+// formatRootlessDevice returns the rootlessDeviceXattr value for the given
+// device header, such as "char 1:3" or "block 8:0". FIFOs (which only need
+// placeholders if the filesystem doesn't permit unprivileged users to create
+// them) are formatted as "fifo 0:0".
+func formatRootlessDevice(hdr *tar.Header) (string, error) {
+	var kind string
+	switch hdr.Typeflag {
+	case tar.TypeChar:
+		kind = "char"
+	case tar.TypeBlock:
+		kind = "block"
+	case tar.TypeFifo:
+		return "fifo 0:0", nil
+	default:
+		return "", errors.Errorf("not a device: %s", hdr.Name)
+	}
+	return fmt.Sprintf("%s %d:%d", kind, hdr.Devmajor, hdr.Devminor), nil
+}
+
+// parseRootlessDevice parses a rootlessDeviceXattr value, returning the tar
+// typeflag and device number of the original device.
+func parseRootlessDevice(value string) (typeflag byte, major, minor int64, err error) {
+	var kind string
+	if n, err := fmt.Sscanf(value, "%s %d:%d", &kind, &major, &minor); err != nil || n != 3 {
+		return 0, 0, 0, errors.Errorf("invalid %s value %q", rootlessDeviceXattr, value)
+	}
+	switch kind {
+	case "char":
+		typeflag = tar.TypeChar
+	case "block":
+		typeflag = tar.TypeBlock
+	case "fifo":
+		if major != 0 || minor != 0 {
+			return 0, 0, 0, errors.Errorf("invalid %s value %q: fifo cannot have a device number", rootlessDeviceXattr, value)
+		}
+		typeflag = tar.TypeFifo
+	default:
+		return 0, 0, 0, errors.Errorf("invalid %s value %q: unknown device type %q", rootlessDeviceXattr, value, kind)
+	}
+	if major < 0 || minor < 0 {
+		return 0, 0, 0, errors.Errorf("invalid %s value %q: negative device number", rootlessDeviceXattr, value)
+	}
+	return typeflag, major, minor, nil
+}
+
+// restoreRootlessDevice converts a tar.Header for a placeholder file (created
+// with RootlessDevicePlaceholder) back into a header for the original device.
+// The placeholder xattr is always removed from the header. If the placeholder
+// has been modified to contain data, it is kept as a regular file.
+func restoreRootlessDevice(hdr *tar.Header) error {
+	value, ok := hdr.Xattrs[rootlessDeviceXattr]
+	if !ok {
+		return nil
+	}
+	delete(hdr.Xattrs, rootlessDeviceXattr)
+
+	// Hardlinks to a placeholder are hardlinks to the device.
+	if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+		return nil
+	}
+	if hdr.Size != 0 {
+		log.Warnf("rootless{%s} placeholder for device has been modified, including it as a regular file", hdr.Name)
+		return nil
+	}
+
+	typeflag, major, minor, err := parseRootlessDevice(value)
+	if err != nil {
+		return errors.Wrap(err, "parse rootless device placeholder")
+	}
+	hdr.Typeflag = typeflag
+	hdr.Devmajor = major
+	hdr.Devminor = minor
+	return nil
+}
+
+// ParseRootlessDeviceMode parses the name of a RootlessDeviceMode (as
+// returned by RootlessDeviceMode.String).
+func ParseRootlessDeviceMode(name string) (RootlessDeviceMode, error) {
+	for _, mode := range []RootlessDeviceMode{RootlessDevicePlaceholder, RootlessDeviceSkip, RootlessDeviceError} {
+		if mode.String() == name {
+			return mode, nil
+		}
+	}
+	return 0, errors.Errorf("unknown rootless device mode %q", name)
+}
+
+// String returns the name of the RootlessDeviceMode.
+func (mode RootlessDeviceMode) String() string {
+	switch mode {
+	case RootlessDevicePlaceholder:
+		return "placeholder"
+	case RootlessDeviceSkip:
+		return "skip"
+	case RootlessDeviceError:
+		return "error"
+	}
+	return fmt.Sprintf("RootlessDeviceMode(%d)", int(mode))
+}
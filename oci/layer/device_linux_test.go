@@ -0,0 +1,248 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/umoci/pkg/system"
+	"golang.org/x/sys/unix"
+)
+
+func TestRootlessDeviceFormat(t *testing.T) {
+	for _, test := range []struct {
+		hdr   tar.Header
+		value string
+	}{
+		{tar.Header{Name: "null", Typeflag: tar.TypeChar, Devmajor: 1, Devminor: 3}, "char 1:3"},
+		{tar.Header{Name: "sda", Typeflag: tar.TypeBlock, Devmajor: 8, Devminor: 0}, "block 8:0"},
+		{tar.Header{Name: "fifo", Typeflag: tar.TypeFifo}, "fifo 0:0"},
+	} {
+		value, err := formatRootlessDevice(&test.hdr)
+		if err != nil {
+			t.Fatalf("%s: unexpected format error: %+v", test.hdr.Name, err)
+		}
+		if value != test.value {
+			t.Errorf("%s: expected %q, got %q", test.hdr.Name, test.value, value)
+		}
+
+		typeflag, major, minor, err := parseRootlessDevice(value)
+		if err != nil {
+			t.Fatalf("%s: unexpected parse error: %+v", test.hdr.Name, err)
+		}
+		if typeflag != test.hdr.Typeflag || major != test.hdr.Devmajor || minor != test.hdr.Devminor {
+			t.Errorf("%s: round-trip mismatch: got %c %d:%d", test.hdr.Name, typeflag, major, minor)
+		}
+	}
+
+	if _, err := formatRootlessDevice(&tar.Header{Name: "file", Typeflag: tar.TypeReg}); err == nil {
+		t.Errorf("expected error formatting non-device")
+	}
+	for _, invalid := range []string{"", "char", "char 1", "fifo 1:3", "char -1:3", "char a:b"} {
+		if _, _, _, err := parseRootlessDevice(invalid); err == nil {
+			t.Errorf("expected error parsing %q", invalid)
+		}
+	}
+}
+
+func TestParseRootlessDeviceMode(t *testing.T) {
+	for _, mode := range []RootlessDeviceMode{RootlessDevicePlaceholder, RootlessDeviceSkip, RootlessDeviceError} {
+		got, err := ParseRootlessDeviceMode(mode.String())
+		if err != nil {
+			t.Errorf("%s: unexpected error: %+v", mode, err)
+		} else if got != mode {
+			t.Errorf("%s: round-trip mismatch: got %s", mode, got)
+		}
+	}
+	if _, err := ParseRootlessDeviceMode("mknod"); err == nil {
+		t.Errorf("expected error parsing unknown mode")
+	}
+}
+
+func TestUnpackRootlessDevice(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		mode RootlessDeviceMode
+	}{
+		{"Placeholder", RootlessDevicePlaceholder},
+		{"Skip", RootlessDeviceSkip},
+		{"Error", RootlessDeviceError},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "umoci-TestUnpackRootlessDevice")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			mapOptions := MapOptions{Rootless: true}
+			te := NewTarExtractor(UnpackOptions{
+				MapOptions:         mapOptions,
+				RootlessDeviceMode: test.mode,
+			})
+			hdr := &tar.Header{
+				Name:     "null",
+				Mode:     0666,
+				Typeflag: tar.TypeChar,
+				Devmajor: 1,
+				Devminor: 3,
+				ModTime:  time.Now(),
+			}
+			err = te.UnpackEntry(dir, hdr, nil)
+			path := filepath.Join(dir, "null")
+
+			switch test.mode {
+			case RootlessDeviceError:
+				if err == nil {
+					t.Fatalf("expected UnpackEntry to fail")
+				}
+				return
+			case RootlessDeviceSkip:
+				if err != nil {
+					t.Fatalf("unexpected UnpackEntry error: %+v", err)
+				}
+				if _, err := os.Lstat(path); !os.IsNotExist(err) {
+					t.Errorf("expected skipped device to not exist: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected UnpackEntry error: %+v", err)
+			}
+
+			// The placeholder must be an empty file marked with the device.
+			fi, err := os.Lstat(path)
+			if err != nil {
+				t.Fatalf("lstat placeholder: %+v", err)
+			}
+			if !fi.Mode().IsRegular() || fi.Size() != 0 {
+				t.Errorf("placeholder should be an empty regular file, got mode %v with size %d", fi.Mode(), fi.Size())
+			}
+			value, err := system.Lgetxattr(path, rootlessDeviceXattr)
+			if err != nil {
+				t.Skipf("skipping test: cannot get %s: %v", rootlessDeviceXattr, err)
+			}
+			if string(value) != "char 1:3" {
+				t.Errorf("unexpected %s value: %q", rootlessDeviceXattr, value)
+			}
+
+			// Generating a layer must reconstruct the device.
+			var buf bytes.Buffer
+			tg := newTarGenerator(&buf, mapOptions)
+			if err := tg.AddFile("null", path); err != nil {
+				t.Fatalf("AddFile: unexpected error: %+v", err)
+			}
+			if err := tg.tw.Close(); err != nil {
+				t.Fatalf("tw.Close: unexpected error: %+v", err)
+			}
+			tr := tar.NewReader(&buf)
+			gotHdr, err := tr.Next()
+			if err != nil {
+				t.Fatalf("read tar: %+v", err)
+			}
+			if gotHdr.Typeflag != tar.TypeChar || gotHdr.Devmajor != 1 || gotHdr.Devminor != 3 {
+				t.Errorf("expected char device 1:3, got type %c %d:%d", gotHdr.Typeflag, gotHdr.Devmajor, gotHdr.Devminor)
+			}
+			if gotHdr.Mode&0777 != 0666 {
+				t.Errorf("expected mode 0666, got %o", gotHdr.Mode&0777)
+			}
+			if _, ok := gotHdr.Xattrs[rootlessDeviceXattr]; ok {
+				t.Errorf("%s should not be included in the layer", rootlessDeviceXattr)
+			}
+		})
+	}
+}
+
+func TestFifoRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestFifoRoundTrip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rootfs := filepath.Join(dir, "rootfs")
+	if err := os.Mkdir(rootfs, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Mkfifo(filepath.Join(rootfs, "fifo"), 0620); err != nil {
+		t.Fatalf("mkfifo: %+v", err)
+	}
+	if err := os.Chmod(filepath.Join(rootfs, "fifo"), 0620); err != nil {
+		t.Fatal(err)
+	}
+	// Sockets cannot be included in layers, and must be skipped.
+	listener, err := net.Listen("unix", filepath.Join(rootfs, "socket"))
+	if err != nil {
+		t.Fatalf("create socket: %+v", err)
+	}
+	defer listener.Close()
+
+	mapOptions := MapOptions{Rootless: os.Geteuid() != 0}
+	var buf bytes.Buffer
+	tg := newTarGenerator(&buf, mapOptions)
+	for _, name := range []string{"fifo", "socket"} {
+		if err := tg.AddFile(name, filepath.Join(rootfs, name)); err != nil {
+			t.Fatalf("AddFile(%s): unexpected error: %+v", name, err)
+		}
+	}
+	if err := tg.tw.Close(); err != nil {
+		t.Fatalf("tw.Close: unexpected error: %+v", err)
+	}
+
+	tr := tar.NewReader(&buf)
+	hdr, err := tr.Next()
+	if err != nil {
+		t.Fatalf("read tar: %+v", err)
+	}
+	if hdr.Name != "fifo" || hdr.Typeflag != tar.TypeFifo {
+		t.Errorf("expected fifo entry, got %s with type %c", hdr.Name, hdr.Typeflag)
+	}
+	if hdr.Mode&0777 != 0620 {
+		t.Errorf("expected mode 0620, got %o", hdr.Mode&0777)
+	}
+	if extra, err := tr.Next(); err != io.EOF {
+		t.Errorf("expected socket to be skipped, got %v (err=%v)", extra, err)
+	}
+
+	unpacked := filepath.Join(dir, "unpacked")
+	if err := os.Mkdir(unpacked, 0755); err != nil {
+		t.Fatal(err)
+	}
+	te := NewTarExtractor(UnpackOptions{MapOptions: mapOptions})
+	if err := te.UnpackEntry(unpacked, hdr, nil); err != nil {
+		t.Fatalf("UnpackEntry: unexpected error: %+v", err)
+	}
+	fi, err := os.Lstat(filepath.Join(unpacked, "fifo"))
+	if err != nil {
+		t.Fatalf("lstat fifo: %+v", err)
+	}
+	if fi.Mode()&os.ModeNamedPipe == 0 {
+		t.Errorf("expected fifo to be unpacked as a fifo, got mode %v", fi.Mode())
+	}
+	if fi.Mode().Perm() != 0620 {
+		t.Errorf("expected mode 0620, got %o", fi.Mode().Perm())
+	}
+}
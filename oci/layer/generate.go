@@ -18,13 +18,18 @@
 package layer
 
 import (
+	"archive/tar"
 	"io"
 	"os"
 	"path"
 	"path/filepath"
 	"sort"
+	"strings"
+	"syscall"
 
 	"github.com/apex/log"
+	"github.com/opencontainers/umoci/pkg/fseval"
+	"github.com/opencontainers/umoci/pkg/system"
 	"github.com/opencontainers/umoci/pkg/unpriv"
 	"github.com/pkg/errors"
 	"github.com/vbatts/go-mtree"
@@ -49,6 +54,12 @@ func GenerateLayer(path string, deltas []mtree.InodeDelta, opt *RepackOptions) (
 		packOptions = *opt
 	}
 
+	ignore, err := compileIgnorePatterns(packOptions.IgnorePatterns)
+	if err != nil {
+		return nil, errors.Wrap(err, "compile ignore patterns")
+	}
+	deltas = ignore.filterDeltas(deltas)
+
 	reader, writer := io.Pipe()
 
 	go func() (Err error) {
@@ -63,6 +74,12 @@ func GenerateLayer(path string, deltas []mtree.InodeDelta, opt *RepackOptions) (
 		// to emulate a proper tar generator. Luckily there aren't that many
 		// things to emulate (and we can do them all in tar.go).
 		tg := newTarGenerator(writer, packOptions.MapOptions)
+		tg.reproducible = packOptions.Reproducible
+		tg.canonical = packOptions.Canonicalize
+		tg.canonicalTime = packOptions.CanonicalTime
+		if packOptions.Progress != nil {
+			tg.progress = newProgressCounter(packOptions.Progress, deltasSize(tg.fsEval, path, deltas))
+		}
 
 		// Sort the delta paths.
 		// FIXME: We need to add whiteouts first, otherwise we might end up
@@ -70,6 +87,10 @@ func GenerateLayer(path string, deltas []mtree.InodeDelta, opt *RepackOptions) (
 		//        meant to modify.
 		sort.Sort(inodeDeltas(deltas))
 
+		// Directories which have been added as opaque directories (along
+		// with all of their contents), with TranslateOverlayWhiteouts.
+		var opaqueDirs []string
+
 		for _, delta := range deltas {
 			name := delta.Path()
 			fullPath := filepath.Join(path, name)
@@ -78,10 +99,14 @@ func GenerateLayer(path string, deltas []mtree.InodeDelta, opt *RepackOptions) (
 			//      AddFile() for no reason. Maybe we should drop nlink= from
 			//      the set of keywords we care about?
 
+			if underOpaqueDir(name, opaqueDirs) {
+				continue
+			}
+
 			switch delta.Type() {
 			case mtree.Modified, mtree.Extra:
 				if packOptions.TranslateOverlayWhiteouts {
-					fi, err := os.Stat(fullPath)
+					fi, err := tg.fsEval.Lstat(fullPath)
 					if err != nil {
 						return errors.Wrapf(err, "couldn't determine overlay whiteout for %s", fullPath)
 					}
@@ -91,11 +116,18 @@ func GenerateLayer(path string, deltas []mtree.InodeDelta, opt *RepackOptions) (
 						return err
 					}
 					if whiteout {
-						if err := tg.AddWhiteout(fullPath); err != nil {
+						if err := tg.AddWhiteout(name); err != nil {
 							return errors.Wrap(err, "generate whiteout from overlayfs")
 						}
+						continue
+					}
+					if fi.IsDir() && isOverlayOpaque(tg.fsEval, fullPath) {
+						if err := addOverlayOpaqueDir(tg, ignore, name, fullPath); err != nil {
+							return errors.Wrap(err, "generate opaque whiteout from overlayfs")
+						}
+						opaqueDirs = append(opaqueDirs, name)
+						continue
 					}
-					continue
 				}
 				if err := tg.AddFile(name, fullPath); err != nil {
 					log.Warnf("generate layer: could not add file '%s': %s", name, err)
@@ -120,9 +152,92 @@ func GenerateLayer(path string, deltas []mtree.InodeDelta, opt *RepackOptions) (
 	return reader, nil
 }
 
+// isOverlayOpaque returns whether the given directory has been marked as an
+// opaque overlayfs directory (with the "trusted.overlay.opaque" xattr).
+func isOverlayOpaque(fsEval fseval.FsEval, path string) bool {
+	value, err := fsEval.Lgetxattr(path, "trusted.overlay.opaque")
+	return err == nil && string(value) == "y"
+}
+
+// underOpaqueDir returns whether name is inside one of the given directories.
+func underOpaqueDir(name string, opaqueDirs []string) bool {
+	name = filepath.Clean(name)
+	for _, dir := range opaqueDirs {
+		if strings.HasPrefix(name, filepath.Clean(dir)+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// addOverlayOpaqueDir adds an opaque overlayfs directory to the layer as an
+// OCI opaque whiteout. Because an opaque directory hides everything in the
+// lower layers, all of its current contents (not just those which have
+// changed) need to be included in the layer. Overlayfs whiteouts inside the
+// directory are redundant and are skipped.
+func addOverlayOpaqueDir(tg *tarGenerator, ignore *ignoreMatcher, name, fullPath string) error {
+	if err := tg.AddFile(name, fullPath); err != nil {
+		return errors.Wrap(err, "add opaque directory")
+	}
+	if err := tg.AddOpaqueWhiteout(name); err != nil {
+		return err
+	}
+	return tg.fsEval.Walk(fullPath, func(curPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if curPath == fullPath {
+			return nil
+		}
+
+		pathInTar := filepath.Join(name, curPath[len(fullPath):])
+		if ignore.Ignored(pathInTar, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		whiteout, err := isOverlayWhiteout(info)
+		if err != nil {
+			return err
+		}
+		if whiteout {
+			return nil
+		}
+		return tg.AddFile(pathInTar, curPath)
+	})
+}
+
+// deltasSize returns the total size of the regular files which will be
+// included in a layer generated from the given deltas (counting hardlinked
+// files only once). Files which cannot be accessed are ignored, as the error
+// will be reported when generating the layer.
+func deltasSize(fsEval fseval.FsEval, path string, deltas []mtree.InodeDelta) int64 {
+	var total int64
+	inodes := map[uint64]struct{}{}
+	for _, delta := range deltas {
+		switch delta.Type() {
+		case mtree.Modified, mtree.Extra:
+			fi, err := fsEval.Lstat(filepath.Join(path, delta.Path()))
+			if err != nil || !fi.Mode().IsRegular() {
+				continue
+			}
+			if stat, ok := fi.Sys().(*syscall.Stat_t); ok {
+				if _, seen := inodes[stat.Ino]; seen {
+					continue
+				}
+				inodes[stat.Ino] = struct{}{}
+			}
+			total += fi.Size()
+		}
+	}
+	return total
+}
+
 // GenerateInsertLayer generates a completely new layer from "root"to be
 // inserted into the image at "target". If "root" is an empty string then the
-// "target" will be removed via a whiteout.
+// "target" will be removed via a whiteout (or, if "opaque" is set, only the
+// contents of the "target" directory will be removed via an opaque whiteout).
 func GenerateInsertLayer(root string, target string, opaque bool, opt *RepackOptions) io.ReadCloser {
 	root = CleanPath(root)
 
@@ -140,7 +255,16 @@ func GenerateInsertLayer(root string, target string, opaque bool, opt *RepackOpt
 			_ = writer.CloseWithError(errors.Wrap(Err, "generate insert layer"))
 		}()
 
+		ignore, err := compileIgnorePatterns(packOptions.IgnorePatterns)
+		if err != nil {
+			return errors.Wrap(err, "compile ignore patterns")
+		}
+
 		tg := newTarGenerator(writer, packOptions.MapOptions)
+		tg.reproducible = packOptions.Reproducible
+		tg.canonical = packOptions.Canonicalize
+		tg.canonicalTime = packOptions.CanonicalTime
+		tg.progress = newProgressCounter(packOptions.Progress, -1)
 
 		if opaque {
 			if err := tg.AddOpaqueWhiteout(target); err != nil {
@@ -148,6 +272,9 @@ func GenerateInsertLayer(root string, target string, opaque bool, opt *RepackOpt
 			}
 		}
 		if root == "" {
+			if opaque {
+				return nil
+			}
 			return tg.AddWhiteout(target)
 		}
 		return unpriv.Walk(root, func(curPath string, info os.FileInfo, err error) error {
@@ -156,6 +283,13 @@ func GenerateInsertLayer(root string, target string, opaque bool, opt *RepackOpt
 			}
 
 			pathInTar := path.Join(target, curPath[len(root):])
+			if ignore.Ignored(pathInTar, info.IsDir()) {
+				log.Debugf("generate insert layer: ignoring path %q", pathInTar)
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
 			whiteout, err := isOverlayWhiteout(info)
 			if err != nil {
 				return err
@@ -170,3 +304,97 @@ func GenerateInsertLayer(root string, target string, opaque bool, opt *RepackOpt
 	}()
 	return reader
 }
+
+// escapesRoot returns whether the (lexically cleaned) tar entry name refers to
+// a path outside the root of the archive. Leading slashes are ignored, so
+// "/../foo" escapes the root but "/foo/../bar" does not.
+func escapesRoot(name string) bool {
+	name = path.Clean(strings.TrimLeft(name, "/"))
+	return name == ".." || strings.HasPrefix(name, "../")
+}
+
+// GenerateTarLayer generates a new layer from the given tar archive. The
+// entries in the archive are copied as-is, except that their names are
+// normalised (entries which would be outside the root of the layer, such as
+// paths containing "..", result in an error) and their owners are mapped as
+// though the archive was generated from the host filesystem (using the
+// MapOptions in opt).
+func GenerateTarLayer(archive io.Reader, opt *RepackOptions) io.ReadCloser {
+	var packOptions RepackOptions
+	if opt != nil {
+		packOptions = *opt
+	}
+
+	reader, writer := io.Pipe()
+
+	go func() (Err error) {
+		defer func() {
+			if Err != nil {
+				log.Warnf("could not generate tar layer: %v", Err)
+			}
+			// #nosec G104
+			_ = writer.CloseWithError(errors.Wrap(Err, "generate tar layer"))
+		}()
+
+		tr := tar.NewReader(archive)
+		tw := tar.NewWriter(writer)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return errors.Wrap(err, "read next entry")
+			}
+
+			// normalise silently clamps ".." components at the root, but we
+			// would rather reject such archives than guess what they meant.
+			if escapesRoot(hdr.Name) {
+				return errors.Errorf("invalid entry %q: path is outside the root", hdr.Name)
+			}
+			name, err := normalise(hdr.Name, hdr.Typeflag == tar.TypeDir)
+			if err != nil {
+				return errors.Wrapf(err, "invalid entry %q", hdr.Name)
+			}
+			if name == "." {
+				name = "./"
+			}
+			hdr.Name = name
+			if hdr.Typeflag == tar.TypeLink {
+				if escapesRoot(hdr.Linkname) {
+					return errors.Errorf("invalid hardlink target %q of entry %q: path is outside the root", hdr.Linkname, hdr.Name)
+				}
+				linkname, err := normalise(hdr.Linkname, false)
+				if err != nil {
+					return errors.Wrapf(err, "invalid hardlink target %q of entry %q", hdr.Linkname, hdr.Name)
+				}
+				hdr.Linkname = linkname
+			}
+
+			// mapHeader modifies hdr.Xattrs, so make sure the (unmodified)
+			// xattrs in PAXRecords don't take precedence over them.
+			if err := decodePAXXattrs(hdr); err != nil {
+				return errors.Wrapf(err, "decode xattrs of %q", hdr.Name)
+			}
+			if err := mapHeader(hdr, packOptions.MapOptions); err != nil {
+				return errors.Wrapf(err, "map header of %q", hdr.Name)
+			}
+			if packOptions.Reproducible {
+				normaliseReproducible(hdr)
+			}
+			if packOptions.Canonicalize {
+				canonicaliseHeader(hdr, packOptions.CanonicalTime)
+			}
+			encodePAXXattrs(hdr)
+
+			if err := tw.WriteHeader(hdr); err != nil {
+				return errors.Wrapf(err, "write header of %q", hdr.Name)
+			}
+			if _, err := system.Copy(tw, tr); err != nil {
+				return errors.Wrapf(err, "copy contents of %q", hdr.Name)
+			}
+		}
+		return tw.Close()
+	}()
+	return reader
+}
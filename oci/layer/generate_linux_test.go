@@ -92,11 +92,82 @@ func TestGenerateLayerTranslateOverlayWhiteouts(t *testing.T) {
 
 	tr := tar.NewReader(reader)
 
+	// The root directory is "new", and must be included as-is.
 	hdr, err := tr.Next()
 	assert.NoError(err)
+	assert.Equal(int32(hdr.Typeflag), int32(tar.TypeDir))
+
+	hdr, err = tr.Next()
+	assert.NoError(err)
 
 	assert.Equal(int32(hdr.Typeflag), int32(tar.TypeReg))
-	assert.Equal(path.Base(hdr.Name), whPrefix+"test")
+	assert.Equal(hdr.Name, whPrefix+"test")
 	_, err = tr.Next()
 	assert.Equal(err, io.EOF)
 }
+
+func TestGenerateLayerTranslateOverlayOpaque(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "umoci-TestTranslateOverlayOpaque")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	mknodOk, err := canMknod(dir)
+	if err != nil {
+		t.Fatalf("couldn't mknod in dir: %v", err)
+	}
+	if !mknodOk {
+		t.Skip("skipping overlayfs test on kernel < 5.8")
+	}
+
+	assert.NoError(os.MkdirAll(path.Join(dir, "opaque", "subdir"), 0755))
+	assert.NoError(ioutil.WriteFile(path.Join(dir, "opaque", "unchanged"), []byte("unchanged"), 0644))
+	assert.NoError(ioutil.WriteFile(path.Join(dir, "regular"), []byte("old"), 0644))
+
+	mtreeKeywords := []mtree.Keyword{"size", "type", "uid", "gid", "mode", "sha256digest", "xattr"}
+	initDh, err := mtree.Walk(dir, nil, mtreeKeywords, fseval.Default)
+	assert.NoError(err)
+
+	// Make the kinds of changes an overlayfs upper directory would contain.
+	if err := unix.Lsetxattr(path.Join(dir, "opaque"), "trusted.overlay.opaque", []byte("y"), 0); err != nil {
+		t.Skipf("skipping test: cannot set trusted.overlay.opaque: %v", err)
+	}
+	assert.NoError(ioutil.WriteFile(path.Join(dir, "opaque", "new"), []byte("new"), 0644))
+	assert.NoError(system.Mknod(path.Join(dir, "opaque", "subdir", "whiteout"), unix.S_IFCHR|0666, unix.Mkdev(0, 0)))
+	assert.NoError(system.Mknod(path.Join(dir, "deleted"), unix.S_IFCHR|0666, unix.Mkdev(0, 0)))
+	assert.NoError(ioutil.WriteFile(path.Join(dir, "regular"), []byte("new"), 0644))
+
+	deltas, err := mtree.Check(dir, initDh, mtreeKeywords, fseval.Default)
+	assert.NoError(err)
+
+	reader, err := GenerateLayer(dir, deltas, &RepackOptions{TranslateOverlayWhiteouts: true})
+	assert.NoError(err)
+	defer reader.Close()
+
+	var names []string
+	tr := tar.NewReader(reader)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if !assert.NoError(err) {
+			break
+		}
+		_, opaque := hdr.Xattrs["trusted.overlay.opaque"]
+		assert.False(opaque, "overlayfs xattrs must not be included in %s", hdr.Name)
+		names = append(names, hdr.Name)
+	}
+
+	// The opaque directory must include all of its contents (but not the
+	// redundant overlayfs whiteouts inside it).
+	assert.Equal([]string{
+		whPrefix + "deleted",
+		"opaque/",
+		"opaque/" + whOpaque,
+		"opaque/new",
+		"opaque/subdir/",
+		"opaque/unchanged",
+		"regular",
+	}, names)
+}
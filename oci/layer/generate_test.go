@@ -24,9 +24,15 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/opencontainers/umoci/pkg/system"
 	"github.com/vbatts/go-mtree"
+	"golang.org/x/sys/unix"
 )
 
 func TestGenerate(t *testing.T) {
@@ -137,6 +143,71 @@ func TestGenerate(t *testing.T) {
 }
 
 // Make sure that opencontainers/umoci#33 doesn't regress.
+func TestGenerateProgress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestGenerateProgress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.MkdirAll(filepath.Join(dir, "some"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// Get initial.
+	initDh, err := mtree.Walk(dir, nil, append(mtree.DefaultKeywords, "sha256digest"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Add some files (including a hardlink, which must only be counted once).
+	if err := ioutil.WriteFile(filepath.Join(dir, "some", "file1"), bytes.Repeat([]byte("a"), 100000), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "some", "file2"), bytes.Repeat([]byte("b"), 1234), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(filepath.Join(dir, "some", "file1"), filepath.Join(dir, "some", "link1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("file1", filepath.Join(dir, "some", "symlink1")); err != nil {
+		t.Fatal(err)
+	}
+	const expectedTotal = 100000 + 1234
+
+	// Get post.
+	postDh, err := mtree.Walk(dir, nil, initDh.UsedKeywords(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	diffs, err := mtree.Compare(initDh, postDh, initDh.UsedKeywords())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var lastProcessed, lastTotal int64
+	reader, err := GenerateLayer(dir, diffs, &RepackOptions{
+		Progress: func(processed, total int64) {
+			if processed < lastProcessed {
+				t.Errorf("progress went backwards: %d -> %d", lastProcessed, processed)
+			}
+			lastProcessed, lastTotal = processed, total
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	if _, err := io.Copy(ioutil.Discard, reader); err != nil {
+		t.Fatalf("unexpected error reading layer: %+v", err)
+	}
+	if lastProcessed != expectedTotal || lastTotal != expectedTotal {
+		t.Errorf("final progress was %d/%d, expected %d/%d", lastProcessed, lastTotal, expectedTotal, expectedTotal)
+	}
+}
+
 func TestGenerateMissingFileError(t *testing.T) {
 	dir, err := ioutil.TempDir("", "umoci-TestGenerateError")
 	if err != nil {
@@ -270,3 +341,566 @@ func TestGenerateWrongRootError(t *testing.T) {
 		}
 	}
 }
+
+// makeReproducibleTree creates a small filesystem tree inside root, with all
+// of the timestamps in the tree set to mtime.
+func makeReproducibleTree(t *testing.T, root string, mtime time.Time) {
+	for _, dir := range []string{"etc", "usr/bin", "var/empty"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, contents := range map[string]string{
+		"etc/passwd":   "root:x:0:0:root:/root:/bin/sh\n",
+		"etc/hostname": "reproducible\n",
+		"usr/bin/tool": "#!/bin/sh\necho hello\n",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(root, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Link(filepath.Join(root, "usr/bin/tool"), filepath.Join(root, "usr/bin/tool-link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("tool", filepath.Join(root, "usr/bin/tool-symlink")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Set the timestamps bottom-up so that directory times aren't clobbered.
+	var paths []string
+	if err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		paths = append(paths, path)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for i := len(paths) - 1; i >= 0; i-- {
+		if err := unix.Lutimes(paths[i], []unix.Timeval{
+			unix.NsecToTimeval(mtime.UnixNano()),
+			unix.NsecToTimeval(mtime.UnixNano()),
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func generateReproducibleLayer(t *testing.T, root string, opt *RepackOptions) []byte {
+	reader := GenerateInsertLayer(root, "/", false, opt)
+	defer reader.Close()
+
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("generate layer: %+v", err)
+	}
+	return data
+}
+
+func TestGenerateReproducible(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestGenerateReproducible")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Two trees with identical contents, created at different times.
+	rootA := filepath.Join(dir, "a")
+	makeReproducibleTree(t, rootA, time.Unix(1234567890, 123456789))
+	rootB := filepath.Join(dir, "b")
+	makeReproducibleTree(t, rootB, time.Unix(1600000000, 987654321))
+
+	opt := &RepackOptions{Reproducible: true}
+	layerA := generateReproducibleLayer(t, rootA, opt)
+	if again := generateReproducibleLayer(t, rootA, opt); !bytes.Equal(layerA, again) {
+		t.Errorf("generating a reproducible layer twice gave different results")
+	}
+	if layerB := generateReproducibleLayer(t, rootB, opt); !bytes.Equal(layerA, layerB) {
+		t.Errorf("reproducible layers of identical trees with different timestamps differ")
+	}
+
+	// Without --reproducible the timestamps must be preserved.
+	if bytes.Equal(generateReproducibleLayer(t, rootA, nil), generateReproducibleLayer(t, rootB, nil)) {
+		t.Errorf("non-reproducible layers of trees with different timestamps are identical")
+	}
+
+	var names []string
+	tr := tar.NewReader(bytes.NewReader(layerA))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error reading layer: %+v", err)
+		}
+		names = append(names, hdr.Name)
+
+		if !hdr.ModTime.Equal(time.Unix(0, 0)) {
+			t.Errorf("%s: expected mtime to be the epoch, got %v", hdr.Name, hdr.ModTime)
+		}
+		if !hdr.AccessTime.IsZero() || !hdr.ChangeTime.IsZero() {
+			t.Errorf("%s: unexpected atime (%v) or ctime (%v)", hdr.Name, hdr.AccessTime, hdr.ChangeTime)
+		}
+		if hdr.Uname != "" || hdr.Gname != "" {
+			t.Errorf("%s: unexpected uname (%q) or gname (%q)", hdr.Name, hdr.Uname, hdr.Gname)
+		}
+	}
+	if !sort.StringsAreSorted(names) {
+		t.Errorf("reproducible layer entries are not sorted: %v", names)
+	}
+}
+
+// checkCanonicalLayer checks that every entry in the given layer has
+// canonical metadata (see RepackOptions.Canonicalize).
+func checkCanonicalLayer(t *testing.T, layer []byte, mtime time.Time) {
+	tr := tar.NewReader(bytes.NewReader(layer))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error reading layer: %+v", err)
+		}
+		if hdr.Uid != 0 || hdr.Gid != 0 {
+			t.Errorf("%s: expected owner 0:0, got %d:%d", hdr.Name, hdr.Uid, hdr.Gid)
+		}
+		if !hdr.ModTime.Equal(mtime) {
+			t.Errorf("%s: expected mtime %v, got %v", hdr.Name, mtime, hdr.ModTime)
+		}
+		if !hdr.AccessTime.IsZero() || !hdr.ChangeTime.IsZero() {
+			t.Errorf("%s: unexpected atime (%v) or ctime (%v)", hdr.Name, hdr.AccessTime, hdr.ChangeTime)
+		}
+		if len(hdr.PAXRecords) != 0 {
+			t.Errorf("%s: unexpected pax records: %v", hdr.Name, hdr.PAXRecords)
+		}
+	}
+}
+
+func TestGenerateCanonical(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestGenerateCanonical")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Two trees with identical contents, created at different times and
+	// (if we can) with different owners and xattrs.
+	rootA := filepath.Join(dir, "a")
+	makeReproducibleTree(t, rootA, time.Unix(1234567890, 123456789))
+	rootB := filepath.Join(dir, "b")
+	makeReproducibleTree(t, rootB, time.Unix(1600000000, 987654321))
+
+	if os.Geteuid() == 0 {
+		if err := filepath.Walk(rootB, func(path string, _ os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			return os.Lchown(path, 1000, 1000)
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := unix.Lsetxattr(filepath.Join(rootB, "etc/passwd"), "user.comment", []byte("not essential"), 0); err != nil {
+		t.Logf("could not set xattr (skipping that part of the test): %v", err)
+	}
+
+	canonicalTime := time.Unix(1700000000, 0)
+	opt := &RepackOptions{Canonicalize: true, CanonicalTime: canonicalTime}
+	layerA := generateReproducibleLayer(t, rootA, opt)
+	layerB := generateReproducibleLayer(t, rootB, opt)
+	if !bytes.Equal(layerA, layerB) {
+		t.Errorf("canonical layers of identical trees with different metadata differ")
+	}
+	checkCanonicalLayer(t, layerA, canonicalTime)
+
+	// Owners are flattened, not translated (unlike MapOptions).
+	layerB = generateReproducibleLayer(t, rootB, &RepackOptions{
+		MapOptions: MapOptions{
+			UIDMappings: []rspec.LinuxIDMapping{{HostID: 0, ContainerID: 0, Size: 2000}},
+			GIDMappings: []rspec.LinuxIDMapping{{HostID: 0, ContainerID: 0, Size: 2000}},
+		},
+		Canonicalize:  true,
+		CanonicalTime: canonicalTime,
+	})
+	if !bytes.Equal(layerA, layerB) {
+		t.Errorf("canonical layers with id mappings differ")
+	}
+
+	// The default canonical time is the epoch.
+	checkCanonicalLayer(t, generateReproducibleLayer(t, rootB, &RepackOptions{Canonicalize: true}), time.Unix(0, 0))
+
+	// Layers generated from archives are also canonicalised.
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range []*tar.Header{
+		{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755, Uid: 1234, Gid: 5678, Uname: "user", Gname: "group", ModTime: time.Unix(1234567890, 0)},
+		{Name: "etc/file", Typeflag: tar.TypeReg, Mode: 0644, Uid: 1234, Gid: 5678, ModTime: time.Unix(1234567890, 123), AccessTime: time.Unix(1234567891, 0), Format: tar.FormatPAX, PAXRecords: map[string]string{
+			"SCHILY.xattr.user.comment": "not essential",
+			"SCHILY.fflags":             "nodump",
+		}},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	reader := GenerateTarLayer(&buf, opt)
+	defer reader.Close()
+	layer, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("generate tar layer: %+v", err)
+	}
+	checkCanonicalLayer(t, layer, canonicalTime)
+
+	// Whiteouts get the canonical time too.
+	buf.Reset()
+	tg := newTarGenerator(&buf, MapOptions{})
+	tg.canonical = true
+	tg.canonicalTime = canonicalTime
+	if err := tg.AddWhiteout("etc/passwd"); err != nil {
+		t.Fatalf("add whiteout: %+v", err)
+	}
+	if err := tg.AddOpaqueWhiteout("var"); err != nil {
+		t.Fatalf("add opaque whiteout: %+v", err)
+	}
+	if err := tg.tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	checkCanonicalLayer(t, buf.Bytes(), canonicalTime)
+}
+
+func TestGenerateNanosecondTimestamps(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestGenerateNanosecondTimestamps")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	root := filepath.Join(dir, "root")
+	if err := os.MkdirAll(filepath.Join(root, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "dir", "file"), []byte("contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("file", filepath.Join(root, "dir", "symlink")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "whole"), []byte("contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Set the timestamps bottom-up so that directory times aren't clobbered.
+	times := map[string]struct{ atime, mtime time.Time }{
+		"dir/symlink": {time.Unix(1234567890, 1), time.Unix(1234567890, 999999999)},
+		"dir/file":    {time.Unix(1500000000, 123456789), time.Unix(1600000000, 987654321)},
+		"dir":         {time.Unix(1300000000, 500000000), time.Unix(1300000000, 100)},
+		"whole":       {time.Unix(1400000000, 0), time.Unix(1400000000, 0)},
+	}
+	for _, name := range []string{"dir/symlink", "dir/file", "dir", "whole"} {
+		ts := times[name]
+		if err := system.Lutimes(filepath.Join(root, name), ts.atime, ts.mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Skip the test if the filesystem doesn't support nanosecond timestamps.
+	var st unix.Stat_t
+	if err := unix.Lstat(filepath.Join(root, "dir", "file"), &st); err != nil {
+		t.Fatal(err)
+	}
+	if got := time.Unix(st.Mtim.Unix()); !got.Equal(times["dir/file"].mtime) {
+		t.Skipf("filesystem doesn't support nanosecond timestamps: %v", got)
+	}
+
+	layer := generateReproducibleLayer(t, root, nil)
+
+	// Entries with sub-second timestamps must use PAX, while other entries
+	// should not need any extended headers.
+	tr := tar.NewReader(bytes.NewReader(layer))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error reading layer: %+v", err)
+		}
+		ts, ok := times[strings.TrimSuffix(hdr.Name, "/")]
+		if !ok {
+			continue
+		}
+		if !hdr.ModTime.Equal(ts.mtime) {
+			t.Errorf("%s: expected mtime %v, got %v", hdr.Name, ts.mtime, hdr.ModTime)
+		}
+		if ts.mtime.Nanosecond() != 0 || ts.atime.Nanosecond() != 0 {
+			if !hdr.AccessTime.Equal(ts.atime) {
+				t.Errorf("%s: expected atime %v, got %v", hdr.Name, ts.atime, hdr.AccessTime)
+			}
+		} else if len(hdr.PAXRecords) != 0 {
+			t.Errorf("%s: unexpected PAX records for entry with whole-second timestamps: %v", hdr.Name, hdr.PAXRecords)
+		}
+		if !hdr.ChangeTime.IsZero() {
+			t.Errorf("%s: unexpected ctime %v", hdr.Name, hdr.ChangeTime)
+		}
+	}
+
+	// The timestamps must be restored exactly when extracting the layer.
+	extracted := filepath.Join(dir, "extracted")
+	if err := os.Mkdir(extracted, 0755); err != nil {
+		t.Fatal(err)
+	}
+	unpackOptions := &UnpackOptions{
+		MapOptions: MapOptions{
+			Rootless: os.Geteuid() != 0,
+		},
+	}
+	if err := UnpackLayer(extracted, bytes.NewReader(layer), unpackOptions); err != nil {
+		t.Fatalf("unexpected error unpacking layer: %+v", err)
+	}
+	for name, ts := range times {
+		if err := unix.Lstat(filepath.Join(extracted, name), &st); err != nil {
+			t.Fatal(err)
+		}
+		if got := time.Unix(st.Mtim.Unix()); !got.Equal(ts.mtime) {
+			t.Errorf("%s: expected extracted mtime %v, got %v", name, ts.mtime, got)
+		}
+		if got := time.Unix(st.Atim.Unix()); !got.Equal(ts.atime) {
+			t.Errorf("%s: expected extracted atime %v, got %v", name, ts.atime, got)
+		}
+	}
+}
+
+func TestGenerateInsertLayerMetadata(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("changing file ownership requires root")
+	}
+
+	dir, err := ioutil.TempDir("", "umoci-TestGenerateInsertLayerMetadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mtime := time.Unix(1234567890, 0)
+	src := filepath.Join(dir, "src")
+	if err := os.MkdirAll(filepath.Join(src, "sub"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "sub", "file"), []byte("contents"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// Set the metadata bottom-up so that directory times aren't clobbered.
+	for _, entry := range []struct {
+		path string
+		mode os.FileMode
+	}{
+		{filepath.Join(src, "sub", "file"), 0600},
+		{filepath.Join(src, "sub"), 0750},
+		{src, 0750},
+	} {
+		if err := os.Chmod(entry.path, entry.mode); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Lchown(entry.path, 1000, 2000); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(entry.path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Host 1000:2000 is mapped to 0:0 in the image.
+	opt := &RepackOptions{MapOptions: MapOptions{
+		UIDMappings: []rspec.LinuxIDMapping{{HostID: 1000, ContainerID: 0, Size: 1}},
+		GIDMappings: []rspec.LinuxIDMapping{{HostID: 2000, ContainerID: 0, Size: 1}},
+	}}
+	reader := GenerateInsertLayer(src, "/opt/app", true, opt)
+	defer reader.Close()
+
+	expected := map[string]int64{
+		"opt/app":          0750,
+		"opt/app/sub":      0750,
+		"opt/app/sub/file": 0600,
+	}
+	var sawOpaque bool
+	tr := tar.NewReader(reader)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("read layer: %+v", err)
+		}
+		name := filepath.Clean(hdr.Name)
+		if name == "opt/app/"+whOpaque {
+			sawOpaque = true
+			continue
+		}
+		mode, ok := expected[name]
+		if !ok {
+			t.Errorf("unexpected entry in layer: %s", hdr.Name)
+			continue
+		}
+		delete(expected, name)
+		if hdr.Mode&0777 != mode {
+			t.Errorf("%s: expected mode %o, got %o", name, mode, hdr.Mode&0777)
+		}
+		if hdr.Uid != 0 || hdr.Gid != 0 {
+			t.Errorf("%s: expected owner to be mapped to 0:0, got %d:%d", name, hdr.Uid, hdr.Gid)
+		}
+		if !hdr.ModTime.Equal(mtime) {
+			t.Errorf("%s: expected mtime %v, got %v", name, mtime, hdr.ModTime)
+		}
+	}
+	if len(expected) != 0 {
+		t.Errorf("entries missing from layer: %v", expected)
+	}
+	if !sawOpaque {
+		t.Errorf("opaque whiteout missing from layer")
+	}
+}
+
+func TestGenerateInsertLayerWhiteout(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		opaque   bool
+		expected string
+	}{
+		{"Whiteout", false, "etc/" + whPrefix + "passwd"},
+		{"OpaqueWhiteout", true, "etc/passwd/" + whOpaque},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			reader := GenerateInsertLayer("", "/etc/passwd", test.opaque, nil)
+			defer reader.Close()
+
+			var names []string
+			tr := tar.NewReader(reader)
+			for {
+				hdr, err := tr.Next()
+				if err == io.EOF {
+					break
+				} else if err != nil {
+					t.Fatalf("read layer: %+v", err)
+				}
+				names = append(names, filepath.Clean(hdr.Name))
+				if hdr.Typeflag != tar.TypeReg || hdr.Size != 0 {
+					t.Errorf("%s: whiteout should be an empty regular file, got type %c with size %d", hdr.Name, hdr.Typeflag, hdr.Size)
+				}
+			}
+			if len(names) != 1 || names[0] != test.expected {
+				t.Errorf("expected layer to only contain %q, got %v", test.expected, names)
+			}
+		})
+	}
+}
+
+func makeTestTar(t *testing.T, hdrs ...tar.Header) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range hdrs {
+		hdr := hdr
+		var data []byte
+		if hdr.Typeflag == tar.TypeReg {
+			data = []byte("contents of " + hdr.Name)
+			hdr.Size = int64(len(data))
+		}
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestGenerateTarLayer(t *testing.T) {
+	archive := makeTestTar(t,
+		tar.Header{Name: "./", Typeflag: tar.TypeDir, Mode: 0755, Uid: 1000, Gid: 2000},
+		tar.Header{Name: "/etc", Typeflag: tar.TypeDir, Mode: 0755, Uid: 1000, Gid: 2000},
+		tar.Header{Name: "/etc/file", Typeflag: tar.TypeReg, Mode: 0600, Uid: 1001, Gid: 2001},
+		tar.Header{Name: "usr/../etc/other", Typeflag: tar.TypeReg, Mode: 0644, Uid: 1000, Gid: 2000},
+		tar.Header{Name: "./etc/link", Typeflag: tar.TypeLink, Linkname: "/etc/file", Uid: 1001, Gid: 2001},
+		tar.Header{Name: "etc/symlink", Typeflag: tar.TypeSymlink, Linkname: "../../outside", Uid: 1000, Gid: 2000},
+	)
+
+	opt := &RepackOptions{MapOptions: MapOptions{
+		UIDMappings: []rspec.LinuxIDMapping{{HostID: 1000, ContainerID: 0, Size: 10}},
+		GIDMappings: []rspec.LinuxIDMapping{{HostID: 2000, ContainerID: 0, Size: 10}},
+	}}
+	reader := GenerateTarLayer(bytes.NewReader(archive), opt)
+	defer reader.Close()
+
+	type entry struct {
+		name, linkname, data string
+		uid, gid             int
+	}
+	var got []entry
+	tr := tar.NewReader(reader)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("read layer: %+v", err)
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, entry{hdr.Name, hdr.Linkname, string(data), hdr.Uid, hdr.Gid})
+	}
+
+	expected := []entry{
+		{"./", "", "", 0, 0},
+		{"etc/", "", "", 0, 0},
+		{"etc/file", "", "contents of /etc/file", 1, 1},
+		{"etc/other", "", "contents of usr/../etc/other", 0, 0},
+		{"etc/link", "etc/file", "", 1, 1},
+		// Symlink targets are resolved inside the rootfs, so are left as-is.
+		{"etc/symlink", "../../outside", "", 0, 0},
+	}
+	if len(got) != len(expected) {
+		t.Fatalf("unexpected entries in layer: %+v", got)
+	}
+	for idx := range expected {
+		if got[idx] != expected[idx] {
+			t.Errorf("entry %d: expected %+v, got %+v", idx, expected[idx], got[idx])
+		}
+	}
+}
+
+func TestGenerateTarLayerUnsafe(t *testing.T) {
+	for _, hdr := range []tar.Header{
+		{Name: "../escape", Typeflag: tar.TypeReg},
+		{Name: "etc/../../escape", Typeflag: tar.TypeReg},
+		{Name: "/../escape", Typeflag: tar.TypeReg},
+		{Name: "etc/link", Typeflag: tar.TypeLink, Linkname: "../escape"},
+		// Unmapped owners must also be rejected.
+		{Name: "etc/unmapped", Typeflag: tar.TypeReg, Uid: 5000},
+	} {
+		archive := makeTestTar(t, hdr)
+		opt := &RepackOptions{MapOptions: MapOptions{
+			UIDMappings: []rspec.LinuxIDMapping{{HostID: 0, ContainerID: 0, Size: 1000}},
+			GIDMappings: []rspec.LinuxIDMapping{{HostID: 0, ContainerID: 0, Size: 1000}},
+		}}
+		reader := GenerateTarLayer(bytes.NewReader(archive), opt)
+		if _, err := ioutil.ReadAll(reader); err == nil {
+			t.Errorf("expected %q (link %q) to be rejected", hdr.Name, hdr.Linkname)
+		}
+		reader.Close()
+	}
+
+	// Invalid tar archives must be rejected.
+	reader := GenerateTarLayer(bytes.NewReader([]byte("this is not a tar archive, but it is long enough to look like a header to tar.Reader............................................................................................................................................................................................................................................................................................................................................................................................................................................................................")), nil)
+	if _, err := ioutil.ReadAll(reader); err == nil {
+		t.Errorf("expected invalid tar archive to be rejected")
+	}
+	reader.Close()
+}
@@ -0,0 +1,149 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/cas/dir"
+	"github.com/opencontainers/umoci/oci/casext"
+)
+
+// makeLayeredTestImage creates a new image layout in root containing a
+// manifest with the given (uncompressed) layers.
+func makeLayeredTestImage(t *testing.T, root string, layers ...[]squashTestEntry) (casext.Engine, ispec.Manifest) {
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatal(err)
+	}
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	engineExt := casext.NewEngine(engine)
+
+	var (
+		descriptors []ispec.Descriptor
+		diffIDs     []digest.Digest
+	)
+	for _, entries := range layers {
+		descriptor := putSquashTestLayer(t, engineExt, entries, false)
+		descriptors = append(descriptors, descriptor)
+		diffIDs = append(diffIDs, descriptor.Digest)
+	}
+
+	configDigest, configSize, err := engineExt.PutBlobJSON(context.Background(), ispec.Image{
+		OS: "linux",
+		RootFS: ispec.RootFS{
+			Type:    "layers",
+			DiffIDs: diffIDs,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return engineExt, ispec.Manifest{
+		Versioned: specs.Versioned{
+			SchemaVersion: 2,
+		},
+		MediaType: ispec.MediaTypeImageManifest,
+		Config: ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageConfig,
+			Digest:    configDigest,
+			Size:      configSize,
+		},
+		Layers: descriptors,
+	}
+}
+
+// inode returns the inode number and link count of the given path.
+func inode(t *testing.T, path string) (uint64, uint64) {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat := fi.Sys().(*syscall.Stat_t)
+	return uint64(stat.Ino), uint64(stat.Nlink)
+}
+
+func TestUnpackManifestHardlinkAcrossLayers(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestUnpackManifestHardlinkAcrossLayers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	engineExt, manifest := makeLayeredTestImage(t, root,
+		[]squashTestEntry{
+			{hdr: tar.Header{Name: "etc/", Typeflag: tar.TypeDir}},
+			{hdr: tar.Header{Name: "etc/target", Typeflag: tar.TypeReg}, content: "target"},
+			{hdr: tar.Header{Name: "etc/replaced", Typeflag: tar.TypeReg}, content: "old"},
+		},
+		[]squashTestEntry{
+			// Hardlinks to files from the previous layer.
+			{hdr: tar.Header{Name: "link", Typeflag: tar.TypeLink, Linkname: "etc/target"}},
+			{hdr: tar.Header{Name: "usr/", Typeflag: tar.TypeDir}},
+			{hdr: tar.Header{Name: "usr/link", Typeflag: tar.TypeLink, Linkname: "/etc/target"}},
+			// A hardlink to a file which is replaced later in this layer
+			// keeps the old inode.
+			{hdr: tar.Header{Name: "old-link", Typeflag: tar.TypeLink, Linkname: "etc/replaced"}},
+			{hdr: tar.Header{Name: "etc/replaced", Typeflag: tar.TypeReg}, content: "new"},
+		},
+		[]squashTestEntry{
+			// A hardlink to a hardlink from the previous layer.
+			{hdr: tar.Header{Name: "etc/link", Typeflag: tar.TypeLink, Linkname: "usr/link"}},
+		},
+	)
+	defer engineExt.Close()
+
+	rootfs := filepath.Join(root, "rootfs")
+	if err := UnpackRootfs(context.Background(), engineExt, rootfs, manifest, &UnpackOptions{
+		MapOptions: MapOptions{Rootless: os.Geteuid() != 0},
+	}); err != nil {
+		t.Fatalf("unexpected error unpacking image: %+v", err)
+	}
+
+	targetIno, targetNlink := inode(t, filepath.Join(rootfs, "etc", "target"))
+	if targetNlink != 4 {
+		t.Errorf("expected etc/target to have 4 links, got %d", targetNlink)
+	}
+	for _, path := range []string{"link", "usr/link", "etc/link"} {
+		ino, nlink := inode(t, filepath.Join(rootfs, path))
+		if ino != targetIno || nlink != targetNlink {
+			t.Errorf("expected %s to be a hardlink to etc/target (inode %d, nlink %d), got inode %d nlink %d", path, targetIno, targetNlink, ino, nlink)
+		}
+	}
+
+	oldIno, oldNlink := inode(t, filepath.Join(rootfs, "old-link"))
+	newIno, newNlink := inode(t, filepath.Join(rootfs, "etc", "replaced"))
+	if oldIno == newIno || oldNlink != 1 || newNlink != 1 {
+		t.Errorf("expected old-link and etc/replaced to be separate inodes with one link: %d (nlink %d) and %d (nlink %d)", oldIno, oldNlink, newIno, newNlink)
+	}
+	if contents, err := ioutil.ReadFile(filepath.Join(rootfs, "old-link")); err != nil || string(contents) != "old" {
+		t.Errorf("expected old-link to have the old contents: %q (%v)", contents, err)
+	}
+}
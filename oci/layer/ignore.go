@@ -0,0 +1,197 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"path"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/pkg/errors"
+	"github.com/vbatts/go-mtree"
+)
+
+// ignorePattern is a single compiled gitignore-style pattern.
+type ignorePattern struct {
+	source   string
+	segments []string
+	negate   bool
+	dirOnly  bool
+}
+
+// match returns whether the pattern matches the given path (split into its
+// components, relative to the root).
+func (p ignorePattern) match(components []string, isDir bool) bool {
+	if p.dirOnly && !isDir {
+		return false
+	}
+	return matchSegments(p.segments, components)
+}
+
+// matchSegments matches a set of pattern segments (each of which is either
+// "**" or a path.Match pattern) against a set of path components.
+func matchSegments(segments, components []string) bool {
+	for len(segments) > 0 {
+		if segments[0] == "**" {
+			rest := segments[1:]
+			// A trailing "**" matches everything inside the directory, but
+			// not the directory itself.
+			if len(rest) == 0 {
+				return len(components) > 0
+			}
+			for i := 0; i <= len(components); i++ {
+				if matchSegments(rest, components[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(components) == 0 {
+			return false
+		}
+		// The pattern was validated when it was compiled.
+		if ok, _ := path.Match(segments[0], components[0]); !ok {
+			return false
+		}
+		segments, components = segments[1:], components[1:]
+	}
+	return len(components) == 0
+}
+
+// ignoreMatcher implements gitignore-style matching of paths, with the
+// patterns being matched against paths relative to the root of the rootfs.
+type ignoreMatcher struct {
+	patterns []ignorePattern
+}
+
+// compileIgnorePatterns compiles the given set of gitignore-style patterns.
+// The syntax follows gitignore(5): blank lines and lines starting with "#" are
+// ignored, a leading "!" negates the pattern, a trailing "/" only matches
+// directories, a pattern containing a "/" (other than a trailing one) is
+// anchored to the root (otherwise it matches at any depth) and "**" matches
+// any number of directories. The last matching pattern wins, and (as with
+// git) it is not possible to re-include a path if one of its parent
+// directories is ignored.
+func compileIgnorePatterns(patterns []string) (*ignoreMatcher, error) {
+	var matcher ignoreMatcher
+	for _, source := range patterns {
+		pattern := strings.TrimRight(source, " ")
+		if pattern == "" || strings.HasPrefix(pattern, "#") {
+			continue
+		}
+		var p ignorePattern
+		p.source = source
+		if strings.HasPrefix(pattern, "!") {
+			p.negate = true
+			pattern = pattern[1:]
+		} else if strings.HasPrefix(pattern, `\!`) || strings.HasPrefix(pattern, `\#`) {
+			pattern = pattern[1:]
+		}
+		if strings.HasSuffix(pattern, "/") {
+			p.dirOnly = true
+			pattern = strings.TrimRight(pattern, "/")
+		}
+		anchored := strings.Contains(pattern, "/")
+		pattern = strings.Trim(pattern, "/")
+		if pattern == "" {
+			return nil, errors.Errorf("invalid ignore pattern %q: pattern is empty", source)
+		}
+		if !anchored {
+			p.segments = append(p.segments, "**")
+		}
+		for _, segment := range strings.Split(pattern, "/") {
+			if segment == "" {
+				continue
+			}
+			if _, err := path.Match(segment, ""); err != nil {
+				return nil, errors.Wrapf(err, "invalid ignore pattern %q", source)
+			}
+			p.segments = append(p.segments, segment)
+		}
+		matcher.patterns = append(matcher.patterns, p)
+	}
+	return &matcher, nil
+}
+
+// matchOne returns whether the path is ignored by the patterns, without
+// considering whether any of its parent directories are ignored.
+func (m *ignoreMatcher) matchOne(components []string, isDir bool) bool {
+	ignored := false
+	for _, p := range m.patterns {
+		if p.match(components, isDir) {
+			ignored = !p.negate
+		}
+	}
+	return ignored
+}
+
+// Ignored returns whether the given path (relative to the root) is ignored.
+// A nil *ignoreMatcher doesn't ignore anything.
+func (m *ignoreMatcher) Ignored(name string, isDir bool) bool {
+	if m == nil || len(m.patterns) == 0 {
+		return false
+	}
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if name == "" {
+		return false
+	}
+	components := strings.Split(name, "/")
+	for i := 1; i < len(components); i++ {
+		if m.matchOne(components[:i], true) {
+			return true
+		}
+	}
+	return m.matchOne(components, isDir)
+}
+
+// deltaIsDir returns whether the given delta refers to a directory.
+func deltaIsDir(delta mtree.InodeDelta) bool {
+	entry := delta.New()
+	if delta.Type() == mtree.Missing {
+		entry = delta.Old()
+	}
+	return entry != nil && entry.IsDir()
+}
+
+// FilterIgnoredDeltas returns the subset of deltas whose paths are not ignored
+// by the given set of gitignore-style patterns (see RepackOptions for more
+// details). GenerateLayer already does this filtering internally, but this is
+// useful for callers which need to know whether there are any deltas left to
+// generate a layer from.
+func FilterIgnoredDeltas(deltas []mtree.InodeDelta, patterns []string) ([]mtree.InodeDelta, error) {
+	matcher, err := compileIgnorePatterns(patterns)
+	if err != nil {
+		return nil, err
+	}
+	return matcher.filterDeltas(deltas), nil
+}
+
+func (m *ignoreMatcher) filterDeltas(deltas []mtree.InodeDelta) []mtree.InodeDelta {
+	if len(m.patterns) == 0 {
+		return deltas
+	}
+	var filtered []mtree.InodeDelta
+	for _, delta := range deltas {
+		if m.Ignored(delta.Path(), deltaIsDir(delta)) {
+			log.Debugf("generate layer: ignoring path %q", delta.Path())
+			continue
+		}
+		filtered = append(filtered, delta)
+	}
+	return filtered
+}
@@ -0,0 +1,236 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/vbatts/go-mtree"
+)
+
+func TestIgnoreMatcher(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		patterns []string
+		path     string
+		isDir    bool
+		ignored  bool
+	}{
+		{"Empty", nil, "foo", false, false},
+		{"Comment", []string{"# foo", ""}, "# foo", false, false},
+		{"Basename", []string{"*.log"}, "var/log/messages.log", false, true},
+		{"BasenameNoMatch", []string{"*.log"}, "var/log/messages", false, false},
+		{"BasenameRoot", []string{"cache"}, "cache", true, true},
+		{"BasenameDeep", []string{"cache"}, "var/cache", true, true},
+		{"Anchored", []string{"/cache"}, "var/cache", true, false},
+		{"AnchoredRoot", []string{"/cache"}, "cache", true, true},
+		{"AnchoredMiddleSlash", []string{"var/cache"}, "usr/var/cache", true, false},
+		{"AnchoredMiddleSlashMatch", []string{"var/cache"}, "var/cache", true, true},
+		{"AbsolutePath", []string{"var/cache"}, "/var/cache/", true, true},
+		{"DirOnly", []string{"cache/"}, "cache", true, true},
+		{"DirOnlyFile", []string{"cache/"}, "cache", false, false},
+		{"DirContents", []string{"var/cache"}, "var/cache/apt/pkgcache.bin", false, true},
+		{"DirOnlyContents", []string{"cache/"}, "var/cache/apt/pkgcache.bin", false, true},
+		{"DoubleStarPrefix", []string{"**/tmp"}, "a/b/c/tmp", true, true},
+		{"DoubleStarMiddle", []string{"a/**/c"}, "a/c", true, true},
+		{"DoubleStarMiddleDeep", []string{"a/**/c"}, "a/x/y/c", true, true},
+		{"DoubleStarMiddleNoMatch", []string{"a/**/c"}, "b/x/c", true, false},
+		{"DoubleStarSuffix", []string{"tmp/**"}, "tmp/foo/bar", false, true},
+		{"DoubleStarSuffixSelf", []string{"tmp/**"}, "tmp", true, false},
+		{"Negate", []string{"*.log", "!important.log"}, "var/log/important.log", false, false},
+		{"NegateOrder", []string{"!important.log", "*.log"}, "var/log/important.log", false, true},
+		{"NegateOther", []string{"*.log", "!important.log"}, "var/log/other.log", false, true},
+		{"NegateContents", []string{"tmp/**", "!tmp/keep"}, "tmp/keep", false, false},
+		{"NegateContentsOther", []string{"tmp/**", "!tmp/keep"}, "tmp/other", false, true},
+		{"NegateInsideIgnoredDir", []string{"tmp", "!tmp/keep"}, "tmp/keep", false, true},
+		{"EscapedBang", []string{`\!foo`}, "!foo", false, true},
+		{"EscapedHash", []string{`\#foo`}, "#foo", false, true},
+		{"CharClass", []string{"log[0-9]"}, "log1", false, true},
+		{"Root", []string{"*"}, "/", true, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			matcher, err := compileIgnorePatterns(test.patterns)
+			if err != nil {
+				t.Fatalf("unexpected error compiling %v: %v", test.patterns, err)
+			}
+			if got := matcher.Ignored(test.path, test.isDir); got != test.ignored {
+				t.Errorf("patterns %v: expected Ignored(%q, %v) = %v, got %v", test.patterns, test.path, test.isDir, test.ignored, got)
+			}
+		})
+	}
+}
+
+func TestIgnoreMatcherInvalid(t *testing.T) {
+	for _, pattern := range []string{"/", "!", "!/", "foo/[", "[a-"} {
+		if _, err := compileIgnorePatterns([]string{pattern}); err == nil {
+			t.Errorf("expected error compiling invalid pattern %q", pattern)
+		}
+	}
+}
+
+func TestGenerateIgnore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestGenerateIgnore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, path := range []string{"var/cache/apt", "var/log", "etc"} {
+		if err := os.MkdirAll(filepath.Join(dir, path), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "var", "cache", "olddata"), []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	initDh, err := mtree.Walk(dir, nil, append(mtree.DefaultKeywords, "sha256digest"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for path, contents := range map[string]string{
+		"var/cache/apt/pkgcache.bin": "cache",
+		"var/log/messages.log":       "log",
+		"var/log/keep.log":           "keep",
+		"etc/config":                 "config",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, path), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Deletions of ignored paths must not produce whiteouts.
+	if err := os.Remove(filepath.Join(dir, "var", "cache", "olddata")); err != nil {
+		t.Fatal(err)
+	}
+
+	postDh, err := mtree.Walk(dir, nil, initDh.UsedKeywords(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diffs, err := mtree.Compare(initDh, postDh, initDh.UsedKeywords())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := GenerateLayer(dir, diffs, &RepackOptions{
+		IgnorePatterns: []string{"/var/cache/", "*.log", "!keep.log"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	var got []string
+	tr := tar.NewReader(reader)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error reading layer: %v", err)
+		}
+		got = append(got, hdr.Name)
+	}
+	sort.Strings(got)
+
+	// The directories themselves may or may not be included depending on
+	// whether their mtime changed, so only check the files.
+	expected := map[string]bool{
+		"etc/config":       true,
+		"var/log/keep.log": true,
+	}
+	for _, name := range got {
+		if strings.HasSuffix(name, "/") {
+			if name == "var/cache/" || name == "var/cache/apt/" {
+				t.Errorf("got ignored directory %q in layer", name)
+			}
+			continue
+		}
+		if !expected[name] {
+			t.Errorf("got unexpected entry %q in layer", name)
+		}
+		delete(expected, name)
+	}
+	for name := range expected {
+		t.Errorf("missing expected entry %q in layer", name)
+	}
+}
+
+func TestGenerateIgnoreInvalid(t *testing.T) {
+	if _, err := GenerateLayer("/", nil, &RepackOptions{
+		IgnorePatterns: []string{"foo["},
+	}); err == nil {
+		t.Errorf("expected GenerateLayer to fail with invalid ignore pattern")
+	}
+}
+
+func TestGenerateInsertIgnore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestGenerateInsertIgnore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.MkdirAll(filepath.Join(dir, "cache", "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"cache/sub/file", "a.tmp", "b"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, path), []byte(path), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reader := GenerateInsertLayer(dir, "/opt", false, &RepackOptions{
+		IgnorePatterns: []string{"/opt/cache", "*.tmp"},
+	})
+	defer reader.Close()
+
+	var got []string
+	tr := tar.NewReader(reader)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error reading layer: %v", err)
+		}
+		got = append(got, hdr.Name)
+	}
+	sort.Strings(got)
+
+	expected := []string{"opt/", "opt/b"}
+	if len(got) != len(expected) {
+		t.Fatalf("expected entries %v, got %v", expected, got)
+	}
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Errorf("expected entries %v, got %v", expected, got)
+			break
+		}
+	}
+}
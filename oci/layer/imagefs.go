@@ -0,0 +1,385 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/cas"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/pkg/errors"
+)
+
+// maxImageFSSymlinks is the maximum number of symlinks which will be followed
+// while resolving a single path in an ImageFS (matching MAXSYMLINKS on Linux).
+const maxImageFSSymlinks = 40
+
+// imageFSPosition is the position of an entry in the layers of an image.
+type imageFSPosition struct {
+	layer, idx int
+}
+
+// imageFS is the fs.FS returned by OpenImageFS.
+type imageFS struct {
+	ctx       context.Context
+	engineExt casext.Engine
+	layers    []ispec.Descriptor
+
+	once      sync.Once
+	err       error
+	tree      squashTree
+	positions map[*squashEntry]imageFSPosition
+}
+
+// OpenImageFS returns a read-only fs.FS containing the root filesystem of the
+// given image manifest, as though all of its layers were extracted in order
+// (with whiteouts applied) -- but without extracting anything to disk. This is
+// intended for tools which only need to inspect a handful of files in an image
+// (such as vulnerability scanners).
+//
+// As with all fs.FS implementations, paths are unrooted slash-separated paths
+// (such as "etc/os-release"). Symlinks are resolved within the image (they
+// can never refer to paths outside of it), and the Sys method of the
+// fs.FileInfo of every path other than implicitly-created directories returns
+// the *tar.Header of the path. The returned fs.FS also implements fs.StatFS
+// and fs.ReadDirFS, as well as Lstat and ReadLink methods.
+//
+// The layers are only read when the fs.FS is first used, at which point the
+// headers of every layer are read in order to compute the final filesystem
+// state -- only the headers are kept in memory. The contents of files are then
+// streamed from their layer blob when they are read (because layer blobs are
+// verified, closing a file will read the rest of the layer blob). The given
+// context is used for all operations on the
+// fs.FS, and the engine must not be closed while the fs.FS is in use.
+func OpenImageFS(ctx context.Context, engine cas.Engine, manifest ispec.Manifest) (fs.FS, error) {
+	for _, layerDescriptor := range manifest.Layers {
+		if !isLayerType(layerDescriptor.MediaType) {
+			return nil, errors.Errorf("layer %s: blob is not correct mediatype: %s", layerDescriptor.Digest, layerDescriptor.MediaType)
+		}
+	}
+	return &imageFS{
+		ctx:       ctx,
+		engineExt: casext.NewEngine(engine),
+		layers:    manifest.Layers,
+	}, nil
+}
+
+// build computes the final filesystem state of the image, if it hasn't been
+// computed already.
+func (ifs *imageFS) build() error {
+	ifs.once.Do(func() {
+		ifs.positions = map[*squashEntry]imageFSPosition{}
+		ifs.err = forEachSquashEntry(ifs.ctx, ifs.engineExt, ifs.layers, func(layer, idx int, hdr *tar.Header, _ io.Reader) error {
+			if entry := ifs.tree.apply(layer+1, hdr); entry != nil {
+				ifs.positions[entry] = imageFSPosition{layer: layer, idx: idx}
+			}
+			return nil
+		})
+		if ifs.err != nil {
+			ifs.err = errors.Wrap(ifs.err, "compute image filesystem")
+		}
+	})
+	return ifs.err
+}
+
+// resolve returns the node for the given path, following symlinks in all
+// components of the path (and the final component, if follow is set).
+func (ifs *imageFS) resolve(op, name string, follow bool) (*squashNode, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	if err := ifs.build(); err != nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+
+	node := &ifs.tree.root
+	var parents []*squashNode
+	var links int
+	parts := strings.Split(name, "/")
+	for len(parts) > 0 {
+		part := parts[0]
+		parts = parts[1:]
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			// Much like the kernel, ".." of the root is the root.
+			if len(parents) > 0 {
+				node = parents[len(parents)-1]
+				parents = parents[:len(parents)-1]
+			}
+			continue
+		}
+		if !node.isDir() {
+			return nil, &fs.PathError{Op: op, Path: name, Err: syscall.ENOTDIR}
+		}
+		child := node.children[part]
+		if child == nil {
+			return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+		if child.entry != nil && child.entry.hdr.Typeflag == tar.TypeSymlink && (len(parts) > 0 || follow) {
+			links++
+			if links > maxImageFSSymlinks {
+				return nil, &fs.PathError{Op: op, Path: name, Err: syscall.ELOOP}
+			}
+			target := child.entry.hdr.Linkname
+			if path.IsAbs(target) {
+				node = &ifs.tree.root
+				parents = nil
+			}
+			parts = append(strings.Split(target, "/"), parts...)
+			continue
+		}
+		parents = append(parents, node)
+		node = child
+	}
+	return node, nil
+}
+
+// Open opens the named file, following symlinks.
+func (ifs *imageFS) Open(name string) (fs.File, error) {
+	node, err := ifs.resolve("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+	info := newImageFSInfo(path.Base(name), node)
+	if node.isDir() {
+		return &imageFSDir{ifs: ifs, name: name, info: info, node: node}, nil
+	}
+	return &imageFSFile{ifs: ifs, name: name, info: info}, nil
+}
+
+// Stat returns the fs.FileInfo of the named file, following symlinks.
+func (ifs *imageFS) Stat(name string) (fs.FileInfo, error) {
+	node, err := ifs.resolve("stat", name, true)
+	if err != nil {
+		return nil, err
+	}
+	return newImageFSInfo(path.Base(name), node), nil
+}
+
+// Lstat returns the fs.FileInfo of the named file, without following the
+// final component if it is a symlink.
+func (ifs *imageFS) Lstat(name string) (fs.FileInfo, error) {
+	node, err := ifs.resolve("lstat", name, false)
+	if err != nil {
+		return nil, err
+	}
+	return newImageFSInfo(path.Base(name), node), nil
+}
+
+// ReadLink returns the target of the named symlink.
+func (ifs *imageFS) ReadLink(name string) (string, error) {
+	node, err := ifs.resolve("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+	if node.entry == nil || node.entry.hdr.Typeflag != tar.TypeSymlink {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+	return node.entry.hdr.Linkname, nil
+}
+
+// ReadDir returns the entries of the named directory, sorted by name.
+func (ifs *imageFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	node, err := ifs.resolve("readdir", name, true)
+	if err != nil {
+		return nil, err
+	}
+	if !node.isDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: syscall.ENOTDIR}
+	}
+	return imageFSDirEntries(node), nil
+}
+
+func imageFSDirEntries(node *squashNode) []fs.DirEntry {
+	names := make([]string, 0, len(node.children))
+	for name := range node.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	entries := make([]fs.DirEntry, 0, len(names))
+	for _, name := range names {
+		entries = append(entries, fs.FileInfoToDirEntry(newImageFSInfo(name, node.children[name])))
+	}
+	return entries
+}
+
+// imageFSInfo is the fs.FileInfo of a path in an imageFS.
+type imageFSInfo struct {
+	name string
+	// hdr is the header of the path (or of the source of a hardlink), or nil
+	// if the path is an implicitly-created directory.
+	hdr *tar.Header
+	// entry is the entry containing the contents of the path.
+	entry *squashEntry
+}
+
+func newImageFSInfo(name string, node *squashNode) imageFSInfo {
+	info := imageFSInfo{name: name, entry: node.entry}
+	if info.entry != nil && info.entry.source != nil {
+		info.entry = info.entry.source
+	}
+	if info.entry != nil {
+		info.hdr = info.entry.hdr
+	}
+	return info
+}
+
+func (info imageFSInfo) Name() string { return info.name }
+
+func (info imageFSInfo) Size() int64 {
+	if info.hdr == nil {
+		return 0
+	}
+	return info.hdr.Size
+}
+
+func (info imageFSInfo) Mode() fs.FileMode {
+	if info.hdr == nil {
+		return fs.ModeDir | 0755
+	}
+	return info.hdr.FileInfo().Mode()
+}
+
+func (info imageFSInfo) ModTime() time.Time {
+	if info.hdr == nil {
+		return time.Time{}
+	}
+	return info.hdr.ModTime
+}
+
+func (info imageFSInfo) IsDir() bool { return info.Mode().IsDir() }
+
+func (info imageFSInfo) Sys() interface{} {
+	if info.hdr == nil {
+		return nil
+	}
+	return info.hdr
+}
+
+// imageFSDir is an open directory in an imageFS.
+type imageFSDir struct {
+	ifs     *imageFS
+	name    string
+	info    imageFSInfo
+	node    *squashNode
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *imageFSDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+
+func (d *imageFSDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: syscall.EISDIR}
+}
+
+func (d *imageFSDir) Close() error { return nil }
+
+func (d *imageFSDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if d.entries == nil {
+		d.entries = imageFSDirEntries(d.node)
+	}
+	remaining := d.entries[d.offset:]
+	if n <= 0 {
+		d.offset = len(d.entries)
+		return remaining, nil
+	}
+	if len(remaining) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(remaining) {
+		n = len(remaining)
+	}
+	d.offset += n
+	return remaining[:n], nil
+}
+
+// imageFSFile is an open non-directory in an imageFS. The contents of regular
+// files are streamed from the layer containing the file when first read.
+type imageFSFile struct {
+	ifs    *imageFS
+	name   string
+	info   imageFSInfo
+	layer  io.ReadCloser
+	reader io.Reader
+	closed bool
+}
+
+func (f *imageFSFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+
+// open seeks to the contents of the file in its layer.
+func (f *imageFSFile) open() error {
+	if f.info.entry.hdr.Typeflag == tar.TypeLink {
+		return errors.Errorf("hardlink target %s not found", f.info.entry.hdr.Linkname)
+	}
+	if !f.info.Mode().IsRegular() {
+		return errors.Errorf("not a regular file")
+	}
+
+	pos := f.ifs.positions[f.info.entry]
+	layerDescriptor := f.ifs.layers[pos.layer]
+	layerRaw, err := openLayer(f.ifs.ctx, f.ifs.engineExt, layerDescriptor)
+	if err != nil {
+		return err
+	}
+	f.layer = layerRaw
+
+	tr := tar.NewReader(f.layer)
+	for idx := 0; idx <= pos.idx; idx++ {
+		if _, err := tr.Next(); err != nil {
+			return errors.Wrapf(err, "layer %s: find entry %d", layerDescriptor.Digest, pos.idx)
+		}
+	}
+	f.reader = tr
+	return nil
+}
+
+func (f *imageFSFile) Read(p []byte) (int, error) {
+	if f.closed {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: fs.ErrClosed}
+	}
+	if f.reader == nil {
+		if err := f.open(); err != nil {
+			return 0, &fs.PathError{Op: "read", Path: f.name, Err: err}
+		}
+	}
+	return f.reader.Read(p)
+}
+
+func (f *imageFSFile) Close() error {
+	if f.closed {
+		return &fs.PathError{Op: "close", Path: f.name, Err: fs.ErrClosed}
+	}
+	f.closed = true
+	if f.layer != nil {
+		return f.layer.Close()
+	}
+	return nil
+}
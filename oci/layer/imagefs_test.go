@@ -0,0 +1,183 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+	"testing/fstest"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/cas/dir"
+	"github.com/opencontainers/umoci/oci/casext"
+)
+
+func TestOpenImageFS(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestOpenImageFS")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatal(err)
+	}
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	manifest := ispec.Manifest{
+		Layers: []ispec.Descriptor{
+			putSquashTestLayer(t, engineExt, []squashTestEntry{
+				{hdr: tar.Header{Name: "etc/", Typeflag: tar.TypeDir}},
+				{hdr: tar.Header{Name: "etc/passwd", Typeflag: tar.TypeReg}, content: "root:x:0:0"},
+				{hdr: tar.Header{Name: "etc/group", Typeflag: tar.TypeReg}, content: "root:x:0"},
+				{hdr: tar.Header{Name: "etc/hosts", Typeflag: tar.TypeReg}, content: "localhost"},
+				{hdr: tar.Header{Name: "etc/hosts.link", Typeflag: tar.TypeLink, Linkname: "etc/hosts"}},
+				{hdr: tar.Header{Name: "opaque/", Typeflag: tar.TypeDir}},
+				{hdr: tar.Header{Name: "opaque/a", Typeflag: tar.TypeReg}, content: "a"},
+				{hdr: tar.Header{Name: "usr/bin/sh", Typeflag: tar.TypeReg, Mode: 0755}, content: "#!"},
+				{hdr: tar.Header{Name: "usr/bin/up", Typeflag: tar.TypeSymlink, Linkname: "../../../etc"}},
+				{hdr: tar.Header{Name: "bin", Typeflag: tar.TypeSymlink, Linkname: "usr/bin"}},
+			}, true),
+			putSquashTestLayer(t, engineExt, []squashTestEntry{
+				{hdr: tar.Header{Name: "etc/.wh.group", Typeflag: tar.TypeReg}},
+				{hdr: tar.Header{Name: "etc/hosts", Typeflag: tar.TypeReg}, content: "new localhost"},
+				{hdr: tar.Header{Name: "opaque/.wh..wh..opq", Typeflag: tar.TypeReg}},
+				{hdr: tar.Header{Name: "opaque/b", Typeflag: tar.TypeReg}, content: "b"},
+				{hdr: tar.Header{Name: "escape", Typeflag: tar.TypeSymlink, Linkname: "/../../etc/passwd"}},
+				{hdr: tar.Header{Name: "loop", Typeflag: tar.TypeSymlink, Linkname: "loop"}},
+				{hdr: tar.Header{Name: "dangling", Typeflag: tar.TypeSymlink, Linkname: "/nonexistent"}},
+			}, false),
+		},
+	}
+
+	imageFS, err := OpenImageFS(ctx, engine, manifest)
+	if err != nil {
+		t.Fatalf("unexpected error opening image fs: %+v", err)
+	}
+
+	// fstest.TestFS doesn't like broken symlinks.
+	subFS, err := fs.Sub(imageFS, "etc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fstest.TestFS(subFS, "passwd", "hosts", "hosts.link"); err != nil {
+		t.Errorf("image fs is not a valid fs.FS: %v", err)
+	}
+
+	for name, expected := range map[string]string{
+		"etc/passwd":     "root:x:0:0",
+		"etc/hosts":      "new localhost",
+		"etc/hosts.link": "localhost", // link to the replaced file
+		"bin/sh":         "#!",
+		"bin/up/passwd":  "root:x:0:0",
+		"escape":         "root:x:0:0",
+	} {
+		content, err := fs.ReadFile(imageFS, name)
+		if err != nil {
+			t.Errorf("unexpected error reading %s: %+v", name, err)
+			continue
+		}
+		if string(content) != expected {
+			t.Errorf("unexpected contents of %s: expected %q, got %q", name, expected, string(content))
+		}
+	}
+
+	for name, expected := range map[string]error{
+		"etc/group":         fs.ErrNotExist,
+		"opaque/a":          fs.ErrNotExist,
+		"etc/passwd/foo":    syscall.ENOTDIR,
+		"loop":              syscall.ELOOP,
+		"dangling":          fs.ErrNotExist,
+		"bin/../etc/passwd": fs.ErrInvalid,
+		"/etc/passwd":       fs.ErrInvalid,
+	} {
+		if _, err := fs.ReadFile(imageFS, name); !errors.Is(err, expected) {
+			t.Errorf("expected error reading %s to be %v, got %v", name, expected, err)
+		}
+	}
+
+	var names []string
+	entries, err := fs.ReadDir(imageFS, "bin")
+	if err != nil {
+		t.Fatalf("unexpected error reading directory: %+v", err)
+	}
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if expected := []string{"sh", "up"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("unexpected directory entries: expected %v, got %v", expected, names)
+	}
+
+	lstatFS := imageFS.(interface {
+		Lstat(string) (fs.FileInfo, error)
+		ReadLink(string) (string, error)
+	})
+	fi, err := lstatFS.Lstat("bin")
+	if err != nil {
+		t.Fatalf("unexpected error in lstat: %+v", err)
+	}
+	if fi.Mode()&fs.ModeSymlink == 0 {
+		t.Errorf("expected bin to be a symlink, got mode %v", fi.Mode())
+	}
+	if target, err := lstatFS.ReadLink("bin"); err != nil || target != "usr/bin" {
+		t.Errorf("unexpected readlink of bin: %q (%v)", target, err)
+	}
+	fi, err = fs.Stat(imageFS, "usr/bin/sh")
+	if err != nil {
+		t.Fatalf("unexpected error in stat: %+v", err)
+	}
+	if fi.Mode() != 0755 {
+		t.Errorf("unexpected mode of usr/bin/sh: %v", fi.Mode())
+	}
+	if hdr, ok := fi.Sys().(*tar.Header); !ok || hdr.Name != "usr/bin/sh" {
+		t.Errorf("unexpected Sys() of usr/bin/sh: %#v", fi.Sys())
+	}
+	// usr/ was never explicitly created in the image.
+	fi, err = fs.Stat(imageFS, "usr")
+	if err != nil {
+		t.Fatalf("unexpected error in stat: %+v", err)
+	}
+	if !fi.IsDir() || fi.Sys() != nil {
+		t.Errorf("expected usr to be an implicit directory: %v %#v", fi.Mode(), fi.Sys())
+	}
+}
+
+func TestOpenImageFSBadMediaType(t *testing.T) {
+	manifest := ispec.Manifest{
+		Layers: []ispec.Descriptor{{MediaType: ispec.MediaTypeImageConfig}},
+	}
+	if _, err := OpenImageFS(context.Background(), nil, manifest); err == nil {
+		t.Errorf("expected an error opening an image fs with a non-layer blob")
+	}
+}
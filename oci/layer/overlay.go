@@ -0,0 +1,233 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/apex/log"
+	securejoin "github.com/cyphar/filepath-securejoin"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/cas"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/opencontainers/umoci/pkg/fseval"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// OverlayLayerName returns the name of the directory inside the bundle path
+// which the layer at index idx of the manifest is extracted to by
+// UnpackManifestOverlay.
+func OverlayLayerName(idx int) string {
+	return fmt.Sprintf("layer%d", idx)
+}
+
+// UnpackManifestOverlay extracts each of the layers in the given manifest to
+// a separate directory inside the bundle (<bundle>/layerN, where N is the
+// index of the layer in the manifest -- see OverlayLayerName), as well as
+// generating a runtime configuration. Whiteouts are converted to overlayfs
+// whiteouts (0/0 character devices and "trusted.overlay.opaque" xattrs), so
+// the layer directories can be used directly as overlayfs lower directories
+// (with the highest index being the top-most layer). An empty
+// <bundle>/<layer.RootfsName> directory is created to be used as the mount
+// point of the overlayfs, as that is what the runtime configuration refers
+// to. For example:
+//
+//	mount -t overlay overlay -o lowerdir=layer2:layer1:layer0 rootfs
+//
+// Hardlinks to files in lower layers are created as hardlinks to the file in
+// the lower layer's directory (so the link count of the file is correct when
+// viewed through the overlayfs).
+func UnpackManifestOverlay(ctx context.Context, engine cas.Engine, bundle string, manifest ispec.Manifest, opt *UnpackOptions) (err error) {
+	engineExt := casext.NewEngine(engine)
+
+	var unpackOptions UnpackOptions
+	if opt != nil {
+		unpackOptions = *opt
+	}
+	unpackOptions.WhiteoutMode = OverlayFSWhiteout
+	if unpackOptions.StartFrom.MediaType != "" {
+		return errors.Errorf("unpack overlay: starting from a specific layer is not supported")
+	}
+
+	fsEval := fseval.Default
+	if unpackOptions.MapOptions.Rootless {
+		fsEval = fseval.Rootless
+	}
+
+	// See UnpackManifest for why we do this.
+	if err := os.MkdirAll(bundle, 0755); err != nil {
+		return errors.Wrap(err, "mkdir bundle")
+	}
+	if err := os.Chmod(bundle, 0700); err != nil {
+		return errors.Wrap(err, "chmod bundle 0700")
+	}
+
+	configPath := filepath.Join(bundle, "config.json")
+	rootfsPath := filepath.Join(bundle, RootfsName)
+
+	// None of the paths we are going to create may already exist.
+	paths := []string{configPath, rootfsPath}
+	for idx := range manifest.Layers {
+		paths = append(paths, filepath.Join(bundle, OverlayLayerName(idx)))
+	}
+	for _, path := range paths {
+		if _, err := os.Lstat(path); !os.IsNotExist(err) {
+			if err == nil {
+				err = fmt.Errorf("%s already exists", path)
+			}
+			return errors.Wrap(err, "unpack overlay")
+		}
+	}
+
+	var created []string
+	defer func() {
+		if err != nil {
+			for _, path := range created {
+				// It's too late to care about errors.
+				// #nosec G104
+				_ = fsEval.RemoveAll(path)
+			}
+		}
+	}()
+
+	config, err := getLayersConfig(ctx, engineExt, manifest)
+	if err != nil {
+		return errors.Wrap(err, "unpack overlay")
+	}
+
+	var total int64
+	for _, layerDescriptor := range manifest.Layers {
+		total += layerDescriptor.Size
+	}
+	progress := newProgressCounter(unpackOptions.Progress, total)
+
+	var lowerRoots []string
+	for idx, layerDescriptor := range manifest.Layers {
+		layerPath := filepath.Join(bundle, OverlayLayerName(idx))
+		log.Infof("unpack layer %s: %s", OverlayLayerName(idx), layerDescriptor.Digest)
+
+		if err := os.Mkdir(layerPath, 0755); err != nil {
+			return errors.Wrap(err, "mkdir layer")
+		}
+		created = append(created, layerPath)
+		if err := prepareRoot(layerPath, &unpackOptions); err != nil {
+			return err
+		}
+		if err := unpackLayerBlob(ctx, engineExt, layerPath, lowerRoots, layerDescriptor, config.RootFS.DiffIDs[idx], &unpackOptions, progress); err != nil {
+			return err
+		}
+		lowerRoots = append([]string{layerPath}, lowerRoots...)
+
+		if unpackOptions.AfterLayerUnpack != nil {
+			if err := unpackOptions.AfterLayerUnpack(manifest, layerDescriptor); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Create the mountpoint for the overlayfs.
+	if err := os.Mkdir(rootfsPath, 0755); err != nil {
+		return errors.Wrap(err, "mkdir rootfs")
+	}
+	created = append(created, rootfsPath)
+	if err := prepareRoot(rootfsPath, &unpackOptions); err != nil {
+		return err
+	}
+
+	// There is no merged rootfs we can use to resolve Config.User, so we use
+	// the top-most layer that contains an /etc/passwd. This is only an
+	// approximation (an upper layer might have removed the file), but is
+	// good enough for the vast majority of images.
+	userRoot := rootfsPath
+	for idx := len(manifest.Layers) - 1; idx >= 0; idx-- {
+		layerPath := filepath.Join(bundle, OverlayLayerName(idx))
+		if fi, err := fsEval.Lstat(filepath.Join(layerPath, "etc", "passwd")); err == nil && fi.Mode().IsRegular() {
+			userRoot = layerPath
+			break
+		}
+	}
+
+	spec, err := unpackRuntimeSpec(ctx, engine, userRoot, manifest, &unpackOptions)
+	if err != nil {
+		return errors.Wrap(err, "unpack config.json")
+	}
+	spec.Root.Path = RootfsName
+
+	configFile, err := os.Create(configPath)
+	if err != nil {
+		return errors.Wrap(err, "open config.json")
+	}
+	defer configFile.Close()
+	created = append(created, configPath)
+
+	enc := json.NewEncoder(configFile)
+	enc.SetIndent("", "\t")
+	return errors.Wrap(enc.Encode(spec), "write config.json")
+}
+
+// lowerHardlinkTarget finds the path (on the host) of the hardlink target
+// linkname in the top-most lower layer containing it, following overlayfs
+// semantics (a lower layer is hidden by whiteouts, opaque directories and
+// non-directory path components in the layers above it). If the target
+// doesn't exist in any of the lower layers, "" is returned.
+func (te *TarExtractor) lowerHardlinkTarget(linkname string) (string, error) {
+	unsafeDir, file := filepath.Split(CleanPath(linkname))
+	for _, lowerRoot := range te.lowerRoots {
+		dir, err := securejoin.SecureJoinVFS(lowerRoot, unsafeDir, te.fsEval)
+		if err != nil {
+			return "", errors.Wrap(err, "sanitise hardlink target in lower layer")
+		}
+		path := filepath.Join(dir, file)
+		if err := checkInRoot(lowerRoot, path); err != nil {
+			return "", errors.Wrap(err, "sanitise hardlink target in lower layer")
+		}
+
+		fi, err := te.fsEval.Lstat(path)
+		switch {
+		case err == nil:
+			if whiteout, err := isOverlayWhiteout(fi); err != nil || whiteout {
+				return "", err
+			}
+			if fi.IsDir() {
+				return "", nil
+			}
+			return path, nil
+		case errors.Is(err, unix.ENOTDIR):
+			// A non-directory component hides the lower layers.
+			return "", nil
+		case !errors.Is(err, os.ErrNotExist):
+			return "", errors.Wrap(err, "lstat hardlink target in lower layer")
+		}
+
+		// An opaque directory in the path hides the lower layers.
+		for parent := dir; ; parent = filepath.Dir(parent) {
+			if value, err := te.fsEval.Lgetxattr(parent, "trusted.overlay.opaque"); err == nil && string(value) == "y" {
+				return "", nil
+			}
+			if parent == lowerRoot || parent == filepath.Dir(parent) {
+				break
+			}
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,305 @@
+//go:build linux
+// +build linux
+
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/opencontainers/umoci/oci/cas/dir"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/opencontainers/umoci/pkg/testutils"
+	"golang.org/x/sys/unix"
+)
+
+type overlayTestEntry struct {
+	path     string
+	typeflag byte
+	contents string
+}
+
+// makeTarLayer creates an uncompressed layer blob from the given set of
+// entries, returning its descriptor (whose digest is also its DiffID).
+func makeTarLayer(t *testing.T, engineExt casext.Engine, entries []overlayTestEntry) ispec.Descriptor {
+	var buffer bytes.Buffer
+	tw := tar.NewWriter(&buffer)
+	for _, entry := range entries {
+		mode := int64(0644)
+		if entry.typeflag == tar.TypeDir {
+			mode = 0755
+		}
+		hdr := &tar.Header{
+			Name:     entry.path,
+			Typeflag: entry.typeflag,
+			Mode:     mode,
+			Size:     int64(len(entry.contents)),
+			ModTime:  testutils.Unix(1210393, 4528036),
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("write header %s: %v", hdr.Name, err)
+		}
+		if _, err := tw.Write([]byte(entry.contents)); err != nil {
+			t.Fatalf("write data %s: %v", hdr.Name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	layerDigest, layerSize, err := engineExt.PutBlob(context.Background(), &buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageLayer,
+		Digest:    layerDigest,
+		Size:      layerSize,
+	}
+}
+
+func TestUnpackManifestOverlay(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestUnpackManifestOverlay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	mknodOk, err := canMknod(root)
+	if err != nil {
+		t.Fatalf("couldn't mknod in dir: %v", err)
+	}
+	if !mknodOk || os.Geteuid() != 0 {
+		t.Skip("skipping overlayfs test: requires mknod and trusted xattrs")
+	}
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatal(err)
+	}
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	layers := []ispec.Descriptor{
+		makeTarLayer(t, engineExt, []overlayTestEntry{
+			{"etc", tar.TypeDir, ""},
+			{"etc/passwd", tar.TypeReg, "root:x:0:0:root:/root:/bin/sh\nfoo:x:1337:1337::/:/bin/sh\n"},
+			{"a", tar.TypeDir, ""},
+			{"a/file", tar.TypeReg, "file"},
+			{"b", tar.TypeDir, ""},
+			{"b/file", tar.TypeReg, "file"},
+			{"c", tar.TypeReg, "c"},
+		}),
+		makeTarLayer(t, engineExt, []overlayTestEntry{
+			{"a/" + whPrefix + "file", tar.TypeReg, ""},
+			{"b", tar.TypeDir, ""},
+			{"b/" + whOpaque, tar.TypeReg, ""},
+			{"b/newfile", tar.TypeReg, "newfile"},
+			{whPrefix + "c", tar.TypeReg, ""},
+		}),
+	}
+	var diffIDs []digest.Digest
+	for _, layer := range layers {
+		diffIDs = append(diffIDs, layer.Digest)
+	}
+
+	configDigest, configSize, err := engineExt.PutBlobJSON(ctx, ispec.Image{
+		OS: "linux",
+		Config: ispec.ImageConfig{
+			User: "foo",
+		},
+		RootFS: ispec.RootFS{
+			Type:    "layers",
+			DiffIDs: diffIDs,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := ispec.Manifest{
+		Versioned: specs.Versioned{
+			SchemaVersion: 2,
+		},
+		MediaType: ispec.MediaTypeImageManifest,
+		Config: ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageConfig,
+			Digest:    configDigest,
+			Size:      configSize,
+		},
+		Layers: layers,
+	}
+
+	bundle := filepath.Join(root, "bundle")
+	if err := UnpackManifestOverlay(ctx, engineExt, bundle, manifest, nil); err != nil {
+		t.Fatalf("unexpected error unpacking overlay: %+v", err)
+	}
+
+	// The lower layer should be extracted normally.
+	for _, path := range []string{"a/file", "b/file", "c"} {
+		fi, err := os.Lstat(filepath.Join(bundle, "layer0", path))
+		if err != nil {
+			t.Errorf("lower layer missing %s: %v", path, err)
+		} else if !fi.Mode().IsRegular() {
+			t.Errorf("lower layer %s is not a regular file: %v", path, fi.Mode())
+		}
+	}
+
+	// The upper layer should contain overlayfs whiteouts.
+	for _, path := range []string{"a/file", "c"} {
+		fi, err := os.Lstat(filepath.Join(bundle, "layer1", path))
+		if err != nil {
+			t.Errorf("upper layer missing whiteout %s: %v", path, err)
+			continue
+		}
+		if whiteout, err := isOverlayWhiteout(fi); err != nil || !whiteout {
+			t.Errorf("upper layer %s is not an overlayfs whiteout: %v", path, err)
+		}
+	}
+	if _, err := os.Lstat(filepath.Join(bundle, "layer1", "b", whOpaque)); !os.IsNotExist(err) {
+		t.Errorf("upper layer contains opaque whiteout file: %v", err)
+	}
+	value := make([]byte, 10)
+	n, err := unix.Lgetxattr(filepath.Join(bundle, "layer1", "b"), "trusted.overlay.opaque", value)
+	if err != nil {
+		t.Errorf("failed to get overlay opaque attr: %v", err)
+	} else if string(value[:n]) != "y" {
+		t.Errorf("bad opaque xattr: %v", string(value[:n]))
+	}
+	if _, err := os.Lstat(filepath.Join(bundle, "layer1", "b", "newfile")); err != nil {
+		t.Errorf("upper layer missing b/newfile: %v", err)
+	}
+
+	// The rootfs should be an empty mountpoint.
+	if names, err := ioutil.ReadDir(filepath.Join(bundle, RootfsName)); err != nil {
+		t.Errorf("failed to read rootfs: %v", err)
+	} else if len(names) != 0 {
+		t.Errorf("rootfs mountpoint is not empty: %v", names)
+	}
+
+	// The config should refer to the rootfs, and the user should have been
+	// resolved using the layers.
+	configData, err := ioutil.ReadFile(filepath.Join(bundle, "config.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var spec rspec.Spec
+	if err := json.Unmarshal(configData, &spec); err != nil {
+		t.Fatal(err)
+	}
+	if spec.Root.Path != RootfsName {
+		t.Errorf("config.json has the wrong root.path: %q", spec.Root.Path)
+	}
+	if spec.Process.User.UID != 1337 || spec.Process.User.GID != 1337 {
+		t.Errorf("config.json has the wrong user: %d:%d", spec.Process.User.UID, spec.Process.User.GID)
+	}
+
+	// Unpacking over an existing bundle must fail.
+	if err := UnpackManifestOverlay(ctx, engineExt, bundle, manifest, nil); err == nil {
+		t.Errorf("expected error when unpacking overlay over existing bundle")
+	}
+}
+
+func TestUnpackManifestOverlayHardlink(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestUnpackManifestOverlayHardlink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	mknodOk, err := canMknod(root)
+	if err != nil {
+		t.Fatalf("couldn't mknod in dir: %v", err)
+	}
+	if !mknodOk || os.Geteuid() != 0 {
+		t.Skip("skipping overlayfs test: requires mknod and trusted xattrs")
+	}
+
+	lower := []squashTestEntry{
+		{hdr: tar.Header{Name: "etc/", Typeflag: tar.TypeDir}},
+		{hdr: tar.Header{Name: "etc/target", Typeflag: tar.TypeReg}, content: "target"},
+		{hdr: tar.Header{Name: "etc/shadowed", Typeflag: tar.TypeReg}, content: "lower"},
+		{hdr: tar.Header{Name: "removed", Typeflag: tar.TypeReg}, content: "removed"},
+		{hdr: tar.Header{Name: "opaque/", Typeflag: tar.TypeDir}},
+		{hdr: tar.Header{Name: "opaque/file", Typeflag: tar.TypeReg}, content: "opaque"},
+	}
+	middle := []squashTestEntry{
+		{hdr: tar.Header{Name: "etc/", Typeflag: tar.TypeDir}},
+		{hdr: tar.Header{Name: "etc/shadowed", Typeflag: tar.TypeReg}, content: "middle"},
+		{hdr: tar.Header{Name: whPrefix + "removed", Typeflag: tar.TypeReg}},
+		{hdr: tar.Header{Name: "opaque/", Typeflag: tar.TypeDir}},
+		{hdr: tar.Header{Name: "opaque/" + whOpaque, Typeflag: tar.TypeReg}},
+	}
+
+	engineExt, manifest := makeLayeredTestImage(t, root, lower, middle, []squashTestEntry{
+		{hdr: tar.Header{Name: "link", Typeflag: tar.TypeLink, Linkname: "etc/target"}},
+		{hdr: tar.Header{Name: "shadowed-link", Typeflag: tar.TypeLink, Linkname: "etc/shadowed"}},
+	})
+	defer engineExt.Close()
+
+	bundle := filepath.Join(root, "bundle")
+	if err := UnpackManifestOverlay(ctx, engineExt, bundle, manifest, nil); err != nil {
+		t.Fatalf("unexpected error unpacking overlay: %+v", err)
+	}
+
+	// The hardlinks must refer to the top-most lower file.
+	for link, target := range map[string]string{
+		"link":          "layer0/etc/target",
+		"shadowed-link": "layer1/etc/shadowed",
+	} {
+		targetIno, targetNlink := inode(t, filepath.Join(bundle, target))
+		ino, nlink := inode(t, filepath.Join(bundle, "layer2", link))
+		if ino != targetIno || nlink != 2 || targetNlink != 2 {
+			t.Errorf("expected layer2/%s to be a hardlink to %s (inode %d, nlink %d), got inode %d nlink %d", link, target, targetIno, targetNlink, ino, nlink)
+		}
+	}
+
+	// Hardlinks to paths hidden by a whiteout or opaque directory must fail.
+	for _, linkname := range []string{"removed", "opaque/file", "does-not-exist"} {
+		root := filepath.Join(root, "hidden-"+filepath.Base(linkname))
+		if err := os.Mkdir(root, 0755); err != nil {
+			t.Fatal(err)
+		}
+		engineExt, manifest := makeLayeredTestImage(t, root, lower, middle, []squashTestEntry{
+			{hdr: tar.Header{Name: "link", Typeflag: tar.TypeLink, Linkname: linkname}},
+		})
+		if err := UnpackManifestOverlay(ctx, engineExt, filepath.Join(root, "bundle"), manifest, nil); err == nil {
+			t.Errorf("expected hardlink to hidden path %s to fail", linkname)
+		}
+		engineExt.Close()
+	}
+}
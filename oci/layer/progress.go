@@ -0,0 +1,77 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"io"
+)
+
+// ProgressFunc is a callback used to report the progress of an operation. It
+// is called with the number of bytes processed so far and the total number of
+// bytes that will be processed (or -1 if the total is not known). The callback
+// may be called very frequently, so implementations should be cheap (and
+// should rate-limit any expensive operations, such as rendering).
+type ProgressFunc func(processed, total int64)
+
+// progressCounter keeps track of the progress of an operation and reports it
+// to a ProgressFunc. A nil *progressCounter (or one without a ProgressFunc) is
+// valid, and does nothing.
+type progressCounter struct {
+	fn        ProgressFunc
+	processed int64
+	total     int64
+}
+
+// newProgressCounter creates a new progressCounter for the given total, which
+// reports to fn. If fn is nil, nil is returned.
+func newProgressCounter(fn ProgressFunc, total int64) *progressCounter {
+	if fn == nil {
+		return nil
+	}
+	return &progressCounter{fn: fn, total: total}
+}
+
+// Add adds n bytes to the number of processed bytes, and reports the new
+// progress.
+func (p *progressCounter) Add(n int64) {
+	if p == nil || n == 0 {
+		return
+	}
+	p.processed += n
+	p.fn(p.processed, p.total)
+}
+
+// Reader wraps the given reader such that all bytes read from it are counted
+// as processed.
+func (p *progressCounter) Reader(r io.Reader) io.Reader {
+	if p == nil {
+		return r
+	}
+	return &progressReader{r: r, counter: p}
+}
+
+type progressReader struct {
+	r       io.Reader
+	counter *progressCounter
+}
+
+func (pr *progressReader) Read(b []byte) (int, error) {
+	n, err := pr.r.Read(b)
+	pr.counter.Add(int64(n))
+	return n, err
+}
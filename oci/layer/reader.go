@@ -0,0 +1,120 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/apex/log"
+	"github.com/opencontainers/umoci/pkg/system"
+	"github.com/pkg/errors"
+)
+
+// layerReader is the reader returned by NewLayerReader. Closing it closes
+// both the compressed stream and the underlying tar stream (so that the
+// goroutines generating them don't leak).
+type layerReader struct {
+	io.ReadCloser
+	raw io.ReadCloser
+}
+
+func (r layerReader) Close() error {
+	err := r.ReadCloser.Close()
+	if rawErr := r.raw.Close(); err == nil {
+		err = rawErr
+	}
+	return err
+}
+
+// NewLayerReader returns a reader for a new layer containing the entire
+// contents of the given rootfs directory, compressed with opt.Compressor (if
+// set). Unlike the other layer generation functions, no mtree manifest or
+// image is required, so this can be used to generate layers outside of an OCI
+// image. The paths in the layer are relative to rootfs. The caller must close
+// the returned reader.
+func NewLayerReader(rootfs string, opt *LayerReaderOptions) (io.ReadCloser, error) {
+	var options LayerReaderOptions
+	if opt != nil {
+		options = *opt
+	}
+
+	// Report any errors we can before generating the layer, rather than
+	// through the reader.
+	if _, err := compileIgnorePatterns(options.IgnorePatterns); err != nil {
+		return nil, errors.Wrap(err, "compile ignore patterns")
+	}
+	fi, err := os.Stat(rootfs)
+	if err != nil {
+		return nil, errors.Wrap(err, "stat rootfs")
+	}
+	if !fi.IsDir() {
+		return nil, errors.Errorf("rootfs %s is not a directory", rootfs)
+	}
+
+	raw := GenerateInsertLayer(rootfs, "/", false, &options.RepackOptions)
+	if options.Compressor == nil {
+		return raw, nil
+	}
+	compressed, err := options.Compressor.Compress(raw)
+	if err != nil {
+		// #nosec G104
+		_ = raw.Close()
+		return nil, errors.Wrap(err, "compress layer")
+	}
+	return layerReader{ReadCloser: compressed, raw: raw}, nil
+}
+
+// ApplyLayerReader extracts the layer read from r on top of the given rootfs
+// directory, decompressing it based on opt.MediaType. This is equivalent to
+// UnpackLayer, except that compressed layers are also supported. Any trailing
+// data after the end of the tar stream is ignored. If an error is returned,
+// the state of rootfs is undefined (extraction is not atomic).
+func ApplyLayerReader(rootfs string, r io.Reader, opt *ApplyLayerOptions) error {
+	var options ApplyLayerOptions
+	if opt != nil {
+		options = *opt
+	}
+
+	layer := ioutil.NopCloser(r)
+	if options.MediaType != "" {
+		var err error
+		layer, err = DecompressLayer(options.MediaType, r)
+		if err != nil {
+			return errors.Wrap(err, "decompress layer")
+		}
+	}
+	defer layer.Close()
+
+	if err := unpackLayer(rootfs, layer, &options.UnpackOptions, nil); err != nil {
+		return err
+	}
+	// Much like unpackLayerBlob, we need to consume any trailing padding so
+	// that callers piping the layer from elsewhere don't get a short read.
+	//
+	// FIXME: We hide the WriteTo method of layer because pgzip returns io.EOF
+	// from WriteTo, which causes havoc with system.Copy. See
+	// <https://github.com/klauspost/pgzip/issues/38>.
+	if n, err := system.Copy(ioutil.Discard, struct{ io.Reader }{layer}); err != nil {
+		return errors.Wrap(err, "discard trailing archive bits")
+	} else if n != 0 {
+		log.Debugf("apply layer: ignoring %d trailing 'junk' bytes in the tar stream", n)
+	}
+	return nil
+}
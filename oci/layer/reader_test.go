@@ -0,0 +1,185 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// testGzipCompressor is a minimal Compressor (we cannot use mutate's
+// compressors here, because mutate imports this package).
+type testGzipCompressor struct{}
+
+func (testGzipCompressor) Compress(r io.Reader) (io.ReadCloser, error) {
+	pipeReader, pipeWriter := io.Pipe()
+	go func() {
+		gzw := gzip.NewWriter(pipeWriter)
+		if _, err := io.Copy(gzw, r); err != nil {
+			pipeWriter.CloseWithError(err)
+			return
+		}
+		pipeWriter.CloseWithError(gzw.Close())
+	}()
+	return pipeReader, nil
+}
+
+func TestLayerReaderRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestLayerReaderRoundTrip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rootfs := filepath.Join(dir, "rootfs")
+	if err := os.MkdirAll(filepath.Join(rootfs, "etc", "empty"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(rootfs, "etc", "hostname"), []byte("umoci\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(rootfs, "etc", "ignored"), []byte("ignored\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("etc/hostname", filepath.Join(rootfs, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name       string
+		compressor Compressor
+		mediaType  string
+	}{
+		{"Uncompressed", nil, ""},
+		{"Gzip", testGzipCompressor{}, ispec.MediaTypeImageLayerGzip},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			reader, err := NewLayerReader(rootfs, &LayerReaderOptions{
+				RepackOptions: RepackOptions{IgnorePatterns: []string{"/etc/ignored"}},
+				Compressor:    test.compressor,
+			})
+			if err != nil {
+				t.Fatalf("unexpected error creating layer reader: %+v", err)
+			}
+			defer reader.Close()
+
+			target := filepath.Join(dir, "target-"+test.name)
+			if err := os.Mkdir(target, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ApplyLayerReader(target, reader, &ApplyLayerOptions{MediaType: test.mediaType}); err != nil {
+				t.Fatalf("unexpected error applying layer: %+v", err)
+			}
+
+			var paths []string
+			if err := filepath.Walk(target, func(path string, _ os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+				rel, err := filepath.Rel(target, path)
+				paths = append(paths, rel)
+				return err
+			}); err != nil {
+				t.Fatal(err)
+			}
+			sort.Strings(paths)
+			expected := []string{".", "etc", "etc/empty", "etc/hostname", "link"}
+			if !reflect.DeepEqual(paths, expected) {
+				t.Errorf("unexpected paths after applying layer: expected %v, got %v", expected, paths)
+			}
+			if data, err := ioutil.ReadFile(filepath.Join(target, "etc", "hostname")); err != nil || string(data) != "umoci\n" {
+				t.Errorf("unexpected etc/hostname contents %q (err=%v)", data, err)
+			}
+			if linkname, err := os.Readlink(filepath.Join(target, "link")); err != nil || linkname != "etc/hostname" {
+				t.Errorf("unexpected link target %q (err=%v)", linkname, err)
+			}
+		})
+	}
+}
+
+func TestNewLayerReaderNames(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestNewLayerReaderNames")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "file"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := NewLayerReader(dir, nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating layer reader: %+v", err)
+	}
+	defer reader.Close()
+
+	var names []string
+	tr := tar.NewReader(reader)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error reading layer: %+v", err)
+		}
+		names = append(names, hdr.Name)
+	}
+	// The rootfs itself is included (so that its metadata is applied).
+	expected := []string{"/", "file"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("unexpected layer entries: expected %q, got %q", expected, names)
+	}
+}
+
+func TestNewLayerReaderErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestNewLayerReaderErrors")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewLayerReader(filepath.Join(dir, "missing"), nil); err == nil {
+		t.Errorf("expected error with missing rootfs")
+	}
+	if _, err := NewLayerReader(file, nil); err == nil {
+		t.Errorf("expected error with non-directory rootfs")
+	}
+	if _, err := NewLayerReader(dir, &LayerReaderOptions{RepackOptions: RepackOptions{IgnorePatterns: []string{"foo\\"}}}); err == nil {
+		t.Errorf("expected error with invalid ignore pattern")
+	}
+
+	if err := ApplyLayerReader(dir, os.Stdin, &ApplyLayerOptions{MediaType: ispec.MediaTypeImageConfig}); err == nil {
+		t.Errorf("expected error applying layer with non-layer media type")
+	}
+}
@@ -0,0 +1,87 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"strings"
+
+	"github.com/apex/log"
+)
+
+// shadowXattrPrefix is the prefix of the "shadow" xattrs created when
+// extracting with UnpackOptions.ShadowXattrs. If an unprivileged user cannot
+// set a privileged xattr (such as "security.capability"), the value is stored
+// in a user.* xattr with this prefix instead (such as
+// "user.umoci.security.capability"). Shadow xattrs are converted back into the
+// original xattr when generating a layer, so they never appear in layers.
+const shadowXattrPrefix = "user.umoci."
+
+// shadowXattrName returns the name of the shadow xattr for the given xattr,
+// and whether the xattr can be shadowed (only xattrs in privileged namespaces
+// can be shadowed).
+func shadowXattrName(name string) (string, bool) {
+	if ns, ok := lookupXattrNamespace(name); ok && ns.privileged {
+		return shadowXattrPrefix + name, true
+	}
+	return "", false
+}
+
+// unshadowXattrName returns the name of the xattr shadowed by the given xattr,
+// and whether the given xattr is a shadow xattr.
+func unshadowXattrName(name string) (string, bool) {
+	if !strings.HasPrefix(name, shadowXattrPrefix) {
+		return "", false
+	}
+	origName := strings.TrimPrefix(name, shadowXattrPrefix)
+	if shadowName, ok := shadowXattrName(origName); !ok || shadowName != name {
+		return "", false
+	}
+	return origName, true
+}
+
+// restoreShadowXattrs converts any shadow xattrs in the given tar.Header
+// (generated from the filesystem) back into the xattrs they shadow. If the
+// shadowed xattr is also set, the shadow xattr is ignored.
+func restoreShadowXattrs(hdr *tar.Header) {
+	for name, value := range hdr.Xattrs {
+		origName, ok := unshadowXattrName(name)
+		if !ok {
+			continue
+		}
+		delete(hdr.Xattrs, name)
+		if _, exists := hdr.Xattrs[origName]; exists {
+			log.Warnf("xattr{%s} ignoring shadow xattr %q: %q is already set", hdr.Name, name, origName)
+			continue
+		}
+		hdr.Xattrs[origName] = value
+	}
+}
+
+// dropShadowXattrs removes any shadow xattrs from the given tar.Header (from a
+// layer). Layers generated by umoci never contain shadow xattrs, and so we
+// must not let a layer smuggle in privileged xattrs through them (they would
+// be converted into the real xattr when repacking).
+func dropShadowXattrs(hdr *tar.Header) {
+	for name := range hdr.Xattrs {
+		if _, ok := unshadowXattrName(name); ok {
+			log.Warnf("suspicious layer: ignoring shadow xattr %q stored in layer: %s", name, hdr.Name)
+			delete(hdr.Xattrs, name)
+		}
+	}
+}
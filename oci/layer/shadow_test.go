@@ -0,0 +1,102 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"reflect"
+	"testing"
+)
+
+func TestShadowXattrName(t *testing.T) {
+	for _, test := range []struct {
+		name, shadowName string
+	}{
+		{"security.capability", "user.umoci.security.capability"},
+		{"trusted.overlay.opaque", "user.umoci.trusted.overlay.opaque"},
+		{"system.posix_acl_access", "user.umoci.system.posix_acl_access"},
+	} {
+		shadowName, ok := shadowXattrName(test.name)
+		if !ok || shadowName != test.shadowName {
+			t.Errorf("%s: expected shadow xattr %q, got %q (ok=%v)", test.name, test.shadowName, shadowName, ok)
+		}
+		origName, ok := unshadowXattrName(shadowName)
+		if !ok || origName != test.name {
+			t.Errorf("%s: shadow xattr %q round-trip mismatch: got %q (ok=%v)", test.name, shadowName, origName, ok)
+		}
+	}
+
+	for _, name := range []string{"user.foo", "user.umoci.security.capability", "unknown.foo"} {
+		if shadowName, ok := shadowXattrName(name); ok {
+			t.Errorf("%s: unexpected shadow xattr %q", name, shadowName)
+		}
+	}
+	for _, name := range []string{"security.capability", "user.umoci.", "user.umoci.user.foo", rootlessDeviceXattr} {
+		if origName, ok := unshadowXattrName(name); ok {
+			t.Errorf("%s: unexpectedly treated as shadow xattr of %q", name, origName)
+		}
+	}
+}
+
+// TestMapShadowXattrs ensures that mapHeader converts shadow xattrs back into
+// the original xattrs.
+func TestMapShadowXattrs(t *testing.T) {
+	for idx, test := range []struct {
+		xattrs, expected map[string]string
+	}{
+		{
+			map[string]string{"user.umoci.security.capability": "cap", "user.other": "value"},
+			map[string]string{"security.capability": "cap", "user.other": "value"},
+		},
+		// The real xattr takes precedence over the shadow xattr.
+		{
+			map[string]string{"user.umoci.security.capability": "shadow", "security.capability": "real"},
+			map[string]string{"security.capability": "real"},
+		},
+	} {
+		hdr := &tar.Header{Name: "file", Typeflag: tar.TypeReg, Xattrs: test.xattrs}
+		if err := mapHeader(hdr, MapOptions{Rootless: true}); err != nil {
+			t.Fatalf("test%d: unexpected error in mapHeader: %+v", idx, err)
+		}
+		if !reflect.DeepEqual(hdr.Xattrs, test.expected) {
+			t.Errorf("test%d: unexpected xattrs: expected %v, got %v", idx, test.expected, hdr.Xattrs)
+		}
+	}
+}
+
+// TestUnmapShadowXattrs ensures that shadow xattrs stored in layers are
+// ignored by unmapHeader.
+func TestUnmapShadowXattrs(t *testing.T) {
+	for _, rootless := range []bool{true, false} {
+		hdr := &tar.Header{
+			Name:     "file",
+			Typeflag: tar.TypeReg,
+			Xattrs: map[string]string{
+				"user.umoci.security.capability": "cap",
+				"user.other":                     "value",
+			},
+		}
+		if err := unmapHeader(hdr, MapOptions{Rootless: rootless}); err != nil {
+			t.Fatalf("rootless=%v: unexpected error in unmapHeader: %+v", rootless, err)
+		}
+		expected := map[string]string{"user.other": "value"}
+		if !reflect.DeepEqual(hdr.Xattrs, expected) {
+			t.Errorf("rootless=%v: unexpected xattrs: expected %v, got %v", rootless, expected, hdr.Xattrs)
+		}
+	}
+}
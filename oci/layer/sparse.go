@@ -0,0 +1,318 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/umoci/pkg/system"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// The Go stdlib can read sparse tar entries (of all the GNU formats) but it
+// will expand the holes into runs of zeroes, and it cannot write sparse
+// entries at all (see <https://golang.org/issue/22735>). So we have to
+// implement both halves ourselves. When generating layers we produce the
+// GNU PAX 1.0 sparse format, which is what GNU tar produces by default.
+
+// sparseGNUPrefix is the prefix for all PAX records used by the GNU sparse
+// formats.
+const sparseGNUPrefix = "GNU.sparse."
+
+// sparseBlockSize is the granularity with which we detect (and create) holes
+// when extracting sparse files.
+const sparseBlockSize = 4096
+
+// sparseEntry represents a single data fragment in a sparse file.
+type sparseEntry struct {
+	Offset int64
+	Length int64
+}
+
+// isSparseHeader returns whether the given header (from a tar.Reader)
+// describes a sparse file.
+func isSparseHeader(hdr *tar.Header) bool {
+	if hdr.Typeflag == tar.TypeGNUSparse {
+		return true
+	}
+	for key := range hdr.PAXRecords {
+		if strings.HasPrefix(key, sparseGNUPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// dataSegments returns the list of data fragments in the given file (using
+// SEEK_DATA and SEEK_HOLE), or nil if the file does not contain any holes (or
+// the filesystem doesn't support hole detection). The file offset of fh is
+// reset to the start of the file.
+func dataSegments(fh *os.File, size int64) ([]sparseEntry, error) {
+	var segments []sparseEntry
+	for offset := int64(0); offset < size; {
+		data, err := fh.Seek(offset, unix.SEEK_DATA)
+		if errors.Is(err, unix.ENXIO) {
+			// The remainder of the file is a hole.
+			break
+		} else if errors.Is(err, unix.EINVAL) && offset == 0 {
+			// SEEK_DATA is not supported.
+			return nil, nil
+		} else if err != nil {
+			return nil, errors.Wrap(err, "seek data")
+		}
+		if data >= size {
+			break
+		}
+		hole, err := fh.Seek(data, unix.SEEK_HOLE)
+		if err != nil {
+			return nil, errors.Wrap(err, "seek hole")
+		}
+		if hole > size {
+			hole = size
+		}
+		segments = append(segments, sparseEntry{Offset: data, Length: hole - data})
+		offset = hole
+	}
+	if _, err := fh.Seek(0, io.SeekStart); err != nil {
+		return nil, errors.Wrap(err, "rewind file")
+	}
+
+	// Not sparse.
+	if size == 0 || (len(segments) == 1 && segments[0] == sparseEntry{0, size}) {
+		return nil, nil
+	}
+	// GNU tar requires the sparse map to end at the end of the file.
+	if len(segments) == 0 || segments[len(segments)-1].Offset+segments[len(segments)-1].Length < size {
+		segments = append(segments, sparseEntry{Offset: size, Length: 0})
+	}
+	return segments, nil
+}
+
+// formatPAXRecords formats the given set of PAX records (sorted by key) as
+// the contents of a PAX extended header.
+func formatPAXRecords(records map[string]string) string {
+	var keys []string
+	for key := range records {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var buf strings.Builder
+	for _, key := range keys {
+		// The length prefix includes itself, so we have to iterate until we
+		// get a stable length.
+		record := " " + key + "=" + records[key] + "\n"
+		size := len(record)
+		for size < len(strconv.Itoa(size))+len(record) {
+			size = len(strconv.Itoa(size)) + len(record)
+		}
+		buf.WriteString(strconv.Itoa(size) + record)
+	}
+	return buf.String()
+}
+
+// formatPAXTime formats a timestamp in the format expected for PAX records.
+func formatPAXTime(t time.Time) string {
+	secs, nsecs := t.Unix(), t.Nanosecond()
+	if nsecs == 0 || secs < 0 {
+		return strconv.FormatInt(secs, 10)
+	}
+	return strings.TrimRight(fmt.Sprintf("%d.%09d", secs, nsecs), "0")
+}
+
+// ustarHeader generates a single raw ustar header block. Any numeric field
+// which cannot be represented is zeroed (it is expected that they have been
+// included in a PAX extended header). The name is truncated if necessary.
+func ustarHeader(name string, typeflag byte, mode, uid, gid, size, mtime int64) []byte {
+	blk := make([]byte, 512)
+	formatOctal := func(field []byte, value int64) {
+		str := strconv.FormatInt(value, 8)
+		if value < 0 || len(str) > len(field)-1 {
+			str = "0"
+		}
+		copy(field, strings.Repeat("0", len(field)-1-len(str))+str)
+	}
+
+	copy(blk[0:100], name)
+	formatOctal(blk[100:108], mode)
+	formatOctal(blk[108:116], uid)
+	formatOctal(blk[116:124], gid)
+	formatOctal(blk[124:136], size)
+	formatOctal(blk[136:148], mtime)
+	blk[156] = typeflag
+	copy(blk[257:263], "ustar\x00")
+	copy(blk[263:265], "00")
+
+	// The checksum is computed with the checksum field set to spaces.
+	copy(blk[148:156], "        ")
+	var chksum int64
+	for _, b := range blk {
+		chksum += int64(b)
+	}
+	copy(blk[148:156], fmt.Sprintf("%06o\x00 ", chksum))
+	return blk
+}
+
+// writePadding writes enough NUL bytes to pad a tar entry of the given size
+// to a block boundary.
+func writePadding(w io.Writer, size int64) error {
+	if rem := size % 512; rem != 0 {
+		if _, err := w.Write(make([]byte, 512-rem)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeSparseFile writes a GNU PAX 1.0 sparse tar entry for the regular file
+// described by hdr (whose contents are in fh) to the given writer. The data
+// fragments of the file are given by segments. This has to be written
+// outside of the tar.Writer, so the caller must ensure that the tar.Writer
+// has been flushed.
+func writeSparseFile(w io.Writer, hdr *tar.Header, fh *os.File, segments []sparseEntry) error {
+	// Generate the sparse map, which is stored in the entry's data.
+	var spMap bytes.Buffer
+	fmt.Fprintf(&spMap, "%d\n", len(segments))
+	physicalSize := int64(0)
+	for _, segment := range segments {
+		fmt.Fprintf(&spMap, "%d\n%d\n", segment.Offset, segment.Length)
+		physicalSize += segment.Length
+	}
+	if rem := spMap.Len() % 512; rem != 0 {
+		spMap.Write(make([]byte, 512-rem))
+	}
+	physicalSize += int64(spMap.Len())
+
+	// The name of the entry itself is a dummy name, with the real name being
+	// stored in the PAX header (just like GNU tar).
+	dir, file := path.Split(hdr.Name)
+	fakeName := path.Join(dir, "GNUSparseFile.0", file)
+
+	// Because we are writing the PAX header ourselves, we need to include
+	// everything that tar.Writer would've included.
+	records := map[string]string{
+		"path":                "./" + fakeName,
+		"size":                strconv.FormatInt(physicalSize, 10),
+		"uid":                 strconv.Itoa(hdr.Uid),
+		"gid":                 strconv.Itoa(hdr.Gid),
+		"mtime":               strconv.FormatInt(hdr.ModTime.Unix(), 10),
+		"GNU.sparse.major":    "1",
+		"GNU.sparse.minor":    "0",
+		"GNU.sparse.name":     hdr.Name,
+		"GNU.sparse.realsize": strconv.FormatInt(hdr.Size, 10),
+	}
+	if hdr.Format == tar.FormatPAX {
+		records["mtime"] = formatPAXTime(hdr.ModTime)
+		if !hdr.AccessTime.IsZero() {
+			records["atime"] = formatPAXTime(hdr.AccessTime)
+		}
+		if !hdr.ChangeTime.IsZero() {
+			records["ctime"] = formatPAXTime(hdr.ChangeTime)
+		}
+	}
+	for key, value := range hdr.PAXRecords {
+		if _, ok := records[key]; !ok && !strings.HasPrefix(key, sparseGNUPrefix) {
+			records[key] = value
+		}
+	}
+	for key, value := range hdr.Xattrs {
+		records[paxSchilyXattr+key] = value
+	}
+	paxData := formatPAXRecords(records)
+
+	// Write the PAX header.
+	paxName := path.Join(dir, "PaxHeaders.0", file)
+	if len(paxName) > 100 {
+		paxName = paxName[:100]
+	}
+	if _, err := w.Write(ustarHeader(paxName, tar.TypeXHeader, 0, 0, 0, int64(len(paxData)), 0)); err != nil {
+		return errors.Wrap(err, "write pax header")
+	}
+	if _, err := io.WriteString(w, paxData); err != nil {
+		return errors.Wrap(err, "write pax header")
+	}
+	if err := writePadding(w, int64(len(paxData))); err != nil {
+		return errors.Wrap(err, "write pax header")
+	}
+
+	// Write the actual header (the PAX records take precedence over any of
+	// the fields which may have been truncated).
+	if len(fakeName) > 100 {
+		fakeName = fakeName[:100]
+	}
+	if _, err := w.Write(ustarHeader(fakeName, tar.TypeReg, hdr.Mode, int64(hdr.Uid), int64(hdr.Gid), physicalSize, hdr.ModTime.Unix())); err != nil {
+		return errors.Wrap(err, "write header")
+	}
+
+	// Write the sparse map followed by the data fragments.
+	if _, err := w.Write(spMap.Bytes()); err != nil {
+		return errors.Wrap(err, "write sparse map")
+	}
+	for _, segment := range segments {
+		n, err := system.Copy(w, io.NewSectionReader(fh, segment.Offset, segment.Length))
+		if err != nil {
+			return errors.Wrap(err, "copy sparse fragment to layer")
+		}
+		if n != segment.Length {
+			return errors.Wrap(io.ErrShortWrite, "copy sparse fragment to layer")
+		}
+	}
+	return errors.Wrap(writePadding(w, physicalSize), "write padding")
+}
+
+// sparseFileWriter is an io.Writer which skips over (rather than writing)
+// any blocks which are entirely zero, resulting in holes in the file. Once
+// all data has been written, the file must be truncated to the correct size
+// (in case it ends with a hole).
+type sparseFileWriter struct {
+	fh *os.File
+}
+
+var zeroBlock [sparseBlockSize]byte
+
+// Write implements io.Writer.
+func (sw *sparseFileWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if n > sparseBlockSize {
+			n = sparseBlockSize
+		}
+		chunk := p[:n]
+		if bytes.Equal(chunk, zeroBlock[:n]) {
+			if _, err := sw.fh.Seek(int64(n), io.SeekCurrent); err != nil {
+				return written, err
+			}
+		} else if _, err := sw.fh.Write(chunk); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
@@ -0,0 +1,149 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestTarSparseRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestTarSparseRoundTrip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	dst := filepath.Join(dir, "dst")
+	for _, path := range []string{src, dst} {
+		if err := os.Mkdir(path, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Create a 1GiB file which is almost entirely holes.
+	const (
+		size       = 1 << 30
+		dataOffset = 512 << 20
+	)
+	head := []byte("some data at the start of the file")
+	middle := bytes.Repeat([]byte("middle"), 2048)
+
+	fh, err := os.Create(filepath.Join(src, "sparse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fh.WriteAt(head, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fh.WriteAt(middle, dataOffset); err != nil {
+		t.Fatal(err)
+	}
+	if err := fh.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	segments, err := dataSegments(fh, size)
+	fh.Close()
+	if err != nil {
+		t.Fatalf("dataSegments: unexpected error: %+v", err)
+	}
+	if segments == nil {
+		t.Skip("skipping test: filesystem does not support hole detection")
+	}
+
+	// Generate a layer containing the file.
+	var buf bytes.Buffer
+	tg := newTarGenerator(&buf, MapOptions{})
+	if err := tg.AddFile("sparse", filepath.Join(src, "sparse")); err != nil {
+		t.Fatalf("AddFile: unexpected error: %+v", err)
+	}
+	if err := tg.tw.Close(); err != nil {
+		t.Fatalf("tw.Close: unexpected error: %+v", err)
+	}
+	if buf.Len() > 1<<20 {
+		t.Errorf("layer with sparse file is too large: %d bytes", buf.Len())
+	}
+
+	// Extract the layer again.
+	te := NewTarExtractor(UnpackOptions{})
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("read tar: %+v", err)
+		}
+		if hdr.Name != "sparse" || hdr.Size != size {
+			t.Errorf("unexpected sparse header: name=%q size=%d", hdr.Name, hdr.Size)
+		}
+		if !isSparseHeader(hdr) {
+			t.Errorf("expected %s to be a sparse entry", hdr.Name)
+		}
+		if err := te.UnpackEntry(dst, hdr, tr); err != nil {
+			t.Fatalf("UnpackEntry %s: unexpected error: %+v", hdr.Name, err)
+		}
+	}
+
+	// The size must be the same but the allocated space must be small.
+	var st unix.Stat_t
+	if err := unix.Stat(filepath.Join(dst, "sparse"), &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Size != size {
+		t.Errorf("unpacked sparse file has wrong size: expected %d, got %d", size, st.Size)
+	}
+	if allocated := st.Blocks * 512; allocated > 1<<20 {
+		t.Errorf("unpacked sparse file allocated too much space: %d bytes", allocated)
+	}
+
+	// Verify the contents.
+	fh, err = os.Open(filepath.Join(dst, "sparse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	for _, test := range []struct {
+		offset int64
+		data   []byte
+	}{
+		{0, head},
+		{int64(len(head)), make([]byte, 4096)},
+		{dataOffset - 4096, make([]byte, 4096)},
+		{dataOffset, middle},
+		{size - 4096, make([]byte, 4096)},
+	} {
+		got := make([]byte, len(test.data))
+		if _, err := fh.ReadAt(got, test.offset); err != nil {
+			t.Errorf("read at %d: unexpected error: %+v", test.offset, err)
+			continue
+		}
+		if !bytes.Equal(got, test.data) {
+			t.Errorf("unexpected data at offset %d", test.offset)
+		}
+	}
+}
@@ -0,0 +1,429 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/apex/log"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/cas"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/pkg/errors"
+)
+
+// squashEntry is an entry from one of the layers being squashed.
+type squashEntry struct {
+	// name is the cleaned (absolute) path of the entry.
+	name string
+	hdr  *tar.Header
+
+	// final is set if the entry is part of the final filesystem state, and
+	// so needs to be included in the squashed layer.
+	final bool
+
+	// source is the regular file entry which a hardlink refers to (or nil if
+	// the entry is not a hardlink to another entry in the layers).
+	source *squashEntry
+	// aliases is the set of (final) hardlinks which refer to this entry.
+	aliases []*squashEntry
+	// carrier is set on a hardlink which needs to be written as a regular
+	// file (with the contents of its source entry) because the source entry
+	// is not part of the final filesystem state.
+	carrier bool
+	// linkname is the name that a (final) hardlink should point to in the
+	// squashed layer.
+	linkname string
+}
+
+// squashNode is a node in the tree of paths built while squashing layers.
+type squashNode struct {
+	// entry is the entry for this path, or nil if the path was only ever
+	// implicitly created as the parent of another entry.
+	entry    *squashEntry
+	children map[string]*squashNode
+	// touched is the index of the last layer (plus one) to contain this
+	// path or one of its descendants, which is used to make sure whiteouts
+	// don't remove entries from the same layer.
+	touched int
+}
+
+func (n *squashNode) isDir() bool {
+	return n.entry == nil || n.entry.hdr.Typeflag == tar.TypeDir
+}
+
+// squashTree is the in-memory representation of the combined filesystem state
+// of the layers being squashed. Only headers are kept in memory, the contents
+// of files are read from the layers again when generating the squashed layer.
+type squashTree struct {
+	root squashNode
+}
+
+func splitSquashPath(name string) []string {
+	if name == "/" {
+		return nil
+	}
+	return strings.Split(strings.TrimPrefix(name, "/"), "/")
+}
+
+// lookup returns the node for the given path, or nil if it doesn't exist.
+func (t *squashTree) lookup(name string) *squashNode {
+	node := &t.root
+	for _, part := range splitSquashPath(name) {
+		node = node.children[part]
+		if node == nil {
+			return nil
+		}
+	}
+	return node
+}
+
+// add adds a new entry from the given layer (1-indexed) to the tree,
+// replacing any existing entry in the same way that the extractor clobbers
+// existing paths.
+func (t *squashTree) add(layer int, entry *squashEntry) {
+	node := &t.root
+	node.touched = layer
+	for _, part := range splitSquashPath(entry.name) {
+		if node.children == nil {
+			node.children = map[string]*squashNode{}
+		}
+		child := node.children[part]
+		if child == nil {
+			child = &squashNode{}
+			node.children[part] = child
+		}
+		node = child
+		node.touched = layer
+	}
+	// Existing paths are clobbered unless both are directories.
+	if !node.isDir() || entry.hdr.Typeflag != tar.TypeDir {
+		node.children = nil
+	}
+	node.entry = entry
+}
+
+// whiteout removes the given path from the tree, as well as any descendants
+// which were not added in the given layer (1-indexed). If opaque is set, only
+// the descendants are removed.
+func (t *squashTree) whiteout(layer int, name string, opaque bool) {
+	node := &t.root
+	var parent *squashNode
+	parts := splitSquashPath(name)
+	for _, part := range parts {
+		parent = node
+		node = node.children[part]
+		if node == nil {
+			return
+		}
+	}
+	if !opaque && node.touched != layer {
+		if parent == nil {
+			// Removing the root is not possible, so just remove everything
+			// underneath it.
+			node.children = nil
+			return
+		}
+		delete(parent.children, parts[len(parts)-1])
+		return
+	}
+	node.whiteoutChildren(layer)
+}
+
+func (n *squashNode) whiteoutChildren(layer int) {
+	for name, child := range n.children {
+		if child.touched != layer {
+			delete(n.children, name)
+			continue
+		}
+		child.whiteoutChildren(layer)
+	}
+}
+
+// markFinal marks all of the entries in the tree as being part of the final
+// filesystem state.
+func (n *squashNode) markFinal() {
+	if n.entry != nil {
+		n.entry.final = true
+	}
+	for _, child := range n.children {
+		child.markFinal()
+	}
+}
+
+func squashPath(name string) string {
+	return path.Join("/", CleanPath(name))
+}
+
+// openLayer returns the uncompressed tar stream of the given layer blob.
+func openLayer(ctx context.Context, engineExt casext.Engine, layerDescriptor ispec.Descriptor) (io.ReadCloser, error) {
+	layerBlob, err := getLayerBlob(ctx, engineExt, layerDescriptor, false)
+	if err != nil {
+		return nil, err
+	}
+	layerRaw, err := decompressLayer(layerDescriptor.MediaType, layerBlob)
+	if err != nil {
+		layerBlob.Close()
+		return nil, errors.Wrap(err, "decompress layer")
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{
+		Reader: layerRaw,
+		Closer: closerFunc(func() error {
+			// #nosec G104
+			_ = layerRaw.Close()
+			return layerBlob.Close()
+		}),
+	}, nil
+}
+
+// apply applies the given tar entry from the given (1-indexed) layer to the
+// tree, returning the new entry (or nil if the entry was a whiteout).
+func (t *squashTree) apply(layer int, hdr *tar.Header) *squashEntry {
+	name := squashPath(hdr.Name)
+	dir, file := path.Split(name)
+
+	// Whiteouts are applied with the same semantics as the extractor.
+	if strings.HasPrefix(file, whPrefix) {
+		if file == whOpaque {
+			t.whiteout(layer, path.Clean(dir), true)
+		} else {
+			t.whiteout(layer, path.Join(dir, strings.TrimPrefix(file, whPrefix)), false)
+		}
+		return nil
+	}
+
+	entry := &squashEntry{name: name, hdr: hdr}
+	if hdr.Typeflag == tar.TypeLink {
+		if target := t.lookup(squashPath(hdr.Linkname)); target != nil && target.entry != nil {
+			entry.source = target.entry
+			if entry.source.source != nil {
+				entry.source = entry.source.source
+			}
+		}
+	}
+	t.add(layer, entry)
+	return entry
+}
+
+type closerFunc func() error
+
+func (fn closerFunc) Close() error { return fn() }
+
+// forEachSquashEntry calls fn for each entry in each of the given layers.
+func forEachSquashEntry(ctx context.Context, engineExt casext.Engine, layers []ispec.Descriptor, fn func(layer, idx int, hdr *tar.Header, r io.Reader) error) error {
+	for layer, layerDescriptor := range layers {
+		if err := func() error {
+			layerRaw, err := openLayer(ctx, engineExt, layerDescriptor)
+			if err != nil {
+				return err
+			}
+			defer layerRaw.Close()
+
+			tr := tar.NewReader(layerRaw)
+			for idx := 0; ; idx++ {
+				hdr, err := tr.Next()
+				if err == io.EOF {
+					return nil
+				}
+				if err != nil {
+					return errors.Wrap(err, "read next entry")
+				}
+				if err := fn(layer, idx, hdr, tr); err != nil {
+					return errors.Wrapf(err, "squash entry %s", hdr.Name)
+				}
+			}
+		}(); err != nil {
+			return errors.Wrapf(err, "layer %s", layerDescriptor.Digest)
+		}
+	}
+	return nil
+}
+
+// SquashLayers generates a single (uncompressed) layer which is equivalent to
+// extracting all of the given layers in order. Whiteouts are applied and are
+// not included in the squashed layer, and hardlinks to files which were
+// replaced in higher layers are converted into regular files. Note that
+// symlinks are not resolved when applying whiteouts, so layers which
+// (ab)use symlinked parent directories may be squashed incorrectly.
+//
+// All of the layers are read twice (once to compute the final filesystem
+// state, and once to generate the new layer), but only the tar headers are
+// kept in memory.
+func SquashLayers(ctx context.Context, engine cas.Engine, layers []ispec.Descriptor) (io.ReadCloser, error) {
+	engineExt := casext.NewEngine(engine)
+
+	// Compute the final filesystem state.
+	var tree squashTree
+	entries := make([][]*squashEntry, len(layers))
+	if err := forEachSquashEntry(ctx, engineExt, layers, func(layer, idx int, hdr *tar.Header, _ io.Reader) error {
+		entries[layer] = append(entries[layer], tree.apply(layer+1, hdr))
+		return nil
+	}); err != nil {
+		return nil, errors.Wrap(err, "compute squashed filesystem")
+	}
+	tree.root.markFinal()
+
+	// Figure out what final hardlinks need to point to.
+	for _, layerEntries := range entries {
+		for _, entry := range layerEntries {
+			if entry == nil || !entry.final || entry.source == nil {
+				continue
+			}
+			source := entry.source
+			if source.final {
+				entry.linkname = source.name
+				continue
+			}
+			if len(source.aliases) == 0 {
+				entry.carrier = true
+			} else {
+				entry.linkname = source.aliases[0].name
+			}
+			source.aliases = append(source.aliases, entry)
+		}
+	}
+
+	reader, writer := io.Pipe()
+	go func() (Err error) {
+		defer func() {
+			if Err != nil {
+				log.Warnf("could not generate squashed layer: %v", Err)
+			}
+			// #nosec G104
+			_ = writer.CloseWithError(errors.Wrap(Err, "generate squashed layer"))
+		}()
+
+		tw := tar.NewWriter(writer)
+		if err := forEachSquashEntry(ctx, engineExt, layers, func(layer, idx int, _ *tar.Header, r io.Reader) error {
+			entry := entries[layer][idx]
+			if entry == nil {
+				return nil
+			}
+
+			// Figure out what names this entry needs to be written as.
+			var names []string
+			if entry.final && !entry.carrier {
+				names = append(names, entry.name)
+			}
+			if len(entry.aliases) > 0 && entry.aliases[0].carrier {
+				names = append(names, entry.aliases[0].name)
+			}
+			for _, name := range names {
+				hdr := squashHeader(entry.hdr, name)
+				if entry.linkname != "" {
+					hdr.Linkname = strings.TrimPrefix(entry.linkname, "/")
+				}
+				if err := tw.WriteHeader(hdr); err != nil {
+					return errors.Wrap(err, "write header")
+				}
+				if hdr.Typeflag == tar.TypeReg && hdr.Size > 0 {
+					if _, err := io.Copy(tw, r); err != nil {
+						return errors.Wrap(err, "write content")
+					}
+				}
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		return tw.Close()
+	}()
+	return reader, nil
+}
+
+// squashHeader returns a copy of the given header, suitable for writing to the
+// squashed layer with the given name.
+func squashHeader(hdr *tar.Header, name string) *tar.Header {
+	newHdr := *hdr
+	newHdr.Name = strings.TrimPrefix(name, "/")
+	if newHdr.Name == "" {
+		newHdr.Name = "."
+	}
+	if newHdr.Typeflag == tar.TypeDir {
+		newHdr.Name += "/"
+	}
+	if newHdr.Typeflag == tar.TypeRegA {
+		newHdr.Typeflag = tar.TypeReg
+	}
+	// Sparse files are expanded by tar.Reader, so we write them out as
+	// regular files.
+	if isSparseHeader(hdr) {
+		newHdr.Typeflag = tar.TypeReg
+		newHdr.PAXRecords = map[string]string{}
+		for key, value := range hdr.PAXRecords {
+			if !strings.HasPrefix(key, "GNU.sparse.") {
+				newHdr.PAXRecords[key] = value
+			}
+		}
+	}
+	// The new name might not fit in a USTAR header, so let the tar.Writer pick
+	// a format which can represent the header.
+	if newHdr.Format == tar.FormatUSTAR {
+		newHdr.Format = tar.FormatUnknown
+	}
+	return &newHdr
+}
+
+// DanglingWhiteout is a (non-opaque) whiteout in a layer which refers to a
+// path that does not exist in any of the layers below it.
+type DanglingWhiteout struct {
+	// Layer is the index of the layer containing the whiteout.
+	Layer int
+	// Path is the path being removed by the whiteout.
+	Path string
+}
+
+// FindDanglingWhiteouts returns the set of whiteouts in the given layers which
+// refer to paths that do not exist when the layers are extracted in order.
+// Such whiteouts are ignored during extraction, but usually indicate that the
+// layers were not generated on top of each other (or that a layer has been
+// removed from the image).
+func FindDanglingWhiteouts(ctx context.Context, engine cas.Engine, layers []ispec.Descriptor) ([]DanglingWhiteout, error) {
+	engineExt := casext.NewEngine(engine)
+
+	var tree squashTree
+	var dangling []DanglingWhiteout
+	if err := forEachSquashEntry(ctx, engineExt, layers, func(layer, _ int, hdr *tar.Header, _ io.Reader) error {
+		name := squashPath(hdr.Name)
+		dir, file := path.Split(name)
+		if !strings.HasPrefix(file, whPrefix) {
+			tree.add(layer+1, &squashEntry{name: name, hdr: hdr})
+			return nil
+		}
+		if file == whOpaque {
+			tree.whiteout(layer+1, path.Clean(dir), true)
+			return nil
+		}
+		target := path.Join(dir, strings.TrimPrefix(file, whPrefix))
+		if tree.lookup(target) == nil {
+			dangling = append(dangling, DanglingWhiteout{Layer: layer, Path: target})
+		}
+		tree.whiteout(layer+1, target, false)
+		return nil
+	}); err != nil {
+		return nil, errors.Wrap(err, "find dangling whiteouts")
+	}
+	return dangling, nil
+}
@@ -0,0 +1,312 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+
+	gzip "github.com/klauspost/pgzip"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/opencontainers/umoci/oci/cas/dir"
+	"github.com/opencontainers/umoci/oci/casext"
+)
+
+type squashTestEntry struct {
+	hdr     tar.Header
+	content string
+}
+
+func putSquashTestLayer(t testing.TB, engineExt casext.Engine, entries []squashTestEntry, compress bool) ispec.Descriptor {
+	var buffer bytes.Buffer
+	tw := tar.NewWriter(&buffer)
+	for _, entry := range entries {
+		hdr := entry.hdr
+		hdr.Size = int64(len(entry.content))
+		if hdr.Mode == 0 {
+			hdr.Mode = 0644
+			if hdr.Typeflag == tar.TypeDir {
+				hdr.Mode = 0755
+			}
+		}
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(entry.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	mediaType := ispec.MediaTypeImageLayer
+	blob := &buffer
+	if compress {
+		var compressed bytes.Buffer
+		gzw := gzip.NewWriter(&compressed)
+		if _, err := gzw.Write(buffer.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+		if err := gzw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		mediaType = ispec.MediaTypeImageLayerGzip
+		blob = &compressed
+	}
+
+	layerDigest, layerSize, err := engineExt.PutBlob(context.Background(), blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    layerDigest,
+		Size:      layerSize,
+	}
+}
+
+// describeTree returns a description of every path in the given root, with
+// hardlinks identified by the first path (in lexical order) of their inode.
+func describeTree(t *testing.T, root string) []string {
+	var paths []string
+	if err := filepath.Walk(root, func(path string, _ os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		paths = append(paths, path)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(paths)
+
+	inodes := map[uint64]string{}
+	var tree []string
+	for _, path := range paths {
+		rel, _ := filepath.Rel(root, path)
+		fi, err := os.Lstat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		desc := rel + " " + fi.Mode().String()
+		switch {
+		case fi.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			desc += " -> " + target
+		case fi.Mode().IsRegular():
+			content, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			desc += " " + string(content)
+			ino := fi.Sys().(*syscall.Stat_t).Ino
+			if first, ok := inodes[ino]; ok {
+				desc += " (link " + first + ")"
+			} else {
+				inodes[ino] = rel
+			}
+		}
+		tree = append(tree, desc)
+	}
+	return tree
+}
+
+func TestSquashLayers(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestSquashLayers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatal(err)
+	}
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	layers := []ispec.Descriptor{
+		putSquashTestLayer(t, engineExt, []squashTestEntry{
+			{hdr: tar.Header{Name: "etc/", Typeflag: tar.TypeDir}},
+			{hdr: tar.Header{Name: "etc/passwd", Typeflag: tar.TypeReg}, content: "root:x:0:0"},
+			{hdr: tar.Header{Name: "etc/group", Typeflag: tar.TypeReg}, content: "root:x:0"},
+			{hdr: tar.Header{Name: "etc/hosts", Typeflag: tar.TypeReg}, content: "localhost"},
+			{hdr: tar.Header{Name: "etc/hosts.link", Typeflag: tar.TypeLink, Linkname: "etc/hosts"}},
+			{hdr: tar.Header{Name: "opaque/", Typeflag: tar.TypeDir}},
+			{hdr: tar.Header{Name: "opaque/a", Typeflag: tar.TypeReg}, content: "a"},
+			{hdr: tar.Header{Name: "opaque/dir/", Typeflag: tar.TypeDir}},
+			{hdr: tar.Header{Name: "opaque/dir/b", Typeflag: tar.TypeReg}, content: "b"},
+			{hdr: tar.Header{Name: "replaced/", Typeflag: tar.TypeDir}},
+			{hdr: tar.Header{Name: "replaced/child", Typeflag: tar.TypeReg}, content: "child"},
+			{hdr: tar.Header{Name: "usr/", Typeflag: tar.TypeDir}},
+			{hdr: tar.Header{Name: "usr/bin/", Typeflag: tar.TypeDir}},
+			{hdr: tar.Header{Name: "usr/bin/sh", Typeflag: tar.TypeReg, Mode: 0755}, content: "#!"},
+			{hdr: tar.Header{Name: "bin", Typeflag: tar.TypeSymlink, Linkname: "usr/bin"}},
+		}, true),
+		putSquashTestLayer(t, engineExt, []squashTestEntry{
+			{hdr: tar.Header{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0700}},
+			{hdr: tar.Header{Name: "etc/.wh.group", Typeflag: tar.TypeReg}},
+			{hdr: tar.Header{Name: "etc/hosts", Typeflag: tar.TypeReg}, content: "new localhost"},
+			{hdr: tar.Header{Name: "etc/hosts.link2", Typeflag: tar.TypeLink, Linkname: "etc/hosts.link"}},
+			{hdr: tar.Header{Name: "opaque/", Typeflag: tar.TypeDir}},
+			{hdr: tar.Header{Name: "opaque/c", Typeflag: tar.TypeReg}, content: "c"},
+			{hdr: tar.Header{Name: "opaque/.wh..wh..opq", Typeflag: tar.TypeReg}},
+			{hdr: tar.Header{Name: "replaced", Typeflag: tar.TypeReg}, content: "now a file"},
+		}, false),
+		putSquashTestLayer(t, engineExt, []squashTestEntry{
+			{hdr: tar.Header{Name: "etc/.wh.hosts.link", Typeflag: tar.TypeReg}},
+			{hdr: tar.Header{Name: "etc/group", Typeflag: tar.TypeReg}, content: "wheel:x:10"},
+			{hdr: tar.Header{Name: "etc/passwd.link", Typeflag: tar.TypeLink, Linkname: "etc/passwd"}},
+			{hdr: tar.Header{Name: ".wh.usr", Typeflag: tar.TypeReg}},
+			{hdr: tar.Header{Name: "usr/", Typeflag: tar.TypeDir}},
+			{hdr: tar.Header{Name: "usr/bin/", Typeflag: tar.TypeDir}},
+			{hdr: tar.Header{Name: "usr/bin/bash", Typeflag: tar.TypeReg, Mode: 0755}, content: "#!bash"},
+		}, true),
+	}
+
+	unpackOptions := &UnpackOptions{
+		MapOptions: MapOptions{
+			UIDMappings: []rspec.LinuxIDMapping{{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1}},
+			GIDMappings: []rspec.LinuxIDMapping{{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1}},
+			Rootless:    os.Geteuid() != 0,
+		},
+	}
+
+	// Extract the layers the normal way.
+	expectedRoot := filepath.Join(root, "expected")
+	if err := os.Mkdir(expectedRoot, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, layer := range layers {
+		if err := UnpackLayerDescriptor(ctx, engineExt, expectedRoot, layer, unpackOptions); err != nil {
+			t.Fatalf("unexpected error in UnpackLayerDescriptor: %+v", err)
+		}
+	}
+
+	// Generate and extract the squashed layer.
+	squashed, err := SquashLayers(ctx, engineExt, layers)
+	if err != nil {
+		t.Fatalf("unexpected error in SquashLayers: %+v", err)
+	}
+	squashedData, err := ioutil.ReadAll(squashed)
+	if err != nil {
+		t.Fatalf("unexpected error reading squashed layer: %+v", err)
+	}
+	squashed.Close()
+
+	tr := tar.NewReader(bytes.NewReader(squashedData))
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		if strings.HasPrefix(filepath.Base(hdr.Name), whPrefix) {
+			t.Errorf("squashed layer contains whiteout: %s", hdr.Name)
+		}
+	}
+
+	squashedRoot := filepath.Join(root, "squashed")
+	if err := os.Mkdir(squashedRoot, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := UnpackLayer(squashedRoot, bytes.NewReader(squashedData), unpackOptions); err != nil {
+		t.Fatalf("unexpected error unpacking squashed layer: %+v", err)
+	}
+
+	expected := describeTree(t, expectedRoot)
+	got := describeTree(t, squashedRoot)
+	if strings.Join(expected, "\n") != strings.Join(got, "\n") {
+		t.Errorf("squashed layer does not match layers:\nexpected:\n\t%s\ngot:\n\t%s", strings.Join(expected, "\n\t"), strings.Join(got, "\n\t"))
+	}
+}
+
+func TestFindDanglingWhiteouts(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestFindDanglingWhiteouts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatal(err)
+	}
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	layers := []ispec.Descriptor{
+		putSquashTestLayer(t, engineExt, []squashTestEntry{
+			{hdr: tar.Header{Name: "a", Typeflag: tar.TypeReg}},
+			{hdr: tar.Header{Name: "dir/b", Typeflag: tar.TypeReg}},
+		}, false),
+		putSquashTestLayer(t, engineExt, []squashTestEntry{
+			{hdr: tar.Header{Name: ".wh.a", Typeflag: tar.TypeReg}},
+			{hdr: tar.Header{Name: ".wh.missing", Typeflag: tar.TypeReg}},
+			{hdr: tar.Header{Name: "new/.wh..wh..opq", Typeflag: tar.TypeReg}},
+			{hdr: tar.Header{Name: "dir/.wh.b", Typeflag: tar.TypeReg}},
+		}, true),
+		putSquashTestLayer(t, engineExt, []squashTestEntry{
+			{hdr: tar.Header{Name: ".wh.a", Typeflag: tar.TypeReg}},
+			{hdr: tar.Header{Name: "dir/.wh.b", Typeflag: tar.TypeReg}},
+		}, false),
+	}
+
+	dangling, err := FindDanglingWhiteouts(ctx, engineExt, layers)
+	if err != nil {
+		t.Fatalf("unexpected error in FindDanglingWhiteouts: %+v", err)
+	}
+	expected := []DanglingWhiteout{
+		{Layer: 1, Path: "/missing"},
+		{Layer: 2, Path: "/a"},
+		{Layer: 2, Path: "/dir/b"},
+	}
+	if len(dangling) != len(expected) {
+		t.Fatalf("expected dangling whiteouts %v, got %v", expected, dangling)
+	}
+	for idx := range expected {
+		if dangling[idx] != expected[idx] {
+			t.Errorf("expected dangling whiteouts %v, got %v", expected, dangling)
+			break
+		}
+	}
+}
@@ -25,6 +25,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/apex/log"
@@ -36,10 +37,22 @@ import (
 	"golang.org/x/sys/unix"
 )
 
-// inUserNamespace is a cached return value of shared.RunningInUserNS(). We
-// compute this once globally rather than for each unpack. It won't change (we
-// would hope) after we check it the first time.
-var inUserNamespace = shared.RunningInUserNS()
+var (
+	inUserNamespaceOnce   sync.Once
+	inUserNamespaceResult bool
+)
+
+// inUserNamespace returns a cached return value of shared.RunningInUserNS().
+// We compute this once globally rather than for each unpack. It won't change
+// (we would hope) after we check it the first time -- but we can't check it
+// during package initialisation, because the ID mappings of a user namespace
+// may still be in the process of being configured (see pkg/userns).
+func inUserNamespace() bool {
+	inUserNamespaceOnce.Do(func() {
+		inUserNamespaceResult = shared.RunningInUserNS()
+	})
+	return inUserNamespaceResult
+}
 
 // TarExtractor represents a tar file to be extracted.
 type TarExtractor struct {
@@ -78,6 +91,28 @@ type TarExtractor struct {
 
 	// whiteoutMode indicates how this TarExtractor will handle whiteouts.
 	whiteoutMode WhiteoutMode
+
+	// rootlessDeviceMode indicates how this TarExtractor will handle devices
+	// when partialRootless is set.
+	rootlessDeviceMode RootlessDeviceMode
+
+	// shadowXattrs is the corresponding flag from the UnpackOptions supplied
+	// when this TarExtractor was constructed.
+	shadowXattrs bool
+
+	// noPreserveAtime is the corresponding flag from the UnpackOptions
+	// supplied when this TarExtractor was constructed.
+	noPreserveAtime bool
+
+	// onPathChange is the corresponding callback from the UnpackOptions
+	// supplied when this TarExtractor was constructed.
+	onPathChange PathChangeFunc
+
+	// lowerRoots are the directories the lower layers have been extracted to
+	// (top-most first), when each layer is extracted to a separate directory
+	// (see UnpackManifestOverlay). Hardlinks to paths which don't exist in the
+	// root being extracted to are resolved by looking through lowerRoots.
+	lowerRoots []string
 }
 
 // NewTarExtractor creates a new TarExtractor.
@@ -88,13 +123,17 @@ func NewTarExtractor(opt UnpackOptions) *TarExtractor {
 	}
 
 	return &TarExtractor{
-		mapOptions:      opt.MapOptions,
-		partialRootless: opt.MapOptions.Rootless || inUserNamespace,
-		fsEval:          fsEval,
-		upperPaths:      make(map[string]struct{}),
-		enotsupWarned:   false,
-		keepDirlinks:    opt.KeepDirlinks,
-		whiteoutMode:    opt.WhiteoutMode,
+		mapOptions:         opt.MapOptions,
+		partialRootless:    opt.MapOptions.Rootless || inUserNamespace(),
+		fsEval:             fsEval,
+		upperPaths:         make(map[string]struct{}),
+		enotsupWarned:      false,
+		keepDirlinks:       opt.KeepDirlinks,
+		whiteoutMode:       opt.WhiteoutMode,
+		rootlessDeviceMode: opt.RootlessDeviceMode,
+		shadowXattrs:       opt.ShadowXattrs,
+		noPreserveAtime:    opt.NoPreserveAtime,
+		onPathChange:       opt.OnPathChange,
 	}
 }
 
@@ -143,6 +182,10 @@ func (te *TarExtractor) restoreMetadata(path string, hdr *tar.Header) error {
 		// Default to the mtime.
 		atime = mtime
 	}
+	if te.noPreserveAtime {
+		// Leave the atime as-is (UTIME_OMIT).
+		atime = time.Time{}
+	}
 
 	// Apply xattrs. In order to make sure that we *only* have the xattr set we
 	// want, we first clear the set of xattrs from the file then apply the ones
@@ -184,28 +227,31 @@ func (te *TarExtractor) restoreMetadata(path string, hdr *tar.Header) error {
 			continue
 		}
 		if err := te.fsEval.Lsetxattr(path, name, value, 0); err != nil {
-			// In rootless mode, some xattrs will fail (security.capability).
-			// This is _fine_ as long as we're not running as root (in which
-			// case we shouldn't be ignoring xattrs that we were told to set).
-			//
-			// TODO: We should translate all security.capability capabilities
-			//       into v3 capabilities, which allow us to write them as
-			//       unprivileged users (we also would need to translate them
-			//       back when creating archives).
-			if te.partialRootless && os.IsPermission(errors.Cause(err)) {
-				log.Warnf("rootless{%s} ignoring (usually) harmless EPERM on setxattr %q", hdr.Name, name)
+			// Whether we can ignore the failure depends on the xattr (and
+			// whether we're rootless). See xattrFailurePolicy for details.
+			switch failure, reason := xattrFailurePolicy(name, err, te.partialRootless); failure {
+			case xattrShadow:
+				// If requested, store the xattr in a user.* shadow xattr so
+				// that it isn't lost when repacking.
+				if shadowName, ok := shadowXattrName(name); ok && te.shadowXattrs {
+					shadowErr := te.fsEval.Lsetxattr(path, shadowName, value, 0)
+					if shadowErr == nil {
+						log.Debugf("rootless{%s} storing xattr %q as shadow xattr %q", hdr.Name, name, shadowName)
+						continue
+					}
+					log.Warnf("rootless{%s} could not set shadow xattr %q: %v", hdr.Name, shadowName, shadowErr)
+				}
+				fallthrough
+			case xattrSkip:
+				log.Warnf("xattr{%s} %s on setxattr %q", hdr.Name, reason, name)
 				continue
-			}
-			// We cannot do much if we get an ENOTSUP -- this usually means
-			// that extended attributes are simply unsupported by the
-			// underlying filesystem (such as AUFS or NFS).
-			if errors.Cause(err) == unix.ENOTSUP {
+			case xattrUnsupported:
 				if !te.enotsupWarned {
-					log.Warnf("xattr{%s} ignoring ENOTSUP on setxattr %q", hdr.Name, name)
+					log.Warnf("xattr{%s} %s on setxattr %q", hdr.Name, reason, name)
 					log.Warnf("xattr{%s} destination filesystem does not support xattrs, further warnings will be suppressed", path)
 					te.enotsupWarned = true
 				} else {
-					log.Debugf("xattr{%s} ignoring ENOTSUP on clearxattrs", path)
+					log.Debugf("xattr{%s} %s on setxattr %q", hdr.Name, reason, name)
 				}
 				continue
 			}
@@ -213,6 +259,9 @@ func (te *TarExtractor) restoreMetadata(path string, hdr *tar.Header) error {
 		}
 	}
 
+	// Timestamps are restored with nanosecond precision. Filesystems with a
+	// coarser timestamp granularity silently truncate them, which is fine
+	// because the mtree manifest is generated from the on-disk state.
 	if err := te.fsEval.Lutimes(path, atime, mtime); err != nil {
 		return errors.Wrapf(err, "restore lutimes metadata: %s", path)
 	}
@@ -279,6 +328,21 @@ func (te *TarExtractor) isDirlink(root string, path string) (bool, error) {
 	return targetInfo.IsDir(), nil
 }
 
+// pathChanged calls the onPathChange callback (if any) for the given path
+// inside root.
+func (te *TarExtractor) pathChanged(root, path string, change PathChange) {
+	if te.onPathChange == nil {
+		return
+	}
+	relPath, err := filepath.Rel(root, path)
+	if err != nil {
+		// Really shouldn't happen because of the guarantees of SecureJoinVFS.
+		log.Warnf("could not find relative path of %s in %s: %v", path, root, err)
+		return
+	}
+	te.onPathChange(filepath.Join("/", relPath), change)
+}
+
 func (te *TarExtractor) ociWhiteout(root string, dir string, file string) error {
 	isOpaque := file == whOpaque
 	file = strings.TrimPrefix(file, whPrefix)
@@ -352,8 +416,11 @@ func (te *TarExtractor) ociWhiteout(root string, dir string, file string) error
 			// directory) since we just purged it -- and we don't want to
 			// hit ENOENT during iteration for no good reason.
 			err := errors.Wrap(te.fsEval.RemoveAll(subpath), "whiteout subpath")
-			if err == nil && info.IsDir() {
-				err = filepath.SkipDir
+			if err == nil {
+				te.pathChanged(root, subpath, PathDeleted)
+				if info.IsDir() {
+					err = filepath.SkipDir
+				}
 			}
 			return err
 		}
@@ -365,6 +432,14 @@ func (te *TarExtractor) ociWhiteout(root string, dir string, file string) error
 func (te *TarExtractor) overlayFSWhiteout(dir string, file string) error {
 	isOpaque := file == whOpaque
 
+	// Whiteouts are handled before the parent directory is created, but
+	// (unlike OCI whiteouts) overlayfs whiteouts need to exist on-disk even
+	// if the whited-out path doesn't exist in the root we're extracting to
+	// (such as when extracting each layer to a separate directory).
+	if err := te.fsEval.MkdirAll(dir, 0777); err != nil {
+		return errors.Wrap(err, "mkdir whiteout parent")
+	}
+
 	// if this is an opaque whiteout, whiteout the directory
 	if isOpaque {
 		err := te.fsEval.Lsetxattr(dir, "trusted.overlay.opaque", []byte("y"), 0)
@@ -381,6 +456,54 @@ func (te *TarExtractor) overlayFSWhiteout(dir string, file string) error {
 	return errors.Wrapf(err, "couldn't create overlayfs whiteout for %s", p)
 }
 
+// checkInRoot returns an error if path (which must have already been scoped
+// to root using SecureJoinVFS) is not lexically inside root. This should never
+// fail, and is only here as an additional safeguard against path traversal.
+func checkInRoot(root, path string) error {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return errors.Wrapf(err, "find relative-to-root path of %s", path)
+	}
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(os.PathSeparator)) {
+		return errors.Errorf("malicious tar entry -- path %s escapes root %s", path, root)
+	}
+	return nil
+}
+
+// unpackRootlessDevice creates a placeholder file in place of the given
+// device (or FIFO) when extracting in rootless mode, according to the
+// configured RootlessDeviceMode. It returns whether the placeholder was
+// created (devices are not created at all with RootlessDeviceSkip).
+func (te *TarExtractor) unpackRootlessDevice(path string, hdr *tar.Header) (bool, error) {
+	switch te.rootlessDeviceMode {
+	case RootlessDeviceSkip:
+		log.Warnf("rootless{%s} skipping device %d:%d", hdr.Name, hdr.Devmajor, hdr.Devminor)
+		return false, nil
+	case RootlessDeviceError:
+		return false, errors.Errorf("cannot create device %d:%d as an unprivileged user", hdr.Devmajor, hdr.Devminor)
+	}
+
+	log.Warnf("rootless{%s} creating empty file in place of device %d:%d", hdr.Name, hdr.Devmajor, hdr.Devminor)
+	value, err := formatRootlessDevice(hdr)
+	if err != nil {
+		return false, errors.Wrap(err, "create rootless device placeholder")
+	}
+	if hdr.Xattrs == nil {
+		hdr.Xattrs = make(map[string]string)
+	}
+	hdr.Xattrs[rootlessDeviceXattr] = value
+
+	fh, err := te.fsEval.Create(path)
+	if err != nil {
+		return false, errors.Wrap(err, "create rootless block")
+	}
+	defer fh.Close()
+	if err := fh.Chmod(0); err != nil {
+		return false, errors.Wrap(err, "chmod 0 rootless block")
+	}
+	return true, nil
+}
+
 // UnpackEntry extracts the given tar.Header to the provided root, ensuring
 // that the layer state is consistent with the layer state that produced the
 // tar archive being iterated over. This does handle whiteouts, so a tar.Header
@@ -415,6 +538,9 @@ func (te *TarExtractor) UnpackEntry(root string, hdr *tar.Header, r io.Reader) (
 		return errors.Wrap(err, "sanitise symlinks in root")
 	}
 	path := filepath.Join(dir, file)
+	if err := checkInRoot(root, path); err != nil {
+		return errors.Wrap(err, "sanitise path in root")
+	}
 
 	// Before we do anything, get the state of dir. Because we might be adding
 	// or removing files, our parent directory might be modified in the
@@ -483,7 +609,16 @@ func (te *TarExtractor) UnpackEntry(root string, hdr *tar.Header, r io.Reader) (
 	// ('\x00') but it could be possible that someone produces a different
 	// Typeflag, expecting that the path is the only thing that matters in a
 	// whiteout entry.
-	if strings.HasPrefix(file, whPrefix) {
+	if strings.HasPrefix(file, whPrefix) && te.whiteoutMode != LiteralWhiteout {
+		// A whiteout of "." or ".." would remove the parent directory (or
+		// the parent of the root), so make sure the whiteout refers to an
+		// actual entry inside dir.
+		if file != whOpaque {
+			switch strings.TrimPrefix(file, whPrefix) {
+			case "", ".", "..":
+				return errors.Errorf("malicious tar entry -- refusing to apply invalid whiteout %q", hdr.Name)
+			}
+		}
 		switch te.whiteoutMode {
 		case OCIStandardWhiteout:
 			return te.ociWhiteout(root, dir, file)
@@ -497,10 +632,12 @@ func (te *TarExtractor) UnpackEntry(root string, hdr *tar.Header, r io.Reader) (
 	// Get information about the path. This has to be done after we've dealt
 	// with whiteouts because it turns out that lstat(2) will return EPERM if
 	// you try to stat a whiteout on AUFS.
+	change := PathModified
 	fi, err := te.fsEval.Lstat(path)
 	if err != nil {
 		// File doesn't exist, just switch fi to the file header.
 		fi = hdr.FileInfo()
+		change = PathCreated
 	}
 
 	// Attempt to create the parent directory of the path we're unpacking.
@@ -510,9 +647,21 @@ func (te *TarExtractor) UnpackEntry(root string, hdr *tar.Header, r io.Reader) (
 	// FIXME: We have to make this consistent, since if the tar archive doesn't
 	//        have entries for some of these components we won't be able to
 	//        verify that we have consistent results during unpacking.
+	var newParents []string
+	if te.onPathChange != nil {
+		for parent := dir; parent != root && parent != filepath.Dir(parent); parent = filepath.Dir(parent) {
+			if _, err := te.fsEval.Lstat(parent); err == nil {
+				break
+			}
+			newParents = append(newParents, parent)
+		}
+	}
 	if err := te.fsEval.MkdirAll(dir, 0777); err != nil {
 		return errors.Wrap(err, "mkdir parent")
 	}
+	for i := len(newParents) - 1; i >= 0; i-- {
+		te.pathChanged(root, newParents[i], PathCreated)
+	}
 
 	isDirlink := false
 	// We remove whatever existed at the old path to clobber it so that
@@ -564,7 +713,7 @@ func (te *TarExtractor) UnpackEntry(root string, hdr *tar.Header, r io.Reader) (
 	// will fix all of that for us.
 	switch hdr.Typeflag {
 	// regular file
-	case tar.TypeReg, tar.TypeRegA:
+	case tar.TypeReg, tar.TypeRegA, tar.TypeGNUSparse:
 		// Create a new file, then just copy the data.
 		fh, err := te.fsEval.Create(path)
 		if err != nil {
@@ -572,8 +721,16 @@ func (te *TarExtractor) UnpackEntry(root string, hdr *tar.Header, r io.Reader) (
 		}
 		defer fh.Close()
 
+		// For sparse files, tar.Reader gives us the holes as runs of zeroes,
+		// which we convert back into holes.
+		var w io.Writer = fh
+		sparse := isSparseHeader(hdr)
+		if sparse {
+			w = &sparseFileWriter{fh: fh}
+		}
+
 		// We need to make sure that we copy all of the bytes.
-		n, err := system.Copy(fh, r)
+		n, err := system.Copy(w, r)
 		if int64(n) != hdr.Size {
 			if err != nil {
 				err = errors.Wrapf(err, "short write")
@@ -584,6 +741,12 @@ func (te *TarExtractor) UnpackEntry(root string, hdr *tar.Header, r io.Reader) (
 		if err != nil {
 			return errors.Wrap(err, "unpack to regular file")
 		}
+		// The file might end with a hole, which we skipped over.
+		if sparse {
+			if err := fh.Truncate(hdr.Size); err != nil {
+				return errors.Wrap(err, "truncate sparse file")
+			}
+		}
 
 		// Force close here so that we don't affect the metadata.
 		if err := fh.Close(); err != nil {
@@ -624,6 +787,21 @@ func (te *TarExtractor) UnpackEntry(root string, hdr *tar.Header, r io.Reader) (
 				return errors.Wrap(err, "sanitise hardlink target in root")
 			}
 			linkname = filepath.Join(linkDir, linkFile)
+			if err := checkInRoot(root, linkname); err != nil {
+				return errors.Wrap(err, "sanitise hardlink target in root")
+			}
+
+			// The target might be in one of the lower layers.
+			if _, err := te.fsEval.Lstat(linkname); errors.Is(err, os.ErrNotExist) && len(te.lowerRoots) > 0 {
+				lowerLinkname, err := te.lowerHardlinkTarget(hdr.Linkname)
+				if err != nil {
+					return errors.Wrap(err, "resolve hardlink target in lower layers")
+				}
+				if lowerLinkname != "" {
+					log.Debugf("hardlink %s: linking to %s from a lower layer", hdr.Name, lowerLinkname)
+					linkname = lowerLinkname
+				}
+			}
 		case tar.TypeSymlink:
 			linkFn = te.fsEval.Symlink
 		}
@@ -642,22 +820,13 @@ func (te *TarExtractor) UnpackEntry(root string, hdr *tar.Header, r io.Reader) (
 	// character device node, block device node
 	case tar.TypeChar, tar.TypeBlock:
 		// In rootless mode we have no choice but to fake this, since mknod(2)
-		// doesn't work as an unprivileged user here.
-		//
-		// TODO: We need to add the concept of a fake block device in
-		//       "user.rootlesscontainers", because this workaround suffers
-		//       from the obvious issue that if the file is touched (even the
-		//       metadata) then it will be incorrectly copied into the layer.
-		//       This would break distribution images fairly badly.
+		// doesn't work as an unprivileged user here. The placeholder file is
+		// marked with rootlessDeviceXattr (which is included in the mtree
+		// manifest of the bundle), so that if the file is touched it is
+		// converted back to the original device when generating a layer.
 		if te.partialRootless {
-			log.Warnf("rootless{%s} creating empty file in place of device %d:%d", hdr.Name, hdr.Devmajor, hdr.Devminor)
-			fh, err := te.fsEval.Create(path)
-			if err != nil {
-				return errors.Wrap(err, "create rootless block")
-			}
-			defer fh.Close()
-			if err := fh.Chmod(0); err != nil {
-				return errors.Wrap(err, "chmod 0 rootless block")
+			if created, err := te.unpackRootlessDevice(path, hdr); err != nil || !created {
+				return err
 			}
 			goto out
 		}
@@ -675,7 +844,15 @@ func (te *TarExtractor) UnpackEntry(root string, hdr *tar.Header, r io.Reader) (
 
 		// Create the node.
 		if err := te.fsEval.Mknod(path, os.FileMode(int64(mode)|hdr.Mode), dev); err != nil {
-			return errors.Wrap(err, "mknod")
+			// Unprivileged users can usually create FIFOs, but some
+			// filesystems (and seccomp profiles) don't permit it -- in which
+			// case we fall back to a placeholder just like devices.
+			if !te.partialRootless || hdr.Typeflag != tar.TypeFifo || !errors.Is(err, unix.EPERM) {
+				return errors.Wrap(err, "mknod")
+			}
+			if created, err := te.unpackRootlessDevice(path, hdr); err != nil || !created {
+				return err
+			}
 		}
 
 	// We should never hit any other headers (Go abstracts them away from us),
@@ -705,5 +882,6 @@ out:
 	for pth := upperPath; pth != filepath.Dir(pth); pth = filepath.Dir(pth) {
 		te.upperPaths[pth] = struct{}{}
 	}
+	te.pathChanged(root, path, change)
 	return nil
 }
@@ -957,3 +957,223 @@ func TestIsDirlink(t *testing.T) {
 		t.Errorf("file dirlink test failed")
 	}
 }
+
+// TestUnpackEntryKeepDirlinks checks how existing symlinks are handled when a
+// layer contains a directory at the same path, both with and without
+// KeepDirlinks.
+func TestUnpackEntryKeepDirlinks(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		// linkname is the target of the existing symlink at "link". If empty,
+		// "link" is an existing directory and the layer contains a symlink.
+		linkname string
+		// keep is whether the symlink should be kept with KeepDirlinks, and
+		// path is where "link/file" should be extracted to in that case.
+		keep bool
+		path string
+	}{
+		{name: "Dirlink", linkname: "dir", keep: true, path: "dir/file"},
+		{name: "AbsoluteDirlink", linkname: "/dir", keep: true, path: "dir/file"},
+		{name: "NestedDirlink", linkname: "link2", keep: true, path: "dir/file"},
+		{name: "EscapingDirlink", linkname: "../../../dir", keep: true, path: "dir/file"},
+		{name: "RootDirlink", linkname: "../..", keep: true, path: "file"},
+		{name: "FileLink", linkname: "regular", keep: false},
+		{name: "BrokenLink", linkname: "nonexistent", keep: false},
+		{name: "LoopLink", linkname: "link", keep: false},
+		{name: "DirectoryToSymlink", linkname: "", keep: false},
+	} {
+		for _, keepDirlinks := range []bool{false, true} {
+			name := test.name + "/Default"
+			if keepDirlinks {
+				name = test.name + "/KeepDirlinks"
+			}
+			t.Run(name, func(t *testing.T) {
+				dir, err := ioutil.TempDir("", "umoci-TestUnpackEntryKeepDirlinks")
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer os.RemoveAll(dir)
+
+				if err := os.MkdirAll(filepath.Join(dir, "dir"), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := ioutil.WriteFile(filepath.Join(dir, "regular"), []byte("regular"), 0644); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Symlink("dir", filepath.Join(dir, "link2")); err != nil {
+					t.Fatal(err)
+				}
+
+				var hdrs []*tar.Header
+				if test.linkname != "" {
+					if err := os.Symlink(test.linkname, filepath.Join(dir, "link")); err != nil {
+						t.Fatal(err)
+					}
+					hdrs = []*tar.Header{
+						{Name: "link/", Typeflag: tar.TypeDir, Mode: 0755},
+						{Name: "link/file", Typeflag: tar.TypeReg, Mode: 0644},
+					}
+				} else {
+					// KeepDirlinks doesn't stop a directory from being
+					// replaced with a symlink.
+					if err := os.Mkdir(filepath.Join(dir, "link"), 0755); err != nil {
+						t.Fatal(err)
+					}
+					hdrs = []*tar.Header{
+						{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "dir", Mode: 0777},
+					}
+				}
+
+				te := NewTarExtractor(UnpackOptions{KeepDirlinks: keepDirlinks})
+				for _, hdr := range hdrs {
+					hdr.Uid = os.Getuid()
+					hdr.Gid = os.Getgid()
+					hdr.ModTime = time.Now()
+					if err := te.UnpackEntry(dir, hdr, bytes.NewBuffer(nil)); err != nil {
+						t.Fatalf("unexpected UnpackEntry error: %+v", err)
+					}
+				}
+
+				fi, err := os.Lstat(filepath.Join(dir, "link"))
+				if err != nil {
+					t.Fatalf("lstat link: %v", err)
+				}
+				isSymlink := fi.Mode()&os.ModeSymlink == os.ModeSymlink
+				switch {
+				case test.linkname == "":
+					if !isSymlink {
+						t.Errorf("expected directory to be replaced with symlink, got %s", fi.Mode())
+					}
+				case keepDirlinks && test.keep:
+					if !isSymlink {
+						t.Errorf("expected dirlink to be kept, got %s", fi.Mode())
+					}
+					if target, err := os.Readlink(filepath.Join(dir, "link")); err != nil || target != test.linkname {
+						t.Errorf("expected dirlink to be unchanged (%q), got %q (err=%v)", test.linkname, target, err)
+					}
+					if _, err := os.Lstat(filepath.Join(dir, test.path)); err != nil {
+						t.Errorf("expected link/file to be written through dirlink to %s: %v", test.path, err)
+					}
+				default:
+					if !fi.IsDir() {
+						t.Errorf("expected symlink to be replaced with directory, got %s", fi.Mode())
+					}
+					if _, err := os.Lstat(filepath.Join(dir, "link/file")); err != nil {
+						t.Errorf("expected link/file to be inside new directory: %v", err)
+					}
+					if _, err := os.Lstat(filepath.Join(dir, "dir/file")); err == nil {
+						t.Errorf("link/file was written through the replaced symlink")
+					}
+				}
+			})
+		}
+	}
+}
+
+// TestUnpackEntryPreserveAtime makes sure that the atime of extracted files is
+// only restored from the header if NoPreserveAtime is not set.
+func TestUnpackEntryPreserveAtime(t *testing.T) {
+	for _, test := range []struct {
+		name            string
+		noPreserveAtime bool
+	}{
+		{"PreserveAtime", false},
+		{"NoPreserveAtime", true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "umoci-TestUnpackEntryPreserveAtime")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			atime := testutils.Unix(7892829, 0)
+			mtime := testutils.Unix(1210393, 0)
+			for _, hdr := range []*tar.Header{
+				{Name: "file", Typeflag: tar.TypeReg, Mode: 0644, ModTime: mtime, AccessTime: atime, Format: tar.FormatPAX},
+				{Name: "dir", Typeflag: tar.TypeDir, Mode: 0755, ModTime: mtime, AccessTime: atime, Format: tar.FormatPAX},
+			} {
+				te := NewTarExtractor(UnpackOptions{NoPreserveAtime: test.noPreserveAtime})
+				if err := te.UnpackEntry(dir, hdr, bytes.NewReader(nil)); err != nil {
+					t.Fatalf("%s: unexpected UnpackEntry error: %+v", hdr.Name, err)
+				}
+
+				var st unix.Stat_t
+				if err := unix.Lstat(filepath.Join(dir, hdr.Name), &st); err != nil {
+					t.Fatal(err)
+				}
+				if got := time.Unix(st.Mtim.Unix()); !got.Equal(mtime) {
+					t.Errorf("%s: expected mtime %v, got %v", hdr.Name, mtime, got)
+				}
+				gotAtime := time.Unix(st.Atim.Unix())
+				if test.noPreserveAtime && gotAtime.Equal(atime) {
+					t.Errorf("%s: atime was restored with NoPreserveAtime", hdr.Name)
+				} else if !test.noPreserveAtime && !gotAtime.Equal(atime) {
+					t.Errorf("%s: expected atime %v, got %v", hdr.Name, atime, gotAtime)
+				}
+			}
+		})
+	}
+}
+
+// TestUnpackEntryPathChange checks that OnPathChange is called for every path
+// changed by UnpackEntry (including implicitly created parent directories and
+// the children of opaque whiteouts).
+func TestUnpackEntryPathChange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestUnpackEntryPathChange")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	type change struct {
+		path   string
+		change PathChange
+	}
+	var got []change
+	onPathChange := func(path string, pathChange PathChange) {
+		got = append(got, change{path, pathChange})
+	}
+
+	// Whiteouts only apply to paths from lower layers, so each layer needs
+	// its own TarExtractor.
+	for _, layer := range [][]*tar.Header{
+		{
+			{Name: "a/b/file", Typeflag: tar.TypeReg, Mode: 0644},
+			{Name: "a/b/file", Typeflag: tar.TypeReg, Mode: 0600},
+			{Name: "a/link", Typeflag: tar.TypeSymlink, Linkname: "b/file"},
+			{Name: "c", Typeflag: tar.TypeDir, Mode: 0755},
+		},
+		{
+			{Name: "a/" + whOpaque, Typeflag: tar.TypeReg},
+			{Name: whPrefix + "c", Typeflag: tar.TypeReg},
+		},
+	} {
+		te := NewTarExtractor(UnpackOptions{OnPathChange: onPathChange})
+		for _, hdr := range layer {
+			if err := te.UnpackEntry(dir, hdr, bytes.NewReader(nil)); err != nil {
+				t.Fatalf("%s: unexpected UnpackEntry error: %+v", hdr.Name, err)
+			}
+		}
+	}
+
+	expected := []change{
+		{"/a", PathCreated},
+		{"/a/b", PathCreated},
+		{"/a/b/file", PathCreated},
+		{"/a/b/file", PathModified},
+		{"/a/link", PathCreated},
+		{"/c", PathCreated},
+		{"/a/b", PathDeleted},
+		{"/a/link", PathDeleted},
+		{"/c", PathDeleted},
+	}
+	if len(got) != len(expected) {
+		t.Fatalf("expected %d path changes, got %d: %v", len(expected), len(got), got)
+	}
+	for idx := range expected {
+		if got[idx] != expected[idx] {
+			t.Errorf("path change %d: expected %v, got %v", idx, expected[idx], got[idx])
+		}
+	}
+}
@@ -23,6 +23,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/apex/log"
 	"github.com/opencontainers/umoci/pkg/fseval"
@@ -78,6 +79,10 @@ func init() {
 type tarGenerator struct {
 	tw *tar.Writer
 
+	// w is the writer underneath tw, which is needed for writing sparse
+	// entries (which tar.Writer doesn't support).
+	w io.Writer
+
 	// mapOptions is the set of mapping options for modifying entries before
 	// they're added to the layer.
 	mapOptions MapOptions
@@ -88,10 +93,85 @@ type tarGenerator struct {
 	// fsEval is an fseval.FsEval used for extraction.
 	fsEval fseval.FsEval
 
+	// reproducible indicates that host-specific metadata (such as timestamps)
+	// should be normalised in the generated entries. See RepackOptions.
+	reproducible bool
+
+	// canonical indicates that the metadata of the generated entries should
+	// be flattened, with canonicalTime as the modification time. See
+	// RepackOptions.Canonicalize.
+	canonical     bool
+	canonicalTime time.Time
+
+	// progress is used to report how much of the file contents has been
+	// added to the layer.
+	progress *progressCounter
+
 	// XXX: Should we add a safety check to make sure we don't generate two of
 	//      the same path in a tar archive? This is not permitted by the spec.
 }
 
+// reproducibleTime is the modification time used for all entries generated
+// in reproducible mode.
+var reproducibleTime = time.Unix(0, 0)
+
+// normaliseReproducible strips all of the metadata from hdr which depends on
+// when (or on which host) the layer was generated rather than the contents of
+// the filesystem.
+func normaliseReproducible(hdr *tar.Header) {
+	hdr.ModTime = reproducibleTime
+	hdr.AccessTime = time.Time{}
+	hdr.ChangeTime = time.Time{}
+	hdr.Uname = ""
+	hdr.Gname = ""
+	// Let tar.Writer pick the simplest format which can represent the entry,
+	// rather than depending on what tar.FileInfoHeader decided.
+	hdr.Format = tar.FormatUnknown
+}
+
+// canonicalXattrs is the set of xattrs which are kept in canonical mode,
+// because they affect how the files in the layer behave rather than just
+// describing who created them.
+var canonicalXattrs = map[string]struct{}{
+	// File capabilities (such as CAP_NET_RAW for ping) are needed for some
+	// binaries to work.
+	capabilityXattr: {},
+}
+
+// canonicaliseHeader flattens the metadata of hdr in canonical mode (see
+// RepackOptions.Canonicalize), so that the entry only depends on the path,
+// type, mode and contents of the file. hdr.Xattrs must already include any
+// xattrs stored in hdr.PAXRecords.
+func canonicaliseHeader(hdr *tar.Header, mtime time.Time) {
+	normaliseReproducible(hdr)
+	if !mtime.IsZero() {
+		hdr.ModTime = mtime
+	}
+	hdr.Uid = 0
+	hdr.Gid = 0
+	for name := range hdr.Xattrs {
+		if _, keep := canonicalXattrs[name]; !keep {
+			delete(hdr.Xattrs, name)
+		}
+	}
+	// Any other PAX records (such as those copied from an input archive) are
+	// extraneous metadata too.
+	hdr.PAXRecords = nil
+}
+
+// preserveTimestamps makes sure that sub-second timestamps are not lost when
+// the entry is written. tar.Writer rounds the mtime to whole seconds (and
+// drops the atime) unless the PAX format is explicitly requested, so we only
+// request it for entries with sub-second timestamps (to avoid adding a PAX
+// header to every entry). The ctime is always dropped, as it is host-specific
+// and cannot be restored on extraction.
+func preserveTimestamps(hdr *tar.Header) {
+	hdr.ChangeTime = time.Time{}
+	if hdr.ModTime.Nanosecond() != 0 || hdr.AccessTime.Nanosecond() != 0 {
+		hdr.Format = tar.FormatPAX
+	}
+}
+
 // newTarGenerator creates a new tarGenerator using the provided writer as the
 // output writer.
 func newTarGenerator(w io.Writer, opt MapOptions) *tarGenerator {
@@ -102,6 +182,7 @@ func newTarGenerator(w io.Writer, opt MapOptions) *tarGenerator {
 
 	return &tarGenerator{
 		tw:         tar.NewWriter(w),
+		w:          w,
 		mapOptions: opt,
 		inodes:     map[uint64]string{},
 		fsEval:     fsEval,
@@ -149,6 +230,13 @@ func (tg *tarGenerator) AddFile(name, path string) error {
 		return errors.Wrap(err, "add file lstat")
 	}
 
+	// Unix sockets cannot be represented in tar archives (and are
+	// meaningless outside of the process which created them anyway).
+	if fi.Mode()&os.ModeSocket == os.ModeSocket {
+		log.Warnf("generate layer: skipping socket %s: sockets cannot be included in layers", name)
+		return nil
+	}
+
 	linkname := ""
 	if fi.Mode()&os.ModeSymlink == os.ModeSymlink {
 		if linkname, err = tg.fsEval.Readlink(path); err != nil {
@@ -195,6 +283,7 @@ func (tg *tarGenerator) AddFile(name, path string) error {
 		return errors.Wrapf(err, "lstatx %q", path)
 	}
 	updateHeader(hdr, statx)
+	preserveTimestamps(hdr)
 
 	// Set up xattrs externally to updateHeader because the function signature
 	// would look really dumb otherwise.
@@ -210,9 +299,6 @@ func (tg *tarGenerator) AddFile(name, path string) error {
 		if _, ignore := ignoreXattrs[name]; ignore {
 			continue
 		}
-		// TODO: We should translate all v3 capabilities into root-owned
-		//       capabilities here. But we don't have Go code for that yet
-		//       (we'd need to use libcap to parse it).
 		value, err := tg.fsEval.Lgetxattr(path, name)
 		if err != nil {
 			// XXX: I'm not sure if we're unprivileged whether Lgetxattr can
@@ -220,6 +306,15 @@ func (tg *tarGenerator) AddFile(name, path string) error {
 			//      we try to clear xattrs).
 			return errors.Wrapf(err, "get xattr: %s", name)
 		}
+		// Namespaced (v3) capabilities are host-specific, so translate them
+		// into root-owned (v2) capabilities.
+		if name == capabilityXattr {
+			newValue, err := normaliseCapability(string(value))
+			if err != nil {
+				return errors.Wrapf(err, "normalise xattr: %s", name)
+			}
+			value = []byte(newValue)
+		}
 		// https://golang.org/issues/20698 -- We don't just error out here
 		// because it's not _really_ a fatal error. Currently it's unclear
 		// whether the stdlib will correctly handle reading or disable writing
@@ -249,6 +344,39 @@ func (tg *tarGenerator) AddFile(name, path string) error {
 	if err := mapHeader(hdr, tg.mapOptions); err != nil {
 		return errors.Wrap(err, "map header")
 	}
+	if tg.reproducible {
+		normaliseReproducible(hdr)
+	}
+	if tg.canonical {
+		canonicaliseHeader(hdr, tg.canonicalTime)
+	}
+	encodePAXXattrs(hdr)
+
+	// Regular files which contain holes are written as sparse entries, which
+	// has to be done outside of tar.Writer.
+	if hdr.Typeflag == tar.TypeReg {
+		fh, err := tg.fsEval.Open(path)
+		if err != nil {
+			return errors.Wrap(err, "open file")
+		}
+		defer fh.Close()
+
+		segments, err := dataSegments(fh, hdr.Size)
+		if err != nil {
+			return errors.Wrap(err, "find sparse file holes")
+		}
+		if segments != nil {
+			if err := tg.tw.Flush(); err != nil {
+				return errors.Wrap(err, "flush tar writer")
+			}
+			if err := writeSparseFile(tg.w, hdr, fh, segments); err != nil {
+				return errors.Wrap(err, "write sparse file")
+			}
+			tg.progress.Add(hdr.Size)
+			return nil
+		}
+	}
+
 	if err := tg.tw.WriteHeader(hdr); err != nil {
 		return errors.Wrap(err, "write header")
 	}
@@ -261,7 +389,7 @@ func (tg *tarGenerator) AddFile(name, path string) error {
 		}
 		defer fh.Close()
 
-		n, err := system.Copy(tg.tw, fh)
+		n, err := system.Copy(tg.tw, tg.progress.Reader(fh))
 		if err != nil {
 			return errors.Wrap(err, "copy to layer")
 		}
@@ -304,11 +432,19 @@ func (tg *tarGenerator) addWhiteout(name string, opaque bool) error {
 		whiteout = filepath.Join(name, whOpaque)
 	}
 
-	// Add a dummy header for the whiteout file.
-	return errors.Wrap(tg.tw.WriteHeader(&tar.Header{
+	// Add a dummy header for the whiteout file. It has no metadata of its
+	// own, but it still needs the same timestamp as every other entry.
+	hdr := &tar.Header{
 		Name: whiteout,
 		Size: 0,
-	}), "write whiteout header")
+	}
+	if tg.reproducible {
+		normaliseReproducible(hdr)
+	}
+	if tg.canonical {
+		canonicaliseHeader(hdr, tg.canonicalTime)
+	}
+	return errors.Wrap(tg.tw.WriteHeader(hdr), "write whiteout header")
 }
 
 // AddWhiteout creates a whiteout for the provided path.
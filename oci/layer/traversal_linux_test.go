@@ -0,0 +1,289 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+// traversalSnapshot records the state of every path outside of the rootfs, so
+// that we can verify an adversarial layer didn't modify the host.
+type traversalSnapshot map[string]string
+
+func snapshotOutsideRoot(t *testing.T, dir, rootfs string) traversalSnapshot {
+	snapshot := traversalSnapshot{}
+	if err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == rootfs {
+			return filepath.SkipDir
+		}
+		var state string
+		switch {
+		case info.Mode().IsRegular():
+			content, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			// Include the link count so that we detect hardlinks to host
+			// files being created inside the rootfs.
+			state = string(content)
+			if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+				state += fmt.Sprintf("|nlink=%d", stat.Nlink)
+			}
+		case info.Mode()&os.ModeSymlink == os.ModeSymlink:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			state = "symlink:" + target
+		}
+		snapshot[path] = info.Mode().String() + "|" + state
+		return nil
+	}); err != nil {
+		t.Fatalf("snapshot host: %v", err)
+	}
+	return snapshot
+}
+
+// TestUnpackLayerTraversal unpacks a series of adversarial layers, and makes
+// sure that none of them are able to modify anything outside of the rootfs
+// (through absolute paths, ".." components, symlinks, hardlinks or whiteouts).
+func TestUnpackLayerTraversal(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		opt     UnpackOptions
+		overlay bool
+		// entries is called with the host directory, so that layers can use
+		// absolute paths which point to the host.
+		entries func(host string) []squashTestEntry
+		// fail indicates whether the layer should be rejected outright.
+		fail bool
+	}{
+		{name: "AbsolutePath", entries: func(host string) []squashTestEntry {
+			return []squashTestEntry{
+				{hdr: tar.Header{Name: "/escape", Typeflag: tar.TypeReg}, content: "escaped"},
+				{hdr: tar.Header{Name: filepath.Join(host, "file"), Typeflag: tar.TypeReg}, content: "escaped"},
+			}
+		}},
+		{name: "DotDotClimb", entries: func(host string) []squashTestEntry {
+			return []squashTestEntry{
+				{hdr: tar.Header{Name: "../escape", Typeflag: tar.TypeReg}, content: "escaped"},
+				{hdr: tar.Header{Name: "../../../../../../escape", Typeflag: tar.TypeReg}, content: "escaped"},
+				{hdr: tar.Header{Name: "a/../../escape", Typeflag: tar.TypeReg}, content: "escaped"},
+				{hdr: tar.Header{Name: "../host/file", Typeflag: tar.TypeReg}, content: "escaped"},
+				{hdr: tar.Header{Name: "../host/dir/", Typeflag: tar.TypeDir}},
+			}
+		}},
+		{name: "SymlinkAbsolute", entries: func(host string) []squashTestEntry {
+			return []squashTestEntry{
+				{hdr: tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: host}},
+				{hdr: tar.Header{Name: "link/file", Typeflag: tar.TypeReg}, content: "escaped"},
+				{hdr: tar.Header{Name: "link/escape", Typeflag: tar.TypeReg}, content: "escaped"},
+			}
+		}},
+		{name: "SymlinkRelative", entries: func(host string) []squashTestEntry {
+			return []squashTestEntry{
+				{hdr: tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "../host"}},
+				{hdr: tar.Header{Name: "link/file", Typeflag: tar.TypeReg}, content: "escaped"},
+				{hdr: tar.Header{Name: "root", Typeflag: tar.TypeSymlink, Linkname: "../../../../../../../.."}},
+				{hdr: tar.Header{Name: "root/escape", Typeflag: tar.TypeReg}, content: "escaped"},
+			}
+		}},
+		{name: "SymlinkChain", entries: func(host string) []squashTestEntry {
+			return []squashTestEntry{
+				{hdr: tar.Header{Name: "a", Typeflag: tar.TypeSymlink, Linkname: "b/c"}},
+				{hdr: tar.Header{Name: "b", Typeflag: tar.TypeSymlink, Linkname: "sub/../.."}},
+				{hdr: tar.Header{Name: "c", Typeflag: tar.TypeSymlink, Linkname: "../host"}},
+				{hdr: tar.Header{Name: "sub/", Typeflag: tar.TypeDir}},
+				{hdr: tar.Header{Name: "a/file", Typeflag: tar.TypeReg}, content: "escaped"},
+			}
+		}},
+		{name: "SymlinkDirectory", entries: func(host string) []squashTestEntry {
+			return []squashTestEntry{
+				{hdr: tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "../host"}},
+				{hdr: tar.Header{Name: "link/dir/", Typeflag: tar.TypeDir, Mode: 0700}},
+				{hdr: tar.Header{Name: "link/newdir/", Typeflag: tar.TypeDir}},
+				{hdr: tar.Header{Name: "link/newdir/escape", Typeflag: tar.TypeReg}, content: "escaped"},
+			}
+		}},
+		{name: "SymlinkLeaf", entries: func(host string) []squashTestEntry {
+			return []squashTestEntry{
+				{hdr: tar.Header{Name: "file", Typeflag: tar.TypeSymlink, Linkname: filepath.Join(host, "file")}},
+				{hdr: tar.Header{Name: "file", Typeflag: tar.TypeReg}, content: "escaped"},
+				{hdr: tar.Header{Name: "dir", Typeflag: tar.TypeSymlink, Linkname: "../host/dir"}},
+				{hdr: tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0700}},
+			}
+		}},
+		{name: "KeepDirlinks", opt: UnpackOptions{KeepDirlinks: true}, entries: func(host string) []squashTestEntry {
+			return []squashTestEntry{
+				{hdr: tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "../host"}},
+				{hdr: tar.Header{Name: "link/", Typeflag: tar.TypeDir, Mode: 0700}},
+				{hdr: tar.Header{Name: "link/escape", Typeflag: tar.TypeReg}, content: "escaped"},
+				{hdr: tar.Header{Name: "abs", Typeflag: tar.TypeSymlink, Linkname: host}},
+				{hdr: tar.Header{Name: "abs/", Typeflag: tar.TypeDir, Mode: 0700}},
+				{hdr: tar.Header{Name: "abs/file", Typeflag: tar.TypeReg}, content: "escaped"},
+			}
+		}},
+		{name: "HardlinkDotDot", fail: true, entries: func(host string) []squashTestEntry {
+			return []squashTestEntry{
+				{hdr: tar.Header{Name: "hardlink", Typeflag: tar.TypeLink, Linkname: "../host/file"}},
+			}
+		}},
+		{name: "HardlinkAbsolute", fail: true, entries: func(host string) []squashTestEntry {
+			return []squashTestEntry{
+				{hdr: tar.Header{Name: "hardlink", Typeflag: tar.TypeLink, Linkname: filepath.Join(host, "file")}},
+			}
+		}},
+		{name: "HardlinkThroughSymlink", fail: true, entries: func(host string) []squashTestEntry {
+			return []squashTestEntry{
+				{hdr: tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "../host"}},
+				{hdr: tar.Header{Name: "hardlink", Typeflag: tar.TypeLink, Linkname: "link/file"}},
+			}
+		}},
+		{name: "HardlinkIntoSymlink", entries: func(host string) []squashTestEntry {
+			return []squashTestEntry{
+				{hdr: tar.Header{Name: "target", Typeflag: tar.TypeReg}, content: "target"},
+				{hdr: tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "../host"}},
+				{hdr: tar.Header{Name: "link/escape", Typeflag: tar.TypeLink, Linkname: "target"}},
+			}
+		}},
+		{name: "WhiteoutDotDot", fail: true, entries: func(host string) []squashTestEntry {
+			return []squashTestEntry{
+				{hdr: tar.Header{Name: whPrefix + "..", Typeflag: tar.TypeReg}},
+			}
+		}},
+		{name: "WhiteoutDot", fail: true, entries: func(host string) []squashTestEntry {
+			return []squashTestEntry{
+				{hdr: tar.Header{Name: "/" + whPrefix + ".", Typeflag: tar.TypeReg}},
+			}
+		}},
+		{name: "WhiteoutEmpty", fail: true, entries: func(host string) []squashTestEntry {
+			return []squashTestEntry{
+				{hdr: tar.Header{Name: "sub/" + whPrefix, Typeflag: tar.TypeReg}},
+			}
+		}},
+		{name: "WhiteoutThroughSymlink", entries: func(host string) []squashTestEntry {
+			return []squashTestEntry{
+				{hdr: tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "../host"}},
+				{hdr: tar.Header{Name: "link/" + whPrefix + "file", Typeflag: tar.TypeReg}},
+				{hdr: tar.Header{Name: "link/" + whOpaque, Typeflag: tar.TypeReg}},
+				{hdr: tar.Header{Name: "../" + whPrefix + "host", Typeflag: tar.TypeReg}},
+			}
+		}},
+		{name: "OverlayWhiteoutDotDot", overlay: true, fail: true, opt: UnpackOptions{WhiteoutMode: OverlayFSWhiteout}, entries: func(host string) []squashTestEntry {
+			return []squashTestEntry{
+				{hdr: tar.Header{Name: whPrefix + "..", Typeflag: tar.TypeReg}},
+			}
+		}},
+		{name: "OverlayWhiteoutThroughSymlink", overlay: true, opt: UnpackOptions{WhiteoutMode: OverlayFSWhiteout}, entries: func(host string) []squashTestEntry {
+			return []squashTestEntry{
+				{hdr: tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "../host"}},
+				{hdr: tar.Header{Name: "link/" + whPrefix + "file", Typeflag: tar.TypeReg}},
+				{hdr: tar.Header{Name: "link/" + whOpaque, Typeflag: tar.TypeReg}},
+			}
+		}},
+		{name: "RootSymlink", fail: true, entries: func(host string) []squashTestEntry {
+			return []squashTestEntry{
+				{hdr: tar.Header{Name: "/", Typeflag: tar.TypeSymlink, Linkname: "../host"}},
+				{hdr: tar.Header{Name: "file", Typeflag: tar.TypeReg}, content: "escaped"},
+			}
+		}},
+		{name: "RootDotDotSymlink", fail: true, entries: func(host string) []squashTestEntry {
+			return []squashTestEntry{
+				{hdr: tar.Header{Name: "../", Typeflag: tar.TypeSymlink, Linkname: host}},
+				{hdr: tar.Header{Name: "file", Typeflag: tar.TypeReg}, content: "escaped"},
+			}
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "umoci-TestUnpackLayerTraversal")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			if test.overlay {
+				mknodOk, err := canMknod(dir)
+				if err != nil {
+					t.Fatalf("couldn't mknod in dir: %v", err)
+				}
+				if !mknodOk || os.Geteuid() != 0 {
+					t.Skip("skipping overlayfs test: requires mknod and trusted xattrs")
+				}
+			}
+
+			rootfs := filepath.Join(dir, "rootfs")
+			host := filepath.Join(dir, "host")
+			for _, path := range []string{rootfs, host, filepath.Join(host, "dir")} {
+				if err := os.Mkdir(path, 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := ioutil.WriteFile(filepath.Join(host, "file"), []byte("host content"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			before := snapshotOutsideRoot(t, dir, rootfs)
+
+			var buffer bytes.Buffer
+			tw := tar.NewWriter(&buffer)
+			for _, entry := range test.entries(host) {
+				hdr := entry.hdr
+				hdr.Size = int64(len(entry.content))
+				hdr.Uid = os.Getuid()
+				hdr.Gid = os.Getgid()
+				if hdr.Mode == 0 {
+					hdr.Mode = 0644
+					if hdr.Typeflag == tar.TypeDir {
+						hdr.Mode = 0755
+					}
+				}
+				if err := tw.WriteHeader(&hdr); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := tw.Write([]byte(entry.content)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := tw.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			err = UnpackLayer(rootfs, &buffer, &test.opt)
+			if test.fail && err == nil {
+				t.Errorf("expected malicious layer to be rejected")
+			} else if !test.fail && err != nil {
+				t.Errorf("unexpected error unpacking layer: %+v", err)
+			}
+
+			after := snapshotOutsideRoot(t, dir, rootfs)
+			if !reflect.DeepEqual(before, after) {
+				t.Errorf("HOST WAS MODIFIED! THIS IS A PATH ESCAPE!\nbefore: %v\nafter:  %v", before, after)
+			}
+		})
+	}
+}
@@ -1,7 +1,12 @@
 package layer
 
 import (
+	"fmt"
+	"io"
+	"time"
+
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
 )
 
 // WhiteoutMode indicates how this TarExtractor will create whiteouts on the
@@ -17,6 +22,67 @@ const (
 	// so it follows the overlayfs whiteout protocol:
 	//     .wh.foo => mknod c 0 0 foo
 	OverlayFSWhiteout
+
+	// LiteralWhiteout doesn't treat whiteouts specially at all, and instead
+	// extracts them as though they were regular entries (so .wh.foo is
+	// extracted as an ordinary file called .wh.foo). This is only really
+	// useful for inspecting the contents of a single layer.
+	LiteralWhiteout
+)
+
+// PathChange describes how a path was changed by a TarExtractor.
+type PathChange int
+
+const (
+	// PathCreated means that the path did not exist and was created.
+	PathCreated PathChange = iota
+
+	// PathModified means that the path already existed, and was replaced or
+	// had its metadata changed.
+	PathModified
+
+	// PathDeleted means that the path was removed (by a whiteout). If the
+	// path was a directory, all of its children were also removed but are
+	// not reported separately.
+	PathDeleted
+)
+
+// String returns the name of the change ("created", "modified" or
+// "deleted").
+func (c PathChange) String() string {
+	switch c {
+	case PathCreated:
+		return "created"
+	case PathModified:
+		return "modified"
+	case PathDeleted:
+		return "deleted"
+	}
+	return fmt.Sprintf("PathChange(%d)", int(c))
+}
+
+// PathChangeFunc is called by a TarExtractor after it changes a path. The path
+// is relative to the root being extracted to, with a leading "/" (so the root
+// itself is "/").
+type PathChangeFunc func(path string, change PathChange)
+
+// RootlessDeviceMode indicates how a TarExtractor will handle character and
+// block devices when it cannot create them (when extracting rootless or inside
+// a user namespace).
+type RootlessDeviceMode int
+
+const (
+	// RootlessDevicePlaceholder creates an empty regular file in place of the
+	// device, with the original device type and number stored in an xattr.
+	// The placeholder is converted back into the original device when it is
+	// included in a generated layer.
+	RootlessDevicePlaceholder RootlessDeviceMode = iota
+
+	// RootlessDeviceSkip doesn't create anything in place of the device.
+	RootlessDeviceSkip
+
+	// RootlessDeviceError causes extraction to fail if a device is found.
+	RootlessDeviceError
 )
 
 // UnpackOptions describes the behavior of the various unpack operations.
@@ -24,11 +90,16 @@ type UnpackOptions struct {
 	// MapOptions are the UID and GID mappings used when unpacking an image
 	MapOptions MapOptions
 
-	// KeepDirlinks is essentially the same as rsync's optio
+	// KeepDirlinks is essentially the same as rsync's option
 	// --keep-dirlinks: if, on extraction, a directory would be created
 	// where a symlink to a directory previously existed, KeepDirlinks
 	// doesn't create that directory, but instead just uses the existing
-	// symlink.
+	// symlink (and the contents of the directory are extracted through
+	// it). The symlink is resolved inside the root, so it cannot be used to
+	// write outside of it. Symlinks to non-directories, broken symlinks and
+	// symlink loops are still replaced, as are existing directories which
+	// are replaced by a symlink in the layer. By default (false), any
+	// existing symlink is replaced with the directory.
 	KeepDirlinks bool
 
 	// AfterLayerUnpack is a function that's called after every layer is
@@ -40,6 +111,88 @@ type UnpackOptions struct {
 
 	// WhiteoutMode is the type of whiteout to write to the filesystem.
 	WhiteoutMode WhiteoutMode
+
+	// AllowForeignLayers causes non-distributable ("foreign") layers which
+	// are not included in the image to be fetched from the URLs in their
+	// descriptor. Otherwise, unpacking an image with such layers fails.
+	AllowForeignLayers bool
+
+	// DetectCompression causes the compression of each layer to be detected
+	// from the first bytes of the layer blob (rather than trusting the media
+	// type of the layer descriptor), to allow extracting images built by
+	// tools which mislabel their layers. A warning is logged for each layer
+	// whose media type doesn't match the detected compression. The DiffIDs
+	// of the layers are still verified.
+	DetectCompression bool
+
+	// RootlessDeviceMode is how to handle devices which cannot be created
+	// because we are unprivileged.
+	RootlessDeviceMode RootlessDeviceMode
+
+	// ShadowXattrs causes privileged xattrs (such as "security.capability")
+	// which cannot be set because we are unprivileged to be stored in a
+	// user.* "shadow" xattr (such as "user.umoci.security.capability")
+	// rather than being dropped. Shadow xattrs are converted back into the
+	// original xattr when generating a layer.
+	ShadowXattrs bool
+
+	// NoPreserveAtime causes the access time of extracted files to not be
+	// restored from the layer (it is left as whatever the filesystem set it
+	// to when the file was created). By default, the access time is restored
+	// (falling back to the modification time if the layer doesn't include an
+	// access time), as was always the case before this option was added.
+	NoPreserveAtime bool
+
+	// OnPathChange, if set, is called for every path created, modified or
+	// deleted while extracting the layers.
+	OnPathChange PathChangeFunc
+
+	// LayerCache, if set, is the path of a directory used to cache snapshots
+	// of the extracted rootfs, keyed by the ChainID of the layers (and the
+	// options which affect extraction). The final rootfs is always stored,
+	// but snapshots of intermediate layers are only stored if the files can
+	// be reflinked into the cache (copying the whole rootfs after every layer
+	// would be quadratic in the number of layers). When unpacking an
+	// image, the snapshot for the longest cached prefix of its layers is
+	// cloned (using reflinks if the filesystem supports them, otherwise by
+	// copying) instead of extracting those layers. The DiffIDs of restored
+	// layers are not re-verified, so the cache directory must only be
+	// writable by trusted users. The cache is not used with StartFrom, and
+	// restored paths are reported to OnPathChange as PathCreated.
+	LayerCache string
+
+	// RuntimeOptions describes how the runtime configuration of the bundle
+	// is generated.
+	RuntimeOptions RuntimeOptions
+
+	// Progress, if set, is called to report the progress of extracting the
+	// layers, in terms of the (compressed) size of the layer blobs.
+	Progress ProgressFunc
+}
+
+// RuntimeOptions describes how a runtime configuration (config.json) is
+// generated from an image configuration.
+type RuntimeOptions struct {
+	// NoHardening disables the default linux.maskedPaths and
+	// linux.readonlyPaths (see convert.DefaultMaskedPaths and
+	// convert.DefaultReadonlyPaths), producing a bare configuration.
+	NoHardening bool
+
+	// MaskedPaths are additional paths to add to linux.maskedPaths.
+	MaskedPaths []string
+
+	// ReadonlyPaths are additional paths to add to linux.readonlyPaths.
+	ReadonlyPaths []string
+
+	// DefaultCapabilities replaces the minimal capability set of the
+	// generated configuration with the default capability set used by
+	// container engines (see convert.DefaultCapabilitySet).
+	DefaultCapabilities bool
+
+	// Seccomp, if set, is the seccomp profile to use as linux.seccomp (see
+	// convert.MinimalSeccomp for a minimal profile). By default no seccomp
+	// profile is generated.
+	Seccomp *rspec.LinuxSeccomp
 }
 
 // RepackOptions describes the behavior of the various GenerateLayer operations.
@@ -51,4 +204,73 @@ type RepackOptions struct {
 	// .wh.foo style whiteouts when generating tarballs. Without this,
 	// whiteouts are untouched.
 	TranslateOverlayWhiteouts bool
+
+	// Reproducible causes the generated layer to only depend on the contents
+	// of the filesystem, so that generating a layer from the same filesystem
+	// twice results in byte-identical archives. In particular, the
+	// modification time of every entry is set to the Unix epoch, and access
+	// and change times (as well as user and group names) are not included.
+	// Entries are always emitted sorted by path and PAX records are always
+	// sorted by key, regardless of this setting.
+	Reproducible bool
+
+	// Canonicalize flattens the metadata of every entry in the generated
+	// layer, for minimal ("scratch-like") images where the layer should not
+	// depend on who created the files or when. Every entry is owned by
+	// root:root regardless of MapOptions (the owner is discarded rather than
+	// translated), has a modification time of CanonicalTime, and only
+	// essential xattrs (file capabilities) are kept. This implies the
+	// normalisation done by Reproducible.
+	Canonicalize bool
+
+	// CanonicalTime is the modification time of every entry with
+	// Canonicalize. If it is zero, the Unix epoch is used.
+	CanonicalTime time.Time
+
+	// Progress, if set, is called to report the progress of generating the
+	// layer, in terms of the size of the file contents included in the layer.
+	Progress ProgressFunc
+
+	// IgnorePatterns is a set of gitignore-style patterns (matched against
+	// paths relative to the root of the rootfs) for paths which should be
+	// excluded from the generated layer. Nothing at all (not even a whiteout)
+	// is emitted for ignored paths, and the contents of ignored directories
+	// are also ignored. Patterns starting with "!" re-include paths which were
+	// ignored by a previous pattern.
+	IgnorePatterns []string
+
+	// AlwaysAppend causes umoci.Repack to always add a new layer to the
+	// image, even if there are no changes to the rootfs (in which case the
+	// new layer is an empty tar archive). Without this, repacking a bundle
+	// without any changes only updates the image configuration. It has no
+	// effect on GenerateLayer, which always generates a layer.
+	AlwaysAppend bool
+}
+
+// Compressor compresses a layer tar stream. mutate.Compressor implementations
+// (such as mutate.GzipCompressor) can be used as a Compressor.
+type Compressor interface {
+	// Compress sets up the streaming compressor for the given tar stream.
+	Compress(io.Reader) (io.ReadCloser, error)
+}
+
+// LayerReaderOptions describes the behavior of NewLayerReader.
+type LayerReaderOptions struct {
+	// RepackOptions describes how the layer is generated.
+	RepackOptions
+
+	// Compressor, if set, is used to compress the generated layer. Otherwise
+	// the layer is an uncompressed tar stream.
+	Compressor Compressor
+}
+
+// ApplyLayerOptions describes the behavior of ApplyLayerReader.
+type ApplyLayerOptions struct {
+	// UnpackOptions describes how the layer is extracted.
+	UnpackOptions
+
+	// MediaType is the layer media type of the stream (such as
+	// ispec.MediaTypeImageLayerGzip), which is used to decompress it. If
+	// empty, the stream must be an uncompressed tar stream.
+	MediaType string
 }
@@ -19,6 +19,8 @@ package layer
 
 import (
 	"archive/tar"
+	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
@@ -32,14 +34,17 @@ import (
 	_ "crypto/sha256"
 
 	"github.com/apex/log"
+	zstd "github.com/klauspost/compress/zstd"
 	gzip "github.com/klauspost/pgzip"
 	"github.com/opencontainers/go-digest"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	rspec "github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/opencontainers/umoci/oci/cas"
 	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/opencontainers/umoci/oci/casext/mediatype"
 	iconv "github.com/opencontainers/umoci/oci/config/convert"
 	"github.com/opencontainers/umoci/pkg/fseval"
+	"github.com/opencontainers/umoci/pkg/hardening"
 	"github.com/opencontainers/umoci/pkg/idtools"
 	"github.com/opencontainers/umoci/pkg/system"
 	"github.com/pkg/errors"
@@ -51,13 +56,25 @@ type AfterLayerUnpackCallback func(manifest ispec.Manifest, desc ispec.Descripto
 // UnpackLayer unpacks the tar stream representing an OCI layer at the given
 // root. It ensures that the state of the root is as close as possible to the
 // state used to create the layer. If an error is returned, the state of root
-// is undefined (unpacking is not guaranteed to be atomic).
+// is undefined (unpacking is not guaranteed to be atomic). See
+// ApplyLayerReader for extracting compressed layers.
 func UnpackLayer(root string, layer io.Reader, opt *UnpackOptions) error {
+	var applyOptions ApplyLayerOptions
+	if opt != nil {
+		applyOptions.UnpackOptions = *opt
+	}
+	return ApplyLayerReader(root, layer, &applyOptions)
+}
+
+// unpackLayer is UnpackLayer, but with the set of directories that the lower
+// layers were extracted to (see TarExtractor.lowerRoots).
+func unpackLayer(root string, layer io.Reader, opt *UnpackOptions, lowerRoots []string) error {
 	var unpackOptions UnpackOptions
 	if opt != nil {
 		unpackOptions = *opt
 	}
 	te := NewTarExtractor(unpackOptions)
+	te.lowerRoots = lowerRoots
 	tr := tar.NewReader(layer)
 	for {
 		hdr, err := tr.Next()
@@ -81,12 +98,157 @@ const RootfsName = "rootfs"
 // isLayerType returns if the given MediaType is the media type of an image
 // layer blob. This includes both distributable and non-distributable images.
 func isLayerType(mediaType string) bool {
-	return mediaType == ispec.MediaTypeImageLayer || mediaType == ispec.MediaTypeImageLayerNonDistributable ||
-		mediaType == ispec.MediaTypeImageLayerGzip || mediaType == ispec.MediaTypeImageLayerNonDistributableGzip
+	switch mediaType {
+	case ispec.MediaTypeImageLayer, ispec.MediaTypeImageLayerNonDistributable,
+		ispec.MediaTypeImageLayerGzip, ispec.MediaTypeImageLayerNonDistributableGzip,
+		mediatype.MediaTypeImageLayerZstd, mediatype.MediaTypeImageLayerNonDistributableZstd:
+		return true
+	}
+	return false
+}
+
+// decompressLayer wraps the given (compressed) layer blob so that reads from
+// the returned reader produce the raw tar stream, based on the compression
+// implied by the media type. Uncompressed layers are passed through as-is. The
+// caller is responsible for closing the returned reader, which does not close
+// the underlying blob.
+func decompressLayer(mediaType string, blob io.Reader) (io.ReadCloser, error) {
+	switch mediaType {
+	case ispec.MediaTypeImageLayerGzip, ispec.MediaTypeImageLayerNonDistributableGzip:
+		gzr, err := gzip.NewReader(blob)
+		if err != nil {
+			return nil, errors.Wrap(err, "create gzip reader")
+		}
+		return gzr, nil
+	case mediatype.MediaTypeImageLayerZstd, mediatype.MediaTypeImageLayerNonDistributableZstd:
+		zr, err := zstd.NewReader(blob)
+		if err != nil {
+			return nil, errors.Wrap(err, "create zstd reader")
+		}
+		return zr.IOReadCloser(), nil
+	default:
+		return ioutil.NopCloser(blob), nil
+	}
 }
 
-func needsGunzip(mediaType string) bool {
-	return mediaType == ispec.MediaTypeImageLayerGzip || mediaType == ispec.MediaTypeImageLayerNonDistributableGzip
+// Magic numbers at the start of compressed layer streams.
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// layerCompression returns the compression suffix ("gzip", "zstd" or "" for
+// uncompressed layers) used by the given layer media type.
+func layerCompression(mediaType string) string {
+	switch mediaType {
+	case ispec.MediaTypeImageLayerGzip, ispec.MediaTypeImageLayerNonDistributableGzip:
+		return "gzip"
+	case mediatype.MediaTypeImageLayerZstd, mediatype.MediaTypeImageLayerNonDistributableZstd:
+		return "zstd"
+	default:
+		return ""
+	}
+}
+
+// detectLayerCompression sniffs the first bytes of the given layer blob to
+// figure out how it is actually compressed, returning the media type which
+// should be used to decompress it (based on the compression used rather than
+// what the descriptor claims) and a reader which must be used in place of the
+// blob. A warning is logged if the detected compression doesn't match the
+// media type of the descriptor.
+func detectLayerCompression(layerDescriptor ispec.Descriptor, blob io.ReadCloser) (string, io.ReadCloser, error) {
+	buffered := bufio.NewReader(blob)
+	reader := struct {
+		io.Reader
+		io.Closer
+	}{buffered, blob}
+
+	magic, err := buffered.Peek(len(zstdMagic))
+	if err != nil && err != io.EOF {
+		return "", nil, errors.Wrap(err, "read layer header")
+	}
+	var detected, mediaType string
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		detected, mediaType = "gzip", ispec.MediaTypeImageLayerGzip
+	case bytes.HasPrefix(magic, zstdMagic):
+		detected, mediaType = "zstd", mediatype.MediaTypeImageLayerZstd
+	default:
+		detected, mediaType = "", ispec.MediaTypeImageLayer
+	}
+	if declared := layerCompression(layerDescriptor.MediaType); declared != detected {
+		if detected == "" {
+			detected = "uncompressed"
+		}
+		log.Warnf("layer %s: media type %s does not match detected compression (%s) -- this may indicate a bug in the tool which built this image", layerDescriptor.Digest, layerDescriptor.MediaType, detected)
+	}
+	return mediaType, reader, nil
+}
+
+// DecompressLayer returns a reader for the raw tar stream of the given layer
+// blob (which has the given media type). Uncompressed layers are passed
+// through as-is, and an error is returned if the media type is not a layer
+// media type. The caller is responsible for closing the returned reader, which
+// does not close the underlying blob.
+func DecompressLayer(mediaType string, blob io.Reader) (io.ReadCloser, error) {
+	if !isLayerType(mediaType) {
+		return nil, errors.Errorf("blob is not correct mediatype: %s", mediaType)
+	}
+	return decompressLayer(mediaType, blob)
+}
+
+// UncompressedSize returns the size of the raw tar stream of the given layer
+// blob (which has the given media type), by decompressing the entire blob.
+func UncompressedSize(mediaType string, blob io.Reader) (int64, error) {
+	layer, err := decompressLayer(mediaType, blob)
+	if err != nil {
+		return -1, err
+	}
+	defer layer.Close()
+
+	size, err := system.Copy(ioutil.Discard, layer)
+	if err != nil {
+		return -1, errors.Wrap(err, "decompress layer")
+	}
+	return size, nil
+}
+
+// DiffID returns the DiffID of the layer referenced by the given descriptor
+// (the digest of the uncompressed tar stream, as stored in the rootfs.diff_ids
+// of the image configuration). The layer blob is decompressed as it is read
+// from the engine, and its digest is verified against the descriptor.
+func DiffID(ctx context.Context, engine cas.Engine, descriptor ispec.Descriptor) (digest.Digest, error) {
+	if !isLayerType(descriptor.MediaType) {
+		return "", errors.Errorf("compute diffid: layer %s: blob is not correct mediatype: %s", descriptor.Digest, descriptor.MediaType)
+	}
+
+	engineExt := casext.NewEngine(engine)
+	blob, err := engineExt.GetVerifiedBlob(ctx, descriptor)
+	if err != nil {
+		return "", errors.Wrap(err, "get layer blob")
+	}
+	defer blob.Close()
+
+	blobReader := bufio.NewReader(blob)
+	layerRaw, err := decompressLayer(descriptor.MediaType, blobReader)
+	if err != nil {
+		return "", errors.Wrap(err, "decompress layer")
+	}
+	defer layerRaw.Close()
+
+	diffID, err := digest.SHA256.FromReader(layerRaw)
+	if err != nil {
+		return "", errors.Wrap(err, "compute diffid")
+	}
+	// Decompressors don't necessarily read the blob until EOF, so consume
+	// whatever is left to make sure the blob digest is verified.
+	if _, err := system.Copy(ioutil.Discard, blobReader); err != nil {
+		return "", errors.Wrap(err, "discard trailing raw bits")
+	}
+	if err := blob.Close(); err != nil {
+		return "", errors.Wrap(err, "verify layer blob")
+	}
+	return diffID, nil
 }
 
 // UnpackManifest extracts all of the layers in the given manifest, as well as
@@ -150,7 +312,7 @@ func UnpackManifest(ctx context.Context, engine cas.Engine, bundle string, manif
 	}
 	defer configFile.Close()
 
-	if err := UnpackRuntimeJSON(ctx, engine, configFile, rootfsPath, manifest, &opt.MapOptions); err != nil {
+	if err := UnpackRuntimeJSONWithOptions(ctx, engine, configFile, rootfsPath, manifest, opt); err != nil {
 		return errors.Wrap(err, "unpack config.json")
 	}
 	return nil
@@ -161,25 +323,143 @@ func UnpackManifest(ctx context.Context, engine cas.Engine, bundle string, manif
 func UnpackRootfs(ctx context.Context, engine cas.Engine, rootfsPath string, manifest ispec.Manifest, opt *UnpackOptions) (err error) {
 	engineExt := casext.NewEngine(engine)
 
-	if err := os.Mkdir(rootfsPath, 0755); err != nil && !os.IsExist(err) {
-		return errors.Wrap(err, "mkdir rootfs")
+	created := true
+	if err := os.Mkdir(rootfsPath, 0755); err != nil {
+		if !os.IsExist(err) {
+			return errors.Wrap(err, "mkdir rootfs")
+		}
+		created = false
 	}
 
 	// In order to avoid having a broken rootfs in the case of an error, we
 	// remove the rootfs. In the case of rootless this is particularly
-	// important (`rm -rf` won't work on most distro rootfs's).
+	// important (`rm -rf` won't work on most distro rootfs's). If the rootfs
+	// directory already existed, we only remove its contents so that we
+	// don't remove a directory we didn't create.
 	defer func() {
 		if err != nil {
 			fsEval := fseval.Default
 			if opt != nil && opt.MapOptions.Rootless {
 				fsEval = fseval.Rootless
 			}
-			// It's too late to care about errors.
-			// #nosec G104
-			_ = fsEval.RemoveAll(rootfsPath)
+			if created {
+				// It's too late to care about errors.
+				// #nosec G104
+				_ = fsEval.RemoveAll(rootfsPath)
+				return
+			}
+			children, _ := fsEval.Readdir(rootfsPath)
+			for _, child := range children {
+				// #nosec G104
+				_ = fsEval.RemoveAll(filepath.Join(rootfsPath, child.Name()))
+			}
 		}
 	}()
 
+	if err := prepareRoot(rootfsPath, opt); err != nil {
+		return err
+	}
+
+	// In order to verify the DiffIDs as we extract layers, we have to get the
+	// .Config blob first. But we can't extract it (generate the runtime
+	// config) until after we have the full rootfs generated.
+	config, err := getLayersConfig(ctx, engineExt, manifest)
+	if err != nil {
+		return errors.Wrap(err, "unpack rootfs")
+	}
+
+	// Figure out which layers need to be extracted.
+	start := 0
+	if opt.StartFrom.MediaType != "" {
+		start = len(manifest.Layers)
+		for idx, layerDescriptor := range manifest.Layers {
+			if layerDescriptor.Digest.String() == opt.StartFrom.Digest.String() {
+				start = idx
+				break
+			}
+		}
+	}
+
+	// If we have a layer cache, restore the snapshot of the longest prefix of
+	// the layers we have cached rather than extracting them.
+	var (
+		cache  *layerCache
+		chain  []digest.Digest
+		cached int
+	)
+	if opt.LayerCache != "" && opt.StartFrom.MediaType == "" {
+		cache, err = openLayerCache(opt)
+		if err != nil {
+			return errors.Wrap(err, "unpack rootfs")
+		}
+		chain = chainIDs(config.RootFS.DiffIDs)
+		if cached = cache.Lookup(chain); cached > 0 {
+			log.Infof("unpack layers: restoring %d cached layers: %s", cached, chain[cached-1])
+			var onPath func(string)
+			if opt.OnPathChange != nil {
+				onPath = func(path string) {
+					opt.OnPathChange(filepath.Join("/", path), PathCreated)
+				}
+			}
+			if err := cache.Restore(chain[cached-1], rootfsPath, onPath); err != nil {
+				return errors.Wrap(err, "unpack rootfs")
+			}
+			start = cached
+		}
+	}
+
+	// Progress is reported in terms of the (compressed) layer blobs.
+	var total int64
+	for _, layerDescriptor := range manifest.Layers[start:] {
+		total += layerDescriptor.Size
+	}
+	progress := newProgressCounter(opt.Progress, total)
+
+	// Layer extraction.
+	for idx, layerDescriptor := range manifest.Layers {
+		if idx < start {
+			// Layers restored from the cache still count as being unpacked.
+			if idx < cached && opt.AfterLayerUnpack != nil {
+				if err := opt.AfterLayerUnpack(manifest, layerDescriptor); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		layerDiffID := config.RootFS.DiffIDs[idx]
+		log.Infof("unpack layer: %s", layerDescriptor.Digest)
+
+		if err := unpackLayerBlob(ctx, engineExt, rootfsPath, nil, layerDescriptor, layerDiffID, opt, progress); err != nil {
+			return err
+		}
+
+		// Failing to populate the cache shouldn't cause the unpack to fail.
+		// Snapshots of intermediate layers are only stored if they can be
+		// reflinked, as otherwise we would copy the whole rootfs after every
+		// layer. The final rootfs is always stored.
+		if cache != nil {
+			final := idx == len(manifest.Layers)-1
+			if err := cache.Store(chain[idx], rootfsPath, !final); errors.Is(err, errNoReflink) {
+				log.Debugf("unpack layer: not adding intermediate layer to layer cache: %v", err)
+			} else if err != nil {
+				log.Warnf("unpack layer: could not add layer to layer cache: %v", err)
+			}
+		}
+
+		if opt.AfterLayerUnpack != nil {
+			if err := opt.AfterLayerUnpack(manifest, layerDescriptor); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// prepareRoot sets the ownership and timestamps of the (already existing)
+// root directory which layers will be extracted into.
+func prepareRoot(root string, opt *UnpackOptions) error {
 	// Make sure that the owner is correct.
 	rootUID, err := idtools.ToHost(0, opt.MapOptions.UIDMappings)
 	if err != nil {
@@ -189,7 +469,7 @@ func UnpackRootfs(ctx context.Context, engine cas.Engine, rootfsPath string, man
 	if err != nil {
 		return errors.Wrap(err, "ensure rootgid has mapping")
 	}
-	if err := os.Lchown(rootfsPath, rootUID, rootGID); err != nil {
+	if err := os.Lchown(root, rootUID, rootGID); err != nil {
 		return errors.Wrap(err, "chown rootfs")
 	}
 
@@ -199,112 +479,198 @@ func UnpackRootfs(ctx context.Context, engine cas.Engine, rootfsPath string, man
 	// this, we first set the mtime of the root directory to the Unix epoch
 	// (which is as good of an arbitrary choice as any).
 	epoch := time.Unix(0, 0)
-	if err := system.Lutimes(rootfsPath, epoch, epoch); err != nil {
+	if err := system.Lutimes(root, epoch, epoch); err != nil {
 		return errors.Wrap(err, "set initial root time")
 	}
 
-	// In order to verify the DiffIDs as we extract layers, we have to get the
-	// .Config blob first. But we can't extract it (generate the runtime
-	// config) until after we have the full rootfs generated.
+	return nil
+}
+
+// getLayersConfig fetches the image configuration for the given manifest, and
+// verifies that it describes a layer-based image.
+func getLayersConfig(ctx context.Context, engineExt casext.Engine, manifest ispec.Manifest) (ispec.Image, error) {
 	configBlob, err := engineExt.FromDescriptor(ctx, manifest.Config)
 	if err != nil {
-		return errors.Wrap(err, "get config blob")
+		return ispec.Image{}, errors.Wrap(err, "get config blob")
 	}
 	defer configBlob.Close()
 	if configBlob.Descriptor.MediaType != ispec.MediaTypeImageConfig {
-		return errors.Errorf("unpack rootfs: config blob is not correct mediatype %s: %s", ispec.MediaTypeImageConfig, configBlob.Descriptor.MediaType)
+		return ispec.Image{}, errors.Errorf("config blob is not correct mediatype %s: %s", ispec.MediaTypeImageConfig, configBlob.Descriptor.MediaType)
 	}
 	config, ok := configBlob.Data.(ispec.Image)
 	if !ok {
 		// Should _never_ be reached.
-		return errors.Errorf("[internal error] unknown config blob type: %s", configBlob.Descriptor.MediaType)
+		return ispec.Image{}, errors.Errorf("[internal error] unknown config blob type: %s", configBlob.Descriptor.MediaType)
 	}
 
 	// We can't understand non-layer images.
 	if config.RootFS.Type != "layers" {
-		return errors.Errorf("unpack rootfs: config: unsupported rootfs.type: %s", config.RootFS.Type)
+		return ispec.Image{}, errors.Errorf("config: unsupported rootfs.type: %s", config.RootFS.Type)
 	}
+	if len(config.RootFS.DiffIDs) != len(manifest.Layers) {
+		return ispec.Image{}, errors.Errorf("config: number of diffids (%d) doesn't match number of layers (%d)", len(config.RootFS.DiffIDs), len(manifest.Layers))
+	}
+	return config, nil
+}
 
-	// Layer extraction.
-	found := false
-	for idx, layerDescriptor := range manifest.Layers {
-		if !found && opt.StartFrom.MediaType != "" && layerDescriptor.Digest.String() != opt.StartFrom.Digest.String() {
-			continue
-		}
-		found = true
-
-		layerDiffID := config.RootFS.DiffIDs[idx]
-		log.Infof("unpack layer: %s", layerDescriptor.Digest)
+// UnpackLayerDescriptor extracts the single layer blob referenced by the
+// given descriptor into root, without applying any of the other layers in the
+// image. The blob must have one of the layer media types (compressed or
+// otherwise). Use LiteralWhiteout as the WhiteoutMode in order to extract
+// whiteouts as ordinary files rather than applying them.
+func UnpackLayerDescriptor(ctx context.Context, engine cas.Engine, root string, layerDescriptor ispec.Descriptor, opt *UnpackOptions) error {
+	engineExt := casext.NewEngine(engine)
+	var progressFn ProgressFunc
+	if opt != nil {
+		progressFn = opt.Progress
+	}
+	progress := newProgressCounter(progressFn, layerDescriptor.Size)
+	return unpackLayerBlob(ctx, engineExt, root, nil, layerDescriptor, "", opt, progress)
+}
 
-		layerBlob, err := engineExt.FromDescriptor(ctx, layerDescriptor)
-		if err != nil {
-			return errors.Wrap(err, "get layer blob")
+// getLayerBlob returns a verified reader for the (compressed) blob of the
+// given layer. Non-distributable layers which are not included in the image
+// are fetched from the URLs in their descriptor, but only if allowForeign is
+// set -- otherwise an error is returned.
+func getLayerBlob(ctx context.Context, engineExt casext.Engine, layerDescriptor ispec.Descriptor, allowForeign bool) (io.ReadCloser, error) {
+	if !isLayerType(layerDescriptor.MediaType) {
+		return nil, errors.Errorf("layer %s: blob is not correct mediatype: %s", layerDescriptor.Digest, layerDescriptor.MediaType)
+	}
+	blob, err := engineExt.GetVerifiedBlob(ctx, layerDescriptor)
+	if err != nil {
+		if !casext.IsNotExist(err) || !mediatype.IsNonDistributable(layerDescriptor.MediaType) {
+			return nil, errors.Wrapf(err, "get layer %s blob", layerDescriptor.Digest)
 		}
-		defer layerBlob.Close()
-		if !isLayerType(layerBlob.Descriptor.MediaType) {
-			return errors.Errorf("unpack rootfs: layer %s: blob is not correct mediatype: %s", layerBlob.Descriptor.Digest, layerBlob.Descriptor.MediaType)
+		// Non-distributable layers are usually not included in images.
+		if !allowForeign {
+			return nil, errors.Errorf("layer %s: non-distributable layer is not included in the image and fetching foreign layers is disabled (layer urls: %v)", layerDescriptor.Digest, layerDescriptor.URLs)
 		}
-		layerData, ok := layerBlob.Data.(io.ReadCloser)
-		if !ok {
-			// Should _never_ be reached.
-			return errors.Errorf("[internal error] layerBlob was not an io.ReadCloser")
+		blob, err = casext.GetForeignBlob(ctx, nil, layerDescriptor)
+		if err != nil {
+			return nil, errors.Wrapf(err, "layer %s", layerDescriptor.Digest)
 		}
+	}
+	return blob, nil
+}
 
-		layerRaw := layerData
-		if needsGunzip(layerBlob.Descriptor.MediaType) {
-			// We have to extract a gzip'd version of the above layer. Also note
-			// that we have to check the DiffID we're extracting (which is the
-			// sha256 sum of the *uncompressed* layer).
-			layerRaw, err = gzip.NewReader(layerData)
-			if err != nil {
-				return errors.Wrap(err, "create gzip reader")
-			}
-		}
+// blobVerifyReader wraps the verified reader of a layer blob, and records the
+// first verification error (the blob not matching its descriptor) returned
+// from it. Closing the reader consumes the rest of the blob first, so that a
+// mismatch is always detected even if unpacking stopped early.
+type blobVerifyReader struct {
+	blob   io.ReadCloser
+	err    error
+	closed bool
+}
 
-		layerDigester := digest.SHA256.Digester()
-		layer := io.TeeReader(layerRaw, layerDigester.Hash())
+func (b *blobVerifyReader) Read(p []byte) (int, error) {
+	n, err := b.blob.Read(p)
+	if cause := errors.Cause(err); b.err == nil && (cause == hardening.ErrDigestMismatch || cause == hardening.ErrSizeMismatch) {
+		b.err = err
+	}
+	return n, err
+}
 
-		if err := UnpackLayer(rootfsPath, layer, opt); err != nil {
-			return errors.Wrap(err, "unpack layer")
-		}
-		// Different tar implementations can have different levels of redundant
-		// padding and other similar weird behaviours. While on paper they are
-		// all entirely valid archives, Go's tar.Reader implementation doesn't
-		// guarantee that the entire stream will be consumed (which can result
-		// in the later diff_id check failing because the digester didn't get
-		// the whole uncompressed stream). Just blindly consume anything left
-		// in the layer.
-		if n, err := system.Copy(ioutil.Discard, layer); err != nil {
-			return errors.Wrap(err, "discard trailing archive bits")
-		} else if n != 0 {
-			log.Debugf("unpack manifest: layer %s: ignoring %d trailing 'junk' bytes in the tar stream -- probably from GNU tar", layerDescriptor.Digest, n)
-		}
-		// Same goes for compressed layers -- it seems like some gzip
-		// implementations add trailing NUL bytes, which Go doesn't slurp up.
-		// Just eat up the rest of the remaining bytes and discard them.
-		//
-		// FIXME: We use layerData here because pgzip returns io.EOF from
-		// WriteTo, which causes havoc with system.Copy. Ideally we would use
-		// layerRaw. See <https://github.com/klauspost/pgzip/issues/38>.
-		if n, err := system.Copy(ioutil.Discard, layerData); err != nil {
-			return errors.Wrap(err, "discard trailing raw bits")
-		} else if n != 0 {
-			log.Warnf("unpack manifest: layer %s: ignoring %d trailing 'junk' bytes in the blob stream -- this may indicate a bug in the tool which built this image", layerDescriptor.Digest, n)
+func (b *blobVerifyReader) Close() error {
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	// #nosec G104
+	_, _ = system.Copy(ioutil.Discard, b)
+	if err := b.blob.Close(); err != nil {
+		return err
+	}
+	return b.err
+}
+
+// unpackLayerBlob extracts the layer referenced by the given descriptor into
+// root, verifying that the uncompressed layer matches layerDiffID (unless
+// layerDiffID is empty). The (compressed) blob data read is reported to
+// progress. If the lower layers were extracted to separate directories, they
+// must be given in lowerRoots (top-most first) so that hardlinks to files in
+// lower layers can be resolved.
+//
+// The blob is verified against the digest and size in layerDescriptor while
+// it is being extracted. If the blob doesn't match, an error is returned
+// (with hardening.ErrDigestMismatch or hardening.ErrSizeMismatch as its
+// cause) even if extraction failed for some other reason first, since a
+// corrupted blob will usually also be an invalid archive.
+func unpackLayerBlob(ctx context.Context, engineExt casext.Engine, root string, lowerRoots []string, layerDescriptor ispec.Descriptor, layerDiffID digest.Digest, opt *UnpackOptions, progress *progressCounter) (Err error) {
+	var allowForeign bool
+	if opt != nil {
+		allowForeign = opt.AllowForeignLayers
+	}
+	verifiedBlob, err := getLayerBlob(ctx, engineExt, layerDescriptor, allowForeign)
+	if err != nil {
+		return errors.Wrap(err, "unpack rootfs")
+	}
+	layerBlob := &blobVerifyReader{blob: verifiedBlob}
+	defer func() {
+		// #nosec G104
+		_ = layerBlob.Close()
+		if layerBlob.err != nil {
+			Err = errors.Wrapf(layerBlob.err, "unpack manifest: layer %s: blob does not match descriptor", layerDescriptor.Digest)
 		}
-		if err := layerData.Close(); err != nil {
-			return errors.Wrap(err, "close layer data")
+	}()
+	var layerData io.ReadCloser = struct {
+		io.Reader
+		io.Closer
+	}{progress.Reader(layerBlob), layerBlob}
+
+	// We have to extract a decompressed version of the above layer. Also
+	// note that we have to check the DiffID we're extracting (which is the
+	// sha256 sum of the *uncompressed* layer).
+	mediaType := layerDescriptor.MediaType
+	if opt != nil && opt.DetectCompression {
+		mediaType, layerData, err = detectLayerCompression(layerDescriptor, layerData)
+		if err != nil {
+			return errors.Wrap(err, "detect layer compression")
 		}
+	}
+	layerRaw, err := decompressLayer(mediaType, layerData)
+	if err != nil {
+		return errors.Wrap(err, "decompress layer")
+	}
+	defer layerRaw.Close()
 
-		layerDigest := layerDigester.Digest()
-		if layerDigest != layerDiffID {
-			return errors.Errorf("unpack manifest: layer %s: diffid mismatch: got %s expected %s", layerDescriptor.Digest, layerDigest, layerDiffID)
-		}
+	layerDigester := digest.SHA256.Digester()
+	layer := io.TeeReader(layerRaw, layerDigester.Hash())
 
-		if opt.AfterLayerUnpack != nil {
-			if err := opt.AfterLayerUnpack(manifest, layerDescriptor); err != nil {
-				return err
-			}
-		}
+	if err := unpackLayer(root, layer, opt, lowerRoots); err != nil {
+		return errors.Wrap(err, "unpack layer")
+	}
+	// Different tar implementations can have different levels of redundant
+	// padding and other similar weird behaviours. While on paper they are
+	// all entirely valid archives, Go's tar.Reader implementation doesn't
+	// guarantee that the entire stream will be consumed (which can result
+	// in the later diff_id check failing because the digester didn't get
+	// the whole uncompressed stream). Just blindly consume anything left
+	// in the layer.
+	if n, err := system.Copy(ioutil.Discard, layer); err != nil {
+		return errors.Wrap(err, "discard trailing archive bits")
+	} else if n != 0 {
+		log.Debugf("unpack manifest: layer %s: ignoring %d trailing 'junk' bytes in the tar stream -- probably from GNU tar", layerDescriptor.Digest, n)
+	}
+	// Same goes for compressed layers -- it seems like some gzip
+	// implementations add trailing NUL bytes, which Go doesn't slurp up.
+	// Just eat up the rest of the remaining bytes and discard them.
+	//
+	// FIXME: We use layerData here because pgzip returns io.EOF from
+	// WriteTo, which causes havoc with system.Copy. Ideally we would use
+	// layerRaw. See <https://github.com/klauspost/pgzip/issues/38>.
+	if n, err := system.Copy(ioutil.Discard, layerData); err != nil {
+		return errors.Wrap(err, "discard trailing raw bits")
+	} else if n != 0 {
+		log.Warnf("unpack manifest: layer %s: ignoring %d trailing 'junk' bytes in the blob stream -- this may indicate a bug in the tool which built this image", layerDescriptor.Digest, n)
+	}
+	if err := layerData.Close(); err != nil {
+		return errors.Wrap(err, "close layer data")
+	}
+
+	layerDigest := layerDigester.Digest()
+	if layerDiffID != "" && layerDigest != layerDiffID {
+		return errors.Errorf("unpack manifest: layer %s: diffid mismatch: got %s expected %s", layerDescriptor.Digest, layerDigest, layerDiffID)
 	}
 
 	return nil
@@ -320,11 +686,40 @@ func UnpackRootfs(ctx context.Context, engine cas.Engine, rootfsPath string, man
 //
 // XXX: I don't like this API. It has way too many arguments.
 func UnpackRuntimeJSON(ctx context.Context, engine cas.Engine, configFile io.Writer, rootfs string, manifest ispec.Manifest, opt *MapOptions) error {
+	var unpackOptions UnpackOptions
+	if opt != nil {
+		unpackOptions.MapOptions = *opt
+	}
+	return UnpackRuntimeJSONWithOptions(ctx, engine, configFile, rootfs, manifest, &unpackOptions)
+}
+
+// UnpackRuntimeJSONWithOptions is the same as UnpackRuntimeJSON, except that
+// the runtime configuration is generated according to opt.MapOptions and
+// opt.RuntimeOptions (the other options are ignored).
+func UnpackRuntimeJSONWithOptions(ctx context.Context, engine cas.Engine, configFile io.Writer, rootfs string, manifest ispec.Manifest, opt *UnpackOptions) error {
+	spec, err := unpackRuntimeSpec(ctx, engine, rootfs, manifest, opt)
+	if err != nil {
+		return err
+	}
+
+	// Save the config.json.
+	enc := json.NewEncoder(configFile)
+	enc.SetIndent("", "\t")
+	return errors.Wrap(enc.Encode(spec), "write config.json")
+}
+
+// unpackRuntimeSpec is the implementation of UnpackRuntimeJSON, returning the
+// generated runtime configuration rather than writing it.
+func unpackRuntimeSpec(ctx context.Context, engine cas.Engine, rootfs string, manifest ispec.Manifest, opt *UnpackOptions) (rspec.Spec, error) {
 	engineExt := casext.NewEngine(engine)
 
-	var mapOptions MapOptions
+	var (
+		mapOptions     MapOptions
+		runtimeOptions RuntimeOptions
+	)
 	if opt != nil {
-		mapOptions = *opt
+		mapOptions = opt.MapOptions
+		runtimeOptions = opt.RuntimeOptions
 	}
 
 	// In order to verify the DiffIDs as we extract layers, we have to get the
@@ -332,21 +727,21 @@ func UnpackRuntimeJSON(ctx context.Context, engine cas.Engine, configFile io.Wri
 	// config) until after we have the full rootfs generated.
 	configBlob, err := engineExt.FromDescriptor(ctx, manifest.Config)
 	if err != nil {
-		return errors.Wrap(err, "get config blob")
+		return rspec.Spec{}, errors.Wrap(err, "get config blob")
 	}
 	defer configBlob.Close()
 	if configBlob.Descriptor.MediaType != ispec.MediaTypeImageConfig {
-		return errors.Errorf("unpack manifest: config blob is not correct mediatype %s: %s", ispec.MediaTypeImageConfig, configBlob.Descriptor.MediaType)
+		return rspec.Spec{}, errors.Errorf("unpack manifest: config blob is not correct mediatype %s: %s", ispec.MediaTypeImageConfig, configBlob.Descriptor.MediaType)
 	}
 	config, ok := configBlob.Data.(ispec.Image)
 	if !ok {
 		// Should _never_ be reached.
-		return errors.Errorf("[internal error] unknown config blob type: %s", configBlob.Descriptor.MediaType)
+		return rspec.Spec{}, errors.Errorf("[internal error] unknown config blob type: %s", configBlob.Descriptor.MediaType)
 	}
 
 	spec, err := iconv.ToRuntimeSpec(rootfs, config)
 	if err != nil {
-		return errors.Wrap(err, "generate config.json")
+		return rspec.Spec{}, errors.Wrap(err, "generate config.json")
 	}
 
 	// Add UIDMapping / GIDMapping options.
@@ -366,12 +761,41 @@ func UnpackRuntimeJSON(ctx context.Context, engine cas.Engine, configFile io.Wri
 	spec.Linux.GIDMappings = mapOptions.GIDMappings
 	if mapOptions.Rootless {
 		if err := iconv.ToRootless(&spec); err != nil {
-			return errors.Wrap(err, "convert spec to rootless")
+			return rspec.Spec{}, errors.Wrap(err, "convert spec to rootless")
 		}
 	}
 
-	// Save the config.json.
-	enc := json.NewEncoder(configFile)
-	enc.SetIndent("", "\t")
-	return errors.Wrap(enc.Encode(spec), "write config.json")
+	// Apply the hardening options.
+	if runtimeOptions.NoHardening {
+		spec.Linux.MaskedPaths = nil
+		spec.Linux.ReadonlyPaths = nil
+	}
+	spec.Linux.MaskedPaths = appendPaths(spec.Linux.MaskedPaths, runtimeOptions.MaskedPaths)
+	spec.Linux.ReadonlyPaths = appendPaths(spec.Linux.ReadonlyPaths, runtimeOptions.ReadonlyPaths)
+	if runtimeOptions.DefaultCapabilities {
+		spec.Process.Capabilities = iconv.DefaultCapabilitySet()
+	}
+	if runtimeOptions.Seccomp != nil {
+		seccomp := *runtimeOptions.Seccomp
+		spec.Linux.Seccomp = &seccomp
+	}
+
+	return spec, nil
+}
+
+// appendPaths appends the paths in extra to paths, skipping any paths which
+// are already present.
+func appendPaths(paths, extra []string) []string {
+	seen := map[string]struct{}{}
+	for _, path := range paths {
+		seen[path] = struct{}{}
+	}
+	for _, path := range extra {
+		if _, ok := seen[path]; ok {
+			continue
+		}
+		seen[path] = struct{}{}
+		paths = append(paths, path)
+	}
+	return paths
 }
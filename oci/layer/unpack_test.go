@@ -18,21 +18,33 @@
 package layer
 
 import (
+	"archive/tar"
 	"bytes"
 	"context"
 	"encoding/base64"
+	"encoding/json"
 	"io"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 
+	zstd "github.com/klauspost/compress/zstd"
+	gzip "github.com/klauspost/pgzip"
 	"github.com/opencontainers/go-digest"
 	"github.com/opencontainers/image-spec/specs-go"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	rspec "github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/opencontainers/umoci/oci/cas/dir"
 	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/opencontainers/umoci/oci/casext/mediatype"
+	iconv "github.com/opencontainers/umoci/oci/config/convert"
+	"github.com/opencontainers/umoci/pkg/hardening"
+	"github.com/pkg/errors"
 )
 
 func mustDecodeString(s string) []byte {
@@ -220,3 +232,720 @@ func TestUnpackStartFromDescriptor(t *testing.T) {
 		t.Errorf("test file present? %+v\n", err)
 	}
 }
+
+// Make sure that zstd-compressed layers are transparently decompressed based
+// on their media-type during unpacking.
+func TestUnpackManifestZstd(t *testing.T) {
+	ctx := context.Background()
+
+	root, manifest, engineExt := makeImage(t)
+	defer os.RemoveAll(root)
+
+	// Re-compress all of the gzip layers as zstd. The DiffIDs are unchanged
+	// because they are computed from the uncompressed archive.
+	for idx, layerDescriptor := range manifest.Layers {
+		layerBlob, err := engineExt.GetBlob(ctx, layerDescriptor.Digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gzr, err := gzip.NewReader(layerBlob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var compressed bytes.Buffer
+		zw, err := zstd.NewWriter(&compressed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.Copy(zw, gzr); err != nil {
+			t.Fatal(err)
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		gzr.Close()
+		layerBlob.Close()
+
+		layerDigest, layerSize, err := engineExt.PutBlob(ctx, &compressed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		manifest.Layers[idx] = ispec.Descriptor{
+			MediaType: mediatype.MediaTypeImageLayerZstd,
+			Digest:    layerDigest,
+			Size:      layerSize,
+		}
+	}
+
+	bundle, err := ioutil.TempDir("", "umoci-TestUnpackManifestZstd_bundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(bundle)
+
+	// Unpack (we map both root and the uid/gid in the archives to the current user).
+	unpackOptions := &UnpackOptions{MapOptions: MapOptions{
+		UIDMappings: []rspec.LinuxIDMapping{
+			{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1},
+			{HostID: uint32(os.Geteuid()), ContainerID: 1000, Size: 1},
+		},
+		GIDMappings: []rspec.LinuxIDMapping{
+			{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1},
+			{HostID: uint32(os.Getegid()), ContainerID: 100, Size: 1},
+		},
+		Rootless: os.Geteuid() != 0,
+	}}
+	if err := UnpackManifest(ctx, engineExt, bundle, manifest, unpackOptions); err != nil {
+		t.Fatalf("unexpected UnpackManifest error: %+v\n", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(bundle, "rootfs/test_file")); err != nil {
+		t.Errorf("test file missing after unpack: %+v\n", err)
+	}
+}
+
+func TestUnpackManifestDetectCompression(t *testing.T) {
+	ctx := context.Background()
+
+	for _, mislabel := range []string{
+		ispec.MediaTypeImageLayer,
+		mediatype.MediaTypeImageLayerZstd,
+	} {
+		t.Run(mislabel, func(t *testing.T) {
+			root, manifest, engineExt := makeImage(t)
+			defer os.RemoveAll(root)
+
+			// Mislabel all of the (gzip) layers.
+			for idx := range manifest.Layers {
+				manifest.Layers[idx].MediaType = mislabel
+			}
+
+			unpackOptions := &UnpackOptions{MapOptions: MapOptions{
+				UIDMappings: []rspec.LinuxIDMapping{
+					{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1},
+					{HostID: uint32(os.Geteuid()), ContainerID: 1000, Size: 1},
+				},
+				GIDMappings: []rspec.LinuxIDMapping{
+					{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1},
+					{HostID: uint32(os.Getegid()), ContainerID: 100, Size: 1},
+				},
+				Rootless: os.Geteuid() != 0,
+			}}
+
+			// By default, the media type is trusted and so unpacking fails.
+			bundle, err := ioutil.TempDir("", "umoci-TestUnpackManifestDetectCompression_bundle")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(bundle)
+			if err := UnpackManifest(ctx, engineExt, bundle, manifest, unpackOptions); err == nil {
+				t.Fatalf("expected UnpackManifest of mislabelled layers to fail")
+			}
+
+			// With DetectCompression, the actual compression is used.
+			detectBundle, err := ioutil.TempDir("", "umoci-TestUnpackManifestDetectCompression_bundle")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(detectBundle)
+			unpackOptions.DetectCompression = true
+			if err := UnpackManifest(ctx, engineExt, detectBundle, manifest, unpackOptions); err != nil {
+				t.Fatalf("unexpected UnpackManifest error: %+v\n", err)
+			}
+			if _, err := os.Stat(filepath.Join(detectBundle, "rootfs/test_file")); err != nil {
+				t.Errorf("test file missing after unpack: %+v\n", err)
+			}
+		})
+	}
+}
+
+func TestUnpackLayerDescriptorLiteralWhiteout(t *testing.T) {
+	ctx := context.Background()
+
+	root, _, engineExt := makeImage(t)
+	defer os.RemoveAll(root)
+
+	// Create a layer containing some whiteouts.
+	var layer bytes.Buffer
+	tw := tar.NewWriter(&layer)
+	for _, hdr := range []*tar.Header{
+		{Name: "a/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "a/file", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "a/.wh.gone", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "b/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "b/.wh..wh..opq", Typeflag: tar.TypeReg, Mode: 0644},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	layerDigest, layerSize, err := engineExt.PutBlob(ctx, &layer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layerDescriptor := ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageLayer,
+		Digest:    layerDigest,
+		Size:      layerSize,
+	}
+
+	rootfs, err := ioutil.TempDir("", "umoci-TestUnpackLayerDescriptorLiteralWhiteout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootfs)
+
+	unpackOptions := &UnpackOptions{
+		MapOptions: MapOptions{
+			UIDMappings: []rspec.LinuxIDMapping{{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1}},
+			GIDMappings: []rspec.LinuxIDMapping{{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1}},
+			Rootless:    os.Geteuid() != 0,
+		},
+		WhiteoutMode: LiteralWhiteout,
+	}
+	if err := UnpackLayerDescriptor(ctx, engineExt, rootfs, layerDescriptor, unpackOptions); err != nil {
+		t.Fatalf("unexpected error in UnpackLayerDescriptor: %+v", err)
+	}
+
+	// The whiteouts must have been extracted as-is.
+	for _, path := range []string{"a/file", "a/.wh.gone", "b/.wh..wh..opq"} {
+		fi, err := os.Lstat(filepath.Join(rootfs, path))
+		if err != nil {
+			t.Errorf("expected %s to exist: %v", path, err)
+			continue
+		}
+		if !fi.Mode().IsRegular() {
+			t.Errorf("expected %s to be a regular file, got %s", path, fi.Mode())
+		}
+	}
+
+	// Non-layer blobs must be rejected.
+	badDescriptor := layerDescriptor
+	badDescriptor.MediaType = ispec.MediaTypeImageConfig
+	if err := UnpackLayerDescriptor(ctx, engineExt, rootfs, badDescriptor, unpackOptions); err == nil {
+		t.Errorf("expected UnpackLayerDescriptor to fail with non-layer media type")
+	}
+}
+
+func TestUnpackRuntimeJSONHardening(t *testing.T) {
+	ctx := context.Background()
+
+	root, manifest, engineExt := makeImage(t)
+	defer os.RemoveAll(root)
+
+	for _, test := range []struct {
+		name             string
+		opt              RuntimeOptions
+		expectedMasked   []string
+		expectedReadonly []string
+	}{
+		{"Default", RuntimeOptions{}, iconv.DefaultMaskedPaths(), iconv.DefaultReadonlyPaths()},
+		{"NoHardening", RuntimeOptions{NoHardening: true}, nil, nil},
+		{"Extra", RuntimeOptions{
+			MaskedPaths:   []string{"/proc/kcore", "/proc/foo"},
+			ReadonlyPaths: []string{"/proc/bar"},
+		}, append(iconv.DefaultMaskedPaths(), "/proc/foo"), append(iconv.DefaultReadonlyPaths(), "/proc/bar")},
+		{"NoHardeningExtra", RuntimeOptions{
+			NoHardening:   true,
+			MaskedPaths:   []string{"/proc/foo"},
+			ReadonlyPaths: []string{"/proc/bar", "/proc/bar"},
+		}, []string{"/proc/foo"}, []string{"/proc/bar"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var buffer bytes.Buffer
+			if err := UnpackRuntimeJSONWithOptions(ctx, engineExt, &buffer, "", manifest, &UnpackOptions{RuntimeOptions: test.opt}); err != nil {
+				t.Fatalf("unexpected error generating config.json: %+v", err)
+			}
+			var spec rspec.Spec
+			if err := json.Unmarshal(buffer.Bytes(), &spec); err != nil {
+				t.Fatalf("unexpected error parsing config.json: %+v", err)
+			}
+			if !reflect.DeepEqual(spec.Linux.MaskedPaths, test.expectedMasked) {
+				t.Errorf("unexpected maskedPaths: expected %v got %v", test.expectedMasked, spec.Linux.MaskedPaths)
+			}
+			if !reflect.DeepEqual(spec.Linux.ReadonlyPaths, test.expectedReadonly) {
+				t.Errorf("unexpected readonlyPaths: expected %v got %v", test.expectedReadonly, spec.Linux.ReadonlyPaths)
+			}
+		})
+	}
+}
+
+func TestUnpackRuntimeJSONSecurity(t *testing.T) {
+	ctx := context.Background()
+
+	root, manifest, engineExt := makeImage(t)
+	defer os.RemoveAll(root)
+
+	customSeccomp := &rspec.LinuxSeccomp{
+		DefaultAction: rspec.ActErrno,
+		Syscalls: []rspec.LinuxSyscall{
+			{Names: []string{"read", "write"}, Action: rspec.ActAllow},
+		},
+	}
+
+	for _, test := range []struct {
+		name                 string
+		opt                  RuntimeOptions
+		expectedCapabilities *rspec.LinuxCapabilities
+		expectedSeccomp      *rspec.LinuxSeccomp
+	}{
+		{"Default", RuntimeOptions{}, iconv.Example().Process.Capabilities, nil},
+		{"DefaultCapabilities", RuntimeOptions{DefaultCapabilities: true}, iconv.DefaultCapabilitySet(), nil},
+		{"MinimalSeccomp", RuntimeOptions{Seccomp: iconv.MinimalSeccomp()}, iconv.Example().Process.Capabilities, iconv.MinimalSeccomp()},
+		{"CustomSeccomp", RuntimeOptions{DefaultCapabilities: true, Seccomp: customSeccomp}, iconv.DefaultCapabilitySet(), customSeccomp},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var buffer bytes.Buffer
+			if err := UnpackRuntimeJSONWithOptions(ctx, engineExt, &buffer, "", manifest, &UnpackOptions{RuntimeOptions: test.opt}); err != nil {
+				t.Fatalf("unexpected error generating config.json: %+v", err)
+			}
+			var spec rspec.Spec
+			if err := json.Unmarshal(buffer.Bytes(), &spec); err != nil {
+				t.Fatalf("unexpected error parsing config.json: %+v", err)
+			}
+			if !reflect.DeepEqual(spec.Process.Capabilities, test.expectedCapabilities) {
+				t.Errorf("unexpected capabilities: expected %#v got %#v", test.expectedCapabilities, spec.Process.Capabilities)
+			}
+			if !reflect.DeepEqual(spec.Linux.Seccomp, test.expectedSeccomp) {
+				t.Errorf("unexpected seccomp profile: expected %#v got %#v", test.expectedSeccomp, spec.Linux.Seccomp)
+			}
+		})
+	}
+}
+
+func TestUnpackRuntimeJSONDefaults(t *testing.T) {
+	ctx := context.Background()
+
+	root, manifest, engineExt := makeImage(t)
+	defer os.RemoveAll(root)
+
+	for _, test := range []struct {
+		name               string
+		opt                MapOptions
+		expectedNamespaces []rspec.LinuxNamespaceType
+		expectedMounts     []string
+	}{
+		{"Default", MapOptions{},
+			[]rspec.LinuxNamespaceType{rspec.CgroupNamespace, rspec.PIDNamespace, rspec.NetworkNamespace, rspec.IPCNamespace, rspec.UTSNamespace, rspec.MountNamespace},
+			[]string{"/proc", "/dev", "/dev/pts", "/dev/shm", "/dev/mqueue", "/sys", "/sys/fs/cgroup"}},
+		{"Rootless", MapOptions{Rootless: true},
+			[]rspec.LinuxNamespaceType{rspec.CgroupNamespace, rspec.PIDNamespace, rspec.IPCNamespace, rspec.UTSNamespace, rspec.MountNamespace, rspec.UserNamespace},
+			[]string{"/proc", "/dev", "/dev/pts", "/dev/shm", "/dev/mqueue", "/sys", "/etc/resolv.conf"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var buffer bytes.Buffer
+			if err := UnpackRuntimeJSON(ctx, engineExt, &buffer, "", manifest, &test.opt); err != nil {
+				t.Fatalf("unexpected error generating config.json: %+v", err)
+			}
+			var spec rspec.Spec
+			if err := json.Unmarshal(buffer.Bytes(), &spec); err != nil {
+				t.Fatalf("unexpected error parsing config.json: %+v", err)
+			}
+
+			var namespaces []rspec.LinuxNamespaceType
+			for _, ns := range spec.Linux.Namespaces {
+				namespaces = append(namespaces, ns.Type)
+			}
+			if !reflect.DeepEqual(namespaces, test.expectedNamespaces) {
+				t.Errorf("unexpected namespaces: expected %v got %v", test.expectedNamespaces, namespaces)
+			}
+
+			var mounts []string
+			for _, mount := range spec.Mounts {
+				mounts = append(mounts, mount.Destination)
+			}
+			if !reflect.DeepEqual(mounts, test.expectedMounts) {
+				t.Errorf("unexpected mounts: expected %v got %v", test.expectedMounts, mounts)
+			}
+		})
+	}
+}
+
+func TestUnpackManifestProgress(t *testing.T) {
+	ctx := context.Background()
+
+	root, manifest, engineExt := makeImage(t)
+	defer os.RemoveAll(root)
+
+	bundle, err := ioutil.TempDir("", "umoci-TestUnpackManifestProgress_bundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(bundle)
+
+	var expectedTotal int64
+	for _, layer := range manifest.Layers {
+		expectedTotal += layer.Size
+	}
+
+	var (
+		calls         int
+		lastProcessed int64
+		lastTotal     int64
+		nonIncreasing bool
+		inconsistent  bool
+		unpackOptions = &UnpackOptions{MapOptions: MapOptions{
+			UIDMappings: []rspec.LinuxIDMapping{
+				{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1},
+				{HostID: uint32(os.Geteuid()), ContainerID: 1000, Size: 1},
+			},
+			GIDMappings: []rspec.LinuxIDMapping{
+				{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1},
+				{HostID: uint32(os.Getegid()), ContainerID: 100, Size: 1},
+			},
+			Rootless: os.Geteuid() != 0,
+		}}
+	)
+	unpackOptions.Progress = func(processed, total int64) {
+		calls++
+		if processed <= lastProcessed {
+			nonIncreasing = true
+		}
+		if total != expectedTotal {
+			inconsistent = true
+		}
+		lastProcessed, lastTotal = processed, total
+	}
+	if err := UnpackManifest(ctx, engineExt, bundle, manifest, unpackOptions); err != nil {
+		t.Fatalf("unexpected UnpackManifest error: %+v\n", err)
+	}
+
+	if calls == 0 {
+		t.Fatalf("progress callback not called")
+	}
+	if nonIncreasing {
+		t.Errorf("progress callback called with non-increasing processed count")
+	}
+	if inconsistent {
+		t.Errorf("progress callback called with unexpected total (expected %d)", expectedTotal)
+	}
+	if lastProcessed != expectedTotal || lastTotal != expectedTotal {
+		t.Errorf("final progress was %d/%d, expected %d/%d", lastProcessed, lastTotal, expectedTotal, expectedTotal)
+	}
+}
+
+func TestDiffID(t *testing.T) {
+	ctx := context.Background()
+
+	root, manifest, engineExt := makeImage(t)
+	defer os.RemoveAll(root)
+
+	configBlob, err := engineExt.FromDescriptor(ctx, manifest.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := configBlob.Data.(ispec.Image)
+
+	for idx, layerDescriptor := range manifest.Layers {
+		expected := config.RootFS.DiffIDs[idx]
+
+		// Store the uncompressed and zstd-compressed versions of the layer
+		// as well, which must all have the same DiffID.
+		layerBlob, err := engineExt.GetBlob(ctx, layerDescriptor.Digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gzr, err := gzip.NewReader(layerBlob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw, err := ioutil.ReadAll(gzr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gzr.Close()
+		layerBlob.Close()
+
+		var compressed bytes.Buffer
+		zw, err := zstd.NewWriter(&compressed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := zw.Write(raw); err != nil {
+			t.Fatal(err)
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		descriptors := []ispec.Descriptor{layerDescriptor}
+		for _, blob := range []struct {
+			mediaType string
+			data      []byte
+		}{
+			{ispec.MediaTypeImageLayer, raw},
+			{mediatype.MediaTypeImageLayerZstd, compressed.Bytes()},
+		} {
+			blobDigest, blobSize, err := engineExt.PutBlob(ctx, bytes.NewReader(blob.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			descriptors = append(descriptors, ispec.Descriptor{
+				MediaType: blob.mediaType,
+				Digest:    blobDigest,
+				Size:      blobSize,
+			})
+		}
+
+		for _, descriptor := range descriptors {
+			diffID, err := DiffID(ctx, engineExt, descriptor)
+			if err != nil {
+				t.Errorf("unexpected DiffID error for %s layer: %+v", descriptor.MediaType, err)
+				continue
+			}
+			if diffID != expected {
+				t.Errorf("DiffID of %s layer %d doesn't match config: expected %s, got %s", descriptor.MediaType, idx, expected, diffID)
+			}
+		}
+	}
+
+	// Non-layer blobs must be rejected.
+	if _, err := DiffID(ctx, engineExt, manifest.Config); err == nil {
+		t.Errorf("expected DiffID of config blob to fail")
+	}
+
+	// The blob must match the descriptor.
+	corrupt := manifest.Layers[0]
+	corrupt.Digest = manifest.Layers[1].Digest
+	if _, err := DiffID(ctx, engineExt, corrupt); err == nil {
+		t.Errorf("expected DiffID of layer with mismatched descriptor to fail")
+	}
+}
+
+func TestDecompressLayer(t *testing.T) {
+	ctx := context.Background()
+
+	root, manifest, engineExt := makeImage(t)
+	defer os.RemoveAll(root)
+
+	configBlob, err := engineExt.FromDescriptor(ctx, manifest.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := configBlob.Data.(ispec.Image)
+
+	for idx, layerDescriptor := range manifest.Layers {
+		layerBlob, err := engineExt.GetBlob(ctx, layerDescriptor.Digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		layerRaw, err := DecompressLayer(layerDescriptor.MediaType, layerBlob)
+		if err != nil {
+			t.Fatalf("unexpected DecompressLayer error for layer %d: %+v", idx, err)
+		}
+		diffID, err := digest.SHA256.FromReader(layerRaw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		layerRaw.Close()
+		layerBlob.Close()
+
+		if expected := config.RootFS.DiffIDs[idx]; diffID != expected {
+			t.Errorf("decompressed layer %d doesn't match config: expected %s, got %s", idx, expected, diffID)
+		}
+	}
+
+	// Non-layer blobs must be rejected.
+	if _, err := DecompressLayer(manifest.Config.MediaType, bytes.NewReader(nil)); err == nil {
+		t.Errorf("expected DecompressLayer of config blob to fail")
+	}
+}
+
+func TestUnpackManifestForeignLayer(t *testing.T) {
+	ctx := context.Background()
+
+	root, manifest, engineExt := makeImage(t)
+	defer os.RemoveAll(root)
+
+	// Remove the first layer from the image, and instead serve it over HTTP
+	// as a non-distributable layer.
+	foreignDescriptor := manifest.Layers[0]
+	layerBlob, err := engineExt.GetBlob(ctx, foreignDescriptor.Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layerData, err := ioutil.ReadAll(layerBlob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layerBlob.Close()
+	if err := engineExt.DeleteBlob(ctx, foreignDescriptor.Digest); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(layerData)
+	}))
+	defer server.Close()
+
+	foreignDescriptor.MediaType = ispec.MediaTypeImageLayerNonDistributableGzip
+	foreignDescriptor.URLs = []string{server.URL + "/layer.tar.gz"}
+	manifest.Layers[0] = foreignDescriptor
+
+	unpackOptions := &UnpackOptions{MapOptions: MapOptions{
+		UIDMappings: []rspec.LinuxIDMapping{
+			{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1},
+			{HostID: uint32(os.Geteuid()), ContainerID: 1000, Size: 1},
+		},
+		GIDMappings: []rspec.LinuxIDMapping{
+			{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1},
+			{HostID: uint32(os.Getegid()), ContainerID: 100, Size: 1},
+		},
+		Rootless: os.Geteuid() != 0,
+	}}
+
+	// Foreign layers are not fetched by default.
+	bundle := filepath.Join(root, "bundle-default")
+	if err := UnpackManifest(ctx, engineExt, bundle, manifest, unpackOptions); err == nil {
+		t.Errorf("expected UnpackManifest with missing foreign layer to fail")
+	} else if !strings.Contains(err.Error(), "non-distributable") {
+		t.Errorf("expected error to mention non-distributable layer: %v", err)
+	}
+
+	unpackOptions.AllowForeignLayers = true
+	bundle = filepath.Join(root, "bundle-foreign")
+	if err := UnpackManifest(ctx, engineExt, bundle, manifest, unpackOptions); err != nil {
+		t.Fatalf("unexpected UnpackManifest error: %+v", err)
+	}
+	if _, err := os.Stat(filepath.Join(bundle, "rootfs/test_file")); err != nil {
+		t.Errorf("test file missing after unpack: %+v", err)
+	}
+
+	// A corrupted foreign layer must be rejected.
+	layerData = []byte("not the layer")
+	bundle = filepath.Join(root, "bundle-corrupt")
+	if err := UnpackManifest(ctx, engineExt, bundle, manifest, unpackOptions); err == nil {
+		t.Errorf("expected UnpackManifest with corrupt foreign layer to fail")
+	}
+}
+
+// tamperBlob replaces the contents of the given blob in the image created by
+// makeImage, without changing its digest.
+func tamperBlob(t *testing.T, root string, blobDigest digest.Digest, data []byte) {
+	path := filepath.Join(root, "image", "blobs", blobDigest.Algorithm().String(), blobDigest.Encoded())
+	if err := os.Chmod(path, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUnpackManifestTamperedBlob(t *testing.T) {
+	ctx := context.Background()
+
+	for _, test := range []struct {
+		name   string
+		tamper func(layer, other []byte) []byte
+	}{
+		// A corrupted blob is usually also an invalid archive, so unpacking
+		// fails before the whole blob has been read.
+		{"Corrupted", func(layer, _ []byte) []byte {
+			tampered := append([]byte{}, layer...)
+			tampered[len(tampered)/2] ^= 0xff
+			return tampered
+		}},
+		{"Truncated", func(layer, _ []byte) []byte {
+			return layer[:len(layer)/2]
+		}},
+		{"Extended", func(layer, _ []byte) []byte {
+			return append(append([]byte{}, layer...), make([]byte, 1024)...)
+		}},
+		// A completely valid (but different) layer is only detected once the
+		// whole blob has been read.
+		{"OtherLayer", func(_, other []byte) []byte {
+			return other
+		}},
+	} {
+		test := test // copy iterator
+		t.Run(test.name, func(t *testing.T) {
+			root, manifest, engineExt := makeImage(t)
+			defer os.RemoveAll(root)
+
+			var blobs [][]byte
+			for _, layerDescriptor := range manifest.Layers {
+				layerBlob, err := engineExt.GetBlob(ctx, layerDescriptor.Digest)
+				if err != nil {
+					t.Fatal(err)
+				}
+				data, err := ioutil.ReadAll(layerBlob)
+				if err != nil {
+					t.Fatal(err)
+				}
+				layerBlob.Close()
+				blobs = append(blobs, data)
+			}
+			tamperBlob(t, root, manifest.Layers[0].Digest, test.tamper(blobs[0], blobs[1]))
+
+			unpackOptions := &UnpackOptions{MapOptions: MapOptions{
+				UIDMappings: []rspec.LinuxIDMapping{
+					{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1},
+					{HostID: uint32(os.Geteuid()), ContainerID: 1000, Size: 1},
+				},
+				GIDMappings: []rspec.LinuxIDMapping{
+					{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1},
+					{HostID: uint32(os.Getegid()), ContainerID: 100, Size: 1},
+				},
+				Rootless: os.Geteuid() != 0,
+			}}
+
+			bundle := filepath.Join(root, "bundle")
+			err := UnpackManifest(ctx, engineExt, bundle, manifest, unpackOptions)
+			if err == nil {
+				t.Fatalf("expected UnpackManifest with tampered layer blob to fail")
+			}
+			if cause := errors.Cause(err); cause != hardening.ErrDigestMismatch && cause != hardening.ErrSizeMismatch {
+				t.Errorf("expected UnpackManifest to fail with a blob verification error, got: %+v", err)
+			}
+			if !strings.Contains(err.Error(), "blob does not match descriptor") {
+				t.Errorf("expected UnpackManifest error to clearly indicate a tampered blob, got: %v", err)
+			}
+		})
+	}
+}
+
+func TestUnpackManifestDiffIDMismatch(t *testing.T) {
+	ctx := context.Background()
+
+	root, manifest, engineExt := makeImage(t)
+	defer os.RemoveAll(root)
+
+	// Swap the DiffIDs in the configuration, so the (otherwise valid) layer
+	// blobs don't match their DiffIDs.
+	configBlob, err := engineExt.FromDescriptor(ctx, manifest.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := configBlob.Data.(ispec.Image)
+	diffIDs := config.RootFS.DiffIDs
+	diffIDs[0], diffIDs[1] = diffIDs[1], diffIDs[0]
+	configDigest, configSize, err := engineExt.PutBlobJSON(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest.Config.Digest = configDigest
+	manifest.Config.Size = configSize
+
+	unpackOptions := &UnpackOptions{MapOptions: MapOptions{
+		UIDMappings: []rspec.LinuxIDMapping{
+			{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1},
+			{HostID: uint32(os.Geteuid()), ContainerID: 1000, Size: 1},
+		},
+		GIDMappings: []rspec.LinuxIDMapping{
+			{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1},
+			{HostID: uint32(os.Getegid()), ContainerID: 100, Size: 1},
+		},
+		Rootless: os.Geteuid() != 0,
+	}}
+
+	bundle := filepath.Join(root, "bundle")
+	err = UnpackManifest(ctx, engineExt, bundle, manifest, unpackOptions)
+	if err == nil {
+		t.Fatalf("expected UnpackManifest with mismatched diffid to fail")
+	}
+	if !strings.Contains(err.Error(), "diffid mismatch") {
+		t.Errorf("expected UnpackManifest error to indicate a diffid mismatch, got: %v", err)
+	}
+}
@@ -42,6 +42,96 @@ type MapOptions struct {
 
 	// Rootless specifies whether any to error out if chown fails.
 	Rootless bool `json:"rootless"`
+
+	// OnUnmapped specifies what to do when unpacking a layer which contains
+	// an owner (or POSIX ACL entry) that is not covered by UIDMappings or
+	// GIDMappings. The default is UnmappedError. This does not affect
+	// packing layers, which always fails for unmapped owners.
+	OnUnmapped UnmappedPolicy `json:"on_unmapped,omitempty"`
+
+	// NobodyUID and NobodyGID are the container IDs used instead of unmapped
+	// IDs with UnmappedNobody. They must be covered by UIDMappings and
+	// GIDMappings respectively. If zero, DefaultNobodyID is used.
+	NobodyUID int `json:"nobody_uid,omitempty"`
+	NobodyGID int `json:"nobody_gid,omitempty"`
+}
+
+// UnmappedPolicy describes how IDs which are not covered by the mappings in
+// MapOptions are handled when unpacking a layer.
+type UnmappedPolicy string
+
+const (
+	// UnmappedError causes unpacking to fail. This is the default, because
+	// the other policies result in a rootfs with different owners to the
+	// image.
+	UnmappedError UnmappedPolicy = "error"
+
+	// UnmappedSkip leaves the owner of the unpacked inode unchanged (so it is
+	// owned by the user running umoci). POSIX ACLs with unmapped entries are
+	// dropped.
+	UnmappedSkip UnmappedPolicy = "skip"
+
+	// UnmappedNobody maps unmapped IDs to MapOptions.NobodyUID and
+	// MapOptions.NobodyGID, similar to how the kernel presents unmapped IDs
+	// inside a user namespace.
+	UnmappedNobody UnmappedPolicy = "nobody"
+)
+
+// DefaultNobodyID is the default value for MapOptions.NobodyUID and
+// MapOptions.NobodyGID (the overflow ID used by Linux).
+const DefaultNobodyID = 65534
+
+// ParseUnmappedPolicy parses the name of an UnmappedPolicy ("error", "skip"
+// or "nobody").
+func ParseUnmappedPolicy(name string) (UnmappedPolicy, error) {
+	switch policy := UnmappedPolicy(name); policy {
+	case UnmappedError, UnmappedSkip, UnmappedNobody:
+		return policy, nil
+	default:
+		return "", errors.Errorf("unknown unmapped id policy %q (must be error, skip or nobody)", name)
+	}
+}
+
+// unmappedHostID is the host ID returned by toHost for unmapped IDs with
+// UnmappedSkip. When passed to lchown(2), it leaves the ID unchanged.
+const unmappedHostID = -1
+
+// toHost maps the container ID id to a host ID using the given mappings,
+// applying the OnUnmapped policy if the ID is not covered by the mappings.
+// nobody is the NobodyUID or NobodyGID corresponding to the mappings.
+func (opt MapOptions) toHost(id int, idMap []rspec.LinuxIDMapping, nobody int) (int, error) {
+	hostID, err := idtools.ToHost(id, idMap)
+	if err == nil {
+		return hostID, nil
+	}
+
+	switch opt.OnUnmapped {
+	case "", UnmappedError:
+		return -1, err
+	case UnmappedSkip:
+		return unmappedHostID, nil
+	case UnmappedNobody:
+		if nobody == 0 {
+			nobody = DefaultNobodyID
+		}
+		hostID, err := idtools.ToHost(nobody, idMap)
+		if err != nil {
+			return -1, errors.Wrapf(err, "map nobody id %d (in place of unmapped id %d)", nobody, id)
+		}
+		return hostID, nil
+	default:
+		return -1, errors.Errorf("unknown unmapped id policy %q", opt.OnUnmapped)
+	}
+}
+
+// uidToHost is toHost for UIDs.
+func (opt MapOptions) uidToHost(uid int) (int, error) {
+	return opt.toHost(uid, opt.UIDMappings, opt.NobodyUID)
+}
+
+// gidToHost is toHost for GIDs.
+func (opt MapOptions) gidToHost(gid int) (int, error) {
+	return opt.toHost(gid, opt.GIDMappings, opt.NobodyGID)
 }
 
 // mapHeader maps a tar.Header generated from the filesystem so that it
@@ -64,6 +154,18 @@ func mapHeader(hdr *tar.Header, mapOptions MapOptions) error {
 		if err != nil {
 			return errors.Wrap(err, "map gid to container")
 		}
+
+		// POSIX ACLs contain IDs which also need to be mapped.
+		for name, value := range hdr.Xattrs {
+			if !isACLXattr(name) {
+				continue
+			}
+			newValue, err := mapACLToContainer(value, mapOptions)
+			if err != nil {
+				return errors.Wrapf(err, "map %s to container", name)
+			}
+			hdr.Xattrs[name] = newValue
+		}
 	}
 
 	// We have special handling for the "user.rootlesscontainers" xattr. If
@@ -99,6 +201,16 @@ func mapHeader(hdr *tar.Header, mapOptions MapOptions) error {
 		delete(hdr.Xattrs, rootlesscontainers.Keyname)
 	}
 
+	// Placeholders for devices created when extracting rootless (or in a
+	// user namespace) need to be converted back into the original device.
+	if err := restoreRootlessDevice(hdr); err != nil {
+		return err
+	}
+
+	// Privileged xattrs which were shadowed when extracting (because we
+	// couldn't set them) need to be converted back into the original xattr.
+	restoreShadowXattrs(hdr)
+
 	hdr.Uid = newUID
 	hdr.Gid = newGID
 	return nil
@@ -107,11 +219,14 @@ func mapHeader(hdr *tar.Header, mapOptions MapOptions) error {
 // unmapHeader maps a tar.Header from a tar layer stream so that it describes
 // the inode as it would be exist on the host filesystem. In particular this
 // involves applying an ID mapping from the container filesystem to the host
-// mappings. Returns an error if it's not possible to map the given UID.
+// mappings. If the owner is not covered by the mappings, the OnUnmapped policy
+// is applied (and with UnmappedSkip, the owner is set to -1 so that it is left
+// unchanged by lchown(2)).
 func unmapHeader(hdr *tar.Header, mapOptions MapOptions) error {
-	// To avoid nil references.
-	if hdr.Xattrs == nil {
-		hdr.Xattrs = make(map[string]string)
+	// Collect all of the xattrs from the PAX records (this also avoids nil
+	// references).
+	if err := decodePAXXattrs(hdr); err != nil {
+		return errors.Wrap(err, "decode xattrs")
 	}
 
 	// If there is already a "user.rootlesscontainers" we give a warning in
@@ -126,6 +241,9 @@ func unmapHeader(hdr *tar.Header, mapOptions MapOptions) error {
 		}
 	}
 
+	// Shadow xattrs are a marker for us, and shouldn't be in layers.
+	dropShadowXattrs(hdr)
+
 	// In rootless mode there are a few things we need to do. We need to map
 	// all of the files in the layer to have an owner of (0, 0) because we
 	// cannot lchown(2) anything -- and then if the owner was non-root we have
@@ -165,14 +283,36 @@ func unmapHeader(hdr *tar.Header, mapOptions MapOptions) error {
 		hdr.Gid = 0
 	}
 
-	newUID, err := idtools.ToHost(hdr.Uid, mapOptions.UIDMappings)
+	newUID, err := mapOptions.uidToHost(hdr.Uid)
 	if err != nil {
 		return errors.Wrap(err, "map uid to host")
 	}
-	newGID, err := idtools.ToHost(hdr.Gid, mapOptions.GIDMappings)
+	newGID, err := mapOptions.gidToHost(hdr.Gid)
 	if err != nil {
 		return errors.Wrap(err, "map gid to host")
 	}
+	if newUID == unmappedHostID || newGID == unmappedHostID {
+		log.Debugf("unpack: not changing owner of %s with unmapped uid %d or gid %d", hdr.Name, hdr.Uid, hdr.Gid)
+	}
+
+	// POSIX ACLs contain IDs which also need to be mapped. In rootless mode
+	// we usually can't represent the named users and groups in an ACL (they
+	// are very unlikely to be mapped), so we just drop the ACL.
+	for name, value := range hdr.Xattrs {
+		if !isACLXattr(name) {
+			continue
+		}
+		newValue, err := mapACLToHost(value, mapOptions)
+		if err != nil {
+			if mapOptions.Rootless || mapOptions.OnUnmapped == UnmappedSkip {
+				log.Warnf("rootless{%s} ignoring unmappable %s xattr: %v", hdr.Name, name, err)
+				delete(hdr.Xattrs, name)
+				continue
+			}
+			return errors.Wrapf(err, "map %s to host", name)
+		}
+		hdr.Xattrs[name] = newValue
+	}
 
 	hdr.Uid = newUID
 	hdr.Gid = newGID
@@ -181,3 +181,70 @@ func TestUnmapRootless(t *testing.T) {
 		}
 	}
 }
+
+// TestUnmapUnmapped ensures that unmapHeader applies the OnUnmapped policy to
+// owners which are not covered by the mappings.
+func TestUnmapUnmapped(t *testing.T) {
+	uidMap := []rspec.LinuxIDMapping{{HostID: 100000, ContainerID: 0, Size: 65536}}
+	gidMap := []rspec.LinuxIDMapping{{HostID: 200000, ContainerID: 0, Size: 65536}}
+
+	for _, test := range []struct {
+		name                 string
+		mapOptions           MapOptions
+		expectErr            bool
+		expectUID, expectGID int
+	}{
+		{"Default", MapOptions{}, true, 0, 0},
+		{"Error", MapOptions{OnUnmapped: UnmappedError}, true, 0, 0},
+		{"Skip", MapOptions{OnUnmapped: UnmappedSkip}, false, -1, 201000},
+		{"NobodyDefault", MapOptions{OnUnmapped: UnmappedNobody}, false, 100000 + DefaultNobodyID, 201000},
+		{"Nobody", MapOptions{OnUnmapped: UnmappedNobody, NobodyUID: 1234, NobodyGID: 5678}, false, 101234, 201000},
+		{"NobodyUnmapped", MapOptions{OnUnmapped: UnmappedNobody, NobodyUID: 70000}, true, 0, 0},
+		{"Unknown", MapOptions{OnUnmapped: "bogus"}, true, 0, 0},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			mapOptions := test.mapOptions
+			mapOptions.UIDMappings = uidMap
+			mapOptions.GIDMappings = gidMap
+
+			// The uid is unmapped but the gid is mapped.
+			hdr := &tar.Header{
+				Name:     "etc/passwd",
+				Typeflag: tar.TypeReg,
+				Uid:      70000,
+				Gid:      1000,
+			}
+			err := unmapHeader(hdr, mapOptions)
+			if test.expectErr {
+				if err == nil {
+					t.Errorf("expected unmapHeader to fail with unmapped uid")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error in unmapHeader: %+v", err)
+			}
+			if hdr.Uid != test.expectUID {
+				t.Errorf("got unexpected uid: expected %d got %d", test.expectUID, hdr.Uid)
+			}
+			if hdr.Gid != test.expectGID {
+				t.Errorf("got unexpected gid: expected %d got %d", test.expectGID, hdr.Gid)
+			}
+		})
+	}
+}
+
+func TestParseUnmappedPolicy(t *testing.T) {
+	for _, name := range []string{"error", "skip", "nobody"} {
+		if policy, err := ParseUnmappedPolicy(name); err != nil {
+			t.Errorf("unexpected error parsing %q: %+v", name, err)
+		} else if string(policy) != name {
+			t.Errorf("parsing %q gave unexpected policy %q", name, policy)
+		}
+	}
+	for _, name := range []string{"", "ERROR", "root", "65534"} {
+		if _, err := ParseUnmappedPolicy(name); err == nil {
+			t.Errorf("expected error parsing %q", name)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// paxSchilyXattr is the prefix of PAX records which store xattrs, as
+	// used by star, GNU tar, bsdtar and archive/tar. The rest of the record
+	// key is the xattr name, and the record value is the raw xattr value.
+	paxSchilyXattr = "SCHILY.xattr."
+
+	// paxLibarchiveXattr is the prefix of PAX records which store xattrs in
+	// the libarchive format (written by bsdtar alongside the SCHILY records).
+	// The rest of the record key is the percent-encoded xattr name, and the
+	// record value is the base64-encoded xattr value. This allows for xattr
+	// names which cannot be stored in a SCHILY record (such as names
+	// containing "=").
+	paxLibarchiveXattr = "LIBARCHIVE.xattr."
+)
+
+// isPAXXattrRecord returns whether the given PAX record key stores an xattr.
+func isPAXXattrRecord(key string) bool {
+	return strings.HasPrefix(key, paxSchilyXattr) || strings.HasPrefix(key, paxLibarchiveXattr)
+}
+
+// decodePAXXattrs fills hdr.Xattrs with every xattr stored in the PAX records
+// of the given header (from a tar.Reader), regardless of namespace, and
+// removes the xattr records from hdr.PAXRecords. After this, hdr.Xattrs is
+// the only copy of the xattrs of the entry (so code which modifies hdr.Xattrs
+// doesn't need to worry about stale PAX records). If an xattr is stored in
+// both formats, the SCHILY record takes precedence.
+func decodePAXXattrs(hdr *tar.Header) error {
+	if hdr.Xattrs == nil {
+		hdr.Xattrs = map[string]string{}
+	}
+	for key, value := range hdr.PAXRecords {
+		if !strings.HasPrefix(key, paxLibarchiveXattr) {
+			continue
+		}
+		name, err := url.PathUnescape(strings.TrimPrefix(key, paxLibarchiveXattr))
+		if err != nil {
+			return errors.Wrapf(err, "decode name of pax record %q", key)
+		}
+		// libarchive doesn't pad its base64 values.
+		rawValue, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(value, "="))
+		if err != nil {
+			return errors.Wrapf(err, "decode value of pax record %q", key)
+		}
+		if _, ok := hdr.PAXRecords[paxSchilyXattr+name]; !ok {
+			hdr.Xattrs[name] = string(rawValue)
+		}
+	}
+	for key, value := range hdr.PAXRecords {
+		if strings.HasPrefix(key, paxSchilyXattr) {
+			hdr.Xattrs[strings.TrimPrefix(key, paxSchilyXattr)] = value
+		}
+		if isPAXXattrRecord(key) {
+			delete(hdr.PAXRecords, key)
+		}
+	}
+	return nil
+}
+
+// libarchiveEscapeName percent-encodes an xattr name in the same way as
+// libarchive, for use in a LIBARCHIVE.xattr record.
+func libarchiveEscapeName(name string) string {
+	var escaped strings.Builder
+	for _, ch := range []byte(name) {
+		if ch <= ' ' || ch >= 0x7f || ch == '%' || ch == '=' {
+			fmt.Fprintf(&escaped, "%%%02X", ch)
+		} else {
+			escaped.WriteByte(ch)
+		}
+	}
+	return escaped.String()
+}
+
+// encodePAXXattrs moves the xattrs in hdr.Xattrs into hdr.PAXRecords (to be
+// written by a tar.Writer), replacing any existing xattr records. Xattrs are
+// stored as SCHILY records, except for those whose names cannot be
+// represented in a PAX record key, which are stored as LIBARCHIVE records.
+func encodePAXXattrs(hdr *tar.Header) {
+	for key := range hdr.PAXRecords {
+		if isPAXXattrRecord(key) {
+			delete(hdr.PAXRecords, key)
+		}
+	}
+	for name, value := range hdr.Xattrs {
+		if hdr.PAXRecords == nil {
+			hdr.PAXRecords = map[string]string{}
+		}
+		if strings.Contains(name, "=") {
+			key := paxLibarchiveXattr + libarchiveEscapeName(name)
+			hdr.PAXRecords[key] = base64.RawStdEncoding.EncodeToString([]byte(value))
+		} else {
+			hdr.PAXRecords[paxSchilyXattr+name] = value
+		}
+	}
+	hdr.Xattrs = nil
+}
+
+// xattrNamespace describes how xattrs in a given namespace are handled.
+type xattrNamespace struct {
+	// prefix is the prefix of the names of xattrs in the namespace.
+	prefix string
+
+	// privileged indicates that xattrs in the namespace can only be set by a
+	// privileged user, and so are expected to fail when extracting rootless
+	// (they can be stored as shadow xattrs instead).
+	privileged bool
+}
+
+// xattrNamespaces are the xattr namespaces supported by Linux. Every xattr is
+// stored in (and extracted from) layers in the same way, but the namespace of
+// an xattr decides how failures to set it are handled.
+var xattrNamespaces = []xattrNamespace{
+	{prefix: "security.", privileged: true},
+	{prefix: "system.", privileged: true},
+	{prefix: "trusted.", privileged: true},
+	{prefix: "user.", privileged: false},
+}
+
+// lookupXattrNamespace returns the namespace of the given xattr, and whether
+// the namespace is known.
+func lookupXattrNamespace(name string) (xattrNamespace, bool) {
+	for _, ns := range xattrNamespaces {
+		if strings.HasPrefix(name, ns.prefix) {
+			return ns, true
+		}
+	}
+	return xattrNamespace{}, false
+}
+
+// xattrFailure is what a TarExtractor does when it fails to set an xattr from
+// a layer.
+type xattrFailure int
+
+const (
+	// xattrFail means the extraction fails.
+	xattrFail xattrFailure = iota
+
+	// xattrSkip means the xattr is skipped (with a warning).
+	xattrSkip
+
+	// xattrShadow means the xattr is stored as a shadow xattr if
+	// UnpackOptions.ShadowXattrs is set, and is otherwise skipped.
+	xattrShadow
+
+	// xattrUnsupported means the filesystem doesn't support xattrs at all, so
+	// the xattr is skipped (only warning the first time).
+	xattrUnsupported
+)
+
+// xattrFailurePolicy decides what to do when setting the given xattr failed
+// with err, depending on the namespace of the xattr and whether we are
+// extracting rootless (or in a user namespace).
+func xattrFailurePolicy(name string, err error, rootless bool) (xattrFailure, string) {
+	ns, known := lookupXattrNamespace(name)
+	err = errors.Cause(err)
+	switch {
+	case rootless && os.IsPermission(err):
+		// Privileged xattrs will fail (security.capability). This is _fine_
+		// as long as we're not running as root (in which case we shouldn't
+		// be ignoring xattrs that we were told to set). Unprivileged users
+		// also cannot set user.* xattrs on files they don't own or on
+		// special files (such as symlinks).
+		//
+		// Note that if we are root inside a user namespace, the kernel will
+		// automatically translate security.capability into a v3 capability
+		// for us (and tar_generate translates them back).
+		if ns.privileged {
+			return xattrShadow, "ignoring (usually) harmless EPERM"
+		}
+		return xattrSkip, "ignoring EPERM"
+	case rootless && isACLXattr(name) && err == unix.EINVAL:
+		// POSIX ACLs which reference users or groups that are not mapped
+		// into our user namespace will give us EINVAL.
+		return xattrSkip, "ignoring EINVAL: acl probably references unmapped ids"
+	case err == unix.ENOTSUP && !known:
+		// The kernel doesn't know about the namespace, which says nothing
+		// about whether the filesystem supports xattrs.
+		return xattrSkip, "ignoring ENOTSUP: unknown xattr namespace"
+	case err == unix.ENOTSUP:
+		// This usually means that extended attributes are simply unsupported
+		// by the underlying filesystem (such as AUFS or NFS).
+		return xattrUnsupported, "ignoring ENOTSUP"
+	}
+	return xattrFail, ""
+}
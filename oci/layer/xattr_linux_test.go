@@ -0,0 +1,108 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// TestXattrRoundTrip checks that xattrs from several namespaces survive being
+// put into a layer and extracted again.
+func TestXattrRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestXattrRoundTrip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	dst := filepath.Join(dir, "dst")
+	for _, path := range []string{src, dst} {
+		if err := os.Mkdir(path, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "file"), []byte("contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only test the xattrs the filesystem (and our privileges) allow us to
+	// set.
+	expected := map[string]string{}
+	for _, xattr := range []struct {
+		name, value string
+	}{
+		{"user.mime_type", "text/plain"},
+		{"user.key=with=equals", "equals"},
+		{"user.app.binary", "\x00\x01\x02\xff"},
+		{"trusted.custom", "trusted value"},
+	} {
+		if err := unix.Lsetxattr(filepath.Join(src, "file"), xattr.name, []byte(xattr.value), 0); err != nil {
+			t.Logf("skipping xattr %s: %v", xattr.name, err)
+			continue
+		}
+		expected[xattr.name] = xattr.value
+	}
+	if len(expected) == 0 {
+		t.Skip("skipping test: filesystem doesn't support xattrs")
+	}
+
+	var buf bytes.Buffer
+	tg := newTarGenerator(&buf, MapOptions{})
+	if err := tg.AddFile("file", filepath.Join(src, "file")); err != nil {
+		t.Fatalf("AddFile: unexpected error: %+v", err)
+	}
+	if err := tg.tw.Close(); err != nil {
+		t.Fatalf("tw.Close: unexpected error: %+v", err)
+	}
+
+	te := NewTarExtractor(UnpackOptions{})
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("read tar: %+v", err)
+		}
+		if err := te.UnpackEntry(dst, hdr, tr); err != nil {
+			t.Fatalf("UnpackEntry %s: unexpected error: %+v", hdr.Name, err)
+		}
+	}
+
+	for name, value := range expected {
+		buf := make([]byte, 256)
+		n, err := unix.Lgetxattr(filepath.Join(dst, "file"), name, buf)
+		if err != nil {
+			t.Errorf("xattr %s not extracted: %v", name, err)
+			continue
+		}
+		if got := string(buf[:n]); got != value {
+			t.Errorf("xattr %s: expected %q, got %q", name, value, got)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// testXattrs is a set of xattrs from a variety of namespaces (including ones
+// umoci has no special handling for).
+var testXattrs = map[string]string{
+	"user.mime_type":               "text/plain",
+	"user.app.metadata":            "{\"key\": \"value\"}",
+	"user.key=with=equals":         "equals",
+	"user.with space\tand%percent": "whitespace",
+	"trusted.overlay.custom":       "y",
+	"security.capability":          "\x00\x00\x00\x02\x00\x20\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00",
+	"system.posix_acl_access":      "\x02\x00\x00\x00\x01\x00\x06\x00\xff\xff\xff\xff",
+	"unknown.namespace":            "\xde\xad\xbe\xef",
+}
+
+func TestPAXXattrsRoundTrip(t *testing.T) {
+	hdr := &tar.Header{
+		Name:     "file",
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		Xattrs:   map[string]string{},
+	}
+	for name, value := range testXattrs {
+		hdr.Xattrs[name] = value
+	}
+
+	encodePAXXattrs(hdr)
+	if hdr.Xattrs != nil {
+		t.Errorf("expected hdr.Xattrs to be cleared after encoding, got %v", hdr.Xattrs)
+	}
+	for key := range hdr.PAXRecords {
+		if strings.Contains(key, "=with=") && !strings.HasPrefix(key, paxLibarchiveXattr) {
+			t.Errorf("xattr name containing '=' stored in non-libarchive record %q", key)
+		}
+	}
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := tw.WriteHeader(hdr); err != nil {
+		t.Fatalf("write header: %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tr := tar.NewReader(&buf)
+	gotHdr, err := tr.Next()
+	if err != nil {
+		t.Fatalf("read header: %v", err)
+	}
+	if err := decodePAXXattrs(gotHdr); err != nil {
+		t.Fatalf("unexpected decodePAXXattrs error: %+v", err)
+	}
+	if !reflect.DeepEqual(gotHdr.Xattrs, testXattrs) {
+		t.Errorf("xattrs not preserved:\n\texpected: %q\n\tgot:      %q", testXattrs, gotHdr.Xattrs)
+	}
+	for key := range gotHdr.PAXRecords {
+		if isPAXXattrRecord(key) {
+			t.Errorf("xattr pax record %q not removed by decodePAXXattrs", key)
+		}
+	}
+	if _, err := tr.Next(); err != io.EOF {
+		t.Errorf("expected only one entry, got %v", err)
+	}
+}
+
+func TestDecodePAXXattrsLibarchive(t *testing.T) {
+	hdr := &tar.Header{
+		Name: "file",
+		PAXRecords: map[string]string{
+			// As written by bsdtar (unpadded base64 values).
+			"LIBARCHIVE.xattr.user.foo%3Dbar":   "aGVsbG8",
+			"LIBARCHIVE.xattr.user.both":        "bGliYXJjaGl2ZQ",
+			"SCHILY.xattr.user.both":            "schily",
+			"LIBARCHIVE.xattr.trusted.%25%20ok": "eQ==",
+			"comment":                           "not an xattr",
+		},
+	}
+	if err := decodePAXXattrs(hdr); err != nil {
+		t.Fatalf("unexpected decodePAXXattrs error: %+v", err)
+	}
+
+	expected := map[string]string{
+		"user.foo=bar": "hello",
+		"user.both":    "schily",
+		"trusted.% ok": "y",
+	}
+	if !reflect.DeepEqual(hdr.Xattrs, expected) {
+		t.Errorf("unexpected xattrs:\n\texpected: %q\n\tgot:      %q", expected, hdr.Xattrs)
+	}
+	if !reflect.DeepEqual(hdr.PAXRecords, map[string]string{"comment": "not an xattr"}) {
+		t.Errorf("unexpected remaining pax records: %q", hdr.PAXRecords)
+	}
+
+	for _, records := range []map[string]string{
+		{"LIBARCHIVE.xattr.user.%zz": "eQ"},
+		{"LIBARCHIVE.xattr.user.foo": "not base64!"},
+	} {
+		if err := decodePAXXattrs(&tar.Header{PAXRecords: records}); err == nil {
+			t.Errorf("expected error decoding invalid records %q", records)
+		}
+	}
+}
+
+func TestXattrFailurePolicy(t *testing.T) {
+	eperm := errors.Wrap(unix.EPERM, "lsetxattr")
+	for _, test := range []struct {
+		name     string
+		err      error
+		rootless bool
+		expected xattrFailure
+	}{
+		{"security.capability", eperm, true, xattrShadow},
+		{"trusted.overlay.opaque", eperm, true, xattrShadow},
+		{"system.posix_acl_access", eperm, true, xattrShadow},
+		{"user.foo", eperm, true, xattrSkip},
+		{"security.capability", eperm, false, xattrFail},
+		{"user.foo", eperm, false, xattrFail},
+		{"system.posix_acl_access", unix.EINVAL, true, xattrSkip},
+		{"system.posix_acl_access", unix.EINVAL, false, xattrFail},
+		{"user.foo", unix.EINVAL, true, xattrFail},
+		{"user.foo", unix.ENOTSUP, false, xattrUnsupported},
+		{"unknown.foo", unix.ENOTSUP, false, xattrSkip},
+		{"unknown.foo", unix.ENOTSUP, true, xattrSkip},
+		{"user.foo", unix.ENOSPC, true, xattrFail},
+	} {
+		if got, _ := xattrFailurePolicy(test.name, test.err, test.rootless); got != test.expected {
+			t.Errorf("xattrFailurePolicy(%q, %v, rootless=%v): expected %v, got %v", test.name, test.err, test.rootless, test.expected, got)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package registry
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/pkg/errors"
+)
+
+// Credentials are the credentials used to authenticate with a registry.
+type Credentials struct {
+	// Username and Password are used for basic authentication (and when
+	// requesting bearer tokens).
+	Username string
+	Password string
+
+	// IdentityToken is an OAuth2 refresh token which is used instead of
+	// Username and Password when requesting bearer tokens.
+	IdentityToken string
+}
+
+// dockerConfig is the subset of the docker config.json used for credentials.
+type dockerConfig struct {
+	Auths       map[string]dockerAuth `json:"auths"`
+	CredsStore  string                `json:"credsStore,omitempty"`
+	CredHelpers map[string]string     `json:"credHelpers,omitempty"`
+}
+
+// dockerAuth is an entry in the "auths" section of the docker config.json.
+type dockerAuth struct {
+	Auth          string `json:"auth,omitempty"`
+	Username      string `json:"username,omitempty"`
+	Password      string `json:"password,omitempty"`
+	IdentityToken string `json:"identitytoken,omitempty"`
+}
+
+// DockerConfigPath returns the path of the docker config.json, which is
+// $DOCKER_CONFIG/config.json if $DOCKER_CONFIG is set and
+// ~/.docker/config.json otherwise.
+func DockerConfigPath() string {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return filepath.Join(dir, "config.json")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".docker", "config.json")
+}
+
+// normaliseAuthKey converts the key of an entry in the "auths" section of a
+// docker config.json (which may be a URL) to a registry name.
+func normaliseAuthKey(key string) string {
+	key = strings.TrimPrefix(key, "https://")
+	key = strings.TrimPrefix(key, "http://")
+	if idx := strings.Index(key, "/"); idx >= 0 {
+		key = key[:idx]
+	}
+	switch key {
+	case "index.docker.io", defaultRegistryHost:
+		return DefaultRegistry
+	}
+	return key
+}
+
+// LoadCredentials returns the credentials for the given registry stored in
+// the docker config.json at configPath. If the file doesn't exist or has no
+// credentials for the registry, nil is returned. Credential helpers are not
+// supported.
+func LoadCredentials(configPath, registry string) (*Credentials, error) {
+	data, err := ioutil.ReadFile(configPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "read docker config")
+	}
+
+	var config dockerConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, errors.Wrapf(err, "parse docker config %s", configPath)
+	}
+
+	registry = normaliseAuthKey(registry)
+	for key, auth := range config.Auths {
+		if normaliseAuthKey(key) != registry {
+			continue
+		}
+		creds := &Credentials{
+			Username:      auth.Username,
+			Password:      auth.Password,
+			IdentityToken: auth.IdentityToken,
+		}
+		if auth.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+			if err != nil {
+				return nil, errors.Wrapf(err, "decode auth for %s", key)
+			}
+			parts := strings.SplitN(string(decoded), ":", 2)
+			if len(parts) != 2 {
+				return nil, errors.Errorf("invalid auth for %s: missing password", key)
+			}
+			creds.Username, creds.Password = parts[0], parts[1]
+		}
+		if creds.Username == "" && creds.Password == "" && creds.IdentityToken == "" {
+			// An empty entry is created by credential helpers.
+			break
+		}
+		return creds, nil
+	}
+
+	if _, ok := config.CredHelpers[registry]; ok || config.CredsStore != "" {
+		log.Warnf("registry: docker credential helpers are not supported, ignoring them for %s", registry)
+	}
+	return nil, nil
+}
@@ -0,0 +1,105 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package registry
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeDockerConfig(t *testing.T, dir, config string) string {
+	configPath := filepath.Join(dir, "config.json")
+	if err := ioutil.WriteFile(configPath, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return configPath
+}
+
+func TestLoadCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestLoadCredentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	auth := base64.StdEncoding.EncodeToString([]byte("user:pass:word"))
+	configPath := writeDockerConfig(t, dir, `{
+		"auths": {
+			"https://index.docker.io/v1/": {"auth": "`+auth+`"},
+			"localhost:5000": {"username": "local", "password": "secret"},
+			"https://registry.example.com": {"identitytoken": "refresh-token"},
+			"empty.example.com": {}
+		},
+		"credsStore": "desktop"
+	}`)
+
+	for _, test := range []struct {
+		registry string
+		expected *Credentials
+	}{
+		{"docker.io", &Credentials{Username: "user", Password: "pass:word"}},
+		{"localhost:5000", &Credentials{Username: "local", Password: "secret"}},
+		{"registry.example.com", &Credentials{IdentityToken: "refresh-token"}},
+		{"empty.example.com", nil},
+		{"unknown.example.com", nil},
+	} {
+		creds, err := LoadCredentials(configPath, test.registry)
+		if err != nil {
+			t.Errorf("LoadCredentials(%s): unexpected error: %+v", test.registry, err)
+			continue
+		}
+		if (creds == nil) != (test.expected == nil) || (creds != nil && *creds != *test.expected) {
+			t.Errorf("LoadCredentials(%s): expected %+v, got %+v", test.registry, test.expected, creds)
+		}
+	}
+
+	// A missing config has no credentials.
+	if creds, err := LoadCredentials(filepath.Join(dir, "missing.json"), "docker.io"); err != nil || creds != nil {
+		t.Errorf("LoadCredentials(missing): expected no credentials, got %+v (err=%v)", creds, err)
+	}
+
+	// Invalid configs must produce errors.
+	badPath := writeDockerConfig(t, dir, `{"auths": {"docker.io": {"auth": "not base64!"}}}`)
+	if _, err := LoadCredentials(badPath, "docker.io"); err == nil {
+		t.Errorf("LoadCredentials(invalid auth): expected error")
+	}
+}
+
+func TestParseChallenge(t *testing.T) {
+	scheme, params := parseChallenge(`Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/busybox:pull"`)
+	if scheme != "bearer" {
+		t.Errorf("unexpected scheme: %s", scheme)
+	}
+	for key, value := range map[string]string{
+		"realm":   "https://auth.docker.io/token",
+		"service": "registry.docker.io",
+		"scope":   "repository:library/busybox:pull",
+	} {
+		if params[key] != value {
+			t.Errorf("challenge param %s: expected %q, got %q", key, value, params[key])
+		}
+	}
+
+	scheme, params = parseChallenge(`Basic realm="a \"quoted\" realm", charset=UTF-8`)
+	if scheme != "basic" || params["realm"] != `a "quoted" realm` || params["charset"] != "UTF-8" {
+		t.Errorf("unexpected basic challenge: %s %v", scheme, params)
+	}
+}
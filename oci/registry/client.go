@@ -0,0 +1,709 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package registry
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/dockerarchive"
+	"github.com/opencontainers/umoci/pkg/hardening"
+	"github.com/pkg/errors"
+)
+
+// ErrNotFound is returned when the requested manifest or blob does not exist
+// in the registry.
+var ErrNotFound = errors.New("not found in registry")
+
+// transientError marks an error which may not occur if the request is retried,
+// such as a connection error or a "503 Service Unavailable" response.
+type transientError struct {
+	error
+}
+
+// isTransient returns whether the cause of err is a transientError.
+func isTransient(err error) bool {
+	_, ok := errors.Cause(err).(transientError)
+	return ok
+}
+
+// transientReader marks every error (other than io.EOF) returned while
+// reading a response body as a transientError.
+type transientReader struct {
+	io.ReadCloser
+}
+
+func (r transientReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		err = transientError{err}
+	}
+	return n, err
+}
+
+// maxManifestSize is the maximum size of a manifest that will be downloaded.
+// This matches the limit used by most registries.
+const maxManifestSize = 4 << 20
+
+// uploadChunkSize is the size of each chunk when uploading blobs. Blobs no
+// larger than this are uploaded with a single (monolithic) request.
+const uploadChunkSize = 16 << 20
+
+// manifestMediaTypes are the manifest media types we accept, in order of
+// preference.
+var manifestMediaTypes = []string{
+	ispec.MediaTypeImageManifest,
+	ispec.MediaTypeImageIndex,
+	dockerarchive.MediaTypeDockerManifest,
+	dockerarchive.MediaTypeDockerManifestList,
+}
+
+// ClientOptions modifies the behaviour of a Client.
+type ClientOptions struct {
+	// HTTPClient is the client used to make requests. If nil,
+	// http.DefaultClient is used.
+	HTTPClient *http.Client
+
+	// PlainHTTP causes the registry to be accessed over HTTP rather than
+	// HTTPS.
+	PlainHTTP bool
+
+	// Credentials are used to authenticate with the registry. If nil, the
+	// credentials are loaded from the docker config.json (see
+	// DockerConfigPath).
+	Credentials *Credentials
+
+	// UserAgent is the User-Agent used for requests.
+	UserAgent string
+
+	// Push requests push access to the repository when authenticating, which
+	// is required in order to upload blobs and manifests.
+	Push bool
+
+	// Timeout is the maximum amount of time a request to the registry may go
+	// without making progress (that is, without any of the request being sent
+	// or any of the response being received). Requests which stall for longer
+	// than Timeout are aborted with ErrTimeout, and are retried like any other
+	// transient error. Because only stalled requests are aborted, blobs of any
+	// size can still be transferred. If zero, requests never time out (other
+	// than through the context passed to each method). To limit how long an
+	// entire operation may take, pass a context with a deadline instead.
+	Timeout time.Duration
+}
+
+// Client is a client for a single repository in a registry.
+type Client struct {
+	ref        Reference
+	httpClient *http.Client
+	scheme     string
+	creds      *Credentials
+	userAgent  string
+	timeout    time.Duration
+
+	// actions are the actions requested when requesting bearer tokens.
+	actions string
+
+	// lock protects authorization.
+	lock sync.Mutex
+
+	// authorization is the Authorization header value for requests, once we
+	// have authenticated with the registry.
+	authorization string
+}
+
+// NewClient creates a new client for the repository referenced by ref.
+func NewClient(ref Reference, opt *ClientOptions) (*Client, error) {
+	var options ClientOptions
+	if opt != nil {
+		options = *opt
+	}
+	if options.Timeout < 0 {
+		return nil, errors.Errorf("invalid timeout %s: must not be negative", options.Timeout)
+	}
+
+	client := &Client{
+		ref:        ref,
+		httpClient: options.HTTPClient,
+		scheme:     "https",
+		creds:      options.Credentials,
+		userAgent:  options.UserAgent,
+		timeout:    options.Timeout,
+		actions:    "pull",
+	}
+	if client.httpClient == nil {
+		client.httpClient = http.DefaultClient
+	}
+	if options.PlainHTTP {
+		client.scheme = "http"
+	}
+	if options.Push {
+		client.actions = "pull,push"
+	}
+	if client.creds == nil {
+		creds, err := LoadCredentials(DockerConfigPath(), ref.Registry)
+		if err != nil {
+			return nil, errors.Wrap(err, "load registry credentials")
+		}
+		client.creds = creds
+	}
+	return client, nil
+}
+
+// Reference returns the reference the client was created for.
+func (c *Client) Reference() Reference {
+	return c.ref
+}
+
+// url returns the URL of the given path in the repository API.
+func (c *Client) url(format string, args ...interface{}) string {
+	return fmt.Sprintf("%s://%s/v2/%s/", c.scheme, c.ref.host(), c.ref.Repository) + fmt.Sprintf(format, args...)
+}
+
+// registryError is the error format returned by registries.
+type registryError struct {
+	Errors []struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+// checkResponse returns an error if the response doesn't have one of the
+// expected status codes, closing the response body in that case.
+func checkResponse(resp *http.Response, expected ...int) error {
+	for _, status := range expected {
+		if resp.StatusCode == status {
+			return nil
+		}
+	}
+	defer resp.Body.Close()
+
+	msg := resp.Status
+	var regErr registryError
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&regErr); err == nil {
+		for _, e := range regErr.Errors {
+			msg += fmt.Sprintf(": %s (%s)", e.Message, e.Code)
+		}
+	}
+	err := errors.Errorf("%s %s: %s", resp.Request.Method, resp.Request.URL.Redacted(), msg)
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		err = errors.Wrap(ErrNotFound, err.Error())
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		err = transientError{err}
+	}
+	return err
+}
+
+// parseChallenge parses a WWW-Authenticate header, returning the scheme and
+// the parameters of the challenge.
+func parseChallenge(header string) (string, map[string]string) {
+	params := map[string]string{}
+	parts := strings.SplitN(strings.TrimSpace(header), " ", 2)
+	scheme := strings.ToLower(parts[0])
+	if len(parts) < 2 {
+		return scheme, params
+	}
+
+	rest := parts[1]
+	for rest != "" {
+		rest = strings.TrimLeft(rest, " ,")
+		idx := strings.Index(rest, "=")
+		if idx < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(rest[:idx]))
+		rest = rest[idx+1:]
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			// Quoted value, which may contain escaped characters.
+			var buf strings.Builder
+			i := 1
+			for ; i < len(rest) && rest[i] != '"'; i++ {
+				if rest[i] == '\\' && i+1 < len(rest) {
+					i++
+				}
+				buf.WriteByte(rest[i])
+			}
+			value = buf.String()
+			if i < len(rest) {
+				// Skip the closing quote.
+				i++
+			}
+			rest = rest[i:]
+		} else {
+			end := strings.Index(rest, ",")
+			if end < 0 {
+				end = len(rest)
+			}
+			value = strings.TrimSpace(rest[:end])
+			rest = rest[end:]
+		}
+		params[key] = value
+	}
+	return scheme, params
+}
+
+// tokenResponse is the response from a token server.
+type tokenResponse struct {
+	Token       string `json:"token"`
+	AccessToken string `json:"access_token"`
+}
+
+// authenticate responds to the given WWW-Authenticate challenge, updating the
+// authorization used for future requests.
+func (c *Client) authenticate(ctx context.Context, challenge string) error {
+	scheme, params := parseChallenge(challenge)
+	switch scheme {
+	case "basic":
+		if c.creds == nil || c.creds.Username == "" {
+			return errors.Errorf("registry %s requires basic authentication but no credentials are available", c.ref.Registry)
+		}
+		auth := base64.StdEncoding.EncodeToString([]byte(c.creds.Username + ":" + c.creds.Password))
+		c.lock.Lock()
+		c.authorization = "Basic " + auth
+		c.lock.Unlock()
+		return nil
+	case "bearer":
+		// Handled below.
+	default:
+		return errors.Errorf("unsupported authentication scheme %q", scheme)
+	}
+
+	realm := params["realm"]
+	if realm == "" {
+		return errors.Errorf("bearer challenge is missing realm")
+	}
+	scope := params["scope"]
+	if scope == "" {
+		scope = fmt.Sprintf("repository:%s:%s", c.ref.Repository, c.actions)
+	}
+
+	var req *http.Request
+	var err error
+	if c.creds != nil && c.creds.IdentityToken != "" {
+		// OAuth2 refresh tokens must be exchanged using a POST.
+		form := url.Values{
+			"grant_type":    {"refresh_token"},
+			"refresh_token": {c.creds.IdentityToken},
+			"service":       {params["service"]},
+			"scope":         {scope},
+			"client_id":     {"umoci"},
+		}
+		req, err = http.NewRequestWithContext(ctx, "POST", realm, strings.NewReader(form.Encode()))
+		if err != nil {
+			return errors.Wrap(err, "create token request")
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		tokenURL, err := url.Parse(realm)
+		if err != nil {
+			return errors.Wrap(err, "parse token realm")
+		}
+		query := tokenURL.Query()
+		if service := params["service"]; service != "" {
+			query.Set("service", service)
+		}
+		query.Set("scope", scope)
+		tokenURL.RawQuery = query.Encode()
+
+		req, err = http.NewRequestWithContext(ctx, "GET", tokenURL.String(), nil)
+		if err != nil {
+			return errors.Wrap(err, "create token request")
+		}
+		if c.creds != nil && c.creds.Username != "" {
+			req.SetBasicAuth(c.creds.Username, c.creds.Password)
+		}
+	}
+	if c.userAgent != "" {
+		req.Header.Set("User-Agent", c.userAgent)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "request token")
+	}
+	if err := checkResponse(resp, http.StatusOK); err != nil {
+		return errors.Wrap(err, "request token")
+	}
+	defer resp.Body.Close()
+
+	var token tokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return errors.Wrap(err, "parse token response")
+	}
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+	if token.Token == "" {
+		return errors.Errorf("token server returned an empty token")
+	}
+
+	c.lock.Lock()
+	c.authorization = "Bearer " + token.Token
+	c.lock.Unlock()
+	return nil
+}
+
+// do sends the request created by newRequest, authenticating with the
+// registry and retrying the request if needed. newRequest may be called more
+// than once.
+func (c *Client) do(ctx context.Context, newRequest func() (*http.Request, error)) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := newRequest()
+		if err != nil {
+			return nil, errors.Wrap(err, "create request")
+		}
+		what := req.Method + " " + req.URL.Redacted()
+		reqCtx, timer := newStallTimer(ctx, c.timeout)
+		req = req.WithContext(reqCtx)
+		if timer != nil && req.Body != nil {
+			req.Body = &stallReader{ReadCloser: req.Body, timer: timer, what: what}
+		}
+		if c.userAgent != "" {
+			req.Header.Set("User-Agent", c.userAgent)
+		}
+		c.lock.Lock()
+		if c.authorization != "" {
+			req.Header.Set("Authorization", c.authorization)
+		}
+		c.lock.Unlock()
+
+		resp, err := c.httpClient.Do(req)
+		if err != nil {
+			timer.stop()
+			if timeoutErr := timer.wrapErr(err, what); timeoutErr != err {
+				return nil, timeoutErr
+			}
+			err = errors.Wrap(err, what)
+			if ctx.Err() == nil {
+				err = transientError{err}
+			}
+			return nil, err
+		}
+		if timer != nil {
+			// The response body is only complete once it has been read, so
+			// keep the timer running until the body is closed.
+			timer.progress()
+			resp.Body = &stallReader{ReadCloser: resp.Body, timer: timer, what: what, stopOnClose: true}
+		}
+		if resp.StatusCode != http.StatusUnauthorized || attempt > 0 {
+			return resp, nil
+		}
+
+		// Authenticate and try again.
+		challenge := resp.Header.Get("WWW-Authenticate")
+		// #nosec G104
+		_ = resp.Body.Close()
+		if challenge == "" {
+			return nil, errors.Errorf("%s %s: unauthorized without an authentication challenge", req.Method, req.URL.Redacted())
+		}
+		log.Debugf("registry: authenticating with %s", c.ref.Registry)
+		if err := c.authenticate(ctx, challenge); err != nil {
+			return nil, errors.Wrap(err, "authenticate with registry")
+		}
+	}
+}
+
+// GetManifest fetches the manifest (or index) with the given reference (a tag
+// or digest), returning its descriptor and contents. The digest of the
+// contents is verified if reference is a digest.
+func (c *Client) GetManifest(ctx context.Context, reference string) (ispec.Descriptor, []byte, error) {
+	resp, err := c.do(ctx, func() (*http.Request, error) {
+		req, err := http.NewRequest("GET", c.url("manifests/%s", reference), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", strings.Join(manifestMediaTypes, ", "))
+		return req, nil
+	})
+	if err != nil {
+		return ispec.Descriptor{}, nil, err
+	}
+	if err := checkResponse(resp, http.StatusOK); err != nil {
+		return ispec.Descriptor{}, nil, errors.Wrapf(err, "get manifest %s", reference)
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxManifestSize+1))
+	if err != nil {
+		return ispec.Descriptor{}, nil, errors.Wrapf(err, "read manifest %s", reference)
+	}
+	if len(data) > maxManifestSize {
+		return ispec.Descriptor{}, nil, errors.Errorf("manifest %s is larger than the maximum manifest size (%d bytes)", reference, maxManifestSize)
+	}
+
+	descriptor := ispec.Descriptor{
+		Digest: digest.FromBytes(data),
+		Size:   int64(len(data)),
+	}
+	if expected, err := digest.Parse(reference); err == nil && expected != descriptor.Digest {
+		return ispec.Descriptor{}, nil, errors.Errorf("manifest %s has mismatched digest %s", reference, descriptor.Digest)
+	}
+	if expected := resp.Header.Get("Docker-Content-Digest"); expected != "" && expected != descriptor.Digest.String() {
+		return ispec.Descriptor{}, nil, errors.Errorf("manifest %s has digest %s but registry claimed %s", reference, descriptor.Digest, expected)
+	}
+
+	// Figure out the media type, preferring the embedded mediaType.
+	var manifestType struct {
+		MediaType string          `json:"mediaType"`
+		Manifests json.RawMessage `json:"manifests"`
+	}
+	if err := json.Unmarshal(data, &manifestType); err != nil {
+		return ispec.Descriptor{}, nil, errors.Wrapf(err, "parse manifest %s", reference)
+	}
+	descriptor.MediaType = manifestType.MediaType
+	if descriptor.MediaType == "" {
+		descriptor.MediaType, _, _ = mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	}
+	switch descriptor.MediaType {
+	case ispec.MediaTypeImageManifest, ispec.MediaTypeImageIndex,
+		dockerarchive.MediaTypeDockerManifest, dockerarchive.MediaTypeDockerManifestList:
+	default:
+		// Some registries return a generic Content-Type, so fall back to
+		// looking at the contents.
+		descriptor.MediaType = ispec.MediaTypeImageManifest
+		if manifestType.Manifests != nil {
+			descriptor.MediaType = ispec.MediaTypeImageIndex
+		}
+	}
+	return descriptor, data, nil
+}
+
+// GetBlob fetches the blob described by descriptor. The returned reader
+// verifies the digest and size of the blob, so the caller must read it to EOF
+// and check the error from Close.
+func (c *Client) GetBlob(ctx context.Context, descriptor ispec.Descriptor) (io.ReadCloser, error) {
+	resp, err := c.do(ctx, func() (*http.Request, error) {
+		return http.NewRequest("GET", c.url("blobs/%s", descriptor.Digest), nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := checkResponse(resp, http.StatusOK); err != nil {
+		return nil, errors.Wrapf(err, "get blob %s", descriptor.Digest)
+	}
+	return &hardening.VerifiedReadCloser{
+		Reader:         transientReader{resp.Body},
+		ExpectedDigest: descriptor.Digest,
+		ExpectedSize:   descriptor.Size,
+	}, nil
+}
+
+// BlobExists returns whether the blob with the given digest exists in the
+// repository.
+func (c *Client) BlobExists(ctx context.Context, dgst digest.Digest) (bool, error) {
+	resp, err := c.do(ctx, func() (*http.Request, error) {
+		return http.NewRequest("HEAD", c.url("blobs/%s", dgst), nil)
+	})
+	if err != nil {
+		return false, err
+	}
+	if err := checkResponse(resp, http.StatusOK); err != nil {
+		if errors.Cause(err) == ErrNotFound {
+			return false, nil
+		}
+		return false, errors.Wrapf(err, "stat blob %s", dgst)
+	}
+	// #nosec G104
+	_ = resp.Body.Close()
+	return true, nil
+}
+
+// uploadLocation returns the upload URL given in the Location header of an
+// upload response, resolved relative to the request URL.
+func uploadLocation(resp *http.Response) (*url.URL, error) {
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return nil, errors.Errorf("%s %s: registry did not return an upload location", resp.Request.Method, resp.Request.URL.Redacted())
+	}
+	return resp.Request.URL.Parse(location)
+}
+
+// startUpload starts a new blob upload session, returning the upload URL.
+func (c *Client) startUpload(ctx context.Context) (*url.URL, error) {
+	resp, err := c.do(ctx, func() (*http.Request, error) {
+		return http.NewRequest("POST", c.url("blobs/uploads/"), nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := checkResponse(resp, http.StatusAccepted); err != nil {
+		return nil, errors.Wrap(err, "start blob upload")
+	}
+	// #nosec G104
+	_ = resp.Body.Close()
+	return uploadLocation(resp)
+}
+
+// MountBlob attempts to cross-mount the blob with the given digest from
+// another repository in the same registry, returning whether the blob was
+// mounted. Registries may refuse to mount blobs (for instance if the blob
+// doesn't exist in the other repository, or mounting is not supported), in
+// which case the blob needs to be uploaded with PutBlob.
+func (c *Client) MountBlob(ctx context.Context, dgst digest.Digest, from string) (bool, error) {
+	resp, err := c.do(ctx, func() (*http.Request, error) {
+		query := url.Values{"mount": {dgst.String()}, "from": {from}}
+		return http.NewRequest("POST", c.url("blobs/uploads/?%s", query.Encode()), nil)
+	})
+	if err != nil {
+		return false, err
+	}
+	if err := checkResponse(resp, http.StatusCreated, http.StatusAccepted); err != nil {
+		return false, errors.Wrapf(err, "mount blob %s from %s", dgst, from)
+	}
+	// #nosec G104
+	_ = resp.Body.Close()
+	if resp.StatusCode == http.StatusCreated {
+		return true, nil
+	}
+
+	// The registry started a regular upload session instead. We don't use it
+	// (PutBlob will start its own), so cancel it -- failing to do so isn't
+	// fatal since registries expire unused sessions.
+	location, err := uploadLocation(resp)
+	if err != nil {
+		return false, nil
+	}
+	if resp, err := c.do(ctx, func() (*http.Request, error) {
+		return http.NewRequest("DELETE", location.String(), nil)
+	}); err == nil {
+		// #nosec G104
+		_ = resp.Body.Close()
+	}
+	return false, nil
+}
+
+// PutBlob uploads the contents of reader as the blob described by descriptor.
+// Blobs larger than uploadChunkSize are uploaded in several chunks, otherwise
+// the blob is uploaded in a single request. The registry verifies the digest
+// of the uploaded blob.
+func (c *Client) PutBlob(ctx context.Context, descriptor ispec.Descriptor, reader io.Reader) error {
+	location, err := c.startUpload(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Each chunk is buffered in memory so that the request can be retried
+	// if we need to authenticate again.
+	buffer := make([]byte, uploadChunkSize)
+	var (
+		offset int64
+		chunk  []byte
+	)
+	for {
+		n, err := io.ReadFull(reader, buffer)
+		chunk = buffer[:n]
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return errors.Wrapf(err, "read blob %s", descriptor.Digest)
+		}
+
+		resp, err := c.do(ctx, func() (*http.Request, error) {
+			req, err := http.NewRequest("PATCH", location.String(), bytes.NewReader(chunk))
+			if err != nil {
+				return nil, err
+			}
+			req.Header.Set("Content-Type", "application/octet-stream")
+			req.Header.Set("Content-Range", fmt.Sprintf("%d-%d", offset, offset+int64(n)-1))
+			return req, nil
+		})
+		if err != nil {
+			return err
+		}
+		if err := checkResponse(resp, http.StatusAccepted); err != nil {
+			return errors.Wrapf(err, "upload blob %s chunk at offset %d", descriptor.Digest, offset)
+		}
+		// #nosec G104
+		_ = resp.Body.Close()
+		if location, err = uploadLocation(resp); err != nil {
+			return err
+		}
+		offset += int64(n)
+	}
+
+	// The final request includes any remaining data, and completes the
+	// upload.
+	if size := offset + int64(len(chunk)); size != descriptor.Size {
+		return errors.Errorf("blob %s has size %d but expected %d", descriptor.Digest, size, descriptor.Size)
+	}
+	query := location.Query()
+	query.Set("digest", descriptor.Digest.String())
+	location.RawQuery = query.Encode()
+
+	resp, err := c.do(ctx, func() (*http.Request, error) {
+		req, err := http.NewRequest("PUT", location.String(), bytes.NewReader(chunk))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/octet-stream")
+		req.Header.Set("Content-Length", strconv.Itoa(len(chunk)))
+		return req, nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := checkResponse(resp, http.StatusCreated); err != nil {
+		return errors.Wrapf(err, "complete blob %s upload", descriptor.Digest)
+	}
+	// #nosec G104
+	_ = resp.Body.Close()
+	return nil
+}
+
+// PutManifest uploads the manifest (or index) described by descriptor with
+// the given contents, tagging it with reference (a tag or digest).
+func (c *Client) PutManifest(ctx context.Context, reference string, descriptor ispec.Descriptor, data []byte) error {
+	resp, err := c.do(ctx, func() (*http.Request, error) {
+		req, err := http.NewRequest("PUT", c.url("manifests/%s", reference), bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", descriptor.MediaType)
+		return req, nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := checkResponse(resp, http.StatusCreated); err != nil {
+		return errors.Wrapf(err, "put manifest %s", reference)
+	}
+	// #nosec G104
+	_ = resp.Body.Close()
+	if actual := resp.Header.Get("Docker-Content-Digest"); actual != "" && actual != descriptor.Digest.String() {
+		return errors.Errorf("registry stored manifest %s with digest %s", descriptor.Digest, actual)
+	}
+	return nil
+}
@@ -0,0 +1,364 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// fakeRegistry is a minimal in-memory registry implementing the subset of the
+// distribution API used by Client (including pushing), optionally requiring token authentication.
+type fakeRegistry struct {
+	t      *testing.T
+	server *httptest.Server
+
+	lock sync.Mutex
+
+	// manifests maps "<repo>/<tag or digest>" to the manifest contents and
+	// media type.
+	manifests map[string]fakeManifest
+
+	// blobs maps digests to blob contents, and are available in every
+	// repository.
+	blobs map[digest.Digest][]byte
+
+	// repoBlobs maps repositories to the blobs which have been uploaded to
+	// (or mounted in) that repository.
+	repoBlobs map[string]map[digest.Digest][]byte
+
+	// uploads maps upload session ids to the data uploaded so far, and
+	// nextUpload is the id of the next upload session.
+	uploads    map[string][]byte
+	nextUpload int
+
+	// patches counts the number of chunks uploaded with PATCH.
+	patches int
+
+	// scopes are the scopes requested from the token server.
+	scopes []string
+
+	// username and password are the credentials required to get a token. If
+	// username is empty, no authentication is required.
+	username, password string
+
+	// requests counts the requests made to each path.
+	requests map[string]int
+
+	// failures is the number of requests to each path which will fail with
+	// "503 Service Unavailable" before the path is served normally.
+	failures map[string]int
+
+	// stalls is the number of requests to each path which will stall (never
+	// complete) until the client gives up. If stallHeaders is set, stalled
+	// requests don't send a response at all, otherwise only part of the
+	// response body is sent.
+	stalls       map[string]int
+	stallHeaders bool
+
+	// blobDelay delays every blob download (without holding lock), and
+	// maxBlobDownloads is the largest number of concurrent blob downloads seen.
+	blobDelay        time.Duration
+	blobLock         sync.Mutex
+	blobDownloads    int
+	maxBlobDownloads int
+}
+
+type fakeManifest struct {
+	mediaType string
+	data      []byte
+}
+
+const fakeToken = "fake-token"
+
+func newFakeRegistry(t *testing.T) *fakeRegistry {
+	reg := &fakeRegistry{
+		t:         t,
+		manifests: map[string]fakeManifest{},
+		blobs:     map[digest.Digest][]byte{},
+		repoBlobs: map[string]map[digest.Digest][]byte{},
+		uploads:   map[string][]byte{},
+		requests:  map[string]int{},
+		failures:  map[string]int{},
+		stalls:    map[string]int{},
+	}
+	reg.server = httptest.NewServer(http.HandlerFunc(reg.serveHTTP))
+	return reg
+}
+
+func (reg *fakeRegistry) Close() {
+	reg.server.Close()
+}
+
+// host returns the host:port of the registry.
+func (reg *fakeRegistry) host() string {
+	u, err := url.Parse(reg.server.URL)
+	if err != nil {
+		reg.t.Fatal(err)
+	}
+	return u.Host
+}
+
+// client returns a Client for the given repository and tag or digest in the
+// registry.
+func (reg *fakeRegistry) client(name string, creds *Credentials) *Client {
+	ref, err := ParseReference(TransportPrefix + reg.host() + "/" + name)
+	if err != nil {
+		reg.t.Fatalf("parse reference: %+v", err)
+	}
+	if creds == nil {
+		creds = &Credentials{}
+	}
+	client, err := NewClient(ref, &ClientOptions{PlainHTTP: true, Credentials: creds, Push: true})
+	if err != nil {
+		reg.t.Fatalf("create client: %+v", err)
+	}
+	return client
+}
+
+// putBlob adds a blob to the registry, returning its digest.
+func (reg *fakeRegistry) putBlob(data []byte) digest.Digest {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+	dgst := digest.FromBytes(data)
+	reg.blobs[dgst] = data
+	return dgst
+}
+
+// putManifest adds a manifest to the registry under its digest and the given
+// tag (if not empty), returning its digest.
+func (reg *fakeRegistry) putManifest(repo, tag, mediaType string, v interface{}) digest.Digest {
+	data, err := json.Marshal(v)
+	if err != nil {
+		reg.t.Fatal(err)
+	}
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+	dgst := digest.FromBytes(data)
+	reg.manifests[repo+"/"+dgst.String()] = fakeManifest{mediaType: mediaType, data: data}
+	if tag != "" {
+		reg.manifests[repo+"/"+tag] = fakeManifest{mediaType: mediaType, data: data}
+	}
+	return dgst
+}
+
+// getBlob returns the blob with the given digest, if it is available in the
+// given repository.
+func (reg *fakeRegistry) getBlob(repo string, dgst digest.Digest) ([]byte, bool) {
+	if data, ok := reg.blobs[dgst]; ok {
+		return data, true
+	}
+	data, ok := reg.repoBlobs[repo][dgst]
+	return data, ok
+}
+
+// linkBlob makes a blob available in the given repository.
+func (reg *fakeRegistry) linkBlob(repo string, dgst digest.Digest, data []byte) {
+	if reg.repoBlobs[repo] == nil {
+		reg.repoBlobs[repo] = map[digest.Digest][]byte{}
+	}
+	reg.repoBlobs[repo][dgst] = data
+}
+
+func (reg *fakeRegistry) writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `{"errors": [{"code": %q, "message": %q}]}`, code, message)
+}
+
+func (reg *fakeRegistry) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	// Stalled requests must not hold lock, so that other requests can still
+	// be served.
+	reg.lock.Lock()
+	stall := reg.stalls[r.URL.Path] > 0
+	if stall {
+		reg.stalls[r.URL.Path]--
+		reg.requests[r.URL.Path]++
+	}
+	stallHeaders := reg.stallHeaders
+	reg.lock.Unlock()
+	if stall {
+		if !stallHeaders {
+			w.WriteHeader(http.StatusOK)
+			_, _ = w.Write([]byte("p"))
+			w.(http.Flusher).Flush()
+		}
+		<-r.Context().Done()
+		return
+	}
+
+	if reg.blobDelay > 0 && r.Method == "GET" && strings.Contains(r.URL.Path, "/blobs/sha256:") {
+		reg.blobLock.Lock()
+		reg.blobDownloads++
+		if reg.blobDownloads > reg.maxBlobDownloads {
+			reg.maxBlobDownloads = reg.blobDownloads
+		}
+		reg.blobLock.Unlock()
+		time.Sleep(reg.blobDelay)
+		defer func() {
+			reg.blobLock.Lock()
+			reg.blobDownloads--
+			reg.blobLock.Unlock()
+		}()
+	}
+
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+	reg.requests[r.URL.Path]++
+
+	if reg.failures[r.URL.Path] > 0 {
+		reg.failures[r.URL.Path]--
+		reg.writeError(w, http.StatusServiceUnavailable, "UNAVAILABLE", "service unavailable")
+		return
+	}
+
+	if r.URL.Path == "/token" {
+		if user, pass, ok := r.BasicAuth(); !ok || user != reg.username || pass != reg.password {
+			reg.writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "invalid credentials")
+			return
+		}
+		if r.URL.Query().Get("service") != "fake" || !strings.HasPrefix(r.URL.Query().Get("scope"), "repository:") {
+			reg.writeError(w, http.StatusBadRequest, "DENIED", "invalid token request")
+			return
+		}
+		reg.scopes = append(reg.scopes, r.URL.Query()["scope"]...)
+		fmt.Fprintf(w, `{"token": %q}`, fakeToken)
+		return
+	}
+
+	if reg.username != "" && r.Header.Get("Authorization") != "Bearer "+fakeToken {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="fake"`, reg.server.URL))
+		reg.writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "authentication required")
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/v2/")
+	switch {
+	case r.Method == "GET" && strings.Contains(path, "/manifests/"):
+		parts := strings.SplitN(path, "/manifests/", 2)
+		manifest, ok := reg.manifests[parts[0]+"/"+parts[1]]
+		if !ok {
+			reg.writeError(w, http.StatusNotFound, "MANIFEST_UNKNOWN", "manifest unknown")
+			return
+		}
+		w.Header().Set("Content-Type", manifest.mediaType)
+		w.Header().Set("Docker-Content-Digest", digest.FromBytes(manifest.data).String())
+		_, _ = w.Write(manifest.data)
+	case r.Method == "PUT" && strings.Contains(path, "/manifests/"):
+		parts := strings.SplitN(path, "/manifests/", 2)
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			reg.writeError(w, http.StatusBadRequest, "MANIFEST_INVALID", err.Error())
+			return
+		}
+		var manifest ispec.Manifest
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			reg.writeError(w, http.StatusBadRequest, "MANIFEST_INVALID", err.Error())
+			return
+		}
+		if r.Header.Get("Content-Type") == ispec.MediaTypeImageManifest {
+			for _, blob := range append([]ispec.Descriptor{manifest.Config}, manifest.Layers...) {
+				if _, ok := reg.getBlob(parts[0], blob.Digest); !ok && blob.MediaType != ispec.MediaTypeImageLayerNonDistributableGzip {
+					reg.writeError(w, http.StatusBadRequest, "MANIFEST_BLOB_UNKNOWN", "blob unknown "+blob.Digest.String())
+					return
+				}
+			}
+		}
+		dgst := digest.FromBytes(data)
+		reg.manifests[parts[0]+"/"+dgst.String()] = fakeManifest{mediaType: r.Header.Get("Content-Type"), data: data}
+		reg.manifests[parts[0]+"/"+parts[1]] = fakeManifest{mediaType: r.Header.Get("Content-Type"), data: data}
+		w.Header().Set("Docker-Content-Digest", dgst.String())
+		w.WriteHeader(http.StatusCreated)
+	case (r.Method == "GET" || r.Method == "HEAD") && strings.Contains(path, "/blobs/"):
+		parts := strings.SplitN(path, "/blobs/", 2)
+		data, ok := reg.getBlob(parts[0], digest.Digest(parts[1]))
+		if !ok {
+			reg.writeError(w, http.StatusNotFound, "BLOB_UNKNOWN", "blob unknown")
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(data)))
+		if r.Method == "GET" {
+			_, _ = bytes.NewReader(data).WriteTo(w)
+		}
+	case r.Method == "POST" && strings.HasSuffix(path, "/blobs/uploads/"):
+		repo := strings.TrimSuffix(path, "/blobs/uploads/")
+		if mount := r.URL.Query().Get("mount"); mount != "" {
+			if data, ok := reg.repoBlobs[r.URL.Query().Get("from")][digest.Digest(mount)]; ok {
+				reg.linkBlob(repo, digest.Digest(mount), data)
+				w.WriteHeader(http.StatusCreated)
+				return
+			}
+		}
+		id := fmt.Sprintf("upload-%d", reg.nextUpload)
+		reg.nextUpload++
+		reg.uploads[id] = []byte{}
+		w.Header().Set("Location", "/v2/"+repo+"/blobs/uploads/"+id)
+		w.WriteHeader(http.StatusAccepted)
+	case strings.Contains(path, "/blobs/uploads/"):
+		parts := strings.SplitN(path, "/blobs/uploads/", 2)
+		data, ok := reg.uploads[parts[1]]
+		if !ok {
+			reg.writeError(w, http.StatusNotFound, "BLOB_UPLOAD_UNKNOWN", "upload unknown")
+			return
+		}
+		chunk, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			reg.writeError(w, http.StatusBadRequest, "BLOB_UPLOAD_INVALID", err.Error())
+			return
+		}
+		switch r.Method {
+		case "PATCH":
+			if expected := fmt.Sprintf("%d-%d", len(data), len(data)+len(chunk)-1); r.Header.Get("Content-Range") != expected {
+				reg.writeError(w, http.StatusRequestedRangeNotSatisfiable, "BLOB_UPLOAD_INVALID", "invalid range")
+				return
+			}
+			reg.patches++
+			reg.uploads[parts[1]] = append(data, chunk...)
+			w.Header().Set("Location", r.URL.Path)
+			w.WriteHeader(http.StatusAccepted)
+		case "PUT":
+			data = append(data, chunk...)
+			delete(reg.uploads, parts[1])
+			if dgst := digest.FromBytes(data); dgst.String() != r.URL.Query().Get("digest") {
+				reg.writeError(w, http.StatusBadRequest, "DIGEST_INVALID", "digest mismatch")
+				return
+			}
+			reg.linkBlob(parts[0], digest.FromBytes(data), data)
+			w.WriteHeader(http.StatusCreated)
+		case "DELETE":
+			delete(reg.uploads, parts[1])
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			reg.writeError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", "unsupported method")
+		}
+	default:
+		reg.writeError(w, http.StatusNotFound, "UNSUPPORTED", "unsupported request")
+	}
+}
@@ -0,0 +1,295 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package registry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/docker/go-units"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/opencontainers/umoci/oci/casext/mediatype"
+	"github.com/opencontainers/umoci/oci/dockerarchive"
+	"github.com/pkg/errors"
+)
+
+// PullOptions modifies the behaviour of Pull.
+type PullOptions struct {
+	// MaxConcurrentDownloads is the maximum number of layer blobs of a
+	// manifest which will be downloaded in parallel. Values less than 1 are
+	// treated as 1 (layers are downloaded one at a time).
+	MaxConcurrentDownloads int
+}
+
+// pullRetries is the number of times a request which failed with a transient
+// error (such as a connection error or a 5xx response) is retried. The delay
+// before the first retry is pullRetryDelay, and doubles for each retry.
+const pullRetries = 3
+
+var pullRetryDelay = time.Second
+
+// withRetry calls fn, retrying it (with exponential backoff) if it fails with
+// a transient error. Any other error is returned immediately.
+func withRetry(ctx context.Context, what string, fn func() error) error {
+	delay := pullRetryDelay
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || !isTransient(err) || attempt >= pullRetries {
+			return err
+		}
+		log.Warnf("%s failed, retrying in %s: %v", what, delay, err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return errors.Wrap(ctx.Err(), what)
+		}
+		delay *= 2
+	}
+}
+
+// isNonDistributable returns whether blobs of the given layer media type may
+// be unavailable from the registry.
+func isNonDistributable(mediaType string) bool {
+	return mediatype.IsNonDistributable(mediaType) || mediaType == dockerarchive.MediaTypeDockerForeignLayer
+}
+
+// pullBlob fetches the blob described by descriptor from the registry and
+// stores it in the image layout, unless the image layout already contains it.
+func pullBlob(ctx context.Context, engineExt casext.Engine, client *Client, descriptor ispec.Descriptor) error {
+	exists, err := engineExt.StatBlob(ctx, descriptor.Digest)
+	if err != nil {
+		return errors.Wrapf(err, "stat blob %s", descriptor.Digest)
+	}
+	if exists {
+		log.Debugf("registry: blob %s already exists", descriptor.Digest)
+		return nil
+	}
+
+	log.WithFields(log.Fields{
+		"digest": descriptor.Digest,
+		"size":   units.HumanSize(float64(descriptor.Size)),
+	}).Infof("pulling blob")
+
+	return withRetry(ctx, "pull blob "+descriptor.Digest.String(), func() error {
+		blob, err := client.GetBlob(ctx, descriptor)
+		if err != nil {
+			return err
+		}
+		defer blob.Close()
+
+		// The blob reader verifies the digest and size of the blob, so a
+		// corrupted blob will cause PutBlob to fail (and PutBlob only stores
+		// the blob once it has been completely written).
+		if _, _, err := engineExt.PutBlob(ctx, blob); err != nil {
+			return errors.Wrapf(err, "put blob %s", descriptor.Digest)
+		}
+		return errors.Wrapf(blob.Close(), "verify blob %s", descriptor.Digest)
+	})
+}
+
+// pullLayers fetches the given layer blobs from the registry and stores them
+// in the image layout, with up to maxDownloads blobs being downloaded in
+// parallel. The order in which the layers are stored is not important, as the
+// manifest (which defines their order) is stored after all of its layers.
+// Non-distributable layers which are not available from the registry are
+// skipped. The first error cancels every other download.
+func pullLayers(ctx context.Context, engineExt casext.Engine, client *Client, layers []ispec.Descriptor, maxDownloads int) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+
+	workers := maxDownloads
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(layers) {
+		workers = len(layers)
+	}
+	jobs := make(chan ispec.Descriptor)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for layer := range jobs {
+				if err := pullBlob(ctx, engineExt, client, layer); err != nil {
+					if errors.Cause(err) == ErrNotFound && isNonDistributable(layer.MediaType) {
+						log.Warnf("non-distributable layer %s is not available from the registry: %v", layer.Digest, err)
+						continue
+					}
+					errOnce.Do(func() {
+						firstErr = errors.Wrap(err, "pull layer")
+						cancel()
+					})
+				}
+			}
+		}()
+	}
+	// The same layer may be used more than once in a manifest, but we only
+	// need to download it once.
+	seen := map[digest.Digest]struct{}{}
+feed:
+	for _, layer := range layers {
+		if _, ok := seen[layer.Digest]; ok {
+			continue
+		}
+		seen[layer.Digest] = struct{}{}
+		select {
+		case jobs <- layer:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	return errors.Wrap(ctx.Err(), "pull layers")
+}
+
+// pullManifest fetches the manifest (or index) with the given reference, and
+// everything it references, and stores it in the image layout. If skipLayers
+// is set, the layer blobs referenced by manifests are not fetched. Docker
+// manifests and manifest lists are converted to their OCI equivalents (which
+// changes their digest), so the descriptor of the stored manifest is
+// returned.
+func pullManifest(ctx context.Context, engineExt casext.Engine, client *Client, reference string, skipLayers bool, opt PullOptions) (ispec.Descriptor, error) {
+	var (
+		descriptor ispec.Descriptor
+		data       []byte
+		err        error
+	)
+	if err := withRetry(ctx, "pull manifest "+reference, func() error {
+		descriptor, data, err = client.GetManifest(ctx, reference)
+		return err
+	}); err != nil {
+		return ispec.Descriptor{}, err
+	}
+
+	log.WithFields(log.Fields{
+		"digest":    descriptor.Digest,
+		"mediatype": descriptor.MediaType,
+	}).Debugf("registry: fetched manifest %s", reference)
+
+	var converted interface{}
+	switch descriptor.MediaType {
+	case ispec.MediaTypeImageManifest, dockerarchive.MediaTypeDockerManifest:
+		var manifest ispec.Manifest
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			return ispec.Descriptor{}, errors.Wrapf(err, "parse manifest %s", reference)
+		}
+
+		if err := pullBlob(ctx, engineExt, client, manifest.Config); err != nil {
+			return ispec.Descriptor{}, errors.Wrap(err, "pull config")
+		}
+		if !skipLayers {
+			if err := pullLayers(ctx, engineExt, client, manifest.Layers, opt.MaxConcurrentDownloads); err != nil {
+				return ispec.Descriptor{}, err
+			}
+		}
+
+		if descriptor.MediaType == dockerarchive.MediaTypeDockerManifest {
+			manifest.MediaType = ispec.MediaTypeImageManifest
+			if manifest.Config.MediaType, err = dockerarchive.TranslateMediaType(manifest.Config.MediaType); err != nil {
+				return ispec.Descriptor{}, errors.Wrap(err, "convert config descriptor")
+			}
+			for i := range manifest.Layers {
+				if manifest.Layers[i].MediaType, err = dockerarchive.TranslateMediaType(manifest.Layers[i].MediaType); err != nil {
+					return ispec.Descriptor{}, errors.Wrap(err, "convert layer descriptor")
+				}
+			}
+			converted = manifest
+		}
+
+	case ispec.MediaTypeImageIndex, dockerarchive.MediaTypeDockerManifestList:
+		var index ispec.Index
+		if err := json.Unmarshal(data, &index); err != nil {
+			return ispec.Descriptor{}, errors.Wrapf(err, "parse index %s", reference)
+		}
+
+		changed := descriptor.MediaType == dockerarchive.MediaTypeDockerManifestList
+		for i, child := range index.Manifests {
+			childDescriptor, err := pullManifest(ctx, engineExt, client, child.Digest.String(), skipLayers, opt)
+			if err != nil {
+				return ispec.Descriptor{}, errors.Wrapf(err, "pull index entry %s", child.Digest)
+			}
+			if childDescriptor.Digest != child.Digest || childDescriptor.MediaType != child.MediaType {
+				index.Manifests[i].MediaType = childDescriptor.MediaType
+				index.Manifests[i].Digest = childDescriptor.Digest
+				index.Manifests[i].Size = childDescriptor.Size
+				changed = true
+			}
+		}
+
+		if changed {
+			index.MediaType = ispec.MediaTypeImageIndex
+			converted = index
+		}
+
+	default:
+		// Should _never_ be reached.
+		return ispec.Descriptor{}, errors.Errorf("[internal error] unsupported manifest media type: %s", descriptor.MediaType)
+	}
+
+	if converted != nil {
+		if data, err = json.Marshal(converted); err != nil {
+			return ispec.Descriptor{}, errors.Wrap(err, "encode converted manifest")
+		}
+		log.Debugf("registry: converted %s %s to OCI", descriptor.MediaType, descriptor.Digest)
+		descriptor.MediaType, _ = dockerarchive.TranslateMediaType(descriptor.MediaType)
+	}
+
+	manifestDigest, manifestSize, err := engineExt.PutBlob(ctx, bytes.NewReader(data))
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "put manifest blob")
+	}
+	descriptor.Digest = manifestDigest
+	descriptor.Size = manifestSize
+	return descriptor, nil
+}
+
+// Pull fetches the image the client refers to from the registry, along with
+// every blob it references, and stores it in the image layout. If the image
+// is an index, every manifest in the index is pulled. The digest of every
+// blob is verified as it is downloaded. Docker manifests (and manifest lists)
+// are converted to OCI manifests (and indexes), which changes their digest.
+// The descriptor of the stored manifest (or index) is returned, and is not
+// tagged. The layers of each manifest are downloaded in parallel (up to
+// PullOptions.MaxConcurrentDownloads at a time), and requests which fail with
+// a transient error are retried with exponential backoff.
+func Pull(ctx context.Context, engineExt casext.Engine, client *Client, opt *PullOptions) (ispec.Descriptor, error) {
+	var options PullOptions
+	if opt != nil {
+		options = *opt
+	}
+
+	log.Infof("pulling %s", client.Reference())
+	return pullManifest(ctx, engineExt, client, client.Reference().reference(), false, options)
+}
@@ -0,0 +1,503 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	imeta "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/cas/dir"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/opencontainers/umoci/oci/dockerarchive"
+	"github.com/pkg/errors"
+)
+
+func newTestLayout(t *testing.T) (casext.Engine, func()) {
+	root, err := ioutil.TempDir("", "umoci-registry-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	return casext.NewEngine(engine), func() {
+		engine.Close()
+		os.RemoveAll(root)
+	}
+}
+
+// putTestImage adds a single-layer image to the registry, using either OCI or
+// Docker media types, returning the manifest descriptor.
+func putTestImage(reg *fakeRegistry, repo, tag, arch string, docker bool) ispec.Descriptor {
+	configType, layerType, manifestType := ispec.MediaTypeImageConfig, ispec.MediaTypeImageLayerGzip, ispec.MediaTypeImageManifest
+	if docker {
+		configType, layerType, manifestType = dockerarchive.MediaTypeDockerConfig, dockerarchive.MediaTypeDockerLayerGzip, dockerarchive.MediaTypeDockerManifest
+	}
+
+	config := []byte(`{"architecture": "` + arch + `", "os": "linux", "rootfs": {"type": "layers", "diff_ids": []}}`)
+	layer := []byte("layer for " + arch)
+	manifest := ispec.Manifest{
+		Versioned: imeta.Versioned{SchemaVersion: 2},
+		MediaType: manifestType,
+		Config: ispec.Descriptor{
+			MediaType: configType,
+			Digest:    reg.putBlob(config),
+			Size:      int64(len(config)),
+		},
+		Layers: []ispec.Descriptor{{
+			MediaType: layerType,
+			Digest:    reg.putBlob(layer),
+			Size:      int64(len(layer)),
+		}},
+	}
+	dgst := reg.putManifest(repo, tag, manifestType, manifest)
+	return ispec.Descriptor{
+		MediaType: manifestType,
+		Digest:    dgst,
+		Size:      int64(len(reg.manifests[repo+"/"+dgst.String()].data)),
+		Platform:  &ispec.Platform{OS: "linux", Architecture: arch},
+	}
+}
+
+// checkPulled makes sure that every blob reachable from descriptor is in the
+// image layout, returning the number of blobs.
+func checkPulled(t *testing.T, engineExt casext.Engine, descriptor ispec.Descriptor) map[digest.Digest]string {
+	blobs := map[digest.Digest]string{}
+	if err := engineExt.Walk(context.Background(), descriptor, func(descriptorPath casext.DescriptorPath) error {
+		d := descriptorPath.Descriptor()
+		blobs[d.Digest] = d.MediaType
+		exists, err := engineExt.StatBlob(context.Background(), d.Digest)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			t.Errorf("blob %s (%s) was not pulled", d.Digest, d.MediaType)
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("unexpected error walking pulled image: %+v", err)
+	}
+	return blobs
+}
+
+func TestPull(t *testing.T) {
+	ctx := context.Background()
+
+	reg := newFakeRegistry(t)
+	defer reg.Close()
+	reg.username, reg.password = "user", "pass"
+
+	engineExt, cleanup := newTestLayout(t)
+	defer cleanup()
+
+	expected := putTestImage(reg, "test/image", "v1", "amd64", false)
+
+	// Authentication must fail with the wrong credentials.
+	if _, err := Pull(ctx, engineExt, reg.client("test/image:v1", &Credentials{Username: "user", Password: "wrong"}), nil); err == nil {
+		t.Errorf("expected pull with wrong credentials to fail")
+	}
+
+	client := reg.client("test/image:v1", &Credentials{Username: "user", Password: "pass"})
+	descriptor, err := Pull(ctx, engineExt, client, nil)
+	if err != nil {
+		t.Fatalf("unexpected error pulling image: %+v", err)
+	}
+	if descriptor.Digest != expected.Digest || descriptor.MediaType != ispec.MediaTypeImageManifest {
+		t.Errorf("unexpected pulled descriptor: expected %s, got %+v", expected.Digest, descriptor)
+	}
+	if blobs := checkPulled(t, engineExt, descriptor); len(blobs) != 3 {
+		t.Errorf("expected 3 blobs to be pulled, got %d", len(blobs))
+	}
+
+	// Pulling by digest must work, and must not download the blobs again.
+	layerRequests := len(reg.requests)
+	byDigest := reg.client("test/image@"+expected.Digest.String(), &Credentials{Username: "user", Password: "pass"})
+	if descriptor, err := Pull(ctx, engineExt, byDigest, nil); err != nil {
+		t.Errorf("unexpected error pulling image by digest: %+v", err)
+	} else if descriptor.Digest != expected.Digest {
+		t.Errorf("unexpected descriptor pulling by digest: %+v", descriptor)
+	}
+	for path, count := range reg.requests {
+		if count > 1 && filepath.Base(filepath.Dir(path)) == "blobs" {
+			t.Errorf("blob %s was downloaded %d times", path, count)
+		}
+	}
+	if len(reg.requests) != layerRequests+1 {
+		t.Errorf("expected only the manifest to be requested again")
+	}
+
+	// Missing tags must fail.
+	if _, err := Pull(ctx, engineExt, reg.client("test/image:missing", &Credentials{Username: "user", Password: "pass"}), nil); err == nil {
+		t.Errorf("expected pulling a missing tag to fail")
+	}
+}
+
+func TestPullIndex(t *testing.T) {
+	ctx := context.Background()
+
+	reg := newFakeRegistry(t)
+	defer reg.Close()
+
+	engineExt, cleanup := newTestLayout(t)
+	defer cleanup()
+
+	index := ispec.Index{
+		Versioned: imeta.Versioned{SchemaVersion: 2},
+		MediaType: ispec.MediaTypeImageIndex,
+		Manifests: []ispec.Descriptor{
+			putTestImage(reg, "test/multi", "", "amd64", false),
+			putTestImage(reg, "test/multi", "", "arm64", false),
+		},
+	}
+	indexDigest := reg.putManifest("test/multi", "latest", ispec.MediaTypeImageIndex, index)
+
+	descriptor, err := Pull(ctx, engineExt, reg.client("test/multi", nil), nil)
+	if err != nil {
+		t.Fatalf("unexpected error pulling index: %+v", err)
+	}
+	if descriptor.Digest != indexDigest || descriptor.MediaType != ispec.MediaTypeImageIndex {
+		t.Errorf("unexpected pulled descriptor: expected %s, got %+v", indexDigest, descriptor)
+	}
+	if blobs := checkPulled(t, engineExt, descriptor); len(blobs) != 7 {
+		t.Errorf("expected 7 blobs to be pulled, got %d", len(blobs))
+	}
+}
+
+func TestPullDocker(t *testing.T) {
+	ctx := context.Background()
+
+	reg := newFakeRegistry(t)
+	defer reg.Close()
+
+	engineExt, cleanup := newTestLayout(t)
+	defer cleanup()
+
+	image := putTestImage(reg, "test/docker", "", "amd64", true)
+	list := ispec.Index{
+		Versioned: imeta.Versioned{SchemaVersion: 2},
+		MediaType: dockerarchive.MediaTypeDockerManifestList,
+		Manifests: []ispec.Descriptor{image},
+	}
+	listDigest := reg.putManifest("test/docker", "latest", dockerarchive.MediaTypeDockerManifestList, list)
+
+	descriptor, err := Pull(ctx, engineExt, reg.client("test/docker", nil), nil)
+	if err != nil {
+		t.Fatalf("unexpected error pulling docker image: %+v", err)
+	}
+	// Docker manifests are converted, which changes their digests.
+	if descriptor.Digest == listDigest || descriptor.MediaType != ispec.MediaTypeImageIndex {
+		t.Errorf("docker manifest list was not converted: %+v", descriptor)
+	}
+
+	blobs := checkPulled(t, engineExt, descriptor)
+	if len(blobs) != 4 {
+		t.Errorf("expected 4 blobs to be pulled, got %d", len(blobs))
+	}
+	for dgst, mediaType := range blobs {
+		if _, err := dockerarchive.TranslateMediaType(mediaType); err != nil || mediaType != mustTranslate(t, mediaType) {
+			t.Errorf("blob %s has non-OCI media type %s after pull", dgst, mediaType)
+		}
+		if dgst == image.Digest {
+			t.Errorf("docker manifest %s was not converted", dgst)
+		}
+	}
+}
+
+func mustTranslate(t *testing.T, mediaType string) string {
+	translated, err := dockerarchive.TranslateMediaType(mediaType)
+	if err != nil {
+		t.Fatalf("translate media type %s: %+v", mediaType, err)
+	}
+	return translated
+}
+
+func TestPullCorruptBlob(t *testing.T) {
+	ctx := context.Background()
+
+	reg := newFakeRegistry(t)
+	defer reg.Close()
+
+	engineExt, cleanup := newTestLayout(t)
+	defer cleanup()
+
+	image := putTestImage(reg, "test/corrupt", "latest", "amd64", false)
+
+	// Corrupt the layer.
+	var manifest ispec.Manifest
+	layerDigest := func() digest.Digest {
+		data := reg.manifests["test/corrupt/latest"].data
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			t.Fatal(err)
+		}
+		return manifest.Layers[0].Digest
+	}()
+	reg.blobs[layerDigest] = []byte("corrupted layer")
+
+	if _, err := Pull(ctx, engineExt, reg.client("test/corrupt", nil), nil); err == nil {
+		t.Fatalf("expected pulling an image with a corrupted blob to fail")
+	}
+	if count := reg.requests["/v2/test/corrupt/blobs/"+layerDigest.String()]; count != 1 {
+		t.Errorf("corrupted blob must not be retried: requested %d times", count)
+	}
+	if exists, err := engineExt.StatBlob(ctx, layerDigest); err != nil || exists {
+		t.Errorf("corrupted blob must not be stored: exists=%v err=%v", exists, err)
+	}
+	if exists, err := engineExt.StatBlob(ctx, image.Digest); err != nil || exists {
+		t.Errorf("manifest with corrupted blob must not be stored: exists=%v err=%v", exists, err)
+	}
+}
+
+// putTestLayers adds an image with the given number of layers to the
+// registry, returning the digests of the layers.
+func putTestLayers(reg *fakeRegistry, repo, tag string, n int) []digest.Digest {
+	config := []byte(`{"architecture": "amd64", "os": "linux", "rootfs": {"type": "layers", "diff_ids": []}}`)
+	manifest := ispec.Manifest{
+		Versioned: imeta.Versioned{SchemaVersion: 2},
+		MediaType: ispec.MediaTypeImageManifest,
+		Config: ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageConfig,
+			Digest:    reg.putBlob(config),
+			Size:      int64(len(config)),
+		},
+	}
+	var layers []digest.Digest
+	for i := 0; i < n; i++ {
+		layer := []byte(fmt.Sprintf("layer %d", i))
+		dgst := reg.putBlob(layer)
+		manifest.Layers = append(manifest.Layers, ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageLayerGzip,
+			Digest:    dgst,
+			Size:      int64(len(layer)),
+		})
+		layers = append(layers, dgst)
+	}
+	reg.putManifest(repo, tag, ispec.MediaTypeImageManifest, manifest)
+	return layers
+}
+
+func TestPullConcurrentDownloads(t *testing.T) {
+	ctx := context.Background()
+
+	reg := newFakeRegistry(t)
+	defer reg.Close()
+	reg.blobDelay = 50 * time.Millisecond
+
+	layers := putTestLayers(reg, "test/layers", "latest", 6)
+
+	for _, test := range []struct {
+		maxDownloads, expected int
+	}{
+		{0, 1},
+		{1, 1},
+		{2, 2},
+		{4, 4},
+		{16, len(layers)},
+	} {
+		t.Run(fmt.Sprintf("MaxConcurrentDownloads=%d", test.maxDownloads), func(t *testing.T) {
+			engineExt, cleanup := newTestLayout(t)
+			defer cleanup()
+			reg.maxBlobDownloads = 0
+
+			descriptor, err := Pull(ctx, engineExt, reg.client("test/layers", nil), &PullOptions{
+				MaxConcurrentDownloads: test.maxDownloads,
+			})
+			if err != nil {
+				t.Fatalf("unexpected error pulling image: %+v", err)
+			}
+			if blobs := checkPulled(t, engineExt, descriptor); len(blobs) != len(layers)+2 {
+				t.Errorf("expected %d blobs to be pulled, got %d", len(layers)+2, len(blobs))
+			}
+			if reg.maxBlobDownloads != test.expected {
+				t.Errorf("expected %d concurrent downloads, got %d", test.expected, reg.maxBlobDownloads)
+			}
+		})
+	}
+}
+
+func TestPullRetry(t *testing.T) {
+	ctx := context.Background()
+	defer func(delay time.Duration) { pullRetryDelay = delay }(pullRetryDelay)
+	pullRetryDelay = time.Millisecond
+
+	reg := newFakeRegistry(t)
+	defer reg.Close()
+
+	layers := putTestLayers(reg, "test/retry", "latest", 3)
+	layerPath := "/v2/test/retry/blobs/" + layers[1].String()
+	manifestPath := "/v2/test/retry/manifests/latest"
+
+	// Transient failures are retried.
+	engineExt, cleanup := newTestLayout(t)
+	defer cleanup()
+	reg.failures[manifestPath] = 1
+	reg.failures[layerPath] = pullRetries
+	descriptor, err := Pull(ctx, engineExt, reg.client("test/retry", nil), &PullOptions{MaxConcurrentDownloads: 2})
+	if err != nil {
+		t.Fatalf("unexpected error pulling image with transient failures: %+v", err)
+	}
+	if blobs := checkPulled(t, engineExt, descriptor); len(blobs) != len(layers)+2 {
+		t.Errorf("expected %d blobs to be pulled, got %d", len(layers)+2, len(blobs))
+	}
+	if reg.requests[layerPath] != pullRetries+1 {
+		t.Errorf("expected layer to be requested %d times, got %d", pullRetries+1, reg.requests[layerPath])
+	}
+
+	// But only a limited number of times.
+	otherExt, otherCleanup := newTestLayout(t)
+	defer otherCleanup()
+	reg.requests = map[string]int{}
+	reg.failures[layerPath] = pullRetries + 1
+	if _, err := Pull(ctx, otherExt, reg.client("test/retry", nil), nil); err == nil {
+		t.Errorf("expected pull to fail after %d retries", pullRetries)
+	}
+	if reg.requests[layerPath] != pullRetries+1 {
+		t.Errorf("expected layer to be requested %d times, got %d", pullRetries+1, reg.requests[layerPath])
+	}
+
+	// Permanent failures are not retried.
+	reg.requests = map[string]int{}
+	reg.failures = map[string]int{}
+	delete(reg.blobs, layers[1])
+	if _, err := Pull(ctx, otherExt, reg.client("test/retry", nil), nil); err == nil {
+		t.Errorf("expected pull of missing layer to fail")
+	}
+	if reg.requests[layerPath] != 1 {
+		t.Errorf("missing layer was requested %d times", reg.requests[layerPath])
+	}
+}
+
+func TestPullDeadline(t *testing.T) {
+	defer func(delay time.Duration) { pullRetryDelay = delay }(pullRetryDelay)
+	pullRetryDelay = time.Millisecond
+
+	reg := newFakeRegistry(t)
+	defer reg.Close()
+
+	layers := putTestLayers(reg, "test/deadline", "latest", 3)
+	layerPath := "/v2/test/deadline/blobs/" + layers[1].String()
+
+	// A stalled request without a client timeout is only aborted by the
+	// deadline of the context, and is not retried.
+	engineExt, cleanup := newTestLayout(t)
+	defer cleanup()
+	reg.lock.Lock()
+	reg.stalls[layerPath] = 1
+	reg.lock.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	_, err := Pull(ctx, engineExt, reg.client("test/deadline", nil), nil)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected pull with stalled layer to exceed deadline, got: %+v", err)
+	}
+	reg.lock.Lock()
+	if reg.requests[layerPath] != 1 {
+		t.Errorf("expected layer to be requested once, got %d", reg.requests[layerPath])
+	}
+	reg.lock.Unlock()
+	if exists, err := engineExt.StatBlob(context.Background(), layers[1]); err != nil || exists {
+		t.Errorf("expected stalled layer to not be in the image: exists=%v err=%+v", exists, err)
+	}
+}
+
+func TestPullTimeout(t *testing.T) {
+	ctx := context.Background()
+	defer func(delay time.Duration) { pullRetryDelay = delay }(pullRetryDelay)
+	pullRetryDelay = time.Millisecond
+
+	reg := newFakeRegistry(t)
+	defer reg.Close()
+
+	layers := putTestLayers(reg, "test/timeout", "latest", 3)
+	layerPath := "/v2/test/timeout/blobs/" + layers[1].String()
+	manifestPath := "/v2/test/timeout/manifests/latest"
+
+	newClient := func() *Client {
+		client := reg.client("test/timeout", nil)
+		client.timeout = 100 * time.Millisecond
+		return client
+	}
+
+	// Stalled requests time out and are retried.
+	engineExt, cleanup := newTestLayout(t)
+	defer cleanup()
+	reg.lock.Lock()
+	reg.stalls[manifestPath] = 1
+	reg.stalls[layerPath] = 1
+	reg.lock.Unlock()
+	descriptor, err := Pull(ctx, engineExt, newClient(), nil)
+	if err != nil {
+		t.Fatalf("unexpected error pulling image with stalled requests: %+v", err)
+	}
+	if blobs := checkPulled(t, engineExt, descriptor); len(blobs) != len(layers)+2 {
+		t.Errorf("expected %d blobs to be pulled, got %d", len(layers)+2, len(blobs))
+	}
+	reg.lock.Lock()
+	if reg.requests[layerPath] != 2 {
+		t.Errorf("expected layer to be requested 2 times, got %d", reg.requests[layerPath])
+	}
+	reg.lock.Unlock()
+
+	// But only a limited number of times, and the partially-downloaded blob
+	// must not end up in the image.
+	for _, stallHeaders := range []bool{false, true} {
+		otherExt, otherCleanup := newTestLayout(t)
+		defer otherCleanup()
+		reg.lock.Lock()
+		reg.requests = map[string]int{}
+		reg.stalls[layerPath] = pullRetries + 1
+		reg.stallHeaders = stallHeaders
+		reg.lock.Unlock()
+		_, err := Pull(ctx, otherExt, newClient(), nil)
+		if err == nil {
+			t.Fatalf("expected pull with stalled layer (stallHeaders=%v) to fail", stallHeaders)
+		}
+		if !strings.Contains(err.Error(), ErrTimeout.Error()) {
+			t.Errorf("expected pull with stalled layer (stallHeaders=%v) to time out, got: %+v", stallHeaders, err)
+		}
+		reg.lock.Lock()
+		if reg.requests[layerPath] != pullRetries+1 {
+			t.Errorf("expected layer to be requested %d times, got %d", pullRetries+1, reg.requests[layerPath])
+		}
+		reg.lock.Unlock()
+		if exists, err := otherExt.StatBlob(ctx, layers[1]); err != nil || exists {
+			t.Errorf("expected stalled layer to not be in the image: exists=%v err=%+v", exists, err)
+		}
+		index, err := otherExt.GetIndex(ctx)
+		if err != nil {
+			t.Fatalf("unexpected error getting index: %+v", err)
+		}
+		if len(index.Manifests) != 0 {
+			t.Errorf("expected failed pull to not modify the index, got %d manifests", len(index.Manifests))
+		}
+	}
+}
@@ -0,0 +1,187 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+
+	"github.com/apex/log"
+	"github.com/docker/go-units"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/pkg/errors"
+)
+
+// PushOptions modifies the behaviour of Push.
+type PushOptions struct {
+	// MountFrom is a list of other repositories in the same registry which
+	// blobs will be cross-mounted from (if they exist there) rather than
+	// being uploaded.
+	MountFrom []string
+}
+
+// pushBlob uploads the blob described by descriptor from the image layout to
+// the registry, unless the registry already has it or it can be mounted from
+// another repository.
+func pushBlob(ctx context.Context, engineExt casext.Engine, client *Client, descriptor ispec.Descriptor, opt PushOptions) error {
+	exists, err := client.BlobExists(ctx, descriptor.Digest)
+	if err != nil {
+		return err
+	}
+	if exists {
+		log.Debugf("registry: blob %s already exists", descriptor.Digest)
+		return nil
+	}
+	for _, from := range opt.MountFrom {
+		mounted, err := client.MountBlob(ctx, descriptor.Digest, from)
+		if err != nil {
+			return err
+		}
+		if mounted {
+			log.Debugf("registry: mounted blob %s from %s", descriptor.Digest, from)
+			return nil
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"digest": descriptor.Digest,
+		"size":   units.HumanSize(float64(descriptor.Size)),
+	}).Infof("pushing blob")
+
+	blob, err := engineExt.GetVerifiedBlob(ctx, descriptor)
+	if err != nil {
+		return errors.Wrapf(err, "get blob %s", descriptor.Digest)
+	}
+	defer blob.Close()
+
+	// The blob reader verifies the digest of the local blob, so a corrupted
+	// blob will cause the upload to fail before it is completed.
+	if err := client.PutBlob(ctx, descriptor, blob); err != nil {
+		return err
+	}
+	return errors.Wrapf(blob.Close(), "verify blob %s", descriptor.Digest)
+}
+
+// readManifest reads the contents of the manifest (or index) described by
+// descriptor from the image layout.
+func readManifest(ctx context.Context, engineExt casext.Engine, descriptor ispec.Descriptor) ([]byte, error) {
+	if descriptor.Size > maxManifestSize {
+		return nil, errors.Errorf("manifest %s is larger than the maximum manifest size (%d bytes)", descriptor.Digest, maxManifestSize)
+	}
+	blob, err := engineExt.GetVerifiedBlob(ctx, descriptor)
+	if err != nil {
+		return nil, errors.Wrapf(err, "get manifest %s", descriptor.Digest)
+	}
+	defer blob.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(blob, maxManifestSize))
+	if err != nil {
+		return nil, errors.Wrapf(err, "read manifest %s", descriptor.Digest)
+	}
+	return data, errors.Wrapf(blob.Close(), "verify manifest %s", descriptor.Digest)
+}
+
+// pushManifest uploads the manifest (or index) described by descriptor, and
+// everything it references, to the registry and tags it with reference.
+func pushManifest(ctx context.Context, engineExt casext.Engine, client *Client, descriptor ispec.Descriptor, reference string, opt PushOptions) error {
+	data, err := readManifest(ctx, engineExt, descriptor)
+	if err != nil {
+		return err
+	}
+
+	switch descriptor.MediaType {
+	case ispec.MediaTypeImageManifest:
+		var manifest ispec.Manifest
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			return errors.Wrapf(err, "parse manifest %s", descriptor.Digest)
+		}
+
+		if err := pushBlob(ctx, engineExt, client, manifest.Config, opt); err != nil {
+			return errors.Wrap(err, "push config")
+		}
+		for _, layer := range manifest.Layers {
+			// Non-distributable layers must not be uploaded, and clients
+			// are expected to fetch them from their URLs.
+			if isNonDistributable(layer.MediaType) {
+				log.Debugf("registry: skipping non-distributable layer %s", layer.Digest)
+				continue
+			}
+			if err := pushBlob(ctx, engineExt, client, layer, opt); err != nil {
+				return errors.Wrap(err, "push layer")
+			}
+		}
+
+	case ispec.MediaTypeImageIndex:
+		var index ispec.Index
+		if err := json.Unmarshal(data, &index); err != nil {
+			return errors.Wrapf(err, "parse index %s", descriptor.Digest)
+		}
+
+		for _, child := range index.Manifests {
+			switch child.MediaType {
+			case ispec.MediaTypeImageManifest, ispec.MediaTypeImageIndex:
+				err = pushManifest(ctx, engineExt, client, child, child.Digest.String(), opt)
+			default:
+				err = pushBlob(ctx, engineExt, client, child, opt)
+			}
+			if err != nil {
+				return errors.Wrapf(err, "push index entry %s", child.Digest)
+			}
+		}
+
+	default:
+		return errors.Errorf("unsupported manifest media type: %s", descriptor.MediaType)
+	}
+
+	log.WithFields(log.Fields{
+		"digest":    descriptor.Digest,
+		"mediatype": descriptor.MediaType,
+	}).Debugf("registry: pushing manifest %s", reference)
+	return client.PutManifest(ctx, reference, descriptor, data)
+}
+
+// Push uploads the manifest (or index) described by descriptor from the image
+// layout to the registry, along with every blob it references, and tags it
+// with the tag of the reference the client refers to. Blobs that already exist in the
+// repository are not uploaded again, and blobs that exist in one of the
+// PushOptions.MountFrom repositories are cross-mounted. The client must have
+// been created with ClientOptions.Push set.
+func Push(ctx context.Context, engineExt casext.Engine, client *Client, descriptor ispec.Descriptor, opt *PushOptions) error {
+	var options PushOptions
+	if opt != nil {
+		options = *opt
+	}
+
+	ref := client.Reference()
+	if ref.Digest != "" && ref.Digest != descriptor.Digest {
+		return errors.Errorf("cannot push %s to %s: digest does not match", descriptor.Digest, ref)
+	}
+
+	// Unlike pulls, we want to push to the tag if we have one (the digest is
+	// only used to double-check we are pushing the right image).
+	reference := ref.Tag
+	if reference == "" {
+		reference = descriptor.Digest.String()
+	}
+
+	log.Infof("pushing %s", ref)
+	return pushManifest(ctx, engineExt, client, descriptor, reference, options)
+}
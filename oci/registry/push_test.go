@@ -0,0 +1,205 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package registry
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	imeta "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/casext"
+)
+
+// putLocalImage adds an image with the given layers to the image layout,
+// returning the manifest descriptor.
+func putLocalImage(t *testing.T, engineExt casext.Engine, arch string, layers ...[]byte) ispec.Descriptor {
+	ctx := context.Background()
+
+	config := ispec.Image{OS: "linux", Architecture: arch}
+	config.RootFS.Type = "layers"
+	configDigest, configSize, err := engineExt.PutBlobJSON(ctx, config)
+	if err != nil {
+		t.Fatalf("put config: %+v", err)
+	}
+
+	manifest := ispec.Manifest{
+		Versioned: imeta.Versioned{SchemaVersion: 2},
+		MediaType: ispec.MediaTypeImageManifest,
+		Config: ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageConfig,
+			Digest:    configDigest,
+			Size:      configSize,
+		},
+	}
+	for _, layer := range layers {
+		layerDigest, layerSize, err := engineExt.PutBlob(ctx, bytes.NewReader(layer))
+		if err != nil {
+			t.Fatalf("put layer: %+v", err)
+		}
+		manifest.Layers = append(manifest.Layers, ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageLayerGzip,
+			Digest:    layerDigest,
+			Size:      layerSize,
+		})
+	}
+	manifestDigest, manifestSize, err := engineExt.PutBlobJSON(ctx, manifest)
+	if err != nil {
+		t.Fatalf("put manifest: %+v", err)
+	}
+	return ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    manifestDigest,
+		Size:      manifestSize,
+		Platform:  &ispec.Platform{OS: "linux", Architecture: arch},
+	}
+}
+
+// checkPushed makes sure that every blob reachable from descriptor was pushed
+// to the given repository, by pulling it into a fresh image layout.
+func checkPushed(t *testing.T, reg *fakeRegistry, name string, creds *Credentials, descriptor ispec.Descriptor) {
+	engineExt, cleanup := newTestLayout(t)
+	defer cleanup()
+
+	pulled, err := Pull(context.Background(), engineExt, reg.client(name, creds), nil)
+	if err != nil {
+		t.Fatalf("unexpected error pulling pushed image: %+v", err)
+	}
+	if pulled.Digest != descriptor.Digest || pulled.MediaType != descriptor.MediaType {
+		t.Errorf("pushed image has wrong digest: expected %s, got %+v", descriptor.Digest, pulled)
+	}
+	checkPulled(t, engineExt, pulled)
+}
+
+func TestPush(t *testing.T) {
+	ctx := context.Background()
+
+	reg := newFakeRegistry(t)
+	defer reg.Close()
+	reg.username, reg.password = "user", "pass"
+	creds := &Credentials{Username: "user", Password: "pass"}
+
+	engineExt, cleanup := newTestLayout(t)
+	defer cleanup()
+
+	// The large layer must be uploaded in several chunks.
+	large := make([]byte, 2*uploadChunkSize+1234)
+	rand.Read(large)
+	descriptor := putLocalImage(t, engineExt, "amd64", []byte("small layer"), large)
+
+	if err := Push(ctx, engineExt, reg.client("test/image:v1", creds), descriptor, nil); err != nil {
+		t.Fatalf("unexpected error pushing image: %+v", err)
+	}
+	if reg.patches != 2 {
+		t.Errorf("expected large layer to be uploaded in 3 chunks, got %d PATCH requests", reg.patches)
+	}
+	var pushScope bool
+	for _, scope := range reg.scopes {
+		if scope == "repository:test/image:pull,push" {
+			pushScope = true
+		}
+	}
+	if !pushScope {
+		t.Errorf("push access was not requested: %v", reg.scopes)
+	}
+	checkPushed(t, reg, "test/image:v1", creds, descriptor)
+
+	// Pushing again must not upload any blobs.
+	uploads := reg.nextUpload
+	if err := Push(ctx, engineExt, reg.client("test/image:v2", creds), descriptor, nil); err != nil {
+		t.Fatalf("unexpected error pushing image again: %+v", err)
+	}
+	if reg.nextUpload != uploads {
+		t.Errorf("pushing an existing image uploaded %d blobs", reg.nextUpload-uploads)
+	}
+	checkPushed(t, reg, "test/image:v2", creds, descriptor)
+
+	// Pushing to a mismatched digest must fail.
+	wrongDigest := digest.FromString("wrong")
+	if err := Push(ctx, engineExt, reg.client("test/image@"+wrongDigest.String(), creds), descriptor, nil); err == nil {
+		t.Errorf("expected pushing to a mismatched digest to fail")
+	}
+}
+
+func TestPushIndex(t *testing.T) {
+	ctx := context.Background()
+
+	reg := newFakeRegistry(t)
+	defer reg.Close()
+
+	engineExt, cleanup := newTestLayout(t)
+	defer cleanup()
+
+	index := ispec.Index{
+		Versioned: imeta.Versioned{SchemaVersion: 2},
+		MediaType: ispec.MediaTypeImageIndex,
+		Manifests: []ispec.Descriptor{
+			putLocalImage(t, engineExt, "amd64", []byte("amd64 layer")),
+			putLocalImage(t, engineExt, "arm64", []byte("arm64 layer")),
+		},
+	}
+	descriptor, err := engineExt.PutImageIndex(ctx, index)
+	if err != nil {
+		t.Fatalf("put index: %+v", err)
+	}
+
+	if err := Push(ctx, engineExt, reg.client("test/multi", nil), descriptor, nil); err != nil {
+		t.Fatalf("unexpected error pushing index: %+v", err)
+	}
+	for _, manifest := range index.Manifests {
+		if _, ok := reg.manifests["test/multi/"+manifest.Digest.String()]; !ok {
+			t.Errorf("index entry %s was not pushed", manifest.Digest)
+		}
+	}
+	checkPushed(t, reg, "test/multi", nil, descriptor)
+}
+
+func TestPushMount(t *testing.T) {
+	ctx := context.Background()
+
+	reg := newFakeRegistry(t)
+	defer reg.Close()
+
+	engineExt, cleanup := newTestLayout(t)
+	defer cleanup()
+
+	descriptor := putLocalImage(t, engineExt, "amd64", []byte("layer"))
+	if err := Push(ctx, engineExt, reg.client("test/base", nil), descriptor, nil); err != nil {
+		t.Fatalf("unexpected error pushing image: %+v", err)
+	}
+
+	// All of the blobs must be mounted rather than uploaded.
+	uploads := reg.nextUpload
+	if err := Push(ctx, engineExt, reg.client("test/derived", nil), descriptor, &PushOptions{
+		MountFrom: []string{"test/nonexistent", "test/base"},
+	}); err != nil {
+		t.Fatalf("unexpected error pushing image with mounts: %+v", err)
+	}
+	// Each blob should've caused one (cancelled) upload session for the
+	// nonexistent repository, but no blobs should have been uploaded.
+	if reg.nextUpload-uploads != 2 || len(reg.uploads) != 0 {
+		t.Errorf("expected only cancelled upload sessions, got %d sessions (%d open)", reg.nextUpload-uploads, len(reg.uploads))
+	}
+	if len(reg.repoBlobs["test/derived"]) != 2 {
+		t.Errorf("expected 2 blobs to be mounted, got %d", len(reg.repoBlobs["test/derived"]))
+	}
+	checkPushed(t, reg, "test/derived", nil, descriptor)
+}
@@ -0,0 +1,152 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package registry implements a minimal client for the OCI distribution (and
+// Docker registry v2) protocol, which allows images to be pulled from a
+// registry into an OCI image layout.
+package registry
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+const (
+	// TransportPrefix is the prefix used for registry references, matching
+	// the "docker://" transport used by other tools.
+	TransportPrefix = "docker://"
+
+	// DefaultRegistry is the registry used for references which do not
+	// explicitly specify one.
+	DefaultRegistry = "docker.io"
+
+	// defaultRegistryHost is the host actually serving the DefaultRegistry
+	// API.
+	defaultRegistryHost = "registry-1.docker.io"
+
+	// defaultTag is the tag used for references without a tag or digest.
+	defaultTag = "latest"
+)
+
+var (
+	// repositoryRegexp matches valid repository names, as defined by the
+	// distribution spec.
+	repositoryRegexp = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|[-]*)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:[._]|__|[-]*)[a-z0-9]+)*)*$`)
+
+	// tagRegexp matches valid tag names, as defined by the distribution spec.
+	tagRegexp = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+)
+
+// Reference is a reference to an image in a registry.
+type Reference struct {
+	// Registry is the registry (host and optional port) containing the image,
+	// such as "docker.io" or "localhost:5000".
+	Registry string
+
+	// Repository is the name of the repository in the registry, such as
+	// "library/opensuse".
+	Repository string
+
+	// Tag is the tag of the image in the repository. It is ignored if Digest
+	// is set.
+	Tag string
+
+	// Digest is the digest of the image manifest (or index).
+	Digest digest.Digest
+}
+
+// ParseReference parses a reference of the form
+// [docker://][<registry>/]<repository>[:<tag>][@<digest>]. References without a
+// registry refer to DefaultRegistry (with single-component repositories in
+// DefaultRegistry being prefixed with "library/"), and references without a
+// tag or digest refer to the "latest" tag.
+func ParseReference(ref string) (Reference, error) {
+	var reference Reference
+	name := strings.TrimPrefix(ref, TransportPrefix)
+
+	if idx := strings.LastIndex(name, "@"); idx >= 0 {
+		dgst, err := digest.Parse(name[idx+1:])
+		if err != nil {
+			return Reference{}, errors.Wrapf(err, "invalid reference %q: parse digest", ref)
+		}
+		reference.Digest = dgst
+		name = name[:idx]
+	}
+
+	if idx := strings.Index(name, "/"); idx >= 0 {
+		if domain := name[:idx]; strings.ContainsAny(domain, ".:") || domain == "localhost" {
+			reference.Registry = domain
+			name = name[idx+1:]
+		}
+	}
+	if reference.Registry == "" {
+		reference.Registry = DefaultRegistry
+	}
+
+	if idx := strings.LastIndex(name, ":"); idx > strings.LastIndex(name, "/") {
+		reference.Tag = name[idx+1:]
+		name = name[:idx]
+		if !tagRegexp.MatchString(reference.Tag) {
+			return Reference{}, errors.Errorf("invalid reference %q: invalid tag %q", ref, reference.Tag)
+		}
+	}
+	if reference.Registry == DefaultRegistry && !strings.Contains(name, "/") {
+		name = "library/" + name
+	}
+	if !repositoryRegexp.MatchString(name) {
+		return Reference{}, errors.Errorf("invalid reference %q: invalid repository name %q", ref, name)
+	}
+	reference.Repository = name
+
+	if reference.Tag == "" && reference.Digest == "" {
+		reference.Tag = defaultTag
+	}
+	return reference, nil
+}
+
+// String returns the canonical string form of the reference (without the
+// TransportPrefix).
+func (r Reference) String() string {
+	name := r.Registry + "/" + r.Repository
+	if r.Tag != "" {
+		name += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		name += "@" + r.Digest.String()
+	}
+	return name
+}
+
+// reference returns the tag or digest that should be used to request the
+// image manifest from the registry.
+func (r Reference) reference() string {
+	if r.Digest != "" {
+		return r.Digest.String()
+	}
+	return r.Tag
+}
+
+// host returns the host serving the registry API for the reference.
+func (r Reference) host() string {
+	if r.Registry == DefaultRegistry {
+		return defaultRegistryHost
+	}
+	return r.Registry
+}
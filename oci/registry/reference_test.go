@@ -0,0 +1,81 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package registry
+
+import (
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+func TestParseReference(t *testing.T) {
+	dgst := digest.FromString("manifest")
+
+	for _, test := range []struct {
+		ref      string
+		expected Reference
+	}{
+		{"docker://opensuse/leap:15.2", Reference{Registry: "docker.io", Repository: "opensuse/leap", Tag: "15.2"}},
+		{"opensuse/leap:15.2", Reference{Registry: "docker.io", Repository: "opensuse/leap", Tag: "15.2"}},
+		{"docker://busybox", Reference{Registry: "docker.io", Repository: "library/busybox", Tag: "latest"}},
+		{"docker://localhost/foo", Reference{Registry: "localhost", Repository: "foo", Tag: "latest"}},
+		{"docker://localhost:5000/foo/bar:v1", Reference{Registry: "localhost:5000", Repository: "foo/bar", Tag: "v1"}},
+		{"docker://registry.opensuse.org/opensuse/leap", Reference{Registry: "registry.opensuse.org", Repository: "opensuse/leap", Tag: "latest"}},
+		{"docker://quay.io/a/b/c@" + dgst.String(), Reference{Registry: "quay.io", Repository: "a/b/c", Digest: dgst}},
+		{"docker://quay.io/a/b:tag@" + dgst.String(), Reference{Registry: "quay.io", Repository: "a/b", Tag: "tag", Digest: dgst}},
+	} {
+		got, err := ParseReference(test.ref)
+		if err != nil {
+			t.Errorf("ParseReference(%q): unexpected error: %+v", test.ref, err)
+			continue
+		}
+		if got != test.expected {
+			t.Errorf("ParseReference(%q): expected %+v, got %+v", test.ref, test.expected, got)
+		}
+	}
+
+	for _, ref := range []string{
+		"",
+		"docker://",
+		"docker://UPPERCASE/repo",
+		"docker://localhost:5000/",
+		"docker://repo:bad tag",
+		"docker://repo:" + string(make([]byte, 200)),
+		"docker://repo@sha256:invalid",
+	} {
+		if got, err := ParseReference(ref); err == nil {
+			t.Errorf("ParseReference(%q): expected error, got %+v", ref, got)
+		}
+	}
+}
+
+func TestReferenceString(t *testing.T) {
+	for _, ref := range []string{
+		"docker.io/library/busybox:latest",
+		"localhost:5000/foo/bar:v1",
+		"quay.io/a/b@" + digest.FromString("manifest").String(),
+	} {
+		parsed, err := ParseReference(ref)
+		if err != nil {
+			t.Fatalf("ParseReference(%q): unexpected error: %+v", ref, err)
+		}
+		if got := parsed.String(); got != ref {
+			t.Errorf("ParseReference(%q).String(): got %q", ref, got)
+		}
+	}
+}
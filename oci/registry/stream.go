@@ -0,0 +1,162 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package registry
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/apex/log"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/cas"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/pkg/errors"
+)
+
+// streamEngine is a cas.Engine which stores manifests and configs (and the
+// index) in memory, and streams every other blob directly from the registry
+// when it is read.
+type streamEngine struct {
+	client *Client
+
+	lock  sync.RWMutex
+	blobs map[digest.Digest][]byte
+	index ispec.Index
+}
+
+// NewStreamingEngine returns a read-only view of the image the client refers
+// to, as a cas.Engine. The manifest (or index, along with every manifest it
+// references) and image configuration are fetched eagerly and kept in memory,
+// while layer blobs are only streamed from the registry as they are read (and
+// are never stored on disk), so that an image can be unpacked without first
+// pulling it into an image layout. The digest of every blob is verified as it
+// is read. As with Pull, Docker manifests (and manifest lists) are converted
+// to their OCI equivalents, which changes their digest.
+//
+// The descriptor of the (converted) manifest or index is returned. It is not
+// referenced by the index of the engine, and the caller can use
+// casext.Engine.UpdateReference to tag it. Blobs can be added to the engine
+// with PutBlob, but they are only stored in memory.
+func NewStreamingEngine(ctx context.Context, client *Client) (cas.Engine, ispec.Descriptor, error) {
+	engine := &streamEngine{
+		client: client,
+		blobs:  map[digest.Digest][]byte{},
+	}
+	log.Infof("fetching %s", client.Reference())
+	descriptor, err := pullManifest(ctx, casext.NewEngine(engine), client, client.Reference().reference(), true, PullOptions{})
+	if err != nil {
+		return nil, ispec.Descriptor{}, err
+	}
+	return engine, descriptor, nil
+}
+
+// PutBlob adds the blob to the set of in-memory blobs.
+func (e *streamEngine) PutBlob(ctx context.Context, reader io.Reader) (digest.Digest, int64, error) {
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return "", -1, errors.Wrap(err, "read blob")
+	}
+	dgst := cas.BlobAlgorithm.FromBytes(data)
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.blobs[dgst] = data
+	return dgst, int64(len(data)), nil
+}
+
+// GetBlob returns the in-memory blob with the given digest if there is one,
+// otherwise the blob is streamed from the registry. The size of streamed
+// blobs is not known, so callers should use casext.Engine.GetVerifiedBlob.
+func (e *streamEngine) GetBlob(ctx context.Context, dgst digest.Digest) (io.ReadCloser, error) {
+	e.lock.RLock()
+	data, ok := e.blobs[dgst]
+	e.lock.RUnlock()
+	if ok {
+		return ioutil.NopCloser(bytes.NewReader(data)), nil
+	}
+
+	log.Debugf("registry: streaming blob %s", dgst)
+	blob, err := e.client.GetBlob(ctx, ispec.Descriptor{Digest: dgst, Size: -1})
+	if err != nil {
+		if errors.Cause(err) == ErrNotFound {
+			err = errors.Wrap(cas.ErrNotExist, err.Error())
+		}
+		return nil, err
+	}
+	return blob, nil
+}
+
+// StatBlob only returns whether the blob is stored in memory, to avoid making
+// requests to the registry.
+func (e *streamEngine) StatBlob(ctx context.Context, dgst digest.Digest) (bool, error) {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	_, ok := e.blobs[dgst]
+	return ok, nil
+}
+
+// PutIndex sets the in-memory index.
+func (e *streamEngine) PutIndex(ctx context.Context, index ispec.Index) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.index = index
+	return nil
+}
+
+// GetIndex returns the in-memory index.
+func (e *streamEngine) GetIndex(ctx context.Context) (ispec.Index, error) {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	return e.index, nil
+}
+
+// DeleteBlob removes the blob from the set of in-memory blobs.
+func (e *streamEngine) DeleteBlob(ctx context.Context, dgst digest.Digest) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	delete(e.blobs, dgst)
+	return nil
+}
+
+// ListBlobs returns the set of in-memory blobs.
+func (e *streamEngine) ListBlobs(ctx context.Context) ([]digest.Digest, error) {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	var digests []digest.Digest
+	for dgst := range e.blobs {
+		digests = append(digests, dgst)
+	}
+	return digests, nil
+}
+
+// Clean is a no-op, as there is no on-disk state to clean.
+func (e *streamEngine) Clean(ctx context.Context) error {
+	return nil
+}
+
+// Close releases the in-memory blobs.
+func (e *streamEngine) Close() error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.blobs = map[digest.Digest][]byte{}
+	return nil
+}
@@ -0,0 +1,201 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package registry
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	imeta "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/opencontainers/umoci/oci/dockerarchive"
+	"github.com/opencontainers/umoci/oci/layer"
+)
+
+// putTestLayerImage adds a single-layer image (with a real layer containing a
+// single file) to the registry, returning the layer digest.
+func putTestLayerImage(t *testing.T, reg *fakeRegistry, repo, tag string, docker bool) digest.Digest {
+	var layerTar bytes.Buffer
+	tw := tar.NewWriter(&layerTar)
+	contents := []byte("streamed contents")
+	if err := tw.WriteHeader(&tar.Header{Name: "file", Mode: 0644, Size: int64(len(contents)), Typeflag: tar.TypeReg}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write(contents); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var layerGz bytes.Buffer
+	gzw := gzip.NewWriter(&layerGz)
+	if _, err := gzw.Write(layerTar.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	configType, layerType, manifestType := ispec.MediaTypeImageConfig, ispec.MediaTypeImageLayerGzip, ispec.MediaTypeImageManifest
+	if docker {
+		configType, layerType, manifestType = dockerarchive.MediaTypeDockerConfig, dockerarchive.MediaTypeDockerLayerGzip, dockerarchive.MediaTypeDockerManifest
+	}
+
+	config := []byte(`{"architecture": "amd64", "os": "linux", "rootfs": {"type": "layers", "diff_ids": ["` + digest.FromBytes(layerTar.Bytes()).String() + `"]}}`)
+	layerDigest := reg.putBlob(layerGz.Bytes())
+	reg.putManifest(repo, tag, manifestType, ispec.Manifest{
+		Versioned: imeta.Versioned{SchemaVersion: 2},
+		MediaType: manifestType,
+		Config: ispec.Descriptor{
+			MediaType: configType,
+			Digest:    reg.putBlob(config),
+			Size:      int64(len(config)),
+		},
+		Layers: []ispec.Descriptor{{
+			MediaType: layerType,
+			Digest:    layerDigest,
+			Size:      int64(layerGz.Len()),
+		}},
+	})
+	return layerDigest
+}
+
+func testStreamingUnpack(t *testing.T, docker bool) {
+	ctx := context.Background()
+
+	reg := newFakeRegistry(t)
+	defer reg.Close()
+
+	layerDigest := putTestLayerImage(t, reg, "test/image", "v1", docker)
+	layerPath := "/v2/test/image/blobs/" + layerDigest.String()
+
+	engine, descriptor, err := NewStreamingEngine(ctx, reg.client("test/image:v1", nil))
+	if err != nil {
+		t.Fatalf("unexpected error creating streaming engine: %+v", err)
+	}
+	defer engine.Close()
+	engineExt := casext.NewEngine(engine)
+
+	if descriptor.MediaType != ispec.MediaTypeImageManifest {
+		t.Errorf("expected manifest to be converted to %s, got %s", ispec.MediaTypeImageManifest, descriptor.MediaType)
+	}
+	// The layer must not have been fetched yet.
+	if n := reg.requests[layerPath]; n != 0 {
+		t.Errorf("expected layer to not be fetched before unpacking, got %d requests", n)
+	}
+	if exists, err := engineExt.StatBlob(ctx, layerDigest); err != nil || exists {
+		t.Errorf("expected layer to not be stored in memory: exists=%v err=%v", exists, err)
+	}
+
+	manifestBlob, err := engineExt.FromDescriptor(ctx, descriptor)
+	if err != nil {
+		t.Fatalf("unexpected error reading manifest: %+v", err)
+	}
+	manifest := manifestBlob.Data.(ispec.Manifest)
+	if manifest.Layers[0].MediaType != ispec.MediaTypeImageLayerGzip {
+		t.Errorf("expected layer media type to be converted to %s, got %s", ispec.MediaTypeImageLayerGzip, manifest.Layers[0].MediaType)
+	}
+
+	root, err := ioutil.TempDir("", "umoci-TestStreamingUnpack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	rootfs := filepath.Join(root, "rootfs")
+	opt := &layer.UnpackOptions{MapOptions: layer.MapOptions{Rootless: os.Geteuid() != 0}}
+	if err := layer.UnpackRootfs(ctx, engine, rootfs, manifest, opt); err != nil {
+		t.Fatalf("unexpected error unpacking streamed image: %+v", err)
+	}
+
+	contents, err := ioutil.ReadFile(filepath.Join(rootfs, "file"))
+	if err != nil {
+		t.Fatalf("unexpected error reading unpacked file: %+v", err)
+	}
+	if string(contents) != "streamed contents" {
+		t.Errorf("unexpected unpacked file contents: %q", contents)
+	}
+	if n := reg.requests[layerPath]; n != 1 {
+		t.Errorf("expected layer to be fetched once, got %d requests", n)
+	}
+}
+
+func TestStreamingUnpack(t *testing.T) {
+	testStreamingUnpack(t, false)
+}
+
+func TestStreamingUnpackDocker(t *testing.T) {
+	testStreamingUnpack(t, true)
+}
+
+func TestStreamingUnpackCorrupt(t *testing.T) {
+	ctx := context.Background()
+
+	reg := newFakeRegistry(t)
+	defer reg.Close()
+
+	layerDigest := putTestLayerImage(t, reg, "test/image", "v1", false)
+
+	engine, descriptor, err := NewStreamingEngine(ctx, reg.client("test/image:v1", nil))
+	if err != nil {
+		t.Fatalf("unexpected error creating streaming engine: %+v", err)
+	}
+	defer engine.Close()
+	engineExt := casext.NewEngine(engine)
+
+	manifestBlob, err := engineExt.FromDescriptor(ctx, descriptor)
+	if err != nil {
+		t.Fatalf("unexpected error reading manifest: %+v", err)
+	}
+	manifest := manifestBlob.Data.(ispec.Manifest)
+
+	// Corrupt the layer after the manifest has been fetched.
+	reg.lock.Lock()
+	corrupted := append([]byte{}, reg.blobs[layerDigest]...)
+	corrupted[len(corrupted)-1] ^= 0xff
+	reg.blobs[layerDigest] = corrupted
+	reg.lock.Unlock()
+
+	root, err := ioutil.TempDir("", "umoci-TestStreamingUnpackCorrupt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	opt := &layer.UnpackOptions{MapOptions: layer.MapOptions{Rootless: os.Geteuid() != 0}}
+	if err := layer.UnpackRootfs(ctx, engine, filepath.Join(root, "rootfs"), manifest, opt); err == nil {
+		t.Errorf("expected unpacking a corrupted streamed layer to fail")
+	}
+}
+
+func TestStreamingEngineNotFound(t *testing.T) {
+	reg := newFakeRegistry(t)
+	defer reg.Close()
+
+	if _, _, err := NewStreamingEngine(context.Background(), reg.client("test/image:missing", nil)); err == nil {
+		t.Errorf("expected error fetching missing image")
+	}
+}
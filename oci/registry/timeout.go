@@ -0,0 +1,151 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package registry
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrTimeout is returned when a request to the registry is aborted because it
+// made no progress for longer than ClientOptions.Timeout.
+var ErrTimeout = errors.New("registry request timed out")
+
+// stallTimer cancels the context of a request if the request makes no
+// progress (see progress) for longer than timeout. A nil *stallTimer is valid
+// and never cancels the request.
+type stallTimer struct {
+	timeout time.Duration
+	cancel  context.CancelFunc
+
+	// lock protects the remaining fields.
+	lock     sync.Mutex
+	timer    *time.Timer
+	last     time.Time
+	stopped  bool
+	timedOut bool
+}
+
+// newStallTimer returns a context derived from ctx which is cancelled once the
+// request has made no progress for longer than timeout, as well as the
+// stallTimer which tracks the progress of the request. If timeout is not
+// positive, ctx is returned as-is (along with a nil stallTimer).
+func newStallTimer(ctx context.Context, timeout time.Duration) (context.Context, *stallTimer) {
+	if timeout <= 0 {
+		return ctx, nil
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	t := &stallTimer{
+		timeout: timeout,
+		cancel:  cancel,
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.last = time.Now()
+	t.timer = time.AfterFunc(timeout, t.check)
+	return ctx, t
+}
+
+// check is called whenever the timer fires, and cancels the request if there
+// hasn't been any progress since the timeout (otherwise the timer is
+// restarted).
+func (t *stallTimer) check() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.stopped {
+		return
+	}
+	if remaining := t.timeout - time.Since(t.last); remaining > 0 {
+		t.timer.Reset(remaining)
+		return
+	}
+	t.timedOut = true
+	t.cancel()
+}
+
+// progress records that the request has made progress.
+func (t *stallTimer) progress() {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	t.last = time.Now()
+	t.lock.Unlock()
+}
+
+// stop stops the timer and releases the resources of the request context.
+func (t *stallTimer) stop() {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	t.stopped = true
+	t.timer.Stop()
+	t.lock.Unlock()
+	t.cancel()
+}
+
+// wrapErr returns an ErrTimeout error (which is transient, so the request
+// will be retried) in place of err if the request was cancelled by the timer.
+func (t *stallTimer) wrapErr(err error, what string) error {
+	if t == nil || err == nil {
+		return err
+	}
+	t.lock.Lock()
+	timedOut := t.timedOut
+	t.lock.Unlock()
+	if !timedOut {
+		return err
+	}
+	return transientError{errors.Wrapf(ErrTimeout, "%s: no progress for %s", what, t.timeout)}
+}
+
+// stallReader records progress of the request whenever data is read from the
+// underlying reader (the body of a request or response). Closing the reader
+// stops the timer if stopOnClose is set (which is the case for response
+// bodies, as the request is complete once its response has been read).
+type stallReader struct {
+	io.ReadCloser
+	timer       *stallTimer
+	what        string
+	stopOnClose bool
+}
+
+func (r *stallReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		r.timer.progress()
+	}
+	if err != nil && err != io.EOF {
+		err = r.timer.wrapErr(err, r.what)
+	}
+	return n, err
+}
+
+func (r *stallReader) Close() error {
+	err := r.ReadCloser.Close()
+	if r.stopOnClose {
+		r.timer.stop()
+	}
+	return err
+}
@@ -0,0 +1,73 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package registry
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestStallTimer(t *testing.T) {
+	const timeout = 50 * time.Millisecond
+
+	// Requests which keep making progress never time out.
+	ctx, timer := newStallTimer(context.Background(), timeout)
+	for i := 0; i < 20; i++ {
+		time.Sleep(timeout / 5)
+		timer.progress()
+	}
+	if err := ctx.Err(); err != nil {
+		t.Fatalf("request making progress was cancelled: %v", err)
+	}
+	if err := timer.wrapErr(context.Canceled, "test"); err != context.Canceled {
+		t.Errorf("expected errors to not be modified before timing out, got %v", err)
+	}
+
+	// But they do once they stall.
+	select {
+	case <-ctx.Done():
+	case <-time.After(10 * timeout):
+		t.Fatalf("stalled request was not cancelled")
+	}
+	err := timer.wrapErr(ctx.Err(), "test")
+	if transient, ok := errors.Cause(err).(transientError); !ok {
+		t.Errorf("expected timeout error to be transient, got %v", err)
+	} else if errors.Cause(transient.error) != ErrTimeout {
+		t.Errorf("expected timeout error to be ErrTimeout, got %v", err)
+	}
+	timer.stop()
+
+	// Stopped timers never cancel the request.
+	ctx, timer = newStallTimer(context.Background(), timeout)
+	timer.stop()
+	time.Sleep(2 * timeout)
+	if err := timer.wrapErr(ctx.Err(), "test"); err != context.Canceled {
+		t.Errorf("expected stopped timer to not time out, got %v", err)
+	}
+
+	// A zero timeout disables the timer.
+	ctx, timer = newStallTimer(context.Background(), 0)
+	if timer != nil || ctx != context.Background() {
+		t.Errorf("expected zero timeout to disable the timer")
+	}
+	timer.progress()
+	timer.stop()
+}
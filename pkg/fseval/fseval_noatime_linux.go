@@ -0,0 +1,67 @@
+//go:build linux
+// +build linux
+
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package fseval
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// NoAtime returns a wrapper around fs which opens files (and directories
+// read with Readdir) with O_NOATIME, so that reading them does not update their
+// access time. O_NOATIME is only permitted for the owner of a file (or with
+// CAP_FOWNER), so if a path cannot be opened with O_NOATIME the corresponding
+// method of fs is used instead.
+func NoAtime(fs FsEval) FsEval {
+	return noatimeFsEval{fs}
+}
+
+type noatimeFsEval struct {
+	FsEval
+}
+
+// openNoatime opens the given path for reading with O_NOATIME.
+func openNoatime(path string) (*os.File, error) {
+	fd, err := unix.Open(path, unix.O_RDONLY|unix.O_NOATIME|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	return os.NewFile(uintptr(fd), path), nil
+}
+
+// Open is equivalent to os.Open, but tries to use O_NOATIME.
+func (fs noatimeFsEval) Open(path string) (*os.File, error) {
+	if fh, err := openNoatime(path); err == nil {
+		return fh, nil
+	}
+	return fs.FsEval.Open(path)
+}
+
+// Readdir is equivalent to os.Readdir, but tries to use O_NOATIME.
+func (fs noatimeFsEval) Readdir(path string) ([]os.FileInfo, error) {
+	fh, err := openNoatime(path)
+	if err != nil {
+		return fs.FsEval.Readdir(path)
+	}
+	defer fh.Close()
+	return fh.Readdir(-1)
+}
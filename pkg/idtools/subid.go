@@ -0,0 +1,124 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package idtools
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+)
+
+// Paths of the files containing the subordinate UIDs and GIDs allocated to
+// each user (see subuid(5) and subgid(5)).
+const (
+	SubUIDPath = "/etc/subuid"
+	SubGIDPath = "/etc/subgid"
+)
+
+// SubIDRange is a range of subordinate IDs allocated to a user. Start is the
+// first subordinate ID, and there are Count IDs in the range.
+type SubIDRange struct {
+	Start uint32
+	Count uint32
+}
+
+// ParseSubIDs parses a subuid(5) or subgid(5) formatted file and returns the
+// ranges allocated to the user with the given name or UID (users can be
+// identified by either in both files), in the order they appear in the file.
+// Blank lines and comments are ignored. If name is empty, users are only
+// matched by UID.
+func ParseSubIDs(r io.Reader, name string, uid int) ([]SubIDRange, error) {
+	var ranges []SubIDRange
+
+	scanner := bufio.NewScanner(r)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.Split(line, ":")
+		if len(parts) != 3 {
+			return nil, errors.Errorf("line %d: invalid number of fields: %d", lineno, len(parts))
+		}
+		if user := parts[0]; user != strconv.Itoa(uid) && (name == "" || user != name) {
+			continue
+		}
+
+		start, err := strconv.ParseUint(parts[1], 10, 32)
+		if err != nil {
+			return nil, errors.Wrapf(err, "line %d: invalid start of range", lineno)
+		}
+		count, err := strconv.ParseUint(parts[2], 10, 32)
+		if err != nil {
+			return nil, errors.Wrapf(err, "line %d: invalid size of range", lineno)
+		}
+		if count == 0 {
+			continue
+		}
+		ranges = append(ranges, SubIDRange{Start: uint32(start), Count: uint32(count)})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "read subordinate ids")
+	}
+	return ranges, nil
+}
+
+// SubIDMappings returns the ID mappings which map container ID 0 to hostID,
+// followed by each of the subordinate ranges (in order) starting at container
+// ID 1. This is the same mapping as is used by most rootless container tools.
+func SubIDMappings(hostID int, ranges []SubIDRange) []rspec.LinuxIDMapping {
+	idMap := []rspec.LinuxIDMapping{{HostID: uint32(hostID), ContainerID: 0, Size: 1}}
+	next := uint32(1)
+	for _, r := range ranges {
+		idMap = append(idMap, rspec.LinuxIDMapping{HostID: r.Start, ContainerID: next, Size: r.Count})
+		next += r.Count
+	}
+	return idMap
+}
+
+// SubIDMappingsFromFile reads the subordinate ID allocations of the user with
+// the given name or UID from the given subuid(5) or subgid(5) formatted file,
+// and returns the corresponding ID mappings with container ID 0 mapped to
+// hostID (see SubIDMappings). An error is returned if the user has no
+// allocations.
+func SubIDMappingsFromFile(path, name string, uid, hostID int) ([]rspec.LinuxIDMapping, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "open subordinate id file")
+	}
+	defer fh.Close()
+
+	ranges, err := ParseSubIDs(fh, name, uid)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse %s", path)
+	}
+	if len(ranges) == 0 {
+		user := strconv.Itoa(uid)
+		if name != "" {
+			user = name
+		}
+		return nil, errors.Errorf("no subordinate ids allocated to user %s in %s", user, path)
+	}
+	return SubIDMappings(hostID, ranges), nil
+}
@@ -0,0 +1,141 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package idtools
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+const testSubIDs = `# comment
+alice:100000:65536
+
+1000:200000:1000
+bob:300000:65536
+alice:400000:10
+alice:500000:0
+`
+
+func TestParseSubIDs(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		user     string
+		uid      int
+		expected []SubIDRange
+	}{
+		{"ByName", "alice", 1001, []SubIDRange{{100000, 65536}, {400000, 10}}},
+		{"ByUID", "", 1000, []SubIDRange{{200000, 1000}}},
+		{"ByNameAndUID", "alice", 1000, []SubIDRange{{100000, 65536}, {200000, 1000}, {400000, 10}}},
+		{"NoName", "", 1001, nil},
+		{"Unknown", "eve", 1002, nil},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ranges, err := ParseSubIDs(strings.NewReader(testSubIDs), test.user, test.uid)
+			if err != nil {
+				t.Fatalf("unexpected error: %+v", err)
+			}
+			if !reflect.DeepEqual(ranges, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, ranges)
+			}
+		})
+	}
+}
+
+func TestParseSubIDsInvalid(t *testing.T) {
+	for _, invalid := range []string{
+		"alice:100000",
+		"alice:100000:65536:1",
+		"alice:foo:65536",
+		"alice:100000:-1",
+		"alice:100000:4294967296",
+	} {
+		if _, err := ParseSubIDs(strings.NewReader(invalid), "alice", 1000); err == nil {
+			t.Errorf("expected an error parsing %q", invalid)
+		}
+	}
+}
+
+func TestSubIDMappings(t *testing.T) {
+	idMap := SubIDMappings(1000, []SubIDRange{{100000, 65536}, {400000, 10}})
+	expected := []rspec.LinuxIDMapping{
+		{HostID: 1000, ContainerID: 0, Size: 1},
+		{HostID: 100000, ContainerID: 1, Size: 65536},
+		{HostID: 400000, ContainerID: 65537, Size: 10},
+	}
+	if !reflect.DeepEqual(idMap, expected) {
+		t.Errorf("expected %v, got %v", expected, idMap)
+	}
+
+	// Make sure that they work with ToHost and ToContainer.
+	for _, test := range []struct{ host, container int }{
+		{1000, 0},
+		{100000, 1},
+		{165535, 65536},
+		{400000, 65537},
+		{400009, 65546},
+	} {
+		if id, err := ToHost(test.container, idMap); err != nil || id != test.host {
+			t.Errorf("ToHost(%d): expected %d, got %d (%v)", test.container, test.host, id, err)
+		}
+		if id, err := ToContainer(test.host, idMap); err != nil || id != test.container {
+			t.Errorf("ToContainer(%d): expected %d, got %d (%v)", test.host, test.container, id, err)
+		}
+	}
+	if _, err := ToHost(65547, idMap); err == nil {
+		t.Errorf("expected ToHost to fail past the end of the subordinate ranges")
+	}
+}
+
+func TestSubIDMappingsFromFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestSubIDMappingsFromFile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "subgid")
+	if err := ioutil.WriteFile(path, []byte(testSubIDs), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The file is keyed by user, but container root maps to hostID.
+	idMap, err := SubIDMappingsFromFile(path, "bob", 1003, 2000)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	expected := []rspec.LinuxIDMapping{
+		{HostID: 2000, ContainerID: 0, Size: 1},
+		{HostID: 300000, ContainerID: 1, Size: 65536},
+	}
+	if !reflect.DeepEqual(idMap, expected) {
+		t.Errorf("expected %v, got %v", expected, idMap)
+	}
+
+	if _, err := SubIDMappingsFromFile(path, "eve", 1002, 1002); err == nil {
+		t.Errorf("expected an error for a user with no allocations")
+	}
+	if _, err := SubIDMappingsFromFile(filepath.Join(dir, "nonexistent"), "bob", 1003, 1003); err == nil {
+		t.Errorf("expected an error for a non-existent file")
+	}
+}
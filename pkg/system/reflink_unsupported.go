@@ -0,0 +1,34 @@
+//go:build !linux
+// +build !linux
+
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package system
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Reflink makes dst share the contents of src. Reflinks are only supported on
+// Linux, so this always fails with EOPNOTSUPP and the caller should fall back
+// to copying the file contents.
+func Reflink(dst, src *os.File) error {
+	return &os.PathError{Op: "ficlone", Path: dst.Name(), Err: unix.EOPNOTSUPP}
+}
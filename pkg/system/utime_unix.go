@@ -26,11 +26,12 @@ import (
 
 // Lutimes is a wrapper around utimensat(2), with the AT_SYMLINK_NOFOLLOW flag
 // set, to allow changing the time of a symlink rather than the file it points
-// to.
+// to. If atime or mtime is the zero time, that timestamp is left unchanged
+// (UTIME_OMIT).
 func Lutimes(path string, atime, mtime time.Time) error {
 	times := []unix.Timespec{
-		unix.NsecToTimespec(atime.UnixNano()),
-		unix.NsecToTimespec(mtime.UnixNano()),
+		utimeTimespec(atime),
+		utimeTimespec(mtime),
 	}
 
 	err := unix.UtimesNanoAt(unix.AT_FDCWD, path, times, unix.AT_SYMLINK_NOFOLLOW)
@@ -39,3 +40,12 @@ func Lutimes(path string, atime, mtime time.Time) error {
 	}
 	return nil
 }
+
+// utimeTimespec converts t to a timespec for utimensat(2), with the zero time
+// being converted to UTIME_OMIT.
+func utimeTimespec(t time.Time) unix.Timespec {
+	if t.IsZero() {
+		return unix.Timespec{Nsec: utimeOmit}
+	}
+	return unix.NsecToTimespec(t.UnixNano())
+}
@@ -271,3 +271,55 @@ func TestLutimesRelative(t *testing.T) {
 		t.Errorf("parent directory mtime was changed! old='%s' new='%s'", mtimeParentOld, mtimeParentNew)
 	}
 }
+
+func TestLutimesOmit(t *testing.T) {
+	var fiOld, fiNew unix.Stat_t
+
+	dir, err := ioutil.TempDir("", "umoci-system.TestLutimesOmit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "some file")
+
+	if err := ioutil.WriteFile(path, []byte("some contents"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	atime := testutils.Unix(125812851, 128518257)
+	mtime := testutils.Unix(257172893, 995216512)
+
+	if err := Lutimes(path, atime, mtime); err != nil {
+		t.Fatalf("unexpected error with system.lutimes: %s", err)
+	}
+	if err := unix.Lstat(path, &fiOld); err != nil {
+		t.Fatal(err)
+	}
+
+	// A zero atime must leave the atime unchanged.
+	newMtime := testutils.Unix(357172893, 0)
+	if err := Lutimes(path, time.Time{}, newMtime); err != nil {
+		t.Errorf("unexpected error with system.lutimes: %s", err)
+	}
+	if err := unix.Lstat(path, &fiNew); err != nil {
+		t.Fatal(err)
+	}
+	if atimeOld, atimeNew := time.Unix(fiOld.Atim.Unix()), time.Unix(fiNew.Atim.Unix()); !atimeNew.Equal(atimeOld) {
+		t.Errorf("atime was changed with zero atime: expected='%s' got='%s'", atimeOld, atimeNew)
+	}
+	if mtimeNew := time.Unix(fiNew.Mtim.Unix()); !mtimeNew.Equal(newMtime) {
+		t.Errorf("mtime was not changed: expected='%s' got='%s'", newMtime, mtimeNew)
+	}
+
+	// And the same goes for a zero mtime.
+	if err := Lutimes(path, atime, time.Time{}); err != nil {
+		t.Errorf("unexpected error with system.lutimes: %s", err)
+	}
+	if err := unix.Lstat(path, &fiNew); err != nil {
+		t.Fatal(err)
+	}
+	if mtimeNew := time.Unix(fiNew.Mtim.Unix()); !mtimeNew.Equal(newMtime) {
+		t.Errorf("mtime was changed with zero mtime: expected='%s' got='%s'", newMtime, mtimeNew)
+	}
+}
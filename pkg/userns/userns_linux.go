@@ -0,0 +1,203 @@
+//go:build linux
+// +build linux
+
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package userns implements re-executing umoci inside a new user namespace,
+// so that unprivileged users can extract images with the correct (mapped)
+// ownership using the subordinate IDs allocated to them in /etc/subuid and
+// /etc/subgid (without needing CAP_CHOWN on the host).
+package userns
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/apex/log"
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// childEnv is set in the environment of the re-executed child process.
+const childEnv = "_UMOCI_USERNS_CHILD"
+
+// childCapabilities are the capabilities (in the new user namespace) given to
+// the child so that it can create files with arbitrary ownership and modes.
+var childCapabilities = []uintptr{
+	unix.CAP_CHOWN,
+	unix.CAP_DAC_OVERRIDE,
+	unix.CAP_DAC_READ_SEARCH,
+	unix.CAP_FOWNER,
+	unix.CAP_FSETID,
+	unix.CAP_SETFCAP,
+}
+
+// IsChild returns whether the current process is a child re-executed by Run.
+func IsChild() bool {
+	return os.Getenv(childEnv) != ""
+}
+
+// Init must be called at the start of main. If the current process is a child
+// re-executed by Run, it waits until the parent has configured the ID
+// mappings of the user namespace. Otherwise, it does nothing.
+func Init() error {
+	if !IsChild() {
+		return nil
+	}
+	syncPipe := os.NewFile(3, "userns-sync")
+	defer syncPipe.Close()
+
+	var buf [1]byte
+	if n, err := syncPipe.Read(buf[:]); n != 1 {
+		return errors.Wrap(err, "parent failed to configure user namespace")
+	}
+	return nil
+}
+
+// namespaceMappings returns the ID mappings of the user namespace created by
+// Run. Every host ID in the given mappings is mapped to itself, so that IDs
+// inside the user namespace are the same as on the host (and thus paths
+// created in the user namespace look the same as if they were created by a
+// privileged process). The given own ID (the ID of the current process) is
+// always included.
+func namespaceMappings(mappings []rspec.LinuxIDMapping, ownID uint32) []rspec.LinuxIDMapping {
+	var nsMappings []rspec.LinuxIDMapping
+	hasOwn := false
+	for _, mapping := range mappings {
+		if mapping.HostID <= ownID && ownID-mapping.HostID < mapping.Size {
+			hasOwn = true
+		}
+		nsMappings = append(nsMappings, rspec.LinuxIDMapping{
+			ContainerID: mapping.HostID,
+			HostID:      mapping.HostID,
+			Size:        mapping.Size,
+		})
+	}
+	if !hasOwn {
+		nsMappings = append(nsMappings, rspec.LinuxIDMapping{
+			ContainerID: ownID,
+			HostID:      ownID,
+			Size:        1,
+		})
+	}
+	return nsMappings
+}
+
+// writeMappings configures the ID mappings of the user namespace of the
+// given process. Unprivileged users can only map other IDs using the setuid
+// newuidmap(1) and newgidmap(1) helpers, which check the allocations in
+// /etc/subuid and /etc/subgid.
+func writeMappings(pid int, kind string, mappings []rspec.LinuxIDMapping) error {
+	if os.Geteuid() == 0 {
+		var lines []string
+		for _, mapping := range mappings {
+			lines = append(lines, fmt.Sprintf("%d %d %d", mapping.ContainerID, mapping.HostID, mapping.Size))
+		}
+		mapPath := fmt.Sprintf("/proc/%d/%s_map", pid, kind)
+		return errors.Wrapf(ioutil.WriteFile(mapPath, []byte(strings.Join(lines, "\n")+"\n"), 0), "write %s", mapPath)
+	}
+
+	helper := "new" + kind + "map"
+	args := []string{strconv.Itoa(pid)}
+	for _, mapping := range mappings {
+		args = append(args, strconv.FormatUint(uint64(mapping.ContainerID), 10), strconv.FormatUint(uint64(mapping.HostID), 10), strconv.FormatUint(uint64(mapping.Size), 10))
+	}
+	if output, err := exec.Command(helper, args...).CombinedOutput(); err != nil {
+		return errors.Wrapf(err, "run %s: %s", helper, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// Run re-executes the current program (with the given arguments, which
+// should be os.Args) in a new user namespace in which every host ID in the
+// given mappings is mapped to itself, and waits for it to exit. The child is
+// given enough capabilities in the user namespace to create files owned by
+// any of the mapped IDs. The child must call Init before doing anything else,
+// and can use IsChild to detect that it is running inside the user namespace.
+// The exit status of the child is returned.
+func Run(args []string, uidMap, gidMap []rspec.LinuxIDMapping) (int, error) {
+	if len(uidMap) == 0 || len(gidMap) == 0 {
+		return -1, errors.Errorf("user namespace requires both uid and gid mappings")
+	}
+	uidMap = namespaceMappings(uidMap, uint32(os.Geteuid()))
+	gidMap = namespaceMappings(gidMap, uint32(os.Getegid()))
+
+	syncReader, syncWriter, err := os.Pipe()
+	if err != nil {
+		return -1, errors.Wrap(err, "create sync pipe")
+	}
+	defer syncReader.Close()
+	defer syncWriter.Close()
+
+	cmd := exec.Command("/proc/self/exe", args[1:]...)
+	cmd.Args[0] = args[0]
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), childEnv+"=1")
+	cmd.ExtraFiles = []*os.File{syncReader}
+	cmd.SysProcAttr = &unix.SysProcAttr{
+		Cloneflags:  unix.CLONE_NEWUSER,
+		AmbientCaps: childCapabilities,
+	}
+	if err := cmd.Start(); err != nil {
+		return -1, errors.Wrap(err, "start child in user namespace")
+	}
+	// #nosec G104
+	_ = syncReader.Close()
+
+	log.WithFields(log.Fields{
+		"pid":     cmd.Process.Pid,
+		"map.uid": uidMap,
+		"map.gid": gidMap,
+	}).Debugf("userns: configuring user namespace mappings")
+
+	err = writeMappings(cmd.Process.Pid, "uid", uidMap)
+	if err == nil {
+		err = writeMappings(cmd.Process.Pid, "gid", gidMap)
+	}
+	if err != nil {
+		// #nosec G104
+		_ = cmd.Process.Kill()
+		// #nosec G104
+		_ = cmd.Wait()
+		return -1, errors.Wrap(err, "configure user namespace")
+	}
+
+	// Let the child continue.
+	if _, err := syncWriter.Write([]byte{0}); err != nil {
+		// #nosec G104
+		_ = cmd.Process.Kill()
+	}
+	// #nosec G104
+	_ = syncWriter.Close()
+
+	if err := cmd.Wait(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return exitErr.ExitCode(), nil
+		}
+		return -1, errors.Wrap(err, "wait for child in user namespace")
+	}
+	return 0, nil
+}
@@ -0,0 +1,87 @@
+//go:build linux
+// +build linux
+
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package userns
+
+import (
+	"reflect"
+	"testing"
+
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestNamespaceMappings(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		mappings []rspec.LinuxIDMapping
+		ownID    uint32
+		expected []rspec.LinuxIDMapping
+	}{
+		{
+			name:     "SubIDs",
+			mappings: []rspec.LinuxIDMapping{{ContainerID: 0, HostID: 100000, Size: 65536}},
+			ownID:    1000,
+			expected: []rspec.LinuxIDMapping{
+				{ContainerID: 100000, HostID: 100000, Size: 65536},
+				{ContainerID: 1000, HostID: 1000, Size: 1},
+			},
+		},
+		{
+			name: "SubIDAuto",
+			mappings: []rspec.LinuxIDMapping{
+				{ContainerID: 0, HostID: 1000, Size: 1},
+				{ContainerID: 1, HostID: 100000, Size: 65536},
+			},
+			ownID: 1000,
+			expected: []rspec.LinuxIDMapping{
+				{ContainerID: 1000, HostID: 1000, Size: 1},
+				{ContainerID: 100000, HostID: 100000, Size: 65536},
+			},
+		},
+		{
+			name:     "OwnIDInRange",
+			mappings: []rspec.LinuxIDMapping{{ContainerID: 0, HostID: 900, Size: 200}},
+			ownID:    1000,
+			expected: []rspec.LinuxIDMapping{{ContainerID: 900, HostID: 900, Size: 200}},
+		},
+		{
+			name:     "OwnIDAfterRange",
+			mappings: []rspec.LinuxIDMapping{{ContainerID: 0, HostID: 900, Size: 100}},
+			ownID:    1000,
+			expected: []rspec.LinuxIDMapping{
+				{ContainerID: 900, HostID: 900, Size: 100},
+				{ContainerID: 1000, HostID: 1000, Size: 1},
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got := namespaceMappings(test.mappings, test.ownID)
+			if !reflect.DeepEqual(got, test.expected) {
+				t.Errorf("unexpected namespace mappings: expected %v, got %v", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestRunInvalidMappings(t *testing.T) {
+	if _, err := Run([]string{"umoci"}, nil, []rspec.LinuxIDMapping{{ContainerID: 0, HostID: 1000, Size: 1}}); err == nil {
+		t.Errorf("expected Run to fail without uid mappings")
+	}
+}
@@ -0,0 +1,43 @@
+//go:build !linux
+// +build !linux
+
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package userns
+
+import (
+	"runtime"
+
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+)
+
+// IsChild returns whether the current process is a child re-executed by Run.
+func IsChild() bool {
+	return false
+}
+
+// Init must be called at the start of main. It does nothing on this platform.
+func Init() error {
+	return nil
+}
+
+// Run is not supported on this platform.
+func Run(args []string, uidMap, gidMap []rspec.LinuxIDMapping) (int, error) {
+	return -1, errors.Errorf("user namespaces are not supported on GOOS=%s", runtime.GOOS)
+}
@@ -0,0 +1,133 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"context"
+	"path"
+	"sort"
+	"time"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/pkg/errors"
+)
+
+// tagCreated returns the creation time of the image the given tag refers to,
+// which is the "created" timestamp of its image configuration. If the tag
+// refers to several images (such as a multi-platform image), the newest
+// timestamp is used. Images without a "created" timestamp are treated as
+// having been created at the zero time.
+func tagCreated(ctx context.Context, engineExt casext.Engine, tag string) (time.Time, error) {
+	descriptorPaths, err := engineExt.ResolveReference(ctx, tag)
+	if err != nil {
+		return time.Time{}, errors.Wrapf(err, "resolve tag %s", tag)
+	}
+	var created time.Time
+	for _, descriptorPath := range descriptorPaths {
+		descriptor := descriptorPath.Descriptor()
+		if descriptor.MediaType != ispec.MediaTypeImageManifest {
+			continue
+		}
+		manifestBlob, err := engineExt.FromDescriptor(ctx, descriptor)
+		if err != nil {
+			return time.Time{}, errors.Wrapf(err, "get manifest %s", descriptor.Digest)
+		}
+		// #nosec G104
+		_ = manifestBlob.Close()
+		manifest, ok := manifestBlob.Data.(ispec.Manifest)
+		if !ok {
+			// Should _never_ be reached.
+			return time.Time{}, errors.Errorf("[internal error] unknown manifest blob type: %s", manifestBlob.Descriptor.MediaType)
+		}
+
+		configBlob, err := engineExt.FromDescriptor(ctx, manifest.Config)
+		if err != nil {
+			return time.Time{}, errors.Wrapf(err, "get config %s", manifest.Config.Digest)
+		}
+		// #nosec G104
+		_ = configBlob.Close()
+		config, ok := configBlob.Data.(ispec.Image)
+		if !ok {
+			return time.Time{}, errors.Errorf("config %s is not an image configuration: %s", manifest.Config.Digest, configBlob.Descriptor.MediaType)
+		}
+		if config.Created != nil && config.Created.After(created) {
+			created = *config.Created
+		}
+	}
+	return created, nil
+}
+
+// ExpiredTags returns the tags in the image which match the given glob pattern
+// (using the syntax of path.Match) other than the keep newest such tags -- in
+// other words, the tags which should be removed to implement a "keep the
+// latest N builds" retention policy. Tags are ordered by the "created"
+// timestamp of the image configuration they refer to (see tagCreated), with
+// ties (including images without a "created" timestamp) broken by comparing
+// the tag names, where the lexicographically greater tag is considered newer.
+// The returned tags are ordered from newest to oldest.
+func ExpiredTags(ctx context.Context, engineExt casext.Engine, pattern string, keep int) ([]string, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, errors.Wrapf(err, "invalid tag pattern %q", pattern)
+	}
+	if keep < 0 {
+		return nil, errors.Errorf("invalid number of tags to keep: %d", keep)
+	}
+
+	refs, err := engineExt.ListReferences(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "list references")
+	}
+
+	type tagInfo struct {
+		name    string
+		created time.Time
+	}
+	var tags []tagInfo
+	seen := map[string]struct{}{}
+	for _, ref := range refs {
+		if _, ok := seen[ref]; ok {
+			continue
+		}
+		seen[ref] = struct{}{}
+		// The pattern has already been validated.
+		if matched, _ := path.Match(pattern, ref); !matched {
+			continue
+		}
+		created, err := tagCreated(ctx, engineExt, ref)
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, tagInfo{name: ref, created: created})
+	}
+
+	sort.Slice(tags, func(i, j int) bool {
+		if !tags[i].created.Equal(tags[j].created) {
+			return tags[i].created.After(tags[j].created)
+		}
+		return tags[i].name > tags[j].name
+	})
+
+	var expired []string
+	for idx, tag := range tags {
+		if idx >= keep {
+			expired = append(expired, tag.name)
+		}
+	}
+	return expired, nil
+}
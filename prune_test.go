@@ -0,0 +1,91 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExpiredTags(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "umoci-TestExpiredTags")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engineExt, err := CreateLayout(filepath.Join(dir, "image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engineExt.Close()
+
+	for _, image := range []struct {
+		tag, created string
+	}{
+		{"build-1", "2020-01-01T00:00:00Z"},
+		{"build-2", "2020-01-03T00:00:00Z"},
+		{"build-3", "2020-01-02T00:00:00Z"},
+		// Ties are broken by the tag name.
+		{"build-4a", "2020-01-04T00:00:00Z"},
+		{"build-4b", "2020-01-04T00:00:00Z"},
+		{"release-1", "2019-01-01T00:00:00Z"},
+	} {
+		config := `{"created": "` + image.created + `", "architecture": "amd64", "os": "linux", "rootfs": {"type": "layers", "diff_ids": []}}`
+		if err := NewImageConfig(engineExt, image.tag, strings.NewReader(config)); err != nil {
+			t.Fatalf("create image %s: %+v", image.tag, err)
+		}
+	}
+
+	for _, test := range []struct {
+		pattern  string
+		keep     int
+		expected []string
+	}{
+		{"build-*", 2, []string{"build-2", "build-3", "build-1"}},
+		{"build-*", 0, []string{"build-4b", "build-4a", "build-2", "build-3", "build-1"}},
+		{"build-*", 5, nil},
+		{"build-*", 100, nil},
+		{"*", 5, []string{"release-1"}},
+		{"release-*", 0, []string{"release-1"}},
+		{"nothing-*", 0, nil},
+	} {
+		expired, err := ExpiredTags(ctx, engineExt, test.pattern, test.keep)
+		if err != nil {
+			t.Errorf("ExpiredTags(%q, %d): unexpected error: %+v", test.pattern, test.keep, err)
+			continue
+		}
+		if !reflect.DeepEqual(expired, test.expected) {
+			t.Errorf("ExpiredTags(%q, %d): expected %v, got %v", test.pattern, test.keep, test.expected, expired)
+		}
+	}
+
+	if _, err := ExpiredTags(ctx, engineExt, "[", 1); err == nil {
+		t.Errorf("expected invalid pattern to fail")
+	}
+	if _, err := ExpiredTags(ctx, engineExt, "*", -1); err == nil {
+		t.Errorf("expected negative keep to fail")
+	}
+}
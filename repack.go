@@ -21,7 +21,6 @@ import (
 	"context"
 	"os"
 	"path/filepath"
-	"strings"
 
 	"github.com/apex/log"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
@@ -35,53 +34,44 @@ import (
 )
 
 // Repack repacks a bundle into an image adding a new layer for the changed
-// data in the bundle.
-func Repack(engineExt casext.Engine, tagName string, bundlePath string, meta Meta, history *ispec.History, filters []mtreefilter.FilterFunc, refreshBundle bool, mutator *mutate.Mutator) error {
-	mtreeName := strings.Replace(meta.From.Descriptor().Digest.String(), ":", "_", 1)
-	mtreePath := filepath.Join(bundlePath, mtreeName+".mtree")
+// data in the bundle. The new layer is compressed using the given compressor
+// (if nil, mutate.GzipCompressor is used) and is generated using the given
+// layer.RepackOptions (which may be nil). The MapOptions setting of
+// packOptions is ignored, as it is instead set based on the bundle metadata.
+// TranslateOverlayWhiteouts is always enabled for bundles unpacked with
+// overlayfs whiteouts. If there are no changes to the bundle, no layer is added
+// (only the history entry is appended) unless AlwaysAppend is set in
+// packOptions, in which case an empty layer is added.
+func Repack(engineExt casext.Engine, tagName string, bundlePath string, meta Meta, history *ispec.History, filters []mtreefilter.FilterFunc, refreshBundle bool, mutator *mutate.Mutator, compressor mutate.Compressor, packOptions *layer.RepackOptions) error {
 	fullRootfsPath := filepath.Join(bundlePath, layer.RootfsName)
 
 	log.WithFields(log.Fields{
 		"bundle": bundlePath,
 		"rootfs": layer.RootfsName,
-		"mtree":  mtreePath,
 	}).Debugf("umoci: repacking OCI image")
 
-	mfh, err := os.Open(mtreePath)
-	if err != nil {
-		return errors.Wrap(err, "open mtree")
-	}
-	defer mfh.Close()
-
-	spec, err := mtree.ParseSpec(mfh)
-	if err != nil {
-		return errors.Wrap(err, "parse mtree")
+	if compressor == nil {
+		compressor = mutate.GzipCompressor
 	}
 
-	log.WithFields(log.Fields{
-		"keywords": MtreeKeywords,
-	}).Debugf("umoci: parsed mtree spec")
-
 	fsEval := fseval.Default
 	if meta.MapOptions.Rootless {
 		fsEval = fseval.Rootless
 	}
 
-	log.Info("computing filesystem diff ...")
-	diffs, err := mtree.Check(fullRootfsPath, spec, MtreeKeywords, fsEval)
-	if err != nil {
-		return errors.Wrap(err, "check mtree")
+	var packOpts layer.RepackOptions
+	if packOptions != nil {
+		packOpts = *packOptions
 	}
-	log.Info("... done")
-
-	log.WithFields(log.Fields{
-		"ndiff": len(diffs),
-	}).Debugf("umoci: checked mtree spec")
+	packOpts.MapOptions = meta.MapOptions
+	packOpts.TranslateOverlayWhiteouts = packOpts.TranslateOverlayWhiteouts || meta.WhiteoutMode == layer.OverlayFSWhiteout
 
-	allFilters := append(filters, mtreefilter.SimplifyFilter(diffs))
-	diffs = mtreefilter.FilterDeltas(diffs, allFilters...)
+	diffs, err := repackDeltas(bundlePath, meta, filters, packOpts.IgnorePatterns, fsEval)
+	if err != nil {
+		return err
+	}
 
-	if len(diffs) == 0 {
+	if len(diffs) == 0 && !packOpts.AlwaysAppend {
 		config, err := mutator.Config(context.Background())
 		if err != nil {
 			return err
@@ -102,11 +92,10 @@ func Repack(engineExt casext.Engine, tagName string, bundlePath string, meta Met
 			return err
 		}
 	} else {
-		packOptions := layer.RepackOptions{MapOptions: meta.MapOptions}
-		if meta.WhiteoutMode == layer.OverlayFSWhiteout {
-			packOptions.TranslateOverlayWhiteouts = true
+		if len(diffs) == 0 {
+			log.Info("no changes to the rootfs: adding an empty layer")
 		}
-		reader, err := layer.GenerateLayer(fullRootfsPath, diffs, &packOptions)
+		reader, err := layer.GenerateLayer(fullRootfsPath, diffs, &packOpts)
 		if err != nil {
 			return errors.Wrap(err, "generate diff layer")
 		}
@@ -114,7 +103,7 @@ func Repack(engineExt casext.Engine, tagName string, bundlePath string, meta Met
 
 		// TODO: We should add a flag to allow for a new layer to be made
 		//       non-distributable.
-		if _, err := mutator.Add(context.Background(), ispec.MediaTypeImageLayer, reader, history, mutate.GzipCompressor, nil); err != nil {
+		if _, err := mutator.Add(context.Background(), ispec.MediaTypeImageLayer, reader, history, compressor, nil); err != nil {
 			return errors.Wrap(err, "add diff layer")
 		}
 	}
@@ -133,17 +122,200 @@ func Repack(engineExt casext.Engine, tagName string, bundlePath string, meta Met
 	log.Infof("created new tag for image manifest: %s", tagName)
 
 	if refreshBundle {
-		newMtreeName := strings.Replace(newDescriptorPath.Descriptor().Digest.String(), ":", "_", 1)
-		if err := GenerateBundleManifest(newMtreeName, bundlePath, fsEval); err != nil {
-			return errors.Wrap(err, "write mtree metadata")
+		if err := rebaseBundle(bundlePath, meta, newDescriptorPath, fsEval); err != nil {
+			return err
 		}
-		if err := os.Remove(mtreePath); err != nil {
+	}
+	return nil
+}
+
+// RepackDiff computes the changes to the rootfs of the bundle which Repack
+// would include in the new layer (using the same filters and the
+// IgnorePatterns of packOptions, which may be nil), without generating the
+// layer or modifying the image. The returned differences are sorted by path,
+// and the keys of modified paths are the mtree keywords which differ from the
+// mtree manifest of the bundle.
+func RepackDiff(bundlePath string, meta Meta, filters []mtreefilter.FilterFunc, packOptions *layer.RepackOptions) ([]FileDiff, error) {
+	fsEval := fseval.Default
+	if meta.MapOptions.Rootless {
+		fsEval = fseval.Rootless
+	}
+
+	var ignorePatterns []string
+	if packOptions != nil {
+		ignorePatterns = packOptions.IgnorePatterns
+	}
+	deltas, err := repackDeltas(bundlePath, meta, filters, ignorePatterns, fsEval)
+	if err != nil {
+		return nil, err
+	}
+	return fileDiffs(deltas), nil
+}
+
+// repackDeltas computes the (filtered) set of changes to the rootfs of the
+// bundle since it was unpacked, which make up the new layer created by Repack.
+func repackDeltas(bundlePath string, meta Meta, filters []mtreefilter.FilterFunc, ignorePatterns []string, fsEval fseval.FsEval) ([]mtree.InodeDelta, error) {
+	mtreePath := meta.mtreePath(bundlePath)
+	mtreeKeywords := meta.mtreeKeywords()
+	fullRootfsPath := filepath.Join(bundlePath, layer.RootfsName)
+
+	mfh, err := os.Open(mtreePath)
+	if err != nil {
+		return nil, errors.Wrap(err, "open mtree")
+	}
+	defer mfh.Close()
+
+	spec, err := mtree.ParseSpec(mfh)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse mtree")
+	}
+
+	log.WithFields(log.Fields{
+		"mtree":    mtreePath,
+		"keywords": mtreeKeywords,
+	}).Debugf("umoci: parsed mtree spec")
+
+	if err := checkMtreeKeywords(spec, mtreeKeywords); err != nil {
+		return nil, errors.Wrapf(err, "check mtree keywords of %s", mtreePath)
+	}
+
+	log.Info("computing filesystem diff ...")
+	diffs, err := mtree.Check(fullRootfsPath, spec, mtreeKeywords, fsEval)
+	if err != nil {
+		return nil, errors.Wrap(err, "check mtree")
+	}
+	log.Info("... done")
+
+	log.WithFields(log.Fields{
+		"ndiff": len(diffs),
+	}).Debugf("umoci: checked mtree spec")
+
+	allFilters := append(filters, mtreefilter.SimplifyFilter(diffs))
+	diffs = mtreefilter.FilterDeltas(diffs, allFilters...)
+
+	// Filter out ignored paths here, so that we don't create an empty layer if
+	// every change was ignored.
+	diffs, err = layer.FilterIgnoredDeltas(diffs, ignorePatterns)
+	if err != nil {
+		return nil, errors.Wrap(err, "filter ignored paths")
+	}
+	return diffs, nil
+}
+
+// rebaseBundle regenerates the mtree manifest of the bundle from the current
+// state of its rootfs and updates the bundle metadata so that the bundle is
+// based on the given image. The old mtree manifest is removed.
+func rebaseBundle(bundlePath string, meta Meta, from casext.DescriptorPath, fsEval mtree.FsEval) error {
+	oldMtreePath := meta.mtreePath(bundlePath)
+	meta.From = from
+	newMtreePath := meta.mtreePath(bundlePath)
+
+	// The new manifest is generated in a temporary file which is then renamed
+	// over the new path, so that the bundle always has a valid manifest (a
+	// custom manifest path doesn't depend on the image, and neither does
+	// rebasing onto the same image, so newMtreePath may be oldMtreePath).
+	tmpMtreePath := newMtreePath + ".tmp"
+	if err := os.Remove(tmpMtreePath); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "remove stale temporary mtree metadata")
+	}
+	if err := generateBundleManifest(tmpMtreePath, bundlePath, meta.mtreeKeywords(), fsEval); err != nil {
+		// #nosec G104
+		_ = os.Remove(tmpMtreePath)
+		return errors.Wrap(err, "write mtree metadata")
+	}
+	if err := os.Rename(tmpMtreePath, newMtreePath); err != nil {
+		// #nosec G104
+		_ = os.Remove(tmpMtreePath)
+		return errors.Wrap(err, "replace mtree metadata")
+	}
+	if err := WriteBundleMeta(bundlePath, meta); err != nil {
+		return errors.Wrap(err, "write umoci.json metadata")
+	}
+	if newMtreePath != oldMtreePath {
+		if err := os.Remove(oldMtreePath); err != nil {
 			return errors.Wrap(err, "remove old mtree metadata")
 		}
-		meta.From = newDescriptorPath
-		if err := WriteBundleMeta(bundlePath, meta); err != nil {
-			return errors.Wrap(err, "write umoci.json metadata")
-		}
 	}
 	return nil
 }
+
+// RefreshBundle updates an existing (non-overlay) bundle so that it is based
+// on the image referenced by fromName, without re-extracting the image. The
+// current contents of the bundle's rootfs become the new baseline: its mtree
+// manifest is regenerated and the bundle metadata is updated to refer to the
+// new image, so that a later Repack of the bundle only contains changes made
+// after the refresh. This is useful if the current contents of the rootfs
+// were already added to the image (such as with a Repack without
+// refreshBundle). If fromName refers to a multi-platform image, platform is
+// used to select which image is used.
+//
+// Any changes to the rootfs since the bundle was unpacked (or last refreshed)
+// are computed and logged, but are otherwise discarded from the point of view
+// of future repacks -- so the rootfs should match the image referenced by
+// fromName.
+func RefreshBundle(engineExt casext.Engine, fromName string, bundlePath string, platform *ispec.Platform) error {
+	meta, err := ReadBundleMeta(bundlePath)
+	if err != nil {
+		return errors.Wrap(err, "read umoci.json metadata")
+	}
+	if meta.Overlay {
+		return errors.Errorf("cannot refresh bundle %s: bundles unpacked with --overlay have no mtree manifest", bundlePath)
+	}
+
+	fromDescriptorPath, err := ResolveReference(context.Background(), engineExt, fromName, platform)
+	if err != nil {
+		return err
+	}
+	if mediaType := fromDescriptorPath.Descriptor().MediaType; mediaType != ispec.MediaTypeImageManifest {
+		return errors.Errorf("invalid --image tag: descriptor does not point to ispec.MediaTypeImageManifest: not implemented: %s", mediaType)
+	}
+
+	mtreePath := meta.mtreePath(bundlePath)
+	mtreeKeywords := meta.mtreeKeywords()
+	fullRootfsPath := filepath.Join(bundlePath, layer.RootfsName)
+
+	log.WithFields(log.Fields{
+		"bundle": bundlePath,
+		"ref":    fromName,
+		"mtree":  mtreePath,
+	}).Debugf("umoci: refreshing bundle")
+
+	mfh, err := os.Open(mtreePath)
+	if err != nil {
+		return errors.Wrap(err, "open mtree")
+	}
+	defer mfh.Close()
+
+	spec, err := mtree.ParseSpec(mfh)
+	if err != nil {
+		return errors.Wrap(err, "parse mtree")
+	}
+	if err := checkMtreeKeywords(spec, mtreeKeywords); err != nil {
+		return errors.Wrapf(err, "check mtree keywords of %s", mtreePath)
+	}
+
+	fsEval := fseval.Default
+	if meta.MapOptions.Rootless {
+		fsEval = fseval.Rootless
+	}
+
+	log.Info("computing filesystem diff ...")
+	diffs, err := mtree.Check(fullRootfsPath, spec, mtreeKeywords, fsEval)
+	if err != nil {
+		return errors.Wrap(err, "check mtree")
+	}
+	diffs = mtreefilter.FilterDeltas(diffs, mtreefilter.SimplifyFilter(diffs))
+	log.Info("... done")
+
+	for _, diff := range diffs {
+		log.Debugf("umoci: refresh: absorbing %s change to %s", diff.Type(), diff.Path())
+	}
+	log.Infof("absorbing %d changes to the rootfs into the bundle metadata", len(diffs))
+
+	if err := rebaseBundle(bundlePath, meta, fromDescriptorPath, fsEval); err != nil {
+		return err
+	}
+
+	log.Infof("refreshed bundle %s: now based on %s", bundlePath, fromDescriptorPath.Descriptor().Digest)
+	return nil
+}
@@ -0,0 +1,205 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/apex/log"
+	"github.com/pkg/errors"
+)
+
+// SealName is the name of the file storing the seal of a bundle's metadata
+// (see SealBundle).
+const SealName = "umoci.seal"
+
+// SealVersion is the version of the Seal format supported by this code.
+const SealVersion = 1
+
+const (
+	// SealAlgorithmSHA256 seals the bundle metadata with a plain SHA-256
+	// checksum. This detects accidental corruption (or careless edits) of the
+	// metadata, but anyone able to modify the metadata can also update the
+	// checksum.
+	SealAlgorithmSHA256 = "sha256"
+
+	// SealAlgorithmHMACSHA256 seals the bundle metadata with a HMAC-SHA256
+	// keyed with a secret key, so the seal can only be updated by someone who
+	// knows the key.
+	SealAlgorithmHMACSHA256 = "hmac-sha256"
+)
+
+// ErrSealMismatch is returned (wrapped) by VerifyBundleSeal if the bundle
+// metadata doesn't match the seal.
+var ErrSealMismatch = errors.New("bundle metadata does not match seal")
+
+// Seal is the on-disk representation of the seal of a bundle's metadata.
+type Seal struct {
+	// Version is the version of the seal format (SealVersion).
+	Version int `json:"version"`
+
+	// Algorithm is the algorithm used to compute Digest (SealAlgorithmSHA256
+	// or SealAlgorithmHMACSHA256).
+	Algorithm string `json:"algorithm"`
+
+	// Digest is the hex-encoded checksum of the bundle metadata.
+	Digest string `json:"digest"`
+}
+
+// sealDigest computes the digest of the metadata of the given bundle using
+// the given algorithm. The digest covers both umoci.json and (for
+// non-overlay bundles) the mtree manifest of the bundle.
+func sealDigest(bundlePath string, algorithm string, key []byte) (string, error) {
+	var h hash.Hash
+	switch algorithm {
+	case SealAlgorithmSHA256:
+		h = sha256.New()
+	case SealAlgorithmHMACSHA256:
+		h = hmac.New(sha256.New, key)
+	default:
+		return "", errors.Errorf("unsupported seal algorithm: %s", algorithm)
+	}
+
+	meta, err := ReadBundleMeta(bundlePath)
+	if err != nil {
+		return "", errors.Wrap(err, "read umoci.json metadata")
+	}
+	files := []string{filepath.Join(bundlePath, MetaName)}
+	if !meta.Overlay {
+		files = append(files, meta.mtreePath(bundlePath))
+	}
+
+	for _, file := range files {
+		fh, err := os.Open(file)
+		if err != nil {
+			return "", errors.Wrap(err, "open sealed metadata")
+		}
+		fi, err := fh.Stat()
+		if err != nil {
+			fh.Close()
+			return "", errors.Wrap(err, "stat sealed metadata")
+		}
+		// Include the length of each file so that the boundary between them
+		// is unambiguous.
+		fmt.Fprintf(h, "%d\n", fi.Size())
+		_, err = io.Copy(h, fh)
+		fh.Close()
+		if err != nil {
+			return "", errors.Wrap(err, "hash sealed metadata")
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// SealBundle seals the metadata (umoci.json and the mtree manifest) of the
+// given bundle, so that later modifications of the metadata can be detected
+// with VerifyBundleSeal. If key is non-empty, the seal is a HMAC-SHA256 keyed
+// with key (so the seal cannot be forged without the key), otherwise it is a
+// plain SHA-256 checksum. Any existing seal is replaced.
+//
+// Because the seal covers the metadata, SealBundle must be called again
+// whenever the metadata is regenerated (such as by Repack with refreshBundle
+// or by RefreshBundle).
+func SealBundle(bundlePath string, key []byte) error {
+	seal := Seal{
+		Version:   SealVersion,
+		Algorithm: SealAlgorithmSHA256,
+	}
+	if len(key) > 0 {
+		seal.Algorithm = SealAlgorithmHMACSHA256
+	}
+
+	digest, err := sealDigest(bundlePath, seal.Algorithm, key)
+	if err != nil {
+		return errors.Wrap(err, "compute seal")
+	}
+	seal.Digest = digest
+
+	fh, err := os.Create(filepath.Join(bundlePath, SealName))
+	if err != nil {
+		return errors.Wrap(err, "create seal")
+	}
+	defer fh.Close()
+
+	if err := json.NewEncoder(fh).Encode(seal); err != nil {
+		return errors.Wrap(err, "write seal")
+	}
+	log.WithFields(log.Fields{
+		"algorithm": seal.Algorithm,
+		"digest":    seal.Digest,
+	}).Debugf("umoci: sealed bundle metadata")
+	return errors.Wrap(fh.Close(), "close seal")
+}
+
+// VerifyBundleSeal checks that the metadata of the given bundle matches the
+// seal created by SealBundle, returning whether the bundle is sealed. Bundles
+// without a seal are only accepted if key is empty -- if a key is provided
+// the bundle must have a seal created with that key (otherwise an attacker
+// could just remove the seal). If the metadata doesn't match the seal, the
+// returned error wraps ErrSealMismatch.
+func VerifyBundleSeal(bundlePath string, key []byte) (bool, error) {
+	fh, err := os.Open(filepath.Join(bundlePath, SealName))
+	if os.IsNotExist(err) {
+		if len(key) > 0 {
+			return false, errors.Errorf("bundle %s is not sealed, but a seal key was provided", bundlePath)
+		}
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrap(err, "open seal")
+	}
+	defer fh.Close()
+
+	var seal Seal
+	if err := json.NewDecoder(fh).Decode(&seal); err != nil {
+		return true, errors.Wrap(err, "decode seal")
+	}
+	if seal.Version != SealVersion {
+		return true, errors.Errorf("unsupported seal version: %d", seal.Version)
+	}
+
+	switch seal.Algorithm {
+	case SealAlgorithmSHA256:
+		// Don't allow a keyed seal to be downgraded to a plain checksum.
+		if len(key) > 0 {
+			return true, errors.Errorf("bundle %s is sealed without a key, but a seal key was provided", bundlePath)
+		}
+	case SealAlgorithmHMACSHA256:
+		if len(key) == 0 {
+			return true, errors.Errorf("bundle %s is sealed with a key: a seal key must be provided to verify it", bundlePath)
+		}
+	}
+
+	digest, err := sealDigest(bundlePath, seal.Algorithm, key)
+	if err != nil {
+		return true, errors.Wrap(err, "compute seal")
+	}
+	if subtle.ConstantTimeCompare([]byte(digest), []byte(seal.Digest)) != 1 {
+		return true, errors.Wrapf(ErrSealMismatch, "verify seal of %s", bundlePath)
+	}
+	return true, nil
+}
@@ -0,0 +1,128 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/umoci/oci/layer"
+	"github.com/pkg/errors"
+)
+
+// setupSealBundle creates a fake bundle containing just the metadata covered
+// by the bundle seal.
+func setupSealBundle(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "umoci-TestSeal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteBundleMeta(dir, Meta{Version: MetaVersion, MtreePath: "bundle.mtree"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "bundle.mtree"), []byte("#mtree\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestSealBundle(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		key  []byte
+	}{
+		{"Checksum", nil},
+		{"HMAC", []byte("secret key")},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			bundle := setupSealBundle(t)
+			defer os.RemoveAll(bundle)
+
+			if err := SealBundle(bundle, test.key); err != nil {
+				t.Fatalf("unexpected SealBundle error: %+v", err)
+			}
+			sealed, err := VerifyBundleSeal(bundle, test.key)
+			if err != nil {
+				t.Fatalf("unexpected VerifyBundleSeal error: %+v", err)
+			}
+			if !sealed {
+				t.Errorf("expected bundle to be sealed")
+			}
+
+			// Modifying the mtree manifest must invalidate the seal.
+			if err := ioutil.WriteFile(filepath.Join(bundle, "bundle.mtree"), []byte("#mtree\n./etc type=dir\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := VerifyBundleSeal(bundle, test.key); errors.Cause(err) != ErrSealMismatch {
+				t.Errorf("expected ErrSealMismatch after modifying mtree manifest, got %v", err)
+			}
+
+			// Re-sealing makes the bundle valid again.
+			if err := SealBundle(bundle, test.key); err != nil {
+				t.Fatalf("unexpected SealBundle error: %+v", err)
+			}
+			if _, err := VerifyBundleSeal(bundle, test.key); err != nil {
+				t.Errorf("unexpected VerifyBundleSeal error after re-sealing: %+v", err)
+			}
+
+			// Modifying umoci.json must also invalidate the seal.
+			if err := WriteBundleMeta(bundle, Meta{Version: MetaVersion, MtreePath: "bundle.mtree", WhiteoutMode: layer.OverlayFSWhiteout}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := VerifyBundleSeal(bundle, test.key); errors.Cause(err) != ErrSealMismatch {
+				t.Errorf("expected ErrSealMismatch after modifying umoci.json, got %v", err)
+			}
+		})
+	}
+}
+
+func TestVerifyBundleSealKey(t *testing.T) {
+	bundle := setupSealBundle(t)
+	defer os.RemoveAll(bundle)
+
+	key := []byte("secret key")
+
+	// Unsealed bundles are only accepted without a key.
+	if sealed, err := VerifyBundleSeal(bundle, nil); err != nil || sealed {
+		t.Errorf("expected unsealed bundle to be accepted without a key: sealed=%v err=%v", sealed, err)
+	}
+	if _, err := VerifyBundleSeal(bundle, key); err == nil {
+		t.Errorf("expected unsealed bundle to be rejected with a key")
+	}
+
+	// Plain checksums cannot be verified with a key.
+	if err := SealBundle(bundle, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := VerifyBundleSeal(bundle, key); err == nil {
+		t.Errorf("expected checksum seal to be rejected with a key")
+	}
+
+	// Keyed seals need the right key.
+	if err := SealBundle(bundle, key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := VerifyBundleSeal(bundle, nil); err == nil {
+		t.Errorf("expected HMAC seal to be rejected without a key")
+	}
+	if _, err := VerifyBundleSeal(bundle, []byte("wrong key")); errors.Cause(err) != ErrSealMismatch {
+		t.Errorf("expected ErrSealMismatch with the wrong key, got %v", err)
+	}
+}
@@ -0,0 +1,304 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+
+	"github.com/apex/log"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/pkg/errors"
+)
+
+const (
+	// CosignSignatureMediaType is the media type of the layers of a cosign
+	// signature manifest. Each layer is a "simple signing" payload which
+	// describes the signed image.
+	CosignSignatureMediaType = "application/vnd.dev.cosign.simplesigning.v1+json"
+
+	// CosignSignatureAnnotation is the annotation of a cosign signature layer
+	// descriptor which contains the (base64-encoded) signature of the layer.
+	CosignSignatureAnnotation = "dev.cosignproject.cosign/signature"
+
+	// cosignSignatureType is the payload type of cosign image signatures.
+	cosignSignatureType = "cosign container image signature"
+
+	// maxCosignPayloadSize is the largest signature payload we will read.
+	// Payloads are tiny JSON documents, so anything larger is bogus.
+	maxCosignPayloadSize = 1 << 20
+)
+
+// CosignSignatureTag returns the tag used by cosign for the signature
+// manifest of the image with the given digest ("<algorithm>-<encoded>.sig").
+func CosignSignatureTag(imageDigest digest.Digest) string {
+	return imageDigest.Algorithm().String() + "-" + imageDigest.Encoded() + ".sig"
+}
+
+// Signature is the result of verifying a single cosign signature of an image.
+type Signature struct {
+	// Image is the digest of the image (manifest or image index) which was
+	// verified.
+	Image digest.Digest `json:"image"`
+
+	// Manifest is the descriptor of the cosign signature manifest containing
+	// the signature.
+	Manifest ispec.Descriptor `json:"manifest"`
+
+	// Payload is the descriptor of the signed payload (a layer of Manifest).
+	// It is empty if Manifest has no signature layers.
+	Payload ispec.Descriptor `json:"payload"`
+
+	// Valid is whether the payload was signed by the key and describes the
+	// image.
+	Valid bool `json:"valid"`
+
+	// Error is the reason the signature is not valid.
+	Error string `json:"error,omitempty"`
+}
+
+// cosignPayload is the subset of a cosign "simple signing" payload which we
+// need to verify that it describes an image.
+type cosignPayload struct {
+	Critical struct {
+		Image struct {
+			DockerManifestDigest digest.Digest `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+}
+
+// ParsePublicKey parses a PEM-encoded (PKIX) public key, such as the
+// cosign.pub generated by "cosign generate-key-pair". ECDSA, RSA and Ed25519
+// keys are supported.
+func ParsePublicKey(data []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("parse public key: no PEM data found")
+	}
+	if block.Type != "PUBLIC KEY" {
+		return nil, errors.Errorf("parse public key: unsupported PEM block type %q", block.Type)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse public key")
+	}
+	switch key.(type) {
+	case *ecdsa.PublicKey, *rsa.PublicKey, ed25519.PublicKey:
+		return key, nil
+	}
+	return nil, errors.Errorf("parse public key: unsupported key type %T", key)
+}
+
+// verifySignature verifies that sig is a signature of payload by key, using
+// the same algorithms as cosign (SHA-256 digests with ECDSA and RSA
+// PKCS#1 v1.5 keys, and plain Ed25519).
+func verifySignature(key crypto.PublicKey, payload, sig []byte) error {
+	hash := sha256.Sum256(payload)
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(key, hash[:], sig) {
+			return errors.New("invalid ecdsa signature")
+		}
+	case *rsa.PublicKey:
+		if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], sig); err != nil {
+			return errors.Wrap(err, "invalid rsa signature")
+		}
+	case ed25519.PublicKey:
+		if !ed25519.Verify(key, payload, sig) {
+			return errors.New("invalid ed25519 signature")
+		}
+	default:
+		return errors.Errorf("unsupported key type %T", key)
+	}
+	return nil
+}
+
+// cosignSignatureManifests returns the descriptors of the cosign signature
+// manifests for the image with the given digest in the image layout. This
+// includes both the manifest tagged according to cosign's tag convention (see
+// CosignSignatureTag) and any referrers of the image (see
+// casext.Engine.Referrers).
+func cosignSignatureManifests(ctx context.Context, engineExt casext.Engine, imageDigest digest.Digest) ([]ispec.Descriptor, error) {
+	index, err := engineExt.GetIndex(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "get top-level index")
+	}
+	referrers, err := engineExt.Referrers(ctx, imageDigest)
+	if err != nil {
+		return nil, errors.Wrap(err, "get referrers")
+	}
+
+	var (
+		manifests []ispec.Descriptor
+		seen      = map[digest.Digest]struct{}{}
+	)
+	add := func(descriptor ispec.Descriptor) {
+		if descriptor.MediaType != ispec.MediaTypeImageManifest {
+			return
+		}
+		if _, ok := seen[descriptor.Digest]; ok {
+			return
+		}
+		seen[descriptor.Digest] = struct{}{}
+		manifests = append(manifests, descriptor)
+	}
+
+	tag := CosignSignatureTag(imageDigest)
+	for _, descriptor := range index.Manifests {
+		if descriptor.Annotations[ispec.AnnotationRefName] == tag {
+			add(descriptor)
+		}
+	}
+	for _, descriptor := range referrers {
+		add(descriptor)
+	}
+	return manifests, nil
+}
+
+// verifyCosignPayload verifies that the given cosign signature layer is a
+// signature (by key) of a payload describing the image with the given digest.
+func verifyCosignPayload(ctx context.Context, engineExt casext.Engine, imageDigest digest.Digest, layer ispec.Descriptor, key crypto.PublicKey) (Err error) {
+	encodedSig, ok := layer.Annotations[CosignSignatureAnnotation]
+	if !ok {
+		return errors.Errorf("missing %s annotation", CosignSignatureAnnotation)
+	}
+	sig, err := base64.StdEncoding.DecodeString(encodedSig)
+	if err != nil {
+		return errors.Wrap(err, "decode signature")
+	}
+
+	if layer.Size > maxCosignPayloadSize {
+		return errors.Errorf("payload is too large (%d bytes)", layer.Size)
+	}
+	reader, err := engineExt.GetVerifiedBlob(ctx, layer)
+	if err != nil {
+		return errors.Wrap(err, "get payload")
+	}
+	defer func() {
+		if err := reader.Close(); err != nil && Err == nil {
+			Err = errors.Wrap(err, "get payload")
+		}
+	}()
+	payload, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return errors.Wrap(err, "read payload")
+	}
+
+	if err := verifySignature(key, payload, sig); err != nil {
+		return err
+	}
+
+	// Only now that we know the payload is authentic do we look at it.
+	var parsed cosignPayload
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	if err := decoder.Decode(&parsed); err != nil {
+		return errors.Wrap(err, "parse payload")
+	}
+	if parsed.Critical.Type != cosignSignatureType {
+		return errors.Errorf("unsupported payload type %q", parsed.Critical.Type)
+	}
+	if parsed.Critical.Image.DockerManifestDigest != imageDigest {
+		return errors.Errorf("payload signs a different image (%s)", parsed.Critical.Image.DockerManifestDigest)
+	}
+	return nil
+}
+
+// VerifyCosignSignatures finds the cosign signatures of the image (manifest
+// or image index) with the given digest in the image layout, and verifies
+// each of them using key. Signature manifests are found using cosign's tag
+// convention (see CosignSignatureTag) as well as by looking for manifests in
+// the top-level index whose subject is the image. No signatures are fetched
+// from registries or transparency logs, so this can be used offline.
+//
+// The result of verifying each signature is returned (so the image has a
+// valid signature if any of the returned Signatures are Valid). An error is
+// only returned if the signatures of the image could not be found.
+func VerifyCosignSignatures(ctx context.Context, engineExt casext.Engine, imageDigest digest.Digest, key crypto.PublicKey) ([]Signature, error) {
+	manifestDescriptors, err := cosignSignatureManifests(ctx, engineExt, imageDigest)
+	if err != nil {
+		return nil, errors.Wrap(err, "find signature manifests")
+	}
+
+	var signatures []Signature
+	for _, manifestDescriptor := range manifestDescriptors {
+		invalid := func(err error) Signature {
+			return Signature{
+				Image:    imageDigest,
+				Manifest: manifestDescriptor,
+				Error:    err.Error(),
+			}
+		}
+
+		manifestBlob, err := engineExt.FromDescriptor(ctx, manifestDescriptor)
+		if err != nil {
+			signatures = append(signatures, invalid(errors.Wrap(err, "get signature manifest")))
+			continue
+		}
+		manifest, ok := manifestBlob.Data.(ispec.Manifest)
+		if err := manifestBlob.Close(); err != nil {
+			signatures = append(signatures, invalid(errors.Wrap(err, "get signature manifest")))
+			continue
+		}
+		if !ok {
+			// Should _never_ be reached.
+			return nil, errors.Errorf("[internal error] unknown manifest blob type: %s", manifestBlob.Descriptor.MediaType)
+		}
+
+		found := false
+		for _, layer := range manifest.Layers {
+			if layer.MediaType != CosignSignatureMediaType {
+				continue
+			}
+			found = true
+
+			signature := Signature{
+				Image:    imageDigest,
+				Manifest: manifestDescriptor,
+				Payload:  layer,
+				Valid:    true,
+			}
+			if err := verifyCosignPayload(ctx, engineExt, imageDigest, layer, key); err != nil {
+				signature.Valid = false
+				signature.Error = err.Error()
+			}
+			log.WithFields(log.Fields{
+				"manifest": manifestDescriptor.Digest,
+				"payload":  layer.Digest,
+				"valid":    signature.Valid,
+			}).Debugf("umoci: verified cosign signature of %s", imageDigest)
+			signatures = append(signatures, signature)
+		}
+		if !found {
+			signatures = append(signatures, invalid(errors.New("manifest contains no cosign signatures")))
+		}
+	}
+	return signatures, nil
+}
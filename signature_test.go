@@ -0,0 +1,350 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	imeta "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/cas/dir"
+	"github.com/opencontainers/umoci/oci/casext"
+)
+
+// signatureTestManifest is an image-spec v1.1 manifest, which our vendored
+// image-spec doesn't support yet.
+type signatureTestManifest struct {
+	ispec.Manifest
+	Subject *ispec.Descriptor `json:"subject,omitempty"`
+}
+
+func signCosignTestPayload(t *testing.T, key crypto.Signer, payload []byte) string {
+	var (
+		sig []byte
+		err error
+	)
+	if _, ok := key.(ed25519.PrivateKey); ok {
+		sig, err = key.Sign(rand.Reader, payload, crypto.Hash(0))
+	} else {
+		hash := sha256.Sum256(payload)
+		sig, err = key.Sign(rand.Reader, hash[:], crypto.SHA256)
+	}
+	if err != nil {
+		t.Fatalf("sign payload: %+v", err)
+	}
+	return base64.StdEncoding.EncodeToString(sig)
+}
+
+// putCosignTestSignature adds a cosign signature manifest (with a signature
+// of a payload for signedDigest by key) for the image with the given digest.
+// If subject is set, the signature manifest is added to the top-level index
+// with the image as its subject. Otherwise it is tagged using the cosign tag
+// convention.
+func putCosignTestSignature(t *testing.T, engineExt casext.Engine, image ispec.Descriptor, signedDigest digest.Digest, key crypto.Signer, subject bool) ispec.Descriptor {
+	ctx := context.Background()
+
+	var payload cosignPayload
+	payload.Critical.Type = cosignSignatureType
+	payload.Critical.Image.DockerManifestDigest = signedDigest
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payloadDigest, payloadSize, err := engineExt.PutBlob(ctx, strings.NewReader(string(payloadBytes)))
+	if err != nil {
+		t.Fatalf("put payload: %+v", err)
+	}
+	configDigest, configSize, err := engineExt.PutBlobJSON(ctx, ispec.Image{})
+	if err != nil {
+		t.Fatalf("put config: %+v", err)
+	}
+
+	manifest := signatureTestManifest{
+		Manifest: ispec.Manifest{
+			Versioned: imeta.Versioned{SchemaVersion: 2},
+			MediaType: ispec.MediaTypeImageManifest,
+			Config: ispec.Descriptor{
+				MediaType: ispec.MediaTypeImageConfig,
+				Digest:    configDigest,
+				Size:      configSize,
+			},
+			Layers: []ispec.Descriptor{{
+				MediaType: CosignSignatureMediaType,
+				Digest:    payloadDigest,
+				Size:      payloadSize,
+				Annotations: map[string]string{
+					CosignSignatureAnnotation: signCosignTestPayload(t, key, payloadBytes),
+				},
+			}},
+		},
+	}
+	if subject {
+		manifest.Subject = &image
+	}
+	manifestDigest, manifestSize, err := engineExt.PutBlobJSON(ctx, manifest)
+	if err != nil {
+		t.Fatalf("put manifest: %+v", err)
+	}
+	descriptor := ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    manifestDigest,
+		Size:      manifestSize,
+	}
+
+	if subject {
+		index, err := engineExt.GetIndex(ctx)
+		if err != nil {
+			t.Fatalf("get index: %+v", err)
+		}
+		index.Manifests = append(index.Manifests, descriptor)
+		if err := engineExt.PutIndex(ctx, index); err != nil {
+			t.Fatalf("put index: %+v", err)
+		}
+	} else {
+		if err := engineExt.UpdateReference(ctx, CosignSignatureTag(image.Digest), descriptor); err != nil {
+			t.Fatalf("tag signature: %+v", err)
+		}
+	}
+	return descriptor
+}
+
+func TestParsePublicKey(t *testing.T) {
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ed25519Key, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name string
+		key  crypto.PublicKey
+	}{
+		{"ECDSA", &ecdsaKey.PublicKey},
+		{"RSA", &rsaKey.PublicKey},
+		{"Ed25519", ed25519Key},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			der, err := x509.MarshalPKIXPublicKey(test.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+
+			key, err := ParsePublicKey(data)
+			if err != nil {
+				t.Fatalf("unexpected error parsing key: %+v", err)
+			}
+			if !test.key.(interface{ Equal(crypto.PublicKey) bool }).Equal(key) {
+				t.Errorf("parsed key doesn't match: expected %v got %v", test.key, key)
+			}
+		})
+	}
+
+	if _, err := ParsePublicKey([]byte("not a key")); err == nil {
+		t.Errorf("expected error parsing non-PEM key")
+	}
+	privateDer, err := x509.MarshalPKCS8PrivateKey(ecdsaKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParsePublicKey(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateDer})); err == nil {
+		t.Errorf("expected error parsing private key")
+	}
+}
+
+func TestVerifyCosignSignatures(t *testing.T) {
+	ctx := context.Background()
+
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name    string
+		key     crypto.Signer
+		subject bool
+	}{
+		{"ECDSA", ecdsaKey, false},
+		{"RSA", rsaKey, false},
+		{"Ed25519", ed25519Key, false},
+		{"Subject", ecdsaKey, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			root, err := ioutil.TempDir("", "umoci-TestVerifyCosignSignatures")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(root)
+
+			image := filepath.Join(root, "image")
+			if err := dir.Create(image); err != nil {
+				t.Fatalf("unexpected error creating image: %+v", err)
+			}
+			engine, err := dir.Open(image)
+			if err != nil {
+				t.Fatalf("unexpected error opening image: %+v", err)
+			}
+			engineExt := casext.NewEngine(engine)
+			defer engine.Close()
+
+			signed := putDiffTestImage(t, engineExt)
+			unsigned := putDiffTestImage(t, engineExt, nil)
+			sigManifest := putCosignTestSignature(t, engineExt, signed, signed.Digest, test.key, test.subject)
+
+			// The signature is valid with the right key.
+			signatures, err := VerifyCosignSignatures(ctx, engineExt, signed.Digest, test.key.Public())
+			if err != nil {
+				t.Fatalf("unexpected error verifying signatures: %+v", err)
+			}
+			if len(signatures) != 1 {
+				t.Fatalf("expected 1 signature, got %d: %+v", len(signatures), signatures)
+			}
+			if sig := signatures[0]; !sig.Valid || sig.Error != "" || sig.Image != signed.Digest || sig.Manifest.Digest != sigManifest.Digest {
+				t.Errorf("expected valid signature by %s, got %+v", sigManifest.Digest, sig)
+			}
+
+			// ... but not with a different key.
+			signatures, err = VerifyCosignSignatures(ctx, engineExt, signed.Digest, &otherKey.PublicKey)
+			if err != nil {
+				t.Fatalf("unexpected error verifying signatures: %+v", err)
+			}
+			if len(signatures) != 1 || signatures[0].Valid || signatures[0].Error == "" {
+				t.Errorf("expected 1 invalid signature with the wrong key, got %+v", signatures)
+			}
+
+			// The other image has no signatures.
+			signatures, err = VerifyCosignSignatures(ctx, engineExt, unsigned.Digest, test.key.Public())
+			if err != nil {
+				t.Fatalf("unexpected error verifying signatures: %+v", err)
+			}
+			if len(signatures) != 0 {
+				t.Errorf("expected no signatures for unsigned image, got %+v", signatures)
+			}
+		})
+	}
+}
+
+func TestVerifyCosignSignaturesInvalid(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestVerifyCosignSignaturesInvalid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A correctly signed payload which describes a different image must not
+	// be accepted as a signature of this image.
+	signed := putDiffTestImage(t, engineExt)
+	other := putDiffTestImage(t, engineExt, nil)
+	putCosignTestSignature(t, engineExt, signed, other.Digest, key, false)
+
+	signatures, err := VerifyCosignSignatures(ctx, engineExt, signed.Digest, &key.PublicKey)
+	if err != nil {
+		t.Fatalf("unexpected error verifying signatures: %+v", err)
+	}
+	if len(signatures) != 1 || signatures[0].Valid || !strings.Contains(signatures[0].Error, "different image") {
+		t.Errorf("expected signature of a different image to be invalid, got %+v", signatures)
+	}
+
+	// A tampered signature is invalid.
+	sigManifest := putCosignTestSignature(t, engineExt, signed, signed.Digest, key, false)
+	manifestBlob, err := engineExt.FromDescriptor(ctx, sigManifest)
+	if err != nil {
+		t.Fatalf("get signature manifest: %+v", err)
+	}
+	manifest := manifestBlob.Data.(ispec.Manifest)
+	sig, err := base64.StdEncoding.DecodeString(manifest.Layers[0].Annotations[CosignSignatureAnnotation])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig[len(sig)-1] ^= 0xff
+	manifest.Layers[0].Annotations[CosignSignatureAnnotation] = base64.StdEncoding.EncodeToString(sig)
+	manifestDigest, manifestSize, err := engineExt.PutBlobJSON(ctx, manifest)
+	if err != nil {
+		t.Fatalf("put manifest: %+v", err)
+	}
+	if err := engineExt.UpdateReference(ctx, CosignSignatureTag(signed.Digest), ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    manifestDigest,
+		Size:      manifestSize,
+	}); err != nil {
+		t.Fatalf("tag signature: %+v", err)
+	}
+
+	signatures, err = VerifyCosignSignatures(ctx, engineExt, signed.Digest, &key.PublicKey)
+	if err != nil {
+		t.Fatalf("unexpected error verifying signatures: %+v", err)
+	}
+	if len(signatures) != 1 || signatures[0].Valid || signatures[0].Error == "" {
+		t.Errorf("expected tampered signature to be invalid, got %+v", signatures)
+	}
+}
@@ -0,0 +1,95 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016-2020 SUSE LLC
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+
+load helpers
+
+function setup() {
+	setup_tmpdirs
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci [oci-archive]" {
+	ARCHIVE="$(setup_tmpdir)/image.tar"
+
+	# Create an archive from the test image.
+	sane_run tar cfC "$ARCHIVE" "$IMAGE" .
+	[ "$status" -eq 0 ]
+
+	# Unpack the image from the archive.
+	new_bundle_rootfs
+	umoci unpack --image "${ARCHIVE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+	[ -e "$ROOTFS/etc/passwd" ]
+
+	# Modify and repack into the archive.
+	echo "archive" > "$ROOTFS/archive-file"
+	umoci repack --image "${ARCHIVE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+
+	# The archive must still be a valid tar archive, containing a valid image.
+	[ -f "$ARCHIVE" ]
+	EXTRACTED="$(setup_tmpdir)/image"
+	mkdir -p "$EXTRACTED"
+	sane_run tar xfC "$ARCHIVE" "$EXTRACTED"
+	[ "$status" -eq 0 ]
+	image-verify "$EXTRACTED"
+
+	umoci ls --layout "$ARCHIVE"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"${TAG}-new"* ]]
+
+	# Unpack the new tag.
+	new_bundle_rootfs
+	umoci unpack --image "${ARCHIVE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+	[ -f "$ROOTFS/archive-file" ]
+
+	# Removing the tag and then running gc should shrink the archive.
+	umoci rm --image "${ARCHIVE}:${TAG}-new"
+	[ "$status" -eq 0 ]
+	sizeBefore="$(stat -c '%s' "$ARCHIVE")"
+	umoci gc --layout "$ARCHIVE"
+	[ "$status" -eq 0 ]
+	sizeAfter="$(stat -c '%s' "$ARCHIVE")"
+	[ "$sizeAfter" -lt "$sizeBefore" ]
+}
+
+@test "umoci init [oci-archive]" {
+	ARCHIVE="$(setup_tmpdir)/new-image.tar"
+
+	umoci init --layout "$ARCHIVE"
+	[ "$status" -eq 0 ]
+	[ -f "$ARCHIVE" ]
+
+	umoci new --image "${ARCHIVE}:latest"
+	[ "$status" -eq 0 ]
+
+	umoci ls --layout "$ARCHIVE"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "latest" ]]
+
+	# Creating an archive over an existing one must fail.
+	umoci init --layout "$ARCHIVE"
+	[ "$status" -ne 0 ]
+}
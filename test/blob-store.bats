@@ -0,0 +1,156 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016-2020 SUSE LLC
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+
+load helpers
+
+function setup() {
+	setup_tmpdirs
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+# move_layers_to_store moves all of the layer blobs of ${IMAGE}:${TAG} into a
+# new additional blob store, and outputs the path of the store.
+function move_layers_to_store() {
+	store="$(setup_tmpdir)/blobs"
+	mkdir -p "$store/sha256"
+
+	manifest="$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}"'") | .digest' "${IMAGE}/index.json" | cut -f2 -d:)"
+	for layer in $(jq -r '.layers[].digest' "${IMAGE}/blobs/sha256/$manifest" | cut -f2 -d:); do
+		mv "${IMAGE}/blobs/sha256/$layer" "$store/sha256/$layer"
+	done
+	echo "$store"
+}
+
+@test "umoci --additional-blob-store [unpack]" {
+	STORE="$(move_layers_to_store)"
+
+	# Without the store, the layers are missing.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -ne 0 ]
+	! [ -e "$ROOTFS" ]
+
+	new_bundle_rootfs
+	umoci --additional-blob-store="$STORE" unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+	[ -d "$ROOTFS" ]
+
+	# Non-existent stores are rejected.
+	new_bundle_rootfs
+	umoci --additional-blob-store="$STORE" --additional-blob-store="$UMOCI_TMPDIR/non-existent" unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -ne 0 ]
+	[[ "$output" == *"invalid --additional-blob-store"* ]]
+	! [ -e "$ROOTFS" ]
+
+	# The image is incomplete without the store, so we can't image-verify it.
+}
+
+@test "umoci --additional-blob-store [repack]" {
+	STORE="$(move_layers_to_store)"
+	storeBlobs="$(ls "$STORE/sha256" | sort)"
+
+	new_bundle_rootfs
+	umoci --additional-blob-store="$STORE" unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+
+	echo "new file" > "$ROOTFS/new-file"
+	umoci --additional-blob-store="$STORE" repack --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+
+	# The new layer lives in the image, and the store is left untouched by
+	# both repack and gc.
+	umoci --additional-blob-store="$STORE" gc --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[[ "$(ls "$STORE/sha256" | sort)" == "$storeBlobs" ]]
+
+	manifest="$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-new"'") | .digest' "${IMAGE}/index.json" | cut -f2 -d:)"
+	newLayer="$(jq -r '.layers[-1].digest' "${IMAGE}/blobs/sha256/$manifest" | cut -f2 -d:)"
+	[ -f "${IMAGE}/blobs/sha256/$newLayer" ]
+	! [ -e "$STORE/sha256/$newLayer" ]
+
+	new_bundle_rootfs
+	umoci --additional-blob-store="$STORE" unpack --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	[ -f "$ROOTFS/new-file" ]
+
+	# The image is incomplete without the store, so we can't image-verify it.
+}
+
+@test "umoci --additional-blob-store [copy]" {
+	STORE="$(move_layers_to_store)"
+
+	DEST_IMAGE="$(setup_tmpdir)/image"
+	umoci init --layout "$DEST_IMAGE"
+	[ "$status" -eq 0 ]
+
+	# The copy must include all of the blobs from the store.
+	umoci --additional-blob-store="$STORE" copy --image "${IMAGE}:${TAG}" --to "$DEST_IMAGE"
+	[ "$status" -eq 0 ]
+	for blob in "$STORE"/sha256/*; do
+		sane_run cmp "$blob" "$DEST_IMAGE/blobs/sha256/$(basename "$blob")"
+		[ "$status" -eq 0 ]
+	done
+
+	new_bundle_rootfs
+	umoci unpack --image "${DEST_IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	image-verify "${DEST_IMAGE}"
+}
+
+@test "umoci --additional-blob-store [fsck]" {
+	STORE="$(move_layers_to_store)"
+
+	# Without the store, the layers are missing.
+	umoci fsck --layout "${IMAGE}"
+	[ "$status" -ne 0 ]
+	[[ "$output" == *"missing blob"* ]]
+
+	# With the store, the layers are checked but are not missing (nor are they
+	# orphans, even though they are not referenced by anything in the store).
+	unused="$(echo "not a real blob" | sha256sum | cut -d' ' -f1)"
+	echo "not a real blob" >"$STORE/sha256/$unused"
+	umoci --additional-blob-store="$STORE" fsck --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[[ "$output" != *"missing blob"* ]]
+	[[ "$output" != *"$unused"* ]]
+	for blob in "$STORE"/sha256/*; do
+		[[ "$output" != *"orphan blob sha256:$(basename "$blob")"* ]]
+	done
+	[[ "$output" == *"shared blobs): no problems found"* ]]
+
+	# Corrupt shared blobs are reported, but are not removed by --fix.
+	rm "$STORE/sha256/$unused"
+	layer="$(ls "$STORE/sha256" | head -n1)"
+	chmod u+w "$STORE/sha256/$layer"
+	echo "corrupted" >>"$STORE/sha256/$layer"
+	umoci --additional-blob-store="$STORE" fsck --layout "${IMAGE}"
+	[ "$status" -ne 0 ]
+	[[ "$output" == *"corrupt blob"*"(in additional blob store)"* ]]
+	umoci --additional-blob-store="$STORE" fsck --layout "${IMAGE}" --fix
+	[ "$status" -ne 0 ]
+	[ -f "$STORE/sha256/$layer" ]
+
+	# The image is incomplete without the store, so we can't image-verify it.
+}
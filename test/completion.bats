@@ -0,0 +1,121 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016-2020 SUSE LLC
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_tmpdirs
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci completion" {
+	for shell in bash zsh fish; do
+		umoci completion "$shell"
+		[ "$status" -eq 0 ]
+		[[ "$output" == *"umoci"* ]]
+		[[ "$output" == *"__complete"* ]]
+	done
+
+	# The bash script must at least be valid.
+	umoci completion bash
+	[ "$status" -eq 0 ]
+	bash -n <<<"$output"
+
+	# Invalid arguments.
+	umoci completion
+	[ "$status" -ne 0 ]
+	umoci completion tcsh
+	[ "$status" -ne 0 ]
+	umoci completion bash zsh
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci completion [subcommands and flags]" {
+	umoci __complete "un"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "unpack" ]]
+
+	umoci __complete raw ""
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"unpack"* ]]
+	[[ "$output" == *"runtime-config"* ]]
+	[[ "$output" != *"repack"* ]]
+
+	umoci __complete unpack "--ima"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "--image" ]]
+
+	# Global flags (and their values).
+	umoci __complete "--log-f"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "--log-format" ]]
+
+	umoci __complete --log-format ""
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"text"* ]]
+	[[ "$output" == *"json"* ]]
+
+	umoci __complete "--log=i"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "--log=info" ]]
+
+	# Hidden flags and commands are not completed.
+	umoci __complete "--cpu"
+	[ "$status" -eq 0 ]
+	[ -z "$output" ]
+	umoci __complete "__"
+	[ "$status" -eq 0 ]
+	[ -z "$output" ]
+}
+
+@test "umoci completion [--image tags]" {
+	# Create some tags to complete.
+	umoci tag --image "${IMAGE}:${TAG}" "completion-a"
+	[ "$status" -eq 0 ]
+	umoci tag --image "${IMAGE}:${TAG}" "completion-b"
+	[ "$status" -eq 0 ]
+
+	umoci __complete unpack --image "${IMAGE}:completion-"
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq 2 ]
+	[[ "${lines[0]}" == "${IMAGE}:completion-a" ]]
+	[[ "${lines[1]}" == "${IMAGE}:completion-b" ]]
+
+	umoci __complete stat "--image=${IMAGE}:completion-b"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "--image=${IMAGE}:completion-b" ]]
+
+	# All tags are listed once the image path is known.
+	umoci __complete stat --image "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"${IMAGE}:${TAG}"* ]]
+	[[ "$output" == *"${IMAGE}:completion-a"* ]]
+
+	# Completion degrades gracefully if the image path isn't valid (yet).
+	umoci __complete stat --image "${UMOCI_TMPDIR}/does-not-exist:"
+	[ "$status" -eq 0 ]
+	[ -z "$output" ]
+	umoci __complete stat --image ""
+	[ "$status" -eq 0 ]
+	[ -z "$output" ]
+
+	image-verify "${IMAGE}"
+}
@@ -461,6 +461,33 @@ function teardown() {
 	image-verify "${IMAGE}"
 }
 
+@test "umoci config --clear=config.env --config.env" {
+	# Replace the entire environment in a single invocation.
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-new" \
+		--clear=config.env --config.env "PATH=/custom/bin" --config.env "VARIABLE1=replaced"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Unpack the image again.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Only our variables (and the defaults added by umoci-unpack for any
+	# missing variables) must be set -- nothing from the base image.
+	sane_run jq -SMr '.process.env[] | split("=")[0]' "$BUNDLE/config.json"
+	[ "$status" -eq 0 ]
+	[[ "$(sort <<<"$output" | tr '\n' ' ')" == "HOME PATH TERM VARIABLE1 " ]]
+
+	sane_run jq -SMr '.process.env[]' "$BUNDLE/config.json"
+	[ "$status" -eq 0 ]
+	[[ "${lines[*]}" == *"PATH=/custom/bin"* ]]
+	[[ "${lines[*]}" == *"VARIABLE1=replaced"* ]]
+
+	image-verify "${IMAGE}"
+}
+
 @test "umoci config --clear=config.{entrypoint or cmd}" {
 	# Modify the entrypoint+cmd.
 	umoci config --image "${IMAGE}:${TAG}" --config.entrypoint "sh" --config.entrypoint "/here is some values/" --config.cmd "-c" --config.cmd "ls -la" --config.cmd="kek"
@@ -569,6 +596,48 @@ function teardown() {
 	image-verify "${IMAGE}"
 }
 
+@test "umoci config --config.[entrypoint+cmd]-json" {
+	# Modify the entrypoint+cmd using JSON arrays.
+	umoci config --image "${IMAGE}:${TAG}" \
+		--config.entrypoint-json '["sh", "-c", "echo \"$1\" '"'"'quoted'"'"'"]' \
+		--config.cmd-json '["--", "arg with spaces", ""]'
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Unpack the image again.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Ensure that the final args are exactly entrypoint+cmd.
+	sane_run jq -SMc '.process.args' "$BUNDLE/config.json"
+	[ "$status" -eq 0 ]
+	[[ "$output" == '["sh","-c","echo \"$1\" '"'"'quoted'"'"'","--","arg with spaces",""]' ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci config --config.[entrypoint+cmd]-json [invalid arguments]" {
+	# Not JSON arrays of strings.
+	umoci config --image "${IMAGE}:${TAG}" --config.entrypoint-json 'sh'
+	[ "$status" -ne 0 ]
+	umoci config --image "${IMAGE}:${TAG}" --config.entrypoint-json '"sh"'
+	[ "$status" -ne 0 ]
+	umoci config --image "${IMAGE}:${TAG}" --config.cmd-json 'null'
+	[ "$status" -ne 0 ]
+	umoci config --image "${IMAGE}:${TAG}" --config.cmd-json '["ls", 1]'
+	[ "$status" -ne 0 ]
+
+	# Mixing the JSON and non-JSON flags.
+	umoci config --image "${IMAGE}:${TAG}" --config.entrypoint "sh" --config.entrypoint-json '["sh"]'
+	[ "$status" -ne 0 ]
+	umoci config --image "${IMAGE}:${TAG}" --config.cmd "ls" --config.cmd-json '["ls"]'
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
 # XXX: This test is somewhat dodgy (since we don't actually set anything other than the destination for a volume).
 @test "umoci config --config.volume" {
 	# Modify none of the configuration.
@@ -699,7 +768,140 @@ function teardown() {
 	image-verify "${IMAGE}"
 }
 
-# XXX: We don't do any testing of --author and that the config is changed properly.
+@test "umoci config --[os+architecture+variant]" {
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-arm64" \
+		--os "linux" --architecture "arm64" --variant "v8"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Unrelated modifications must not clear the variant.
+	umoci config --image "${IMAGE}:${TAG}-arm64" --config.label "foo=bar"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}-arm64" --json
+	[ "$status" -eq 0 ]
+	configDigest="$(jq -SMr '.config.digest' <<<"$output")"
+	sane_run jq -SMr '.os + "/" + .architecture + "/" + .variant' "${IMAGE}/blobs/${configDigest/://}"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "linux/arm64/v8" ]]
+
+	# The platform (including the variant) is used by umoci-index.
+	umoci index add --image "${IMAGE}:${TAG}-index" --manifest "${TAG}-arm64"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	index="$(jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-index"'") | .digest' "${IMAGE}/index.json")"
+	sane_run jq -SMr '.manifests[] | .platform.os + "/" + .platform.architecture + "/" + .platform.variant' "${IMAGE}/blobs/${index/://}"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "linux/arm64/v8" ]]
+
+	# Clearing the variant.
+	umoci config --image "${IMAGE}:${TAG}-arm64" --variant ""
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}-arm64" --json
+	[ "$status" -eq 0 ]
+	configDigest="$(jq -SMr '.config.digest' <<<"$output")"
+	sane_run jq -SMr 'has("variant")' "${IMAGE}/blobs/${configDigest/://}"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "false" ]]
+
+	# Unknown values are permitted, but produce a warning.
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-unknown" \
+		--os "linux" --architecture "arm64" --variant "v1000"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"unknown variant"* ]]
+	image-verify "${IMAGE}"
+}
+
+@test "umoci config [SOURCE_DATE_EPOCH]" {
+	# SOURCE_DATE_EPOCH is used for the history entry and config.
+	SOURCE_DATE_EPOCH=1234567890 umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-epoch" --author="Aleksa Sarai <asarai@suse.com>"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}-epoch" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr '.history[-1].created')" == "2009-02-13T23:31:30Z" ]]
+	config="$(echo "$output" | jq -SMr '.config.digest' | cut -d: -f2)"
+	[[ "$(jq -SMr '.created' "${IMAGE}/blobs/sha256/$config")" == "2009-02-13T23:31:30Z" ]]
+
+	# --created and --history.created take precedence.
+	SOURCE_DATE_EPOCH=1234567890 umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-explicit" \
+		--created="2016-03-25T12:34:02+11:00" --history.created="2016-12-09T04:45:40+11:00"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}-explicit" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr '.history[-1].created')" == "2016-12-09T04:45:40+11:00" ]]
+	config="$(echo "$output" | jq -SMr '.config.digest' | cut -d: -f2)"
+	[[ "$(jq -SMr '.created' "${IMAGE}/blobs/sha256/$config")" == "2016-03-25T12:34:02+11:00" ]]
+
+	# Running twice with the same SOURCE_DATE_EPOCH gives the same image.
+	SOURCE_DATE_EPOCH=1234567890 umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-epoch2" --author="Aleksa Sarai <asarai@suse.com>"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+	manifestA=$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-epoch"'") | .digest' "${IMAGE}/index.json")
+	manifestB=$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-epoch2"'") | .digest' "${IMAGE}/index.json")
+	[[ "$manifestA" == "$manifestB" ]]
+
+	# An invalid SOURCE_DATE_EPOCH is an error.
+	SOURCE_DATE_EPOCH="not a timestamp" umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-invalid" --author="Aleksa Sarai <asarai@suse.com>"
+	[ "$status" -ne 0 ]
+	image-verify "${IMAGE}"
+}
+
+@test "umoci config --author" {
+	# Set the author of the image.
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-author" --author="Aleksa Sarai <asarai@suse.com>"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The image configuration was changed.
+	umoci stat --image "${IMAGE}:${TAG}-author" --json
+	[ "$status" -eq 0 ]
+	configDigest="$(jq -SMr '.config.digest' <<<"$output")"
+	sane_run jq -SMr '.author' "${IMAGE}/blobs/${configDigest/://}"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "Aleksa Sarai <asarai@suse.com>" ]]
+
+	# The history entry uses the new author by default.
+	umoci stat --image "${IMAGE}:${TAG}-author" --json
+	[ "$status" -eq 0 ]
+	[[ "$(jq -SMr '.history[-1].author' <<<"$output")" == "Aleksa Sarai <asarai@suse.com>" ]]
+
+	# New layers added with umoci-repack(1) also use the new author by
+	# default, unless --history.author is specified.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}-author" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	echo "author" > "$ROOTFS/author"
+	umoci repack --image "${IMAGE}:${TAG}-author-repack" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	umoci stat --image "${IMAGE}:${TAG}-author-repack" --json
+	[ "$status" -eq 0 ]
+	[[ "$(jq -SMr '.history[-1].author' <<<"$output")" == "Aleksa Sarai <asarai@suse.com>" ]]
+
+	echo "author2" > "$ROOTFS/author"
+	umoci repack --image "${IMAGE}:${TAG}-author-repack2" --history.author="Not Aleksa <someone@else.com>" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	umoci stat --image "${IMAGE}:${TAG}-author-repack2" --json
+	[ "$status" -eq 0 ]
+	[[ "$(jq -SMr '.history[-1].author' <<<"$output")" == "Not Aleksa <someone@else.com>" ]]
+	# --history.author doesn't change the author of the image.
+	configDigest="$(jq -SMr '.config.digest' <<<"$output")"
+	sane_run jq -SMr '.author' "${IMAGE}/blobs/${configDigest/://}"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "Aleksa Sarai <asarai@suse.com>" ]]
+
+	image-verify "${IMAGE}"
+}
+
 @test "umoci config --history.*" {
 	# Modify something and set the history values.
 	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-new" \
@@ -736,6 +938,46 @@ function teardown() {
 	image-verify "${IMAGE}"
 }
 
+@test "umoci config [history created_by]" {
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	numHistory="$(jq -SMr '.history | length' <<<"$output")"
+	configDigest="$(jq -SMr '.config.digest' <<<"$output")"
+	sane_run jq -SMr '.rootfs.diff_ids[]' "${IMAGE}/blobs/${configDigest/://}"
+	[ "$status" -eq 0 ]
+	diffidsA="$output"
+
+	# By default, created_by describes the change.
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-new" \
+		--config.env "FOO=bar baz" --config.user 1000 --author "Aleksa Sarai <asarai@suse.com>"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}-new" --json
+	[ "$status" -eq 0 ]
+	[[ "$(jq -SMr '.history | length' <<<"$output")" -eq "$((numHistory + 1))" ]]
+	[[ "$(jq -SMr '.history[-1].empty_layer' <<<"$output")" == "true" ]]
+	[[ "$(jq -SMr '.history[-1].created_by' <<<"$output")" == "umoci config --config.user=1000 --config.env='FOO=bar baz' --author='Aleksa Sarai <asarai@suse.com>'" ]]
+
+	# The DiffIDs are unchanged by the empty_layer entry.
+	configDigest="$(jq -SMr '.config.digest' <<<"$output")"
+	sane_run jq -SMr '.rootfs.diff_ids[]' "${IMAGE}/blobs/${configDigest/://}"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$diffidsA" ]]
+
+	# It can be overridden with --history.created_by.
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-new" \
+		--config.env "FOO=bar" --history.created_by "ENV FOO=bar"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}-new" --json
+	[ "$status" -eq 0 ]
+	[[ "$(jq -SMr '.history[-1].created_by' <<<"$output")" == "ENV FOO=bar" ]]
+
+	image-verify "${IMAGE}"
+}
+
 @test "umoci config --no-history" {
 	# Modify something and don't add a history entry.
 	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-new" --no-history \
@@ -746,18 +988,59 @@ function teardown() {
 	# Make sure that the history was modified.
 	umoci stat --image "${IMAGE}:${TAG}" --json
 	[ "$status" -eq 0 ]
-	hashA="$(sha256sum <<<"$output")"
+	hashA="$(jq -SM '.history' <<<"$output" | sha256sum)"
 
 	umoci stat --image "${IMAGE}:${TAG}-new" --json
 	[ "$status" -eq 0 ]
-	hashB="$(sha256sum <<<"$output")"
+	hashB="$(jq -SM '.history' <<<"$output" | sha256sum)"
 
-	# umoci-stat output should be identical.
+	# umoci-stat history should be identical (the manifest is different).
 	[[ "$hashA" == "$hashB" ]]
 
 	image-verify "${IMAGE}"
 }
 
+@test "umoci config --clear-history" {
+	# Get the original layers and diffids.
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	configDigest="$(jq -SMr '.config.digest' <<<"$output")"
+	[[ "$(jq -SMr '.history | length' <<<"$output")" -gt 0 ]]
+	sane_run jq -SMr '.rootfs.diff_ids[]' "${IMAGE}/blobs/${configDigest/://}"
+	[ "$status" -eq 0 ]
+	diffidsA="$output"
+
+	# Clear the history.
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-new" --clear-history
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The history must be empty (not even an entry for this change).
+	umoci stat --image "${IMAGE}:${TAG}-new" --json
+	[ "$status" -eq 0 ]
+	configDigest="$(jq -SMr '.config.digest' <<<"$output")"
+	sane_run jq -SMr '.history | length' "${IMAGE}/blobs/${configDigest/://}"
+	[ "$status" -eq 0 ]
+	[[ "$output" == 0 ]]
+
+	# But the diffids must be untouched.
+	sane_run jq -SMr '.rootfs.diff_ids[]' "${IMAGE}/blobs/${configDigest/://}"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$diffidsA" ]]
+
+	# And the image must still be unpackable.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# --clear-history cannot be used with --history.* flags.
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-new" --clear-history --history.comment="foo"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
 @test "umoci config --config.label" {
 	# Modify none of the configuration.
 	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-new" \
@@ -783,6 +1066,74 @@ function teardown() {
 	image-verify "${IMAGE}"
 }
 
+@test "umoci config --config.remove-label" {
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-new" \
+		--clear=config.labels \
+		--config.label="com.cyphar.test=1" --config.label="com.cyphar.other=2"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Remove one of the labels, as well as a label which doesn't exist.
+	umoci config --image "${IMAGE}:${TAG}-new" \
+		--config.remove-label="com.cyphar.test" --config.remove-label="com.cyphar.nonexistent"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"com.cyphar.nonexistent"* ]]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}-new" --json
+	[ "$status" -eq 0 ]
+	configDigest="$(jq -SMr '.config.digest' <<<"$output")"
+	sane_run jq -SMr '.config.Labels | keys[]' "${IMAGE}/blobs/${configDigest/://}"
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq 1 ]
+	[[ "${lines[0]}" == "com.cyphar.other" ]]
+
+	# Removing and adding a label in one invocation replaces it.
+	umoci config --image "${IMAGE}:${TAG}-new" \
+		--config.remove-label="com.cyphar.other" --config.label="com.cyphar.other=3"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}-new" --json
+	[ "$status" -eq 0 ]
+	configDigest="$(jq -SMr '.config.digest' <<<"$output")"
+	sane_run jq -SMr '.config.Labels["com.cyphar.other"]' "${IMAGE}/blobs/${configDigest/://}"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "3" ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci config --config.remove-volume" {
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-new" \
+		--clear=config.volume \
+		--config.volume /volume --config.volume "/another volume"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci config --image "${IMAGE}:${TAG}-new" \
+		--config.remove-volume /volume --config.remove-volume /nonexistent
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"/nonexistent"* ]]
+	image-verify "${IMAGE}"
+
+	# Unpack the image again.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Get set of mounts
+	sane_run jq -SMr '.mounts[] | .destination' "$BUNDLE/config.json"
+	[ "$status" -eq 0 ]
+
+	# Check mounts.
+	! ( printf -- '%s\n' "${lines[@]}" | grep '^/volume$' )
+	printf -- '%s\n' "${lines[@]}" | grep '^/another volume$'
+
+	image-verify "${IMAGE}"
+}
+
 @test "umoci config --config.exposedports" {
 	# Modify none of the configuration.
 	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-new" \
@@ -826,3 +1177,32 @@ function teardown() {
 
 	image-verify "${IMAGE}"
 }
+
+@test "umoci config --config.stopsignal [canonical names]" {
+	for signal in "SIGTERM:SIGTERM" "term:SIGTERM" "Usr1:SIGUSR1" "15:15" "rtmin+3:SIGRTMIN+3" "SIGRTMAX-2:SIGRTMAX-2"; do
+		umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-new" \
+			--config.stopsignal="${signal%%:*}"
+		[ "$status" -eq 0 ]
+		image-verify "${IMAGE}"
+
+		umoci stat --image "${IMAGE}:${TAG}-new" --json
+		[ "$status" -eq 0 ]
+		configDigest="$(jq -SMr '.config.digest' <<<"$output")"
+
+		sane_run jq -SMr '.config.StopSignal' "${IMAGE}/blobs/${configDigest/://}"
+		[ "$status" -eq 0 ]
+		[[ "$output" == "${signal#*:}" ]]
+	done
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci config --config.stopsignal [invalid signals]" {
+	for signal in 0 65 -1 SIGFOO "SIG" "SIGTERM+1" "SIGRTMIN-1" "SIGRTMAX+1" "SIGRTMIN+31" "SIGRTMIN+foo"; do
+		umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-new" \
+			--config.stopsignal="$signal"
+		[ "$status" -ne 0 ]
+	done
+
+	image-verify "${IMAGE}"
+}
@@ -0,0 +1,111 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016-2020 SUSE LLC
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_tmpdirs
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci copy" {
+	DEST_IMAGE="$(setup_tmpdir)/image"
+	umoci init --layout "$DEST_IMAGE"
+	[ "$status" -eq 0 ]
+
+	# Copy the image.
+	umoci copy --image "${IMAGE}:${TAG}" --to "$DEST_IMAGE"
+	[ "$status" -eq 0 ]
+	image-verify "$DEST_IMAGE"
+
+	# The tag defaults to the source tag, and the image must be identical.
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	srcStat="$output"
+	umoci stat --image "${DEST_IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$srcStat" ]]
+
+	# All of the referenced blobs must be byte-for-byte identical.
+	for blob in "$DEST_IMAGE"/blobs/sha256/*; do
+		sane_run cmp "$blob" "$IMAGE/blobs/sha256/$(basename "$blob")"
+		[ "$status" -eq 0 ]
+	done
+
+	# Copying again with a new tag should re-use all of the blobs.
+	umoci --log=info copy --image "${IMAGE}:${TAG}" --to "${DEST_IMAGE}:new-tag"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"copied 0 blobs"* ]]
+	image-verify "$DEST_IMAGE"
+
+	umoci ls --layout "$DEST_IMAGE"
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq 2 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci copy [corrupted blob]" {
+	DEST_IMAGE="$(setup_tmpdir)/image"
+	umoci init --layout "$DEST_IMAGE"
+	[ "$status" -eq 0 ]
+
+	# Corrupt the first layer of the image.
+	manifest=$(cat "${IMAGE}/index.json" | jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"$TAG"'") | .digest' | cut -d: -f2)
+	layer=$(jq -r '.layers[0].digest' "${IMAGE}/blobs/sha256/$manifest" | cut -d: -f2)
+	chmod +w "${IMAGE}/blobs/sha256/$layer"
+	echo "corrupted" > "${IMAGE}/blobs/sha256/$layer"
+
+	umoci copy --image "${IMAGE}:${TAG}" --to "$DEST_IMAGE"
+	[ "$status" -ne 0 ]
+
+	# Neither the tag nor the corrupted blob should exist in the destination.
+	umoci ls --layout "$DEST_IMAGE"
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq 0 ]
+	! [ -e "$DEST_IMAGE/blobs/sha256/$layer" ]
+}
+
+@test "umoci copy [invalid arguments]" {
+	DEST_IMAGE="$(setup_tmpdir)/image"
+	umoci init --layout "$DEST_IMAGE"
+	[ "$status" -eq 0 ]
+
+	# Missing --to.
+	umoci copy --image "${IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+
+	# Invalid destination tag.
+	umoci copy --image "${IMAGE}:${TAG}" --to "${DEST_IMAGE}:${INVALID_TAG}"
+	[ "$status" -ne 0 ]
+
+	# Non-existent source tag.
+	umoci copy --image "${IMAGE}:does-not-exist" --to "$DEST_IMAGE"
+	[ "$status" -ne 0 ]
+
+	# Non-existent destination.
+	umoci copy --image "${IMAGE}:${TAG}" --to "${DEST_IMAGE}-nonexistent"
+	[ "$status" -ne 0 ]
+
+	# Extra positional arguments.
+	umoci copy --image "${IMAGE}:${TAG}" --to "$DEST_IMAGE" extra
+	[ "$status" -ne 0 ]
+}
@@ -195,6 +195,67 @@ function teardown() {
 	#image-verify "$IMAGE"
 }
 
+@test "umoci new --config" {
+	# We are making a new image.
+	IMAGE="$(setup_tmpdir)/image" TAG="latest"
+
+	# Create an empty layout.
+	umoci init --layout "$IMAGE"
+	[ "$status" -eq 0 ]
+	image-verify "$IMAGE"
+
+	# Create a new image from a base config.
+	CONFIG="$(setup_tmpdir)/config.json"
+	cat >"$CONFIG" <<EOF
+{
+	"created": "2020-01-01T00:00:00Z",
+	"author": "Base Config Author",
+	"architecture": "arm64",
+	"os": "linux",
+	"config": {
+		"User": "1234:1332",
+		"Env": ["PATH=/usr/bin", "BASE=1"],
+		"Labels": {"com.example.base": "true"}
+	},
+	"rootfs": {"type": "layers", "diff_ids": []}
+}
+EOF
+	umoci new --image "${IMAGE}:${TAG}" --config "$CONFIG"
+	[ "$status" -eq 0 ]
+
+	# The config must match the base config.
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	configDigest="$(jq -SMr '.config.digest' <<<"$output")"
+	configBlob="$IMAGE/blobs/${configDigest/://}"
+	[[ "$(jq -SMr '.author' "$configBlob")" == "Base Config Author" ]]
+	[[ "$(jq -SMr '.architecture' "$configBlob")" == "arm64" ]]
+	[[ "$(jq -SMr '.created' "$configBlob")" == "2020-01-01T00:00:00Z" ]]
+	[[ "$(jq -SMr '.config.User' "$configBlob")" == "1234:1332" ]]
+	[[ "$(jq -SMr '.config.Env | join(",")' "$configBlob")" == "PATH=/usr/bin,BASE=1" ]]
+	[[ "$(jq -SMr '.config.Labels["com.example.base"]' "$configBlob")" == "true" ]]
+
+	# Invalid configs are rejected.
+	echo '{"os": "linux", "rootfs": {"type": "layers", "diff_ids": []}}' >"$CONFIG"
+	umoci new --image "${IMAGE}:${TAG}-invalid" --config "$CONFIG"
+	[ "$status" -ne 0 ]
+	echo '{"architecture": "amd64", "os": "linux", "rootfs": {"type": "layers", "diff_ids": []}, "unknown": 1}' >"$CONFIG"
+	umoci new --image "${IMAGE}:${TAG}-invalid" --config "$CONFIG"
+	[ "$status" -ne 0 ]
+	echo '{"architecture": "amd64", "os": "linux", "rootfs": {"type": "layers", "diff_ids": ["sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"]}}' >"$CONFIG"
+	umoci new --image "${IMAGE}:${TAG}-invalid" --config "$CONFIG"
+	[ "$status" -ne 0 ]
+	umoci new --image "${IMAGE}:${TAG}-invalid" --config "$CONFIG-doesnotexist"
+	[ "$status" -ne 0 ]
+	umoci new --image "${IMAGE}:${TAG}-invalid" --config ""
+	[ "$status" -ne 0 ]
+
+	# None of the invalid images were created.
+	umoci list --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq 1 ]
+}
+
 # Given the bad experiences we've had with Go compiler changes resulting in
 # inconsistent archive output, this is a simple test to check whether a Go
 # compiler update will change our expected hashes seriously. We want to be as
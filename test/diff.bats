@@ -0,0 +1,141 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016-2020 SUSE LLC
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_tmpdirs
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci diff" {
+	# Unpack the image.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Create some files, which we will modify later.
+	echo "first file" > "$ROOTFS/newfile"
+	mkdir "$ROOTFS/newdir"
+	echo "subfile" > "$ROOTFS/newdir/anotherfile"
+	echo "to be removed" > "$ROOTFS/newdir/removed"
+
+	umoci repack --image "${IMAGE}:${TAG}-old" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Modify the files.
+	echo "changed file" > "$ROOTFS/newfile"
+	chmod 0700 "$ROOTFS/newdir/anotherfile"
+	rm "$ROOTFS/newdir/removed"
+	ln -s "anotherfile" "$ROOTFS/newdir/link"
+	# Timestamp changes are not reported.
+	touch -d "2001-02-03" "$ROOTFS/newdir/anotherfile"
+
+	umoci repack --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Check the human-readable output.
+	umoci diff --image "${IMAGE}:${TAG}-old" "${IMAGE}:${TAG}-new"
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq 4 ]
+	[[ "${lines[0]}" == "M /newdir/anotherfile (mode: 0644 -> 0700)" ]]
+	[[ "${lines[1]}" == "A /newdir/link" ]]
+	[[ "${lines[2]}" == "D /newdir/removed" ]]
+	[[ "${lines[3]}" == "M /newfile ("*"sha256digest: "* ]]
+
+	# Check the JSON output.
+	umoci diff --image "${IMAGE}:${TAG}-old" --json "${IMAGE}:${TAG}-new"
+	[ "$status" -eq 0 ]
+	diffFile="$(setup_tmpdir)/diff"
+	echo "$output" > "$diffFile"
+
+	sane_run jq -SMr '.[] | select(.path == "/newdir/link") | .type' "$diffFile"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "added" ]]
+
+	sane_run jq -SMr '.[] | select(.path == "/newdir/removed") | .type' "$diffFile"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "removed" ]]
+
+	sane_run jq -SMr '.[] | select(.path == "/newdir/anotherfile") | .keys[] | "\(.keyword) \(.old) \(.new)"' "$diffFile"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "mode 0644 0700" ]]
+
+	# The reverse diff swaps additions and removals.
+	umoci diff --image "${IMAGE}:${TAG}-new" "${IMAGE}:${TAG}-old"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"D /newdir/link"* ]]
+	[[ "$output" == *"A /newdir/removed"* ]]
+
+	# An image has no differences from itself.
+	umoci diff --image "${IMAGE}:${TAG}-new" "${IMAGE}:${TAG}-new"
+	[ "$status" -eq 0 ]
+	[ -z "$output" ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci diff [different images]" {
+	# Copy the image, and compare tags across the two images.
+	otherImage="$(setup_tmpdir)/image"
+	cp -r "${IMAGE}" "$otherImage"
+
+	new_bundle_rootfs
+	umoci unpack --image "${otherImage}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	echo "only in other image" > "$ROOTFS/otherfile"
+	umoci repack --image "${otherImage}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+
+	umoci diff --image "${IMAGE}:${TAG}" "${otherImage}:${TAG}"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "A /otherfile" ]]
+
+	image-verify "${IMAGE}"
+	image-verify "${otherImage}"
+}
+
+@test "umoci diff [invalid arguments]" {
+	# Missing the new image.
+	umoci diff --image "${IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+
+	# Too many arguments.
+	umoci diff --image "${IMAGE}:${TAG}" "${IMAGE}:${TAG}" "${IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+
+	# Invalid new image.
+	umoci diff --image "${IMAGE}:${TAG}" ":${TAG}"
+	[ "$status" -ne 0 ]
+	umoci diff --image "${IMAGE}:${TAG}" "${IMAGE}:${INVALID_TAG}"
+	[ "$status" -ne 0 ]
+
+	# Nonexistent tags.
+	umoci diff --image "${IMAGE}:${TAG}-doesnotexist" "${IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+	umoci diff --image "${IMAGE}:${TAG}" "${IMAGE}:${TAG}-doesnotexist"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
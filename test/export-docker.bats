@@ -0,0 +1,85 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016-2020 SUSE LLC
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_tmpdirs
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci export-docker" {
+	ARCHIVE="$UMOCI_TMPDIR/docker.tar"
+
+	umoci export-docker --image "${IMAGE}:${TAG}" --repo-tag "example/exported:latest" --repo-tag "example/exported:v1" "$ARCHIVE"
+	[ "$status" -eq 0 ]
+	[ -f "$ARCHIVE" ]
+
+	# Check the archive manifest.
+	sane_run tar xOf "$ARCHIVE" manifest.json
+	[ "$status" -eq 0 ]
+	manifest="$output"
+	[[ "$(echo "$manifest" | jq -r 'length')" == 1 ]]
+	[[ "$(echo "$manifest" | jq -r '.[0].RepoTags | join(",")')" == "example/exported:latest,example/exported:v1" ]]
+
+	# The configuration must be stored unmodified.
+	imageManifest=$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}"'") | .digest' "${IMAGE}/index.json" | cut -f2 -d:)
+	config="$(jq -r '.config.digest' "${IMAGE}/blobs/sha256/$imageManifest" | cut -f2 -d:)"
+	[[ "$(echo "$manifest" | jq -r '.[0].Config')" == "$config.json" ]]
+	[[ "$(tar xOf "$ARCHIVE" "$config.json" | sha256sum | cut -d' ' -f1)" == "$config" ]]
+
+	# Importing the archive must result in the same image.
+	umoci import-docker --image "${IMAGE}:reimported" "$ARCHIVE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:reimported" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci export-docker [default repo tag]" {
+	ARCHIVE="$UMOCI_TMPDIR/docker.tar"
+
+	# Without --repo-tag, the image is named after the image and tag.
+	umoci export-docker --image "${IMAGE}:${TAG}" "$ARCHIVE"
+	[ "$status" -eq 0 ]
+	sane_run tar xOf "$ARCHIVE" manifest.json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -r '.[0].RepoTags | join(",")')" == "$(basename "$IMAGE" | tr '[:upper:]' '[:lower:]'):${TAG}" ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci export-docker [stdout]" {
+	umoci export-docker --image "${IMAGE}:${TAG}" -
+	[ "$status" -eq 0 ]
+
+	# Missing tags must fail without creating an archive.
+	umoci export-docker --image "${IMAGE}:non-existent" "$UMOCI_TMPDIR/docker.tar"
+	[ "$status" -ne 0 ]
+	[ ! -e "$UMOCI_TMPDIR/docker.tar" ]
+
+	image-verify "${IMAGE}"
+}
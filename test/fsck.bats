@@ -0,0 +1,98 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016-2020 SUSE LLC
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_tmpdirs
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci fsck [missing arguments]" {
+	# Missing --layout argument.
+	umoci fsck
+	[ "$status" -ne 0 ]
+	image-verify "${IMAGE}"
+
+	# Empty layout path.
+	umoci fsck --layout ""
+	[ "$status" -ne 0 ]
+
+	# Layout path contains a ":".
+	umoci fsck --layout "${IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+
+	# Unknown flag argument.
+	umoci fsck --this-is-an-invalid-argument --layout "${IMAGE}"
+	[ "$status" -ne 0 ]
+
+	# Too many positional arguments.
+	umoci fsck --layout "${IMAGE}" this-is-an-invalid-argument
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci fsck" {
+	# The test image is intact.
+	umoci fsck --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"no problems found"* ]]
+	image-verify "${IMAGE}"
+
+	# Orphan blobs are problems, unless --allow-orphans is given.
+	echo "orphan blob" > "$UMOCI_TMPDIR/orphan"
+	orphan="$(sha256sum "$UMOCI_TMPDIR/orphan" | cut -d' ' -f1)"
+	cp "$UMOCI_TMPDIR/orphan" "$IMAGE/blobs/sha256/$orphan"
+	umoci fsck --layout "${IMAGE}"
+	[ "$status" -ne 0 ]
+	[[ "$output" == *"orphan blob sha256:$orphan"* ]]
+	[[ "$output" == *"1 problems found"* ]]
+	umoci fsck --layout "${IMAGE}" --allow-orphans
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"orphan blob sha256:$orphan"* ]]
+	[[ "$output" == *"no problems found (ignoring 1 orphan blobs)"* ]]
+	image-verify "${IMAGE}"
+
+	# Corrupt the config of the image.
+	manifest=$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}"'") | .digest' "${IMAGE}/index.json" | cut -f2 -d:)
+	config="$(jq -r '.config.digest' "${IMAGE}/blobs/sha256/$manifest" | cut -f2 -d:)"
+	chmod +w "$IMAGE/blobs/sha256/$config"
+	echo "bit rot" >> "$IMAGE/blobs/sha256/$config"
+
+	umoci fsck --layout "${IMAGE}" --allow-orphans
+	[ "$status" -ne 0 ]
+	[[ "$output" == *"corrupt blob sha256:$config"* ]]
+	[[ "$output" == *"orphan blob sha256:$orphan"* ]]
+
+	# --fix removes the corrupt and orphan blobs, but the image is still
+	# corrupted because the config is still referenced.
+	umoci fsck --layout "${IMAGE}" --fix
+	[ "$status" -ne 0 ]
+	[[ "$output" == *"missing blob sha256:$config"* ]]
+	! [ -e "$IMAGE/blobs/sha256/$config" ]
+	! [ -e "$IMAGE/blobs/sha256/$orphan" ]
+
+	# Removing the tag fixes the image.
+	umoci rm --image "${IMAGE}:${TAG}"
+	[ "$status" -eq 0 ]
+	umoci fsck --layout "${IMAGE}" --fix
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+}
@@ -142,6 +142,7 @@ function teardown() {
 	sane_run find "$IMAGE/blobs" -type f
 	[ "$status" -eq 0 ]
 	[ "${#lines[@]}" -ne 0 ]
+	nblobs="${#lines[@]}"
 
 	# Remove refs.
 	umoci ls --layout "${IMAGE}"
@@ -159,8 +160,57 @@ function teardown() {
 	umoci gc --layout "${IMAGE}"
 	[ "$status" -eq 0 ]
 	image-verify "${IMAGE}"
+	[[ "${lines[-1]}" == "removed $nblobs blobs, freed "* ]]
+
+	# Check how many blobs there were.
+	sane_run find "$IMAGE/blobs" -type f
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci gc --dry-run" {
+	# Initial gc.
+	umoci gc --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Remove refs.
+	umoci ls --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -gt 0 ]
+	image-verify "${IMAGE}"
+
+	for line in "${lines[@]}"; do
+		umoci rm --image "${IMAGE}:${line}"
+		[ "$status" -eq 0 ]
+		image-verify "${IMAGE}"
+	done
 
 	# Check how many blobs there were.
+	sane_run find "$IMAGE/blobs" -type f
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -ne 0 ]
+	nblobs="${#lines[@]}"
+	size="$(find "$IMAGE/blobs" -type f -printf '%s\n' | awk '{ s += $1 } END { print s }')"
+
+	# A dry-run should list every blob, without removing any of them.
+	umoci gc --dry-run --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq "$(($nblobs + 1))" ]
+	[[ "${lines[-1]}" == "would remove $nblobs blobs, freeing $size bytes "* ]]
+	image-verify "${IMAGE}"
+
+	sane_run find "$IMAGE/blobs" -type f
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq "$nblobs" ]
+
+	# A real gc should remove all of them.
+	umoci gc --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
 	sane_run find "$IMAGE/blobs" -type f
 	[ "$status" -eq 0 ]
 	[ "${#lines[@]}" -eq 0 ]
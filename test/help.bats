@@ -115,6 +115,42 @@ load helpers
 	[ "$status" -eq 0 ]
 	[[ "${lines[1]}" =~ "umoci raw runtime-config"+ ]]
 
+	umoci squash --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci squash"+ ]]
+
+	umoci import-docker --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci import-docker"+ ]]
+
+	umoci export-docker --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci export-docker"+ ]]
+
+	umoci pull --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci pull"+ ]]
+
+	umoci push --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci push"+ ]]
+
+	umoci completion --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci completion"+ ]]
+
+	umoci index --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci index"+ ]]
+
+	umoci index add --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci index add"+ ]]
+
+	umoci index rm --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci index remove"+ ]]
+
 	umoci remove --help
 	[ "$status" -eq 0 ]
 	[[ "${lines[1]}" =~ "umoci remove"+ ]]
@@ -131,6 +167,10 @@ load helpers
 	[ "$status" -eq 0 ]
 	[[ "${lines[1]}" =~ "umoci remove"+ ]]
 
+	umoci diff --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci diff"+ ]]
+
 	umoci stat --help
 	[ "$status" -eq 0 ]
 	[[ "${lines[1]}" =~ "umoci stat"+ ]]
@@ -139,6 +179,30 @@ load helpers
 	[ "$status" -eq 0 ]
 	[[ "${lines[1]}" =~ "umoci stat"+ ]]
 
+	umoci verify --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci verify"+ ]]
+
+	umoci verify -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci verify"+ ]]
+
+	umoci referrers --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci referrers"+ ]]
+
+	umoci referrers -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci referrers"+ ]]
+
+	umoci verify-config --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci verify-config"+ ]]
+
+	umoci verify-config -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci verify-config"+ ]]
+
 	umoci gc --help
 	[ "$status" -eq 0 ]
 	[[ "${lines[1]}" =~ "umoci gc"+ ]]
@@ -147,6 +211,14 @@ load helpers
 	[ "$status" -eq 0 ]
 	[[ "${lines[1]}" =~ "umoci gc"+ ]]
 
+	umoci fsck --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci fsck"+ ]]
+
+	umoci fsck -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci fsck"+ ]]
+
 	umoci init --help
 	[ "$status" -eq 0 ]
 	[[ "${lines[1]}" =~ "umoci init"+ ]]
@@ -155,6 +227,14 @@ load helpers
 	[ "$status" -eq 0 ]
 	[[ "${lines[1]}" =~ "umoci init"+ ]]
 
+	umoci migrate --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci migrate"+ ]]
+
+	umoci migrate -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci migrate"+ ]]
+
 	umoci list --help
 	[ "$status" -eq 0 ]
 	[[ "${lines[1]}" =~ "umoci list"+ ]]
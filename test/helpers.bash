@@ -91,6 +91,11 @@ function requires() {
 					skip "test requires ${var}"
 				fi
 				;;
+			rootless)
+				if [ "$IS_ROOTLESS" -eq 0 ]; then
+					skip "test requires ${var}"
+				fi
+				;;
 			*)
 				fail "BUG: Invalid requires ${var}."
 				;;
@@ -121,14 +126,20 @@ function umoci() {
 		args+=("-test.coverprofile=${coverprofile}" "__DEVEL--i-heard-you-like-tests")
 	fi
 
+	# Pass through any global arguments which go before the subcommand.
+	# TODO: This only handles global arguments of the form --opt=value (or
+	#       boolean flags). We should probably switch to getopt here.
+	while [[ "$#" -gt 1 && "$1" == -* ]]; do
+		args+=("$1")
+		shift 1
+	done
+
 	if [[ "$1" == "raw" ]]; then
 		args+=("$1")
 		shift 1
 	fi
 
 	# Set the first argument (the subcommand).
-	# TODO: This doesn't correctly handle any global arguments which go before
-	#       the subcommand. We should probably switch to getopt here.
 	args+=("$1")
 
 	# We're rootless if we're asked to unpack something.
@@ -0,0 +1,116 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016-2020 SUSE LLC
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_tmpdirs
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+# make_docker_archive <archive> creates a docker-archive containing two
+# single-layer images ("example/one:latest" and "example/two:latest").
+function make_docker_archive() {
+	local archive="$1"
+	ARCHIVEDIR="$(setup_tmpdir)"
+
+	for name in one two; do
+		LAYERDIR="$(setup_tmpdir)"
+		mkdir -p "$LAYERDIR/etc"
+		echo "$name" > "$LAYERDIR/etc/imported"
+
+		mkdir "$ARCHIVEDIR/$name"
+		sane_run tar cfC "$ARCHIVEDIR/$name/layer.tar" "$LAYERDIR" .
+		[ "$status" -eq 0 ]
+		diffid="sha256:$(sha256sum "$ARCHIVEDIR/$name/layer.tar" | cut -d' ' -f1)"
+
+		jq -n --arg diffid "$diffid" --arg name "$name" '{
+			"architecture": "amd64",
+			"os": "linux",
+			"docker_version": "19.03.8",
+			"config": {"Hostname": "0123456789ab", "Env": ["IMAGE=\($name)"]},
+			"rootfs": {"type": "layers", "diff_ids": [$diffid]},
+			"history": [{"created_by": "ADD \($name) /etc"}]
+		}' > "$ARCHIVEDIR/$name.json"
+	done
+
+	jq -n '[
+		{"Config": "one.json", "RepoTags": ["example/one:latest"], "Layers": ["one/layer.tar"]},
+		{"Config": "two.json", "RepoTags": ["example/two:latest"], "Layers": ["two/layer.tar"]}
+	]' > "$ARCHIVEDIR/manifest.json"
+
+	sane_run tar cfC "$archive" "$ARCHIVEDIR" .
+	[ "$status" -eq 0 ]
+}
+
+@test "umoci import-docker" {
+	ARCHIVE="$UMOCI_TMPDIR/docker.tar"
+	make_docker_archive "$ARCHIVE"
+
+	# The image must be specified for multi-image archives.
+	umoci import-docker --image "${IMAGE}:imported" "$ARCHIVE"
+	[ "$status" -ne 0 ]
+	umoci import-docker --image "${IMAGE}:imported" --repo-tag "example/missing:latest" "$ARCHIVE"
+	[ "$status" -ne 0 ]
+	umoci stat --image "${IMAGE}:imported" --json
+	[ "$status" -ne 0 ]
+
+	umoci import-docker --image "${IMAGE}:imported" --repo-tag "example/two:latest" "$ARCHIVE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Docker-specific fields must be dropped.
+	manifest=$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "imported") | .digest' "${IMAGE}/index.json" | cut -f2 -d:)
+	[[ "$(jq -r '.config.mediaType' "${IMAGE}/blobs/sha256/$manifest")" == "application/vnd.oci.image.config.v1+json" ]]
+	[[ "$(jq -r '.layers[0].mediaType' "${IMAGE}/blobs/sha256/$manifest")" == "application/vnd.oci.image.layer.v1.tar" ]]
+	config=$(jq -r '.config.digest' "${IMAGE}/blobs/sha256/$manifest" | cut -f2 -d:)
+	[[ "$(jq -r '.docker_version' "${IMAGE}/blobs/sha256/$config")" == "null" ]]
+	[[ "$(jq -r '.config.Hostname' "${IMAGE}/blobs/sha256/$config")" == "null" ]]
+
+	# The imported image must be usable.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:imported" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+	[[ "$(cat "$ROOTFS/etc/imported")" == "two" ]]
+	sane_run jq -SM '.process.env[]' "$BUNDLE/config.json"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"IMAGE=two"* ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci import-docker [invalid archive]" {
+	# A non-existent archive.
+	umoci import-docker --image "${IMAGE}:imported" "$UMOCI_TMPDIR/non-existent.tar"
+	[ "$status" -ne 0 ]
+
+	# An archive without a manifest.json.
+	sane_run tar cfC "$UMOCI_TMPDIR/empty.tar" "$(setup_tmpdir)" .
+	[ "$status" -eq 0 ]
+	umoci import-docker --image "${IMAGE}:imported" "$UMOCI_TMPDIR/empty.tar"
+	[ "$status" -ne 0 ]
+
+	umoci stat --image "${IMAGE}:imported" --json
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
@@ -0,0 +1,134 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016-2020 SUSE LLC
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_tmpdirs
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci index add" {
+	# Create two images which will be the per-platform images.
+	umoci new --image "${IMAGE}:build-amd64"
+	[ "$status" -eq 0 ]
+	umoci config --image "${IMAGE}:build-amd64" --config.label "platform=amd64"
+	[ "$status" -eq 0 ]
+	umoci new --image "${IMAGE}:build-arm64"
+	[ "$status" -eq 0 ]
+	umoci config --image "${IMAGE}:build-arm64" --config.label "platform=arm64"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Create the index (the platform of the first image comes from its config).
+	umoci index add --image "${IMAGE}:multi" --manifest build-amd64
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+	umoci index add --image "${IMAGE}:multi" --manifest build-arm64 --platform linux/arm64/v8
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Check the index contents.
+	index="$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "multi") | .digest' "${IMAGE}/index.json" | cut -d: -f2)"
+	sane_run jq -SMr '.manifests | length' "${IMAGE}/blobs/sha256/$index"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "2" ]]
+	sane_run jq -SMr '.manifests[] | .platform.os + "/" + .platform.architecture + "/" + .platform.variant' "${IMAGE}/blobs/sha256/$index"
+	[ "$status" -eq 0 ]
+	[[ "${lines[0]}" == "linux/amd64/" ]]
+	[[ "${lines[1]}" == "linux/arm64/v8" ]]
+
+	# Re-adding the same platform replaces the existing entry.
+	umoci index add --image "${IMAGE}:multi" --manifest build-amd64 --platform linux/arm64/v8
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+	index="$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "multi") | .digest' "${IMAGE}/index.json" | cut -d: -f2)"
+	sane_run jq -SMr '.manifests | length' "${IMAGE}/blobs/sha256/$index"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "2" ]]
+	umoci index add --image "${IMAGE}:multi" --manifest build-arm64 --platform linux/arm64/v8
+	[ "$status" -eq 0 ]
+
+	# The images can be selected with --platform.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:multi" --platform linux/arm64 "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+	sane_run jq -SMr '.annotations["platform"]' "$BUNDLE/config.json"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "arm64" ]]
+
+	# Manifests cannot be modified as though they were indexes.
+	umoci index add --image "${IMAGE}:build-amd64" --manifest build-arm64
+	[ "$status" -ne 0 ]
+
+	# Indexes cannot be added to indexes.
+	umoci index add --image "${IMAGE}:multi2" --manifest multi --platform linux/amd64
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci index new" {
+	umoci index new --image "${IMAGE}:empty"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	index="$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "empty") | .digest' "${IMAGE}/index.json" | cut -d: -f2)"
+	sane_run jq -SMr '.manifests | length' "${IMAGE}/blobs/sha256/$index"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "0" ]]
+
+	umoci index add --image "${IMAGE}:empty" --manifest "${TAG}" --platform linux/amd64 --tag nonempty
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The original index was not modified.
+	index2="$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "empty") | .digest' "${IMAGE}/index.json" | cut -d: -f2)"
+	[[ "$index" == "$index2" ]]
+}
+
+@test "umoci index remove" {
+	umoci index add --image "${IMAGE}:multi" --manifest "${TAG}" --platform linux/amd64
+	[ "$status" -eq 0 ]
+	umoci index add --image "${IMAGE}:multi" --manifest "${TAG}" --platform linux/arm64
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# --platform is mandatory.
+	umoci index remove --image "${IMAGE}:multi"
+	[ "$status" -ne 0 ]
+
+	umoci index remove --image "${IMAGE}:multi" --platform linux/amd64
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	index="$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "multi") | .digest' "${IMAGE}/index.json" | cut -d: -f2)"
+	sane_run jq -SMr '.manifests[] | .platform.os + "/" + .platform.architecture' "${IMAGE}/blobs/sha256/$index"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "linux/arm64" ]]
+
+	# Removing a platform that isn't in the index fails.
+	umoci index rm --image "${IMAGE}:multi" --platform linux/amd64
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
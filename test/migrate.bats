@@ -0,0 +1,106 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016-2020 SUSE LLC
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_tmpdirs
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci migrate [missing arguments]" {
+	# Missing --layout argument.
+	umoci migrate
+	[ "$status" -ne 0 ]
+
+	# Empty layout path.
+	umoci migrate --layout ""
+	[ "$status" -ne 0 ]
+
+	# Non-existent layout path.
+	umoci migrate --layout "$(setup_tmpdir)/nonexistent"
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci migrate [up-to-date]" {
+	sane_run find "$IMAGE" -type f -not -name '.umoci*' -exec sha256sum {} +
+	[ "$status" -eq 0 ]
+	before="$output"
+
+	umoci migrate --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Nothing should've been modified.
+	sane_run find "$IMAGE" -type f -not -name '.umoci*' -exec sha256sum {} +
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$before" ]]
+}
+
+@test "umoci migrate [refs layout]" {
+	# Convert the image to a pre-1.0 layout, with each tag stored as a
+	# descriptor in refs/ and no index.json or oci-layout.
+	mkdir "${IMAGE}/refs"
+	sane_run jq -c '.manifests | length' "${IMAGE}/index.json"
+	[ "$status" -eq 0 ]
+	[ "$output" -gt 0 ]
+	nrefs="$output"
+	for idx in $(seq 0 $((nrefs - 1))); do
+		name="$(jq -r ".manifests[$idx].annotations[\"org.opencontainers.image.ref.name\"]" "${IMAGE}/index.json")"
+		jq -c ".manifests[$idx] | del(.annotations)" "${IMAGE}/index.json" >"${IMAGE}/refs/${name}"
+	done
+	rm "${IMAGE}/index.json" "${IMAGE}/oci-layout"
+
+	# The image cannot be used without migrating it.
+	umoci ls --layout "${IMAGE}"
+	[ "$status" -ne 0 ]
+	[[ "$output" == *"umoci migrate"* ]]
+
+	umoci migrate --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The refs directory should be gone, and all of the tags present.
+	! [ -e "${IMAGE}/refs" ]
+	umoci ls --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq "$nrefs" ]
+	printf -- '%s\n' "${lines[@]}" | grep "^${TAG}$"
+
+	# The image should be usable.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+}
+
+@test "umoci migrate [unknown layout version]" {
+	echo '{"imageLayoutVersion": "9.9.9"}' >"${IMAGE}/oci-layout"
+
+	umoci ls --layout "${IMAGE}"
+	[ "$status" -ne 0 ]
+	[[ "$output" == *"9.9.9"* ]]
+
+	# We cannot migrate layouts we don't understand.
+	umoci migrate --layout "${IMAGE}"
+	[ "$status" -ne 0 ]
+	[[ "$(jq -r .imageLayoutVersion "${IMAGE}/oci-layout")" == "9.9.9" ]]
+}
@@ -71,6 +71,52 @@ function teardown() {
 	image-verify "${IMAGE}"
 }
 
+@test "umoci unpack --userns" {
+	# Mapping arbitrary IDs requires root (or newuidmap(1) and newgidmap(1)
+	# with /etc/subuid and /etc/subgid allocations).
+	requires root
+
+	# Unpack the image inside a user namespace.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" --userns --uid-map "0:1337:65535" --gid-map "0:8888:65535" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# We need to make sure the config exists.
+	[ -f "$BUNDLE/config.json" ]
+
+	# Check that all of the files have a UID owner >=1337 and a GID owner >=8888.
+	find "$ROOTFS" | xargs stat -c '%u:%g' | awk -F: '{
+		uid = $1;
+		if (uid < 1337 || uid >= 1337 + 65535)
+			exit 1;
+		gid = $2;
+		if (gid < 8888 || gid >= 8888 + 65535)
+			exit 1;
+	}'
+
+	# Any devices are placeholders (which are converted back into the original
+	# devices by repack), so repacking the bundle without any changes must not
+	# create a new layer.
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	numLayers="$(echo "$output" | jq -SM '[.history[] | select(.empty_layer != true)] | length')"
+	umoci repack --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	umoci stat --image "${IMAGE}:${TAG}-new" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SM '[.history[] | select(.empty_layer != true)] | length')" == "$numLayers" ]]
+
+	# --userns requires mappings, and cannot be used with --rootless.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" --userns "$BUNDLE"
+	[ "$status" -ne 0 ]
+	umoci unpack --image "${IMAGE}:${TAG}" --userns --rootless --uid-map "0:1337:65535" --gid-map "0:8888:65535" "$BUNDLE"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
 @test "umoci repack [--uid-map --gid-map]" {
 	# We do a bunch of remapping tricks, which we can't really do if we're not root.
 	requires root
@@ -118,6 +164,72 @@ function teardown() {
 	image-verify "${IMAGE}"
 }
 
+@test "umoci unpack [--on-unmapped]" {
+	# We need to be able to chown files.
+	requires root
+
+	# Create a file with an owner outside of the mappings we use below.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+	echo "unmapped" >"$ROOTFS/unmapped"
+	chown 70000:1000 "$ROOTFS/unmapped"
+	umoci repack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# By default, unmapped owners are an error.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" --uid-map "0:100000:65536" --gid-map "0:100000:65536" "$BUNDLE"
+	[ "$status" -ne 0 ]
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" --uid-map "0:100000:65536" --gid-map "0:100000:65536" --on-unmapped=error "$BUNDLE"
+	[ "$status" -ne 0 ]
+
+	# With skip, the unmapped uid is left as the current user.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" --uid-map "0:100000:65536" --gid-map "0:100000:65536" --on-unmapped=skip "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+	sane_run stat -c '%u:%g' "$ROOTFS/unmapped"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$(id -u):101000" ]]
+
+	# With nobody, the unmapped uid is mapped to the (mapped) nobody uid.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" --uid-map "0:100000:65536" --gid-map "0:100000:65536" --on-unmapped=nobody "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+	sane_run stat -c '%u:%g' "$ROOTFS/unmapped"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$((100000 + 65534)):101000" ]]
+
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" --uid-map "0:100000:65536" --gid-map "0:100000:65536" --on-unmapped=nobody --nobody-uid 1234 "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+	sane_run stat -c '%u:%g' "$ROOTFS/unmapped"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "101234:101000" ]]
+
+	# The nobody uid must be mapped.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" --uid-map "0:100000:65536" --gid-map "0:100000:65536" --on-unmapped=nobody --nobody-uid 70001 "$BUNDLE"
+	[ "$status" -ne 0 ]
+
+	# Invalid arguments.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" --on-unmapped=ignore "$BUNDLE"
+	[ "$status" -ne 0 ]
+	umoci unpack --image "${IMAGE}:${TAG}" --on-unmapped=nobody --nobody-uid 0 "$BUNDLE"
+	[ "$status" -ne 0 ]
+	umoci unpack --image "${IMAGE}:${TAG}" --on-unmapped=skip --nobody-gid 1234 "$BUNDLE"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
 @test "umoci {un,re}pack --rootless [user.rootlesscontainers]" {
 	# While we forcefully use --rootless, we also change the owner of files.
 	requires root
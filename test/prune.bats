@@ -0,0 +1,99 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016-2020 SUSE LLC
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_tmpdirs
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci prune [missing arguments]" {
+	# Missing --layout argument.
+	umoci prune --keep-latest 1
+	[ "$status" -ne 0 ]
+
+	# Missing --keep-latest argument.
+	umoci prune --layout "${IMAGE}"
+	[ "$status" -ne 0 ]
+
+	# Negative --keep-latest.
+	umoci prune --layout "${IMAGE}" --keep-latest -1
+	[ "$status" -ne 0 ]
+
+	# Invalid pattern.
+	umoci prune --layout "${IMAGE}" --keep-latest 1 --match "["
+	[ "$status" -ne 0 ]
+
+	# Too many positional arguments.
+	umoci prune --layout "${IMAGE}" --keep-latest 1 this-is-an-invalid-argument
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci prune" {
+	umoci ls --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	ntags="${#lines[@]}"
+
+	# Create a set of builds with different creation times (in a different
+	# order to the tag names).
+	for build in 1 3 2 4; do
+		umoci config --image "${IMAGE}:${TAG}" --tag "build-$build" --created "2020-01-0${build}T00:00:00Z"
+		[ "$status" -eq 0 ]
+	done
+	image-verify "${IMAGE}"
+
+	# A dry-run must not remove anything.
+	umoci prune --layout "${IMAGE}" --keep-latest 2 --match 'build-*' --dry-run
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"would remove 2 tags"* ]]
+	[ "${lines[0]}" = "build-2" ]
+	[ "${lines[1]}" = "build-1" ]
+
+	umoci ls --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq "$((ntags + 4))" ]
+
+	# Only the two newest builds (and the original tag) are kept.
+	umoci prune --layout "${IMAGE}" --keep-latest 2 --match 'build-*'
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci ls --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq "$((ntags + 2))" ]
+	[[ "$output" == *"${TAG}"* ]]
+	[[ "$output" == *"build-3"* ]]
+	[[ "$output" == *"build-4"* ]]
+
+	# Removing every remaining build.
+	umoci prune --layout "${IMAGE}" --keep-latest 0 --match 'build-*'
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"removed 2 tags"* ]]
+	image-verify "${IMAGE}"
+
+	umoci ls --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq "$ntags" ]
+	[[ "$output" == *"${TAG}"* ]]
+}
@@ -0,0 +1,82 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016-2020 SUSE LLC
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_tmpdirs
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci pull [invalid reference]" {
+	for ref in "" "docker://" "docker://UPPERCASE/image" "docker://image@sha256:invalid"; do
+		umoci pull --image "${IMAGE}:pulled" "$ref"
+		[ "$status" -ne 0 ]
+	done
+
+	umoci pull --image "${IMAGE}:pulled"
+	[ "$status" -ne 0 ]
+
+	umoci stat --image "${IMAGE}:pulled" --json
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci pull [unreachable registry]" {
+	# Nothing should be listening on this port, so the pull must fail cleanly
+	# without modifying the image.
+	umoci pull --plain-http --image "${IMAGE}:pulled" "docker://127.0.0.1:1/test/image:latest"
+	[ "$status" -ne 0 ]
+
+	umoci stat --image "${IMAGE}:pulled" --json
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci pull --max-concurrent-downloads [invalid]" {
+	for n in 0 -1 foo; do
+		umoci pull --max-concurrent-downloads "$n" --plain-http --image "${IMAGE}:pulled" "docker://127.0.0.1:1/test/image:latest"
+		[ "$status" -ne 0 ]
+	done
+
+	umoci stat --image "${IMAGE}:pulled" --json
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci pull --timeout --deadline [invalid]" {
+	for timeout in -1s foo 10; do
+		umoci pull --timeout="$timeout" --plain-http --image "${IMAGE}:pulled" "docker://127.0.0.1:1/test/image:latest"
+		[ "$status" -ne 0 ]
+	done
+	for deadline in -1s foo 10; do
+		umoci pull --deadline="$deadline" --plain-http --image "${IMAGE}:pulled" "docker://127.0.0.1:1/test/image:latest"
+		[ "$status" -ne 0 ]
+	done
+
+	umoci stat --image "${IMAGE}:pulled" --json
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
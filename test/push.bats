@@ -0,0 +1,55 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016-2020 SUSE LLC
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_tmpdirs
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci push [invalid arguments]" {
+	for ref in "" "docker://" "docker://UPPERCASE/image" "docker://image@sha256:invalid"; do
+		umoci push --image "${IMAGE}:${TAG}" "$ref"
+		[ "$status" -ne 0 ]
+	done
+
+	umoci push --image "${IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+
+	# Missing tags must fail before contacting the registry.
+	umoci push --plain-http --image "${IMAGE}:nonexistent" "docker://127.0.0.1:1/test/image:latest"
+	[ "$status" -ne 0 ]
+	[[ "$output" == *"tag not found"* ]]
+
+	umoci push --plain-http --creds ":password" --image "${IMAGE}:${TAG}" "docker://127.0.0.1:1/test/image:latest"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci push [unreachable registry]" {
+	# Nothing should be listening on this port, so the push must fail cleanly.
+	umoci push --plain-http --image "${IMAGE}:${TAG}" "docker://127.0.0.1:1/test/image:latest"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
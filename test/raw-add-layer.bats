@@ -164,3 +164,54 @@ function teardown() {
 	[ "$status" -ne 0 ]
 	image-verify "${IMAGE}"
 }
+
+@test "umoci raw add-layer --media-type" {
+	# Create a layer.
+	LAYER="$(setup_tmpdir)"
+	echo "layer" > "$LAYER/file"
+	sane_run tar cvfC "$UMOCI_TMPDIR/layer.tar" "$LAYER" .
+	[ "$status" -eq 0 ]
+
+	# Add the layer with each of the layer media types.
+	umoci new --image "${IMAGE}:${TAG}"
+	[ "$status" -eq 0 ]
+	for mediaType in tar tar+gzip tar+zstd; do
+		umoci raw add-layer --image "${IMAGE}:${TAG}" --tag "${TAG}-${mediaType/+/_}" --media-type "$mediaType" "$UMOCI_TMPDIR/layer.tar"
+		[ "$status" -eq 0 ]
+		image-verify "${IMAGE}"
+
+		umoci stat --image "${IMAGE}:${TAG}-${mediaType/+/_}" --json
+		[ "$status" -eq 0 ]
+		[[ "$(jq -SMr '.history[-1].layer.mediaType' <<<"$output")" == "application/vnd.oci.image.layer.v1.$mediaType" ]]
+
+		new_bundle_rootfs
+		umoci unpack --image "${IMAGE}:${TAG}-${mediaType/+/_}" "$BUNDLE"
+		[ "$status" -eq 0 ]
+		bundle-verify "$BUNDLE"
+		[[ "$(cat "$ROOTFS/file")" == "layer" ]]
+	done
+
+	# zstd:chunked layers are tar+zstd layers with extra annotations.
+	umoci raw add-layer --image "${IMAGE}:${TAG}" --tag "${TAG}-chunked" --media-type "tar+zstd:chunked" "$UMOCI_TMPDIR/layer.tar"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}-chunked" --json
+	[ "$status" -eq 0 ]
+	[[ "$(jq -SMr '.history[-1].layer.mediaType' <<<"$output")" == "application/vnd.oci.image.layer.v1.tar+zstd" ]]
+	[[ "$(jq -SMr '.history[-1].layer.annotations["io.github.containers.zstd-chunked.manifest-checksum"]' <<<"$output")" == "sha256:"* ]]
+
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}-chunked" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+	[[ "$(cat "$ROOTFS/file")" == "layer" ]]
+
+	# Unknown media types are rejected.
+	umoci raw add-layer --image "${IMAGE}:${TAG}" --tag "${TAG}-bad" --media-type "tar+bzip2" "$UMOCI_TMPDIR/layer.tar"
+	[ "$status" -ne 0 ]
+	umoci raw add-layer --image "${IMAGE}:${TAG}" --tag "${TAG}-bad" --media-type "application/vnd.oci.image.manifest.v1+json" "$UMOCI_TMPDIR/layer.tar"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
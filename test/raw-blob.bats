@@ -0,0 +1,77 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016-2020 SUSE LLC
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_tmpdirs
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci raw blob" {
+	manifest="$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"$TAG"'") | .digest' "$IMAGE/index.json")"
+
+	# The output must match the blob.
+	umoci raw blob --layout "${IMAGE}" "$manifest"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$(cat "$IMAGE/blobs/${manifest/://}")" ]]
+
+	# A decompressed layer must match the DiffID in the config.
+	config="$(jq -r '.config.digest' "$IMAGE/blobs/${manifest/://}")"
+	layer="$(jq -r '.layers[-1].digest' "$IMAGE/blobs/${manifest/://}")"
+	diffid="$(jq -r '.rootfs.diff_ids[-1]' "$IMAGE/blobs/${config/://}")"
+	sane_run bash -c "'${UMOCI}' raw blob --layout '${IMAGE}' --decompress '$layer' | sha256sum"
+	[ "$status" -eq 0 ]
+	[[ "sha256:${lines[0]%% *}" == "$diffid" ]]
+
+	# Non-layer blobs cannot be decompressed.
+	umoci raw blob --layout "${IMAGE}" --decompress "$manifest"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci raw blob [invalid]" {
+	# Missing and invalid digests.
+	umoci raw blob --layout "${IMAGE}"
+	[ "$status" -ne 0 ]
+	umoci raw blob --layout "${IMAGE}" "not-a-digest"
+	[ "$status" -ne 0 ]
+	umoci raw blob --layout "${IMAGE}" "sha256:$(printf '%064d' 0)"
+	[ "$status" -ne 0 ]
+
+	# Corrupted blobs must be detected.
+	manifest="$(jq -r '.manifests[0].digest' "$IMAGE/index.json")"
+	layer="$(jq -r '.layers[-1].digest' "$IMAGE/blobs/${manifest/://}")"
+	chmod +w "$IMAGE/blobs/${layer/://}"
+	echo "trailing garbage" >> "$IMAGE/blobs/${layer/://}"
+	umoci raw blob --layout "${IMAGE}" "$layer"
+	[ "$status" -ne 0 ]
+	[[ "$output" == *"digest mismatch"* ]]
+	umoci raw blob --layout "${IMAGE}" --decompress "$layer"
+	[ "$status" -ne 0 ]
+
+	chmod +w "$IMAGE/blobs/${manifest/://}"
+	echo "trailing garbage" >> "$IMAGE/blobs/${manifest/://}"
+	umoci raw blob --layout "${IMAGE}" "$manifest"
+	[ "$status" -ne 0 ]
+	[[ "$output" == *"digest mismatch"* ]]
+}
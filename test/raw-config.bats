@@ -264,6 +264,65 @@ function teardown() {
 	image-verify "${IMAGE}"
 }
 
+@test "umoci raw runtime-config --config.user 'user' --rootfs [additionalGids]" {
+	# Unpack the image.
+	new_bundle_rootfs && OLD_ROOTFS="$ROOTFS"
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Modify /etc/passwd and /etc/group. /etc/passwd is a symlink which must be
+	# resolved inside the rootfs.
+	cp "$ROOTFS/etc/passwd" "$ROOTFS/etc/passwd.real"
+	echo "testuser:x:1337:8888:test user:/home/test:/bin/sh" >> "$ROOTFS/etc/passwd.real"
+	rm -f "$ROOTFS/etc/passwd"
+	ln -s /etc/passwd.real "$ROOTFS/etc/passwd"
+	echo "testgroup:x:2581:root,testuser" >> "$ROOTFS/etc/group"
+	echo "group:x:9001:testuser" >> "$ROOTFS/etc/group"
+	echo "emptygroup:x:2222:" >> "$ROOTFS/etc/group"
+
+	# Modify the user.
+	umoci config --image "${IMAGE}:${TAG}" --config.user="testuser"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Generate config.json.
+	new_bundle_rootfs
+	umoci raw runtime-config --image "${IMAGE}:${TAG}" --rootfs "$OLD_ROOTFS" "$BUNDLE/config.json"
+	[ "$status" -eq 0 ]
+
+	sane_run jq -SM '.process.user.uid' "$BUNDLE/config.json"
+	[ "$status" -eq 0 ]
+	[ "$output" -eq 1337 ]
+	sane_run jq -SM '.process.user.gid' "$BUNDLE/config.json"
+	[ "$status" -eq 0 ]
+	[ "$output" -eq 8888 ]
+	sane_run jq -SMc '.process.user.additionalGids | sort' "$BUNDLE/config.json"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "[2581,9001]" ]]
+
+	# Unknown groups and users must give an error.
+	umoci config --image "${IMAGE}:${TAG}" --config.user="testuser:nonexistent"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	new_bundle_rootfs
+	umoci raw runtime-config --image "${IMAGE}:${TAG}" --rootfs "$OLD_ROOTFS" "$BUNDLE/config.json"
+	[ "$status" -ne 0 ]
+	[[ "$output" == *"unable to find group nonexistent"* ]]
+
+	umoci config --image "${IMAGE}:${TAG}" --config.user="nonexistent"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	new_bundle_rootfs
+	umoci raw runtime-config --image "${IMAGE}:${TAG}" --rootfs "$OLD_ROOTFS" "$BUNDLE/config.json"
+	[ "$status" -ne 0 ]
+	[[ "$output" == *"unable to find user nonexistent"* ]]
+
+	image-verify "${IMAGE}"
+}
+
 @test "umoci raw runtime-config --config.user 'user:group' [non-existent user]" {
 	# Modify the user.
 	umoci config --image "${IMAGE}:${TAG}" --config.user="testuser:emptygroup"
@@ -395,6 +454,41 @@ function teardown() {
 	image-verify "${IMAGE}"
 }
 
+@test "umoci raw runtime-config --config.env [ordering]" {
+	# Set the environment (in a non-sorted order).
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-new" --clear=config.env \
+		--config.env "ZZZ=last" \
+		--config.env "TERM=vt100" \
+		--config.env "AAA=first" \
+		--config.env "HOME=/custom home" \
+		--config.workingdir "/srv/app"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Unpack the image with a rootfs, so that HOME could be set by /etc/passwd.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# The image's environment comes first, in the order it was declared, and
+	# then the defaults which the image didn't set.
+	sane_run jq -SMr '.process.env[]' "$BUNDLE/config.json"
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq 5 ]
+	[[ "${lines[0]}" == "ZZZ=last" ]]
+	[[ "${lines[1]}" == "TERM=vt100" ]]
+	[[ "${lines[2]}" == "AAA=first" ]]
+	[[ "${lines[3]}" == "HOME=/custom home" ]]
+	[[ "${lines[4]}" == "PATH="* ]]
+
+	sane_run jq -SMr '.process.cwd' "$BUNDLE/config.json"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "/srv/app" ]]
+
+	image-verify "${IMAGE}"
+}
+
 @test "umoci raw runtime-config --clear=config.{entrypoint or cmd}" {
 	# Modify the entrypoint+cmd.
 	umoci config --image "${IMAGE}:${TAG}" --config.entrypoint "sh" --config.entrypoint "/here is some values/" --config.cmd "-c" --config.cmd "ls -la" --config.cmd="kek"
@@ -631,3 +725,112 @@ function teardown() {
 
 	image-verify "${IMAGE}"
 }
+
+@test "umoci raw runtime-config [hardening]" {
+	# Default masked and read-only paths.
+	new_bundle_rootfs
+	umoci raw runtime-config --image "${IMAGE}:${TAG}" "$BUNDLE/config.json"
+	[ "$status" -eq 0 ]
+
+	sane_run jq -SMr '.linux.maskedPaths[]' "$BUNDLE/config.json"
+	[ "$status" -eq 0 ]
+	printf -- '%s\n' "${lines[@]}" | grep -Fx -- "/proc/kcore"
+	printf -- '%s\n' "${lines[@]}" | grep -Fx -- "/sys/firmware"
+	sane_run jq -SMr '.linux.readonlyPaths[]' "$BUNDLE/config.json"
+	[ "$status" -eq 0 ]
+	printf -- '%s\n' "${lines[@]}" | grep -Fx -- "/proc/sys"
+	printf -- '%s\n' "${lines[@]}" | grep -Fx -- "/proc/sysrq-trigger"
+
+	# Additional paths.
+	new_bundle_rootfs
+	umoci raw runtime-config --image "${IMAGE}:${TAG}" \
+		--masked-path /proc/umoci-masked --readonly-path /proc/umoci-ro "$BUNDLE/config.json"
+	[ "$status" -eq 0 ]
+
+	sane_run jq -SMr '.linux.maskedPaths[]' "$BUNDLE/config.json"
+	[ "$status" -eq 0 ]
+	printf -- '%s\n' "${lines[@]}" | grep -Fx -- "/proc/kcore"
+	printf -- '%s\n' "${lines[@]}" | grep -Fx -- "/proc/umoci-masked"
+	sane_run jq -SMr '.linux.readonlyPaths[]' "$BUNDLE/config.json"
+	[ "$status" -eq 0 ]
+	printf -- '%s\n' "${lines[@]}" | grep -Fx -- "/proc/sys"
+	printf -- '%s\n' "${lines[@]}" | grep -Fx -- "/proc/umoci-ro"
+
+	# Bare configuration.
+	new_bundle_rootfs
+	umoci raw runtime-config --image "${IMAGE}:${TAG}" --no-hardening "$BUNDLE/config.json"
+	[ "$status" -eq 0 ]
+
+	sane_run jq -SMr '.linux.maskedPaths // [] | length' "$BUNDLE/config.json"
+	[ "$status" -eq 0 ]
+	[ "$output" -eq 0 ]
+	sane_run jq -SMr '.linux.readonlyPaths // [] | length' "$BUNDLE/config.json"
+	[ "$status" -eq 0 ]
+	[ "$output" -eq 0 ]
+
+	# Relative paths are rejected.
+	new_bundle_rootfs
+	umoci raw runtime-config --image "${IMAGE}:${TAG}" --masked-path proc/kcore "$BUNDLE/config.json"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci raw runtime-config [--default-capabilities and --seccomp]" {
+	# By default there are only the minimal capabilities and no seccomp.
+	new_bundle_rootfs
+	umoci raw runtime-config --image "${IMAGE}:${TAG}" "$BUNDLE/config.json"
+	[ "$status" -eq 0 ]
+
+	sane_run jq -SMr '.process.capabilities.bounding[]' "$BUNDLE/config.json"
+	[ "$status" -eq 0 ]
+	! printf -- '%s\n' "${lines[@]}" | grep -Fx -- "CAP_CHOWN"
+	sane_run jq -SMr '.linux.seccomp' "$BUNDLE/config.json"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "null" ]]
+
+	# Default capabilities and the minimal seccomp profile.
+	new_bundle_rootfs
+	umoci raw runtime-config --image "${IMAGE}:${TAG}" --default-capabilities --seccomp minimal "$BUNDLE/config.json"
+	[ "$status" -eq 0 ]
+
+	sane_run jq -SMr '.process.capabilities.bounding[]' "$BUNDLE/config.json"
+	[ "$status" -eq 0 ]
+	printf -- '%s\n' "${lines[@]}" | grep -Fx -- "CAP_CHOWN"
+	printf -- '%s\n' "${lines[@]}" | grep -Fx -- "CAP_KILL"
+	sane_run jq -SMr '.process.capabilities.ambient // [] | length' "$BUNDLE/config.json"
+	[ "$status" -eq 0 ]
+	[ "$output" -eq 0 ]
+	sane_run jq -SMr '.linux.seccomp.defaultAction' "$BUNDLE/config.json"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "SCMP_ACT_ALLOW" ]]
+	sane_run jq -SMr '.linux.seccomp.syscalls[].names[]' "$BUNDLE/config.json"
+	[ "$status" -eq 0 ]
+	printf -- '%s\n' "${lines[@]}" | grep -Fx -- "kexec_load"
+
+	# A custom seccomp profile.
+	cat >"$UMOCI_TMPDIR/seccomp.json" <<EOF
+{"defaultAction": "SCMP_ACT_ERRNO", "syscalls": [{"names": ["read", "write"], "action": "SCMP_ACT_ALLOW"}]}
+EOF
+	new_bundle_rootfs
+	umoci raw runtime-config --image "${IMAGE}:${TAG}" --seccomp "$UMOCI_TMPDIR/seccomp.json" "$BUNDLE/config.json"
+	[ "$status" -eq 0 ]
+
+	sane_run jq -SMr '.linux.seccomp.defaultAction' "$BUNDLE/config.json"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "SCMP_ACT_ERRNO" ]]
+	sane_run jq -SMr '.linux.seccomp.syscalls[].names[]' "$BUNDLE/config.json"
+	[ "$status" -eq 0 ]
+	[[ "${lines[*]}" == "read write" ]]
+
+	# Invalid profiles are rejected.
+	echo '{"syscalls": []}' >"$UMOCI_TMPDIR/seccomp-invalid.json"
+	new_bundle_rootfs
+	umoci raw runtime-config --image "${IMAGE}:${TAG}" --seccomp "$UMOCI_TMPDIR/seccomp-invalid.json" "$BUNDLE/config.json"
+	[ "$status" -ne 0 ]
+	new_bundle_rootfs
+	umoci raw runtime-config --image "${IMAGE}:${TAG}" --seccomp "$UMOCI_TMPDIR/does-not-exist.json" "$BUNDLE/config.json"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
@@ -0,0 +1,90 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016-2020 SUSE LLC
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_tmpdirs
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci raw remove-layer" {
+	# Create layer1 (a "secret").
+	LAYER="$(setup_tmpdir)"
+	echo "secret" > "$LAYER/secret"
+	sane_run tar cvfC "$UMOCI_TMPDIR/layer1.tar" "$LAYER" .
+	[ "$status" -eq 0 ]
+
+	# Create layer2, which removes the secret.
+	LAYER="$(setup_tmpdir)"
+	echo "layer2" > "$LAYER/file"
+	touch "$LAYER/.wh.secret"
+	sane_run tar cvfC "$UMOCI_TMPDIR/layer2.tar" "$LAYER" .
+	[ "$status" -eq 0 ]
+
+	umoci new --image "${IMAGE}:${TAG}"
+	[ "$status" -eq 0 ]
+	umoci raw add-layer --image "${IMAGE}:${TAG}" --history.comment "layer1" "$UMOCI_TMPDIR/layer1.tar"
+	[ "$status" -eq 0 ]
+	umoci config --image "${IMAGE}:${TAG}" --config.env "FOO=bar"
+	[ "$status" -eq 0 ]
+	umoci raw add-layer --image "${IMAGE}:${TAG}" --history.comment "layer2" "$UMOCI_TMPDIR/layer2.tar"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Invalid indices are rejected.
+	umoci raw remove-layer --image "${IMAGE}:${TAG}" 2
+	[ "$status" -ne 0 ]
+	umoci raw remove-layer --image "${IMAGE}:${TAG}" foo
+	[ "$status" -ne 0 ]
+	umoci raw remove-layer --image "${IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+	image-verify "${IMAGE}"
+
+	# Remove the secret layer. The whiteout in layer2 is now dangling.
+	umoci raw remove-layer --image "${IMAGE}:${TAG}" --tag "${TAG}-removed" 0
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"no longer refers to an existing path: /secret"* ]]
+	image-verify "${IMAGE}"
+
+	manifest=$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-removed"'") | .digest' "${IMAGE}/index.json" | cut -f2 -d:)
+	sane_run jq -SMr '.layers | length' "${IMAGE}/blobs/sha256/$manifest"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "1" ]]
+
+	# The history entry for the layer was removed, but the others are kept.
+	umoci stat --image "${IMAGE}:${TAG}-removed" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SM '[.history[] | select(.empty_layer | not)] | length')" == "1" ]]
+	[[ "$(echo "$output" | jq -SMr '[.history[] | select(.empty_layer | not)][0].comment')" == "layer2" ]]
+	[[ "$(echo "$output" | jq -SM '[.history[] | select(.empty_layer)] | length')" == "1" ]]
+
+	# The rest of the image is intact.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}-removed" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+	[ -f "$ROOTFS/file" ]
+	! [ -e "$ROOTFS/secret" ]
+	[[ "$(jq -SMr '.process.env[]' "$BUNDLE/config.json" | grep FOO)" == "FOO=bar" ]]
+
+	image-verify "${IMAGE}"
+}
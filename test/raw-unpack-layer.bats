@@ -0,0 +1,103 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016-2020 SUSE LLC
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_tmpdirs
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci raw unpack-layer" {
+	# Create layer1.
+	LAYER="$(setup_tmpdir)"
+	echo "layer1" > "$LAYER/file"
+	echo "layer1" > "$LAYER/deleted"
+	sane_run tar cvfC "$UMOCI_TMPDIR/layer1.tar" "$LAYER" .
+	[ "$status" -eq 0 ]
+
+	# Create layer2, which whiteouts a file from layer1.
+	LAYER="$(setup_tmpdir)"
+	echo "layer2" > "$LAYER/file2"
+	touch "$LAYER/.wh.deleted"
+	sane_run tar cvfC "$UMOCI_TMPDIR/layer2.tar" "$LAYER" .
+	[ "$status" -eq 0 ]
+
+	umoci new --image "${IMAGE}:${TAG}"
+	[ "$status" -eq 0 ]
+	umoci raw add-layer --image "${IMAGE}:${TAG}" "$UMOCI_TMPDIR/layer1.tar"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+	umoci raw add-layer --image "${IMAGE}:${TAG}" "$UMOCI_TMPDIR/layer2.tar"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Get the digest of the top layer.
+	manifest="$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"$TAG"'") | .digest | sub(":"; "/")' "$IMAGE/index.json")"
+	layer="$(jq -r '.layers[-1].digest' "$IMAGE/blobs/$manifest")"
+
+	# Unpack only the top layer.
+	DIR="$(setup_tmpdir)/layer"
+	umoci raw unpack-layer --layout "${IMAGE}" --digest "$layer" "$DIR"
+	[ "$status" -eq 0 ]
+
+	# Only the top layer's contents should be present, with the whiteout
+	# preserved as-is.
+	sane_run cat "$DIR/file2"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "layer2" ]]
+	[ -f "$DIR/.wh.deleted" ]
+	! [ -e "$DIR/file" ]
+	! [ -e "$DIR/deleted" ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci raw unpack-layer [invalid arguments]" {
+	DIR="$(setup_tmpdir)/layer"
+
+	# Missing --layout.
+	umoci raw unpack-layer --digest "sha256:$(printf '%064d' 0)" "$DIR"
+	[ "$status" -ne 0 ]
+
+	# Missing --digest.
+	umoci raw unpack-layer --layout "${IMAGE}" "$DIR"
+	[ "$status" -ne 0 ]
+
+	# Invalid --digest.
+	umoci raw unpack-layer --layout "${IMAGE}" --digest "not-a-digest" "$DIR"
+	[ "$status" -ne 0 ]
+
+	# Missing directory.
+	umoci raw unpack-layer --layout "${IMAGE}" --digest "sha256:$(printf '%064d' 0)"
+	[ "$status" -ne 0 ]
+
+	# Unknown digest.
+	umoci raw unpack-layer --layout "${IMAGE}" --digest "sha256:$(printf '%064d' 0)" "$DIR"
+	[ "$status" -ne 0 ]
+	! [ -e "$DIR" ]
+
+	# Non-layer blob.
+	manifest="$(jq -r '.manifests[0].digest' "$IMAGE/index.json")"
+	umoci raw unpack-layer --layout "${IMAGE}" --digest "$manifest" "$DIR"
+	[ "$status" -ne 0 ]
+	! [ -e "$DIR" ]
+}
@@ -0,0 +1,175 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016-2020 SUSE LLC
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+
+load helpers
+
+function setup() {
+	setup_tmpdirs
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+# add_referrer creates a copy of the manifest of ${IMAGE}:${TAG} with the
+# given descriptor as its subject (and the given value for an annotation, to
+# make each referrer unique), adds it to the top-level index without a tag and
+# outputs its digest.
+function add_referrer() {
+	subject="$1"
+	name="$2"
+
+	manifest="$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}"'") | .digest' "${IMAGE}/index.json" | cut -f2 -d:)"
+	jq -c --argjson subject "$subject" --arg name "$name" '.subject = $subject | .annotations["org.opencontainers.umoci.test"] = $name' "${IMAGE}/blobs/sha256/$manifest" > "$UMOCI_TMPDIR/manifest"
+	referrer="$(sha256sum "$UMOCI_TMPDIR/manifest" | cut -d' ' -f1)"
+	referrersize="$(stat -c %s "$UMOCI_TMPDIR/manifest")"
+	mv "$UMOCI_TMPDIR/manifest" "${IMAGE}/blobs/sha256/$referrer"
+
+	jq -c --arg digest "sha256:$referrer" --argjson size "$referrersize" '.manifests += [{"mediaType": "application/vnd.oci.image.manifest.v1+json", "digest": $digest, "size": $size}]' "${IMAGE}/index.json" > "$UMOCI_TMPDIR/index.json"
+	mv "$UMOCI_TMPDIR/index.json" "${IMAGE}/index.json"
+	echo "sha256:$referrer"
+}
+
+@test "umoci referrers [missing arguments]" {
+	# Missing --image argument.
+	umoci referrers
+	[ "$status" -ne 0 ]
+
+	# Too many positional arguments.
+	umoci referrers --image "${IMAGE}:${TAG}" this-is-an-invalid-argument
+	[ "$status" -ne 0 ]
+
+	# Non-existent tag.
+	umoci referrers --image "${IMAGE}:this-tag-does-not-exist"
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci referrers" {
+	# The test image has no referrers.
+	umoci referrers --image "${IMAGE}:${TAG}"
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq 0 ]
+
+	umoci referrers --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	[ "$(jq -r 'length' <<<"$output")" -eq 0 ]
+
+	subject="$(jq -c '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}"'") | {mediaType, digest, size}' "${IMAGE}/index.json")"
+	digest="$(jq -r '.digest' <<<"$subject")"
+	sbom="$(add_referrer "$subject" sbom)"
+	attestation="$(add_referrer "$subject" attestation)"
+	umoci fsck --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+
+	umoci referrers --image "${IMAGE}:${TAG}"
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq 2 ]
+	[[ "${lines[0]}" == "$sbom application/vnd.oci.image.manifest.v1+json" ]]
+	[[ "${lines[1]}" == "$attestation application/vnd.oci.image.manifest.v1+json" ]]
+
+	# The subject can also be given by digest.
+	umoci referrers --image "${IMAGE}@${digest}" --json
+	[ "$status" -eq 0 ]
+	[ "$(jq -r 'length' <<<"$output")" -eq 2 ]
+	[ "$(jq -r '.[0].digest' <<<"$output")" == "$sbom" ]
+	[ "$(jq -r '.[1].digest' <<<"$output")" == "$attestation" ]
+
+	# Referrers have no referrers of their own.
+	umoci referrers --image "${IMAGE}@${sbom}"
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq 0 ]
+
+	# Referrers are not tags.
+	umoci ls --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[[ "$output" != *"sha256:"* ]]
+
+	# Untagged referrers are kept by umoci-gc(1).
+	umoci gc --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[ -f "${IMAGE}/blobs/sha256/${sbom#sha256:}" ]
+	[ -f "${IMAGE}/blobs/sha256/${attestation#sha256:}" ]
+
+	# Modifying a referrer keeps its subject.
+	umoci config --image "${IMAGE}@${sbom}" --tag sbom --author "umoci"
+	[ "$status" -eq 0 ]
+	umoci referrers --image "${IMAGE}:${TAG}"
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq 3 ]
+	[[ "${lines[2]}" == *" sbom" ]]
+
+	# Modifying the subject changes its digest, so it no longer has any
+	# referrers.
+	umoci config --image "${IMAGE}:${TAG}" --author "umoci"
+	[ "$status" -eq 0 ]
+	umoci referrers --image "${IMAGE}:${TAG}"
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq 0 ]
+}
+
+@test "umoci referrers --attach" {
+	subject="$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}"'") | .digest' "${IMAGE}/index.json")"
+
+	# Create a separate image to attach.
+	umoci config --image "${IMAGE}:${TAG}" --tag sbom --author "umoci"
+	[ "$status" -eq 0 ]
+	sbom="$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "sbom") | .digest' "${IMAGE}/index.json")"
+
+	# --attach cannot be used with --json, and needs a valid tag.
+	umoci referrers --image "${IMAGE}:${TAG}" --attach sbom --json
+	[ "$status" -ne 0 ]
+	umoci referrers --image "${IMAGE}:${TAG}" --attach "invalid/tag"
+	[ "$status" -ne 0 ]
+	umoci referrers --image "${IMAGE}:${TAG}" --attach this-tag-does-not-exist
+	[ "$status" -ne 0 ]
+
+	umoci referrers --image "${IMAGE}:${TAG}" --attach sbom
+	[ "$status" -eq 0 ]
+	umoci fsck --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+
+	# The attached manifest is an untagged copy of the sbom image.
+	umoci referrers --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	[ "$(jq -r 'length' <<<"$output")" -eq 1 ]
+	referrer="$(jq -r '.[0].digest' <<<"$output")"
+	[[ "$referrer" != "$sbom" ]]
+	[ "$(jq -r '.[0].annotations["org.opencontainers.image.ref.name"] // ""' <<<"$output")" == "" ]
+	[ "$(jq -r '.subject.digest' "${IMAGE}/blobs/sha256/${referrer#sha256:}")" == "$subject" ]
+
+	# The sbom tag is unchanged.
+	[ "$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "sbom") | .digest' "${IMAGE}/index.json")" == "$sbom" ]
+
+	# Attaching again is a no-op.
+	umoci referrers --image "${IMAGE}:${TAG}" --attach sbom
+	[ "$status" -eq 0 ]
+	umoci referrers --image "${IMAGE}:${TAG}"
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq 1 ]
+
+	# Removing the sbom tag keeps the referrer.
+	umoci rm --image "${IMAGE}:sbom"
+	[ "$status" -eq 0 ]
+	umoci gc --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	umoci referrers --image "${IMAGE}:${TAG}"
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq 1 ]
+	[[ "${lines[0]}" == "$referrer application/vnd.oci.image.manifest.v1+json" ]]
+}
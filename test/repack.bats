@@ -238,6 +238,54 @@ function teardown() {
 	image-verify "${IMAGE}"
 }
 
+@test "umoci repack --from-overlay" {
+	# Creating overlayfs whiteouts requires mknod and trusted.* xattrs.
+	requires root
+
+	# Unpack the image.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Make sure the paths we're deleting exist.
+	[ -e "$ROOTFS/usr/bin/env" ]
+	[ -d "$ROOTFS/etc" ]
+	[ -e "$ROOTFS/etc/passwd" ]
+
+	# Replace them with overlayfs-style whiteouts (as though the rootfs was the
+	# upper directory of an overlayfs mount).
+	rm_rf "$ROOTFS/usr/bin/env"
+	mknod "$ROOTFS/usr/bin/env" c 0 0
+	rm_rf "$ROOTFS/etc"
+	mkdir "$ROOTFS/etc"
+	echo "new file" > "$ROOTFS/etc/new"
+	setfattr -n "trusted.overlay.opaque" -v "y" "$ROOTFS/etc"
+
+	# Repack the image, translating the whiteouts.
+	umoci repack --from-overlay --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Unpack it again.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# The whiteouts must have been applied.
+	! [ -e "$ROOTFS/usr/bin/env" ]
+	! [ -e "$ROOTFS/etc/passwd" ]
+	[ -f "$ROOTFS/etc/new" ]
+	[[ "$(cat "$ROOTFS/etc/new")" == "new file" ]]
+
+	# The overlayfs xattr must not be included in the layer.
+	sane_run getfattr -n "trusted.overlay.opaque" "$ROOTFS/etc"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
 @test "umoci repack [replace]" {
 	# Unpack the image.
 	new_bundle_rootfs && ROOTFS_A="$ROOTFS"
@@ -349,13 +397,13 @@ function teardown() {
 	# Make sure we *did not* add a new history entry.
 	umoci stat --image "${IMAGE}:${TAG}" --json
 	[ "$status" -eq 0 ]
-	hashA="$(sha256sum <<<"$output")"
+	hashA="$(jq -SM '.history' <<<"$output" | sha256sum)"
 
 	umoci stat --image "${IMAGE}:${TAG}-new" --json
 	[ "$status" -eq 0 ]
-	hashB="$(sha256sum <<<"$output")"
+	hashB="$(jq -SM '.history' <<<"$output" | sha256sum)"
 
-	# umoci-stat output should be identical.
+	# umoci-stat history should be identical (the manifest is different).
 	[[ "$hashA" == "$hashB" ]]
 
 	image-verify "${IMAGE}"
@@ -417,6 +465,36 @@ function teardown() {
 	image-verify "${IMAGE}"
 }
 
+@test "umoci {un,re}pack [fifo]" {
+	# Unpack the image.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Create a named pipe.
+	mkfifo -m 0640 "$ROOTFS/fifo"
+
+	# Repack the image.
+	umoci repack --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Unpack the image again.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# The fifo must have been recreated.
+	[ -p "$ROOTFS/fifo" ]
+	sane_run stat -c '%a' "$ROOTFS/fifo"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "640" ]]
+
+	image-verify "${IMAGE}"
+}
+
 @test "umoci {un,re}pack [unpriv]" {
 	# Unpack the image.
 	new_bundle_rootfs
@@ -607,6 +685,86 @@ function teardown() {
 	image-verify "${IMAGE}"
 }
 
+@test "umoci {un,re}pack [security.capability]" {
+	# Setting security.capability requires CAP_SETFCAP.
+	requires root
+
+	# Unpack the image.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Set cap_net_raw+ep (a v2 capability) on a new binary.
+	cap="0x0100000200200000000000000000000000000000"
+	echo "ping" > "$ROOTFS/ping"
+	chmod 0755 "$ROOTFS/ping"
+	setfattr -n "security.capability" -v "$cap" "$ROOTFS/ping"
+
+	# Repack the image.
+	umoci repack --image "${IMAGE}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Unpack the image again.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Make sure the capability survived.
+	sane_run _getfattr "security.capability" "$ROOTFS/ping"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$cap" ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci {un,re}pack --shadow-xattrs" {
+	# We need to be unprivileged to be unable to set trusted.* xattrs.
+	requires rootless
+
+	# Create a layer containing a trusted.* xattr.
+	echo "some data" > "$UMOCI_TMPDIR/shadowed"
+	tar -C "$UMOCI_TMPDIR" --format=pax --pax-option="SCHILY.xattr.trusted.umoci_test:=shadowed value" -cf "$UMOCI_TMPDIR/shadowed.tar" shadowed
+	umoci insert --image "${IMAGE}:${TAG}" --tar "$UMOCI_TMPDIR/shadowed.tar"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Unpack the image with --shadow-xattrs.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" --shadow-xattrs "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# The xattr must have been stored in a shadow xattr.
+	sane_run xattr -p "user.umoci.trusted.umoci_test" "$ROOTFS/shadowed"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "shadowed value" ]]
+
+	# Modify the file and repack the image.
+	echo "more data" >> "$ROOTFS/shadowed"
+	umoci repack --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The new layer must contain the original xattr, not the shadow xattr.
+	manifest=$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-new"'") | .digest' "${IMAGE}/index.json" | cut -f2 -d:)
+	layer="$(jq -r '.layers[-1].digest' "${IMAGE}/blobs/sha256/$manifest" | cut -f2 -d:)"
+	zcat "${IMAGE}/blobs/sha256/$layer" | grep -a "SCHILY.xattr.trusted.umoci_test=shadowed value"
+	! zcat "${IMAGE}/blobs/sha256/$layer" | grep -a "user.umoci."
+
+	# Without --shadow-xattrs, the xattr is dropped.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+	sane_run xattr -p "user.umoci.trusted.umoci_test" "$ROOTFS/shadowed"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
 @test "umoci {un,re}pack [unicode]" {
 	# Unpack the image.
 	new_bundle_rootfs
@@ -662,6 +820,42 @@ function teardown() {
 	image-verify "${IMAGE}"
 }
 
+@test "umoci {un,re}pack [nanosecond timestamps]" {
+	# Unpack the image.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Create some files with sub-second timestamps.
+	echo "nanosecond file" > "$ROOTFS/nsec-file"
+	touch -m -d "2001-02-03 04:05:06.123456789Z" "$ROOTFS/nsec-file"
+	echo "whole second file" > "$ROOTFS/sec-file"
+	touch -m -d "2001-02-03 04:05:06Z" "$ROOTFS/sec-file"
+	nsecMtime="$(stat -c '%y' "$ROOTFS/nsec-file")"
+	secMtime="$(stat -c '%y' "$ROOTFS/sec-file")"
+
+	# Skip the test if the filesystem doesn't support nanosecond timestamps.
+	[[ "$nsecMtime" == *".123456789 "* ]] || skip "filesystem doesn't support nanosecond timestamps"
+
+	# Repack the image.
+	umoci repack --image "${IMAGE}:${TAG}-nsec" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Unpack the image again.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}-nsec" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# The timestamps must match exactly.
+	[[ "$(stat -c '%y' "$ROOTFS/nsec-file")" == "$nsecMtime" ]]
+	[[ "$(stat -c '%y' "$ROOTFS/sec-file")" == "$secMtime" ]]
+
+	image-verify "${IMAGE}"
+}
+
 @test "umoci repack [volumes]" {
 	# Set some paths to be volumes.
 	umoci config --image "${IMAGE}:${TAG}" --config.volume /volume --config.volume "/some nutty/path name/ here"
@@ -876,3 +1070,631 @@ function teardown() {
 	layers1=$(cat "${IMAGE}/oci/blobs/sha256/$manifest1" | jq -r .layers)
 	[ "$layers0" == "$layers1" ]
 }
+
+@test "umoci repack --compression-level" {
+	# Unpack the original image
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Create a large compressible file.
+	yes "umoci compression test" | head -n 100000 > "$ROOTFS/compressible"
+
+	# Repack with no compression and the best compression.
+	umoci repack --image "${IMAGE}:${TAG}-level0" --compression-level 0 "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+	umoci repack --image "${IMAGE}:${TAG}-level9" --compression-level 9 "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Both layers should still be gzip layers, but the stored layer should be
+	# much larger than the compressed one.
+	manifest0=$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-level0"'") | .digest' "${IMAGE}/index.json" | cut -f2 -d:)
+	manifest9=$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-level9"'") | .digest' "${IMAGE}/index.json" | cut -f2 -d:)
+	manifest0="$(cat "${IMAGE}/blobs/sha256/$manifest0")"
+	manifest9="$(cat "${IMAGE}/blobs/sha256/$manifest9")"
+	[[ "$(echo "$manifest0" | jq -r '.layers[-1].mediaType')" == "application/vnd.oci.image.layer.v1.tar+gzip" ]]
+	[[ "$(echo "$manifest9" | jq -r '.layers[-1].mediaType')" == "application/vnd.oci.image.layer.v1.tar+gzip" ]]
+	size0="$(echo "$manifest0" | jq -r '.layers[-1].size')"
+	size9="$(echo "$manifest9" | jq -r '.layers[-1].size')"
+	[ "$size0" -gt "$size9" ]
+
+	# Make sure the stored layer can be extracted.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}-level0" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+	[ -f "$ROOTFS/compressible" ]
+
+	# Invalid compression levels must be rejected.
+	umoci repack --image "${IMAGE}:${TAG}-bad" --compression-level 10 "$BUNDLE"
+	[ "$status" -ne 0 ]
+	umoci repack --image "${IMAGE}:${TAG}-bad" --compression-level -2 "$BUNDLE"
+	[ "$status" -ne 0 ]
+	umoci stat --image "${IMAGE}:${TAG}-bad" --json
+	[ "$status" -ne 0 ]
+	image-verify "${IMAGE}"
+}
+
+@test "umoci repack --no-parallel-compression" {
+	# Unpack the original image
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Create a large file.
+	yes "umoci compression test" | head -n 500000 > "$ROOTFS/largefile"
+
+	# Repack the image serially and with a threshold.
+	umoci repack --image "${IMAGE}:${TAG}-serial" --no-parallel-compression "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+	umoci repack --image "${IMAGE}:${TAG}-threshold" --parallel-compression-threshold 1048576 "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Invalid thresholds must be rejected.
+	umoci repack --image "${IMAGE}:${TAG}-bad" --parallel-compression-threshold -1 "$BUNDLE"
+	[ "$status" -ne 0 ]
+	umoci stat --image "${IMAGE}:${TAG}-bad" --json
+	[ "$status" -ne 0 ]
+
+	# Make sure both images can be extracted.
+	for tag in "${TAG}-serial" "${TAG}-threshold"; do
+		new_bundle_rootfs
+		umoci unpack --image "${IMAGE}:$tag" "$BUNDLE"
+		[ "$status" -eq 0 ]
+		bundle-verify "$BUNDLE"
+		[ -f "$ROOTFS/largefile" ]
+	done
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci repack --media-type" {
+	# Unpack the original image
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Repack with each of the layer media types.
+	for mediaType in tar tar+gzip tar+zstd application/vnd.oci.image.layer.v1.tar+zstd; do
+		echo "$mediaType" > "$ROOTFS/file-${mediaType//[^a-z0-9]/_}"
+		umoci repack --image "${IMAGE}:${TAG}-${mediaType//[^a-z0-9]/_}" --media-type "$mediaType" "$BUNDLE"
+		[ "$status" -eq 0 ]
+		image-verify "${IMAGE}"
+
+		umoci stat --image "${IMAGE}:${TAG}-${mediaType//[^a-z0-9]/_}" --json
+		[ "$status" -eq 0 ]
+		[[ "$(jq -SMr '.history[-1].layer.mediaType' <<<"$output")" == *"application/vnd.oci.image.layer.v1.${mediaType##*.}" ]]
+	done
+
+	# The gzip options can be used with tar+gzip.
+	umoci repack --image "${IMAGE}:${TAG}-level9" --media-type tar+gzip --compression-level 9 --no-parallel-compression "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Conflicting or invalid options must be rejected.
+	umoci repack --image "${IMAGE}:${TAG}-bad" --media-type tar+gzip --compression-level 0 "$BUNDLE"
+	[ "$status" -ne 0 ]
+	umoci repack --image "${IMAGE}:${TAG}-bad" --media-type tar --compression-level 6 "$BUNDLE"
+	[ "$status" -ne 0 ]
+	umoci repack --image "${IMAGE}:${TAG}-bad" --media-type tar+zstd --no-parallel-compression "$BUNDLE"
+	[ "$status" -ne 0 ]
+	umoci repack --image "${IMAGE}:${TAG}-bad" --media-type tar+bzip2 "$BUNDLE"
+	[ "$status" -ne 0 ]
+	umoci stat --image "${IMAGE}:${TAG}-bad" --json
+	[ "$status" -ne 0 ]
+
+	# Make sure the images can be extracted.
+	for tag in "${TAG}-tar" "${TAG}-tar_gzip" "${TAG}-tar_zstd"; do
+		new_bundle_rootfs
+		umoci unpack --image "${IMAGE}:$tag" "$BUNDLE"
+		[ "$status" -eq 0 ]
+		bundle-verify "$BUNDLE"
+		[ -f "$ROOTFS/file-tar" ]
+	done
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci repack --reproducible" {
+	for suffix in a b; do
+		# Unpack the original image
+		new_bundle_rootfs
+		umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+		[ "$status" -eq 0 ]
+		bundle-verify "$BUNDLE"
+
+		# Create the same set of files, but at different times.
+		mkdir -p "$ROOTFS/reproducible/dir"
+		echo "some contents" > "$ROOTFS/reproducible/file"
+		echo "other contents" > "$ROOTFS/reproducible/dir/file"
+		ln -s ../file "$ROOTFS/reproducible/dir/link"
+		if [[ "$suffix" == "b" ]]; then
+			find "$ROOTFS/reproducible" -exec touch -h -d "2001-02-03 04:05:06.789" {} +
+		fi
+
+		umoci repack --image "${IMAGE}:${TAG}-$suffix" --reproducible "$BUNDLE"
+		[ "$status" -eq 0 ]
+		image-verify "${IMAGE}"
+	done
+
+	# The generated layers must be byte-for-byte identical.
+	manifestA=$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-a"'") | .digest' "${IMAGE}/index.json" | cut -f2 -d:)
+	manifestB=$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-b"'") | .digest' "${IMAGE}/index.json" | cut -f2 -d:)
+	layerA="$(jq -r '.layers[-1].digest' "${IMAGE}/blobs/sha256/$manifestA")"
+	layerB="$(jq -r '.layers[-1].digest' "${IMAGE}/blobs/sha256/$manifestB")"
+	[[ "$layerA" == "$layerB" ]]
+
+	# All of the entries must have their mtime set to the epoch.
+	layer="$(echo "$layerA" | cut -f2 -d:)"
+	TZ=UTC sane_run tar --full-time -tvzf "${IMAGE}/blobs/sha256/$layer"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"1970-01-01 00:00:00"* ]]
+	[[ "$output" != *"2001-02-03"* ]]
+
+	# The history entry must also be reproducible.
+	umoci stat --image "${IMAGE}:${TAG}-a" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -r '.history[-1].created')" == "1970-01-01T00:00:00Z" ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci repack --canonicalize" {
+	for suffix in a b; do
+		# Unpack the original image
+		new_bundle_rootfs
+		umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+		[ "$status" -eq 0 ]
+		bundle-verify "$BUNDLE"
+
+		# Create the same set of files, but at different times and (if we
+		# can) with different owners.
+		mkdir -p "$ROOTFS/canonical/dir"
+		echo "some contents" > "$ROOTFS/canonical/file"
+		echo "other contents" > "$ROOTFS/canonical/dir/file"
+		ln -s ../file "$ROOTFS/canonical/dir/link"
+		if [[ "$suffix" == "b" ]]; then
+			find "$ROOTFS/canonical" -exec touch -h -d "2001-02-03 04:05:06.789" {} +
+			if [ "$IS_ROOTLESS" -eq 0 ]; then
+				chown -hR 1000:1000 "$ROOTFS/canonical"
+			fi
+		fi
+
+		umoci repack --image "${IMAGE}:${TAG}-$suffix" --canonicalize "$BUNDLE"
+		[ "$status" -eq 0 ]
+		image-verify "${IMAGE}"
+	done
+
+	# The generated layers must be byte-for-byte identical.
+	manifestA=$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-a"'") | .digest' "${IMAGE}/index.json" | cut -f2 -d:)
+	manifestB=$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-b"'") | .digest' "${IMAGE}/index.json" | cut -f2 -d:)
+	layerA="$(jq -r '.layers[-1].digest' "${IMAGE}/blobs/sha256/$manifestA")"
+	layerB="$(jq -r '.layers[-1].digest' "${IMAGE}/blobs/sha256/$manifestB")"
+	[[ "$layerA" == "$layerB" ]]
+
+	# All of the entries must be owned by root with the epoch as their mtime.
+	layer="$(echo "$layerA" | cut -f2 -d:)"
+	TZ=UTC sane_run tar --numeric-owner --full-time -tvzf "${IMAGE}/blobs/sha256/$layer"
+	[ "$status" -eq 0 ]
+	[ "$(grep -c " 0/0 .* 1970-01-01 00:00:00 canonical/" <<<"$output")" -eq 5 ]
+	[[ "$output" != *"2001-02-03"* ]]
+	[[ "$output" != *"1000/1000"* ]]
+
+	# SOURCE_DATE_EPOCH is used as the mtime if it is set.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	echo "some contents" > "$ROOTFS/canonical-epoch"
+	SOURCE_DATE_EPOCH=1234567890 umoci repack --image "${IMAGE}:${TAG}-epoch" --canonicalize "$BUNDLE"
+	[ "$status" -eq 0 ]
+	manifest=$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-epoch"'") | .digest' "${IMAGE}/index.json" | cut -f2 -d:)
+	layer="$(jq -r '.layers[-1].digest' "${IMAGE}/blobs/sha256/$manifest" | cut -f2 -d:)"
+	TZ=UTC sane_run tar --numeric-owner --full-time -tvzf "${IMAGE}/blobs/sha256/$layer"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *" 0/0 "*" 2009-02-13 23:31:30 canonical-epoch"* ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci repack [SOURCE_DATE_EPOCH]" {
+	# Unpack the original image.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	echo "some contents" > "$ROOTFS/epoch-file"
+
+	# The history entry should use SOURCE_DATE_EPOCH.
+	SOURCE_DATE_EPOCH=1234567890 umoci repack --image "${IMAGE}:${TAG}-epoch" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}-epoch" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -r '.history[-1].created')" == "2009-02-13T23:31:30Z" ]]
+
+	# Even with --reproducible.
+	SOURCE_DATE_EPOCH=1234567890 umoci repack --image "${IMAGE}:${TAG}-epoch-reproducible" --reproducible "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}-epoch-reproducible" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -r '.history[-1].created')" == "2009-02-13T23:31:30Z" ]]
+
+	# But --history.created takes precedence.
+	SOURCE_DATE_EPOCH=1234567890 umoci repack --image "${IMAGE}:${TAG}-explicit" --history.created="2016-12-09T04:45:40+11:00" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}-explicit" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -r '.history[-1].created')" == "2016-12-09T04:45:40+11:00" ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci repack [mismatched mtree keywords]" {
+	# Unpack the original image with a custom set of keywords.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" --mtree-keywords=size,type,sha256digest --mtree-output=custom.mtree "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	echo "some contents" > "$ROOTFS/newfile"
+
+	# Change the keywords the manifest claims to have been generated with.
+	cp "$BUNDLE/custom.mtree" "$UMOCI_TMPDIR/custom.mtree"
+	sed -i -E 's/^(#\s+keywords:.*)$/\1,sha512digest/' "$BUNDLE/custom.mtree"
+	grep -E '^#\s+keywords:.*sha512digest' "$BUNDLE/custom.mtree"
+
+	# Repacking must fail, rather than silently ignoring the keyword mismatch.
+	umoci repack --image "${IMAGE}:${TAG}-mismatch" "$BUNDLE"
+	[ "$status" -ne 0 ]
+	[[ "$output" == *"keywords"* ]]
+	umoci stat --image "${IMAGE}:${TAG}-mismatch" --json
+	[ "$status" -ne 0 ]
+
+	# But the original manifest works.
+	mv "$UMOCI_TMPDIR/custom.mtree" "$BUNDLE/custom.mtree"
+
+	umoci repack --image "${IMAGE}:${TAG}-match" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+}
+
+@test "umoci repack --refresh-bundle [custom mtree]" {
+	# Unpack the original image with a custom manifest path.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" --mtree-output=custom.mtree "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	echo "some contents" > "$ROOTFS/newfile"
+
+	# The manifest is regenerated in place (even if a temporary manifest was
+	# left behind by an earlier failure).
+	echo "stale" > "$BUNDLE/custom.mtree.tmp"
+	umoci repack --refresh-bundle --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+	[ -f "$BUNDLE/custom.mtree" ]
+	[ ! -e "$BUNDLE/custom.mtree.tmp" ]
+	grep -E '^\s*newfile\s' "$BUNDLE/custom.mtree"
+
+	# Repacking again without changes doesn't create a new layer.
+	umoci stat --image "${IMAGE}:${TAG}-new" --json
+	[ "$status" -eq 0 ]
+	numLayers="$(echo "$output" | jq -SM '[.history[] | select(.empty_layer != true)] | length')"
+	umoci repack --image "${IMAGE}:${TAG}-new2" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	umoci stat --image "${IMAGE}:${TAG}-new2" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SM '[.history[] | select(.empty_layer != true)] | length')" == "$numLayers" ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci repack --ignore" {
+	# Unpack the original image.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Create some runtime-only files, as well as some files we want to keep.
+	mkdir -p "$ROOTFS/ignore/cache/sub" "$ROOTFS/ignore/logs"
+	echo "cached" > "$ROOTFS/ignore/cache/sub/file"
+	echo "log" > "$ROOTFS/ignore/logs/app.log"
+	echo "keep" > "$ROOTFS/ignore/logs/keep.log"
+	echo "data" > "$ROOTFS/ignore/data"
+	# Deleting an ignored path must not produce a whiteout.
+	rm -rf "$ROOTFS/etc"
+
+	umoci repack --image "${IMAGE}:${TAG}-ignore" \
+		--ignore "/ignore/cache/" \
+		--ignore "*.log" --ignore "!keep.log" \
+		--ignore "/etc" \
+		"$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	manifest=$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-ignore"'") | .digest' "${IMAGE}/index.json" | cut -f2 -d:)
+	layer="$(jq -r '.layers[-1].digest' "${IMAGE}/blobs/sha256/$manifest" | cut -f2 -d:)"
+	sane_run tar -tzf "${IMAGE}/blobs/sha256/$layer"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"ignore/data"* ]]
+	[[ "$output" == *"ignore/logs/keep.log"* ]]
+	[[ "$output" != *"ignore/cache"* ]]
+	[[ "$output" != *"app.log"* ]]
+	[[ "$output" != *"etc"* ]]
+
+	# Ignoring every change doesn't create a new layer.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Only modify the contents of an existing file, because creating (or
+	# removing) a path also modifies its parent directory.
+	echo "modified" >> "$ROOTFS/etc/passwd"
+
+	umoci repack --image "${IMAGE}:${TAG}-ignore-all" --ignore "/etc/passwd" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	numLayers="$(echo "$output" | jq -r '[.history[] | select(.empty_layer | not)] | length')"
+	umoci stat --image "${IMAGE}:${TAG}-ignore-all" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -r '[.history[] | select(.empty_layer | not)] | length')" == "$numLayers" ]]
+
+	# Invalid patterns are rejected.
+	umoci repack --image "${IMAGE}:${TAG}-ignore-bad" --ignore "foo[" "$BUNDLE"
+	[ "$status" -ne 0 ]
+	umoci stat --image "${IMAGE}:${TAG}-ignore-bad" --json
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci repack --dry-run" {
+	# Unpack the original image.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Make some changes.
+	echo "new file" > "$ROOTFS/newfile"
+	chmod 0600 "$ROOTFS/etc/passwd"
+	rm -rf "$ROOTFS/etc/shadow"
+	mkdir -p "$ROOTFS/ignore"
+	echo "ignored" > "$ROOTFS/ignore/file"
+
+	sane_run find "$IMAGE" -type f -exec sha256sum {} +
+	[ "$status" -eq 0 ]
+	imageBefore="$(echo "$output" | sort)"
+
+	umoci repack --image "${IMAGE}:${TAG}-dry-run" --dry-run --ignore "/ignore" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"A /newfile"* ]]
+	[[ "$output" == *"M /etc/passwd (mode: "*" -> 0600)"* ]]
+	[[ "$output" == *"D /etc/shadow"* ]]
+	[[ "$output" != *"/ignore"* ]]
+
+	# Nothing was written to the image.
+	sane_run find "$IMAGE" -type f -exec sha256sum {} +
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | sort)" == "$imageBefore" ]]
+	umoci stat --image "${IMAGE}:${TAG}-dry-run" --json
+	[ "$status" -ne 0 ]
+
+	# The bundle can still be repacked normally.
+	umoci repack --image "${IMAGE}:${TAG}-dry-run" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# --dry-run cannot be used with --refresh-bundle.
+	umoci repack --image "${IMAGE}:${TAG}-dry-run" --dry-run --refresh-bundle "$BUNDLE"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci repack --media-type=tar+zstd:chunked" {
+	# Unpack the original image
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	echo "chunked" > "$ROOTFS/chunked"
+	mkdir -p "$ROOTFS/chunked-dir"
+	ln -s ../chunked "$ROOTFS/chunked-dir/link"
+
+	umoci repack --image "${IMAGE}:${TAG}-chunked" --media-type tar+zstd:chunked "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The layer is a regular zstd layer with the zstd:chunked annotations.
+	manifest=$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-chunked"'") | .digest' "${IMAGE}/index.json" | cut -f2 -d:)
+	[[ "$(jq -r '.layers[-1].mediaType' "${IMAGE}/blobs/sha256/$manifest")" == "application/vnd.oci.image.layer.v1.tar+zstd" ]]
+	for annotation in manifest-checksum manifest-position tarsplit-position; do
+		[[ "$(jq -r '.layers[-1].annotations["io.github.containers.zstd-chunked.'"$annotation"'"]' "${IMAGE}/blobs/sha256/$manifest")" != "null" ]]
+	done
+
+	# The gzip options cannot be used with zstd:chunked layers.
+	umoci repack --image "${IMAGE}:${TAG}-bad" --media-type tar+zstd:chunked --compression-level 9 "$BUNDLE"
+	[ "$status" -ne 0 ]
+
+	# Make sure the image can be extracted.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}-chunked" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+	[[ "$(cat "$ROOTFS/chunked")" == "chunked" ]]
+	[[ "$(readlink "$ROOTFS/chunked-dir/link")" == "../chunked" ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci repack --append" {
+	# Unpack the original image.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	numLayers="$(echo "$output" | jq -r '[.history[] | select(.empty_layer | not)] | length')"
+	numHistory="$(echo "$output" | jq -r '.history | length')"
+
+	# Without --append, repacking without any changes doesn't add a layer.
+	umoci repack --image "${IMAGE}:${TAG}-noappend" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}-noappend" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -r '[.history[] | select(.empty_layer | not)] | length')" == "$numLayers" ]]
+	[[ "$(echo "$output" | jq -r '.history | length')" == "$((numHistory + 1))" ]]
+
+	# With --append, an empty layer is added.
+	umoci repack --image "${IMAGE}:${TAG}-append" --append --history.comment "marker" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}-append" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -r '[.history[] | select(.empty_layer | not)] | length')" == "$((numLayers + 1))" ]]
+	[[ "$(echo "$output" | jq -r '.history | length')" == "$((numHistory + 1))" ]]
+	[[ "$(echo "$output" | jq -r '.history[-1].comment')" == "marker" ]]
+
+	manifest=$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-append"'") | .digest' "${IMAGE}/index.json" | cut -f2 -d:)
+	layer="$(jq -r '.layers[-1].digest' "${IMAGE}/blobs/sha256/$manifest" | cut -f2 -d:)"
+	sane_run tar -tzf "${IMAGE}/blobs/sha256/$layer"
+	[ "$status" -eq 0 ]
+	[ -z "$output" ]
+
+	# Combined with --ignore, only the non-ignored changes are included.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	echo "marker" > "$ROOTFS/marker"
+	mkdir -p "$ROOTFS/ignore"
+	echo "ignored" > "$ROOTFS/ignore/file"
+
+	umoci repack --image "${IMAGE}:${TAG}-append-ignore" --append --ignore "*" --ignore "!/marker" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	manifest=$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-append-ignore"'") | .digest' "${IMAGE}/index.json" | cut -f2 -d:)
+	layer="$(jq -r '.layers[-1].digest' "${IMAGE}/blobs/sha256/$manifest" | cut -f2 -d:)"
+	sane_run tar -tzf "${IMAGE}/blobs/sha256/$layer"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"marker"* ]]
+	[[ "$output" != *"ignore"* ]]
+
+	# --append cannot be used with --dry-run.
+	umoci repack --image "${IMAGE}:${TAG}-append" --append --dry-run "$BUNDLE"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci repack [sealed bundle]" {
+	# Unpack the original image with a sealed bundle.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" --seal "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+	[ -f "$BUNDLE/umoci.seal" ]
+
+	echo "some contents" > "$ROOTFS/newfile"
+
+	# An untouched sealed bundle can be repacked (and is re-sealed).
+	umoci repack --refresh-bundle --image "${IMAGE}:${TAG}-sealed" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	echo "more contents" > "$ROOTFS/newfile2"
+	umoci repack --image "${IMAGE}:${TAG}-sealed2" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Tampering with the metadata must be detected.
+	cp "$BUNDLE/umoci.json" "$UMOCI_TMPDIR/umoci.json"
+	jq -c '.map_options.rootless = true' "$UMOCI_TMPDIR/umoci.json" > "$BUNDLE/umoci.json"
+
+	umoci repack --image "${IMAGE}:${TAG}-tampered" "$BUNDLE"
+	[ "$status" -ne 0 ]
+	[[ "$output" == *"does not match seal"* ]]
+	umoci stat --image "${IMAGE}:${TAG}-tampered" --json
+	[ "$status" -ne 0 ]
+
+	# ... unless --force is used.
+	umoci repack --force --image "${IMAGE}:${TAG}-tampered" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Restoring the metadata makes the seal valid again.
+	mv "$UMOCI_TMPDIR/umoci.json" "$BUNDLE/umoci.json"
+	umoci repack --image "${IMAGE}:${TAG}-restored" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+}
+
+@test "umoci repack [sealed bundle with key]" {
+	keyFile="$UMOCI_TMPDIR/seal.key"
+	head -c 32 /dev/urandom > "$keyFile"
+	otherKeyFile="$UMOCI_TMPDIR/other-seal.key"
+	head -c 32 /dev/urandom > "$otherKeyFile"
+
+	# Unpack the original image with a keyed seal.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" --seal-key "$keyFile" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+	sane_run jq -SMr '.algorithm' "$BUNDLE/umoci.seal"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "hmac-sha256" ]]
+
+	echo "some contents" > "$ROOTFS/newfile"
+
+	# The key is required, and must be the same key.
+	umoci repack --image "${IMAGE}:${TAG}-sealed" "$BUNDLE"
+	[ "$status" -ne 0 ]
+	umoci repack --seal-key "$otherKeyFile" --image "${IMAGE}:${TAG}-sealed" "$BUNDLE"
+	[ "$status" -ne 0 ]
+	umoci stat --image "${IMAGE}:${TAG}-sealed" --json
+	[ "$status" -ne 0 ]
+
+	umoci repack --seal-key "$keyFile" --refresh-bundle --image "${IMAGE}:${TAG}-sealed" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Removing (or replacing) the seal doesn't work if a key is provided.
+	rm "$BUNDLE/umoci.seal"
+	umoci repack --seal-key "$keyFile" --image "${IMAGE}:${TAG}-unsealed" "$BUNDLE"
+	[ "$status" -ne 0 ]
+
+	# Sealing cannot be used without metadata.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" --no-mtree --seal "$BUNDLE"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
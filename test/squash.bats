@@ -0,0 +1,99 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016-2020 SUSE LLC
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_tmpdirs
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci squash" {
+	# Add some layers with whiteouts.
+	INSERTDIR="$(setup_tmpdir)"
+	mkdir -p "${INSERTDIR}/test/dir"
+	echo "a" > "${INSERTDIR}/test/a"
+	echo "b" > "${INSERTDIR}/test/dir/b"
+	ln "${INSERTDIR}/test/a" "${INSERTDIR}/test/a-link"
+
+	umoci insert --image "${IMAGE}:${TAG}" "${INSERTDIR}/test" /squash
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+	umoci insert --image "${IMAGE}:${TAG}" --whiteout /squash/dir
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+	umoci insert --image "${IMAGE}:${TAG}" --whiteout /etc/passwd
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+	umoci config --image "${IMAGE}:${TAG}" --config.env "SQUASH=1"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Unpack the original image.
+	BUNDLE_A="$(setup_tmpdir)"
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+
+	# Squash the image.
+	umoci squash --image "${IMAGE}:${TAG}" --tag "${TAG}-squashed" --history.comment "squashed"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# There should only be a single layer and history entry.
+	manifest=$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-squashed"'") | .digest' "${IMAGE}/index.json" | cut -f2 -d:)
+	sane_run jq -SMr '.layers | length' "${IMAGE}/blobs/sha256/$manifest"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "1" ]]
+
+	umoci stat --image "${IMAGE}:${TAG}-squashed" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SM '.history | length')" == "1" ]]
+	[[ "$(echo "$output" | jq -SMr '.history[0].comment')" == "squashed" ]]
+	[[ "$(echo "$output" | jq -SM '.history[0].empty_layer')" == "false" ]]
+
+	# Unpack the squashed image.
+	BUNDLE_B="$(setup_tmpdir)"
+	umoci unpack --image "${IMAGE}:${TAG}-squashed" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+
+	# The configuration and filesystem should be identical.
+	[[ "$(jq -SMr '.process.env[]' "$BUNDLE_B/config.json" | grep SQUASH)" == "SQUASH=1" ]]
+	[ -f "$BUNDLE_B/rootfs/squash/a" ]
+	! [ -e "$BUNDLE_B/rootfs/squash/dir" ]
+	! [ -e "$BUNDLE_B/rootfs/etc/passwd" ]
+	[[ "$(stat -c '%i' "$BUNDLE_B/rootfs/squash/a")" == "$(stat -c '%i' "$BUNDLE_B/rootfs/squash/a-link")" ]]
+	sane_run diff -u \
+		<(cd "$BUNDLE_A/rootfs" && find . -printf '%p %M %U:%G %s %l %n\n' | sort) \
+		<(cd "$BUNDLE_B/rootfs" && find . -printf '%p %M %U:%G %s %l %n\n' | sort)
+	[ "$status" -eq 0 ]
+
+	# Squash without history.
+	umoci squash --image "${IMAGE}:${TAG}" --tag "${TAG}-nohistory" --no-history
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+	umoci stat --image "${IMAGE}:${TAG}-nohistory" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SM '.history | length')" == "0" ]]
+
+	image-verify "${IMAGE}"
+}
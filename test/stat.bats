@@ -40,13 +40,76 @@ function teardown() {
 	[ "$output" -ge 1 ]
 
 	# There should be at least one non-empty_layer.
-	sane_run jq -SMr '[.history[] | .empty_layer == null] | any' "$statFile"
+	sane_run jq -SMr '[.history[] | .empty_layer == false] | any' "$statFile"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "true" ]]
+
+	# Every history entry must have all of the documented fields.
+	sane_run jq -SMr '[.history[] | [has("layer"), has("diff_id"), has("cumulative_size"), has("uncompressed_size"), has("created"), has("created_by"), has("author"), has("comment"), has("empty_layer")] | all] | all' "$statFile"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "true" ]]
+
+	# Check the versioned top-level fields.
+	sane_run jq -SMr '.schema_version' "$statFile"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "1" ]]
+
+	sane_run jq -SMr '.manifest.mediaType' "$statFile"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "application/vnd.oci.image.manifest.v1+json" ]]
+
+	sane_run jq -SMr '.config.mediaType' "$statFile"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "application/vnd.oci.image.config.v1+json" ]]
+
+	# The total size must include every layer.
+	sane_run jq -SMr '.size >= ([.history[] | .layer.size // 0] | add) + .manifest.size + .config.size' "$statFile"
 	[ "$status" -eq 0 ]
 	[[ "$output" == "true" ]]
 
 	image-verify "${IMAGE}"
 }
 
+@test "umoci stat --uncompressed" {
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	statFile="$(setup_tmpdir)/stat"
+	echo "$output" > "$statFile"
+
+	# The cumulative size of the last entry is the total size of the layers.
+	sane_run jq -SMr '(.history[-1].cumulative_size) == ([.history[] | .layer.size // 0] | add)' "$statFile"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "true" ]]
+
+	umoci stat --image "${IMAGE}:${TAG}" --json --uncompressed
+	[ "$status" -eq 0 ]
+	echo "$output" > "$statFile"
+
+	# Every non-empty layer must have an uncompressed size, which must match
+	# the size of the decompressed blob.
+	sane_run jq -SMr '[.history[] | select(.empty_layer == false) | .uncompressed_size != null] | all' "$statFile"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "true" ]]
+
+	layer="$(jq -SMr '[.history[] | select(.empty_layer == false)][0].layer.digest' "$statFile" | cut -d: -f2)"
+	expected="$(jq -SMr '[.history[] | select(.empty_layer == false)][0].uncompressed_size' "$statFile")"
+	sane_run sh -c "gzip -dc '${IMAGE}/blobs/sha256/$layer' | wc -c"
+	[ "$status" -eq 0 ]
+	[ "$output" -eq "$expected" ]
+
+	# The human-readable output only has the extra column if requested.
+	umoci stat --image "${IMAGE}:${TAG}"
+	[ "$status" -eq 0 ]
+	[[ "${lines[0]}" != *"UNCOMPRESSED"* ]]
+	[[ "${lines[0]}" == *"TOTAL"* ]]
+
+	umoci stat --image "${IMAGE}:${TAG}" --uncompressed
+	[ "$status" -eq 0 ]
+	[[ "${lines[0]}" == *"UNCOMPRESSED"* ]]
+
+	image-verify "${IMAGE}"
+}
+
 # We can't really test the output for non-JSON output, but we can smoke test it.
 @test "umoci stat [smoke]" {
 	# Make sure that stat looks about right.
@@ -112,3 +175,68 @@ function teardown() {
 
 # TODO: Add a test to make sure that empty_layer and layer are mutually
 #	   exclusive. Unfortunately, jq doesn't provide an XOR operator...
+
+@test "umoci stat [annotation reference]" {
+	# Create a second image, and give both images custom annotations.
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-other" --author "Other Author"
+	[ "$status" -eq 0 ]
+
+	indexFile="$(setup_tmpdir)/index.json"
+	jq -SM '.manifests |= map(.annotations["com.example.team"] = "shared" | .annotations["com.example.build"] = .annotations["org.opencontainers.image.ref.name"])' "${IMAGE}/index.json" > "$indexFile"
+	mv "$indexFile" "${IMAGE}/index.json"
+	image-verify "${IMAGE}"
+
+	# Resolving by a unique annotation gives us the right image.
+	umoci stat --image "${IMAGE}@annotation:com.example.build=${TAG}-other" --json
+	[ "$status" -eq 0 ]
+	[[ "$(jq -SMr '.manifest.annotations["org.opencontainers.image.ref.name"]' <<<"$output")" == "${TAG}-other" ]]
+
+	# Ambiguous and missing annotations are errors.
+	umoci stat --image "${IMAGE}@annotation:com.example.team=shared"
+	[ "$status" -ne 0 ]
+	[[ "$output" == *"ambiguous"* ]]
+	umoci stat --image "${IMAGE}@annotation:com.example.team=missing"
+	[ "$status" -ne 0 ]
+	umoci stat --image "${IMAGE}@annotation:com.example.team"
+	[ "$status" -ne 0 ]
+
+	# Annotation references cannot be overwritten.
+	umoci config --image "${IMAGE}@annotation:com.example.build=${TAG}-other" --author "New Author"
+	[ "$status" -ne 0 ]
+	umoci config --image "${IMAGE}@annotation:com.example.build=${TAG}-other" --tag "${TAG}-new" --author "New Author"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+}
+
+@test "umoci stat [digest reference]" {
+	# Create a second image and then untag it.
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-other" --author "Other Author"
+	[ "$status" -eq 0 ]
+	manifest=$(jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-other"'") | .digest' "${IMAGE}/index.json")
+	umoci rm --image "${IMAGE}:${TAG}-other"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Resolving by the full digest gives us the untagged image.
+	umoci stat --image "${IMAGE}@${manifest}" --json
+	[ "$status" -eq 0 ]
+	[[ "$(jq -SMr '.history[-1].author' <<<"$output")" == "Other Author" ]]
+
+	# As does an unambiguous prefix.
+	umoci stat --image "${IMAGE}@${manifest:0:19}" --json
+	[ "$status" -eq 0 ]
+	[[ "$(jq -SMr '.history[-1].author' <<<"$output")" == "Other Author" ]]
+
+	# Missing and malformed digests are errors.
+	umoci stat --image "${IMAGE}@sha256:$(sha256sum <<<"does not exist" | cut -d' ' -f1)"
+	[ "$status" -ne 0 ]
+	umoci stat --image "${IMAGE}@sha256:NOTHEX"
+	[ "$status" -ne 0 ]
+
+	# Digest references cannot be overwritten.
+	umoci config --image "${IMAGE}@${manifest}" --author "New Author"
+	[ "$status" -ne 0 ]
+	umoci config --image "${IMAGE}@${manifest}" --tag "${TAG}-new" --author "New Author"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+}
@@ -50,6 +50,34 @@ function teardown() {
 	image-verify "${IMAGE}"
 }
 
+@test "umoci list --json" {
+	# Get list of tags.
+	umoci list --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	nrefs="${#lines[@]}"
+	image-verify "${IMAGE}"
+
+	# Get the JSON list of tags.
+	umoci list --layout "${IMAGE}" --json
+	[ "$status" -eq 0 ]
+	listJSON="$output"
+	image-verify "${IMAGE}"
+
+	# Same number of entries.
+	[ "$(jq -SMr 'length' <<<"$listJSON")" -eq "$nrefs" ]
+
+	# Make sure the entries match the index.
+	jq -SMc '[.[] | {name, mediaType, digest, size}] | sort' <<<"$listJSON" >"$UMOCI_TMPDIR/list.json"
+	jq -SMc '[.manifests[] | select(.annotations["org.opencontainers.image.ref.name"]) | {name: .annotations["org.opencontainers.image.ref.name"], mediaType, digest, size}] | sort' "$IMAGE/index.json" >"$UMOCI_TMPDIR/index.json"
+	sane_run diff -u "$UMOCI_TMPDIR/index.json" "$UMOCI_TMPDIR/list.json"
+	[ "$status" -eq 0 ]
+
+	# Annotations must be included.
+	[[ "$(jq -SMr --arg tag "$TAG" '.[] | select(.name == $tag) | .annotations["org.opencontainers.image.ref.name"]' <<<"$listJSON")" == "$TAG" ]]
+
+	image-verify "${IMAGE}"
+}
+
 @test "umoci list [invalid arguments]" {
 	umoci list
 	[ "$status" -ne 0 ]
@@ -202,6 +230,148 @@ function teardown() {
 	image-verify "${IMAGE}"
 }
 
+@test "umoci tag --rename" {
+	NEW_TAG="${TAG}-newtag"
+	OTHER_TAG="${TAG}-othertag"
+
+	# Get the original stat output.
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	oldOutput="$output"
+	blobs="$(find "${IMAGE}/blobs" -type f | sort)"
+
+	# Rename the tag.
+	umoci tag --image "${IMAGE}" --rename "${TAG}" "${NEW_TAG}"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The old tag must be gone.
+	umoci list --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[[ "$(printf -- '%s\n' "${lines[@]}" | grep -Fx -- "${TAG}" | wc -l)" -eq 0 ]]
+	[[ "$(printf -- '%s\n' "${lines[@]}" | grep -Fx -- "${NEW_TAG}" | wc -l)" -eq 1 ]]
+
+	# The new tag must be the same image.
+	umoci stat --image "${IMAGE}:${NEW_TAG}" --json
+	[ "$status" -eq 0 ]
+	[[ "$oldOutput" == "$output" ]]
+
+	# No blobs should have been modified.
+	[[ "$blobs" == "$(find "${IMAGE}/blobs" -type f | sort)" ]]
+
+	# Renaming onto an existing tag must fail without --force.
+	umoci tag --image "${IMAGE}:${NEW_TAG}" "${OTHER_TAG}"
+	[ "$status" -eq 0 ]
+	umoci config --image "${IMAGE}:${OTHER_TAG}" --author="Someone"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci tag --image "${IMAGE}" --rename "${NEW_TAG}" "${OTHER_TAG}"
+	[ "$status" -ne 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${OTHER_TAG}" --json
+	[ "$status" -eq 0 ]
+	[[ "$oldOutput" != "$output" ]]
+
+	# ... but works with --force.
+	umoci tag --image "${IMAGE}" --rename --force "${NEW_TAG}" "${OTHER_TAG}"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${OTHER_TAG}" --json
+	[ "$status" -eq 0 ]
+	[[ "$oldOutput" == "$output" ]]
+
+	umoci list --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[[ "$(printf -- '%s\n' "${lines[@]}" | grep -Fx -- "${NEW_TAG}" | wc -l)" -eq 0 ]]
+	[[ "$(printf -- '%s\n' "${lines[@]}" | grep -Fx -- "${OTHER_TAG}" | wc -l)" -eq 1 ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci tag --copy" {
+	NEW_TAG="${TAG}-newtag"
+
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	oldOutput="$output"
+	blobs="$(find "${IMAGE}/blobs" -type f | sort)"
+
+	# Copy the tag.
+	umoci tag --image "${IMAGE}" --copy "${TAG}" "${NEW_TAG}"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Both tags must be the same image.
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	[[ "$oldOutput" == "$output" ]]
+	umoci stat --image "${IMAGE}:${NEW_TAG}" --json
+	[ "$status" -eq 0 ]
+	[[ "$oldOutput" == "$output" ]]
+
+	# No blobs should have been modified.
+	[[ "$blobs" == "$(find "${IMAGE}/blobs" -type f | sort)" ]]
+
+	# Copying onto an existing tag must fail without --force.
+	umoci tag --image "${IMAGE}" --copy "${TAG}" "${NEW_TAG}"
+	[ "$status" -ne 0 ]
+	image-verify "${IMAGE}"
+
+	umoci tag --image "${IMAGE}" --copy --force "${TAG}" "${NEW_TAG}"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+}
+
+@test "umoci tag --{rename,copy} [invalid arguments]" {
+	NEW_TAG="${TAG}-newtag"
+
+	# Both --rename and --copy.
+	umoci tag --image "${IMAGE}" --rename --copy "${TAG}" "${NEW_TAG}"
+	[ "$status" -ne 0 ]
+	image-verify "${IMAGE}"
+
+	# Tag included in --image.
+	umoci tag --image "${IMAGE}:${TAG}" --rename "${TAG}" "${NEW_TAG}"
+	[ "$status" -ne 0 ]
+	image-verify "${IMAGE}"
+
+	# Missing positional arguments.
+	umoci tag --image "${IMAGE}" --rename "${TAG}"
+	[ "$status" -ne 0 ]
+	image-verify "${IMAGE}"
+
+	# Too many positional arguments.
+	umoci tag --image "${IMAGE}" --copy "${TAG}" "${NEW_TAG}" this-is-an-invalid-argument
+	[ "$status" -ne 0 ]
+	image-verify "${IMAGE}"
+
+	# Invalid tags.
+	umoci tag --image "${IMAGE}" --rename "${TAG}" "${INVALID_TAG}"
+	[ "$status" -ne 0 ]
+	image-verify "${IMAGE}"
+	umoci tag --image "${IMAGE}" --rename "${INVALID_TAG}" "${NEW_TAG}"
+	[ "$status" -ne 0 ]
+	image-verify "${IMAGE}"
+
+	# Same source and destination.
+	umoci tag --image "${IMAGE}" --rename "${TAG}" "${TAG}"
+	[ "$status" -ne 0 ]
+	image-verify "${IMAGE}"
+
+	# Non-existent source tag.
+	umoci tag --image "${IMAGE}" --rename "${TAG}-doesnotexist" "${NEW_TAG}"
+	[ "$status" -ne 0 ]
+	image-verify "${IMAGE}"
+
+	# --force without --rename or --copy.
+	umoci tag --image "${IMAGE}:${TAG}" --force "${NEW_TAG}"
+	[ "$status" -ne 0 ]
+	image-verify "${IMAGE}"
+}
+
 @test "umoci remove" {
 	# How many tags?
 	umoci list --layout "${IMAGE}"
@@ -51,6 +51,95 @@ function teardown() {
 	[ "$status" -ne 0 ]
 }
 
+@test "umoci --log-format" {
+	# Text logs are the default.
+	umoci --log=info --log-format=text list --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	umoci --log=info list --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+
+	# JSON logs. umoci tag logs at info level.
+	umoci --log=debug --log-format=json tag --image "${IMAGE}:${TAG}" "${TAG}-new"
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -gt 0 ]
+	# sane_run clobbers $lines, so iterate over a copy.
+	logLines=("${lines[@]}")
+	for line in "${logLines[@]}"; do
+		# Every line must be a JSON object with the standard keys.
+		sane_run jq -e 'has("time") and has("level") and has("msg")' <<<"$line"
+		[ "$status" -eq 0 ]
+	done
+	printf -- '%s\n' "${logLines[@]}" | jq -se 'map(select(.level == "info" and (.msg | startswith("created new tag")))) | length == 1'
+
+	# Errors are also logged as JSON.
+	umoci --log-format=json stat --image "${IMAGE}:${TAG}-doesnotexist"
+	[ "$status" -ne 0 ]
+	sane_run jq -e '.level == "fatal"' <<<"${lines[-1]}"
+	[ "$status" -eq 0 ]
+
+	# Invalid --log-format arguments.
+	umoci --log-format=xml list --layout "${IMAGE}"
+	[ "$status" -ne 0 ]
+	umoci --log-format= list --layout "${IMAGE}"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci --errors-json" {
+	# Successful commands don't output anything extra.
+	umoci --errors-json list --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[[ "$output" != *"{"* ]]
+
+	# Missing tags.
+	umoci --errors-json stat --image "${IMAGE}:${TAG}-doesnotexist"
+	[ "$status" -ne 0 ]
+	[ "${#lines[@]}" -eq 1 ]
+	sane_run jq -SMr '.code' <<<"$output"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "tag_not_found" ]]
+	umoci --errors-json stat --image "${IMAGE}:${TAG}-doesnotexist"
+	sane_run jq -SMr '.image + ":" + .tag' <<<"$output"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "${IMAGE}:${TAG}-doesnotexist" ]]
+	umoci --errors-json stat --image "${IMAGE}:${TAG}-doesnotexist"
+	sane_run jq -SMr '.message' <<<"$output"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"tag not found"* ]]
+
+	# Corrupt blobs (including the digest of the blob).
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	configDigest="$(jq -SMr '.config.digest' <<<"$output")"
+	chmod +w "${IMAGE}/blobs/${configDigest/://}"
+	echo "corrupted" >>"${IMAGE}/blobs/${configDigest/://}"
+
+	new_bundle_rootfs
+	umoci --errors-json unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -ne 0 ]
+	sane_run jq -SMr '.code' <<<"${lines[-1]}"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "blob_corrupt" ]]
+	umoci --errors-json unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	sane_run jq -SMr '.digest' <<<"${lines[-1]}"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$configDigest" ]]
+
+	# Invalid layouts.
+	umoci --errors-json list --layout "$(setup_tmpdir)"
+	[ "$status" -ne 0 ]
+	sane_run jq -SMr '.code' <<<"${lines[-1]}"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "invalid_layout" ]]
+
+	# Without --errors-json, errors are not output as JSON.
+	umoci stat --image "${IMAGE}:${TAG}-doesnotexist"
+	[ "$status" -ne 0 ]
+	sane_run jq -e . <<<"$output"
+	[ "$status" -ne 0 ]
+}
+
 @test "umoci --cpu-profile" {
 	CPU_PROFILE="$(setup_tmpdir)/umoci.profile"
 
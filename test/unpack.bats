@@ -110,6 +110,36 @@ function teardown() {
 		this-is-an-invalid-argument
 	[ "$status" -ne 0 ]
 	image-verify "${IMAGE}"
+
+	# Invalid --rootless-devices mode.
+	umoci unpack --image "${IMAGE}:${TAG}" --rootless-devices=mknod "$BUNDLE"
+	[ "$status" -ne 0 ]
+	image-verify "${IMAGE}"
+
+	# --subid-auto conflicts with explicit mappings.
+	umoci unpack --image "${IMAGE}:${TAG}" --subid-auto --uid-map 0:1000:1 "$BUNDLE"
+	[ "$status" -ne 0 ]
+	image-verify "${IMAGE}"
+	umoci unpack --image "${IMAGE}:${TAG}" --subid-auto --gid-map 0:1000:1 "$BUNDLE"
+	[ "$status" -ne 0 ]
+	image-verify "${IMAGE}"
+
+	# Invalid --mtree-keywords and --mtree-output.
+	umoci unpack --image "${IMAGE}:${TAG}" --mtree-keywords=nonexistent "$BUNDLE"
+	[ "$status" -ne 0 ]
+	image-verify "${IMAGE}"
+	umoci unpack --image "${IMAGE}:${TAG}" --mtree-keywords=+sha512digest,size "$BUNDLE"
+	[ "$status" -ne 0 ]
+	image-verify "${IMAGE}"
+	umoci unpack --image "${IMAGE}:${TAG}" --mtree-keywords=-size,-type,-uid,-gid,-mode,-link,-nlink,-tar_time,-sha256digest,-xattr "$BUNDLE"
+	[ "$status" -ne 0 ]
+	image-verify "${IMAGE}"
+	umoci unpack --image "${IMAGE}:${TAG}" --mtree-output= "$BUNDLE"
+	[ "$status" -ne 0 ]
+	image-verify "${IMAGE}"
+	umoci unpack --image "${IMAGE}:${TAG}" --overlay --mtree-keywords=size,type "$BUNDLE"
+	[ "$status" -ne 0 ]
+	image-verify "${IMAGE}"
 }
 
 @test "umoci unpack [config.json contains mount namespace]" {
@@ -290,6 +320,80 @@ function teardown() {
 	image-verify "${IMAGE}"
 }
 
+@test "umoci unpack --rootless-devices" {
+	# We need to mknod to create the devices in the image.
+	requires root
+
+	# Add some devices to the image.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	mknod "$ROOTFS/block1" b 128 42
+	mknod "$ROOTFS/char1"  c 133 37
+	chmod 0640 "$ROOTFS/char1"
+
+	umoci repack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# --rootless-devices=error fails to unpack the image.
+	new_bundle_rootfs
+	umoci unpack --rootless --rootless-devices=error --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -ne 0 ]
+
+	# --rootless-devices=skip doesn't create the devices.
+	new_bundle_rootfs
+	umoci unpack --rootless --rootless-devices=skip --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	! [ -e "$ROOTFS/block1" ]
+	! [ -e "$ROOTFS/char1" ]
+
+	# --rootless-devices=placeholder (the default) creates empty files.
+	new_bundle_rootfs
+	umoci unpack --rootless --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	[ -f "$ROOTFS/block1" ]
+	[ ! -s "$ROOTFS/block1" ]
+	[ -f "$ROOTFS/char1" ]
+	[ ! -s "$ROOTFS/char1" ]
+	[[ "$(getfattr --absolute-names --only-values -n user.umoci.rootless.device "$ROOTFS/block1")" == "block 128:42" ]]
+	[[ "$(getfattr --absolute-names --only-values -n user.umoci.rootless.device "$ROOTFS/char1")" == "char 133:37" ]]
+	# The placeholders are recorded in the mtree manifest.
+	grep -q 'xattr.user.umoci.rootless.device' "$BUNDLE"/*.mtree
+
+	# Modify the metadata of a placeholder and repack.
+	chmod 0600 "$ROOTFS/char1"
+	umoci repack --image "${IMAGE}:${TAG}-placeholder" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The device must have been reconstructed in the new layer.
+	manifest=$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-placeholder"'") | .digest' "${IMAGE}/index.json" | cut -f2 -d:)
+	layer="$(jq -r '.layers[-1].digest' "${IMAGE}/blobs/sha256/$manifest" | cut -f2 -d:)"
+	sane_run tar --xattrs --xattrs-include='*' -tvzf "${IMAGE}/blobs/sha256/$layer"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"crw-------"*"133,37"*"char1"* ]]
+	[[ "$output" != *"block1"* ]]
+
+	# And unpacking it as root gives us the device.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}-placeholder" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	[ -c "$ROOTFS/char1" ]
+	[[ "$(stat -c '%t:%T %a' "$ROOTFS/char1")" == "85:25 600" ]]
+	[ -b "$ROOTFS/block1" ]
+
+	image-verify "${IMAGE}"
+}
+
 @test "umoci unpack --keep-dirlinks" {
 	# Unpack the image.
 	new_bundle_rootfs
@@ -354,3 +458,577 @@ function teardown() {
 	[ "$(readlink "$ROOTFS/loop3")" = "link2/loop4" ]
 	[ "$(readlink "$ROOTFS/dir/loop4")" = "../loop1" ]
 }
+
+@test "umoci unpack --overlay" {
+	# Create an image with a whiteout in a new layer.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	rm "$ROOTFS/etc/group"
+	echo "new layer" > "$ROOTFS/newfile"
+
+	umoci repack --image "${IMAGE}:${TAG}-overlay" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Unpack the image as an overlay bundle.
+	new_bundle_rootfs
+	umoci unpack --overlay --image "${IMAGE}:${TAG}-overlay" "$BUNDLE"
+	[ "$status" -eq 0 ]
+
+	# The rootfs is an empty mountpoint, and there is no mtree manifest.
+	[ -f "$BUNDLE/config.json" ]
+	[ -d "$ROOTFS" ]
+	[ -z "$(ls -A "$ROOTFS")" ]
+	! ls "$BUNDLE"/sha256_*.mtree
+	[[ "$(jq -r '.root.path' "$BUNDLE/config.json")" == "rootfs" ]]
+
+	# Each layer is extracted to a separate directory.
+	manifest=$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-overlay"'") | .digest' "${IMAGE}/index.json" | cut -f2 -d:)
+	numLayers="$(jq -r '.layers | length' "${IMAGE}/blobs/sha256/$manifest")"
+	topLayer="$BUNDLE/layer$((numLayers - 1))"
+	[ -d "$topLayer" ]
+	! [ -d "$BUNDLE/layer$numLayers" ]
+	[ -f "$topLayer/newfile" ]
+
+	# The whiteout must be an overlayfs whiteout.
+	[ -c "$topLayer/etc/group" ]
+	[[ "$(stat -c '%t:%T' "$topLayer/etc/group")" == "0:0" ]]
+
+	# Overlay bundles cannot be repacked.
+	umoci repack --image "${IMAGE}:${TAG}-overlay2" "$BUNDLE"
+	[ "$status" -ne 0 ]
+	umoci stat --image "${IMAGE}:${TAG}-overlay2" --json
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci unpack --mtree-keywords --mtree-output" {
+	# Unpack the image with a custom mtree manifest.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" --mtree-keywords=+sha512digest,-tar_time --mtree-output=custom.mtree "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# The manifest is written to the requested path with the requested keywords.
+	[ -f "$BUNDLE/custom.mtree" ]
+	! ls "$BUNDLE"/sha256_*.mtree
+	grep -E '^#\s+keywords:.*sha512digest' "$BUNDLE/custom.mtree"
+	! grep -E '^#\s+keywords:.*tar_time' "$BUNDLE/custom.mtree"
+	grep 'sha512digest=' "$BUNDLE/custom.mtree"
+	! grep 'time=' "$BUNDLE/custom.mtree"
+
+	# The settings are saved in the bundle metadata.
+	[[ "$(jq -r '.mtree_path' "$BUNDLE/umoci.json")" == "custom.mtree" ]]
+	[[ "$(jq -r '.mtree_keywords | index("sha512digest") != null' "$BUNDLE/umoci.json")" == "true" ]]
+	[[ "$(jq -r '.mtree_keywords | index("tar_time") == null' "$BUNDLE/umoci.json")" == "true" ]]
+
+	# Ensure that gomtree succeeds on the unchanged rootfs.
+	gomtree -p "$ROOTFS" -f "$BUNDLE/custom.mtree"
+	[ "$status" -eq 0 ]
+	[ -z "$output" ]
+
+	# Modifying only the modification time isn't a change with these keywords.
+	touch -d "1997-03-25T13:40:00Z" "$ROOTFS/etc/passwd"
+	umoci repack --image "${IMAGE}:${TAG}-mtime" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+	umoci stat --image "${IMAGE}:${TAG}-mtime" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SM '.history[-1].empty_layer')" == "true" ]]
+
+	# Content changes are still picked up, and --refresh-bundle regenerates the
+	# manifest at the same path.
+	echo "new file" > "$ROOTFS/newfile"
+	umoci repack --refresh-bundle --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+	[ -f "$BUNDLE/custom.mtree" ]
+	! ls "$BUNDLE"/sha256_*.mtree
+	grep 'newfile.*sha512digest=' "$BUNDLE/custom.mtree"
+}
+
+@test "umoci unpack --refresh" {
+	# Unpack the original image.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Make some changes and repack them without refreshing the bundle.
+	echo "first file" > "$ROOTFS/newfile"
+	umoci repack --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Refresh the bundle so that it is based on the new image.
+	umoci --log=info unpack --refresh --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	[[ "$output" =~ "absorbing "[1-9][0-9]*" changes" ]]
+
+	# The bundle metadata must now refer to the new image, and the mtree
+	# manifest must match the rootfs.
+	umoci stat --image "${IMAGE}:${TAG}-new" --json
+	[ "$status" -eq 0 ]
+	manifestDigest="$(jq -SMr '.manifest.digest' <<<"$output")"
+	sane_run jq -SMr '.from_descriptor_path.descriptor_walk[-1].digest' "$BUNDLE/umoci.json"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$manifestDigest" ]]
+	[ -f "$BUNDLE/${manifestDigest/:/_}.mtree" ]
+	[ "$(find "$BUNDLE" -maxdepth 1 -name '*.mtree' | wc -l)" -eq 1 ]
+	gomtree -p "$ROOTFS" -f "$BUNDLE/${manifestDigest/:/_}.mtree"
+	[ "$status" -eq 0 ]
+	[ -z "$output" ]
+
+	# A later repack only contains the changes made after the refresh.
+	echo "second file" > "$ROOTFS/newfile2"
+	umoci repack --image "${IMAGE}:${TAG}-new2" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}-new" --json
+	[ "$status" -eq 0 ]
+	numLayersA="$(jq -SMr '[.history[] | select(.layer != null)] | length' <<<"$output")"
+	umoci stat --image "${IMAGE}:${TAG}-new2" --json
+	[ "$status" -eq 0 ]
+	numLayersB="$(jq -SMr '[.history[] | select(.layer != null)] | length' <<<"$output")"
+	[ "$numLayersB" -eq "$((numLayersA + 1))" ]
+	layerDigest="$(jq -SMr '[.history[] | select(.layer != null)] | last | .layer.digest' <<<"$output")"
+
+	new_bundle_rootfs
+	umoci raw unpack-layer --layout "${IMAGE}" --digest "$layerDigest" "$ROOTFS"
+	[ "$status" -eq 0 ]
+	[ -f "$ROOTFS/newfile2" ]
+	! [ -e "$ROOTFS/newfile" ]
+}
+
+@test "umoci unpack --refresh [invalid arguments]" {
+	# Refreshing a non-existent bundle.
+	new_bundle_rootfs
+	umoci unpack --refresh --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -ne 0 ]
+
+	# Extraction options cannot be used with --refresh.
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	umoci unpack --refresh --keep-dirlinks --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -ne 0 ]
+	umoci unpack --refresh --overlay --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -ne 0 ]
+
+	# Overlay bundles cannot be refreshed.
+	new_bundle_rootfs
+	umoci unpack --overlay --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	umoci unpack --refresh --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci unpack --no-mtree" {
+	# Unpack the image without any metadata.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" --no-mtree "$BUNDLE"
+	[ "$status" -eq 0 ]
+
+	# Only the runtime bundle is generated.
+	[ -d "$ROOTFS" ]
+	[ -f "$BUNDLE/config.json" ]
+	! [ -e "$BUNDLE/umoci.json" ]
+	[ "$(find "$BUNDLE" -maxdepth 1 -name '*.mtree' | wc -l)" -eq 0 ]
+	[ -f "$ROOTFS/etc/passwd" ]
+
+	# The bundle cannot be repacked or refreshed.
+	umoci repack --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -ne 0 ]
+	[[ "$output" == *"unpacked without metadata"* ]]
+	umoci unpack --refresh --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -ne 0 ]
+	[[ "$output" == *"unpacked without metadata"* ]]
+
+	# --no-mtree conflicts with the options controlling the mtree manifest.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" --no-mtree --mtree-output=custom.mtree "$BUNDLE"
+	[ "$status" -ne 0 ]
+	umoci unpack --image "${IMAGE}:${TAG}" --no-mtree --mtree-keywords=sha256digest "$BUNDLE"
+	[ "$status" -ne 0 ]
+	umoci unpack --image "${IMAGE}:${TAG}" --no-mtree --overlay "$BUNDLE"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci unpack --[no-]preserve-atime" {
+	# Add a file with old timestamps to the image.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	echo "some contents" > "$ROOTFS/old-file"
+	touch -d "@1234567890" "$ROOTFS/old-file"
+
+	umoci repack --image "${IMAGE}:${TAG}-atime" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Reading the file while repacking may have updated its atime, so we only
+	# know that the atime in the image is older than now.
+	sleep 2s
+	now="$(date +%s)"
+
+	# By default, the atime is restored from the image (even though the mtree
+	# manifest generation reads every file).
+	for flags in "" "--preserve-atime"; do
+		new_bundle_rootfs
+		umoci unpack --image "${IMAGE}:${TAG}-atime" $flags "$BUNDLE"
+		[ "$status" -eq 0 ]
+		bundle-verify "$BUNDLE"
+
+		sane_run stat -c '%X' "$ROOTFS/old-file"
+		[ "$status" -eq 0 ]
+		[ "$output" -lt "$now" ]
+		sane_run stat -c '%Y' "$ROOTFS/old-file"
+		[ "$status" -eq 0 ]
+		[ "$output" -eq 1234567890 ]
+	done
+
+	# With --no-preserve-atime only the mtime is restored.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}-atime" --no-preserve-atime "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	sane_run stat -c '%X' "$ROOTFS/old-file"
+	[ "$status" -eq 0 ]
+	[ "$output" -ge "$now" ]
+	sane_run stat -c '%Y' "$ROOTFS/old-file"
+	[ "$status" -eq 0 ]
+	[ "$output" -eq 1234567890 ]
+
+	# The two flags are mutually exclusive.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}-atime" --preserve-atime --no-preserve-atime "$BUNDLE"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci unpack --rootfs-only" {
+	# Unpack just the rootfs.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" --rootfs-only "$BUNDLE"
+	[ "$status" -eq 0 ]
+
+	# The layers are extracted directly into the target, with nothing else.
+	[ -f "$BUNDLE/etc/passwd" ]
+	! [ -e "$BUNDLE/rootfs" ]
+	! [ -e "$BUNDLE/config.json" ]
+	! [ -e "$BUNDLE/umoci.json" ]
+	[ "$(find "$BUNDLE" -maxdepth 1 -name '*.mtree' | wc -l)" -eq 0 ]
+
+	# The contents match a normal unpack.
+	otherBundle="$(setup_tmpdir)/bundle"
+	umoci unpack --image "${IMAGE}:${TAG}" "$otherBundle"
+	[ "$status" -eq 0 ]
+	bundle-verify "$otherBundle"
+	sane_run diff -r "$BUNDLE" "$otherBundle/rootfs"
+	[ "$status" -eq 0 ]
+
+	# It cannot be repacked.
+	umoci repack --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -ne 0 ]
+
+	# Options for the bundle metadata or config.json don't make sense.
+	for flag in --overlay --no-mtree --mtree-output=custom.mtree --seal --refresh --no-hardening --masked-path=/foo; do
+		new_bundle_rootfs
+		umoci unpack --image "${IMAGE}:${TAG}" --rootfs-only "$flag" "$BUNDLE"
+		[ "$status" -ne 0 ]
+	done
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci unpack --rootfs-only [existing directory]" {
+	# Refuse to extract into a non-empty directory.
+	new_bundle_rootfs
+	echo "keep me" > "$BUNDLE/keep"
+	umoci unpack --image "${IMAGE}:${TAG}" --rootfs-only "$BUNDLE"
+	[ "$status" -ne 0 ]
+	[[ "$(cat "$BUNDLE/keep")" == "keep me" ]]
+	! [ -e "$BUNDLE/etc" ]
+
+	# Corrupt one of the layers of the image.
+	manifest=$(jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"$TAG"'") | .digest' "${IMAGE}/index.json")
+	layer=$(jq -SMr '.layers[-1].digest' "${IMAGE}/blobs/sha256/${manifest#sha256:}")
+	chmod +w "${IMAGE}/blobs/sha256/${layer#sha256:}"
+	echo "corrupted" >> "${IMAGE}/blobs/sha256/${layer#sha256:}"
+
+	# A failed unpack into an existing (empty) directory only removes what
+	# it extracted, not the directory itself.
+	new_bundle_rootfs
+	[ -d "$BUNDLE" ]
+	umoci unpack --image "${IMAGE}:${TAG}" --rootfs-only "$BUNDLE"
+	[ "$status" -ne 0 ]
+	[ -d "$BUNDLE" ]
+	[ -z "$(ls -A "$BUNDLE")" ]
+}
+
+@test "umoci unpack --detect-compression" {
+	# Mislabel all of the (compressed) layers of the image as uncompressed.
+	manifest=$(jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"$TAG"'") | .digest' "${IMAGE}/index.json")
+	newManifest="$(setup_tmpdir)/manifest.json"
+	jq -cM '.layers[].mediaType = "application/vnd.oci.image.layer.v1.tar"' "${IMAGE}/blobs/sha256/${manifest#sha256:}" >"$newManifest"
+	newDigest="sha256:$(sha256sum "$newManifest" | cut -d' ' -f1)"
+	newSize="$(stat -c '%s' "$newManifest")"
+	mv "$newManifest" "${IMAGE}/blobs/sha256/${newDigest#sha256:}"
+	newIndex="$(setup_tmpdir)/index.json"
+	jq -SM '.manifests |= map(select(.annotations["org.opencontainers.image.ref.name"] == "'"$TAG"'") |= (.digest = "'"$newDigest"'" | .size = '"$newSize"'))' "${IMAGE}/index.json" >"$newIndex"
+	mv "$newIndex" "${IMAGE}/index.json"
+
+	# By default the media type is trusted, so unpacking fails.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -ne 0 ]
+
+	# But the compression can be detected.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" --detect-compression "$BUNDLE"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"does not match detected compression (gzip)"* ]]
+	bundle-verify "$BUNDLE"
+	[ -f "$BUNDLE/rootfs/etc/passwd" ]
+}
+
+@test "umoci unpack --layer-cache" {
+	cacheDir="$(setup_tmpdir)/cache"
+
+	# The first unpack populates the cache.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" --layer-cache "$cacheDir" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+	numLayers="$(find "$cacheDir" -mindepth 2 -maxdepth 2 -type d | wc -l)"
+	[ "$numLayers" -gt 0 ]
+
+	# Create a new image which shares all of the layers of the base image.
+	echo "layer cache" > "$ROOTFS/layer-cache"
+	umoci repack --image "${IMAGE}:${TAG}-cache" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Unpacking it only extracts (and caches) the new layer.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}-cache" --layer-cache "$cacheDir" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+	[ "$(find "$cacheDir" -mindepth 2 -maxdepth 2 -type d | wc -l)" -eq "$((numLayers + 1))" ]
+	[[ "$(cat "$ROOTFS/layer-cache")" == "layer cache" ]]
+	cachedBundle="$BUNDLE"
+
+	# The contents match a normal unpack.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}-cache" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+	sane_run diff -r "$cachedBundle/rootfs" "$BUNDLE/rootfs"
+	[ "$status" -eq 0 ]
+
+	# Modifying the unpacked rootfs doesn't modify the cache.
+	echo "modified" > "$cachedBundle/rootfs/layer-cache"
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}-cache" --layer-cache "$cacheDir" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+	[[ "$(cat "$ROOTFS/layer-cache")" == "layer cache" ]]
+
+	# --layer-cache cannot be used with --overlay.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" --layer-cache "$cacheDir" --overlay "$BUNDLE"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci unpack --manifest-out" {
+	# Create an image which modifies and deletes some files.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	mkdir -p "$ROOTFS/newdir"
+	echo "some contents" > "$ROOTFS/newdir/file"
+	chmod 0600 "$ROOTFS/newdir/file"
+	ln -s file "$ROOTFS/newdir/link"
+	rm -rf "$ROOTFS/etc/shadow"
+
+	umoci repack --image "${IMAGE}:${TAG}-manifest" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	manifestFile="$(setup_tmpdir)/files.json"
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}-manifest" --manifest-out "$manifestFile" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	sane_run jq -SMr '.version' "$manifestFile"
+	[ "$status" -eq 0 ]
+	[ "$output" -eq 1 ]
+
+	# Every path in the rootfs was created (apart from the rootfs itself).
+	sane_run jq -SMr '.entries[] | select(.path == "/newdir/file") | "\(.change) \(.type) \(.mode) \(.size)"' "$manifestFile"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "created file 0600 14" ]]
+	sane_run jq -SMr '.entries[] | select(.path == "/newdir/link") | "\(.change) \(.type)"' "$manifestFile"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "created symlink" ]]
+	sane_run jq -SMr '.entries[] | select(.path == "/etc/passwd") | .change' "$manifestFile"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "created" ]]
+	sane_run jq -SMr '.entries[] | select(.path == "/") | .change' "$manifestFile"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "modified" ]]
+
+	# Paths removed by a later layer don't end up in the rootfs at all.
+	sane_run jq -SMr '.entries[] | select(.path == "/etc/shadow") | .path' "$manifestFile"
+	[ "$status" -eq 0 ]
+	[ -z "$output" ]
+
+	# The manifest works without the mtree manifest, but cannot be used with
+	# overlay bundles or --refresh.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}-manifest" --no-mtree --manifest-out "$manifestFile" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	sane_run jq -SMr '.entries[] | select(.path == "/newdir/file") | .change' "$manifestFile"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "created" ]]
+
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}-manifest" --overlay --manifest-out "$manifestFile" "$BUNDLE"
+	[ "$status" -ne 0 ]
+	umoci unpack --image "${IMAGE}:${TAG}-manifest" --manifest-out "" "$BUNDLE"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci unpack --platform" {
+	# Create a second image which will be the "arm64" image.
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-arm64" --config.label "platform=arm64"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Create a multi-platform index referencing both images.
+	amd64="$(jq -c '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}"'") | del(.annotations) | .platform = {"os": "linux", "architecture": "amd64"}' "${IMAGE}/index.json")"
+	arm64="$(jq -c '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-arm64"'") | del(.annotations) | .platform = {"os": "linux", "architecture": "arm64", "variant": "v8"}' "${IMAGE}/index.json")"
+	jq -cn --argjson amd64 "$amd64" --argjson arm64 "$arm64" '{"schemaVersion": 2, "manifests": [$amd64, $arm64]}' >"$UMOCI_TMPDIR/index.json"
+	indexDigest="$(sha256sum "$UMOCI_TMPDIR/index.json" | cut -d' ' -f1)"
+	indexSize="$(stat -c '%s' "$UMOCI_TMPDIR/index.json")"
+	cp "$UMOCI_TMPDIR/index.json" "${IMAGE}/blobs/sha256/$indexDigest"
+	jq -c '.manifests += [{"mediaType": "application/vnd.oci.image.index.v1+json", "digest": "sha256:'"$indexDigest"'", "size": '"$indexSize"', "annotations": {"org.opencontainers.image.ref.name": "multi"}}]' "${IMAGE}/index.json" >"$UMOCI_TMPDIR/image-index.json"
+	mv "$UMOCI_TMPDIR/image-index.json" "${IMAGE}/index.json"
+	image-verify "${IMAGE}"
+
+	# Without --platform the tag is ambiguous, and the error includes the
+	# available platforms.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:multi" "$BUNDLE"
+	[ "$status" -ne 0 ]
+	[[ "$output" == *"linux/amd64"* ]]
+	[[ "$output" == *"linux/arm64/v8"* ]]
+
+	# An unknown platform fails.
+	umoci unpack --image "${IMAGE}:multi" --platform "linux/s390x" "$BUNDLE"
+	[ "$status" -ne 0 ]
+
+	# Invalid platforms are rejected.
+	umoci unpack --image "${IMAGE}:multi" --platform "linux" "$BUNDLE"
+	[ "$status" -ne 0 ]
+
+	# Select the arm64 image.
+	umoci unpack --image "${IMAGE}:multi" --platform "linux/arm64" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+	sane_run jq -SMr '.annotations["platform"]' "$BUNDLE/config.json"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "arm64" ]]
+
+	# Select the amd64 image.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:multi" --platform "linux/amd64" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+	sane_run jq -SMr '.annotations["platform"]' "$BUNDLE/config.json"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "null" ]]
+
+	# umoci stat also supports --platform.
+	umoci stat --image "${IMAGE}:multi" --platform "linux/arm64/v8" --json
+	[ "$status" -eq 0 ]
+	umoci stat --image "${IMAGE}:multi" --json
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci unpack --no-hardening" {
+	# Unpack the image.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" --no-hardening --masked-path /proc/umoci-masked "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	sane_run jq -SMc '.linux.maskedPaths' "$BUNDLE/config.json"
+	[ "$status" -eq 0 ]
+	[[ "$output" == '["/proc/umoci-masked"]' ]]
+	sane_run jq -SMr '.linux.readonlyPaths // [] | length' "$BUNDLE/config.json"
+	[ "$status" -eq 0 ]
+	[ "$output" -eq 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci unpack [tampered blob]" {
+	# Replace the first layer of the image with a different (but valid) layer.
+	manifest=$(cat "${IMAGE}/index.json" | jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"$TAG"'") | .digest' | cut -d: -f2)
+	layer=$(jq -r '.layers[0].digest' "${IMAGE}/blobs/sha256/$manifest" | cut -d: -f2)
+	tampered="$(setup_tmpdir)"
+	echo "tampered" > "$tampered/file"
+	chmod +w "${IMAGE}/blobs/sha256/$layer"
+	tar -C "$tampered" -cz file > "${IMAGE}/blobs/sha256/$layer"
+
+	# The unpack must fail, and not leave behind a half-extracted rootfs.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -ne 0 ]
+	[[ "$output" == *"layer sha256:$layer: blob does not match descriptor"* ]]
+	! [ -e "$ROOTFS" ]
+}
+
+@test "umoci unpack [registry reference]" {
+	# Invalid registry references.
+	for ref in "docker://" "docker://UPPERCASE/image" "docker://image@sha256:invalid"; do
+		new_bundle_rootfs
+		umoci unpack --image "$ref" "$BUNDLE"
+		[ "$status" -ne 0 ]
+		! [ -e "$ROOTFS" ]
+	done
+
+	# Nothing should be listening on this port, so the unpack must fail
+	# cleanly without creating the bundle.
+	new_bundle_rootfs
+	umoci unpack --plain-http --image "docker://127.0.0.1:1/test/image:latest" "$BUNDLE"
+	[ "$status" -ne 0 ]
+	! [ -e "$ROOTFS" ]
+
+	# Other commands don't support registry references.
+	umoci stat --image "docker://127.0.0.1:1/test/image:latest" --json
+	[ "$status" -ne 0 ]
+	[[ "$output" == *"registry references are not supported"* ]]
+
+	image-verify "${IMAGE}"
+}
@@ -0,0 +1,96 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016-2020 SUSE LLC
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_tmpdirs
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+# edit_config applies the given jq filter to the configuration of
+# ${IMAGE}:${TAG}, updating the manifest and index to refer to the new blobs.
+function edit_config() {
+	manifest="$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}"'") | .digest' "${IMAGE}/index.json" | cut -f2 -d:)"
+	config="$(jq -r '.config.digest' "${IMAGE}/blobs/sha256/$manifest" | cut -f2 -d:)"
+
+	jq -c "$1" "${IMAGE}/blobs/sha256/$config" > "$UMOCI_TMPDIR/config"
+	newconfig="$(sha256sum "$UMOCI_TMPDIR/config" | cut -d' ' -f1)"
+	newconfigsize="$(stat -c %s "$UMOCI_TMPDIR/config")"
+	mv "$UMOCI_TMPDIR/config" "${IMAGE}/blobs/sha256/$newconfig"
+
+	jq -c '.config.digest = "sha256:'"$newconfig"'" | .config.size = '"$newconfigsize" "${IMAGE}/blobs/sha256/$manifest" > "$UMOCI_TMPDIR/manifest"
+	newmanifest="$(sha256sum "$UMOCI_TMPDIR/manifest" | cut -d' ' -f1)"
+	newmanifestsize="$(stat -c %s "$UMOCI_TMPDIR/manifest")"
+	mv "$UMOCI_TMPDIR/manifest" "${IMAGE}/blobs/sha256/$newmanifest"
+
+	jq -c '(.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}"'")) |= (.digest = "sha256:'"$newmanifest"'" | .size = '"$newmanifestsize"')' "${IMAGE}/index.json" > "$UMOCI_TMPDIR/index.json"
+	mv "$UMOCI_TMPDIR/index.json" "${IMAGE}/index.json"
+}
+
+@test "umoci verify-config [missing arguments]" {
+	# Missing --image argument.
+	umoci verify-config
+	[ "$status" -ne 0 ]
+
+	# Unknown flag argument.
+	umoci verify-config --this-is-an-invalid-argument --image "${IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+
+	# Too many positional arguments.
+	umoci verify-config --image "${IMAGE}:${TAG}" this-is-an-invalid-argument
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci verify-config" {
+	# The test image is intact.
+	umoci verify-config --image "${IMAGE}:${TAG}"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"no mismatches found"* ]]
+
+	# Layers added by umoci have the correct diffid.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	touch "$ROOTFS/new-file"
+	umoci repack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+	umoci verify-config --image "${IMAGE}:${TAG}"
+	[ "$status" -eq 0 ]
+
+	# Swapping the first two diffids results in two mismatches, even though
+	# all of the blobs are intact.
+	edit_config '.rootfs.diff_ids |= ([.[1], .[0]] + .[2:])'
+	umoci fsck --layout "${IMAGE}" --allow-orphans
+	[ "$status" -eq 0 ]
+	umoci verify-config --image "${IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+	[ "$(grep -c "^layer [0-9]* (sha256:.*): layer has diffid" <<<"$output")" -eq 2 ]
+	[[ "$output" == *"layer 0 "* ]]
+	[[ "$output" == *"layer 1 "* ]]
+
+	# A missing diffid is also reported.
+	edit_config '.rootfs.diff_ids |= .[:-1]'
+	umoci verify-config --image "${IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+	[[ "$output" == *"config has no such diffid"* ]]
+}
@@ -0,0 +1,131 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016-2020 SUSE LLC
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+
+load helpers
+
+function setup() {
+	setup_tmpdirs
+	setup_image
+
+	openssl ecparam -genkey -name prime256v1 -noout -out "$UMOCI_TMPDIR/cosign.key"
+	openssl ec -in "$UMOCI_TMPDIR/cosign.key" -pubout -out "$UMOCI_TMPDIR/cosign.pub"
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+# put_blob moves the given file into ${IMAGE} as a blob, and outputs its
+# (encoded) digest.
+function put_blob() {
+	blob="$(sha256sum "$1" | cut -d' ' -f1)"
+	mv "$1" "${IMAGE}/blobs/sha256/$blob"
+	echo "$blob"
+}
+
+# sign_image adds a cosign signature manifest to ${IMAGE}, signing a payload
+# for the image with the given digest using the given key. The signature is
+# tagged with the cosign tag convention for the given digest.
+function sign_image() {
+	digest="$1"
+	key="$2"
+
+	jq -cn --arg digest "$digest" '{"critical": {"identity": {"docker-reference": "umoci"}, "image": {"docker-manifest-digest": $digest}, "type": "cosign container image signature"}, "optional": null}' > "$UMOCI_TMPDIR/payload"
+	signature="$(openssl dgst -sha256 -sign "$key" "$UMOCI_TMPDIR/payload" | base64 -w0)"
+	payloadsize="$(stat -c %s "$UMOCI_TMPDIR/payload")"
+	payload="$(put_blob "$UMOCI_TMPDIR/payload")"
+
+	echo '{}' > "$UMOCI_TMPDIR/config"
+	configsize="$(stat -c %s "$UMOCI_TMPDIR/config")"
+	config="$(put_blob "$UMOCI_TMPDIR/config")"
+
+	jq -cn --arg config "sha256:$config" --argjson configsize "$configsize" \
+	       --arg payload "sha256:$payload" --argjson payloadsize "$payloadsize" \
+	       --arg signature "$signature" \
+		'{"schemaVersion": 2, "mediaType": "application/vnd.oci.image.manifest.v1+json",
+		  "config": {"mediaType": "application/vnd.oci.image.config.v1+json", "digest": $config, "size": $configsize},
+		  "layers": [{"mediaType": "application/vnd.dev.cosign.simplesigning.v1+json", "digest": $payload, "size": $payloadsize,
+		              "annotations": {"dev.cosignproject.cosign/signature": $signature}}]}' > "$UMOCI_TMPDIR/manifest"
+	manifestsize="$(stat -c %s "$UMOCI_TMPDIR/manifest")"
+	manifest="$(put_blob "$UMOCI_TMPDIR/manifest")"
+
+	jq -c --arg manifest "sha256:$manifest" --argjson manifestsize "$manifestsize" --arg tag "$(tr : - <<<"$digest").sig" \
+		'.manifests += [{"mediaType": "application/vnd.oci.image.manifest.v1+json", "digest": $manifest, "size": $manifestsize,
+		                 "annotations": {"org.opencontainers.image.ref.name": $tag}}]' "${IMAGE}/index.json" > "$UMOCI_TMPDIR/index.json"
+	mv "$UMOCI_TMPDIR/index.json" "${IMAGE}/index.json"
+}
+
+@test "umoci verify [missing arguments]" {
+	# Missing --image argument.
+	umoci verify --key "$UMOCI_TMPDIR/cosign.pub"
+	[ "$status" -ne 0 ]
+
+	# Missing --key argument.
+	umoci verify --image "${IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+
+	# Too many positional arguments.
+	umoci verify --image "${IMAGE}:${TAG}" --key "$UMOCI_TMPDIR/cosign.pub" this-is-an-invalid-argument
+	[ "$status" -ne 0 ]
+
+	# Invalid key.
+	echo "not a key" > "$UMOCI_TMPDIR/invalid.pub"
+	umoci verify --image "${IMAGE}:${TAG}" --key "$UMOCI_TMPDIR/invalid.pub"
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci verify" {
+	# The test image is not signed.
+	umoci verify --image "${IMAGE}:${TAG}" --key "$UMOCI_TMPDIR/cosign.pub"
+	[ "$status" -ne 0 ]
+	[[ "$output" == *"no signatures found"* ]]
+
+	digest="$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}"'") | .digest' "${IMAGE}/index.json")"
+	sign_image "$digest" "$UMOCI_TMPDIR/cosign.key"
+	umoci fsck --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+
+	umoci verify --image "${IMAGE}:${TAG}" --key "$UMOCI_TMPDIR/cosign.pub"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"valid signature of $digest"* ]]
+
+	umoci verify --image "${IMAGE}:${TAG}" --key "$UMOCI_TMPDIR/cosign.pub" --json
+	[ "$status" -eq 0 ]
+	[ "$(jq -r '.[0].valid' <<<"$output")" == "true" ]
+	[ "$(jq -r '.[0].image' <<<"$output")" == "$digest" ]
+
+	# The signature is not valid for a different key.
+	openssl ecparam -genkey -name prime256v1 -noout -out "$UMOCI_TMPDIR/other.key"
+	openssl ec -in "$UMOCI_TMPDIR/other.key" -pubout -out "$UMOCI_TMPDIR/other.pub"
+	umoci verify --image "${IMAGE}:${TAG}" --key "$UMOCI_TMPDIR/other.pub"
+	[ "$status" -ne 0 ]
+	[[ "$output" == *"invalid signature of $digest"* ]]
+	[[ "$output" == *"no valid signatures found"* ]]
+
+	# Modifying the image invalidates the signature (the signature manifest is
+	# tagged for the old digest).
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	touch "$ROOTFS/new-file"
+	umoci repack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	umoci verify --image "${IMAGE}:${TAG}" --key "$UMOCI_TMPDIR/cosign.pub"
+	[ "$status" -ne 0 ]
+	[[ "$output" == *"no signatures found"* ]]
+}
@@ -20,8 +20,9 @@ package umoci
 import (
 	"context"
 	"fmt"
+	"io"
 	"os"
-	"strings"
+	"path/filepath"
 
 	"github.com/apex/log"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
@@ -29,27 +30,75 @@ import (
 	"github.com/opencontainers/umoci/oci/layer"
 	"github.com/opencontainers/umoci/pkg/fseval"
 	"github.com/pkg/errors"
+	"github.com/vbatts/go-mtree"
 )
 
-// Unpack unpacks an image to the specified bundle path.
-func Unpack(engineExt casext.Engine, fromName string, bundlePath string, unpackOptions layer.UnpackOptions) error {
+// BundleOptions describes how the mtree manifest of a bundle is generated.
+type BundleOptions struct {
+	// MtreeKeywords is the set of keywords to record in the mtree manifest.
+	// If empty, MtreeKeywords is used.
+	MtreeKeywords []mtree.Keyword
+
+	// MtreePath is the path the mtree manifest is written to. Relative paths
+	// are relative to the bundle. If empty, the manifest is written to the
+	// bundle and named after the digest of the image manifest.
+	MtreePath string
+
+	// NoMtree disables generation of both the mtree manifest and the umoci
+	// metadata of the bundle, leaving just the runtime bundle. This is useful
+	// for one-shot extraction of an image, but bundles unpacked this way cannot
+	// be repacked or refreshed.
+	NoMtree bool
+
+	// FileManifestPath, if set, is the path a FileManifest describing every
+	// path changed in the root filesystem of the bundle is written to.
+	// Relative paths are relative to the current directory. This is not
+	// supported for overlay bundles.
+	FileManifestPath string
+
+	// RootfsOnly extracts the layers directly into the bundle path (rather
+	// than a rootfs/ subdirectory of it), without generating a config.json,
+	// the mtree manifest or the umoci metadata. The result is just the root
+	// filesystem of the image, which cannot be repacked or refreshed. This
+	// is not supported for overlay bundles.
+	RootfsOnly bool
+}
+
+// Unpack unpacks an image to the specified bundle path. If fromName refers to a
+// multi-platform image, platform is used to select which image is unpacked.
+func Unpack(engineExt casext.Engine, fromName string, bundlePath string, unpackOptions layer.UnpackOptions, platform *ispec.Platform) error {
+	return UnpackBundle(engineExt, fromName, bundlePath, unpackOptions, platform, BundleOptions{})
+}
+
+// UnpackBundle is Unpack but with additional options controlling how the mtree
+// manifest of the bundle is generated. The options are stored in the bundle
+// metadata, so that Repack uses the same manifest and keywords.
+func UnpackBundle(engineExt casext.Engine, fromName string, bundlePath string, unpackOptions layer.UnpackOptions, platform *ispec.Platform, bundleOptions BundleOptions) error {
+	return unpack(engineExt, fromName, bundlePath, unpackOptions, platform, bundleOptions, false)
+}
+
+// UnpackOverlay unpacks an image to the specified bundle path, with each layer
+// extracted to a separate overlayfs lower directory (see
+// layer.UnpackManifestOverlay). Bundles unpacked this way cannot be repacked.
+func UnpackOverlay(engineExt casext.Engine, fromName string, bundlePath string, unpackOptions layer.UnpackOptions, platform *ispec.Platform) error {
+	unpackOptions.WhiteoutMode = layer.OverlayFSWhiteout
+	return unpack(engineExt, fromName, bundlePath, unpackOptions, platform, BundleOptions{}, true)
+}
+
+func unpack(engineExt casext.Engine, fromName string, bundlePath string, unpackOptions layer.UnpackOptions, platform *ispec.Platform, bundleOptions BundleOptions, overlay bool) error {
 	var meta Meta
 	meta.Version = MetaVersion
+	meta.MtreeKeywords = bundleOptions.MtreeKeywords
+	meta.MtreePath = bundleOptions.MtreePath
 	meta.MapOptions = unpackOptions.MapOptions
 	meta.WhiteoutMode = unpackOptions.WhiteoutMode
+	meta.Overlay = overlay
 
-	fromDescriptorPaths, err := engineExt.ResolveReference(context.Background(), fromName)
+	fromDescriptorPath, err := ResolveReference(context.Background(), engineExt, fromName, platform)
 	if err != nil {
-		return errors.Wrap(err, "get descriptor")
-	}
-	if len(fromDescriptorPaths) == 0 {
-		return errors.Errorf("tag is not found: %s", fromName)
+		return err
 	}
-	if len(fromDescriptorPaths) != 1 {
-		// TODO: Handle this more nicely.
-		return errors.Errorf("tag is ambiguous: %s", fromName)
-	}
-	meta.From = fromDescriptorPaths[0]
+	meta.From = fromDescriptorPath
 
 	manifestBlob, err := engineExt.FromDescriptor(context.Background(), meta.From.Descriptor())
 	if err != nil {
@@ -61,7 +110,6 @@ func Unpack(engineExt casext.Engine, fromName string, bundlePath string, unpackO
 		return errors.Wrap(fmt.Errorf("descriptor does not point to ispec.MediaTypeImageManifest: not implemented: %s", manifestBlob.Descriptor.MediaType), "invalid --image tag")
 	}
 
-	mtreeName := strings.Replace(meta.From.Descriptor().Digest.String(), ":", "_", 1)
 	log.WithFields(log.Fields{
 		"bundle": bundlePath,
 		"ref":    fromName,
@@ -75,25 +123,83 @@ func Unpack(engineExt casext.Engine, fromName string, bundlePath string, unpackO
 		return errors.Errorf("[internal error] unknown manifest blob type: %s", manifestBlob.Descriptor.MediaType)
 	}
 
+	// With RootfsOnly the layers are extracted directly into bundlePath, so
+	// (like UnpackManifest does for the rootfs) we refuse to extract over
+	// existing files -- otherwise they would be removed if unpacking fails.
+	if bundleOptions.RootfsOnly {
+		if err := checkEmptyDir(bundlePath); err != nil {
+			return err
+		}
+	}
+
 	// Unpack the runtime bundle.
 	if err := os.MkdirAll(bundlePath, 0755); err != nil {
 		return errors.Wrap(err, "create bundle path")
 	}
 	// XXX: We should probably defer os.RemoveAll(bundlePath).
 
+	fsEval := fseval.Default
+	if meta.MapOptions.Rootless {
+		fsEval = fseval.Rootless
+	}
+	// Generating the mtree manifest requires reading every file, which must
+	// not clobber the access times restored while unpacking.
+	fsEval = fseval.NoAtime(fsEval)
+
+	rootfsPath := filepath.Join(bundlePath, layer.RootfsName)
+	if bundleOptions.RootfsOnly {
+		if overlay {
+			return errors.Errorf("rootfs-only unpacking is not supported for overlay bundles")
+		}
+		rootfsPath = bundlePath
+	}
+
+	var recorder *fileManifestRecorder
+	if bundleOptions.FileManifestPath != "" {
+		if overlay {
+			return errors.Errorf("file manifests are not supported for overlay bundles")
+		}
+		recorder = newFileManifestRecorder()
+		unpackOptions.OnPathChange = recorder.onPathChange
+	}
+
 	log.Info("unpacking bundle ...")
-	if err := layer.UnpackManifest(context.Background(), engineExt, bundlePath, manifest, &unpackOptions); err != nil {
-		return errors.Wrap(err, "create runtime bundle")
+	if bundleOptions.RootfsOnly {
+		if err := layer.UnpackRootfs(context.Background(), engineExt, rootfsPath, manifest, &unpackOptions); err != nil {
+			return errors.Wrap(err, "create rootfs")
+		}
+	} else if overlay {
+		if err := layer.UnpackManifestOverlay(context.Background(), engineExt, bundlePath, manifest, &unpackOptions); err != nil {
+			return errors.Wrap(err, "create overlay runtime bundle")
+		}
+	} else {
+		if err := layer.UnpackManifest(context.Background(), engineExt, bundlePath, manifest, &unpackOptions); err != nil {
+			return errors.Wrap(err, "create runtime bundle")
+		}
 	}
 	log.Info("... done")
 
-	fsEval := fseval.Default
-	if meta.MapOptions.Rootless {
-		fsEval = fseval.Rootless
+	if recorder != nil {
+		if err := recorder.writeFileManifest(bundleOptions.FileManifestPath, rootfsPath, fsEval); err != nil {
+			return errors.Wrap(err, "write file manifest")
+		}
+	}
+
+	if bundleOptions.RootfsOnly {
+		log.Infof("unpacked image rootfs: %s", rootfsPath)
+		return nil
+	}
+	if bundleOptions.NoMtree {
+		log.Infof("unpacked image bundle (without metadata): %s", bundlePath)
+		return nil
 	}
 
-	if err := GenerateBundleManifest(mtreeName, bundlePath, fsEval); err != nil {
-		return errors.Wrap(err, "write mtree")
+	// Overlay bundles have no single rootfs to generate an mtree manifest
+	// for (and cannot be repacked anyway).
+	if !overlay {
+		if err := generateBundleManifest(meta.mtreePath(bundlePath), bundlePath, meta.mtreeKeywords(), fsEval); err != nil {
+			return errors.Wrap(err, "write mtree")
+		}
 	}
 
 	log.WithFields(log.Fields{
@@ -109,3 +215,29 @@ func Unpack(engineExt casext.Engine, fromName string, bundlePath string, unpackO
 	log.Infof("unpacked image bundle: %s", bundlePath)
 	return nil
 }
+
+// checkEmptyDir returns an error if path exists and is not an empty
+// directory.
+func checkEmptyDir(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "check rootfs path")
+	}
+	if !fi.IsDir() {
+		return errors.Errorf("%s already exists and is not a directory", path)
+	}
+	dir, err := os.Open(path)
+	if err != nil {
+		return errors.Wrap(err, "check rootfs path")
+	}
+	defer dir.Close()
+	if _, err := dir.Readdirnames(1); err != io.EOF {
+		if err == nil {
+			return errors.Errorf("%s already exists and is not empty", path)
+		}
+		return errors.Wrap(err, "check rootfs path")
+	}
+	return nil
+}
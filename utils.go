@@ -24,14 +24,19 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"os/user"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"text/tabwriter"
+	"time"
 
 	"github.com/apex/log"
 	"github.com/docker/go-units"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/opencontainers/umoci/oci/casext/mediatype"
 	igen "github.com/opencontainers/umoci/oci/config/generate"
 	"github.com/opencontainers/umoci/oci/layer"
 	"github.com/opencontainers/umoci/pkg/idtools"
@@ -62,6 +67,108 @@ var MtreeKeywords = []mtree.Keyword{
 	"xattr",
 }
 
+// ParseMtreeKeywords parses a comma-separated list of mtree keywords. If every
+// keyword in the list has a "+" or "-" prefix, the keywords are added to (or
+// removed from) MtreeKeywords. Otherwise, the list is the complete set of
+// keywords to use. Keywords are converted to their canonical names (so
+// "sha256" is equivalent to "sha256digest"), and unknown keywords result in an
+// error.
+func ParseMtreeKeywords(list string) ([]mtree.Keyword, error) {
+	var names []string
+	for _, name := range strings.Split(list, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil, errors.New("no mtree keywords specified")
+	}
+
+	var modify int
+	for _, name := range names {
+		if strings.HasPrefix(name, "+") || strings.HasPrefix(name, "-") {
+			modify++
+		}
+	}
+	if modify != 0 && modify != len(names) {
+		return nil, errors.New("mtree keywords must either all be modifications (+keyword or -keyword) or none of them")
+	}
+
+	var keywords []mtree.Keyword
+	if modify != 0 {
+		keywords = append(keywords, MtreeKeywords...)
+	}
+	for _, name := range names {
+		op := byte(0)
+		if modify != 0 {
+			op, name = name[0], name[1:]
+		}
+		keyword := mtree.KeywordSynonym(name)
+		if _, ok := mtree.KeywordFuncs[keyword]; !ok {
+			return nil, errors.Errorf("unknown mtree keyword %q", name)
+		}
+		if op == '-' {
+			var newKeywords []mtree.Keyword
+			for _, kw := range keywords {
+				if kw != keyword {
+					newKeywords = append(newKeywords, kw)
+				}
+			}
+			keywords = newKeywords
+		} else if !mtree.InKeywordSlice(keyword, keywords) {
+			keywords = append(keywords, keyword)
+		}
+	}
+	if len(keywords) == 0 {
+		return nil, errors.New("no mtree keywords left after removing keywords")
+	}
+	return keywords, nil
+}
+
+// checkMtreeKeywords verifies that the given mtree manifest was generated with
+// the expected set of keywords. The manifest header generated by umoci (and
+// gomtree) lists the keywords used, which must match the expected set
+// exactly. Manifests without such a header are not checked, because the
+// keywords used by the entries (which always include "/set" defaults like uid
+// and gid) are not necessarily the keywords the manifest was generated with.
+func checkMtreeKeywords(spec *mtree.DirectoryHierarchy, expected []mtree.Keyword) error {
+	for _, entry := range spec.Entries {
+		if entry.Type != mtree.CommentType {
+			continue
+		}
+		line := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(entry.Raw), "#"))
+		if !strings.HasPrefix(line, "keywords:") {
+			continue
+		}
+		var used []mtree.Keyword
+		for _, name := range strings.Split(strings.TrimPrefix(line, "keywords:"), ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				used = append(used, mtree.KeywordSynonym(name))
+			}
+		}
+		if !sameKeywords(used, expected) {
+			return errors.Errorf("manifest was generated with keywords %v but the bundle expects keywords %v", used, expected)
+		}
+	}
+	return nil
+}
+
+// sameKeywords returns whether the two sets of keywords are the same
+// (ignoring order).
+func sameKeywords(a, b []mtree.Keyword) bool {
+	for _, kw := range a {
+		if !mtree.InKeywordSlice(kw, b) {
+			return false
+		}
+	}
+	for _, kw := range b {
+		if !mtree.InKeywordSlice(kw, a) {
+			return false
+		}
+	}
+	return true
+}
+
 // MetaName is the name of umoci's metadata file that is stored in all
 // bundles extracted by umoci.
 const MetaName = "umoci.json"
@@ -93,6 +200,43 @@ type Meta struct {
 	// WhiteoutMode indicates what style of whiteout was written to disk
 	// when this filesystem was extracted.
 	WhiteoutMode layer.WhiteoutMode `json:"whiteout_mode"`
+
+	// Overlay indicates that each layer was extracted to a separate
+	// overlayfs lower directory (with umoci-unpack(1)'s --overlay), rather
+	// than being extracted to a single rootfs.
+	Overlay bool `json:"overlay,omitempty"`
+
+	// MtreeKeywords is the set of keywords recorded in the mtree manifest of
+	// the bundle (with umoci-unpack(1)'s --mtree-keywords). If empty, the
+	// default MtreeKeywords were used.
+	MtreeKeywords []mtree.Keyword `json:"mtree_keywords,omitempty"`
+
+	// MtreePath is the path of the mtree manifest of the bundle (with
+	// umoci-unpack(1)'s --mtree-output). Relative paths are relative to the
+	// bundle. If empty, the manifest is stored in the bundle and named after
+	// the digest of the image manifest.
+	MtreePath string `json:"mtree_path,omitempty"`
+}
+
+// mtreeKeywords returns the set of keywords used for the mtree manifest of
+// the bundle.
+func (m Meta) mtreeKeywords() []mtree.Keyword {
+	if len(m.MtreeKeywords) == 0 {
+		return MtreeKeywords
+	}
+	return m.MtreeKeywords
+}
+
+// mtreePath returns the path of the mtree manifest of the given bundle.
+func (m Meta) mtreePath(bundlePath string) string {
+	if m.MtreePath == "" {
+		mtreeName := strings.Replace(m.From.Descriptor().Digest.String(), ":", "_", 1)
+		return filepath.Join(bundlePath, mtreeName+".mtree")
+	}
+	if filepath.IsAbs(m.MtreePath) {
+		return m.MtreePath
+	}
+	return filepath.Join(bundlePath, m.MtreePath)
 }
 
 // WriteTo writes a JSON-serialised version of Meta to the given io.Writer.
@@ -119,6 +263,9 @@ func ReadBundleMeta(bundle string) (Meta, error) {
 	var meta Meta
 
 	fh, err := os.Open(filepath.Join(bundle, MetaName))
+	if os.IsNotExist(err) {
+		return meta, errors.Wrapf(err, "open metadata: %s is not an umoci bundle (or was unpacked without metadata)", bundle)
+	}
 	if err != nil {
 		return meta, errors.Wrap(err, "open metadata")
 	}
@@ -133,6 +280,12 @@ func ReadBundleMeta(bundle string) (Meta, error) {
 	return meta, errors.Wrap(err, "decode metadata")
 }
 
+// StatSchemaVersion is the version of the JSON representation of
+// ManifestStat. It is incremented whenever a backwards-incompatible change is
+// made to the representation (new fields may be added without changing the
+// version).
+const StatSchemaVersion = 1
+
 // ManifestStat has information about a given OCI manifest.
 // TODO: Implement support for manifest lists, this should also be able to
 //
@@ -142,8 +295,26 @@ type ManifestStat struct {
 	//       equivalent of docker-history(1). We really need to add more
 	//       information about it.
 
+	// SchemaVersion is the version of the JSON representation of the stat
+	// information, and is always StatSchemaVersion.
+	SchemaVersion int `json:"schema_version"`
+
+	// Manifest is the descriptor of the manifest.
+	Manifest ispec.Descriptor `json:"manifest"`
+
+	// Config is the descriptor of the image configuration.
+	Config ispec.Descriptor `json:"config"`
+
+	// Size is the total size of the image, which is the sum of the sizes of
+	// the manifest, the configuration and every layer blob.
+	Size int64 `json:"size"`
+
 	// History stores the history information for the manifest.
 	History []historyStat `json:"history"`
+
+	// uncompressed is whether the uncompressed layer sizes were requested,
+	// in which case Format includes them in the output.
+	uncompressed bool
 }
 
 // Format formats a ManifestStat using the default formatting, and writes the
@@ -155,23 +326,40 @@ type ManifestStat struct {
 func (ms ManifestStat) Format(w io.Writer) error {
 	// Output history information.
 	tw := tabwriter.NewWriter(w, 4, 2, 1, ' ', 0)
-	fmt.Fprintf(tw, "LAYER\tCREATED\tCREATED BY\tSIZE\tCOMMENT\n")
+	if ms.uncompressed {
+		fmt.Fprintf(tw, "LAYER\tCREATED\tCREATED BY\tSIZE\tUNCOMPRESSED\tTOTAL\tCOMMENT\n")
+	} else {
+		fmt.Fprintf(tw, "LAYER\tCREATED\tCREATED BY\tSIZE\tTOTAL\tCOMMENT\n")
+	}
 	for _, histEntry := range ms.History {
 		var (
-			created   = strings.Replace(histEntry.Created.Format(igen.ISO8601), "\t", " ", -1)
-			createdBy = strings.Replace(histEntry.CreatedBy, "\t", " ", -1)
-			comment   = strings.Replace(histEntry.Comment, "\t", " ", -1)
-			layerID   = "<none>"
-			size      = "<none>"
+			created          = "<none>"
+			createdBy        = strings.Replace(histEntry.CreatedBy, "\t", " ", -1)
+			comment          = strings.Replace(histEntry.Comment, "\t", " ", -1)
+			layerID          = "<none>"
+			size             = "<none>"
+			uncompressedSize = "<none>"
+			total            = units.HumanSize(float64(histEntry.CumulativeSize))
 		)
 
+		if histEntry.Created != nil {
+			created = strings.Replace(histEntry.Created.Format(igen.ISO8601), "\t", " ", -1)
+		}
 		if !histEntry.EmptyLayer {
 			layerID = histEntry.Layer.Digest.String()
 			size = units.HumanSize(float64(histEntry.Layer.Size))
+			uncompressedSize = "<unknown>"
+		}
+		if histEntry.UncompressedSize != nil {
+			uncompressedSize = units.HumanSize(float64(*histEntry.UncompressedSize))
 		}
 
 		// TODO: We need to truncate some of the fields.
-		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", layerID, created, createdBy, size, comment)
+		if ms.uncompressed {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", layerID, created, createdBy, size, uncompressedSize, total, comment)
+		} else {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", layerID, created, createdBy, size, total, comment)
+		}
 	}
 	return tw.Flush()
 }
@@ -190,14 +378,57 @@ type historyStat struct {
 	// is "", then this entry is an empty_layer.
 	DiffID string `json:"diff_id"`
 
+	// CumulativeSize is the total (compressed) size of Layer and all of the
+	// layers before it in the image.
+	CumulativeSize int64 `json:"cumulative_size"`
+
+	// UncompressedSize is the size of the uncompressed layer (the size of the
+	// blob referenced by DiffID). It is nil if the size is unknown, which is
+	// the case for empty_layers and for compressed layers unless the
+	// uncompressed sizes were requested from Stat.
+	UncompressedSize *int64 `json:"uncompressed_size"`
+
 	// History is embedded in the stat information.
 	ispec.History
 }
 
+// MarshalJSON encodes the history entry, as documented in umoci-stat(1).
+// Unlike ispec.History, every field is always included (even if it is empty)
+// so that users can rely on the structure of the output.
+func (hs historyStat) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Layer            *ispec.Descriptor `json:"layer"`
+		DiffID           string            `json:"diff_id"`
+		CumulativeSize   int64             `json:"cumulative_size"`
+		UncompressedSize *int64            `json:"uncompressed_size"`
+		Created          *time.Time        `json:"created"`
+		CreatedBy        string            `json:"created_by"`
+		Author           string            `json:"author"`
+		Comment          string            `json:"comment"`
+		EmptyLayer       bool              `json:"empty_layer"`
+	}{
+		Layer:            hs.Layer,
+		DiffID:           hs.DiffID,
+		CumulativeSize:   hs.CumulativeSize,
+		UncompressedSize: hs.UncompressedSize,
+		Created:          hs.Created,
+		CreatedBy:        hs.CreatedBy,
+		Author:           hs.Author,
+		Comment:          hs.Comment,
+		EmptyLayer:       hs.EmptyLayer,
+	})
+}
+
 // Stat computes the ManifestStat for a given manifest blob. The provided
-// descriptor must refer to an OCI Manifest.
-func Stat(ctx context.Context, engine casext.Engine, manifestDescriptor ispec.Descriptor) (ManifestStat, error) {
-	var stat ManifestStat
+// descriptor must refer to an OCI Manifest. If uncompressed is set, every
+// compressed layer is decompressed in order to compute its uncompressed size
+// (which can be quite expensive).
+func Stat(ctx context.Context, engine casext.Engine, manifestDescriptor ispec.Descriptor, uncompressed bool) (ManifestStat, error) {
+	stat := ManifestStat{
+		SchemaVersion: StatSchemaVersion,
+		History:       []historyStat{},
+		uncompressed:  uncompressed,
+	}
 
 	if manifestDescriptor.MediaType != ispec.MediaTypeImageManifest {
 		return stat, errors.Errorf("stat: cannot stat a non-manifest descriptor: invalid media type '%s'", manifestDescriptor.MediaType)
@@ -225,12 +456,20 @@ func Stat(ctx context.Context, engine casext.Engine, manifestDescriptor ispec.De
 		return stat, errors.Errorf("[internal error] unknown config blob type: %s", configBlob.Descriptor.MediaType)
 	}
 
+	stat.Manifest = manifestDescriptor
+	stat.Config = manifest.Config
+	stat.Size = manifestDescriptor.Size + manifest.Config.Size
+	for _, layer := range manifest.Layers {
+		stat.Size += layer.Size
+	}
+
 	// TODO: This should probably be moved into separate functions.
 
 	// Generate the history of the image. Because the config.History entries
 	// are in the same order as the manifest.Layer entries this is fairly
 	// simple. However, we only increment the layer index if a layer was
 	// actually generated by a history entry.
+	var cumulativeSize int64
 	layerIdx := 0
 	for _, histEntry := range config.History {
 		info := historyStat{
@@ -242,10 +481,20 @@ func Stat(ctx context.Context, engine casext.Engine, manifestDescriptor ispec.De
 		// Only fill the other information and increment layerIdx if it's a
 		// non-empty layer.
 		if !histEntry.EmptyLayer {
+			if layerIdx >= len(manifest.Layers) || layerIdx >= len(config.RootFS.DiffIDs) {
+				return stat, errors.Errorf("stat: image has more non-empty history entries than layers")
+			}
 			info.DiffID = config.RootFS.DiffIDs[layerIdx].String()
 			info.Layer = &manifest.Layers[layerIdx]
+			cumulativeSize += info.Layer.Size
+			size, err := layerUncompressedSize(ctx, engine, *info.Layer, uncompressed)
+			if err != nil {
+				return stat, errors.Wrapf(err, "stat: get uncompressed size of layer %s", info.Layer.Digest)
+			}
+			info.UncompressedSize = size
 			layerIdx++
 		}
+		info.CumulativeSize = cumulativeSize
 
 		stat.History = append(stat.History, info)
 	}
@@ -253,19 +502,56 @@ func Stat(ctx context.Context, engine casext.Engine, manifestDescriptor ispec.De
 	return stat, nil
 }
 
+// layerUncompressedSize returns the uncompressed size of the given layer. The
+// size of uncompressed layers is always known, but compressed layers are only
+// decompressed (to compute their uncompressed size) if decompress is set --
+// otherwise nil is returned.
+func layerUncompressedSize(ctx context.Context, engine casext.Engine, descriptor ispec.Descriptor, decompress bool) (*int64, error) {
+	switch descriptor.MediaType {
+	case ispec.MediaTypeImageLayer, ispec.MediaTypeImageLayerNonDistributable:
+		size := descriptor.Size
+		return &size, nil
+	}
+	if !decompress {
+		return nil, nil
+	}
+	blob, err := engine.GetVerifiedBlob(ctx, descriptor)
+	if err != nil {
+		// Non-distributable layers are usually not included in the image,
+		// in which case the size is unknown.
+		if casext.IsNotExist(err) && mediatype.IsNonDistributable(descriptor.MediaType) {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "get layer blob")
+	}
+	defer blob.Close()
+
+	size, err := layer.UncompressedSize(descriptor.MediaType, blob)
+	if err != nil {
+		return nil, err
+	}
+	return &size, nil
+}
+
 // GenerateBundleManifest creates and writes an mtree of the rootfs in the given
 // bundle path, using the supplied fsEval method
 func GenerateBundleManifest(mtreeName string, bundlePath string, fsEval mtree.FsEval) error {
 	mtreePath := filepath.Join(bundlePath, mtreeName+".mtree")
+	return generateBundleManifest(mtreePath, bundlePath, MtreeKeywords, fsEval)
+}
+
+// generateBundleManifest is GenerateBundleManifest but with an explicit
+// manifest path and set of keywords.
+func generateBundleManifest(mtreePath string, bundlePath string, keywords []mtree.Keyword, fsEval mtree.FsEval) error {
 	fullRootfsPath := filepath.Join(bundlePath, layer.RootfsName)
 
 	log.WithFields(log.Fields{
-		"keywords": MtreeKeywords,
+		"keywords": keywords,
 		"mtree":    mtreePath,
 	}).Debugf("umoci: generating mtree manifest")
 
 	log.Info("computing filesystem manifest ...")
-	dh, err := mtree.Walk(fullRootfsPath, nil, MtreeKeywords, fsEval)
+	dh, err := mtree.Walk(fullRootfsPath, nil, keywords, fsEval)
 	if err != nil {
 		return errors.Wrap(err, "generate mtree spec")
 	}
@@ -287,12 +573,53 @@ func GenerateBundleManifest(mtreeName string, bundlePath string, fsEval mtree.Fs
 	return nil
 }
 
+// subIDMappings returns the UID and GID mappings for the current user based on
+// their allocations in /etc/subuid and /etc/subgid, with container root being
+// mapped to the current user.
+func subIDMappings() ([]rspec.LinuxIDMapping, []rspec.LinuxIDMapping, error) {
+	uid, gid := os.Geteuid(), os.Getegid()
+
+	// Users can be listed by name or UID, but we might not have a name if the
+	// user isn't in /etc/passwd.
+	var name string
+	if u, err := user.LookupId(strconv.Itoa(uid)); err == nil {
+		name = u.Username
+	} else {
+		log.Debugf("subid-auto: could not find name of user %d: %v", uid, err)
+	}
+
+	uidMap, err := idtools.SubIDMappingsFromFile(idtools.SubUIDPath, name, uid, uid)
+	if err != nil {
+		return nil, nil, err
+	}
+	gidMap, err := idtools.SubIDMappingsFromFile(idtools.SubGIDPath, name, uid, gid)
+	if err != nil {
+		return nil, nil, err
+	}
+	return uidMap, gidMap, nil
+}
+
 // ParseIdmapOptions sets up the mapping options for Meta, using
-// the arguments specified on the command line
+// the arguments specified on the command line. The --on-unmapped policy (and
+// the --nobody-uid and --nobody-gid used by --on-unmapped=nobody) applies to
+// the final mappings, including those generated by --rootless and
+// --subid-auto. Note that in rootless mode every owner is stored in the
+// "user.rootlesscontainers" xattr instead of being mapped (and unmappable
+// POSIX ACLs are always dropped), so the policy has no effect.
 func ParseIdmapOptions(meta *Meta, ctx *cli.Context) error {
 	// We need to set mappings if we're in rootless mode.
 	meta.MapOptions.Rootless = ctx.Bool("rootless")
-	if meta.MapOptions.Rootless {
+	if ctx.Bool("subid-auto") {
+		if ctx.IsSet("uid-map") || ctx.IsSet("gid-map") {
+			return errors.New("--subid-auto cannot be used with --uid-map or --gid-map")
+		}
+		uidMap, gidMap, err := subIDMappings()
+		if err != nil {
+			return errors.Wrap(err, "--subid-auto")
+		}
+		meta.MapOptions.UIDMappings = uidMap
+		meta.MapOptions.GIDMappings = gidMap
+	} else if meta.MapOptions.Rootless {
 		if !ctx.IsSet("uid-map") {
 			if err := ctx.Set("uid-map", fmt.Sprintf("0:%d:1", os.Geteuid())); err != nil {
 				// Should _never_ be reached.
@@ -322,10 +649,77 @@ func ParseIdmapOptions(meta *Meta, ctx *cli.Context) error {
 		meta.MapOptions.GIDMappings = append(meta.MapOptions.GIDMappings, idMap)
 	}
 
+	policy, err := layer.ParseUnmappedPolicy(ctx.String("on-unmapped"))
+	if err != nil {
+		return errors.Wrap(err, "invalid --on-unmapped")
+	}
+	meta.MapOptions.OnUnmapped = policy
+	if policy == layer.UnmappedNobody {
+		for _, flag := range []string{"nobody-uid", "nobody-gid"} {
+			if ctx.Int(flag) <= 0 {
+				return errors.Errorf("invalid --%s %d: must be a positive (non-root) id", flag, ctx.Int(flag))
+			}
+		}
+		meta.MapOptions.NobodyUID = ctx.Int("nobody-uid")
+		meta.MapOptions.NobodyGID = ctx.Int("nobody-gid")
+	} else if ctx.IsSet("nobody-uid") || ctx.IsSet("nobody-gid") {
+		return errors.New("--nobody-uid and --nobody-gid can only be used with --on-unmapped=nobody")
+	}
+
 	log.WithFields(log.Fields{
-		"map.uid": meta.MapOptions.UIDMappings,
-		"map.gid": meta.MapOptions.GIDMappings,
+		"map.uid":      meta.MapOptions.UIDMappings,
+		"map.gid":      meta.MapOptions.GIDMappings,
+		"map.unmapped": meta.MapOptions.OnUnmapped,
 	}).Debugf("parsed mappings")
 
 	return nil
 }
+
+// ResolveReference resolves the given reference name to a single descriptor
+// path. If the reference refers to an index with several images (such as a
+// multi-platform image) then platform is used to select the image for a given
+// platform. An error is returned if the reference does not resolve to
+// exactly one descriptor path, which includes the list of available
+// platforms if the reference is ambiguous.
+func ResolveReference(ctx context.Context, engineExt casext.Engine, refname string, platform *ispec.Platform) (casext.DescriptorPath, error) {
+	descriptorPaths, err := engineExt.ResolveReference(ctx, refname)
+	if err != nil {
+		return casext.DescriptorPath{}, errors.Wrap(err, "get descriptor")
+	}
+	if len(descriptorPaths) == 0 {
+		return casext.DescriptorPath{}, errors.Wrap(casext.ErrReferenceNotFound, refname)
+	}
+
+	allPaths := descriptorPaths
+	if platform != nil {
+		descriptorPaths, err = engineExt.FilterPlatform(ctx, descriptorPaths, *platform)
+		if err != nil {
+			return casext.DescriptorPath{}, errors.Wrap(err, "filter platform")
+		}
+	}
+	if len(descriptorPaths) == 1 {
+		return descriptorPaths[0], nil
+	}
+
+	// Give the user a hint about which platforms they can choose from.
+	var platforms []string
+	for _, descriptorPath := range allPaths {
+		descPlatform, err := engineExt.DescriptorPlatform(ctx, descriptorPath)
+		if err != nil {
+			return casext.DescriptorPath{}, errors.Wrapf(err, "get platform of %s", descriptorPath.Descriptor().Digest)
+		}
+		if descPlatform != nil {
+			platforms = append(platforms, casext.FormatPlatform(*descPlatform))
+		}
+	}
+	available := "unknown"
+	if len(platforms) > 0 {
+		available = strings.Join(platforms, ", ")
+	}
+
+	if len(descriptorPaths) == 0 {
+		return casext.DescriptorPath{}, errors.Wrapf(casext.ErrReferenceNotFound, "%s has no image for platform %s (available platforms: %s)", refname, casext.FormatPlatform(*platform), available)
+	}
+	// TODO: Handle this more nicely.
+	return casext.DescriptorPath{}, errors.Wrapf(casext.ErrAmbiguousReference, "%s (available platforms: %s)", refname, available)
+}
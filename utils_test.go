@@ -0,0 +1,368 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2020 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	imeta "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/cas/dir"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/vbatts/go-mtree"
+)
+
+func TestStatJSON(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestStatJSON")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	layerData := []byte("not really a layer")
+	layerDigest, layerSize, err := engineExt.PutBlob(ctx, bytes.NewReader(layerData))
+	if err != nil {
+		t.Fatalf("put layer: %+v", err)
+	}
+
+	created := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	config := ispec.Image{
+		OS:           "linux",
+		Architecture: "amd64",
+		History: []ispec.History{
+			{Created: &created, CreatedBy: "empty", EmptyLayer: true},
+			{Created: &created, CreatedBy: "layer"},
+		},
+	}
+	config.RootFS.Type = "layers"
+	config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, layerDigest)
+	configDigest, configSize, err := engineExt.PutBlobJSON(ctx, config)
+	if err != nil {
+		t.Fatalf("put config: %+v", err)
+	}
+
+	manifest := ispec.Manifest{
+		Versioned: imeta.Versioned{SchemaVersion: 2},
+		MediaType: ispec.MediaTypeImageManifest,
+		Config: ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageConfig,
+			Digest:    configDigest,
+			Size:      configSize,
+		},
+		Layers: []ispec.Descriptor{{
+			MediaType: ispec.MediaTypeImageLayer,
+			Digest:    layerDigest,
+			Size:      layerSize,
+		}},
+	}
+	manifestDigest, manifestSize, err := engineExt.PutBlobJSON(ctx, manifest)
+	if err != nil {
+		t.Fatalf("put manifest: %+v", err)
+	}
+	manifestDescriptor := ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    manifestDigest,
+		Size:      manifestSize,
+	}
+
+	ms, err := Stat(ctx, engineExt, manifestDescriptor, false)
+	if err != nil {
+		t.Fatalf("unexpected error in stat: %+v", err)
+	}
+	data, err := json.Marshal(ms)
+	if err != nil {
+		t.Fatalf("unexpected error encoding stat: %+v", err)
+	}
+
+	var got struct {
+		SchemaVersion *int              `json:"schema_version"`
+		Manifest      ispec.Descriptor  `json:"manifest"`
+		Config        ispec.Descriptor  `json:"config"`
+		Size          int64             `json:"size"`
+		History       []json.RawMessage `json:"history"`
+	}
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("unexpected error decoding stat: %+v", err)
+	}
+	if got.SchemaVersion == nil || *got.SchemaVersion != StatSchemaVersion {
+		t.Errorf("unexpected schema_version in %s", data)
+	}
+	if got.Manifest.Digest != manifestDigest || got.Config.Digest != configDigest {
+		t.Errorf("unexpected manifest or config in %s", data)
+	}
+	if expected := manifestSize + configSize + layerSize; got.Size != expected {
+		t.Errorf("unexpected size: expected %d, got %d", expected, got.Size)
+	}
+	if len(got.History) != 2 {
+		t.Fatalf("unexpected number of history entries in %s", data)
+	}
+
+	// Every field must be present in every history entry, even if empty.
+	for idx, entry := range got.History {
+		var fields map[string]interface{}
+		if err := json.Unmarshal(entry, &fields); err != nil {
+			t.Fatalf("unexpected error decoding history entry: %+v", err)
+		}
+		for _, field := range []string{"layer", "diff_id", "cumulative_size", "uncompressed_size", "created", "created_by", "author", "comment", "empty_layer"} {
+			if _, ok := fields[field]; !ok {
+				t.Errorf("history entry %d is missing %q: %s", idx, field, entry)
+			}
+		}
+	}
+
+	var layerEntry struct {
+		Layer      *ispec.Descriptor `json:"layer"`
+		EmptyLayer bool              `json:"empty_layer"`
+	}
+	if err := json.Unmarshal(got.History[1], &layerEntry); err != nil {
+		t.Fatalf("unexpected error decoding history entry: %+v", err)
+	}
+	if layerEntry.EmptyLayer || layerEntry.Layer == nil || layerEntry.Layer.Digest != layerDigest || layerEntry.Layer.Size != layerSize {
+		t.Errorf("unexpected layer history entry: %s", got.History[1])
+	}
+}
+
+func TestStatLayerSizes(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestStatLayerSizes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	// One gzip and one uncompressed layer, with an empty layer in between.
+	rawData := bytes.Repeat([]byte("compressible "), 4096)
+	var gzData bytes.Buffer
+	gzw := gzip.NewWriter(&gzData)
+	if _, err := gzw.Write(rawData); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var layers []ispec.Descriptor
+	for _, layer := range []struct {
+		mediaType string
+		data      []byte
+	}{
+		{ispec.MediaTypeImageLayerGzip, gzData.Bytes()},
+		{ispec.MediaTypeImageLayer, rawData},
+	} {
+		layerDigest, layerSize, err := engineExt.PutBlob(ctx, bytes.NewReader(layer.data))
+		if err != nil {
+			t.Fatalf("put layer: %+v", err)
+		}
+		layers = append(layers, ispec.Descriptor{
+			MediaType: layer.mediaType,
+			Digest:    layerDigest,
+			Size:      layerSize,
+		})
+	}
+
+	config := ispec.Image{
+		OS:           "linux",
+		Architecture: "amd64",
+		History: []ispec.History{
+			{CreatedBy: "gzip"},
+			{CreatedBy: "empty", EmptyLayer: true},
+			{CreatedBy: "uncompressed"},
+		},
+	}
+	config.RootFS.Type = "layers"
+	config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, digest.FromBytes(rawData), digest.FromBytes(rawData))
+	configDigest, configSize, err := engineExt.PutBlobJSON(ctx, config)
+	if err != nil {
+		t.Fatalf("put config: %+v", err)
+	}
+
+	manifestDigest, manifestSize, err := engineExt.PutBlobJSON(ctx, ispec.Manifest{
+		Versioned: imeta.Versioned{SchemaVersion: 2},
+		MediaType: ispec.MediaTypeImageManifest,
+		Config: ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageConfig,
+			Digest:    configDigest,
+			Size:      configSize,
+		},
+		Layers: layers,
+	})
+	if err != nil {
+		t.Fatalf("put manifest: %+v", err)
+	}
+	manifestDescriptor := ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    manifestDigest,
+		Size:      manifestSize,
+	}
+
+	gzSize, rawSize := int64(gzData.Len()), int64(len(rawData))
+	for _, test := range []struct {
+		uncompressed bool
+		expected     []*int64
+	}{
+		{false, []*int64{nil, nil, &rawSize}},
+		{true, []*int64{&rawSize, nil, &rawSize}},
+	} {
+		ms, err := Stat(ctx, engineExt, manifestDescriptor, test.uncompressed)
+		if err != nil {
+			t.Fatalf("unexpected error in stat: %+v", err)
+		}
+		if len(ms.History) != 3 {
+			t.Fatalf("unexpected number of history entries: %d", len(ms.History))
+		}
+
+		cumulative := []int64{gzSize, gzSize, gzSize + rawSize}
+		for idx, entry := range ms.History {
+			if entry.CumulativeSize != cumulative[idx] {
+				t.Errorf("entry %d (uncompressed=%v): expected cumulative size %d, got %d", idx, test.uncompressed, cumulative[idx], entry.CumulativeSize)
+			}
+			expected := test.expected[idx]
+			if (expected == nil) != (entry.UncompressedSize == nil) || (expected != nil && *expected != *entry.UncompressedSize) {
+				t.Errorf("entry %d (uncompressed=%v): unexpected uncompressed size %v", idx, test.uncompressed, entry.UncompressedSize)
+			}
+		}
+
+		var buf bytes.Buffer
+		if err := ms.Format(&buf); err != nil {
+			t.Fatalf("unexpected error formatting stat: %+v", err)
+		}
+		if hasColumn := bytes.Contains(buf.Bytes(), []byte("UNCOMPRESSED")); hasColumn != test.uncompressed {
+			t.Errorf("UNCOMPRESSED column shown=%v with uncompressed=%v:\n%s", hasColumn, test.uncompressed, buf.String())
+		}
+	}
+}
+
+func TestParseMtreeKeywords(t *testing.T) {
+	for _, test := range []struct {
+		list     string
+		expected []mtree.Keyword
+	}{
+		{"size,type,sha256", []mtree.Keyword{"size", "type", "sha256digest"}},
+		{" size , type ,", []mtree.Keyword{"size", "type"}},
+		{"size,size", []mtree.Keyword{"size"}},
+		{"+sha512digest", append(append([]mtree.Keyword{}, MtreeKeywords...), "sha512digest")},
+		{"+size", MtreeKeywords},
+		{"-tar_time,-xattr", []mtree.Keyword{"size", "type", "uid", "gid", "mode", "link", "nlink", "sha256digest"}},
+		{"-time", MtreeKeywords},
+	} {
+		keywords, err := ParseMtreeKeywords(test.list)
+		if err != nil {
+			t.Errorf("unexpected error parsing %q: %+v", test.list, err)
+			continue
+		}
+		if !reflect.DeepEqual(keywords, test.expected) {
+			t.Errorf("unexpected keywords for %q: expected %v, got %v", test.list, test.expected, keywords)
+		}
+	}
+
+	for _, list := range []string{
+		"",
+		",",
+		"nonexistent",
+		"+nonexistent",
+		"+sha512digest,size",
+		"size,-type",
+		"-size,-type,-uid,-gid,-mode,-link,-nlink,-tar_time,-sha256digest,-xattr",
+	} {
+		if keywords, err := ParseMtreeKeywords(list); err == nil {
+			t.Errorf("expected error parsing %q, got %v", list, keywords)
+		}
+	}
+}
+
+func TestCheckMtreeKeywords(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestCheckMtreeKeywords")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	if err := ioutil.WriteFile(filepath.Join(root, "file"), []byte("contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	keywords := []mtree.Keyword{"size", "type", "sha256digest"}
+	dh, err := mtree.Walk(root, nil, keywords, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buffer bytes.Buffer
+	if _, err := dh.WriteTo(&buffer); err != nil {
+		t.Fatal(err)
+	}
+	spec, err := mtree.ParseSpec(&buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range [][]mtree.Keyword{
+		keywords,
+		{"sha256digest", "type", "size"},
+	} {
+		if err := checkMtreeKeywords(spec, expected); err != nil {
+			t.Errorf("unexpected error checking keywords %v: %+v", expected, err)
+		}
+	}
+	for _, expected := range [][]mtree.Keyword{
+		{"size", "type"},
+		{"size", "type", "sha256digest", "sha512digest"},
+		MtreeKeywords,
+	} {
+		if err := checkMtreeKeywords(spec, expected); err == nil {
+			t.Errorf("expected error checking keywords %v", expected)
+		} else if !strings.Contains(err.Error(), "keywords") {
+			t.Errorf("unexpected error checking keywords %v: %+v", expected, err)
+		}
+	}
+}